@@ -0,0 +1,618 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Run a workload against a directory, usually within a gcsfuse mount, and
+// report latency percentiles for each kind of file system operation.
+//
+// The workload is either synthetic, with a number of concurrent readers and
+// writers and a distribution of file sizes, or a trace of operations recorded
+// from an earlier synthetic run with --record and replayed with --trace. Each
+// synthetic reader and writer performs the same sequence of operations for a
+// given --seed, but how far it gets depends on --duration and the latencies it
+// sees; replaying a trace performs exactly the recorded operations.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/format"
+	"github.com/googlecloudplatform/gcsfuse/benchmarks/internal/percentile"
+	"github.com/jacobsa/syncutil"
+)
+
+var fDir = flag.String("dir", "", "Directory within which to run the workload.")
+var fTrace = flag.String("trace", "", "Trace to replay, instead of a synthetic workload.")
+var fRecord = flag.String("record", "", "File to which to write a trace of the synthetic workload.")
+var fWorkers = flag.Int("workers", 8, "Number of workers replaying a trace.")
+
+var fReaders = flag.Int("readers", 4, "Number of synthetic readers.")
+var fWriters = flag.Int("writers", 1, "Number of synthetic writers.")
+var fNumFiles = flag.Int("num_files", 16, "Number of files for synthetic readers to read.")
+var fFileSizes = flag.String(
+	"file_sizes",
+	"4KiB:5,1MiB:4,64MiB:1",
+	"Comma-separated size:weight pairs from which to draw synthetic file sizes.")
+var fDuration = flag.Duration("duration", 30*time.Second, "How long to run the synthetic workload.")
+var fSeed = flag.Int64("seed", 1, "Seed for the synthetic workload.")
+
+////////////////////////////////////////////////////////////////////////
+// Traces
+////////////////////////////////////////////////////////////////////////
+
+// A single line of a trace.
+type record struct {
+	// "write", "read", "stat", "list", or "delete".
+	Op string `json:"op"`
+
+	// Relative to --dir.
+	Path string `json:"path"`
+
+	// For writes, the number of bytes to write.
+	Size int64 `json:"size,omitempty"`
+
+	// Set for operations that prepare for the workload, which are performed
+	// before the rest of the trace and not measured.
+	Setup bool `json:"setup,omitempty"`
+}
+
+// Read a trace written by --record.
+func readTrace(p string) (records []record, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	d := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var r record
+		err = d.Decode(&r)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Decode: %v", err)
+			return
+		}
+
+		records = append(records, r)
+	}
+}
+
+// A sink for records performed by the synthetic workload. Safe for
+// concurrent access.
+type recorder struct {
+	mu sync.Mutex
+	e  *json.Encoder // GUARDED_BY(mu); nil if not recording
+}
+
+func (rec *recorder) Record(r record) (err error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.e != nil {
+		err = rec.e.Encode(r)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Operations
+////////////////////////////////////////////////////////////////////////
+
+// Latencies for each kind of system call. Safe for concurrent access.
+type latencies struct {
+	mu sync.Mutex
+	m  map[string]percentile.DurationSlice // GUARDED_BY(mu)
+}
+
+func (l *latencies) Observe(op string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.m == nil {
+		l.m = make(map[string]percentile.DurationSlice)
+	}
+
+	l.m[op] = append(l.m[op], d)
+}
+
+// Run f, recording its latency under the name op if l is non-nil.
+func timed(l *latencies, op string, f func() error) (err error) {
+	start := time.Now()
+	err = f()
+	if err != nil {
+		err = fmt.Errorf("%s: %v", op, err)
+		return
+	}
+
+	if l != nil {
+		l.Observe(op, time.Since(start))
+	}
+
+	return
+}
+
+// Perform the operation described by r within dir, recording the latency of
+// each system call it makes in l if non-nil.
+func perform(dir string, r record, l *latencies, buf []byte) (err error) {
+	p := path.Join(dir, r.Path)
+
+	switch r.Op {
+	case "write":
+		err = os.MkdirAll(path.Dir(p), 0700)
+		if err != nil {
+			return
+		}
+
+		var f *os.File
+		err = timed(l, "create", func() (err error) {
+			f, err = os.Create(p)
+			return
+		})
+
+		if err != nil {
+			return
+		}
+
+		for n := r.Size; n > 0 && err == nil; n -= int64(len(buf)) {
+			chunk := buf
+			if n < int64(len(chunk)) {
+				chunk = chunk[:n]
+			}
+
+			err = timed(l, "write", func() (err error) {
+				_, err = f.Write(chunk)
+				return
+			})
+		}
+
+		if err != nil {
+			f.Close()
+			return
+		}
+
+		// Closing the file flushes it to GCS.
+		err = timed(l, "close", f.Close)
+
+	case "read":
+		var f *os.File
+		err = timed(l, "open", func() (err error) {
+			f, err = os.Open(p)
+			return
+		})
+
+		if err != nil {
+			return
+		}
+
+		defer f.Close()
+
+		for done := false; !done && err == nil; {
+			err = timed(l, "read", func() (err error) {
+				_, err = f.Read(buf)
+				if err == io.EOF {
+					done = true
+					err = nil
+				}
+
+				return
+			})
+		}
+
+	case "stat":
+		err = timed(l, "stat", func() (err error) {
+			_, err = os.Stat(p)
+			return
+		})
+
+	case "list":
+		err = timed(l, "list", func() (err error) {
+			_, err = ioutil.ReadDir(p)
+			return
+		})
+
+	case "delete":
+		err = timed(l, "delete", func() error { return os.Remove(p) })
+
+	default:
+		err = fmt.Errorf("Unknown op %q", r.Op)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Synthetic workload
+////////////////////////////////////////////////////////////////////////
+
+// A weighted set of file sizes.
+type sizeDistribution struct {
+	sizes   []int64
+	weights []float64
+	total   float64
+}
+
+// Parse a string of the form accepted by --file_sizes.
+func parseSizeDistribution(s string) (d sizeDistribution, err error) {
+	for _, pair := range strings.Split(s, ",") {
+		sizeStr, weightStr := pair, "1"
+		if i := strings.IndexByte(pair, ':'); i >= 0 {
+			sizeStr, weightStr = pair[:i], pair[i+1:]
+		}
+
+		var size int64
+		size, err = parseSize(sizeStr)
+		if err != nil {
+			return
+		}
+
+		var weight float64
+		weight, err = strconv.ParseFloat(weightStr, 64)
+		if err != nil || weight < 0 {
+			err = fmt.Errorf("Invalid weight %q", weightStr)
+			return
+		}
+
+		d.sizes = append(d.sizes, size)
+		d.weights = append(d.weights, weight)
+		d.total += weight
+	}
+
+	if d.total <= 0 {
+		err = errors.New("Weights must not all be zero")
+		return
+	}
+
+	return
+}
+
+// Parse a number of bytes with an optional KiB, MiB, or GiB suffix.
+func parseSize(s string) (n int64, err error) {
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			multiplier = m
+			break
+		}
+	}
+
+	n, err = strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		err = fmt.Errorf("Invalid size %q", s)
+		return
+	}
+
+	n *= multiplier
+	return
+}
+
+func (d *sizeDistribution) Sample(r *rand.Rand) int64 {
+	x := r.Float64() * d.total
+	for i, w := range d.weights {
+		if x < w {
+			return d.sizes[i]
+		}
+
+		x -= w
+	}
+
+	return d.sizes[len(d.sizes)-1]
+}
+
+func readerFile(i int) string {
+	return fmt.Sprintf("loadtest/files/%06d", i)
+}
+
+// Create the files for the synthetic readers to read.
+func setUpSynthetic(
+	dir string,
+	sizes sizeDistribution,
+	rec *recorder,
+	buf []byte) (err error) {
+	r := rand.New(rand.NewSource(*fSeed))
+	for i := 0; i < *fNumFiles; i++ {
+		op := record{
+			Op:    "write",
+			Path:  readerFile(i),
+			Size:  sizes.Sample(r),
+			Setup: true,
+		}
+
+		err = perform(dir, op, nil, buf)
+		if err != nil {
+			return
+		}
+
+		err = rec.Record(op)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Run the synthetic readers and writers until the deadline.
+func runSynthetic(
+	dir string,
+	sizes sizeDistribution,
+	rec *recorder,
+	l *latencies) (err error) {
+	b := syncutil.NewBundle(context.Background())
+	deadline := time.Now().Add(*fDuration)
+
+	// Each worker has its own source of randomness, so that the sequence of
+	// operations it performs doesn't depend on the others.
+	worker := func(seed int64, next func(r *rand.Rand, i int) record) {
+		b.Add(func(ctx context.Context) (err error) {
+			r := rand.New(rand.NewSource(seed))
+			buf := make([]byte, 1<<20)
+
+			for i := 0; time.Now().Before(deadline); i++ {
+				op := next(r, i)
+				err = perform(dir, op, l, buf)
+				if err != nil {
+					return
+				}
+
+				err = rec.Record(op)
+				if err != nil {
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	for i := 0; i < *fReaders; i++ {
+		worker(*fSeed+int64(i)+1, func(r *rand.Rand, _ int) record {
+			return record{Op: "read", Path: readerFile(r.Intn(*fNumFiles))}
+		})
+	}
+
+	for i := 0; i < *fWriters; i++ {
+		writer := i
+		worker(-*fSeed-int64(i)-1, func(r *rand.Rand, n int) record {
+			return record{
+				Op:   "write",
+				Path: fmt.Sprintf("loadtest/writer%d/%06d", writer, n),
+				Size: sizes.Sample(r),
+			}
+		})
+	}
+
+	err = b.Join()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Trace replay
+////////////////////////////////////////////////////////////////////////
+
+// Perform the records on *fWorkers workers. Records for the same path are
+// performed by the same worker, in order.
+func replay(dir string, records []record, l *latencies) (err error) {
+	b := syncutil.NewBundle(context.Background())
+
+	chans := make([]chan record, *fWorkers)
+	for i := range chans {
+		c := make(chan record, 100)
+		chans[i] = c
+
+		b.Add(func(ctx context.Context) (err error) {
+			buf := make([]byte, 1<<20)
+			for r := range c {
+				err = perform(dir, r, l, buf)
+				if err != nil {
+					return
+				}
+			}
+
+			return
+		})
+	}
+
+	b.Add(func(ctx context.Context) (err error) {
+		defer func() {
+			for _, c := range chans {
+				close(c)
+			}
+		}()
+
+		for _, r := range records {
+			h := fnv.New32a()
+			io.WriteString(h, r.Path)
+
+			select {
+			case chans[int(h.Sum32()%uint32(len(chans)))] <- r:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+
+		return
+	})
+
+	err = b.Join()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// main logic
+////////////////////////////////////////////////////////////////////////
+
+func report(l *latencies, d time.Duration) {
+	var ops []string
+	var total int
+	for op, observations := range l.m {
+		ops = append(ops, op)
+		total += len(observations)
+		sort.Sort(observations)
+	}
+
+	sort.Strings(ops)
+
+	seconds := float64(d) / float64(time.Second)
+	fmt.Printf(
+		"Performed %d system calls in %v (%s)\n\n",
+		total,
+		d,
+		format.Hertz(float64(total)/seconds))
+
+	fmt.Printf(
+		"%-8s %10s %12s %12s %12s %12s\n",
+		"op", "count", "50th", "90th", "99th", "max")
+
+	for _, op := range ops {
+		observations := l.m[op]
+		fmt.Printf(
+			"%-8s %10d %12v %12v %12v %12v\n",
+			op,
+			len(observations),
+			percentile.Duration(observations, 50),
+			percentile.Duration(observations, 90),
+			percentile.Duration(observations, 99),
+			observations[len(observations)-1])
+	}
+
+	fmt.Println()
+}
+
+func run() (err error) {
+	if *fDir == "" {
+		err = errors.New("You must set --dir.")
+		return
+	}
+
+	if *fTrace != "" && *fRecord != "" {
+		err = errors.New("--trace and --record are mutually exclusive.")
+		return
+	}
+
+	l := &latencies{}
+	var start time.Time
+
+	if *fTrace != "" {
+		var records []record
+		records, err = readTrace(*fTrace)
+		if err != nil {
+			err = fmt.Errorf("readTrace: %v", err)
+			return
+		}
+
+		// Perform setup without measuring it.
+		var setup, rest []record
+		for _, r := range records {
+			if r.Setup {
+				setup = append(setup, r)
+			} else {
+				rest = append(rest, r)
+			}
+		}
+
+		log.Printf("Setting up with %d operations...", len(setup))
+		err = replay(*fDir, setup, nil)
+		if err != nil {
+			err = fmt.Errorf("replay: %v", err)
+			return
+		}
+
+		log.Printf("Replaying %d operations...", len(rest))
+		start = time.Now()
+		err = replay(*fDir, rest, l)
+		if err != nil {
+			err = fmt.Errorf("replay: %v", err)
+			return
+		}
+	} else {
+		if *fNumFiles <= 0 && *fReaders > 0 {
+			err = fmt.Errorf("Invalid setting for --num_files: %d", *fNumFiles)
+			return
+		}
+
+		var sizes sizeDistribution
+		sizes, err = parseSizeDistribution(*fFileSizes)
+		if err != nil {
+			err = fmt.Errorf("Invalid setting for --file_sizes: %v", err)
+			return
+		}
+
+		rec := &recorder{}
+		if *fRecord != "" {
+			var f *os.File
+			f, err = os.Create(*fRecord)
+			if err != nil {
+				return
+			}
+
+			defer f.Close()
+			rec.e = json.NewEncoder(f)
+		}
+
+		log.Printf("Creating %d files...", *fNumFiles)
+		err = setUpSynthetic(*fDir, sizes, rec, make([]byte, 1<<20))
+		if err != nil {
+			err = fmt.Errorf("setUpSynthetic: %v", err)
+			return
+		}
+
+		log.Printf("Measuring for %v...", *fDuration)
+		start = time.Now()
+		err = runSynthetic(*fDir, sizes, rec, l)
+		if err != nil {
+			err = fmt.Errorf("runSynthetic: %v", err)
+			return
+		}
+	}
+
+	report(l, time.Since(start))
+	return
+}
+
+func main() {
+	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
+	flag.Parse()
+
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
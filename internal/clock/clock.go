@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock
+
+import (
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// A clock that can also be waited on. Code that sleeps or sets timers should
+// use one of these rather than package time, so that tests can substitute a
+// SimulatedClock and control exactly when the waits end.
+type Clock interface {
+	timeutil.Clock
+
+	// Return a channel that receives the clock's time once d has elapsed
+	// according to the clock.
+	After(d time.Duration) <-chan time.Time
+
+	// Arrange for f to be called once d has elapsed according to the clock.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// Block until d has elapsed according to the clock.
+	Sleep(d time.Duration)
+}
+
+// A timer returned by Clock.AfterFunc.
+type Timer interface {
+	// Prevent the timer from firing. Return false if it has already fired or
+	// been stopped.
+	Stop() bool
+}
+
+// Return a clock that follows the real time, according to the system.
+func RealClock() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (c realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (c realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
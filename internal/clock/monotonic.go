@@ -0,0 +1,47 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Clocks for making expiry decisions and for waiting.
+package clock
+
+import (
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// Return a clock whose readings advance with the system's monotonic clock
+// rather than its wall clock, so that the difference between two readings is
+// the real time elapsed between them even if the system time is changed in
+// between. Use it for cache expiry, where a jump in the wall clock should
+// neither expire entries early nor keep them alive indefinitely.
+//
+// Readings start at the wall time at which the clock was created. Because the
+// wall time of each reading is itself derived from the monotonic clock, this
+// holds even for times whose monotonic reading has been stripped (see the
+// documentation for package time), but readings shouldn't be compared with
+// times from other clocks.
+func NewMonotonicClock() timeutil.Clock {
+	return &monotonicClock{
+		start: time.Now(),
+	}
+}
+
+type monotonicClock struct {
+	start time.Time
+}
+
+func (c *monotonicClock) Now() time.Time {
+	return c.start.Add(time.Since(c.start))
+}
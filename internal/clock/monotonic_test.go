@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/clock"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestMonotonicClock(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MonotonicClockTest struct {
+}
+
+func init() { RegisterTestSuite(&MonotonicClockTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MonotonicClockTest) StartsAtWallTime() {
+	before := time.Now()
+	c := clock.NewMonotonicClock()
+	now := c.Now()
+	after := time.Now()
+
+	ExpectFalse(now.Before(before))
+	ExpectFalse(now.After(after))
+}
+
+func (t *MonotonicClockTest) MeasuresElapsedTime() {
+	const delay = 10 * time.Millisecond
+
+	c := clock.NewMonotonicClock()
+	t0 := c.Now()
+	time.Sleep(delay)
+	t1 := c.Now()
+
+	ExpectThat(t1.Sub(t0), GreaterOrEqual(delay))
+}
+
+func (t *MonotonicClockTest) WallTimesAreMonotonic() {
+	const delay = 10 * time.Millisecond
+
+	// Round(0) strips the monotonic reading, leaving only the wall time.
+	c := clock.NewMonotonicClock()
+	t0 := c.Now().Round(0)
+	time.Sleep(delay)
+	t1 := c.Now().Round(0)
+
+	ExpectThat(t1.Sub(t0), GreaterOrEqual(delay))
+}
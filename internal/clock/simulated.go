@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/timeutil"
+)
+
+// A timeutil.SimulatedClock that also supports waiting. Waits end only when
+// SetTime or AdvanceTime moves the clock to or past their deadline, so tests
+// of code that sleeps or sets timers needn't use real sleeps.
+//
+// Functions passed to AfterFunc are called on the goroutine that moves the
+// clock, before SetTime or AdvanceTime returns. If d <= 0 they are called by
+// AfterFunc itself. They must not call SetTime or AdvanceTime.
+//
+// The zero value is a clock initialized to the zero time.
+type SimulatedClock struct {
+	timeutil.SimulatedClock
+
+	mu sync.Mutex
+
+	// Waits that have not yet ended, in the order in which they were begun.
+	//
+	// GUARDED_BY(mu)
+	waiters []*simulatedTimer
+
+	// Signalled whenever a waiter is added.
+	//
+	// GUARDED_BY(mu)
+	added *sync.Cond
+}
+
+var _ Clock = &SimulatedClock{}
+
+type simulatedTimer struct {
+	clock    *SimulatedClock
+	deadline time.Time
+	fire     func(now time.Time)
+}
+
+func (t *simulatedTimer) Stop() (stopped bool) {
+	c := t.clock
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			stopped = true
+			return
+		}
+	}
+
+	return
+}
+
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	// Buffer the channel so that firing never blocks.
+	ch := make(chan time.Time, 1)
+	c.addWaiter(d, func(now time.Time) { ch <- now })
+
+	return ch
+}
+
+func (c *SimulatedClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.addWaiter(d, func(now time.Time) { f() })
+}
+
+func (c *SimulatedClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Set the current time, ending any waits whose deadline is at or before it.
+func (c *SimulatedClock) SetTime(t time.Time) {
+	c.SimulatedClock.SetTime(t)
+	c.fireExpired()
+}
+
+// Advance the current time, ending any waits whose deadline is passed.
+func (c *SimulatedClock) AdvanceTime(d time.Duration) {
+	c.SimulatedClock.AdvanceTime(d)
+	c.fireExpired()
+}
+
+// Block until at least n waits are in progress. Tests can use this to make
+// sure that another goroutine has begun waiting before advancing the clock.
+func (c *SimulatedClock) BlockUntilWaiters(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.initCond()
+	for len(c.waiters) < n {
+		c.added.Wait()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_REQUIRED(c.mu)
+func (c *SimulatedClock) initCond() {
+	if c.added == nil {
+		c.added = sync.NewCond(&c.mu)
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *SimulatedClock) addWaiter(
+	d time.Duration,
+	fire func(now time.Time)) (t *simulatedTimer) {
+	now := c.Now()
+	t = &simulatedTimer{
+		clock:    c,
+		deadline: now.Add(d),
+		fire:     fire,
+	}
+
+	if d <= 0 {
+		fire(now)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.initCond()
+	c.waiters = append(c.waiters, t)
+	c.added.Broadcast()
+
+	return
+}
+
+// End the waits whose deadlines have passed, earliest deadline first.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *SimulatedClock) fireExpired() {
+	now := c.Now()
+
+	// Remove the expired waiters.
+	var expired []*simulatedTimer
+
+	c.mu.Lock()
+	remaining := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(now) {
+			remaining = append(remaining, w)
+		} else {
+			expired = append(expired, w)
+		}
+	}
+
+	c.waiters = remaining
+	c.mu.Unlock()
+
+	// Fire them without holding the lock, so that callbacks may use the clock.
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].deadline.Before(expired[j].deadline)
+	})
+
+	for _, w := range expired {
+		w.fire(now)
+	}
+}
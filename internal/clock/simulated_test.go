@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/clock"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestSimulatedClock(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SimulatedClockTest struct {
+	clock clock.SimulatedClock
+	start time.Time
+}
+
+var _ SetUpInterface = &SimulatedClockTest{}
+
+func init() { RegisterTestSuite(&SimulatedClockTest{}) }
+
+func (t *SimulatedClockTest) SetUp(ti *TestInfo) {
+	t.start = time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	t.clock.SetTime(t.start)
+}
+
+// Return whether a value is ready on the channel, without blocking.
+func ready(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SimulatedClockTest) After_FiresAtDeadline() {
+	c := t.clock.After(time.Second)
+
+	t.clock.AdvanceTime(time.Second - 1)
+	ExpectFalse(ready(c))
+
+	t.clock.AdvanceTime(1)
+	ExpectThat(<-c, timeutil.TimeEq(t.start.Add(time.Second)))
+}
+
+func (t *SimulatedClockTest) After_NonPositiveDuration() {
+	ExpectTrue(ready(t.clock.After(0)))
+	ExpectTrue(ready(t.clock.After(-time.Second)))
+}
+
+func (t *SimulatedClockTest) After_SetTime() {
+	c := t.clock.After(time.Hour)
+
+	t.clock.SetTime(t.start.Add(time.Minute))
+	ExpectFalse(ready(c))
+
+	t.clock.SetTime(t.start.Add(2 * time.Hour))
+	ExpectTrue(ready(c))
+}
+
+func (t *SimulatedClockTest) AfterFunc_FiresInDeadlineOrder() {
+	var calls []string
+	t.clock.AfterFunc(3*time.Second, func() { calls = append(calls, "c") })
+	t.clock.AfterFunc(time.Second, func() { calls = append(calls, "a") })
+	t.clock.AfterFunc(2*time.Second, func() { calls = append(calls, "b") })
+	t.clock.AfterFunc(time.Minute, func() { calls = append(calls, "d") })
+
+	t.clock.AdvanceTime(10 * time.Second)
+	ExpectThat(calls, ElementsAre("a", "b", "c"))
+
+	// Timers fire only once.
+	t.clock.AdvanceTime(time.Hour)
+	ExpectThat(calls, ElementsAre("a", "b", "c", "d"))
+}
+
+func (t *SimulatedClockTest) AfterFunc_Stop() {
+	var called bool
+	timer := t.clock.AfterFunc(time.Second, func() { called = true })
+
+	ExpectTrue(timer.Stop())
+	ExpectFalse(timer.Stop())
+
+	t.clock.AdvanceTime(time.Hour)
+	ExpectFalse(called)
+}
+
+func (t *SimulatedClockTest) AfterFunc_StopAfterFiring() {
+	timer := t.clock.AfterFunc(time.Second, func() {})
+
+	t.clock.AdvanceTime(time.Second)
+	ExpectFalse(timer.Stop())
+}
+
+func (t *SimulatedClockTest) AfterFunc_CallbackMayUseClock() {
+	// Rescheduling from within a callback is a common pattern for periodic
+	// work.
+	var count int
+	var tick func()
+	tick = func() {
+		count++
+		t.clock.AfterFunc(time.Second, tick)
+	}
+
+	t.clock.AfterFunc(time.Second, tick)
+
+	for i := 0; i < 5; i++ {
+		t.clock.AdvanceTime(time.Second)
+	}
+
+	ExpectEq(5, count)
+}
+
+func (t *SimulatedClockTest) Sleep() {
+	done := make(chan struct{})
+	go func() {
+		t.clock.Sleep(time.Minute)
+		close(done)
+	}()
+
+	t.clock.BlockUntilWaiters(1)
+
+	t.clock.AdvanceTime(time.Second)
+	select {
+	case <-done:
+		AddFailure("Sleep returned early")
+	default:
+	}
+
+	t.clock.AdvanceTime(time.Minute)
+	<-done
+}
+
+func (t *SimulatedClockTest) RealClock() {
+	c := clock.RealClock()
+
+	before := time.Now()
+	c.Sleep(10 * time.Millisecond)
+	<-c.After(time.Millisecond)
+
+	ExpectThat(c.Now().Sub(before), GreaterOrEqual(11*time.Millisecond))
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"golang.org/x/net/context"
+)
+
+// Return an opInterceptor that fails ops with EACCES rather than EIO when they
+// fail with an error that isn't already an errno after GCS refused one of
+// their requests, as happens for those within a managed folder that we aren't
+// allowed to use, or while denied (which may be nil) returns true, since the
+// error is then most likely GCS refusing our credentials.
+func reportAccessDenied(denied func() bool) opInterceptor {
+	return func(
+		ctx context.Context,
+		op interface{},
+		next func(context.Context) error) (err error) {
+		ctx, refused := gcsx.RecordRefusals(ctx)
+		err = next(ctx)
+		if err == nil {
+			return
+		}
+
+		if _, ok := err.(syscall.Errno); ok {
+			return
+		}
+
+		if refused() || (denied != nil && denied()) {
+			err = syscall.EACCES
+		}
+
+		return
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// Return an opInterceptor that fails with EACCES the ops sent on behalf of
+// processes whose UIDs, as reported by callerUid, aren't among those
+// supplied, whatever the permissions of the inodes involved.
+//
+// Ops that merely release what the kernel holds are let through, since the
+// kernel sends them on its own behalf, as are ops whose caller is unknown.
+func restrictCallers(
+	uids []uint32,
+	callerUid func(context.Context) (uint32, bool)) opInterceptor {
+	allowed := make(map[uint32]bool)
+	for _, uid := range uids {
+		allowed[uid] = true
+	}
+
+	return func(
+		ctx context.Context,
+		op interface{},
+		next func(context.Context) error) (err error) {
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp,
+			*fuseops.ReleaseFileHandleOp,
+			*fuseops.ReleaseDirHandleOp:
+
+		default:
+			if uid, ok := callerUid(ctx); ok && !allowed[uid] {
+				err = syscall.EACCES
+				return
+			}
+		}
+
+		err = next(ctx)
+		return
+	}
+}
+
+// Return the UID of the process on whose behalf the kernel sent the op to
+// which ctx belongs.
+func opCallerUid(ctx context.Context) (uid uint32, ok bool) {
+	caller, ok := fuse.CallerOf(ctx)
+	uid = caller.Uid
+	return
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestAccessUids(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type AccessUidsTest struct {
+	ctx context.Context
+
+	// The UID of the caller of each op, if known.
+	uid      uint32
+	uidKnown bool
+
+	intercept opInterceptor
+	calls     int
+}
+
+var _ SetUpInterface = &AccessUidsTest{}
+
+func init() { RegisterTestSuite(&AccessUidsTest{}) }
+
+func (t *AccessUidsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.uidKnown = true
+
+	t.intercept = restrictCallers(
+		[]uint32{1000, 1001},
+		func(ctx context.Context) (uint32, bool) {
+			return t.uid, t.uidKnown
+		})
+}
+
+func (t *AccessUidsTest) call(op interface{}) error {
+	return t.intercept(
+		t.ctx,
+		op,
+		func(ctx context.Context) error {
+			t.calls++
+			return nil
+		})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AccessUidsTest) AllowedCaller() {
+	t.uid = 1001
+
+	ExpectEq(nil, t.call(&fuseops.LookUpInodeOp{}))
+	ExpectEq(nil, t.call(&fuseops.WriteFileOp{}))
+	ExpectEq(2, t.calls)
+}
+
+func (t *AccessUidsTest) OtherCaller() {
+	t.uid = 0
+
+	ExpectEq(syscall.EACCES, t.call(&fuseops.LookUpInodeOp{}))
+	ExpectEq(syscall.EACCES, t.call(&fuseops.StatFSOp{}))
+	ExpectEq(syscall.EACCES, t.call(&fuseops.ReadFileOp{}))
+	ExpectEq(0, t.calls)
+}
+
+func (t *AccessUidsTest) ReleasesAlwaysAllowed() {
+	t.uid = 1002
+
+	ExpectEq(nil, t.call(&fuseops.ForgetInodeOp{}))
+	ExpectEq(nil, t.call(&fuseops.ReleaseFileHandleOp{}))
+	ExpectEq(nil, t.call(&fuseops.ReleaseDirHandleOp{}))
+	ExpectEq(3, t.calls)
+}
+
+func (t *AccessUidsTest) UnknownCaller() {
+	t.uidKnown = false
+
+	ExpectEq(nil, t.call(&fuseops.LookUpInodeOp{}))
+	ExpectEq(1, t.calls)
+}
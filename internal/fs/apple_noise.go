@@ -0,0 +1,98 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// Globs matching the files that the macOS Finder scatters through the
+// directories it visits: AppleDouble files holding the extended attributes of
+// their namesakes, and .DS_Store files holding window positions.
+var appleNoisePatterns = []string{"._*", ".DS_Store"}
+
+// The namespace of the extended attributes set by the Finder, such as
+// com.apple.FinderInfo and com.apple.quarantine.
+const appleXattrPrefix = "com.apple."
+
+func isAppleNoise(name string) bool {
+	for _, p := range appleNoisePatterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// An opInterceptor that keeps the Finder's bookkeeping out of the bucket.
+// Creating or renaming to the names in appleNoisePatterns fails with EPERM,
+// as it does with the osxfuse noappledouble mount option. Setting an extended
+// attribute in the com.apple. namespace succeeds without storing anything,
+// since otherwise the kernel falls back to storing it in an AppleDouble file,
+// and the Finder refuses to copy files when that fails too.
+func suppressAppleNoise(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) (err error) {
+	var name string
+	switch typed := op.(type) {
+	case *fuseops.MkDirOp:
+		name = typed.Name
+
+	case *fuseops.MkNodeOp:
+		name = typed.Name
+
+	case *fuseops.CreateFileOp:
+		name = typed.Name
+
+	case *fuseops.CreateSymlinkOp:
+		name = typed.Name
+
+	case *fuseops.RenameOp:
+		name = typed.NewName
+
+	case *fuseops.SetXattrOp:
+		if strings.HasPrefix(typed.Name, appleXattrPrefix) {
+			return
+		}
+
+	case *fuseops.GetXattrOp:
+		if strings.HasPrefix(typed.Name, appleXattrPrefix) {
+			err = fuse.ENOATTR
+			return
+		}
+
+	case *fuseops.RemoveXattrOp:
+		if strings.HasPrefix(typed.Name, appleXattrPrefix) {
+			err = fuse.ENOATTR
+			return
+		}
+	}
+
+	if isAppleNoise(name) {
+		err = syscall.EPERM
+		return
+	}
+
+	err = next(ctx)
+	return
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestAppleNoise(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type AppleNoiseTest struct {
+	ctx   context.Context
+	calls int
+}
+
+var _ SetUpInterface = &AppleNoiseTest{}
+
+func init() { RegisterTestSuite(&AppleNoiseTest{}) }
+
+func (t *AppleNoiseTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+}
+
+func (t *AppleNoiseTest) call(op interface{}) error {
+	return suppressAppleNoise(
+		t.ctx,
+		op,
+		func(ctx context.Context) error {
+			t.calls++
+			return nil
+		})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AppleNoiseTest) CreateNoise() {
+	ExpectEq(syscall.EPERM, t.call(&fuseops.CreateFileOp{Name: ".DS_Store"}))
+	ExpectEq(syscall.EPERM, t.call(&fuseops.CreateFileOp{Name: "._foo.txt"}))
+	ExpectEq(syscall.EPERM, t.call(&fuseops.MkNodeOp{Name: "._foo.txt"}))
+	ExpectEq(syscall.EPERM, t.call(&fuseops.MkDirOp{Name: "._foo"}))
+	ExpectEq(syscall.EPERM, t.call(&fuseops.CreateSymlinkOp{Name: "._foo"}))
+	ExpectEq(syscall.EPERM, t.call(&fuseops.RenameOp{
+		OldName: "foo.tmp",
+		NewName: ".DS_Store",
+	}))
+
+	ExpectEq(0, t.calls)
+}
+
+func (t *AppleNoiseTest) CreateOthers() {
+	ExpectEq(nil, t.call(&fuseops.CreateFileOp{Name: "foo.txt"}))
+	ExpectEq(nil, t.call(&fuseops.CreateFileOp{Name: ".DS_Store.bak"}))
+	ExpectEq(nil, t.call(&fuseops.CreateFileOp{Name: "_.foo"}))
+	ExpectEq(nil, t.call(&fuseops.RenameOp{
+		OldName: "._foo",
+		NewName: "foo",
+	}))
+
+	ExpectEq(4, t.calls)
+}
+
+func (t *AppleNoiseTest) AppleXattrs() {
+	const name = "com.apple.FinderInfo"
+
+	ExpectEq(nil, t.call(&fuseops.SetXattrOp{Name: name, Value: []byte("x")}))
+	ExpectEq(fuse.ENOATTR, t.call(&fuseops.GetXattrOp{Name: name}))
+	ExpectEq(fuse.ENOATTR, t.call(&fuseops.RemoveXattrOp{Name: name}))
+	ExpectEq(0, t.calls)
+}
+
+func (t *AppleNoiseTest) OtherXattrs() {
+	const name = "user.team"
+
+	ExpectEq(nil, t.call(&fuseops.SetXattrOp{Name: name, Value: []byte("x")}))
+	ExpectEq(nil, t.call(&fuseops.GetXattrOp{Name: name}))
+	ExpectEq(nil, t.call(&fuseops.RemoveXattrOp{Name: name}))
+	ExpectEq(3, t.calls)
+}
@@ -0,0 +1,39 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"golang.org/x/net/context"
+)
+
+// An opInterceptor that records the name of each operation and its caller in
+// its context, so that a bucket created with gcsx.NewAuditingBucket can
+// attribute the modifications it records.
+//
+// The caller is copied now, since fuse.CallerOf is valid only until the op is
+// replied to, and the context may be used for longer.
+func tagAuditOp(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) error {
+	var caller *fuse.OpCaller
+	if c, ok := fuse.CallerOf(ctx); ok {
+		caller = &c
+	}
+
+	return next(gcsx.NewAuditContext(ctx, opName(op), caller))
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+)
+
+// Change the cache TTLs of every live inode, and of those minted from now on,
+// except where a DirOverride sets them. Entries cached before the change keep
+// the expiration they were given.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) setCacheTTLs(
+	attributes time.Duration,
+	types time.Duration) {
+	type update struct {
+		in         inode.CachingInode
+		attributes time.Duration
+		types      time.Duration
+	}
+
+	inodes := fs.cachingInodes(func(string) bool { return true })
+
+	fs.mu.Lock()
+	fs.inodeAttributeCacheTTL = attributes
+	fs.dirTypeCacheTTL = types
+
+	updates := make([]update, len(inodes))
+	for i, in := range inodes {
+		updates[i].in = in
+		updates[i].attributes, updates[i].types, _ = fs.settingsFor(in.Name())
+	}
+	fs.mu.Unlock()
+
+	for _, u := range updates {
+		u.in.Lock()
+		u.in.SetCacheTTLs(u.attributes, u.types)
+		u.in.Unlock()
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCacheTTLs(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type CacheTTLsTest struct {
+	directFsTest
+	clock timeutil.SimulatedClock
+}
+
+func init() { RegisterTestSuite(&CacheTTLsTest{}) }
+
+func (t *CacheTTLsTest) SetUp(ti *TestInfo) {
+	// Start with caching disabled.
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.serverCfg.CacheClock = &t.clock
+	t.directFsTest.SetUp(ti)
+
+	// Create some objects.
+	for _, name := range []string{"foo", "bar"} {
+		_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CacheTTLsTest) DisabledAtCreation() {
+	e := t.lookUpPath("foo")
+	ExpectTrue(e.AttributesExpiration.IsZero())
+}
+
+func (t *CacheTTLsTest) EnabledForExistingInodes() {
+	const ttl = time.Minute
+
+	e := t.lookUpPath("foo")
+	AssertTrue(e.AttributesExpiration.IsZero())
+
+	t.server.SetCacheTTLs(ttl, ttl)
+
+	op := &fuseops.GetInodeAttributesOp{
+		Inode: e.Child,
+	}
+
+	err := t.fs.GetInodeAttributes(t.ctx, op)
+	AssertEq(nil, err)
+
+	ExpectFalse(op.AttributesExpiration.IsZero())
+	ExpectTrue(op.AttributesExpiration.After(time.Now()))
+}
+
+func (t *CacheTTLsTest) EnabledForNewInodes() {
+	t.server.SetCacheTTLs(time.Minute, time.Minute)
+
+	e := t.lookUpPath("bar")
+	ExpectFalse(e.AttributesExpiration.IsZero())
+}
+
+func (t *CacheTTLsTest) DisabledAgain() {
+	t.server.SetCacheTTLs(time.Minute, time.Minute)
+	t.server.SetCacheTTLs(0, 0)
+
+	e := t.lookUpPath("foo")
+	ExpectTrue(e.AttributesExpiration.IsZero())
+}
+
+func (t *CacheTTLsTest) KernelEntriesNotCachedByDefault() {
+	e := t.lookUpPath("foo")
+	ExpectTrue(e.EntryExpiration.IsZero())
+}
+
+func (t *CacheTTLsTest) KernelTTLs() {
+	const ttl = time.Hour
+	t.fs.kernelEntryCacheTTL = ttl
+	t.fs.kernelAttrCacheTTL = ttl
+
+	// The kernel may cache both for the configured time, even though our own
+	// caching is disabled.
+	e := t.lookUpPath("foo")
+	ExpectTrue(e.EntryExpiration.After(time.Now().Add(ttl - time.Minute)))
+	ExpectTrue(e.AttributesExpiration.After(time.Now().Add(ttl - time.Minute)))
+
+	op := &fuseops.GetInodeAttributesOp{
+		Inode: e.Child,
+	}
+
+	err := t.fs.GetInodeAttributes(t.ctx, op)
+	AssertEq(nil, err)
+
+	ExpectTrue(op.AttributesExpiration.After(time.Now().Add(ttl - time.Minute)))
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// When ServerConfig.Changes is set, we watch it for changes made to objects
+// by anyone and discard what we and the kernel have cached about each changed
+// object and its parent directory, so that the change shows up at once rather
+// than when the caches expire.
+//
+// The kernel has no way to turn such notifications into inotify events; those
+// are only generated for changes made through the kernel itself. So tools
+// that watch files with inotify still see a remote change only once they next
+// look at the file, e.g. when tail -F next polls it.
+
+// How long to wait before trying again after failing to pull changes.
+const changesRetryDelay = 10 * time.Second
+
+// Tells the kernel to discard what it has cached; see fuse.Connection.
+type kernelNotifier interface {
+	InvalidateInode(inode fuseops.InodeID, off int64, length int64) error
+	InvalidateEntry(parent fuseops.InodeID, name string) error
+}
+
+// Apply the changes reported by the supplied feed until the context is
+// cancelled. Failures to pull changes are logged and retried; in the meantime
+// changes are noticed only as caches expire, as without a feed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) watchChanges(
+	ctx context.Context,
+	changes storage.Changes) {
+	for {
+		batch, err := changes.Next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			logger.Errorf("Watching for changes: %v", err)
+
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(changesRetryDelay):
+			}
+
+			continue
+		}
+
+		fs.applyChanges(batch)
+	}
+}
+
+// Split the name of an object into the name of the directory containing it
+// and its name within that directory.
+func splitObjectName(name string) (parent string, base string) {
+	trimmed := strings.TrimSuffix(name, "/")
+	i := strings.LastIndex(trimmed, "/")
+	parent = trimmed[:i+1]
+	base = trimmed[i+1:]
+	return
+}
+
+// Discard what is cached about the supplied changed objects and their parent
+// directories. Changes to generations that an inode already has, which
+// include those made through this file system, are ignored.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) applyChanges(changes []storage.ObjectChange) {
+	// Index the changes by object name, and the names of changed children by
+	// parent directory.
+	byName := make(map[string]storage.ObjectChange)
+	for _, c := range changes {
+		if prev, ok := byName[c.Name]; !ok || prev.Generation <= c.Generation {
+			byName[c.Name] = c
+		}
+	}
+
+	children := make(map[string][]string)
+	for name := range byName {
+		parent, _ := splitObjectName(name)
+		children[parent] = append(children[parent], name)
+	}
+
+	// Find the affected inodes. We can't lock them while holding the file
+	// system lock; see fileInodes.
+	var objects []inode.Inode
+	var dirs []inode.Inode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if _, ok := byName[in.Name()]; ok {
+			objects = append(objects, in)
+		}
+
+		if _, ok := children[in.Name()]; ok {
+			dirs = append(dirs, in)
+		}
+	}
+
+	notifier := fs.notifier
+	fs.mu.Unlock()
+
+	// Leave alone changes that an inode for the object already reflects.
+	upToDate := make(map[string]bool)
+	var staleIDs []fuseops.InodeID
+	for _, in := range objects {
+		c := byName[in.Name()]
+
+		in.Lock()
+
+		if gb, ok := in.(inode.GenerationBackedInode); ok && !c.Deleted {
+			current := inode.Generation{
+				Object:   c.Generation,
+				Metadata: c.Metageneration,
+			}
+
+			if gb.SourceGeneration() == current {
+				upToDate[c.Name] = true
+				in.Unlock()
+				continue
+			}
+		}
+
+		if ci, ok := in.(inode.CachingInode); ok {
+			ci.InvalidateCaches()
+		}
+
+		staleIDs = append(staleIDs, in.ID())
+		in.Unlock()
+	}
+
+	if fs.statCache != nil {
+		for name := range byName {
+			if !upToDate[name] {
+				fs.statCache.Invalidate(name)
+			}
+		}
+	}
+
+	type entry struct {
+		parent fuseops.InodeID
+		name   string
+	}
+
+	var staleEntries []entry
+	for _, d := range dirs {
+		var names []string
+		for _, name := range children[d.Name()] {
+			if !upToDate[name] {
+				_, base := splitObjectName(name)
+				names = append(names, base)
+			}
+		}
+
+		if len(names) == 0 {
+			continue
+		}
+
+		d.Lock()
+		if ci, ok := d.(inode.CachingInode); ok {
+			ci.InvalidateCaches()
+		}
+		d.Unlock()
+
+		for _, name := range names {
+			staleEntries = append(staleEntries, entry{d.ID(), name})
+		}
+	}
+
+	// Tell the kernel, if we're mounted. It fails with ENOENT for whatever it
+	// has already forgotten.
+	if notifier == nil {
+		return
+	}
+
+	for _, id := range staleIDs {
+		err := notifier.InvalidateInode(id, 0, 0)
+		if err != nil && err != syscall.ENOENT {
+			logger.Debugf("InvalidateInode(%v): %v", id, err)
+		}
+	}
+
+	for _, e := range staleEntries {
+		err := notifier.InvalidateEntry(e.parent, e.name)
+		if err != nil && err != syscall.ENOENT {
+			logger.Debugf("InvalidateEntry(%v, %q): %v", e.parent, e.name, err)
+		}
+	}
+}
+
+// Record the kernel's side of the connection the file system is being served
+// on, so that applyChanges can tell it what is stale.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) setNotifier(n kernelNotifier) {
+	fs.mu.Lock()
+	fs.notifier = n
+	fs.mu.Unlock()
+}
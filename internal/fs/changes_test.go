@@ -0,0 +1,275 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestChanges(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Reports the batches of changes sent on a channel.
+type chanChanges chan []storage.ObjectChange
+
+func (c chanChanges) Next(
+	ctx context.Context) (changes []storage.ObjectChange, err error) {
+	select {
+	case changes = <-c:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Sends a description of each notification on a channel.
+type recordingNotifier struct {
+	calls chan string
+}
+
+func (n *recordingNotifier) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	length int64) (err error) {
+	n.calls <- fmt.Sprintf("inode %v %v %v", inode, off, length)
+	return
+}
+
+func (n *recordingNotifier) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) (err error) {
+	n.calls <- fmt.Sprintf("entry %v %s", parent, name)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for watching changes to objects, calling the file system's methods
+// directly as the kernel would.
+type ChangesTest struct {
+	directFsTest
+	changes  chanChanges
+	notifier recordingNotifier
+}
+
+func init() { RegisterTestSuite(&ChangesTest{}) }
+
+func (t *ChangesTest) SetUp(ti *TestInfo) {
+	t.changes = make(chanChanges)
+	t.notifier.calls = make(chan string, 100)
+
+	t.serverCfg.Changes = t.changes
+	t.serverCfg.InodeAttributeCacheTTL = time.Hour
+	t.serverCfg.DirTypeCacheTTL = time.Hour
+	t.directFsTest.SetUp(ti)
+
+	t.fs.setNotifier(&t.notifier)
+}
+
+// Return the notifications sent so far.
+func (t *ChangesTest) calls() (calls []string) {
+	for {
+		select {
+		case c := <-t.notifier.calls:
+			calls = append(calls, c)
+
+		default:
+			return
+		}
+	}
+}
+
+func (t *ChangesTest) create(name string, contents string) *gcs.Object {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+
+	return o
+}
+
+func (t *ChangesTest) changed(o *gcs.Object) storage.ObjectChange {
+	return storage.ObjectChange{
+		Name:           o.Name,
+		Generation:     o.Generation,
+		Metageneration: o.MetaGeneration,
+	}
+}
+
+func (t *ChangesTest) size(id fuseops.InodeID) uint64 {
+	op := &fuseops.GetInodeAttributesOp{Inode: id}
+	err := t.fs.GetInodeAttributes(t.ctx, op)
+	AssertEq(nil, err)
+
+	return op.Attributes.Size
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ChangesTest) RemoteOverwrite() {
+	t.create("foo", "taco")
+	id := t.lookUp("foo")
+	AssertEq(4, t.size(id))
+
+	o := t.create("foo", "burrito")
+	t.fs.applyChanges([]storage.ObjectChange{t.changed(o)})
+
+	ExpectThat(t.calls(), ElementsAre(
+		fmt.Sprintf("inode %v 0 0", id),
+		fmt.Sprintf("entry %v foo", fuseops.RootInodeID),
+	))
+
+	// The cached attributes are gone, so the new generation is picked up.
+	ExpectEq(7, t.size(id))
+}
+
+func (t *ChangesTest) RemoteDelete() {
+	o := t.create("foo", "taco")
+	id := t.lookUp("foo")
+
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+
+	c := t.changed(o)
+	c.Deleted = true
+	t.fs.applyChanges([]storage.ObjectChange{c})
+
+	ExpectThat(t.calls(), ElementsAre(
+		fmt.Sprintf("inode %v 0 0", id),
+		fmt.Sprintf("entry %v foo", fuseops.RootInodeID),
+	))
+}
+
+func (t *ChangesTest) NewObjectInDirectory() {
+	t.create("dir/", "")
+	e := t.lookUpPath("dir")
+
+	_, err := t.lookUpIn(e.Child, "bar")
+	AssertEq(syscall.ENOENT, err)
+
+	o := t.create("dir/bar", "taco")
+	t.fs.applyChanges([]storage.ObjectChange{t.changed(o)})
+
+	ExpectThat(t.calls(), ElementsAre(
+		fmt.Sprintf("entry %v bar", e.Child),
+	))
+
+	// The directory's cached knowledge of its children is gone too.
+	_, err = t.lookUpIn(e.Child, "bar")
+	ExpectEq(nil, err)
+}
+
+func (t *ChangesTest) OwnWriteIgnored() {
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0644,
+	}
+
+	err := t.fs.CreateFile(t.ctx, op)
+	AssertEq(nil, err)
+
+	err = t.fs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{
+			Inode:  op.Entry.Child,
+			Handle: op.Handle,
+			Data:   []byte("taco"),
+		})
+
+	AssertEq(nil, err)
+
+	err = t.fs.SyncFile(
+		t.ctx,
+		&fuseops.SyncFileOp{Inode: op.Entry.Child, Handle: op.Handle})
+
+	AssertEq(nil, err)
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "foo"})
+
+	AssertEq(nil, err)
+
+	t.fs.applyChanges([]storage.ObjectChange{t.changed(o)})
+	ExpectThat(t.calls(), ElementsAre())
+}
+
+func (t *ChangesTest) MetadataUpdate() {
+	o := t.create("foo", "taco")
+	id := t.lookUp("foo")
+
+	c := t.changed(o)
+	c.Metageneration++
+	t.fs.applyChanges([]storage.ObjectChange{c})
+
+	ExpectThat(t.calls(), ElementsAre(
+		fmt.Sprintf("inode %v 0 0", id),
+		fmt.Sprintf("entry %v foo", fuseops.RootInodeID),
+	))
+}
+
+func (t *ChangesTest) UnknownNamesIgnored() {
+	t.fs.applyChanges([]storage.ObjectChange{
+		{Name: "dir/bar", Generation: 17},
+		{Name: "dir/baz/", Generation: 18, Deleted: true},
+	})
+
+	ExpectThat(t.calls(), ElementsAre())
+}
+
+func (t *ChangesTest) NotMounted() {
+	t.create("foo", "taco")
+	id := t.lookUp("foo")
+	AssertEq(4, t.size(id))
+
+	t.fs.setNotifier(nil)
+
+	o := t.create("foo", "burrito")
+	t.fs.applyChanges([]storage.ObjectChange{t.changed(o)})
+	ExpectEq(7, t.size(id))
+}
+
+func (t *ChangesTest) Watched() {
+	t.changes <- []storage.ObjectChange{{Name: "foo", Generation: 17}}
+
+	select {
+	case c := <-t.notifier.calls:
+		ExpectEq(fmt.Sprintf("entry %v foo", fuseops.RootInodeID), c)
+
+	case <-time.After(5 * time.Second):
+		AddFailure("Timed out waiting for a notification")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Concatenating files through the kernel means reading every byte back from
+// GCS only to upload it again. GCS can instead compose up to 32 objects into
+// one server-side, which we offer through composeXattr: setting it on a
+// destination file, which must already exist, replaces its contents.
+
+// Parse a list of source names as given to composeXattr: one per line,
+// relative to the mount, ignoring blank lines. Fail with EINVAL if there are
+// none or too many, or one names a directory.
+func parseComposeSources(value string) (names []string, err error) {
+	for _, line := range strings.Split(value, "\n") {
+		name := strings.TrimPrefix(strings.TrimSuffix(line, "\r"), "/")
+		if name == "" {
+			continue
+		}
+
+		if inode.IsDirName(name) {
+			err = syscall.EINVAL
+			return
+		}
+
+		names = append(names, name)
+	}
+
+	if len(names) == 0 || len(names) > gcs.MaxSourcesPerComposeRequest {
+		err = syscall.EINVAL
+		return
+	}
+
+	return
+}
+
+// Replace the contents of the file with the concatenation of the objects
+// listed in value, in GCS.
+//
+// LOCKS_EXCLUDED(f)
+func (fs *fileSystem) compose(
+	ctx context.Context,
+	f *inode.FileInode,
+	value string) (err error) {
+	srcNames, err := parseComposeSources(value)
+	if err != nil {
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	err = fs.checkRetention(ctx, f.Source())
+	if err != nil {
+		return
+	}
+
+	err = sourceUpdateError(f.Compose(ctx, srcNames, fs.mtimeClock.Now()))
+	return
+}
@@ -0,0 +1,539 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// When enabled, a virtual directory named controlDirName at the root of the
+// file system lets operators inspect and steer the mount with ordinary tools.
+// It shadows anything in the bucket with that name, and like the trash it
+// isn't listed but can be looked up. It contains:
+//
+//  *  stats, reporting the state of the file system when opened.
+//
+//  *  config, describing the configuration the mount was started with.
+//
+//  *  flush_caches, each write to which discards everything cached about the
+//     bucket.
+//
+//  *  invalidate, a directory in which looking up a path, as with
+//     stat .gcsfuse/invalidate/foo/bar, discards everything cached about the
+//     file or directory foo/bar and its contents. Each name looked up there
+//     appears as an empty directory so that longer paths can be walked.
+//
+// None of this is backed by inodes in the inode table. Instead the
+// interceptor serveControlDir answers every op concerning it, using inode IDs
+// reserved for the purpose.
+
+const controlDirName = ".gcsfuse"
+
+const (
+	controlDirInodeID fuseops.InodeID = fuseops.RootInodeID + 1 + iota
+	controlStatsInodeID
+	controlConfigInodeID
+	controlFlushCachesInodeID
+	controlInvalidateInodeID
+
+	// IDs from here on stand for the names looked up within the invalidate
+	// directory that the kernel hasn't yet forgotten.
+	firstInvalidatedInodeID
+)
+
+// The number of IDs reserved for names within the invalidate directory.
+// Looking up more at once than this fails with ENFILE.
+const maxInvalidatedInodes = 1 << 16
+
+// No inode ID at or below this is chosen for the contents of the bucket; see
+// chooseInodeID.
+const lastReservedInodeID = firstInvalidatedInodeID + maxInvalidatedInodes - 1
+
+// The contents of the control directory, in name order.
+var controlDirEntries = []fuseutil.Dirent{
+	{Name: "config", Inode: controlConfigInodeID, Type: fuseutil.DT_File},
+	{Name: "flush_caches", Inode: controlFlushCachesInodeID, Type: fuseutil.DT_File},
+	{Name: "invalidate", Inode: controlInvalidateInodeID, Type: fuseutil.DT_Directory},
+	{Name: "stats", Inode: controlStatsInodeID, Type: fuseutil.DT_File},
+}
+
+type controlDir struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	// The contents of the config file.
+	config string
+
+	// The time reported for everything in the directory.
+	created time.Time
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The paths that the IDs handed out within the invalidate directory stand
+	// for, and the reverse, along with the kernel's lookup count for each.
+	//
+	// INVARIANT: For each k/v in invalidatedIDs, invalidatedPaths[v] == k
+	// INVARIANT: len(invalidatedIDs) == len(invalidatedPaths)
+	//
+	// GUARDED_BY(mu)
+	invalidatedPaths  map[fuseops.InodeID]string
+	invalidatedIDs    map[string]fuseops.InodeID
+	invalidatedCounts map[fuseops.InodeID]uint64
+
+	// The open handles, with the contents to serve through each, snapshotted
+	// when it was opened. The IDs come from the file system's sequence, so
+	// they don't collide with its own handles.
+	//
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID][]byte
+}
+
+// Create the state for a control directory.
+func newControlDir(
+	config string,
+	created time.Time) *controlDir {
+	return &controlDir{
+		config:            config,
+		created:           created,
+		invalidatedPaths:  make(map[fuseops.InodeID]string),
+		invalidatedIDs:    make(map[string]fuseops.InodeID),
+		invalidatedCounts: make(map[fuseops.InodeID]uint64),
+		handles:           make(map[fuseops.HandleID][]byte),
+	}
+}
+
+// Is the supplied ID one of those reserved for the control directory?
+func isControlInode(id fuseops.InodeID) bool {
+	return id >= controlDirInodeID && id <= lastReservedInodeID
+}
+
+// Does the named child of the parent refer to the control directory itself?
+func isControlDir(parent fuseops.InodeID, name string) bool {
+	return parent == fuseops.RootInodeID && name == controlDirName
+}
+
+// Is the supplied ID that of a directory?
+func isControlDirInode(id fuseops.InodeID) bool {
+	return id == controlDirInodeID ||
+		id == controlInvalidateInodeID ||
+		id >= firstInvalidatedInodeID
+}
+
+// Return the attributes of the supplied inode within the control directory.
+func (fs *fileSystem) controlAttributes(
+	id fuseops.InodeID) (attrs fuseops.InodeAttributes) {
+	attrs = fuseops.InodeAttributes{
+		Nlink: 1,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
+		Atime: fs.control.created,
+		Mtime: fs.control.created,
+		Ctime: fs.control.created,
+	}
+
+	switch {
+	case isControlDirInode(id):
+		attrs.Mode = os.ModeDir | 0555
+
+	case id == controlFlushCachesInodeID:
+		attrs.Mode = 0222
+
+	default:
+		attrs.Mode = 0444
+	}
+
+	return
+}
+
+// Hand out an ID standing for the supplied path within the invalidate
+// directory, or return the one already handed out, incrementing its lookup
+// count.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *controlDir) invalidatedInode(p string) (id fuseops.InodeID, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.invalidatedIDs[p]
+	if !ok {
+		if len(c.invalidatedIDs) == maxInvalidatedInodes {
+			err = syscall.ENFILE
+			return
+		}
+
+		for id = firstInvalidatedInodeID; ; id++ {
+			if _, ok := c.invalidatedPaths[id]; !ok {
+				break
+			}
+		}
+
+		c.invalidatedIDs[p] = id
+		c.invalidatedPaths[id] = p
+	}
+
+	c.invalidatedCounts[id]++
+	return
+}
+
+// Return the path that the supplied ID within the invalidate directory stands
+// for, or the empty string for the directory itself.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *controlDir) invalidatedPath(id fuseops.InodeID) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.invalidatedPaths[id]
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *controlDir) forget(id fuseops.InodeID, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.invalidatedPaths[id]
+	if !ok {
+		return
+	}
+
+	if c.invalidatedCounts[id] > n {
+		c.invalidatedCounts[id] -= n
+		return
+	}
+
+	delete(c.invalidatedPaths, id)
+	delete(c.invalidatedIDs, p)
+	delete(c.invalidatedCounts, id)
+}
+
+// Release the supplied handle, returning false if it isn't ours.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *controlDir) release(h fuseops.HandleID) (ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok = c.handles[h]
+	delete(c.handles, h)
+	return
+}
+
+// An opInterceptor that serves the ops concerning the control directory and
+// its contents, passing on the rest.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) serveControlDir(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) (err error) {
+	id, name := opDetails(op)
+	ours := isControlInode(id) || isControlDir(id, name)
+
+	switch typed := op.(type) {
+	case *fuseops.RenameOp:
+		ours = ours ||
+			isControlInode(typed.NewParent) ||
+			isControlDir(typed.NewParent, typed.NewName)
+
+	// The name is that of an extended attribute, not a child.
+	case *fuseops.GetXattrOp, *fuseops.SetXattrOp, *fuseops.RemoveXattrOp:
+		ours = isControlInode(id)
+
+	case *fuseops.ReleaseDirHandleOp:
+		if fs.control.release(typed.Handle) {
+			return
+		}
+
+	case *fuseops.ReleaseFileHandleOp:
+		if fs.control.release(typed.Handle) {
+			return
+		}
+	}
+
+	if !ours {
+		err = next(ctx)
+		return
+	}
+
+	err = fs.serveControlOp(ctx, op)
+	return
+}
+
+// Serve an op concerning the control directory or its contents.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) serveControlOp(
+	ctx context.Context,
+	op interface{}) (err error) {
+	c := fs.control
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		var child fuseops.InodeID
+		child, err = fs.lookUpControlChild(ctx, typed.Parent, typed.Name)
+		if err != nil {
+			return
+		}
+
+		typed.Entry.Child = child
+		typed.Entry.Attributes = fs.controlAttributes(child)
+
+	case *fuseops.GetInodeAttributesOp:
+		typed.Attributes = fs.controlAttributes(typed.Inode)
+
+	// Allow flush_caches to be truncated, as opening it with O_TRUNC does.
+	case *fuseops.SetInodeAttributesOp:
+		if typed.Inode != controlFlushCachesInodeID &&
+			(typed.Size != nil || typed.Mtime != nil) {
+			err = syscall.EROFS
+			return
+		}
+
+		typed.Attributes = fs.controlAttributes(typed.Inode)
+
+	case *fuseops.ForgetInodeOp:
+		c.forget(typed.Inode, typed.N)
+
+	case *fuseops.OpenDirOp:
+		typed.Handle = fs.openControlHandle(nil)
+
+	case *fuseops.ReadDirOp:
+		var entries []fuseutil.Dirent
+		if typed.Inode == controlDirInodeID {
+			entries = controlDirEntries
+		}
+
+		for i := int(typed.Offset); i < len(entries); i++ {
+			e := entries[i]
+			e.Offset = fuseops.DirOffset(i + 1)
+
+			n := fuseutil.WriteDirent(typed.Dst[typed.BytesRead:], e)
+			if n == 0 {
+				break
+			}
+
+			typed.BytesRead += n
+		}
+
+	case *fuseops.OpenFileOp:
+		var contents []byte
+		switch typed.Inode {
+		case controlStatsInodeID:
+			contents = fs.controlStats()
+
+		case controlConfigInodeID:
+			contents = []byte(c.config)
+		}
+
+		// The size we report is zero, so have reads come to us regardless.
+		typed.Handle = fs.openControlHandle(contents)
+		typed.UseDirectIO = true
+
+	case *fuseops.ReadFileOp:
+		c.mu.Lock()
+		contents := c.handles[typed.Handle]
+		c.mu.Unlock()
+
+		if typed.Offset < int64(len(contents)) {
+			typed.BytesRead = copy(typed.Dst, contents[typed.Offset:])
+		}
+
+	case *fuseops.WriteFileOp:
+		if typed.Inode != controlFlushCachesInodeID {
+			err = syscall.EROFS
+			return
+		}
+
+		fs.flushCaches()
+
+	// Nothing to do for these.
+	case *fuseops.SyncFileOp, *fuseops.FlushFileOp, *fuseops.ListXattrOp:
+
+	case *fuseops.GetXattrOp, *fuseops.RemoveXattrOp:
+		err = fuse.ENOATTR
+
+	// Everything else would modify the directory.
+	default:
+		err = syscall.EROFS
+	}
+
+	return
+}
+
+// Look up the named child of a directory within the control directory, or
+// the control directory itself. Looking up a name within the invalidate
+// directory discards what is cached for the path.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) lookUpControlChild(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) (child fuseops.InodeID, err error) {
+	switch {
+	case isControlDir(parent, name):
+		child = controlDirInodeID
+		return
+
+	case parent == controlDirInodeID:
+		for _, e := range controlDirEntries {
+			if e.Name == name {
+				child = e.Inode
+				return
+			}
+		}
+
+	case parent == controlInvalidateInodeID || parent >= firstInvalidatedInodeID:
+		if name == "." || name == ".." {
+			break
+		}
+
+		p := name
+		if prefix := fs.control.invalidatedPath(parent); prefix != "" {
+			p = prefix + "/" + name
+		}
+
+		fs.invalidatePath(p)
+		child, err = fs.control.invalidatedInode(p)
+		return
+	}
+
+	err = fuse.ENOENT
+	return
+}
+
+// Allocate a handle through which to serve the supplied contents.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) openControlHandle(contents []byte) (h fuseops.HandleID) {
+	fs.mu.Lock()
+	h = fs.nextHandleID
+	fs.nextHandleID++
+	fs.mu.Unlock()
+
+	fs.control.mu.Lock()
+	fs.control.handles[h] = contents
+	fs.control.mu.Unlock()
+
+	return
+}
+
+// Describe the state of the file system, for the stats file.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) controlStats() []byte {
+	var buf bytes.Buffer
+	s := fs.stats()
+
+	fmt.Fprintf(&buf, "inodes: %d\n", s.Inodes)
+	fmt.Fprintf(&buf, "forgotten inodes: %d\n", s.ForgottenInodes)
+	fmt.Fprintf(&buf, "open handles: %d\n", s.OpenHandles)
+	fmt.Fprintf(&buf, "dirty files: %d (%d bytes)\n", s.DirtyFiles, s.DirtyBytes)
+	fmt.Fprintf(&buf, "busy files: %d\n", s.BusyFiles)
+	fmt.Fprintf(&buf, "ops in flight: %d\n", s.OpsInFlight)
+
+	for _, op := range s.Ops {
+		fmt.Fprintf(&buf, "  %s for %v\n", op.Desc, op.Duration)
+	}
+
+	return buf.Bytes()
+}
+
+// Return the inodes in the table that cache anything, and whose names satisfy
+// the supplied predicate. We can't lock them while holding the file system
+// lock; see fileInodes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) cachingInodes(
+	match func(name string) bool) (inodes []inode.CachingInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, in := range fs.inodes {
+		if c, ok := in.(inode.CachingInode); ok && match(in.Name()) {
+			inodes = append(inodes, c)
+		}
+	}
+
+	return
+}
+
+// Discard everything cached about the bucket, by inodes and in front of the
+// bucket. The kernel's own caches of entries and attributes are unaffected.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) flushCaches() {
+	if fs.statCache != nil {
+		fs.statCache.InvalidateAll()
+	}
+
+	inodes := fs.cachingInodes(func(string) bool { return true })
+	for _, in := range inodes {
+		in.Lock()
+		in.InvalidateCaches()
+		in.Unlock()
+	}
+
+	logger.Infof("Flushed caches for %d inodes", len(inodes))
+}
+
+// Discard what is cached about the file or directory with the supplied path,
+// relative to the root of the file system, and about its contents and its
+// parent's listing.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) invalidatePath(p string) {
+	parent := path.Dir(p) + "/"
+	if parent == "./" {
+		parent = ""
+	}
+
+	inodes := fs.cachingInodes(func(name string) bool {
+		return name == p ||
+			name == parent ||
+			strings.HasPrefix(name, p+"/")
+	})
+
+	if sc := fs.statCache; sc != nil {
+		sc.Invalidate(p)
+		sc.Invalidate(p + "/")
+		for _, in := range inodes {
+			sc.Invalidate(in.Name())
+		}
+	}
+
+	for _, in := range inodes {
+		in.Lock()
+		in.InvalidateCaches()
+		in.Unlock()
+	}
+}
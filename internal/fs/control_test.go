@@ -0,0 +1,313 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestControl(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for the control directory, calling the methods of the file system
+// wrapped by serveControlDir directly as the kernel would. Objects are modified
+// through t.bucket, behind the stat cache.
+type ControlTest struct {
+	directFsTest
+	ifs fuseutil.FileSystem
+}
+
+func init() { RegisterTestSuite(&ControlTest{}) }
+
+func (t *ControlTest) SetUp(ti *TestInfo) {
+	const ttl = time.Hour
+
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.serverCfg.Bucket = gcscaching.NewFastStatBucket(
+		ttl,
+		gcscaching.NewStatCache(100),
+		timeutil.RealClock(),
+		t.bucket)
+
+	t.serverCfg.InodeAttributeCacheTTL = ttl
+	t.serverCfg.DirTypeCacheTTL = ttl
+	t.serverCfg.ControlDir = true
+	t.serverCfg.ControlConfig = "Foo: bar\n"
+	t.directFsTest.SetUp(ti)
+
+	t.ifs = newInterceptingFileSystem(
+		t.fs,
+		[]opInterceptor{t.fs.serveControlDir})
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"dir/", "dir/foo", "bar", ".gcsfuse/baz"})
+
+	AssertEq(nil, err)
+}
+
+// Look up a child through the control directory's interceptor.
+func (t *ControlTest) lookUp(
+	parent fuseops.InodeID,
+	name string) (entry fuseops.ChildInodeEntry, err error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+
+	err = t.ifs.LookUpInode(t.ctx, op)
+	entry = op.Entry
+	return
+}
+
+func (t *ControlTest) size(id fuseops.InodeID) uint64 {
+	op := &fuseops.GetInodeAttributesOp{Inode: id}
+	err := t.ifs.GetInodeAttributes(t.ctx, op)
+	AssertEq(nil, err)
+
+	return op.Attributes.Size
+}
+
+func (t *ControlTest) listDir(id fuseops.InodeID) []string {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	err := t.ifs.OpenDir(t.ctx, openOp)
+	AssertEq(nil, err)
+
+	defer t.ifs.ReleaseDirHandle(
+		t.ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	readOp := &fuseops.ReadDirOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 4096),
+	}
+
+	err = t.ifs.ReadDir(t.ctx, readOp)
+	AssertEq(nil, err)
+
+	return names(parseDirents(readOp.Dst[:readOp.BytesRead]))
+}
+
+func (t *ControlTest) readFile(id fuseops.InodeID) string {
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	err := t.ifs.OpenFile(t.ctx, openOp)
+	AssertEq(nil, err)
+
+	defer t.ifs.ReleaseFileHandle(
+		t.ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 4096),
+	}
+
+	err = t.ifs.ReadFile(t.ctx, readOp)
+	AssertEq(nil, err)
+
+	return string(readOp.Dst[:readOp.BytesRead])
+}
+
+func (t *ControlTest) writeFile(id fuseops.InodeID, data string) error {
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	err := t.ifs.OpenFile(t.ctx, openOp)
+	AssertEq(nil, err)
+
+	defer t.ifs.ReleaseFileHandle(
+		t.ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	return t.ifs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{
+			Inode:  id,
+			Handle: openOp.Handle,
+			Data:   []byte(data),
+		})
+}
+
+// Look up the file with the supplied path, then overwrite its object behind
+// the file system's back, returning its ID.
+func (t *ControlTest) lookUpAndClobber(names ...string) fuseops.InodeID {
+	var parent fuseops.InodeID = fuseops.RootInodeID
+	for _, n := range names {
+		entry, err := t.lookUp(parent, n)
+		AssertEq(nil, err)
+		parent = entry.Child
+	}
+
+	AssertEq(0, t.size(parent))
+
+	name := names[0]
+	for _, n := range names[1:] {
+		name += "/" + n
+	}
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("taco"))
+	AssertEq(nil, err)
+
+	return parent
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ControlTest) LookedUpButNotListed() {
+	entry, err := t.lookUp(fuseops.RootInodeID, controlDirName)
+	AssertEq(nil, err)
+	ExpectEq(controlDirInodeID, entry.Child)
+	ExpectTrue(entry.Attributes.Mode.IsDir())
+
+	ExpectThat(t.listDir(fuseops.RootInodeID), ElementsAre("bar", "dir"))
+}
+
+func (t *ControlTest) Contents() {
+	ExpectThat(
+		t.listDir(controlDirInodeID),
+		ElementsAre("config", "flush_caches", "invalidate", "stats"))
+
+	entry, err := t.lookUp(controlDirInodeID, "stats")
+	AssertEq(nil, err)
+	ExpectEq(controlStatsInodeID, entry.Child)
+	ExpectEq(0444, entry.Attributes.Mode)
+
+	entry, err = t.lookUp(controlDirInodeID, "flush_caches")
+	AssertEq(nil, err)
+	ExpectEq(0222, entry.Attributes.Mode)
+
+	_, err = t.lookUp(controlDirInodeID, "baz")
+	ExpectEq(syscall.ENOENT, err)
+}
+
+func (t *ControlTest) Config() {
+	ExpectEq("Foo: bar\n", t.readFile(controlConfigInodeID))
+}
+
+func (t *ControlTest) Stats() {
+	_, err := t.lookUp(fuseops.RootInodeID, "bar")
+	AssertEq(nil, err)
+
+	stats := t.readFile(controlStatsInodeID)
+	ExpectThat(stats, HasSubstr("inodes: 2\n"))
+	ExpectThat(stats, HasSubstr("open handles: 0\n"))
+	ExpectThat(stats, HasSubstr("dirty files: 0 (0 bytes)\n"))
+}
+
+func (t *ControlTest) Stats_DirtyFile() {
+	entry, err := t.lookUp(fuseops.RootInodeID, "bar")
+	AssertEq(nil, err)
+
+	err = t.writeFile(entry.Child, "taco")
+	AssertEq(nil, err)
+
+	stats := t.readFile(controlStatsInodeID)
+	ExpectThat(stats, HasSubstr("dirty files: 1 (4 bytes)\n"))
+	ExpectThat(stats, HasSubstr("busy files: 0\n"))
+}
+
+func (t *ControlTest) ReadOnly() {
+	var err error
+
+	err = t.ifs.MkDir(
+		t.ctx,
+		&fuseops.MkDirOp{Parent: controlDirInodeID, Name: "foo"})
+	ExpectEq(syscall.EROFS, err)
+
+	err = t.ifs.CreateFile(
+		t.ctx,
+		&fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: controlDirName})
+	ExpectEq(syscall.EROFS, err)
+
+	err = t.ifs.Unlink(
+		t.ctx,
+		&fuseops.UnlinkOp{Parent: controlDirInodeID, Name: "stats"})
+	ExpectEq(syscall.EROFS, err)
+
+	err = t.ifs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   "bar",
+			NewParent: controlDirInodeID,
+			NewName:   "bar",
+		})
+	ExpectEq(syscall.EROFS, err)
+
+	err = t.writeFile(controlStatsInodeID, "foo")
+	ExpectEq(syscall.EROFS, err)
+}
+
+func (t *ControlTest) FlushCaches() {
+	bar := t.lookUpAndClobber("bar")
+	foo := t.lookUpAndClobber("dir", "foo")
+
+	// The stale sizes are cached.
+	ExpectEq(0, t.size(bar))
+	ExpectEq(0, t.size(foo))
+
+	// Until the caches are flushed.
+	err := t.writeFile(controlFlushCachesInodeID, "1\n")
+	AssertEq(nil, err)
+
+	ExpectEq(len("taco"), t.size(bar))
+	ExpectEq(len("taco"), t.size(foo))
+}
+
+func (t *ControlTest) InvalidatePath() {
+	bar := t.lookUpAndClobber("bar")
+	foo := t.lookUpAndClobber("dir", "foo")
+
+	// Look up dir/foo within the invalidate directory.
+	entry, err := t.lookUp(controlInvalidateInodeID, "dir")
+	AssertEq(nil, err)
+	ExpectTrue(entry.Attributes.Mode.IsDir())
+
+	dir := entry.Child
+	entry, err = t.lookUp(dir, "foo")
+	AssertEq(nil, err)
+	ExpectNe(dir, entry.Child)
+
+	// Only that file should have been affected.
+	ExpectEq(0, t.size(bar))
+	ExpectEq(len("taco"), t.size(foo))
+
+	// Looking up the same path again should give the same ID, until the
+	// kernel forgets it.
+	again, err := t.lookUp(controlInvalidateInodeID, "dir")
+	AssertEq(nil, err)
+	ExpectEq(dir, again.Child)
+
+	err = t.ifs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: dir, N: 2})
+	AssertEq(nil, err)
+	ExpectEq("", t.fs.control.invalidatedPath(dir))
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// Is the supplied op one that transfers file contents, as opposed to one
+// that only concerns metadata?
+func isDataOp(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ReadFileOp,
+		*fuseops.WriteFileOp,
+		*fuseops.SyncFileOp,
+		*fuseops.FlushFileOp:
+		return true
+	}
+
+	return false
+}
+
+// Return an opInterceptor that runs each op with a deadline of metadataTimeout
+// or dataTimeout after it starts, according to isDataOp. A zero timeout means
+// no deadline. An op that fails after its deadline has passed returns
+// ETIMEDOUT, since the underlying error is most likely the cancellation of
+// the GCS request that it was waiting on.
+func applyOpDeadlines(metadataTimeout, dataTimeout time.Duration) opInterceptor {
+	return func(
+		ctx context.Context,
+		op interface{},
+		next func(context.Context) error) (err error) {
+		timeout := metadataTimeout
+		if isDataOp(op) {
+			timeout = dataTimeout
+		}
+
+		if timeout == 0 {
+			err = next(ctx)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err = next(ctx)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			logger.Warningf(
+				"%s timed out after %v: %v",
+				describeOp(op),
+				timeout,
+				err)
+
+			err = syscall.ETIMEDOUT
+		}
+
+		return
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"golang.org/x/net/context"
+)
+
+// An opInterceptor that logs a one-line summary of each operation once it
+// completes, including its latency and the errno with which it failed.
+func logOp(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) (err error) {
+	start := time.Now()
+	err = next(ctx)
+
+	logger.Debugf(
+		"%s -> %s (%v)",
+		describeOp(op),
+		describeOpErr(err),
+		time.Since(start))
+
+	return
+}
+
+// Return e.g. `LookUpInode(inode=1, name="foo")`.
+func describeOp(op interface{}) string {
+	var buf bytes.Buffer
+
+	inode, name := opDetails(op)
+	fmt.Fprintf(&buf, "%s(inode=%d", opName(op), inode)
+	if name != "" {
+		fmt.Fprintf(&buf, ", name=%q", name)
+	}
+
+	buf.WriteString(")")
+	return buf.String()
+}
+
+// Describe the outcome of an op in terms of the errno that the kernel will
+// see. Package fuse responds with EIO for errors that aren't errnos.
+func describeOpErr(err error) string {
+	if err == nil {
+		return "OK"
+	}
+
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return fmt.Sprintf("errno %d (EIO): %v", syscall.EIO, err)
+	}
+
+	return fmt.Sprintf("errno %d: %v", errno, errno)
+}
@@ -17,6 +17,7 @@ package fs
 import (
 	"fmt"
 	"sort"
+	"strings"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/jacobsa/fuse"
@@ -35,37 +36,80 @@ type dirHandle struct {
 	in           inode.DirInode
 	implicitDirs bool
 
+	// Return directories before other entries, rather than ordering all entries
+	// by name.
+	dirsFirst bool
+
+	// Names to leave out of the listing.
+	hidden []string
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
 	Mu syncutil.InvariantMutex
 
-	// All entries in the directory. Populated the first time we need one.
+	// The window of the listing that we have buffered, usually produced from a
+	// single page of GCS results, so that directories with many entries needn't
+	// be held in memory. entries[i] is the entry at index start+i, and has the
+	// offset of the entry following it.
 	//
-	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
+	// INVARIANT: For each i, entries[i].Offset == start + i + 1
 	//
 	// GUARDED_BY(Mu)
 	entries []fuseutil.Dirent
+	start   int
 
-	// Has entries yet been populated?
+	// The state from which to read the entries following the window.
 	//
-	// INVARIANT: If !entriesValid, then len(entries) == 0
+	// GUARDED_BY(Mu)
+	next listingState
+
+	// The state from which each window that we have read was produced, keyed
+	// by the index of its first entry, so that we can seek backward.
+	//
+	// INVARIANT: checkpoints[0] exists
 	//
 	// GUARDED_BY(Mu)
-	entriesValid bool
+	checkpoints map[int]listingState
+}
+
+// The state of a listing between pages, from which it can be resumed.
+type listingState struct {
+	// The continuation token for the next page, or empty for the first.
+	tok string
+
+	// Have we read the last page?
+	done bool
+
+	// The greatest object name or collapsed run seen so far.
+	pos string
+
+	// Entries for files and symlinks that have been read but not yet returned,
+	// because an entry for a directory with the same name may be yet to come.
+	// Not modified once set.
+	pending []fuseutil.Dirent
 }
 
 // Create a directory handle that obtains listings from the supplied inode.
+// Entries are ordered by name, or with dirsFirst ordered by name among
+// directories followed by other entries ordered by name. Entries with names
+// in hidden are left out.
 func newDirHandle(
 	in inode.DirInode,
-	implicitDirs bool) (dh *dirHandle) {
+	implicitDirs bool,
+	dirsFirst bool,
+	hidden []string) (dh *dirHandle) {
 	// Set up the basic struct.
 	dh = &dirHandle{
 		in:           in,
 		implicitDirs: implicitDirs,
+		dirsFirst:    dirsFirst,
+		hidden:       hidden,
 	}
 
+	dh.reset()
+
 	// Set up invariant checking.
 	dh.Mu = syncutil.NewInvariantMutex(dh.checkInvariants)
 
@@ -83,24 +127,44 @@ func (p sortedDirents) Len() int           { return len(p) }
 func (p sortedDirents) Less(i, j int) bool { return p[i].Name < p[j].Name }
 func (p sortedDirents) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// Dirents, with directories before everything else. Use with sort.Stable to
+// preserve an existing order within each group.
+type dirsFirstDirents []fuseutil.Dirent
+
+func (p dirsFirstDirents) Len() int { return len(p) }
+func (p dirsFirstDirents) Less(i, j int) bool {
+	return p[i].Type == fuseutil.DT_Directory && p[j].Type != fuseutil.DT_Directory
+}
+func (p dirsFirstDirents) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
 func (dh *dirHandle) checkInvariants() {
-	// INVARIANT: For each i, entries[i+1].Offset == entries[i].Offset + 1
-	for i := 0; i < len(dh.entries)-1; i++ {
-		if !(dh.entries[i+1].Offset == dh.entries[i].Offset+1) {
+	// INVARIANT: For each i, entries[i].Offset == start + i + 1
+	for i, e := range dh.entries {
+		if e.Offset != fuseops.DirOffset(dh.start+i+1) {
 			panic(
 				fmt.Sprintf(
-					"Unexpected offset sequence: %v, %v",
-					dh.entries[i].Offset,
-					dh.entries[i+1].Offset))
+					"Unexpected offset for index %v: %v",
+					dh.start+i,
+					e.Offset))
 		}
 	}
 
-	// INVARIANT: If !entriesValid, then len(entries) == 0
-	if !dh.entriesValid && len(dh.entries) != 0 {
-		panic("Unexpected non-empty entries slice")
+	// INVARIANT: checkpoints[0] exists
+	if _, ok := dh.checkpoints[0]; !ok {
+		panic("Missing initial checkpoint")
 	}
 }
 
+// The name under which the supplied entry was listed, for comparison with
+// listingState.pos.
+func listingKey(e fuseutil.Dirent) string {
+	if e.Type == fuseutil.DT_Directory {
+		return e.Name + "/"
+	}
+
+	return e.Name
+}
+
 // Resolve name conflicts between file objects and directory objects (e.g. the
 // objects "foo/bar" and "foo/bar/") by appending U+000A, which is illegal in
 // GCS object names, to conflicting file names.
@@ -154,13 +218,14 @@ func fixConflictingNames(entries []fuseutil.Dirent) (err error) {
 	return
 }
 
-// Read all entries for the directory, fix up conflicting names, and fill in
-// offset fields.
+// Read all entries for the directory, fix up conflicting names, and put them
+// in the order described by newDirHandle.
 //
 // LOCKS_REQUIRED(in)
 func readAllEntries(
 	ctx context.Context,
-	in inode.DirInode) (entries []fuseutil.Dirent, err error) {
+	in inode.DirInode,
+	dirsFirst bool) (entries []fuseutil.Dirent, err error) {
 	// Read one batch at a time.
 	var tok string
 	for {
@@ -193,9 +258,158 @@ func readAllEntries(
 		return
 	}
 
-	// Fix up offset fields.
-	for i := 0; i < len(entries); i++ {
-		entries[i].Offset = fuseops.DirOffset(i) + 1
+	// Move directories to the front if requested, keeping the order by name
+	// within each group.
+	if dirsFirst {
+		sort.Stable(dirsFirstDirents(entries))
+	}
+
+	return
+}
+
+// Read the page of entries following the supplied state, returning those
+// that are ready to be returned, ordered by name, and the state from which to
+// continue.
+//
+// A file or symlink is ready once we know whether a directory with the same
+// name exists, so that we can fix up the conflict. GCS lists in order of
+// object name, and the name of a directory's placeholder object or collapsed
+// run is that of the file followed by a slash, so we know this once the
+// listing has passed that name.
+//
+// LOCKS_REQUIRED(in)
+func readPage(
+	ctx context.Context,
+	in inode.DirInode,
+	s listingState) (entries []fuseutil.Dirent, next listingState, err error) {
+	batch, tok, err := in.ReadEntries(ctx, s.tok)
+	if err != nil {
+		err = fmt.Errorf("ReadEntries: %v", err)
+		return
+	}
+
+	next.tok = tok
+	next.done = tok == ""
+	next.pos = s.pos
+	for _, e := range batch {
+		if k := listingKey(e); k > next.pos {
+			next.pos = k
+		}
+	}
+
+	// Fix name conflicts among the new entries and those held back.
+	candidates := make([]fuseutil.Dirent, 0, len(s.pending)+len(batch))
+	candidates = append(candidates, s.pending...)
+	candidates = append(candidates, batch...)
+	sort.Sort(sortedDirents(candidates))
+
+	err = fixConflictingNames(candidates)
+	if err != nil {
+		err = fmt.Errorf("fixConflictingNames: %v", err)
+		return
+	}
+
+	// Hold back files that may yet turn out to conflict.
+	for _, e := range candidates {
+		undecided := !next.done &&
+			e.Type != fuseutil.DT_Directory &&
+			!strings.HasSuffix(e.Name, inode.ConflictingFileNameSuffix) &&
+			e.Name+"/" > next.pos
+
+		if undecided {
+			next.pending = append(next.pending, e)
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+// Discard all state, so that the listing starts again from the beginning.
+//
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) reset() {
+	dh.entries = nil
+	dh.start = 0
+	dh.next = listingState{}
+	dh.checkpoints = map[int]listingState{0: dh.next}
+}
+
+// Is the supplied name to be left out of the listing?
+func (dh *dirHandle) isHidden(name string) bool {
+	for _, h := range dh.hidden {
+		if name == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Seek backward so that the window is empty and starts at or before the
+// given index.
+//
+// LOCKS_REQUIRED(dh.Mu)
+func (dh *dirHandle) rewind(index int) {
+	best := 0
+	for i := range dh.checkpoints {
+		if i <= index && i > best {
+			best = i
+		}
+	}
+
+	dh.entries = nil
+	dh.start = best
+	dh.next = dh.checkpoints[best]
+}
+
+// Replace the window with the entries that follow it. The new window may be
+// empty if the page read contained only entries that must be held back.
+//
+// LOCKS_REQUIRED(dh.Mu)
+// LOCKS_EXCLUDED(dh.in)
+func (dh *dirHandle) readWindow(ctx context.Context) (err error) {
+	dh.in.Lock()
+	defer dh.in.Unlock()
+
+	start := dh.start + len(dh.entries)
+
+	// Read entries. Ordering directories first requires all of them.
+	var entries []fuseutil.Dirent
+	var next listingState
+	if dh.dirsFirst {
+		entries, err = readAllEntries(ctx, dh.in, true)
+		if err != nil {
+			err = fmt.Errorf("readAllEntries: %v", err)
+			return
+		}
+
+		next.done = true
+	} else {
+		entries, next, err = readPage(ctx, dh.in, dh.next)
+		if err != nil {
+			err = fmt.Errorf("readPage: %v", err)
+			return
+		}
+	}
+
+	// Leave out the hidden names.
+	if len(dh.hidden) > 0 {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !dh.isHidden(e.Name) {
+				kept = append(kept, e)
+			}
+		}
+
+		entries = kept
+	}
+
+	// Fill in offset fields.
+	for i := range entries {
+		entries[i].Offset = fuseops.DirOffset(start+i) + 1
 	}
 
 	// Return a bogus inode ID for each entry, but not the root inode ID.
@@ -215,26 +429,11 @@ func readAllEntries(
 		entries[i].Inode = fuseops.RootInodeID + 1
 	}
 
-	return
-}
-
-// LOCKS_REQUIRED(dh.Mu)
-// LOCKS_EXCLUDED(dh.in)
-func (dh *dirHandle) ensureEntries(ctx context.Context) (err error) {
-	dh.in.Lock()
-	defer dh.in.Unlock()
-
-	// Read entries.
-	var entries []fuseutil.Dirent
-	entries, err = readAllEntries(ctx, dh.in)
-	if err != nil {
-		err = fmt.Errorf("readAllEntries: %v", err)
-		return
-	}
-
 	// Update state.
+	dh.checkpoints[start] = dh.next
 	dh.entries = entries
-	dh.entriesValid = true
+	dh.start = start
+	dh.next = next
 
 	return
 }
@@ -257,28 +456,37 @@ func (dh *dirHandle) ReadDir(
 	// If the request is for offset zero, we assume that either this is the first
 	// call or rewinddir has been called. Reset state.
 	if op.Offset == 0 {
-		dh.entries = nil
-		dh.entriesValid = false
+		dh.reset()
 	}
 
-	// Do we need to read entries from GCS?
-	if !dh.entriesValid {
-		err = dh.ensureEntries(ctx)
-		if err != nil {
+	// Move the window until it contains the requested offset, reading from GCS
+	// as necessary.
+	index := int(op.Offset)
+	for index < dh.start || index >= dh.start+len(dh.entries) {
+		switch {
+		case index < dh.start:
+			dh.rewind(index)
+
+		case dh.next.done:
+			// Is the offset past the end of the listing? If so, this must be an
+			// invalid seekdir according to posix. Otherwise there's nothing left.
+			if index > dh.start+len(dh.entries) {
+				err = fuse.EINVAL
+			}
+
 			return
-		}
-	}
 
-	// Is the offset past the end of what we have buffered? If so, this must be
-	// an invalid seekdir according to posix.
-	index := int(op.Offset)
-	if index > len(dh.entries) {
-		err = fuse.EINVAL
-		return
+		default:
+			err = dh.readWindow(ctx)
+			if err != nil {
+				err = fmt.Errorf("readWindow: %v", err)
+				return
+			}
+		}
 	}
 
 	// We copy out entries until we run out of entries or space.
-	for i := index; i < len(dh.entries); i++ {
+	for i := index - dh.start; i < len(dh.entries); i++ {
 		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], dh.entries[i])
 		if n == 0 {
 			break
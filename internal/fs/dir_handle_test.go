@@ -0,0 +1,255 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDirHandle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The number of results in each page of a listing from the fake bucket.
+const fakeListingPageSize = 1000
+
+type DirHandleTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	dh     *dirHandle
+}
+
+var _ SetUpInterface = &DirHandleTest{}
+
+func init() { RegisterTestSuite(&DirHandleTest{}) }
+
+func (t *DirHandleTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	in := inode.NewDirInode(
+		fuseops.RootInodeID,
+		"",
+		fuseops.InodeAttributes{},
+		true, // implicitDirs
+		nil,
+		false, // caseInsensitive
+		nil,
+		false, // hideDeniedDirs
+		false, // flat
+		0,     // typeCacheTTL
+		0,     // attrCacheTTL
+		0,     // listingCacheTTL
+		t.bucket,
+		nil, // folders
+		&t.clock,
+		&t.clock)
+
+	t.dh = newDirHandle(in, true, false, nil)
+}
+
+// Create empty objects with the given names.
+func (t *DirHandleTest) createObjects(names []string) {
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, names)
+	AssertEq(nil, err)
+}
+
+// Call ReadDir once with a small buffer, returning the entries it produced.
+func (t *DirHandleTest) readDir(
+	offset fuseops.DirOffset) (entries []fuseutil.Dirent, err error) {
+	op := &fuseops.ReadDirOp{
+		Offset: offset,
+		Dst:    make([]byte, 4096),
+	}
+
+	t.dh.Mu.Lock()
+	err = t.dh.ReadDir(t.ctx, op)
+	t.dh.Mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	entries = parseDirents(op.Dst[:op.BytesRead])
+	return
+}
+
+// Read entries starting at the given offset until the end of the directory.
+func (t *DirHandleTest) readFrom(
+	offset fuseops.DirOffset) (entries []fuseutil.Dirent, err error) {
+	for {
+		var batch []fuseutil.Dirent
+		batch, err = t.readDir(offset)
+		if err != nil || len(batch) == 0 {
+			return
+		}
+
+		// The window should never hold much more than a page.
+		AssertLe(len(t.dh.entries), fakeListingPageSize)
+
+		entries = append(entries, batch...)
+		offset = batch[len(batch)-1].Offset
+	}
+}
+
+// Decode the format written by fuseutil.WriteDirent.
+func parseDirents(buf []byte) (entries []fuseutil.Dirent) {
+	const headerSize = 24
+	for len(buf) > 0 {
+		namelen := int(binary.LittleEndian.Uint32(buf[16:]))
+		e := fuseutil.Dirent{
+			Inode:  fuseops.InodeID(binary.LittleEndian.Uint64(buf[0:])),
+			Offset: fuseops.DirOffset(binary.LittleEndian.Uint64(buf[8:])),
+			Type:   fuseutil.DirentType(binary.LittleEndian.Uint32(buf[20:])),
+			Name:   string(buf[headerSize : headerSize+namelen]),
+		}
+
+		entries = append(entries, e)
+
+		n := (headerSize + namelen + 7) &^ 7
+		buf = buf[n:]
+	}
+
+	return
+}
+
+func names(entries []fuseutil.Dirent) (names []string) {
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirHandleTest) Empty() {
+	entries, err := t.readFrom(0)
+	AssertEq(nil, err)
+	ExpectThat(entries, ElementsAre())
+}
+
+func (t *DirHandleTest) HiddenName() {
+	t.createObjects([]string{"bar", "foo/", "qux"})
+	t.dh.hidden = []string{"foo"}
+
+	entries, err := t.readFrom(0)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("bar", entries[0].Name)
+	ExpectEq("qux", entries[1].Name)
+	ExpectEq(2, entries[1].Offset)
+}
+
+func (t *DirHandleTest) ManyPages() {
+	const n = 5*fakeListingPageSize/2 + 1
+
+	var objs []string
+	for i := 0; i < n; i++ {
+		objs = append(objs, fmt.Sprintf("file%05d", i))
+	}
+
+	t.createObjects(objs)
+
+	// All entries should be returned in order, with consecutive offsets.
+	entries, err := t.readFrom(0)
+	AssertEq(nil, err)
+	AssertEq(n, len(entries))
+
+	for i, e := range entries {
+		ExpectEq(objs[i], e.Name)
+		ExpectEq(fuseops.DirOffset(i+1), e.Offset)
+		ExpectEq(fuseutil.DT_File, e.Type)
+	}
+}
+
+func (t *DirHandleTest) ConflictSpanningPages() {
+	// Fill the first page so that the file "foo" comes last in it, and the
+	// collapsed run "foo/" in the next.
+	var objs []string
+	for i := 0; i < fakeListingPageSize-1; i++ {
+		objs = append(objs, fmt.Sprintf("bar%05d", i))
+	}
+
+	objs = append(objs, "foo", "foo/baz")
+	t.createObjects(objs)
+
+	entries, err := t.readFrom(0)
+	AssertEq(nil, err)
+	AssertEq(fakeListingPageSize+1, len(entries))
+
+	tail := entries[fakeListingPageSize-1:]
+	ExpectThat(names(tail), ElementsAre("foo\n", "foo"))
+	ExpectEq(fuseutil.DT_File, tail[0].Type)
+	ExpectEq(fuseutil.DT_Directory, tail[1].Type)
+}
+
+func (t *DirHandleTest) SeekBackward() {
+	const n = 2*fakeListingPageSize + 1
+
+	var objs []string
+	for i := 0; i < n; i++ {
+		objs = append(objs, fmt.Sprintf("file%05d", i))
+	}
+
+	t.createObjects(objs)
+
+	// Read to the end, then seek back into the first page.
+	_, err := t.readFrom(0)
+	AssertEq(nil, err)
+
+	const offset = 17
+	entries, err := t.readFrom(offset)
+	AssertEq(nil, err)
+	AssertEq(n-offset, len(entries))
+	ExpectEq(objs[offset], entries[0].Name)
+	ExpectEq(objs[n-1], entries[len(entries)-1].Name)
+}
+
+func (t *DirHandleTest) SeekPastEnd() {
+	t.createObjects([]string{"foo", "bar"})
+
+	_, err := t.readFrom(0)
+	AssertEq(nil, err)
+
+	// Offset 2 is the end; anything beyond is invalid.
+	entries, err := t.readDir(2)
+	AssertEq(nil, err)
+	ExpectThat(entries, ElementsAre())
+
+	_, err = t.readDir(3)
+	ExpectEq(fuse.EINVAL, err)
+}
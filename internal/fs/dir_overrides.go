@@ -0,0 +1,197 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// Settings that apply to a directory and everything beneath it in place of
+// those for the whole file system. Where several overrides apply, the one for
+// the deepest directory wins.
+type DirOverride struct {
+	// The name of the directory relative to the root of the file system, with
+	// a trailing slash, e.g. "static/".
+	Prefix string
+
+	// If non-nil, used in place of ServerConfig.InodeAttributeCacheTTL and
+	// DirTypeCacheTTL.
+	InodeAttributeCacheTTL *time.Duration
+	DirTypeCacheTTL        *time.Duration
+
+	// If non-nil, used in place of ServerConfig.NameFilter.
+	NameFilter *inode.NameFilter
+
+	// If set, ops that would modify the directory or anything beneath it fail
+	// with EROFS.
+	ReadOnly bool
+}
+
+// Does the override apply to the supplied name, which is that of an inode
+// or the full name of a child?
+func (o *DirOverride) applies(name string) bool {
+	return strings.HasPrefix(strings.TrimSuffix(name, "/")+"/", o.Prefix)
+}
+
+// Order the supplied overrides deepest first, so that the first to apply to a
+// name is the one that wins.
+func sortDirOverrides(overrides []DirOverride) []DirOverride {
+	sorted := append([]DirOverride(nil), overrides...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+
+	return sorted
+}
+
+// Return the override for the supplied name, or nil if there is none.
+func (fs *fileSystem) dirOverrideFor(name string) *DirOverride {
+	for i := range fs.dirOverrides {
+		if fs.dirOverrides[i].applies(name) {
+			return &fs.dirOverrides[i]
+		}
+	}
+
+	return nil
+}
+
+// Return the cache TTLs and name filter for the inode with the supplied name.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) settingsFor(name string) (
+	attributes time.Duration,
+	types time.Duration,
+	filter *inode.NameFilter) {
+	attributes = fs.inodeAttributeCacheTTL
+	types = fs.dirTypeCacheTTL
+	filter = fs.nameFilter
+
+	o := fs.dirOverrideFor(name)
+	if o == nil {
+		return
+	}
+
+	if o.InodeAttributeCacheTTL != nil {
+		attributes = *o.InodeAttributeCacheTTL
+	}
+
+	if o.DirTypeCacheTTL != nil {
+		types = *o.DirTypeCacheTTL
+	}
+
+	if o.NameFilter != nil {
+		filter = o.NameFilter
+	}
+
+	return
+}
+
+// Is the inode with the supplied ID within a read-only directory?
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) inReadOnlyDir(id fuseops.InodeID) bool {
+	fs.mu.Lock()
+	in := fs.inodes[id]
+	fs.mu.Unlock()
+
+	if in == nil {
+		return false
+	}
+
+	o := fs.dirOverrideFor(in.Name())
+	return o != nil && o.ReadOnly
+}
+
+// Is the named child of the supplied parent a read-only directory, or within
+// one?
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) isReadOnlyChild(
+	parent fuseops.InodeID,
+	name string) bool {
+	fs.mu.Lock()
+	in := fs.inodes[parent]
+	fs.mu.Unlock()
+
+	if in == nil {
+		return false
+	}
+
+	o := fs.dirOverrideFor(in.Name() + name)
+	return o != nil && o.ReadOnly
+}
+
+// An opInterceptor that fails ops that would modify read-only directories or
+// their contents with EROFS.
+func (fs *fileSystem) protectReadOnlyDirs(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) (err error) {
+	var modifies bool
+	switch typed := op.(type) {
+	case *fuseops.MkDirOp:
+		modifies = fs.isReadOnlyChild(typed.Parent, typed.Name)
+
+	case *fuseops.MkNodeOp:
+		modifies = fs.isReadOnlyChild(typed.Parent, typed.Name)
+
+	case *fuseops.CreateFileOp:
+		modifies = fs.isReadOnlyChild(typed.Parent, typed.Name)
+
+	case *fuseops.CreateSymlinkOp:
+		modifies = fs.isReadOnlyChild(typed.Parent, typed.Name)
+
+	case *fuseops.UnlinkOp:
+		modifies = fs.isReadOnlyChild(typed.Parent, typed.Name)
+
+	case *fuseops.RmDirOp:
+		modifies = fs.isReadOnlyChild(typed.Parent, typed.Name)
+
+	case *fuseops.RenameOp:
+		modifies = fs.isReadOnlyChild(typed.OldParent, typed.OldName) ||
+			fs.isReadOnlyChild(typed.NewParent, typed.NewName)
+
+	case *fuseops.SetInodeAttributesOp:
+		modifies = (typed.Size != nil || typed.Mtime != nil) &&
+			fs.inReadOnlyDir(typed.Inode)
+
+	case *fuseops.WriteFileOp:
+		modifies = fs.inReadOnlyDir(typed.Inode)
+
+	case *fuseops.FallocateOp:
+		modifies = fs.inReadOnlyDir(typed.Inode)
+
+	case *fuseops.SetXattrOp:
+		modifies = fs.inReadOnlyDir(typed.Inode)
+
+	case *fuseops.RemoveXattrOp:
+		modifies = fs.inReadOnlyDir(typed.Inode)
+	}
+
+	if modifies {
+		err = syscall.EROFS
+		return
+	}
+
+	err = next(ctx)
+	return
+}
@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDirOverrides(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DirOverridesTest struct {
+	directFsTest
+	clock timeutil.SimulatedClock
+}
+
+func init() { RegisterTestSuite(&DirOverridesTest{}) }
+
+func (t *DirOverridesTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.serverCfg.CacheClock = &t.clock
+
+	hour := time.Hour
+	none := time.Duration(0)
+
+	partFilter, err := inode.NewNameFilter([]string{"*.part"}, nil)
+	AssertEq(nil, err)
+
+	// Caching is disabled except beneath static/, where it is disabled again
+	// beneath static/live/.
+	t.serverCfg.DirOverrides = []DirOverride{
+		{
+			Prefix:                 "static/",
+			InodeAttributeCacheTTL: &hour,
+			DirTypeCacheTTL:        &hour,
+			ReadOnly:               true,
+		},
+		{
+			Prefix:                 "static/live/",
+			InodeAttributeCacheTTL: &none,
+		},
+		{
+			Prefix:     "incoming/",
+			NameFilter: partFilter,
+		},
+	}
+
+	t.directFsTest.SetUp(ti)
+
+	// Create some objects.
+	for _, name := range []string{
+		"foo",
+		"foo.part",
+		"static/",
+		"static/foo",
+		"static/live/",
+		"static/live/foo",
+		"incoming/",
+		"incoming/foo",
+		"incoming/foo.part",
+	} {
+		_, err = gcsutil.CreateObject(t.ctx, t.bucket, name, []byte("taco"))
+		AssertEq(nil, err)
+	}
+}
+
+// Look up the supplied path, one component at a time, returning the first
+// error.
+func (t *DirOverridesTest) walk(
+	names ...string) (e fuseops.ChildInodeEntry, err error) {
+	e.Child = fuseops.RootInodeID
+	for _, name := range names {
+		e, err = t.lookUpIn(e.Child, name)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Run the supplied op through the read-only interceptor, returning the error
+// it fails with or nil if it would have been served.
+func (t *DirOverridesTest) intercept(op interface{}) error {
+	return t.fs.protectReadOnlyDirs(
+		t.ctx,
+		op,
+		func(context.Context) error { return nil })
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirOverridesTest) CacheTTLs() {
+	e, err := t.walk("foo")
+	AssertEq(nil, err)
+	ExpectTrue(e.AttributesExpiration.IsZero())
+
+	e, err = t.walk("static", "foo")
+	AssertEq(nil, err)
+	ExpectFalse(e.AttributesExpiration.IsZero())
+
+	e, err = t.walk("static", "live", "foo")
+	AssertEq(nil, err)
+	ExpectTrue(e.AttributesExpiration.IsZero())
+}
+
+func (t *DirOverridesTest) CacheTTLsKeptOnReload() {
+	// Make sure some of the inodes already exist.
+	_, err := t.walk("static", "live", "foo")
+	AssertEq(nil, err)
+
+	t.server.SetCacheTTLs(time.Minute, time.Minute)
+
+	e, err := t.walk("foo")
+	AssertEq(nil, err)
+	ExpectFalse(e.AttributesExpiration.IsZero())
+
+	e, err = t.walk("static", "foo")
+	AssertEq(nil, err)
+	ExpectTrue(e.AttributesExpiration.After(time.Now().Add(30 * time.Minute)))
+
+	e, err = t.walk("static", "live", "foo")
+	AssertEq(nil, err)
+	ExpectTrue(e.AttributesExpiration.IsZero())
+}
+
+func (t *DirOverridesTest) NameFilter() {
+	var err error
+
+	_, err = t.walk("foo.part")
+	ExpectEq(nil, err)
+
+	_, err = t.walk("incoming", "foo")
+	ExpectEq(nil, err)
+
+	_, err = t.walk("incoming", "foo.part")
+	ExpectEq(syscall.ENOENT, err)
+}
+
+func (t *DirOverridesTest) ReadOnly() {
+	static, err := t.walk("static")
+	AssertEq(nil, err)
+
+	file, err := t.walk("static", "foo")
+	AssertEq(nil, err)
+
+	other, err := t.walk("foo")
+	AssertEq(nil, err)
+
+	size := uint64(0)
+
+	// Modifying the directory itself, or anything in it, should fail.
+	ExpectEq(syscall.EROFS, t.intercept(&fuseops.RmDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "static",
+	}))
+
+	ExpectEq(syscall.EROFS, t.intercept(&fuseops.CreateFileOp{
+		Parent: static.Child,
+		Name:   "bar",
+	}))
+
+	ExpectEq(syscall.EROFS, t.intercept(&fuseops.UnlinkOp{
+		Parent: static.Child,
+		Name:   "foo",
+	}))
+
+	ExpectEq(syscall.EROFS, t.intercept(&fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: static.Child,
+		NewName:   "foo",
+	}))
+
+	ExpectEq(syscall.EROFS, t.intercept(&fuseops.WriteFileOp{
+		Inode: file.Child,
+	}))
+
+	ExpectEq(syscall.EROFS, t.intercept(&fuseops.SetInodeAttributesOp{
+		Inode: file.Child,
+		Size:  &size,
+	}))
+
+	// Reading is fine, as is modifying things elsewhere, including names that
+	// merely begin with the name of the directory.
+	ExpectEq(nil, t.intercept(&fuseops.ReadFileOp{Inode: file.Child}))
+	ExpectEq(nil, t.intercept(&fuseops.WriteFileOp{Inode: other.Child}))
+
+	ExpectEq(nil, t.intercept(&fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "static2",
+	}))
+}
@@ -0,0 +1,169 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// A struct that can be embedded to inherit common behaviors for tests that
+// call the file system's methods directly as the kernel would, rather than
+// mounting it as fsTest does. This lets them control the order in which ops
+// arrive and inspect the file system's internal state.
+type directFsTest struct {
+	ctx context.Context
+
+	// Configuration. Fields left unset when SetUp is called are filled in with
+	// defaults; in particular Bucket defaults to the bucket below.
+	serverCfg ServerConfig
+
+	// Dependencies. If bucket is set before SetUp is called, it will be used
+	// rather than creating a default one. Tests create and modify objects
+	// through it, behind the back of any caching in serverCfg.Bucket.
+	bucket gcs.Bucket
+
+	// The file system under test, created from serverCfg.
+	server Server
+	fs     *fileSystem
+}
+
+var _ SetUpInterface = &directFsTest{}
+var _ TearDownInterface = &directFsTest{}
+
+func (t *directFsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	syncutil.EnableInvariantChecking()
+
+	// Set up the bucket.
+	if t.bucket == nil {
+		t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	}
+
+	if t.serverCfg.Bucket == nil {
+		t.serverCfg.Bucket = t.bucket
+	}
+
+	if t.serverCfg.CacheClock == nil {
+		t.serverCfg.CacheClock = timeutil.RealClock()
+	}
+
+	// Set up permissions and the temporary object prefix.
+	if t.serverCfg.FilePerms == 0 {
+		t.serverCfg.FilePerms = 0644
+	}
+
+	if t.serverCfg.DirPerms == 0 {
+		t.serverCfg.DirPerms = 0755
+	}
+
+	if t.serverCfg.TmpObjectPrefix == "" {
+		t.serverCfg.TmpObjectPrefix = ".gcsfuse_tmp/"
+	}
+
+	t.createFileSystem()
+}
+
+func (t *directFsTest) TearDown() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+}
+
+// Replace the file system under test with a new one created from serverCfg,
+// for tests that vary the configuration.
+func (t *directFsTest) createFileSystem() {
+	if t.fs != nil {
+		t.fs.Destroy()
+	}
+
+	var err error
+	t.server, err = NewServer(&t.serverCfg)
+	AssertEq(nil, err)
+
+	t.fs = t.server.(*shutdownServer).fs
+}
+
+// Create a file system from serverCfg that is independent of the one under
+// test. The caller must destroy it.
+func (t *directFsTest) newFileSystem() *fileSystem {
+	server, err := NewServer(&t.serverCfg)
+	AssertEq(nil, err)
+
+	return server.(*shutdownServer).fs
+}
+
+// Look up the child with the given name in the given directory.
+func (t *directFsTest) lookUpIn(
+	parent fuseops.InodeID,
+	name string) (e fuseops.ChildInodeEntry, err error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+
+	err = t.fs.LookUpInode(t.ctx, op)
+	e = op.Entry
+	return
+}
+
+// Look up the slash-separated path from the root, which must exist.
+func (t *directFsTest) lookUpPath(p string) (e fuseops.ChildInodeEntry) {
+	e.Child = fuseops.RootInodeID
+	for _, name := range strings.Split(p, "/") {
+		var err error
+		e, err = t.lookUpIn(e.Child, name)
+		AssertEq(nil, err, "name: %q", name)
+	}
+
+	return
+}
+
+// Look up the child of the root with the given name, which must exist.
+func (t *directFsTest) lookUp(name string) fuseops.InodeID {
+	e, err := t.lookUpIn(fuseops.RootInodeID, name)
+	AssertEq(nil, err)
+
+	return e.Child
+}
+
+// Return the names listed in the directory with the given inode ID.
+func (t *directFsTest) readDir(id fuseops.InodeID) []string {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	err := t.fs.OpenDir(t.ctx, openOp)
+	AssertEq(nil, err)
+
+	defer t.fs.ReleaseDirHandle(
+		t.ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	op := &fuseops.ReadDirOp{
+		Inode:  id,
+		Handle: openOp.Handle,
+		Dst:    make([]byte, 4096),
+	}
+
+	err = t.fs.ReadDir(t.ctx, op)
+	AssertEq(nil, err)
+
+	return names(parseDirents(op.Dst[:op.BytesRead]))
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Tests for a file system configured to list directories before other
+// entries.
+
+package fs_test
+
+import (
+	"os"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DirsFirstTest struct {
+	fsTest
+}
+
+func init() { RegisterTestSuite(&DirsFirstTest{}) }
+
+func (t *DirsFirstTest) SetUp(ti *TestInfo) {
+	t.serverCfg.DirsFirst = true
+	t.fsTest.SetUp(ti)
+}
+
+// Read the names in the directory in the order the file system returns them.
+func readDirNames(dir string) (names []string, err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	names, err = f.Readdirnames(-1)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirsFirstTest) DirectoriesBeforeFiles() {
+	AssertEq(
+		nil,
+		t.createObjects(
+			map[string]string{
+				"a":    "",
+				"b/":   "",
+				"c":    "",
+				"d/":   "",
+				"foo":  "",
+				"foo/": "",
+			}))
+
+	names, err := readDirNames(t.mfs.Dir())
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("b", "d", "foo", "a", "c", "foo\n"))
+
+	// Reading again gives the same order.
+	names, err = readDirNames(t.mfs.Dir())
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("b", "d", "foo", "a", "c", "foo\n"))
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// When the file system is re-exported over NFS, a client may present a file
+// handle for an inode that the kernel has since forgotten. The kernel then
+// asks us for the inode by looking up "." within it, and for the parent of a
+// directory by looking up "..". Inodes we have already destroyed can't be
+// recovered from their IDs, so handles for them become stale; the inode table
+// size controls how long forgotten inodes are kept around for this.
+
+// Respond to a lookup of "." within op.Parent with that inode itself, or
+// ESTALE if it no longer exists.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) lookUpSelf(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	in, ok := fs.inodes[op.Parent]
+	fs.mu.Unlock()
+
+	if !ok {
+		err = syscall.ESTALE
+		return
+	}
+
+	// Take the inode's lock before the file system lock, per our lock ordering,
+	// then make sure the inode wasn't destroyed in between.
+	in.Lock()
+	fs.mu.Lock()
+	if fs.inodes[op.Parent] != in {
+		fs.mu.Unlock()
+		in.Unlock()
+		err = syscall.ESTALE
+		return
+	}
+
+	in.IncrementLookupCount()
+	fs.unforgetInode(in)
+	fs.mu.Unlock()
+
+	defer fs.unlockAndMaybeDisposeOfInode(in, &err)
+
+	// Fill out the response.
+	e := &op.Entry
+	e.Child = in.ID()
+	e.Generation = generationNumber(in)
+	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, in)
+
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Respond to a lookup of ".." within the directory op.Parent with the
+// directory containing it, or ESTALE if either no longer exists. The root is
+// its own parent.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) lookUpParent(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	fs.mu.Lock()
+	child, ok := fs.inodes[op.Parent].(inode.DirInode)
+	fs.mu.Unlock()
+
+	if !ok {
+		err = syscall.ESTALE
+		return
+	}
+
+	parent, err := fs.lookUpOrCreateDirInode(ctx, parentDirName(child.Name()))
+	if err != nil {
+		return
+	}
+
+	defer fs.unlockAndMaybeDisposeOfInode(parent, &err)
+
+	// Fill out the response.
+	e := &op.Entry
+	e.Child = parent.ID()
+	e.Generation = generationNumber(parent)
+	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, parent)
+
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Return the name of the directory containing the directory with the given
+// name, which for the root is the root.
+func parentDirName(name string) string {
+	if name == "" {
+		return ""
+	}
+
+	dir := path.Dir(strings.TrimSuffix(name, "/"))
+	if dir == "." {
+		return ""
+	}
+
+	return dir + "/"
+}
+
+// Return an existing inode for the directory with the given name or create a
+// new one, backed by its placeholder object if it has one. Return ESTALE if
+// the directory doesn't exist.
+//
+// Return the inode locked, incrementing its lookup count.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCK_FUNCTION(in)
+func (fs *fileSystem) lookUpOrCreateDirInode(
+	ctx context.Context,
+	name string) (in inode.Inode, err error) {
+	// Run a retry loop around lookUpOrCreateInodeIfNotStale, as in
+	// lookUpOrCreateChildInode.
+	const maxTries = 3
+	for n := 0; n < maxTries; n++ {
+		// The root has no placeholder object, and nor do directories within the
+		// trash.
+		var o *gcs.Object
+		if name != "" && !(fs.softDeleted != nil && inode.IsTrashName(name)) {
+			o, err = fs.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+			switch err.(type) {
+			case nil:
+
+			// Without a placeholder the directory exists only implicitly.
+			case *gcs.NotFoundError:
+				err = nil
+				if !fs.implicitDirs {
+					err = syscall.ESTALE
+					return
+				}
+
+			default:
+				err = fmt.Errorf("StatObject: %v", err)
+				return
+			}
+		}
+
+		fs.mu.Lock()
+		in = fs.lookUpOrCreateInodeIfNotStale(name, o)
+		if in != nil {
+			return
+		}
+	}
+
+	err = fmt.Errorf("Did not converge after %v tries", maxTries)
+	return
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestExport(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for the lookups the kernel makes to reconnect NFS file handles,
+// calling the file system's methods directly as the kernel would.
+type ExportTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&ExportTest{}) }
+
+func (t *ExportTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ImplicitDirectories = true
+	t.serverCfg.NFSExport = true
+	t.directFsTest.SetUp(ti)
+
+	// Explicit directories, implicit ones, and a file in each.
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			"explicit/",
+			"explicit/sub/",
+			"explicit/sub/foo",
+			"implicit/sub/foo",
+		})
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ExportTest) Self() {
+	for _, p := range []string{"explicit/sub/foo", "implicit/sub", "explicit"} {
+		want := t.lookUpPath(p)
+
+		e, err := t.lookUpIn(want.Child, ".")
+		AssertEq(nil, err, "path: %q", p)
+		ExpectEq(want.Child, e.Child, "path: %q", p)
+		ExpectEq(want.Generation, e.Generation, "path: %q", p)
+		ExpectEq(want.Attributes.Mode, e.Attributes.Mode, "path: %q", p)
+	}
+}
+
+func (t *ExportTest) Self_Root() {
+	e, err := t.lookUpIn(fuseops.RootInodeID, ".")
+	AssertEq(nil, err)
+	ExpectEq(fuseops.RootInodeID, e.Child)
+}
+
+func (t *ExportTest) Self_Unknown() {
+	_, err := t.lookUpIn(17, ".")
+	ExpectEq(syscall.ESTALE, err)
+}
+
+func (t *ExportTest) Parent_ExplicitDir() {
+	want := t.lookUpPath("explicit")
+	sub := t.lookUpPath("explicit/sub")
+
+	e, err := t.lookUpIn(sub.Child, "..")
+	AssertEq(nil, err)
+	ExpectEq(want.Child, e.Child)
+	ExpectEq(want.Generation, e.Generation)
+}
+
+func (t *ExportTest) Parent_ImplicitDir() {
+	want := t.lookUpPath("implicit")
+	sub := t.lookUpPath("implicit/sub")
+
+	e, err := t.lookUpIn(sub.Child, "..")
+	AssertEq(nil, err)
+	ExpectEq(want.Child, e.Child)
+}
+
+func (t *ExportTest) Parent_Root() {
+	dir := t.lookUpPath("explicit")
+
+	e, err := t.lookUpIn(dir.Child, "..")
+	AssertEq(nil, err)
+	ExpectEq(fuseops.RootInodeID, e.Child)
+
+	e, err = t.lookUpIn(fuseops.RootInodeID, "..")
+	AssertEq(nil, err)
+	ExpectEq(fuseops.RootInodeID, e.Child)
+}
+
+func (t *ExportTest) Parent_NotADir() {
+	f := t.lookUpPath("explicit/sub/foo")
+
+	_, err := t.lookUpIn(f.Child, "..")
+	ExpectEq(syscall.ESTALE, err)
+}
+
+func (t *ExportTest) Parent_Deleted() {
+	sub := t.lookUpPath("explicit/sub")
+
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "explicit/"})
+
+	AssertEq(nil, err)
+
+	// The directory still exists implicitly.
+	_, err = t.lookUpIn(sub.Child, "..")
+	ExpectEq(nil, err)
+}
+
+func (t *ExportTest) StableAcrossMounts() {
+	other := directFsTest{ctx: t.ctx, fs: t.newFileSystem()}
+	defer other.TearDown()
+
+	for _, p := range []string{"explicit/sub/foo", "implicit/sub", "explicit"} {
+		e1 := t.lookUpPath(p)
+		e2 := other.lookUpPath(p)
+
+		ExpectEq(e1.Child, e2.Child, "path: %q", p)
+		ExpectEq(e1.Generation, e2.Generation, "path: %q", p)
+	}
+}
+
+func (t *ExportTest) GenerationsDiffer() {
+	e1 := t.lookUpPath("explicit/sub/foo")
+	e2 := t.lookUpPath("implicit/sub/foo")
+
+	ExpectNe(e1.Generation, e2.Generation)
+}
+
+func (t *ExportTest) NotExported() {
+	t.serverCfg.NFSExport = false
+	t.createFileSystem()
+
+	// Without export support, "." and ".." are names like any other, and there
+	// are no such objects.
+	sub := t.lookUpPath("explicit/sub")
+	for _, name := range []string{".", ".."} {
+		_, err := t.lookUpIn(sub.Child, name)
+		ExpectEq(syscall.ENOENT, err, "name: %q", name)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFallocate(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for fallocate(2), calling the file system's methods directly as the
+// kernel would.
+type FallocateTest struct {
+	directFsTest
+
+	// A file created in SetUp holding "taco", and a handle open on it.
+	inode  fuseops.InodeID
+	handle fuseops.HandleID
+}
+
+func init() { RegisterTestSuite(&FallocateTest{}) }
+
+func (t *FallocateTest) SetUp(ti *TestInfo) {
+	t.directFsTest.SetUp(ti)
+
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Mode:   0644,
+	}
+
+	err := t.fs.CreateFile(t.ctx, op)
+	AssertEq(nil, err)
+
+	t.inode = op.Entry.Child
+	t.handle = op.Handle
+
+	err = t.fs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{
+			Inode:  t.inode,
+			Handle: t.handle,
+			Data:   []byte("taco"),
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *FallocateTest) fallocate(offset, length uint64, mode uint32) error {
+	return t.fs.Fallocate(
+		t.ctx,
+		&fuseops.FallocateOp{
+			Inode:  t.inode,
+			Handle: t.handle,
+			Offset: offset,
+			Length: length,
+			Mode:   mode,
+		})
+}
+
+func (t *FallocateTest) size() uint64 {
+	op := &fuseops.GetInodeAttributesOp{Inode: t.inode}
+	err := t.fs.GetInodeAttributes(t.ctx, op)
+	AssertEq(nil, err)
+
+	return op.Attributes.Size
+}
+
+// Sync the file and return the contents of its object.
+func (t *FallocateTest) sync() string {
+	err := t.fs.SyncFile(
+		t.ctx,
+		&fuseops.SyncFileOp{Inode: t.inode, Handle: t.handle})
+
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FallocateTest) Extend() {
+	err := t.fallocate(2, 6, 0)
+	AssertEq(nil, err)
+
+	ExpectEq(8, t.size())
+	ExpectEq("taco\x00\x00\x00\x00", t.sync())
+}
+
+func (t *FallocateTest) WithinFile() {
+	err := t.fallocate(0, 3, 0)
+	AssertEq(nil, err)
+
+	ExpectEq(4, t.size())
+	ExpectEq("taco", t.sync())
+}
+
+func (t *FallocateTest) KeepSize() {
+	err := t.fallocate(0, 100, fallocKeepSize)
+	AssertEq(nil, err)
+
+	ExpectEq(4, t.size())
+	ExpectEq("taco", t.sync())
+}
+
+func (t *FallocateTest) PunchHole() {
+	const punchHole = 0x2
+	err := t.fallocate(0, 2, punchHole|fallocKeepSize)
+	ExpectEq(syscall.ENOTSUP, err)
+
+	ExpectEq("taco", t.sync())
+}
+
+func (t *FallocateTest) UnmodifiedFile() {
+	// Write out the file so that it's no longer dirty, then extend it again.
+	AssertEq("taco", t.sync())
+
+	err := t.fallocate(4, 2, 0)
+	AssertEq(nil, err)
+
+	ExpectEq(6, t.size())
+	ExpectEq("taco\x00\x00", t.sync())
+}
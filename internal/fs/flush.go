@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"golang.org/x/net/context"
+)
+
+// Return the file inodes in the table. We can't lock them while holding the
+// file system lock, so the caller must check each for whether it's dirty, or
+// destroyed, after locking it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) fileInodes() (files []*inode.FileInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, in := range fs.inodes {
+		if f, ok := in.(*inode.FileInode); ok {
+			files = append(files, f)
+		}
+	}
+
+	return
+}
+
+// Write out the contents of every dirty file, logging any errors. Files that
+// fail are left dirty, to be tried again next time or when they are synced or
+// closed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) flushDirtyFilesOnce(ctx context.Context) {
+	for _, f := range fs.fileInodes() {
+		f.Lock()
+
+		if f.Dirty() {
+			err := fs.syncFile(ctx, f)
+			if err != nil {
+				logger.Errorf("Periodic flush of %q: %v", f.Name(), err)
+			}
+		}
+
+		f.Unlock()
+	}
+}
+
+// Write out the contents of every dirty file each time the given interval
+// passes, until the context is cancelled. This saves the writes made to files
+// held open for a long time, such as logs, even if the program writing them
+// never syncs or closes them.
+func (fs *fileSystem) flushPeriodically(
+	ctx context.Context,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		fs.flushDirtyFilesOnce(ctx)
+	}
+}
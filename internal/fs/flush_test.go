@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFlush(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for periodically writing out dirty files, calling the file system's
+// methods directly as the kernel would.
+type FlushTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&FlushTest{}) }
+
+func (t *FlushTest) createFileSystem(flushInterval time.Duration) {
+	t.serverCfg.FlushInterval = flushInterval
+	t.directFsTest.createFileSystem()
+}
+
+// Create a file and write to it, without syncing or closing it.
+func (t *FlushTest) createAndWrite(name string, contents string) {
+	op := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   name,
+		Mode:   0644,
+	}
+
+	err := t.fs.CreateFile(t.ctx, op)
+	AssertEq(nil, err)
+
+	err = t.fs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{
+			Inode:  op.Entry.Child,
+			Handle: op.Handle,
+			Data:   []byte(contents),
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *FlushTest) readObject(name string) string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, name)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlushTest) FlushOnce() {
+	t.createAndWrite("foo", "taco")
+	t.createAndWrite("bar", "burrito")
+	ExpectEq("", t.readObject("foo"))
+	ExpectEq("", t.readObject("bar"))
+
+	t.fs.flushDirtyFilesOnce(t.ctx)
+	ExpectEq("taco", t.readObject("foo"))
+	ExpectEq("burrito", t.readObject("bar"))
+}
+
+func (t *FlushTest) FlushOnce_ClobberedFileIsSkipped() {
+	t.createAndWrite("foo", "taco")
+
+	// Replace the object remotely. Flushing is as for a sync, so the local
+	// modifications are treated as being to an unlinked file.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	t.fs.flushDirtyFilesOnce(t.ctx)
+	ExpectEq("burrito", t.readObject("foo"))
+}
+
+func (t *FlushTest) FlushPeriodically() {
+	t.createFileSystem(10 * time.Millisecond)
+	t.createAndWrite("foo", "taco")
+
+	// Wait for the flusher to get to it.
+	deadline := time.Now().Add(5 * time.Second)
+	for t.readObject("foo") != "taco" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ExpectEq("taco", t.readObject("foo"))
+}
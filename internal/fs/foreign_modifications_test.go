@@ -468,6 +468,31 @@ func (t *ForeignModsTest) Inodes() {
 	}
 }
 
+func (t *ForeignModsTest) BlockCounts() {
+	// Set up files of various sizes and a directory placeholder.
+	AssertEq(nil, t.createWithContents("empty", ""))
+	AssertEq(nil, t.createWithContents("small", "taco"))
+	AssertEq(nil, t.createWithContents("large", strings.Repeat("x", 1025)))
+	AssertEq(nil, t.createWithContents("dir/", ""))
+
+	// st_blocks is measured in 512-byte units, rounded up.
+	expected := map[string]int64{
+		"empty": 0,
+		"small": 1,
+		"large": 3,
+		"dir":   0,
+	}
+
+	for name, blocks := range expected {
+		fi, err := os.Stat(path.Join(t.mfs.Dir(), name))
+		AssertEq(nil, err)
+
+		stat := fi.Sys().(*syscall.Stat_t)
+		ExpectEq(blocks, stat.Blocks, "Name: %s", name)
+		ExpectNe(0, stat.Blksize, "Name: %s", name)
+	}
+}
+
 func (t *ForeignModsTest) OpenNonExistentFile() {
 	_, err := os.Open(path.Join(t.mfs.Dir(), "foo"))
 
@@ -15,21 +15,32 @@
 package fs
 
 import (
+	"container/list"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/metrics"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
 	"github.com/jacobsa/syncutil"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
@@ -37,16 +48,85 @@ import (
 
 type ServerConfig struct {
 	// A clock used for cache expiration. It is *not* used for inode times, for
-	// which we use the wall clock.
+	// which we use the wall clock. It should be unaffected by changes to the
+	// system time; see clock.NewMonotonicClock.
 	CacheClock timeutil.Clock
 
 	// The bucket that the file system is to export.
 	Bucket gcs.Bucket
 
+	// The folders of the bucket, if it has a hierarchical namespace. If set,
+	// directories are created, deleted and looked up as folders rather than
+	// placeholder objects, and can be renamed, which otherwise fails with
+	// ENOSYS. Folder names must match the object names seen through Bucket.
+	Folders storage.Folders
+
+	// The soft-deleted objects of the bucket, if it has a soft delete policy.
+	// If set, they can be browsed and restored within a read-only directory at
+	// the root of the file system; see trash.go. Their names must match the
+	// object names seen through Bucket.
+	SoftDeleted storage.SoftDeleted
+
+	// Reports the holds and retention of objects in the bucket, if set, so that
+	// writing to or deleting a file whose object GCS would refuse to overwrite
+	// or delete fails up front with EPERM; see retention.go.
+	Retention storage.Retention
+
+	// Reports changes made to objects in the bucket by anyone, if set, so that
+	// what we and the kernel have cached about them is discarded at once rather
+	// than when it expires; see changes.go. Its names must match the object
+	// names seen through Bucket.
+	Changes storage.Changes
+
 	// The temporary directory to use for local caching, or the empty string to
 	// use the system default.
 	TempDir string
 
+	// The contents of dirty files no larger than this many bytes are kept in
+	// memory, moving to TempDir only if they grow larger. Zero means always use
+	// TempDir.
+	SpillThreshold int64
+
+	// If non-nil, the contents of dirty files are kept here instead, so that
+	// they survive a crash. The file system closes it when unmounted.
+	StagingArea *gcsx.StagingArea
+
+	// If non-nil, the contents of dirty files written to TempDir are encrypted
+	// with this. A StagingArea has its own.
+	DiskCipher *gcsx.DiskCipher
+
+	// The number of bytes to keep free on the file system holding the contents
+	// of dirty files (StagingArea if set, otherwise TempDir). Writes that would
+	// eat into it, or that wouldn't fit at all, fail with ENOSPC.
+	TempDirMinFree uint64
+
+	// The maximum number of dirty files to write out to GCS at once. Further
+	// uploads wait their turn in the order in which they arrive. Zero means no
+	// limit.
+	MaxConcurrentUploads int
+
+	// If non-zero, a file is modified only after taking a write lease lasting
+	// this long on its object, recorded in the object's metadata. Modifying a
+	// file leased by another mount fails with EBUSY. This only helps if all
+	// mounts writing to the bucket use it.
+	WriteLeaseTTL time.Duration
+
+	// If set, writes that fill an empty or newly truncated file from the start
+	// are passed straight on to GCS as they arrive, with no local staging, and
+	// the object is created when the file is closed or synced. Other writes to
+	// such a file, and reads from it until then, fail with ENOTSUP.
+	StreamingWrites bool
+
+	// If non-zero, the contents of dirty files are written out to GCS each time
+	// this much time passes, as well as when they are synced or closed.
+	FlushInterval time.Duration
+
+	// Set when the file system is mounted read-only, so that it makes no
+	// changes to the bucket of its own accord either. In particular temporary
+	// objects left behind by other mounts aren't garbage collected, which the
+	// read-only credentials used for such a mount wouldn't allow.
+	ReadOnly bool
+
 	// By default, if a bucket contains the object "foo/bar" but no object named
 	// "foo/", it's as if the directory doesn't exist. This allows us to have
 	// non-flaky name resolution code.
@@ -59,16 +139,83 @@ type ServerConfig struct {
 	// See docs/semantics.md for more info.
 	ImplicitDirectories bool
 
-	// How long to allow the kernel to cache inode attributes.
+	// If non-nil, a function applied to file names on lookup and creation,
+	// such as a Unicode normalization. Use this to ensure that names written by
+	// clients that disagree about normalization map to the same objects.
+	//
+	// See docs/semantics.md for more info.
+	NormalizeNames func(string) string
+
+	// If set, looking up a name that matches no child falls back to a child
+	// whose name differs only in case, as Windows clients of a Samba share
+	// expect.
+	//
+	// See docs/semantics.md for more info.
+	CaseInsensitive bool
+
+	// If non-nil, children of directories hidden by this filter are omitted
+	// from listings and can't be looked up.
+	NameFilter *inode.NameFilter
+
+	// Settings for particular directories and their contents, in place of the
+	// ones above.
+	//
+	// See docs/semantics.md for more info.
+	DirOverrides []DirOverride
+
+	// Omit from listings, and fail to look up, child directories that GCS
+	// refuses to let us list, as when a managed folder's IAM policy denies us
+	// access. Otherwise they appear as directories that can't be read.
+	//
+	// See docs/semantics.md for more info.
+	HideDeniedDirs bool
+
+	// If positive, assume that no object is nested more than this many levels
+	// below the root, so that 1 means a flat bucket. Directories at the
+	// deepest level are then taken to have no child directories, saving the
+	// requests that would look for them, and creating directories within them
+	// fails with EPERM.
+	//
+	// See docs/semantics.md for more info.
+	MaxDepth int
+
+	// Hide the AppleDouble and .DS_Store files left by the macOS Finder, refuse
+	// to create them, and discard the Finder's com.apple. extended attributes
+	// rather than rejecting them.
+	//
+	// See docs/semantics.md for more info.
+	DisableAppleNoise bool
+
+	// By default directory listings are ordered by name. If this is set,
+	// directories are listed first, followed by files and symlinks, with each
+	// group ordered by name.
+	DirsFirst bool
+
+	// If set, rmdir(2) of a non-empty directory deletes the objects and
+	// folders within it, with many requests in flight at once, rather than
+	// failing with ENOTEMPTY. This lets rm -r skip looking up and unlinking
+	// each file through the kernel.
+	//
+	// See docs/semantics.md for more info.
+	RecursiveRmDir bool
+
+	// If set, a directory named .gcsfuse at the root of the file system holds
+	// files through which the mount can be inspected and its caches discarded;
+	// see control.go. Its config file holds ControlConfig.
 	//
-	// Any given object generation in GCS is immutable, and a new generation
-	// results in a new inode number. So every update from a remote system results
-	// in a new inode number, and it's therefore safe to allow the kernel to cache
-	// inode attributes.
+	// See docs/semantics.md for more info.
+	ControlDir    bool
+	ControlConfig string
+
+	// How long to cache inode attributes, both in each inode and in the kernel.
+	// Until they expire, statting an inode needs no round trip to GCS.
 	//
-	// The one exception to the above logic is that objects can be _deleted_, in
-	// which case stat::st_nlink changes. So choosing this value comes down to
-	// whether you care about that field being up to date.
+	// Once they expire, statting a file or symlink inode that has no open
+	// handles and no local modifications brings it up to date in place with any
+	// newer generation of its object, keeping its inode number. So an update or
+	// deletion by a remote system may go unnoticed by stat for up to this long,
+	// and choosing this value comes down to how stale you can tolerate
+	// attributes being.
 	InodeAttributeCacheTTL time.Duration
 
 	// If non-zero, each directory will maintain a cache from child name to
@@ -79,6 +226,38 @@ type ServerConfig struct {
 	// before the expiration, we may fail to find it.
 	DirTypeCacheTTL time.Duration
 
+	// If positive, the kernel is allowed to cache the mapping from a name to
+	// the inode it refers to for this long, instead of asking us to look the
+	// name up again each time it is used. Names removed or replaced by other
+	// writers in the meantime go unnoticed.
+	KernelEntryCacheTTL time.Duration
+
+	// If positive, the kernel is allowed to cache inode attributes for this
+	// long, instead of until the inode's own cached attributes expire (see
+	// InodeAttributeCacheTTL).
+	KernelAttrCacheTTL time.Duration
+
+	// If positive, each directory inode caches the entries it lists for this
+	// long, so that listing the same directory again needn't ask GCS. Children
+	// created or deleted by other writers may go unnoticed in listings until
+	// then.
+	DirListingCacheTTL time.Duration
+
+	// If non-zero, inodes that the kernel has forgotten are kept in the inode
+	// table while it holds no more than this many inodes, so that a later
+	// lookup of the same object reuses the inode, along with its ID and cached
+	// state. Beyond that, they are destroyed least recently forgotten first.
+	// Inodes the kernel still knows about are never evicted, so the table may
+	// grow beyond this size. If zero, inodes are destroyed as soon as the
+	// kernel forgets them.
+	InodeTableSize int
+
+	// If set, lookups of "." and ".." are answered with the inode itself and
+	// its parent directory, as the kernel asks when reconnecting file handles
+	// presented by NFS clients; see export.go. Otherwise they are looked up in
+	// the bucket like any other name.
+	NFSExport bool
+
 	// The UID and GID that owns all inodes in the file system.
 	Uid uint32
 	Gid uint32
@@ -88,6 +267,14 @@ type ServerConfig struct {
 	FilePerms os.FileMode
 	DirPerms  os.FileMode
 
+	// The capacity in bytes to report for the file system to statfs(2). If
+	// zero, a very large capacity is reported.
+	Capacity uint64
+
+	// If non-nil, used to report the space and inodes used by the contents of
+	// the bucket to statfs(2). Otherwise none are reported as used.
+	UsageScanner *gcsx.UsageScanner
+
 	// Files backed by on object of length at least AppendThreshold that have
 	// only been appended to (i.e. none of the object's contents have been
 	// dirtied) will be written out by "appending" to the object in GCS with this
@@ -106,10 +293,52 @@ type ServerConfig struct {
 	// periodically garbage collected.
 	AppendThreshold int64
 	TmpObjectPrefix string
+
+	// If non-nil, reads through each file handle are limited by a distinct
+	// client of this throttle, all with equal weight. This prevents one handle
+	// streaming a large object from starving readers using other handles.
+	HandleReadThrottle *gcsx.FairShareThrottle
+
+	// Log a summary of each operation, with its latency and outcome, at debug
+	// severity.
+	DebugOps bool
+
+	// If non-nil, the latency of each operation is recorded here, labelled by
+	// op name.
+	OpLatencies *metrics.LatencyHistograms
+
+	// Tag requests to the bucket with the name of the operation that caused
+	// them, for use with gcsx.NewAuditingBucket and gcsx.NewDryRunBucket.
+	AuditOps bool
+
+	// If non-nil, consulted when an operation fails with an error other than a
+	// syscall.Errno. If it returns true, GCS is refusing our credentials, and
+	// the operation fails with EACCES rather than EIO. Operations that GCS
+	// refused themselves fail with EACCES regardless; see gcsx.NewAuthBucket.
+	AccessDenied func() bool
+
+	// If non-empty, operations sent on behalf of processes whose UIDs aren't
+	// listed fail with EACCES, regardless of permissions.
+	AccessUids []uint32
+
+	// If non-nil, files have an extended attribute named signedURLXattr whose
+	// value is the result of calling this with the name of the file's object:
+	// a URL through which the object can be downloaded.
+	SignURL func(object string) (string, error)
+
+	// If non-nil, the file system logs the operations in flight and the open
+	// handles each time a value is received on this channel.
+	DumpStateSignals <-chan os.Signal
+
+	// If non-zero, operations that transfer file contents (reads, writes,
+	// flushes and syncs) and all other operations respectively are abandoned
+	// with ETIMEDOUT if they take longer than this.
+	DataOpTimeout     time.Duration
+	MetadataOpTimeout time.Duration
 }
 
 // Create a fuse file system server according to the supplied configuration.
-func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
+func NewServer(cfg *ServerConfig) (server Server, err error) {
 	// Check permissions bits.
 	if cfg.FilePerms&^os.ModePerm != 0 {
 		err = fmt.Errorf("Illegal file perms: %v", cfg.FilePerms)
@@ -130,34 +359,98 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 		return
 	}
 
+	var uploads *gcsx.UploadQueue
+	if cfg.MaxConcurrentUploads > 0 {
+		uploads = gcsx.NewUploadQueue(cfg.MaxConcurrentUploads)
+	}
+
 	syncer := gcsx.NewSyncer(
 		cfg.AppendThreshold,
 		cfg.TmpObjectPrefix,
-		bucket)
+		bucket,
+		uploads)
+
+	// Check for room where the contents of dirty files go.
+	spaceDir := cfg.TempDir
+	if cfg.StagingArea != nil {
+		spaceDir = cfg.StagingArea.Dir()
+	}
+
+	spaceChecker := gcsx.NewSpaceChecker(spaceDir, cfg.TempDirMinFree)
+
+	// Choose a name for this mount in write leases.
+	var leaseConfig *inode.LeaseConfig
+	if cfg.WriteLeaseTTL > 0 {
+		leaseConfig = &inode.LeaseConfig{
+			Owner: leaseOwner(),
+			TTL:   cfg.WriteLeaseTTL,
+		}
+	}
+
+	// Hide the Finder's files along with those the caller asked to hide.
+	nameFilter := cfg.NameFilter
+	dirOverrides := sortDirOverrides(cfg.DirOverrides)
+	if cfg.DisableAppleNoise {
+		nameFilter = nameFilter.Ignoring(appleNoisePatterns...)
+		for i := range dirOverrides {
+			if dirOverrides[i].NameFilter != nil {
+				dirOverrides[i].NameFilter =
+					dirOverrides[i].NameFilter.Ignoring(appleNoisePatterns...)
+			}
+		}
+	}
 
 	// Set up the basic struct.
 	fs := &fileSystem{
 		mtimeClock:             timeutil.RealClock(),
 		cacheClock:             cfg.CacheClock,
 		bucket:                 bucket,
+		folders:                cfg.Folders,
+		softDeleted:            cfg.SoftDeleted,
+		retention:              cfg.Retention,
 		syncer:                 syncer,
 		tempDir:                cfg.TempDir,
+		spillThreshold:         cfg.SpillThreshold,
+		diskCipher:             cfg.DiskCipher,
+		signURL:                cfg.SignURL,
+		stagingArea:            cfg.StagingArea,
+		spaceChecker:           spaceChecker,
+		leaseConfig:            leaseConfig,
+		streamingWrites:        cfg.StreamingWrites,
 		implicitDirs:           cfg.ImplicitDirectories,
+		normalizeName:          cfg.NormalizeNames,
+		caseInsensitive:        cfg.CaseInsensitive,
+		nameFilter:             nameFilter,
+		dirOverrides:           dirOverrides,
+		hideDeniedDirs:         cfg.HideDeniedDirs,
+		maxDepth:               cfg.MaxDepth,
+		dirsFirst:              cfg.DirsFirst,
+		recursiveRmDir:         cfg.RecursiveRmDir,
 		inodeAttributeCacheTTL: cfg.InodeAttributeCacheTTL,
 		dirTypeCacheTTL:        cfg.DirTypeCacheTTL,
+		inodeTableSize:         cfg.InodeTableSize,
+		nfsExport:              cfg.NFSExport,
+		kernelEntryCacheTTL:    cfg.KernelEntryCacheTTL,
+		kernelAttrCacheTTL:     cfg.KernelAttrCacheTTL,
+		dirListingCacheTTL:     cfg.DirListingCacheTTL,
 		uid:                    cfg.Uid,
 		gid:                    cfg.Gid,
 		fileMode:               cfg.FilePerms,
 		dirMode:                cfg.DirPerms | os.ModeDir,
+		capacity:               cfg.Capacity,
+		usageScanner:           cfg.UsageScanner,
 		inodes:                 make(map[fuseops.InodeID]inode.Inode),
-		nextInodeID:            fuseops.RootInodeID + 1,
 		generationBackedInodes: make(map[string]inode.GenerationBackedInode),
-		implicitDirInodes:      make(map[string]inode.DirInode),
+		implicitDirInodes:      make(map[string]inode.ImplicitDirInode),
+		forgottenInodes:        list.New(),
+		forgottenElems:         make(map[fuseops.InodeID]*list.Element),
 		handles:                make(map[fuseops.HandleID]interface{}),
+		openCounts:             make(map[fuseops.InodeID]int),
+		handleReadThrottle:     cfg.HandleReadThrottle,
 	}
 
 	// Set up the root inode.
-	root := inode.NewDirInode(
+	root := inode.NewImplicitDirInode(
 		fuseops.RootInodeID,
 		"", // name
 		fuseops.InodeAttributes{
@@ -171,8 +464,16 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 			Mtime: fs.mtimeClock.Now(),
 		},
 		fs.implicitDirs,
+		fs.normalizeName,
+		fs.caseInsensitive,
+		fs.nameFilter,
+		fs.hideDeniedDirs,
+		fs.isFlatDir(""),
 		fs.dirTypeCacheTTL,
+		fs.inodeAttributeCacheTTL,
+		fs.dirListingCacheTTL,
 		fs.bucket,
+		fs.folders,
 		fs.mtimeClock,
 		fs.cacheClock)
 
@@ -185,12 +486,101 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	// Periodically garbage collect temporary objects.
-	var gcCtx context.Context
-	gcCtx, fs.stopGarbageCollecting = context.WithCancel(context.Background())
-	go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
+	// Find any cache of StatObject results, so that stale entries can be
+	// discarded.
+	fs.statCache, _ = cfg.Bucket.(gcscaching.Invalidator)
+
+	// Periodically garbage collect temporary objects, unless read-only.
+	fs.stopGarbageCollecting = func() {}
+	if !cfg.ReadOnly {
+		var gcCtx context.Context
+		gcCtx, fs.stopGarbageCollecting = context.WithCancel(context.Background())
+		go garbageCollect(gcCtx, cfg.TmpObjectPrefix, fs.bucket)
+	}
+
+	// Periodically write out dirty files, if asked to.
+	fs.stopFlushing = func() {}
+	if cfg.FlushInterval > 0 {
+		var flushCtx context.Context
+		flushCtx, fs.stopFlushing = context.WithCancel(context.Background())
+		go fs.flushPeriodically(flushCtx, cfg.FlushInterval)
+	}
+
+	// Watch for changes to objects, if we can.
+	fs.stopWatching = func() {}
+	if cfg.Changes != nil {
+		var watchCtx context.Context
+		watchCtx, fs.stopWatching = context.WithCancel(context.Background())
+		go fs.watchChanges(watchCtx, cfg.Changes)
+	}
+
+	// Set up per-op instrumentation, after noting activity, refusing ops once
+	// we've begun shutting down, and refusing those from callers not allowed to
+	// use the mount.
+	fs.lastOpTime = fs.cacheClock.Now().UnixNano()
+	interceptors := []opInterceptor{fs.recordActivity, fs.rejectAfterShutdown}
+	if len(cfg.AccessUids) > 0 {
+		interceptors = append(
+			interceptors,
+			restrictCallers(cfg.AccessUids, opCallerUid))
+	}
+
+	if cfg.DisableAppleNoise {
+		interceptors = append(interceptors, suppressAppleNoise)
+	}
+
+	if cfg.DumpStateSignals != nil {
+		fs.inFlight = newInFlightOps()
+		interceptors = append(interceptors, fs.inFlight.intercept)
+		go fs.dumpStateOnSignal(cfg.DumpStateSignals)
+	}
+
+	interceptors = append(interceptors, reportAccessDenied(cfg.AccessDenied))
+
+	if cfg.ControlDir {
+		fs.control = newControlDir(
+			cfg.ControlConfig,
+			fs.mtimeClock.Now())
+
+		interceptors = append(interceptors, fs.serveControlDir)
+	}
+
+	if cfg.SoftDeleted != nil {
+		interceptors = append(interceptors, fs.protectTrash)
+	}
+
+	if len(dirOverrides) > 0 {
+		interceptors = append(interceptors, fs.protectReadOnlyDirs)
+	}
+
+	if cfg.MetadataOpTimeout != 0 || cfg.DataOpTimeout != 0 {
+		interceptors = append(
+			interceptors,
+			applyOpDeadlines(cfg.MetadataOpTimeout, cfg.DataOpTimeout))
+	}
+
+	if cfg.DebugOps {
+		interceptors = append(interceptors, logOp)
+	}
+
+	if cfg.AuditOps {
+		interceptors = append(interceptors, tagAuditOp)
+	}
+
+	if cfg.OpLatencies != nil {
+		interceptors = append(interceptors, recordOpLatency(cfg.OpLatencies))
+	}
+
+	if tracing.Enabled() {
+		interceptors = append(interceptors, traceOp)
+	}
+
+	server = &shutdownServer{
+		Server: fuseutil.NewFileSystemServer(
+			newInterceptingFileSystem(fs, interceptors)),
+		fs: fs,
+	}
 
-	server = fuseutil.NewFileSystemServer(fs)
 	return
 }
 
@@ -230,16 +620,46 @@ type fileSystem struct {
 	mtimeClock timeutil.Clock
 	cacheClock timeutil.Clock
 	bucket     gcs.Bucket
+	folders    storage.Folders
 	syncer     gcsx.Syncer
 
+	// The soft-deleted objects of the bucket, or nil if it has no soft delete
+	// policy.
+	softDeleted storage.SoftDeleted
+
+	// The holds and retention of objects in the bucket, or nil if we don't
+	// check them.
+	retention storage.Retention
+
+	// The cache of StatObject results in front of the bucket, if any.
+	statCache gcscaching.Invalidator
+
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	tempDir                string
-	implicitDirs           bool
-	inodeAttributeCacheTTL time.Duration
-	dirTypeCacheTTL        time.Duration
+	tempDir             string
+	spillThreshold      int64
+	diskCipher          *gcsx.DiskCipher
+	signURL             func(string) (string, error)
+	stagingArea         *gcsx.StagingArea
+	spaceChecker        *gcsx.SpaceChecker
+	leaseConfig         *inode.LeaseConfig
+	streamingWrites     bool
+	implicitDirs        bool
+	normalizeName       func(string) string
+	caseInsensitive     bool
+	nameFilter          *inode.NameFilter
+	dirOverrides        []DirOverride
+	hideDeniedDirs      bool
+	dirsFirst           bool
+	recursiveRmDir      bool
+	inodeTableSize      int
+	nfsExport           bool
+	kernelEntryCacheTTL time.Duration
+	kernelAttrCacheTTL  time.Duration
+	dirListingCacheTTL  time.Duration
+	maxDepth            int
 
 	// The user and group owning everything in the file system.
 	uid uint32
@@ -249,28 +669,61 @@ type fileSystem struct {
 	fileMode os.FileMode
 	dirMode  os.FileMode
 
+	// The capacity to report to statfs(2), or zero for the default, and if
+	// non-nil a source for the usage to report.
+	capacity     uint64
+	usageScanner *gcsx.UsageScanner
+
 	// A function that shuts down the garbage collector.
 	stopGarbageCollecting func()
 
+	// A function that stops periodically flushing dirty files.
+	stopFlushing func()
+
+	// A function that stops watching for changes to objects.
+	stopWatching func()
+
+	// If non-nil, a throttle from which each file handle receives a client.
+	handleReadThrottle *gcsx.FairShareThrottle
+
+	// If non-nil, a record of the ops currently executing.
+	inFlight *inFlightOps
+
+	// If non-nil, the state of the control directory; see control.go.
+	control *controlDir
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	// Non-zero once shutDown has been called. Accessed atomically.
+	shuttingDown int32
+
+	// The number of ops being served, and the time according to cacheClock in
+	// nanoseconds since the epoch at which the last one finished, or at which
+	// the file system was created if none has. Accessed atomically.
+	opsInFlight int64
+	lastOpTime  int64
+
 	// A lock protecting the state of the file system struct itself (distinct
 	// from per-inode locks). Make sure to see the notes on lock ordering above.
 	mu syncutil.InvariantMutex
 
-	// The next inode ID to hand out. We assume that this will never overflow,
-	// since even if we were handing out inode IDs at 4 GHz, it would still take
-	// over a century to do so.
+	// The kernel's side of the connection we're serving, once we are.
 	//
 	// GUARDED_BY(mu)
-	nextInodeID fuseops.InodeID
+	notifier kernelNotifier
+
+	// The TTLs given to new inodes; see SetCacheTTLs.
+	//
+	// GUARDED_BY(mu)
+	inodeAttributeCacheTTL time.Duration
+	dirTypeCacheTTL        time.Duration
 
 	// The collection of live inodes, keyed by inode ID. No ID less than
 	// fuseops.RootInodeID is ever used.
 	//
-	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
+	// INVARIANT: For all keys k, fuseops.RootInodeID <= k
 	// INVARIANT: For all keys k, inodes[k].ID() == k
 	// INVARIANT: inodes[fuseops.RootInodeID] is missing or of type inode.DirInode
 	// INVARIANT: For all v, if IsDirName(v.Name()) then v is inode.DirInode
@@ -317,12 +770,27 @@ type fileSystem struct {
 	//
 	// INVARIANT: For each k/v, v.Name() == k
 	// INVARIANT: For each value v, inodes[v.ID()] == v
-	// INVARIANT: For each value v, v is not ExplicitDirInode
-	// INVARIANT: For each in in inodes such that in is DirInode but not
-	//            ExplicitDirInode, implicitDirInodes[d.Name()] == d
+	// INVARIANT: For each in in inodes such that in is ImplicitDirInode,
+	//            implicitDirInodes[d.Name()] == d
+	//
+	// GUARDED_BY(mu)
+	implicitDirInodes map[string]inode.ImplicitDirInode
+
+	// Inodes whose lookup counts have gone to zero but which we're keeping
+	// around for reuse, most recently forgotten at the front, along with an
+	// index from ID to their elements. Each is indexed in
+	// generationBackedInodes or implicitDirInodes when forgotten, though it
+	// may since have been superseded there.
+	//
+	// INVARIANT: Each element's value is an inode.Inode
+	// INVARIANT: For each element e, inodes[e.Value.ID()] == e.Value
+	// INVARIANT: For each element e, forgottenElems[e.Value.ID()] == e
+	// INVARIANT: len(forgottenElems) == forgottenInodes.Len()
+	// INVARIANT: If forgottenInodes.Len() > 0, len(inodes) <= inodeTableSize
 	//
 	// GUARDED_BY(mu)
-	implicitDirInodes map[string]inode.DirInode
+	forgottenInodes *list.List
+	forgottenElems  map[fuseops.InodeID]*list.Element
 
 	// The collection of live handles, keyed by handle ID.
 	//
@@ -331,6 +799,16 @@ type fileSystem struct {
 	// GUARDED_BY(mu)
 	handles map[fuseops.HandleID]interface{}
 
+	// The number of file handles in handles for each inode that has any, so
+	// that we can tell whether an inode is open without scanning them.
+	//
+	// INVARIANT: For each k/v, v > 0
+	// INVARIANT: For each k/v, v is the number of *handle.FileHandle values h
+	//            in handles such that h.Inode().ID() == k
+	//
+	// GUARDED_BY(mu)
+	openCounts map[fuseops.InodeID]int
+
 	// The next handle ID to hand out. We assume that this will never overflow.
 	//
 	// INVARIANT: For all keys k in handles, k < nextHandleID
@@ -343,14 +821,36 @@ type fileSystem struct {
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// Return a name for this mount to use in write leases, unique even among
+// mounts of the same bucket on the same machine.
+func leaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	var b [4]byte
+	rand.Read(b[:])
+
+	return fmt.Sprintf("%s/%d/%x", host, os.Getpid(), b)
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
 func (fs *fileSystem) checkInvariants() {
 	//////////////////////////////////
 	// inodes
 	//////////////////////////////////
 
-	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
+	// INVARIANT: For all keys k, fuseops.RootInodeID <= k
 	for id, _ := range fs.inodes {
-		if id < fuseops.RootInodeID || id >= fs.nextInodeID {
+		if id < fuseops.RootInodeID {
 			panic(fmt.Sprintf("Illegal inode ID: %v", id))
 		}
 	}
@@ -436,23 +936,10 @@ func (fs *fileSystem) checkInvariants() {
 		}
 	}
 
-	// INVARIANT: For each value v, v is not ExplicitDirInode
-	for _, v := range fs.implicitDirInodes {
-		if _, ok := v.(inode.ExplicitDirInode); ok {
-			panic(fmt.Sprintf(
-				"Unexpected implicit dir inode %d, type %T",
-				v.ID(),
-				v))
-		}
-	}
-
-	// INVARIANT: For each in in inodes such that in is DirInode but not
-	//            ExplicitDirInode, implicitDirInodes[d.Name()] == d
+	// INVARIANT: For each in in inodes such that in is ImplicitDirInode,
+	//            implicitDirInodes[d.Name()] == d
 	for _, in := range fs.inodes {
-		_, dir := in.(inode.DirInode)
-		_, edir := in.(inode.ExplicitDirInode)
-
-		if dir && !edir {
+		if _, ok := in.(inode.ImplicitDirInode); ok {
 			if !(fs.implicitDirInodes[in.Name()] == in) {
 				panic(fmt.Sprintf(
 					"implicitDirInodes mismatch: %q %v %v",
@@ -463,6 +950,43 @@ func (fs *fileSystem) checkInvariants() {
 		}
 	}
 
+	//////////////////////////////////
+	// forgottenInodes
+	//////////////////////////////////
+
+	for e := fs.forgottenInodes.Front(); e != nil; e = e.Next() {
+		// INVARIANT: Each element's value is an inode.Inode
+		in, ok := e.Value.(inode.Inode)
+		if !ok {
+			panic(fmt.Sprintf("Unexpected forgotten inode type: %T", e.Value))
+		}
+
+		// INVARIANT: For each element e, inodes[e.Value.ID()] == e.Value
+		if fs.inodes[in.ID()] != in {
+			panic(fmt.Sprintf("Forgotten inode %d not in table", in.ID()))
+		}
+
+		// INVARIANT: For each element e, forgottenElems[e.Value.ID()] == e
+		if fs.forgottenElems[in.ID()] != e {
+			panic(fmt.Sprintf("forgottenElems mismatch for inode %d", in.ID()))
+		}
+	}
+
+	// INVARIANT: len(forgottenElems) == forgottenInodes.Len()
+	if len(fs.forgottenElems) != fs.forgottenInodes.Len() {
+		panic(fmt.Sprintf(
+			"forgottenElems has %d entries, forgottenInodes %d",
+			len(fs.forgottenElems),
+			fs.forgottenInodes.Len()))
+	}
+
+	// INVARIANT: If forgottenInodes.Len() > 0, len(inodes) <= inodeTableSize
+	if fs.forgottenInodes.Len() > 0 && len(fs.inodes) > fs.inodeTableSize {
+		panic(fmt.Sprintf(
+			"Kept forgotten inodes with %d inodes in the table",
+			len(fs.inodes)))
+	}
+
 	//////////////////////////////////
 	// handles
 	//////////////////////////////////
@@ -477,6 +1001,27 @@ func (fs *fileSystem) checkInvariants() {
 		}
 	}
 
+	//////////////////////////////////
+	// openCounts
+	//////////////////////////////////
+
+	// INVARIANT: For each k/v, v > 0
+	// INVARIANT: For each k/v, v is the number of *handle.FileHandle values h
+	//            in handles such that h.Inode().ID() == k
+	openCounts := make(map[fuseops.InodeID]int)
+	for _, h := range fs.handles {
+		if fh, ok := h.(*handle.FileHandle); ok {
+			openCounts[fh.Inode().ID()]++
+		}
+	}
+
+	if !reflect.DeepEqual(openCounts, fs.openCounts) {
+		panic(fmt.Sprintf(
+			"Open counts mismatch: %v vs. %v",
+			fs.openCounts,
+			openCounts))
+	}
+
 	//////////////////////////////////
 	// nextHandleID
 	//////////////////////////////////
@@ -489,17 +1034,104 @@ func (fs *fileSystem) checkInvariants() {
 	}
 }
 
+// Kinds of inode, distinguished when deriving inode IDs.
+const (
+	dirInodeKind     = "dir"
+	fileInodeKind    = "file"
+	symlinkInodeKind = "symlink"
+)
+
+// Choose an ID for a new inode with the given name and kind. IDs are derived
+// from a hash of the two rather than handed out in sequence, so that an object
+// gets the same inode ID each time gcsfuse is mounted, for the sake of programs
+// that remember inode numbers. (NFS handles issued before a restart still fail
+// with ESTALE, since export.go only reconnects inodes it holds.) If the ID is
+// taken, by an inode for another generation of the object or by a hash
+// collision, or reserved for the control directory, use the next free one.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) chooseInodeID(
+	name string,
+	kind string) (id fuseops.InodeID) {
+	h := fnv.New64a()
+	io.WriteString(h, kind)
+	h.Write([]byte{0})
+	io.WriteString(h, name)
+
+	id = fuseops.InodeID(h.Sum64())
+	for {
+		if _, ok := fs.inodes[id]; !ok && id > lastReservedInodeID {
+			return
+		}
+
+		id++
+	}
+}
+
+// Return the generation number to report to the kernel for the inode. It is
+// derived from the inode's name, so it is the same each time the name is
+// looked up, in this mount or a later one, but differs when chooseInodeID
+// gives a colliding name the ID on a later occasion. NFS clients holding a
+// file handle for the old name then get ESTALE rather than the wrong file.
+func generationNumber(in inode.Inode) fuseops.GenerationNumber {
+	// Use a different hash function from chooseInodeID, so that names whose
+	// IDs collide don't also have the same generation.
+	h := fnv.New64()
+	io.WriteString(h, in.Name())
+	return fuseops.GenerationNumber(h.Sum64())
+}
+
 // Implementation detail of lookUpOrCreateInodeIfNotStale; do not use outside
 // of that function.
 //
 // LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
-	// Choose an ID.
-	id := fs.nextInodeID
-	fs.nextInodeID++
+	// Choose an ID. Explicit and implicit directories share a kind, so that a
+	// directory keeps its ID when its placeholder object comes or goes.
+	kind := fileInodeKind
+	switch {
+	case inode.IsDirName(name):
+		kind = dirInodeKind
+
+	case fs.softDeleted != nil && inode.IsTrashName(name):
+
+	case inode.IsSymlink(o):
+		kind = symlinkInodeKind
+	}
+
+	id := fs.chooseInodeID(name, kind)
+	attrCacheTTL, typeCacheTTL, nameFilter := fs.settingsFor(name)
 
 	// Create the inode.
 	switch {
+	// The trash, which holds the soft-deleted objects.
+	case fs.softDeleted != nil && inode.IsTrashName(name) && inode.IsDirName(name):
+		in = inode.NewTrashDirInode(
+			id,
+			name,
+			fuseops.InodeAttributes{
+				Uid:  fs.uid,
+				Gid:  fs.gid,
+				Mode: fs.dirMode &^ 0222,
+
+				// We guarantee only that directory times be "reasonable".
+				Atime: fs.mtimeClock.Now(),
+				Ctime: fs.mtimeClock.Now(),
+				Mtime: fs.mtimeClock.Now(),
+			},
+			fs.softDeleted)
+
+	// Soft-deleted objects, including symlinks, which we show as files.
+	case fs.softDeleted != nil && inode.IsTrashName(name):
+		in = inode.NewTrashFileInode(
+			id,
+			o,
+			fuseops.InodeAttributes{
+				Uid:  fs.uid,
+				Gid:  fs.gid,
+				Mode: fs.fileMode &^ 0222,
+			})
+
 	// Explicit directories
 	case o != nil && inode.IsDirName(o.Name):
 		in = inode.NewExplicitDirInode(
@@ -516,14 +1148,22 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
-			fs.dirTypeCacheTTL,
+			fs.normalizeName,
+			fs.caseInsensitive,
+			nameFilter,
+			fs.hideDeniedDirs,
+			fs.isFlatDir(name),
+			typeCacheTTL,
+			attrCacheTTL,
+			fs.dirListingCacheTTL,
 			fs.bucket,
+			fs.folders,
 			fs.mtimeClock,
 			fs.cacheClock)
 
 	// Implicit directories
 	case inode.IsDirName(name):
-		in = inode.NewDirInode(
+		in = inode.NewImplicitDirInode(
 			id,
 			name,
 			fuseops.InodeAttributes{
@@ -537,8 +1177,16 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Mtime: fs.mtimeClock.Now(),
 			},
 			fs.implicitDirs,
-			fs.dirTypeCacheTTL,
+			fs.normalizeName,
+			fs.caseInsensitive,
+			nameFilter,
+			fs.hideDeniedDirs,
+			fs.isFlatDir(name),
+			typeCacheTTL,
+			attrCacheTTL,
+			fs.dirListingCacheTTL,
 			fs.bucket,
+			fs.folders,
 			fs.mtimeClock,
 			fs.cacheClock)
 
@@ -550,7 +1198,10 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 				Uid:  fs.uid,
 				Gid:  fs.gid,
 				Mode: fs.fileMode | os.ModeSymlink,
-			})
+			},
+			attrCacheTTL,
+			fs.bucket,
+			fs.cacheClock)
 
 	default:
 		in = inode.NewFileInode(
@@ -564,7 +1215,15 @@ func (fs *fileSystem) mintInode(name string, o *gcs.Object) (in inode.Inode) {
 			fs.bucket,
 			fs.syncer,
 			fs.tempDir,
-			fs.mtimeClock)
+			fs.spillThreshold,
+			fs.diskCipher,
+			fs.stagingArea,
+			fs.spaceChecker,
+			fs.leaseConfig,
+			fs.streamingWrites,
+			attrCacheTTL,
+			fs.mtimeClock,
+			fs.cacheClock)
 	}
 
 	// Place it in our map of IDs to inodes.
@@ -593,15 +1252,25 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 	}
 
 	// Ensure that no matter which inode we return, we increase its lookup count
-	// on the way out and then release the file system lock.
+	// on the way out and then release the file system lock. If the inode had
+	// been forgotten, it is now in use again. If we minted one, we may need to
+	// make room for it.
 	//
 	// INVARIANT: we return with fs.mu held, and with in.mu held with in != nil.
 	defer func() {
 		if in != nil {
 			in.IncrementLookupCount()
+			fs.unforgetInode(in)
 		}
 
+		evicted := fs.evictForgottenInodes()
 		fs.mu.Unlock()
+
+		// We return holding the inode's lock, so we can't take those of the
+		// evicted inodes.
+		if len(evicted) > 0 {
+			go destroyInodes(evicted)
+		}
 	}()
 
 	// Handle implicit directories.
@@ -615,7 +1284,7 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 		in, ok = fs.implicitDirInodes[name]
 		if !ok {
 			in = fs.mintInode(name, nil)
-			fs.implicitDirInodes[in.Name()] = in.(inode.DirInode)
+			fs.implicitDirInodes[in.Name()] = in.(inode.ImplicitDirInode)
 		}
 
 		in.Lock()
@@ -684,6 +1353,11 @@ func (fs *fileSystem) lookUpOrCreateInodeIfNotStale(
 		in = fs.mintInode(o.Name, o)
 		fs.generationBackedInodes[in.Name()] = in.(inode.GenerationBackedInode)
 
+		// Make room for it before we drop fs.mu again.
+		if evicted := fs.evictForgottenInodes(); len(evicted) > 0 {
+			go destroyInodes(evicted)
+		}
+
 		continue
 	}
 }
@@ -788,18 +1462,29 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 	// Decrement the lookup count.
 	shouldDestroy := in.DecrementLookupCount(N)
 
+	// If the kernel has forgotten the inode, keep it for reuse if there's room
+	// and it is still the one we would find for its name.
+	indexed := fs.generationBackedInodes[name] == in ||
+		fs.implicitDirInodes[name] == in
+
+	if shouldDestroy && fs.inodeTableSize > 0 && indexed {
+		fs.forgottenElems[in.ID()] = fs.forgottenInodes.PushFront(in)
+		shouldDestroy = false
+	}
+
 	// Update file system state, orphaning the inode if we're going to destroy it
 	// below.
 	if shouldDestroy {
-		delete(fs.inodes, in.ID())
-
-		// Update indexes if necessary.
-		if fs.generationBackedInodes[name] == in {
-			delete(fs.generationBackedInodes, name)
-		}
+		fs.removeInode(in)
+	}
 
-		if fs.implicitDirInodes[name] == in {
-			delete(fs.implicitDirInodes, name)
+	// Make room if necessary. The inode itself may be the one to go.
+	var evicted []inode.Inode
+	for _, e := range fs.evictForgottenInodes() {
+		if e == in {
+			shouldDestroy = true
+		} else {
+			evicted = append(evicted, e)
 		}
 	}
 
@@ -810,11 +1495,77 @@ func (fs *fileSystem) unlockAndDecrementLookupCount(
 	if shouldDestroy {
 		destroyErr := in.Destroy()
 		if destroyErr != nil {
-			log.Printf("Error destroying inode %q: %v", name, destroyErr)
+			logger.Errorf("Error destroying inode %q: %v", name, destroyErr)
 		}
 	}
 
 	in.Unlock()
+
+	// Destroy any other inodes we evicted, now that we hold no locks.
+	destroyInodes(evicted)
+}
+
+// Remove the inode from the table and indexes, orphaning it so that it can be
+// destroyed.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) removeInode(in inode.Inode) {
+	name := in.Name()
+	delete(fs.inodes, in.ID())
+
+	// Update indexes if necessary.
+	if fs.generationBackedInodes[name] == in {
+		delete(fs.generationBackedInodes, name)
+	}
+
+	if fs.implicitDirInodes[name] == in {
+		delete(fs.implicitDirInodes, name)
+	}
+
+	fs.unforgetInode(in)
+}
+
+// If the inode is among those forgotten by the kernel but kept for reuse,
+// remove it from that list.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) unforgetInode(in inode.Inode) {
+	if e, ok := fs.forgottenElems[in.ID()]; ok {
+		fs.forgottenInodes.Remove(e)
+		delete(fs.forgottenElems, in.ID())
+	}
+}
+
+// While the inode table holds more than inodeTableSize inodes, remove the
+// least recently forgotten inode from it. Return the inodes removed, which the
+// caller must arrange to destroy without holding fs.mu.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) evictForgottenInodes() (evicted []inode.Inode) {
+	for len(fs.inodes) > fs.inodeTableSize && fs.forgottenInodes.Len() > 0 {
+		in := fs.forgottenInodes.Back().Value.(inode.Inode)
+		fs.removeInode(in)
+		evicted = append(evicted, in)
+	}
+
+	return
+}
+
+// Destroy inodes evicted from the table. Nobody else can find them any more,
+// but a lookup that found one earlier may still be waiting for its lock, and
+// will notice that it has gone once it gets it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func destroyInodes(inodes []inode.Inode) {
+	for _, in := range inodes {
+		in.Lock()
+		err := in.Destroy()
+		in.Unlock()
+
+		if err != nil {
+			logger.Errorf("Error destroying inode %q: %v", in.Name(), err)
+		}
+	}
 }
 
 // A helper function for use after incrementing an inode's lookup count.
@@ -853,8 +1604,11 @@ func (fs *fileSystem) unlockAndMaybeDisposeOfInode(
 	fs.unlockAndDecrementLookupCount(in, 1)
 }
 
-// Fetch attributes for the supplied inode and fill in an appropriate
-// expiration time for them.
+// Fetch attributes for the supplied inode and fill in an expiration time for
+// them matching the time at which the inode's own cached copy expires, so that
+// the kernel comes back to us just when we would need to recompute them. If
+// the kernel is allowed to cache attributes for a fixed time, use that
+// instead.
 //
 // LOCKS_REQUIRED(in)
 func (fs *fileSystem) getAttributes(
@@ -869,45 +1623,99 @@ func (fs *fileSystem) getAttributes(
 		return
 	}
 
-	// Set up the expiration time.
-	if fs.inodeAttributeCacheTTL > 0 {
-		expiration = time.Now().Add(fs.inodeAttributeCacheTTL)
+	// Set up the expiration time. The inode's cache expiration is according to
+	// the cache clock, so convert it to a time relative to time.Now(). The fuse
+	// package converts this to a duration by subtracting time.Now(), which uses
+	// the monotonic clock reading, so this is unaffected by changes to the
+	// system time.
+	if fs.kernelAttrCacheTTL > 0 {
+		expiration = time.Now().Add(fs.kernelAttrCacheTTL)
+	} else if cacheExpiration := in.AttributesExpiration(); !cacheExpiration.IsZero() {
+		expiration = time.Now().Add(cacheExpiration.Sub(fs.cacheClock.Now()))
 	}
 
 	return
 }
 
-// inodeOrDie returns the inode with the given ID, panicking with a helpful
-// error message if it doesn't exist.
-//
-// LOCKS_REQUIRED(fs.mu)
-func (fs *fileSystem) inodeOrDie(id fuseops.InodeID) (in inode.Inode) {
-	in = fs.inodes[id]
-	if in == nil {
-		panic(fmt.Sprintf("inode %d doesn't exist", id))
-	}
-
-	return
+// Is the directory with the supplied name at the deepest level allowed by
+// MaxDepth, and so assumed to have no child directories?
+func (fs *fileSystem) isFlatDir(name string) bool {
+	return fs.maxDepth > 0 && strings.Count(name, "/")+1 >= fs.maxDepth
 }
 
-// dirInodeOrDie returns the directory inode with the given ID, panicking with
-// a helpful error message if it doesn't exist or is the wrong type.
-//
-// LOCKS_REQUIRED(fs.mu)
-func (fs *fileSystem) dirInodeOrDie(id fuseops.InodeID) (in inode.DirInode) {
-	tmp := fs.inodes[id]
-	in, ok := tmp.(inode.DirInode)
-	if !ok {
-		panic(fmt.Sprintf("inode %d is %T, wanted inode.DirInode", id, tmp))
+// Return the time until which the kernel may cache an entry for a name
+// returned now, or the zero time if it may not.
+func (fs *fileSystem) entryExpiration() (expiration time.Time) {
+	if fs.kernelEntryCacheTTL > 0 {
+		expiration = time.Now().Add(fs.kernelEntryCacheTTL)
 	}
 
 	return
 }
 
-// fileInodeOrDie returns the file inode with the given ID, panicking with a
-// helpful error message if it doesn't exist or is the wrong type.
+// Bring a clean file inode or a symlink inode up to date with any newer
+// generation of its object written by someone else, so that a remotely
+// replaced file or symlink isn't served stale indefinitely. Inodes that are
+// open are left alone, so that their readers keep a consistent view, as are
+// inodes that are no longer the ones indexed for their names, because another
+// inode is known by the newer generation.
 //
-// LOCKS_REQUIRED(fs.mu)
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) refreshInode(
+	ctx context.Context,
+	in inode.RefreshableInode) (err error) {
+	// While we hold the inode lock, lookUpOrCreateInodeIfNotStale can't decide
+	// to replace the index entry, so this remains true until we're done.
+	fs.mu.Lock()
+	indexed := fs.generationBackedInodes[in.Name()] == in
+	open := fs.openCounts[in.ID()] > 0
+	fs.mu.Unlock()
+
+	if !indexed || open {
+		return
+	}
+
+	_, err = in.Refresh(ctx)
+	if err != nil {
+		err = fmt.Errorf("Refresh: %v", err)
+		return
+	}
+
+	return
+}
+
+// inodeOrDie returns the inode with the given ID, panicking with a helpful
+// error message if it doesn't exist.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) inodeOrDie(id fuseops.InodeID) (in inode.Inode) {
+	in = fs.inodes[id]
+	if in == nil {
+		panic(fmt.Sprintf("inode %d doesn't exist", id))
+	}
+
+	return
+}
+
+// dirInodeOrDie returns the directory inode with the given ID, panicking with
+// a helpful error message if it doesn't exist or is the wrong type.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) dirInodeOrDie(id fuseops.InodeID) (in inode.DirInode) {
+	tmp := fs.inodes[id]
+	in, ok := tmp.(inode.DirInode)
+	if !ok {
+		panic(fmt.Sprintf("inode %d is %T, wanted inode.DirInode", id, tmp))
+	}
+
+	return
+}
+
+// fileInodeOrDie returns the file inode with the given ID, panicking with a
+// helpful error message if it doesn't exist or is the wrong type.
+//
+// LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) fileInodeOrDie(id fuseops.InodeID) (in *inode.FileInode) {
 	tmp := fs.inodes[id]
 	in, ok := tmp.(*inode.FileInode)
@@ -933,28 +1741,57 @@ func (fs *fileSystem) symlinkInodeOrDie(
 	return
 }
 
+// Return the bucket that a newly created file handle should read through.
+func (fs *fileSystem) handleBucket() gcs.Bucket {
+	if fs.handleReadThrottle == nil {
+		return fs.bucket
+	}
+
+	return gcsx.NewThrottledReadBucket(
+		fs.handleReadThrottle.NewClient(1),
+		fs.bucket)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // fuse.FileSystem methods
 ////////////////////////////////////////////////////////////////////////
 
 func (fs *fileSystem) Destroy() {
 	fs.stopGarbageCollecting()
+	fs.stopFlushing()
+	fs.stopWatching()
+
+	if fs.stagingArea != nil {
+		fs.stagingArea.Close()
+	}
 }
 
 func (fs *fileSystem) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
-	// Simulate a large amount of free space so that the Finder doesn't refuse to
-	// copy in files. (See issue #125.) Use 2^17 as the block size because that
-	// is the largest that OS X will pass on.
+	// By default simulate a large amount of free space so that the Finder
+	// doesn't refuse to copy in files. (See issue #125.) Use 2^17 as the block
+	// size because that is the largest that OS X will pass on.
 	op.BlockSize = 1 << 17
 	op.Blocks = 1 << 33
-	op.BlocksFree = op.Blocks
-	op.BlocksAvailable = op.Blocks
+	if fs.capacity != 0 {
+		op.Blocks = fs.capacity / uint64(op.BlockSize)
+	}
 
 	// Similarly with inodes.
 	op.Inodes = 1 << 50
-	op.InodesFree = op.Inodes
+
+	// Report the bucket's usage if we know it. Don't wait for a scan if we
+	// don't; programs expect statfs(2) to be cheap.
+	var usage gcsx.BucketUsage
+	if fs.usageScanner != nil {
+		usage, _ = fs.usageScanner.Usage()
+	}
+
+	usedBlocks := (usage.Bytes + uint64(op.BlockSize) - 1) / uint64(op.BlockSize)
+	op.BlocksFree = op.Blocks - minUint64(usedBlocks, op.Blocks)
+	op.BlocksAvailable = op.BlocksFree
+	op.InodesFree = op.Inodes - minUint64(usage.Objects, op.Inodes)
 
 	// Prefer large transfers. This is the largest value that OS X will
 	// faithfully pass on, according to fuseops/ops.go.
@@ -967,6 +1804,25 @@ func (fs *fileSystem) StatFS(
 func (fs *fileSystem) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
+	// Reconnect NFS file handles. See export.go.
+	if fs.nfsExport {
+		switch op.Name {
+		case ".":
+			err = fs.lookUpSelf(ctx, op)
+			return
+
+		case "..":
+			err = fs.lookUpParent(ctx, op)
+			return
+		}
+	}
+
+	// The trash isn't a child of the root directory in the bucket.
+	if fs.isTrashDir(op.Parent, op.Name) {
+		err = fs.lookUpTrashDir(ctx, op)
+		return
+	}
+
 	// Find the parent directory in question.
 	fs.mu.Lock()
 	parent := fs.dirInodeOrDie(op.Parent)
@@ -983,6 +1839,8 @@ func (fs *fileSystem) LookUpInode(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.Generation = generationNumber(child)
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1004,6 +1862,16 @@ func (fs *fileSystem) GetInodeAttributes(
 	in.Lock()
 	defer in.Unlock()
 
+	// Pick up changes made by other writers, unless we're still allowed to use
+	// the attributes we've cached.
+	cached := in.AttributesExpiration().After(fs.cacheClock.Now())
+	if r, ok := in.(inode.RefreshableInode); ok && !cached {
+		err = fs.refreshInode(ctx, r)
+		if err != nil {
+			return
+		}
+	}
+
 	// Grab its attributes.
 	op.Attributes, op.AttributesExpiration, err = fs.getAttributes(ctx, in)
 	if err != nil {
@@ -1037,7 +1905,21 @@ func (fs *fileSystem) SetInodeAttributes(
 
 	// Truncate files.
 	if isFile && op.Size != nil {
+		if !file.Dirty() {
+			err = fs.checkRetention(ctx, file.Source())
+			if err != nil {
+				return
+			}
+		}
+
 		err = file.Truncate(ctx, int64(*op.Size))
+
+		// Special case: pass on these so the user knows what's wrong.
+		switch err {
+		case syscall.ENOSPC, syscall.EBUSY, syscall.ENOTSUP:
+			return
+		}
+
 		if err != nil {
 			err = fmt.Errorf("Truncate: %v", err)
 			return
@@ -1084,6 +1966,12 @@ func (fs *fileSystem) MkDir(
 	parent := fs.dirInodeOrDie(op.Parent)
 	fs.mu.Unlock()
 
+	// Refuse to create directories where we assume there are none.
+	if fs.isFlatDir(parent.Name()) {
+		err = syscall.EPERM
+		return
+	}
+
 	// Create an empty backing object for the child, failing if it already
 	// exists.
 	parent.Lock()
@@ -1104,12 +1992,22 @@ func (fs *fileSystem) MkDir(
 
 	// Attempt to create a child inode using the object we created. If we fail to
 	// do so, it means someone beat us to the punch with a newer generation
-	// (unlikely, so we're probably okay with failing here).
-	fs.mu.Lock()
-	child := fs.lookUpOrCreateInodeIfNotStale(o.Name, o)
-	if child == nil {
-		err = fmt.Errorf("Newly-created record is already stale")
-		return
+	// (unlikely, so we're probably okay with failing here). If we created a
+	// folder instead, look it up.
+	var child inode.Inode
+	if o == nil {
+		child, err = fs.lookUpOrCreateChildInode(ctx, parent, op.Name)
+		if err != nil {
+			err = fmt.Errorf("lookUpOrCreateChildInode: %v", err)
+			return
+		}
+	} else {
+		fs.mu.Lock()
+		child = fs.lookUpOrCreateInodeIfNotStale(o.Name, o)
+		if child == nil {
+			err = fmt.Errorf("Newly-created record is already stale")
+			return
+		}
 	}
 
 	defer fs.unlockAndMaybeDisposeOfInode(child, &err)
@@ -1117,6 +2015,8 @@ func (fs *fileSystem) MkDir(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.Generation = generationNumber(child)
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1142,6 +2042,8 @@ func (fs *fileSystem) MkNode(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.Generation = generationNumber(child)
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1218,7 +2120,8 @@ func (fs *fileSystem) CreateFile(
 
 	fs.handles[handleID] = handle.NewFileHandle(
 		child.(*inode.FileInode),
-		fs.bucket)
+		fs.handleBucket())
+	fs.openCounts[child.ID()]++
 	op.Handle = handleID
 
 	fs.mu.Unlock()
@@ -1226,6 +2129,8 @@ func (fs *fileSystem) CreateFile(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.Generation = generationNumber(child)
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1277,6 +2182,8 @@ func (fs *fileSystem) CreateSymlink(
 	// Fill out the response.
 	e := &op.Entry
 	e.Child = child.ID()
+	e.Generation = generationNumber(child)
+	e.EntryExpiration = fs.entryExpiration()
 	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, child)
 
 	if err != nil {
@@ -1287,6 +2194,17 @@ func (fs *fileSystem) CreateSymlink(
 	return
 }
 
+// A GCS object has exactly one name, so we can't give it another that shares
+// later modifications. Copying it instead would be misleading.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	err = syscall.ENOTSUP
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) RmDir(
 	ctx context.Context,
@@ -1330,8 +2248,9 @@ func (fs *fileSystem) RmDir(
 	//
 	//     https://github.com/GoogleCloudPlatform/gcsfuse/issues/9
 	//
-	//
+	// Unless configured to delete its contents instead.
 	var tok string
+	var nonEmpty bool
 	for {
 		var entries []fuseutil.Dirent
 		entries, tok, err = childDir.ReadEntries(ctx, tok)
@@ -1342,8 +2261,13 @@ func (fs *fileSystem) RmDir(
 
 		// Are there any entries?
 		if len(entries) != 0 {
-			err = fuse.ENOTEMPTY
-			return
+			if !fs.recursiveRmDir {
+				err = fuse.ENOTEMPTY
+				return
+			}
+
+			nonEmpty = true
+			break
 		}
 
 		// Are we done listing?
@@ -1355,11 +2279,49 @@ func (fs *fileSystem) RmDir(
 	// We are done with the child.
 	cleanUpAndUnlockChild()
 
+	if nonEmpty {
+		err = fs.deleteDirContents(ctx, childDir.Name())
+		switch err {
+		case nil:
+		case syscall.EPERM, fuse.ENOTEMPTY:
+			return
+		default:
+			err = fmt.Errorf("deleteDirContents: %v", err)
+			return
+		}
+	}
+
+	// Children hidden by the name filter or MaxDepth weren't listed above, nor
+	// deleted with the rest, but still keep the directory from being empty.
+	fs.mu.Lock()
+	_, _, filter := fs.settingsFor(childDir.Name())
+	fs.mu.Unlock()
+
+	if nonEmpty || filter != nil || fs.isFlatDir(childDir.Name()) {
+		var hidden bool
+		hidden, err = fs.hasChildren(ctx, childDir.Name())
+		if err != nil {
+			err = fmt.Errorf("hasChildren: %v", err)
+			return
+		}
+
+		if hidden {
+			err = fuse.ENOTEMPTY
+			return
+		}
+	}
+
 	// Delete the backing object.
 	parent.Lock()
-	err = parent.DeleteChildDir(ctx, op.Name)
+	err = parent.DeleteChildDir(ctx, op.Name, childDir)
 	parent.Unlock()
 
+	// Special case: a folder that isn't empty after all.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = fuse.ENOTEMPTY
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("DeleteChildDir: %v", err)
 		return
@@ -1368,6 +2330,38 @@ func (fs *fileSystem) RmDir(
 	return
 }
 
+// Does the directory with the supplied name have any children in the bucket,
+// whether or not they are visible in the file system?
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) hasChildren(
+	ctx context.Context,
+	dirName string) (ok bool, err error) {
+	// The placeholder object sorts first, so two results are enough.
+	listing, err := fs.bucket.ListObjects(
+		ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:     dirName,
+			Delimiter:  "/",
+			MaxResults: 2,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("ListObjects: %v", err)
+		return
+	}
+
+	for _, o := range listing.Objects {
+		if o.Name != dirName {
+			ok = true
+			return
+		}
+	}
+
+	ok = len(listing.CollapsedRuns) != 0
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) Rename(
 	ctx context.Context,
@@ -1378,6 +2372,12 @@ func (fs *fileSystem) Rename(
 	newParent := fs.dirInodeOrDie(op.NewParent)
 	fs.mu.Unlock()
 
+	// Renaming out of the trash restores a soft-deleted object.
+	if fs.softDeleted != nil && inode.IsTrashName(oldParent.Name()) {
+		err = fs.restoreFromTrash(ctx, oldParent, op.OldName, newParent, op.NewName)
+		return
+	}
+
 	// Find the object in the old location.
 	oldParent.Lock()
 	lr, err := oldParent.LookUpChild(ctx, op.OldName)
@@ -1393,9 +2393,28 @@ func (fs *fileSystem) Rename(
 		return
 	}
 
-	// We don't support renaming directories.
+	// Directories are renamed differently.
 	if inode.IsDirName(lr.FullName) {
-		err = fuse.ENOSYS
+		err = fs.renameDir(
+			ctx,
+			oldParent,
+			op.OldName,
+			lr.FullName,
+			newParent,
+			op.NewName)
+
+		return
+	}
+
+	// Refuse if either the object or one that it would replace is held or
+	// retained, before doing anything.
+	err = fs.checkRetention(ctx, lr.Object)
+	if err != nil {
+		return
+	}
+
+	err = fs.checkChildRetention(ctx, newParent, op.NewName)
+	if err != nil {
 		return
 	}
 
@@ -1430,6 +2449,149 @@ func (fs *fileSystem) Rename(
 	return
 }
 
+// Rename a directory by renaming its folder, which moves everything within it
+// in a single atomic operation. Only buckets with a hierarchical namespace
+// have folders. For others we would have to copy and delete the directory's
+// contents one object at a time, leaving a mess if interrupted, so we fail
+// with ENOSYS.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(oldParent)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) renameDir(
+	ctx context.Context,
+	oldParent inode.DirInode,
+	oldName string,
+	oldFullName string,
+	newParent inode.DirInode,
+	newName string) (err error) {
+	if fs.folders == nil {
+		err = fuse.ENOSYS
+		return
+	}
+
+	if fs.isFlatDir(newParent.Name()) {
+		err = syscall.EPERM
+		return
+	}
+
+	// rename(2) may replace an empty directory, but we can't do that atomically,
+	// so refuse to replace anything.
+	newParent.Lock()
+	lr, err := newParent.LookUpChild(ctx, newName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	if lr.Exists() {
+		err = fuse.ENOTEMPTY
+		if !inode.IsDirName(lr.FullName) {
+			err = fuse.ENOTDIR
+		}
+
+		return
+	}
+
+	// Rename the folder.
+	oldParent.Lock()
+	err = oldParent.RenameChildDir(ctx, oldName, newParent, newName)
+	oldParent.Unlock()
+
+	// Special case: someone beat us to the new name.
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = fuse.ENOTEMPTY
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("RenameChildDir: %v", err)
+		return
+	}
+
+	newParent.Lock()
+	newParent.NoteRenamedChildDir(newName)
+	newParent.Unlock()
+
+	fs.forgetRenamedDir(oldFullName, oldParent, oldName, newParent, newName)
+
+	return
+}
+
+// Inodes know their names, so those for a renamed directory and everything
+// within it can't follow it to its new name. Stop finding them, so that
+// looking up the new names creates fresh inodes, and tell the kernel to drop
+// its entries for the directory, which still lead to the old inode.
+//
+// Implicit directory inodes must stay indexed under their names, so we
+// discard their caches instead, in case the old name is reused.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) forgetRenamedDir(
+	oldFullName string,
+	oldParent inode.DirInode,
+	oldName string,
+	newParent inode.DirInode,
+	newName string) {
+	var moved []inode.Inode
+	var evicted []inode.Inode
+
+	fs.mu.Lock()
+	for _, in := range fs.inodes {
+		if !strings.HasPrefix(in.Name(), oldFullName) {
+			continue
+		}
+
+		if _, ok := fs.forgottenElems[in.ID()]; ok {
+			fs.removeInode(in)
+			evicted = append(evicted, in)
+			continue
+		}
+
+		if fs.generationBackedInodes[in.Name()] == in {
+			delete(fs.generationBackedInodes, in.Name())
+		}
+
+		moved = append(moved, in)
+	}
+
+	notifier := fs.notifier
+	fs.mu.Unlock()
+
+	destroyInodes(evicted)
+
+	for _, in := range moved {
+		in.Lock()
+		if ci, ok := in.(inode.CachingInode); ok {
+			ci.InvalidateCaches()
+		}
+		in.Unlock()
+	}
+
+	// The kernel holds the locks of both parents until we reply to the rename,
+	// and needs them to invalidate an entry, so we can't wait for it.
+	if notifier == nil {
+		return
+	}
+
+	go func() {
+		for _, e := range []struct {
+			parent fuseops.InodeID
+			name   string
+		}{
+			{oldParent.ID(), oldName},
+			{newParent.ID(), newName},
+		} {
+			err := notifier.InvalidateEntry(e.parent, e.name)
+			if err != nil && err != syscall.ENOENT {
+				logger.Debugf("InvalidateEntry(%v, %q): %v", e.parent, e.name, err)
+			}
+		}
+	}()
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) Unlink(
 	ctx context.Context,
@@ -1439,6 +2601,11 @@ func (fs *fileSystem) Unlink(
 	parent := fs.dirInodeOrDie(op.Parent)
 	fs.mu.Unlock()
 
+	err = fs.checkChildRetention(ctx, parent, op.Name)
+	if err != nil {
+		return
+	}
+
 	parent.Lock()
 	defer parent.Unlock()
 
@@ -1473,7 +2640,18 @@ func (fs *fileSystem) OpenDir(
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.handles[handleID] = newDirHandle(in, fs.implicitDirs)
+	// The trash and the control directory are looked up by name but not
+	// listed; see trash.go and control.go.
+	var hidden []string
+	if fs.isTrashDir(in.ID(), inode.TrashDirName) {
+		hidden = append(hidden, inode.TrashDirName)
+	}
+
+	if fs.control != nil && in.ID() == fuseops.RootInodeID {
+		hidden = append(hidden, controlDirName)
+	}
+
+	fs.handles[handleID] = newDirHandle(in, fs.implicitDirs, fs.dirsFirst, hidden)
 	op.Handle = handleID
 
 	return
@@ -1517,24 +2695,35 @@ func (fs *fileSystem) ReleaseDirHandle(
 func (fs *fileSystem) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// Find the inode.
+	fs.mu.Lock()
 	in := fs.fileInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	in.Lock()
+	defer in.Unlock()
+
+	// Pick up changes made by other writers.
+	err = fs.refreshInode(ctx, in)
+	if err != nil {
+		return
+	}
 
 	// Allocate a handle.
+	fs.mu.Lock()
 	handleID := fs.nextHandleID
 	fs.nextHandleID++
 
-	fs.handles[handleID] = handle.NewFileHandle(in, fs.bucket)
+	fs.handles[handleID] = handle.NewFileHandle(in, fs.handleBucket())
+	fs.openCounts[in.ID()]++
+	fs.mu.Unlock()
+
 	op.Handle = handleID
 
-	// When we observe object generations that we didn't create, we assign them
-	// new inode IDs. So for a given inode, all modifications go through the
-	// kernel. Therefore it's safe to tell the kernel to keep the page cache from
-	// open to open for a given inode.
-	op.KeepPageCache = true
+	// Modifications made through an inode go through the kernel, so the page
+	// cache stays valid from open to open unless the inode has since been
+	// refreshed with contents written by someone else.
+	op.KeepPageCache = !in.TakeContentReplaced()
 
 	return
 }
@@ -1574,7 +2763,16 @@ func (fs *fileSystem) ReadSymlink(
 	in.Lock()
 	defer in.Unlock()
 
-	// Serve the request.
+	// Pick up a target changed by another writer, unless we're still allowed to
+	// use the attributes we've cached.
+	if !in.AttributesExpiration().After(fs.cacheClock.Now()) {
+		err = fs.refreshInode(ctx, in)
+		if err != nil {
+			return
+		}
+	}
+
+	// Serve the request.
 	op.Target = in.Target()
 
 	return
@@ -1592,12 +2790,84 @@ func (fs *fileSystem) WriteFile(
 	in.Lock()
 	defer in.Unlock()
 
+	// The first write since the object was last written out is the time to
+	// find out whether it may be overwritten.
+	if !in.Dirty() {
+		err = fs.checkRetention(ctx, in.Source())
+		if err != nil {
+			return
+		}
+	}
+
 	// Serve the request.
 	err = in.Write(ctx, op.Data, op.Offset)
 
 	return
 }
 
+// The fallocate(2) mode flag asking that the file's size be left alone.
+const fallocKeepSize = 0x1
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	// GCS has no notion of reserving space, and the local temp file is sparse
+	// anyway, so the only useful thing to do is to extend the file. Punching
+	// holes and zeroing ranges aren't supported.
+	if op.Mode&^fallocKeepSize != 0 {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	if op.Mode&fallocKeepSize != 0 {
+		return
+	}
+
+	// Find the inode.
+	fs.mu.Lock()
+	in := fs.fileInodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	in.Lock()
+	defer in.Unlock()
+
+	// Is there anything to do?
+	attrs, err := in.Attributes(ctx)
+	if err != nil {
+		err = fmt.Errorf("Attributes: %v", err)
+		return
+	}
+
+	size := op.Offset + op.Length
+	if size <= attrs.Size {
+		return
+	}
+
+	if !in.Dirty() {
+		err = fs.checkRetention(ctx, in.Source())
+		if err != nil {
+			return
+		}
+	}
+
+	// Extend the file, just as ftruncate(2) would.
+	err = in.Truncate(ctx, int64(size))
+
+	// Special case: pass on these so the user knows what's wrong.
+	switch err {
+	case syscall.ENOSPC, syscall.EBUSY, syscall.ENOTSUP:
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Truncate: %v", err)
+		return
+	}
+
+	return
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) SyncFile(
 	ctx context.Context,
@@ -1642,10 +2912,554 @@ func (fs *fileSystem) ReleaseFileHandle(
 	defer fs.mu.Unlock()
 
 	// Destroy the handle.
-	fs.handles[op.Handle].(*handle.FileHandle).Destroy()
+	fh := fs.handles[op.Handle].(*handle.FileHandle)
+	fh.Destroy()
 
-	// Update the map.
+	// Update the maps.
 	delete(fs.handles, op.Handle)
 
+	id := fh.Inode().ID()
+	fs.openCounts[id]--
+	if fs.openCounts[id] == 0 {
+		delete(fs.openCounts, id)
+	}
+
+	return
+}
+
+// Extended attributes in this namespace on a directory with a placeholder
+// object are backed by the object's custom metadata, keyed by the rest of the
+// name. No other inodes have extended attributes.
+const xattrUserPrefix = "user."
+
+// A read-only extended attribute on files when ServerConfig.SignURL is set. It
+// isn't listed, and is computed without touching GCS.
+const signedURLXattr = "user.gcsfuse.signed_url"
+
+// An extended attribute on files giving the storage class of the object, which
+// may be set to choose the class that the contents are given when next
+// written out. Doesn't touch GCS.
+const storageClassXattr = "user.gcsfuse.storage_class"
+
+// An extended attribute on files giving the custom time of the object in RFC
+// 3339 format, which may be set to a later time but not removed.
+const customTimeXattr = "user.gcsfuse.custom_time"
+
+// An extended attribute present on files whose objects are under a temporary
+// hold, which may be set to place one or removed to release it.
+const temporaryHoldXattr = "user.gcsfuse.temporary_hold"
+
+// A write-only extended attribute on files. Setting it to a list of object
+// names relative to the mount, one per line, replaces the file's object with
+// their concatenation using GCS's compose operation, without downloading them.
+const composeXattr = "user.gcsfuse.compose"
+
+// Read-only extended attributes on files describing their objects as last
+// written out, for auditing object state through the mount. Each formats the
+// object's field, or returns the empty string if the attribute is absent.
+var objectXattrs = map[string]func(o *gcs.Object) string{
+	"user.gcsfuse.generation": func(o *gcs.Object) string {
+		return strconv.FormatInt(o.Generation, 10)
+	},
+
+	"user.gcsfuse.metageneration": func(o *gcs.Object) string {
+		return strconv.FormatInt(o.MetaGeneration, 10)
+	},
+
+	"user.gcsfuse.storage_class_updated": func(o *gcs.Object) string {
+		if o.StorageClassUpdated.IsZero() {
+			return ""
+		}
+
+		return o.StorageClassUpdated.UTC().Format(time.RFC3339Nano)
+	},
+}
+
+// Translate the errors with which a file inode fails to update its source
+// object because the object has been changed or deleted in GCS.
+func sourceUpdateError(err error) error {
+	switch err.(type) {
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+		return fuse.ENOENT
+	}
+
+	return err
+}
+
+// Return the file inode for the given ID if name is the given file attribute,
+// or ok == false otherwise.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) fileXattrTarget(
+	id fuseops.InodeID,
+	name string,
+	attr string) (f *inode.FileInode, ok bool) {
+	if name != attr {
+		return
+	}
+
+	fs.mu.Lock()
+	f, ok = fs.inodeOrDie(id).(*inode.FileInode)
+	fs.mu.Unlock()
+
+	return
+}
+
+// Return the placeholder-backed directory inode for the given ID and the
+// metadata key for the extended attribute name, or ok == false if the inode
+// can't have such an attribute. Doesn't touch GCS, which matters because the
+// kernel asks about security.capability before every write.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) xattrTarget(
+	id fuseops.InodeID,
+	name string) (in inode.ExplicitDirInode, key string, ok bool) {
+	fs.mu.Lock()
+	in, ok = fs.inodeOrDie(id).(inode.ExplicitDirInode)
+	fs.mu.Unlock()
+
+	if !ok || !strings.HasPrefix(name, xattrUserPrefix) {
+		ok = false
+		return
+	}
+
+	key = strings.TrimPrefix(name, xattrUserPrefix)
+	ok = key != ""
+	return
+}
+
+// Update the custom metadata of the placeholder object for a SetXattrOp or
+// RemoveXattrOp, whose flags are checked by check against the metadata that is
+// being replaced.
+//
+// LOCKS_REQUIRED(in)
+func (fs *fileSystem) updateXattr(
+	ctx context.Context,
+	in inode.ExplicitDirInode,
+	key string,
+	value *string,
+	check func(exists bool) error) (err error) {
+	metadata, metaGeneration, err := in.Metadata(ctx)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Metadata: %v", err)
+		return
+	}
+
+	_, exists := metadata[key]
+	err = check(exists)
+	if err != nil {
+		return
+	}
+
+	err = in.UpdateMetadata(
+		ctx,
+		map[string]*string{key: value},
+		metaGeneration)
+
+	switch err.(type) {
+	case nil:
+	case *gcs.NotFoundError:
+		err = fuse.ENOENT
+
+	// Someone else changed the metadata since we looked at it. Have the caller
+	// try again.
+	case *gcs.PreconditionError:
+		err = syscall.EAGAIN
+
+	default:
+		err = fmt.Errorf("UpdateMetadata: %v", err)
+	}
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	if op.Name == signedURLXattr && fs.signURL != nil {
+		fs.mu.Lock()
+		f, isFile := fs.inodeOrDie(op.Inode).(*inode.FileInode)
+		fs.mu.Unlock()
+
+		if isFile {
+			var u string
+			u, err = fs.signURL(f.Name())
+			if err != nil {
+				err = fmt.Errorf("SignURL: %v", err)
+				return
+			}
+
+			err = returnXattrValue(op, u)
+			return
+		}
+	}
+
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, storageClassXattr); ok {
+		f.Lock()
+		class := f.StorageClass()
+		f.Unlock()
+
+		if class == "" {
+			err = fuse.ENOATTR
+			return
+		}
+
+		err = returnXattrValue(op, class)
+		return
+	}
+
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, customTimeXattr); ok {
+		f.Lock()
+		t := f.CustomTime()
+		f.Unlock()
+
+		if t.IsZero() {
+			err = fuse.ENOATTR
+			return
+		}
+
+		err = returnXattrValue(op, t.UTC().Format(time.RFC3339Nano))
+		return
+	}
+
+	if format, ok := objectXattrs[op.Name]; ok {
+		if f, ok := fs.fileXattrTarget(op.Inode, op.Name, op.Name); ok {
+			f.Lock()
+			value := format(f.Source())
+			f.Unlock()
+
+			if value == "" {
+				err = fuse.ENOATTR
+				return
+			}
+
+			err = returnXattrValue(op, value)
+			return
+		}
+	}
+
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, temporaryHoldXattr); ok {
+		f.Lock()
+		held := f.TemporaryHold()
+		f.Unlock()
+
+		if !held {
+			err = fuse.ENOATTR
+			return
+		}
+
+		err = returnXattrValue(op, "true")
+		return
+	}
+
+	in, key, ok := fs.xattrTarget(op.Inode, op.Name)
+	if !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+
+	metadata, _, err := in.Metadata(ctx)
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Metadata: %v", err)
+		return
+	}
+
+	value, ok := metadata[key]
+	if !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	err = returnXattrValue(op, value)
+	return
+}
+
+// Copy the value of an extended attribute into the op, telling the caller how
+// much room it needs if it didn't give us enough.
+func returnXattrValue(op *fuseops.GetXattrOp, value string) (err error) {
+	op.BytesRead = len(value)
+	if len(op.Dst) < len(value) {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, value)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	fs.mu.Lock()
+	in := fs.inodeOrDie(op.Inode)
+	fs.mu.Unlock()
+
+	// Collect the names.
+	var xattrs []string
+	switch typed := in.(type) {
+	case *inode.FileInode:
+		typed.Lock()
+		if typed.StorageClass() != "" {
+			xattrs = append(xattrs, storageClassXattr)
+		}
+
+		if !typed.CustomTime().IsZero() {
+			xattrs = append(xattrs, customTimeXattr)
+		}
+
+		if typed.TemporaryHold() {
+			xattrs = append(xattrs, temporaryHoldXattr)
+		}
+
+		for name, format := range objectXattrs {
+			if format(typed.Source()) != "" {
+				xattrs = append(xattrs, name)
+			}
+		}
+		typed.Unlock()
+
+	case inode.ExplicitDirInode:
+		typed.Lock()
+		defer typed.Unlock()
+
+		var metadata map[string]string
+		metadata, _, err = typed.Metadata(ctx)
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = fuse.ENOENT
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Metadata: %v", err)
+			return
+		}
+
+		for k := range metadata {
+			xattrs = append(xattrs, xattrUserPrefix+k)
+		}
+	}
+
+	// Write out the names, NUL-terminated, in a predictable order.
+	sort.Strings(xattrs)
+
+	var names []byte
+	for _, name := range xattrs {
+		names = append(names, name...)
+		names = append(names, 0)
+	}
+
+	// Tell the caller how much room it needs if it didn't give us enough.
+	op.BytesRead = len(names)
+	if len(op.Dst) < len(names) {
+		err = syscall.ERANGE
+		return
+	}
+
+	copy(op.Dst, names)
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	const (
+		xattrCreate  = 0x1
+		xattrReplace = 0x2
+	)
+
+	check := func(exists bool) error {
+		switch {
+		case op.Flags&xattrCreate != 0 && exists:
+			return fuse.EEXIST
+
+		case op.Flags&xattrReplace != 0 && !exists:
+			return fuse.ENOATTR
+		}
+
+		return nil
+	}
+
+	// The object attributes are read-only.
+	if _, ok := objectXattrs[op.Name]; ok {
+		if _, ok := fs.fileXattrTarget(op.Inode, op.Name, op.Name); ok {
+			err = syscall.EPERM
+			return
+		}
+	}
+
+	// Choose the storage class of a file's next upload.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, storageClassXattr); ok {
+		class := strings.ToUpper(string(op.Value))
+		if !gcsx.IsStorageClass(class) {
+			err = syscall.EINVAL
+			return
+		}
+
+		f.Lock()
+		defer f.Unlock()
+
+		err = check(f.StorageClass() != "")
+		if err != nil {
+			return
+		}
+
+		f.SetStorageClass(class)
+		return
+	}
+
+	// Move a file's custom time forward, which GCS requires.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, customTimeXattr); ok {
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, string(op.Value))
+		if err != nil {
+			err = syscall.EINVAL
+			return
+		}
+
+		f.Lock()
+		defer f.Unlock()
+
+		err = check(!f.CustomTime().IsZero())
+		if err != nil {
+			return
+		}
+
+		if t.Before(f.CustomTime()) {
+			err = syscall.EINVAL
+			return
+		}
+
+		err = sourceUpdateError(f.SetCustomTime(ctx, t))
+		return
+	}
+
+	// Concatenate objects into a file.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, composeXattr); ok {
+		err = fs.compose(ctx, f, string(op.Value))
+		return
+	}
+
+	// Place or release a temporary hold on a file's object.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, temporaryHoldXattr); ok {
+		var hold bool
+		switch strings.ToLower(string(op.Value)) {
+		case "", "true":
+			hold = true
+
+		case "false":
+			hold = false
+
+		default:
+			err = syscall.EINVAL
+			return
+		}
+
+		f.Lock()
+		defer f.Unlock()
+
+		err = check(f.TemporaryHold())
+		if err != nil {
+			return
+		}
+
+		err = sourceUpdateError(f.SetTemporaryHold(ctx, hold))
+		return
+	}
+
+	in, key, ok := fs.xattrTarget(op.Inode, op.Name)
+	if !ok {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+
+	value := string(op.Value)
+	err = fs.updateXattr(ctx, in, key, &value, check)
+
+	return
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	if _, ok := objectXattrs[op.Name]; ok {
+		if _, ok := fs.fileXattrTarget(op.Inode, op.Name, op.Name); ok {
+			err = syscall.EPERM
+			return
+		}
+	}
+
+	// Go back to keeping the source object's storage class.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, storageClassXattr); ok {
+		f.Lock()
+		f.SetStorageClass("")
+		f.Unlock()
+		return
+	}
+
+	// GCS doesn't allow a custom time to be removed once set.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, customTimeXattr); ok {
+		f.Lock()
+		set := !f.CustomTime().IsZero()
+		f.Unlock()
+
+		err = fuse.ENOATTR
+		if set {
+			err = syscall.EPERM
+		}
+
+		return
+	}
+
+	// Release a temporary hold.
+	if f, ok := fs.fileXattrTarget(op.Inode, op.Name, temporaryHoldXattr); ok {
+		f.Lock()
+		defer f.Unlock()
+
+		if !f.TemporaryHold() {
+			err = fuse.ENOATTR
+			return
+		}
+
+		err = sourceUpdateError(f.SetTemporaryHold(ctx, false))
+		return
+	}
+
+	in, key, ok := fs.xattrTarget(op.Inode, op.Name)
+	if !ok {
+		err = fuse.ENOATTR
+		return
+	}
+
+	in.Lock()
+	defer in.Unlock()
+
+	err = fs.updateXattr(ctx, in, key, nil, func(exists bool) error {
+		if !exists {
+			return fuse.ENOATTR
+		}
+
+		return nil
+	})
+
 	return
 }
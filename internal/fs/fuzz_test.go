@@ -0,0 +1,597 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A fuzzer for the file system, which calls its methods directly in the way
+// the kernel would, without mounting it. Several workers make random requests
+// concurrently, while also modifying the bucket behind the file system's back.
+// Afterward we check that nothing panicked (invariant checking is enabled),
+// that no inode ID was used for two objects, that no inodes or handles leaked,
+// and that the file system agrees with the bucket.
+//
+// Run it for longer with e.g.
+//
+//     go test ./internal/fs -run TestFuzz -ogletest.run FuzzTest -fuzz_steps 100000
+//
+// Failures print the seed, which can be passed back with -fuzz_seed. Because
+// the workers run concurrently, a seed doesn't guarantee the same interleaving.
+
+package fs
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+var fFuzzSteps = flag.Int(
+	"fuzz_steps",
+	300,
+	"Number of random steps made by each worker in FuzzTest.")
+
+var fFuzzSeed = flag.Int64(
+	"fuzz_seed",
+	0,
+	"Seed for FuzzTest. Zero means choose one from the time.")
+
+func TestFuzz(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// The names used at each level of the hierarchy. A small set, so that requests
+// collide often.
+var fuzzNames = []string{"a", "b", "c"}
+
+const fuzzWorkers = 8
+
+type FuzzTest struct {
+	ctx    context.Context
+	bucket gcs.Bucket
+	fs     *fileSystem
+	seed   int64
+
+	mu sync.Mutex
+
+	// The object name (with a trailing slash for directories) for which each
+	// inode ID we've been given was returned.
+	//
+	// GUARDED_BY(mu)
+	objectNames map[fuseops.InodeID]string
+
+	// Problems found by workers, to be reported once they have finished.
+	//
+	// GUARDED_BY(mu)
+	failures []string
+}
+
+var _ SetUpInterface = &FuzzTest{}
+var _ TearDownInterface = &FuzzTest{}
+
+func init() { RegisterTestSuite(&FuzzTest{}) }
+
+func (t *FuzzTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.objectNames = make(map[fuseops.InodeID]string)
+
+	t.seed = *fFuzzSeed
+	if t.seed == 0 {
+		t.seed = time.Now().UnixNano()
+	}
+
+	syncutil.EnableInvariantChecking()
+
+	// Create a file system with no caching, so that we can compare it with the
+	// bucket at the end.
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+
+	cfg := &ServerConfig{
+		CacheClock:      timeutil.RealClock(),
+		Bucket:          t.bucket,
+		FilePerms:       0644,
+		DirPerms:        0755,
+		TmpObjectPrefix: ".gcsfuse_tmp/",
+	}
+
+	server, err := NewServer(cfg)
+	AssertEq(nil, err)
+
+	t.fs = server.(*shutdownServer).fs
+}
+
+func (t *FuzzTest) TearDown() {
+	t.fs.Destroy()
+}
+
+// Record a problem, to be reported once the workers are done.
+func (t *FuzzTest) addFailure(format string, v ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failures = append(t.failures, fmt.Sprintf(format, v...))
+}
+
+// Report any recorded problems, along with the seed.
+func (t *FuzzTest) reportFailures() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, f := range t.failures {
+		AddFailure("%s (seed %d)", f, t.seed)
+	}
+
+	if len(t.failures) != 0 {
+		AbortTest()
+	}
+}
+
+// Note that the supplied inode ID was returned for the given object name,
+// checking that it hasn't been returned for another.
+func (t *FuzzTest) noteInode(id fuseops.InodeID, objectName string) {
+	t.mu.Lock()
+	prev, ok := t.objectNames[id]
+	if !ok {
+		t.objectNames[id] = objectName
+	}
+	t.mu.Unlock()
+
+	if ok && prev != objectName {
+		t.addFailure("Inode %d reused: %q, then %q", id, prev, objectName)
+	}
+}
+
+// The name of the object backing the child with the given name, as returned
+// in an entry with the given attributes.
+func fuzzObjectName(
+	parentName string,
+	name string,
+	attrs fuseops.InodeAttributes) string {
+	name = strings.TrimSuffix(name, inode.ConflictingFileNameSuffix)
+	if attrs.Mode.IsDir() {
+		return parentName + name + "/"
+	}
+
+	return parentName + name
+}
+
+// Read the entire contents of a file through the file system.
+func (t *FuzzTest) readFile(
+	id fuseops.InodeID) (contents []byte, err error) {
+	openOp := &fuseops.OpenFileOp{Inode: id}
+	err = t.fs.OpenFile(t.ctx, openOp)
+	if err != nil {
+		return
+	}
+
+	defer t.fs.ReleaseFileHandle(
+		t.ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	for {
+		op := &fuseops.ReadFileOp{
+			Inode:  id,
+			Handle: openOp.Handle,
+			Offset: int64(len(contents)),
+			Dst:    make([]byte, 4096),
+		}
+
+		err = t.fs.ReadFile(t.ctx, op)
+		if err != nil || op.BytesRead == 0 {
+			return
+		}
+
+		contents = append(contents, op.Dst[:op.BytesRead]...)
+	}
+}
+
+// Read all entries of a directory through the file system.
+func (t *FuzzTest) readDir(
+	id fuseops.InodeID) (entries []fuseutil.Dirent, err error) {
+	openOp := &fuseops.OpenDirOp{Inode: id}
+	err = t.fs.OpenDir(t.ctx, openOp)
+	if err != nil {
+		return
+	}
+
+	defer t.fs.ReleaseDirHandle(
+		t.ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: openOp.Handle})
+
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{
+			Inode:  id,
+			Handle: openOp.Handle,
+			Offset: offset,
+			Dst:    make([]byte, 4096),
+		}
+
+		err = t.fs.ReadDir(t.ctx, op)
+		if err != nil || op.BytesRead == 0 {
+			return
+		}
+
+		batch := parseDirents(op.Dst[:op.BytesRead])
+		entries = append(entries, batch...)
+		offset = batch[len(batch)-1].Offset
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuzzWorker
+////////////////////////////////////////////////////////////////////////
+
+// A simulated kernel thread. Like the kernel, it holds a lookup count for each
+// inode that it uses, and forgets them once done.
+type fuzzWorker struct {
+	t    *FuzzTest
+	rand *rand.Rand
+
+	// Lookup counts acquired during the current step.
+	held []fuseops.InodeID
+
+	// A description of the current step, for failure messages.
+	desc string
+}
+
+func (w *fuzzWorker) run(steps int) {
+	for i := 0; i < steps; i++ {
+		w.step()
+	}
+}
+
+func (w *fuzzWorker) name() string {
+	return fuzzNames[w.rand.Intn(len(fuzzNames))]
+}
+
+// Take ownership of a lookup count returned in the supplied entry.
+func (w *fuzzWorker) hold(
+	parentName string,
+	name string,
+	e *fuseops.ChildInodeEntry) {
+	w.held = append(w.held, e.Child)
+	w.t.noteInode(e.Child, fuzzObjectName(parentName, name, e.Attributes))
+}
+
+func (w *fuzzWorker) lookUp(
+	parent fuseops.InodeID,
+	parentName string,
+	name string) (e fuseops.ChildInodeEntry, ok bool) {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	if err := w.t.fs.LookUpInode(w.t.ctx, op); err != nil {
+		return
+	}
+
+	w.hold(parentName, name, &op.Entry)
+	e, ok = op.Entry, true
+	return
+}
+
+// Choose a directory in which to work: either the root or one of its
+// children.
+func (w *fuzzWorker) chooseDir() (id fuseops.InodeID, name string) {
+	id = fuseops.RootInodeID
+	if w.rand.Intn(2) == 0 {
+		return
+	}
+
+	n := w.name()
+	if e, ok := w.lookUp(id, "", n); ok && e.Attributes.Mode.IsDir() {
+		id, name = e.Child, n+"/"
+	}
+
+	return
+}
+
+// Choose an existing file in the supplied directory, if there is one.
+func (w *fuzzWorker) chooseFile(
+	parent fuseops.InodeID,
+	parentName string) (id fuseops.InodeID, ok bool) {
+	e, ok := w.lookUp(parent, parentName, w.name())
+	if ok && e.Attributes.Mode.IsDir() {
+		ok = false
+	}
+
+	id = e.Child
+	return
+}
+
+func (w *fuzzWorker) contents() []byte {
+	return []byte(strings.Repeat("x", w.rand.Intn(10000)))
+}
+
+// Make one random request, or a short sequence of them as a program would,
+// then forget everything looked up.
+func (w *fuzzWorker) step() {
+	defer func() {
+		if r := recover(); r != nil {
+			w.t.addFailure("Panic during %s: %v\n%s", w.desc, r, debug.Stack())
+		}
+	}()
+
+	defer w.forgetAll()
+
+	ctx := w.t.ctx
+	fs := w.t.fs
+	parent, parentName := w.chooseDir()
+
+	switch w.rand.Intn(10) {
+	case 0:
+		w.desc = "lookup"
+		if e, ok := w.lookUp(parent, parentName, w.name()); ok {
+			fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: e.Child})
+		}
+
+	case 1:
+		w.desc = "create"
+		name := w.name()
+		op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: 0644}
+		if err := fs.CreateFile(ctx, op); err != nil {
+			return
+		}
+
+		w.hold(parentName, name, &op.Entry)
+		fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  op.Entry.Child,
+			Handle: op.Handle,
+			Data:   w.contents(),
+		})
+
+		fs.FlushFile(ctx, &fuseops.FlushFileOp{
+			Inode:  op.Entry.Child,
+			Handle: op.Handle,
+		})
+
+		fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: op.Handle})
+
+	case 2:
+		w.desc = "read"
+		if id, ok := w.chooseFile(parent, parentName); ok {
+			w.t.readFile(id)
+		}
+
+	case 3:
+		w.desc = "write"
+		id, ok := w.chooseFile(parent, parentName)
+		if !ok {
+			return
+		}
+
+		openOp := &fuseops.OpenFileOp{Inode: id}
+		if err := fs.OpenFile(ctx, openOp); err != nil {
+			return
+		}
+
+		fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Inode:  id,
+			Handle: openOp.Handle,
+			Offset: int64(w.rand.Intn(10000)),
+			Data:   w.contents(),
+		})
+
+		fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: id, Handle: openOp.Handle})
+		fs.ReleaseFileHandle(
+			ctx,
+			&fuseops.ReleaseFileHandleOp{Handle: openOp.Handle})
+
+	case 4:
+		w.desc = "truncate"
+		if id, ok := w.chooseFile(parent, parentName); ok {
+			size := uint64(w.rand.Intn(10000))
+			fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{
+				Inode: id,
+				Size:  &size,
+			})
+		}
+
+	case 5:
+		w.desc = "mkdir"
+		name := w.name()
+		op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: 0755}
+		if err := fs.MkDir(ctx, op); err == nil {
+			w.hold(parentName, name, &op.Entry)
+		}
+
+	case 6:
+		w.desc = "unlink"
+		if w.rand.Intn(2) == 0 {
+			fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: parent, Name: w.name()})
+		} else {
+			fs.RmDir(ctx, &fuseops.RmDirOp{Parent: parent, Name: w.name()})
+		}
+
+	case 7:
+		w.desc = "rename"
+		fs.Rename(ctx, &fuseops.RenameOp{
+			OldParent: parent,
+			OldName:   w.name(),
+			NewParent: parent,
+			NewName:   w.name(),
+		})
+
+	case 8:
+		w.desc = "readdir"
+		w.t.readDir(parent)
+
+	case 9:
+		w.desc = "bucket mutation"
+		w.mutateBucket(parentName)
+	}
+}
+
+// Modify the bucket directly, as another machine might.
+func (w *fuzzWorker) mutateBucket(parentName string) {
+	name := parentName + w.name()
+	switch w.rand.Intn(3) {
+	case 0:
+		gcsutil.CreateObject(w.t.ctx, w.t.bucket, name, w.contents())
+
+	case 1:
+		gcsutil.CreateObject(w.t.ctx, w.t.bucket, name+"/", nil)
+
+	case 2:
+		if w.rand.Intn(2) == 0 {
+			name += "/"
+		}
+
+		w.t.bucket.DeleteObject(w.t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	}
+}
+
+// Send forget requests for every lookup count acquired during the step.
+func (w *fuzzWorker) forgetAll() {
+	for _, id := range w.held {
+		w.t.fs.ForgetInode(w.t.ctx, &fuseops.ForgetInodeOp{Inode: id, N: 1})
+	}
+
+	w.held = nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Checks
+////////////////////////////////////////////////////////////////////////
+
+// Check that the children of the supplied directory, as seen by the file
+// system, agree with the bucket, then recurse into child directories.
+func (t *FuzzTest) checkDir(
+	w *fuzzWorker,
+	parent fuseops.InodeID,
+	parentName string,
+	depth int) {
+	for _, name := range fuzzNames {
+		objectName := parentName + name
+		contents, fileErr := gcsutil.ReadObject(t.ctx, t.bucket, objectName)
+		_, dirErr := gcsutil.ReadObject(t.ctx, t.bucket, objectName+"/")
+		fileExists := fileErr == nil
+		dirExists := dirErr == nil
+
+		// Look up the name.
+		e, ok := w.lookUp(parent, parentName, name)
+		switch {
+		case !fileExists && !dirExists:
+			if ok {
+				t.addFailure("%q exists only in the file system", objectName)
+			}
+
+			continue
+
+		case !ok:
+			t.addFailure("%q exists only in the bucket", objectName)
+			continue
+
+		case dirExists != e.Attributes.Mode.IsDir():
+			t.addFailure("%q has the wrong type: %v", objectName, e.Attributes.Mode)
+			continue
+		}
+
+		// Check the contents of files, which may need a suffix to be found.
+		if fileExists {
+			id := e.Child
+			if dirExists {
+				fe, ok := w.lookUp(parent, parentName, name+inode.ConflictingFileNameSuffix)
+				if !ok {
+					t.addFailure("Can't look up conflicting file %q", objectName)
+					continue
+				}
+
+				id = fe.Child
+			}
+
+			fsContents, err := t.readFile(id)
+			if err != nil {
+				t.addFailure("Reading %q: %v", objectName, err)
+			} else if string(fsContents) != string(contents) {
+				t.addFailure(
+					"%q has %d bytes in the file system, %d in the bucket",
+					objectName,
+					len(fsContents),
+					len(contents))
+			}
+		}
+
+		// Recurse into directories.
+		if dirExists && depth > 0 {
+			t.checkDir(w, e.Child, objectName+"/", depth-1)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FuzzTest) RandomOps() {
+	fmt.Fprintf(os.Stderr, "FuzzTest seed: %d\n", t.seed)
+
+	// Run the workers.
+	var wg sync.WaitGroup
+	for i := 0; i < fuzzWorkers; i++ {
+		w := &fuzzWorker{
+			t:    t,
+			rand: rand.New(rand.NewSource(t.seed + int64(i))),
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(*fFuzzSteps)
+		}()
+	}
+
+	wg.Wait()
+	t.reportFailures()
+
+	// The file system should now agree with the bucket.
+	w := &fuzzWorker{t: t}
+	t.checkDir(w, fuseops.RootInodeID, "", 1)
+	w.forgetAll()
+	t.reportFailures()
+
+	// Everything except the root should have been forgotten.
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	ExpectEq(1, len(t.fs.inodes), "Leaked inodes (seed %d)", t.seed)
+	ExpectEq(0, len(t.fs.handles), "Leaked handles (seed %d)", t.seed)
+}
+
+// Make sure the fuzzer can tell when something goes wrong.
+func (t *FuzzTest) DetectsReusedInodes() {
+	t.noteInode(17, "foo")
+	t.noteInode(17, "foo")
+	t.noteInode(17, "bar")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ExpectEq(1, len(t.failures))
+	t.failures = nil
+}
@@ -25,6 +25,11 @@ import (
 	"golang.org/x/net/context"
 )
 
+// A handle for a file inode, created for each open. Each handle owns the state
+// for reads through it, separate from the inode: a reader positioned where the
+// handle last read, which notices sequential reads and fetches ahead
+// accordingly. So processes reading the same file through different handles,
+// one sequentially and another at random say, don't disturb each other.
 type FileHandle struct {
 	inode  *inode.FileInode
 	bucket gcs.Bucket
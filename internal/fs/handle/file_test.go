@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handle_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestFileHandle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the read requests made through it.
+type countingBucket struct {
+	gcs.Bucket
+	readers int
+}
+
+func (b *countingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.readers++
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
+const objectSize = 1 << 22
+
+type FileHandleTest struct {
+	ctx      context.Context
+	clock    timeutil.SimulatedClock
+	bucket   countingBucket
+	contents []byte
+	in       *inode.FileInode
+}
+
+var _ SetUpInterface = &FileHandleTest{}
+
+func init() { RegisterTestSuite(&FileHandleTest{}) }
+
+func (t *FileHandleTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.bucket.Bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create an object large enough that a random read doesn't fetch all of it.
+	t.contents = make([]byte, objectSize)
+	for i := range t.contents {
+		t.contents[i] = byte(i * 7)
+	}
+
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket.Bucket, "foo", t.contents)
+	AssertEq(nil, err)
+
+	t.in = inode.NewFileInode(
+		17,
+		o,
+		fuseops.InodeAttributes{},
+		t.bucket.Bucket,
+		gcsx.NewSyncer(1, ".gcsfuse_tmp/", t.bucket.Bucket, nil),
+		"",
+		0,
+		nil,
+		nil,
+		nil,
+		nil,
+		false,
+		0,
+		&t.clock,
+		&t.clock)
+}
+
+func (t *FileHandleTest) read(
+	fh *handle.FileHandle,
+	offset int64,
+	size int) {
+	fh.Lock()
+	defer fh.Unlock()
+
+	buf := make([]byte, size)
+	n, err := fh.Read(t.ctx, buf, offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	AssertEq(nil, err)
+	AssertEq(size, n)
+	AssertTrue(
+		bytes.Equal(t.contents[offset:offset+int64(size)], buf),
+		"offset: %d",
+		offset)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileHandleTest) ConcurrentSequentialAndRandomReaders() {
+	sequential := handle.NewFileHandle(t.in, &t.bucket)
+	random := handle.NewFileHandle(t.in, &t.bucket)
+
+	defer sequential.Destroy()
+	defer random.Destroy()
+
+	// Read through the object in order with one handle, while reading from
+	// scattered offsets with the other.
+	const chunk = 1 << 16
+	var randomReads int
+	for off := int64(0); off < objectSize; off += chunk {
+		t.read(sequential, off, chunk)
+
+		if off%(1<<20) == 0 {
+			t.read(random, (objectSize-off)/2, 100)
+			randomReads++
+		}
+	}
+
+	// The sequential handle should have needed only two requests: one for its
+	// first read, and one for the rest of the object once it noticed the
+	// pattern. The random reads each needed their own.
+	ExpectEq(2+randomReads, t.bucket.readers)
+}
+
+func (t *FileHandleTest) HandlesHaveIndependentReaders() {
+	fh0 := handle.NewFileHandle(t.in, &t.bucket)
+	fh1 := handle.NewFileHandle(t.in, &t.bucket)
+
+	defer fh0.Destroy()
+	defer fh1.Destroy()
+
+	// Each handle starts its own request, and continuing where it left off
+	// doesn't require a new one, even though the other handle read elsewhere
+	// in between.
+	t.read(fh0, 0, 100)
+	t.read(fh1, 1<<21, 100)
+	ExpectEq(2, t.bucket.readers)
+
+	t.read(fh0, 100, 100)
+	t.read(fh1, 1<<21+100, 100)
+	ExpectEq(2, t.bucket.readers)
+}
@@ -0,0 +1,55 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// An opInterceptor that records when the file system was last busy, for
+// idleTime.
+func (fs *fileSystem) recordActivity(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) error {
+	atomic.AddInt64(&fs.opsInFlight, 1)
+	defer func() {
+		atomic.StoreInt64(&fs.lastOpTime, fs.cacheClock.Now().UnixNano())
+		atomic.AddInt64(&fs.opsInFlight, -1)
+	}()
+
+	return next(ctx)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) idleTime() time.Duration {
+	if atomic.LoadInt64(&fs.opsInFlight) != 0 {
+		return 0
+	}
+
+	fs.mu.Lock()
+	open := len(fs.handles)
+	fs.mu.Unlock()
+
+	if open != 0 {
+		return 0
+	}
+
+	last := time.Unix(0, atomic.LoadInt64(&fs.lastOpTime))
+	return fs.cacheClock.Now().Sub(last)
+}
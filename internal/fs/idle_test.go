@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestIdle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type IdleTest struct {
+	directFsTest
+	clock timeutil.SimulatedClock
+}
+
+func init() { RegisterTestSuite(&IdleTest{}) }
+
+func (t *IdleTest) SetUp(ti *TestInfo) {
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.serverCfg.CacheClock = &t.clock
+	t.directFsTest.SetUp(ti)
+}
+
+// Run a no-op through the file system's activity tracking.
+func (t *IdleTest) serveOp(during func()) {
+	t.fs.recordActivity(
+		t.ctx,
+		&fuseops.StatFSOp{},
+		func(ctx context.Context) error {
+			during()
+			return nil
+		})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *IdleTest) IdleSinceCreation() {
+	ExpectEq(0, t.server.IdleTime())
+
+	t.clock.AdvanceTime(time.Minute)
+	ExpectEq(time.Minute, t.server.IdleTime())
+}
+
+func (t *IdleTest) IdleSinceLastOp() {
+	t.clock.AdvanceTime(time.Minute)
+
+	// Not idle while serving an op, even a long one.
+	t.serveOp(func() {
+		t.clock.AdvanceTime(time.Hour)
+		ExpectEq(0, t.server.IdleTime())
+	})
+
+	// Idle time counts from when the op finished.
+	ExpectEq(0, t.server.IdleTime())
+
+	t.clock.AdvanceTime(time.Second)
+	ExpectEq(time.Second, t.server.IdleTime())
+}
+
+func (t *IdleTest) NotIdleWhileHandlesOpen() {
+	op := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	err := t.fs.OpenDir(t.ctx, op)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Hour)
+	ExpectEq(0, t.server.IdleTime())
+
+	err = t.fs.ReleaseDirHandle(
+		t.ctx,
+		&fuseops.ReleaseDirHandleOp{Handle: op.Handle})
+
+	AssertEq(nil, err)
+	ExpectEq(time.Hour, t.server.IdleTime())
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/handle"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// A record of the operations currently being executed.
+type inFlightOps struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	nextID uint64
+
+	// GUARDED_BY(mu)
+	ops map[uint64]inFlightOp
+}
+
+type inFlightOp struct {
+	desc  string
+	start time.Time
+}
+
+func newInFlightOps() *inFlightOps {
+	return &inFlightOps{
+		ops: make(map[uint64]inFlightOp),
+	}
+}
+
+// An opInterceptor that records the op for the duration of its execution.
+func (t *inFlightOps) intercept(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) error {
+	t.mu.Lock()
+	id := t.nextID
+	t.nextID++
+	t.ops[id] = inFlightOp{
+		desc:  describeOp(op),
+		start: time.Now(),
+	}
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.ops, id)
+		t.mu.Unlock()
+	}()
+
+	return next(ctx)
+}
+
+// Return the ops currently in flight, oldest first.
+func (t *inFlightOps) snapshot() (ops []inFlightOp) {
+	t.mu.Lock()
+	for _, op := range t.ops {
+		ops = append(ops, op)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].start.Before(ops[j].start)
+	})
+
+	return
+}
+
+// Log the in-flight ops and open handles each time a value is received on
+// the channel, until it is closed.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) dumpStateOnSignal(signals <-chan os.Signal) {
+	for range signals {
+		fs.dumpState()
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) dumpState() {
+	// Ops first, since they don't depend on the file system lock, which a
+	// wedged op may be holding.
+	ops := fs.inFlight.snapshot()
+	now := time.Now()
+
+	logger.Infof("%d file system ops in flight:", len(ops))
+	for _, op := range ops {
+		logger.Infof("  %s for %v", op.desc, now.Sub(op.start))
+	}
+
+	// Now handles, in order of ID.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var ids []fuseops.HandleID
+	for id := range fs.handles {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	logger.Infof("%d open handles:", len(ids))
+	for _, id := range ids {
+		switch h := fs.handles[id].(type) {
+		case *handle.FileHandle:
+			in := h.Inode()
+			logger.Infof("  %d: file inode %d (%q)", id, in.ID(), in.Name())
+
+		case *dirHandle:
+			logger.Infof("  %d: dir inode %d (%q)", id, h.in.ID(), h.in.Name())
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A cache for the attributes of a single inode, so that they needn't be
+// recomputed (often with a round trip to GCS) each time the kernel asks for
+// them.
+//
+// May be contained in a larger struct. External synchronization is required.
+type attrCache struct {
+	ttl time.Duration
+
+	// The cached attributes, valid only if expiration is non-zero.
+	attrs fuseops.InodeAttributes
+
+	// The time at which the cached attributes expire, or the zero time if
+	// nothing is cached.
+	expiration time.Time
+}
+
+// Create a cache whose entries expire with the supplied TTL. If the TTL is
+// zero, nothing will ever be cached.
+func newAttrCache(ttl time.Duration) (ac attrCache) {
+	ac = attrCache{
+		ttl: ttl,
+	}
+
+	return
+}
+
+// Record the current attributes of the inode.
+func (ac *attrCache) Insert(now time.Time, attrs fuseops.InodeAttributes) {
+	// Are we disabled?
+	if ac.ttl == 0 {
+		return
+	}
+
+	ac.attrs = attrs
+	ac.expiration = now.Add(ac.ttl)
+}
+
+// Change the TTL given to attributes inserted from now on.
+func (ac *attrCache) SetTTL(ttl time.Duration) {
+	ac.ttl = ttl
+}
+
+// Discard any cached attributes, for use when the inode changes.
+func (ac *attrCache) Erase() {
+	ac.expiration = time.Time{}
+}
+
+// Return the cached attributes, if there are any that haven't expired.
+func (ac *attrCache) LookUp(
+	now time.Time) (attrs fuseops.InodeAttributes, ok bool) {
+	// Is there an entry?
+	if ac.expiration.IsZero() {
+		return
+	}
+
+	// Has the entry expired?
+	if ac.expiration.Before(now) {
+		ac.Erase()
+		return
+	}
+
+	attrs = ac.attrs
+	ok = true
+	return
+}
+
+// Return the time at which the cached attributes expire, or the zero time if
+// nothing is cached.
+func (ac *attrCache) Expiration() time.Time {
+	return ac.expiration
+}
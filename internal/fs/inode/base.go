@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/syncutil"
+)
+
+// The bookkeeping shared by all kinds of inode: the ID, the name, the lock, and
+// the lookup count. Embed it within an inode struct and call Init, and it
+// provides the Lock, Unlock, ID, Name, IncrementLookupCount, and
+// DecrementLookupCount methods of Inode. The embedding struct provides the
+// rest.
+type BaseInode struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	id   fuseops.InodeID
+	name string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// A mutex that must be held when calling certain methods. See documentation
+	// for each method.
+	mu syncutil.InvariantMutex
+
+	// GUARDED_BY(mu)
+	lc lookupCount
+}
+
+// Set up the struct for an inode with the given ID and name, with a lookup
+// count of zero. If checkInvariants is non-nil, it is called when the lock is
+// acquired and released, if invariant checking is enabled.
+func (b *BaseInode) Init(
+	id fuseops.InodeID,
+	name string,
+	checkInvariants func()) {
+	if checkInvariants == nil {
+		checkInvariants = func() {}
+	}
+
+	b.id = id
+	b.name = name
+	b.mu = syncutil.NewInvariantMutex(checkInvariants)
+	b.lc.Init(id)
+}
+
+func (b *BaseInode) Lock() {
+	b.mu.Lock()
+}
+
+// Lock the inode if that can be done without waiting, reporting whether it
+// was.
+func (b *BaseInode) TryLock() bool {
+	return b.mu.TryLock()
+}
+
+func (b *BaseInode) Unlock() {
+	b.mu.Unlock()
+}
+
+func (b *BaseInode) ID() fuseops.InodeID {
+	return b.id
+}
+
+func (b *BaseInode) Name() string {
+	return b.name
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *BaseInode) IncrementLookupCount() {
+	b.lc.Inc()
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *BaseInode) DecrementLookupCount(n uint64) (destroy bool) {
+	destroy = b.lc.Dec(n)
+	return
+}
@@ -15,12 +15,14 @@
 package inode
 
 import (
+	"errors"
 	"fmt"
-	"path"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/gcloud/gcs"
@@ -53,12 +55,22 @@ type LookUpResult struct {
 	// descendents? Meaningful only if Object is nil and implicit directories are
 	// enabled for the parent inode.
 	ImplicitDir bool
+
+	// Does the child exist as a folder? Set only for directories in a bucket
+	// with a hierarchical namespace, which have no placeholder objects.
+	Folder bool
+
+	// Did GCS refuse to let us find out whether the child exists as a directory,
+	// as when a managed folder's IAM policy denies us access to it? The child is
+	// then treated as an implicit directory, so that using it fails with EACCES
+	// rather than the child seeming not to exist.
+	Denied bool
 }
 
 // Return true iff the result indicates that the child exists, explicitly or
 // implicitly.
 func (lr *LookUpResult) Exists() bool {
-	return lr.Object != nil || lr.ImplicitDir
+	return lr.Object != nil || lr.ImplicitDir || lr.Folder || lr.Denied
 }
 
 // An inode representing a directory, with facilities for listing entries,
@@ -77,12 +89,18 @@ type DirInode interface {
 	// suffix, confirm that a conflicting directory exists, then return a result
 	// for the file/symlink.
 	//
+	// Names that stand for unrepresentable object name components are
+	// translated back; see the notes on UnrepresentableNameSuffix.
+	//
 	// If this inode was created with implicitDirs is set, this method will use
 	// ListObjects to find child directories that are "implicitly" defined by the
 	// existence of their own descendents. For example, if there is an object
 	// named "foo/bar/baz" and this is the directory "foo", a child directory
 	// named "bar" will be implied. In this case, result.ImplicitDir will be
 	// true.
+	//
+	// If GCS refuses to let us look within the child directory but nothing else
+	// has the name, result.Denied is set; see NewDirInode.
 	LookUpChild(
 		ctx context.Context,
 		name string) (result LookUpResult, err error)
@@ -125,7 +143,8 @@ type DirInode interface {
 
 	// Create a backing object for a child directory with the supplied (relative)
 	// name, failing with *gcs.PreconditionError if a backing object already
-	// exists in GCS.
+	// exists in GCS. In a bucket with a hierarchical namespace, create a folder
+	// instead, returning a nil object.
 	CreateChildDir(
 		ctx context.Context,
 		name string) (o *gcs.Object, err error)
@@ -143,13 +162,43 @@ type DirInode interface {
 		metaGeneration *int64) (err error)
 
 	// Delete the backing object for the child directory with the given
-	// (relative) name.
+	// (relative) name, for which child is the inode. If child is an
+	// ExplicitDirInode, its placeholder object is deleted only if it still has
+	// the child's source generation. If it is an ImplicitDirInode, there is no
+	// placeholder object to delete; the directory disappears once it has no
+	// contents. In a bucket with a hierarchical namespace, delete the child's
+	// folder, failing with *gcs.PreconditionError if it isn't empty.
+	//
+	// child is used only to find out its kind and generation, and need not be
+	// locked.
 	DeleteChildDir(
 		ctx context.Context,
-		name string) (err error)
+		name string,
+		child DirInode) (err error)
+
+	// Rename the folder of the child directory with the given (relative) name,
+	// and everything within it, to make it the child of newParent named
+	// newName, in a single atomic operation. Fail with *gcs.PreconditionError if
+	// something already has the new name. Supported only in a bucket with a
+	// hierarchical namespace; see NewDirInode.
+	//
+	// newParent is used only to find out its name, and need not be locked. Call
+	// its NoteRenamedChildDir method afterward.
+	RenameChildDir(
+		ctx context.Context,
+		name string,
+		newParent DirInode,
+		newName string) (err error)
+
+	// Record that RenameChildDir on some inode has made a child directory with
+	// the given (relative) name of this one, so that our caches show it.
+	NoteRenamedChildDir(name string)
 }
 
 type dirInode struct {
+	// INVARIANT: name == "" || name[len(name)-1] == '/'
+	BaseInode
+
 	/////////////////////////
 	// Dependencies
 	/////////////////////////
@@ -158,15 +207,35 @@ type dirInode struct {
 	mtimeClock timeutil.Clock
 	cacheClock timeutil.Clock
 
+	// The folders of the bucket, or nil if it doesn't have a hierarchical
+	// namespace.
+	folders storage.Folders
+
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	id           fuseops.InodeID
 	implicitDirs bool
 
-	// INVARIANT: name == "" || name[len(name)-1] == '/'
-	name string
+	// If non-nil, applied to the names of children when looking them up and
+	// creating them.
+	normalizeName func(string) string
+
+	// If set, lookups that find no child with the name given fall back to a
+	// child whose name differs only in case. See foldedNames.
+	caseInsensitive bool
+
+	// Children hidden by this filter are not listed and can't be looked up. May
+	// be nil.
+	filter *NameFilter
+
+	// If set, child directories that GCS refuses to let us list are not listed
+	// and can't be looked up.
+	hideDeniedDirs bool
+
+	// If set, the directory is assumed to have no child directories, so none
+	// are looked up or listed.
+	flat bool
 
 	attrs fuseops.InodeAttributes
 
@@ -174,20 +243,49 @@ type dirInode struct {
 	// Mutable state
 	/////////////////////////
 
-	// A mutex that must be held when calling certain methods. See documentation
-	// for each method.
-	mu syncutil.InvariantMutex
+	// cache.CheckInvariants() does not panic.
+	//
+	// GUARDED_BY(mu)
+	cache typeCache
+
+	// Attributes most recently returned by Attributes.
+	//
+	// GUARDED_BY(mu)
+	attrCache attrCache
 
+	// When caseInsensitive is set, an index from the lower-cased names of the
+	// visible children to their names, built from a listing of the directory
+	// and used until foldedNamesExpiration. Nil if there is none. Where names
+	// differ only in case, the first in name order is indexed.
+	//
 	// GUARDED_BY(mu)
-	lc lookupCount
+	foldedNames           map[string]string
+	foldedNamesExpiration time.Time
 
-	// cache.CheckInvariants() does not panic.
+	// How long foldedNames may be used for once built.
 	//
 	// GUARDED_BY(mu)
-	cache typeCache
+	foldedNamesTTL time.Duration
+
+	// Pages of entries recently returned by ReadEntries, keyed by the
+	// continuation token they were read with, so that listing the directory
+	// again within listingCacheTTL needn't ask GCS. Nil if there are none.
+	//
+	// GUARDED_BY(mu)
+	listingCache    map[string]listingPage
+	listingCacheTTL time.Duration
+}
+
+// A page of entries returned by ReadEntries, along with the continuation token
+// for the following page.
+type listingPage struct {
+	entries    []fuseutil.Dirent
+	newTok     string
+	expiration time.Time
 }
 
 var _ DirInode = &dirInode{}
+var _ CachingInode = &dirInode{}
 
 // Create a directory inode for the name, representing the directory containing
 // the objects for which it is an immediate prefix. For the root directory,
@@ -198,6 +296,38 @@ var _ DirInode = &dirInode{}
 // descendents. For example, if there is an object named "foo/bar/baz" and this
 // is the directory "foo", a child directory named "bar" will be implied.
 //
+// If normalizeName is non-nil, children are created with the names it
+// returns, for example in Unicode normalization form C. Lookups try the
+// normalized name first, falling back to the name as given so that objects
+// created by other means remain reachable.
+//
+// If caseInsensitive is set, a lookup that finds no child with the name given
+// (or its normalization) falls back to a child whose name differs only in
+// case, found in an index built by listing the directory. The index is reused
+// for typeCacheTTL, so children created by others in the meantime may be
+// found only by their exact names, and it is discarded when we create a
+// child.
+//
+// Children hidden by filter, if non-nil, are omitted from listings and can't be
+// looked up.
+//
+// A child directory that GCS refuses to let us look within, as when a managed
+// folder's IAM policy denies us access to it, is ordinarily found by
+// LookUpChild as a result with Denied set. If hideDeniedDirs is set, it is
+// instead not found, and ReadEntries omits it, at the cost of listing each
+// child directory to find out whether we may.
+//
+// If flat is set, the directory is assumed to have no child directories, as
+// when the bucket is known to have no objects nested deeper than its children.
+// LookUpChild then finds only files and symlinks, without statting placeholder
+// objects or listing prefixes to look for directories, ReadEntries ignores
+// collapsed runs, and the link count is two rather than one.
+//
+// If folders is non-nil, the bucket has a hierarchical namespace, in which
+// directories are folders rather than placeholder objects. Child directories
+// are then looked up, listed, created and deleted as folders, including empty
+// ones, and can be renamed with RenameChildDir.
+//
 // If typeCacheTTL is non-zero, a cache from child name to information about
 // whether that name exists as a file/symlink and/or directory will be
 // maintained. This may speed up calls to LookUpChild, especially when combined
@@ -205,6 +335,12 @@ var _ DirInode = &dirInode{}
 // child is removed and recreated with a different type before the expiration,
 // we may fail to find it.
 //
+// If attrCacheTTL is non-zero, attributes are cached for that long.
+//
+// If listingCacheTTL is non-zero, the entries returned by ReadEntries are
+// cached for that long, so that children created or deleted by other writers
+// may go unnoticed in listings. Changes made through the inode update them.
+//
 // The initial lookup count is zero.
 //
 // REQUIRES: IsDirName(name)
@@ -213,8 +349,16 @@ func NewDirInode(
 	name string,
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
+	normalizeName func(string) string,
+	caseInsensitive bool,
+	filter *NameFilter,
+	hideDeniedDirs bool,
+	flat bool,
 	typeCacheTTL time.Duration,
+	attrCacheTTL time.Duration,
+	listingCacheTTL time.Duration,
 	bucket gcs.Bucket,
+	folders storage.Folders,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d DirInode) {
 	if !IsDirName(name) {
@@ -224,20 +368,24 @@ func NewDirInode(
 	// Set up the struct.
 	const typeCacheCapacity = 1 << 16
 	typed := &dirInode{
-		bucket:       bucket,
-		mtimeClock:   mtimeClock,
-		cacheClock:   cacheClock,
-		id:           id,
-		implicitDirs: implicitDirs,
-		name:         name,
-		attrs:        attrs,
-		cache:        newTypeCache(typeCacheCapacity/2, typeCacheTTL),
+		bucket:          bucket,
+		folders:         folders,
+		mtimeClock:      mtimeClock,
+		cacheClock:      cacheClock,
+		implicitDirs:    implicitDirs,
+		normalizeName:   normalizeName,
+		caseInsensitive: caseInsensitive,
+		foldedNamesTTL:  typeCacheTTL,
+		filter:          filter,
+		hideDeniedDirs:  hideDeniedDirs,
+		flat:            flat,
+		attrs:           attrs,
+		cache:           newTypeCache(typeCacheCapacity/2, typeCacheTTL),
+		attrCache:       newAttrCache(attrCacheTTL),
+		listingCacheTTL: listingCacheTTL,
 	}
 
-	typed.lc.Init(id)
-
-	// Set up invariant checking.
-	typed.mu = syncutil.NewInvariantMutex(typed.checkInvariants)
+	typed.Init(id, name, typed.checkInvariants)
 
 	d = typed
 	return
@@ -260,7 +408,14 @@ func (d *dirInode) checkInvariants() {
 func (d *dirInode) lookUpChildFile(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
-	result.FullName = d.Name() + name
+	// The empty component names the directory's own placeholder object, not a
+	// file.
+	component := nameToComponent(name)
+	if component == "" {
+		return
+	}
+
+	result.FullName = d.Name() + component
 	result.Object, err = statObjectMayNotExist(ctx, d.bucket, result.FullName)
 	if err != nil {
 		err = fmt.Errorf("statObjectMayNotExist: %v", err)
@@ -270,17 +425,35 @@ func (d *dirInode) lookUpChildFile(
 	return
 }
 
+// If knownDir is set, the type cache has recently seen the child as a
+// directory. The name prefix then can't be empty, since it contained either
+// the placeholder object or the objects that made up a collapsed run in a
+// listing, so we don't list it again.
 func (d *dirInode) lookUpChildDir(
 	ctx context.Context,
-	name string) (result LookUpResult, err error) {
+	name string,
+	knownDir bool) (result LookUpResult, err error) {
 	b := syncutil.NewBundle(ctx)
+	result.FullName = d.Name() + nameToComponent(name) + "/"
 
-	// Stat the placeholder object.
+	// Stat the placeholder object, or the folder in a bucket with a
+	// hierarchical namespace.
+	var placeholderDenied bool
 	b.Add(func(ctx context.Context) (err error) {
-		result.FullName = d.Name() + name + "/"
-		result.Object, err = statObjectMayNotExist(ctx, d.bucket, result.FullName)
+		if d.folders != nil {
+			result.Folder, err = folderExists(ctx, d.folders, result.FullName)
+		} else {
+			result.Object, err = statObjectMayNotExist(ctx, d.bucket, result.FullName)
+		}
+
+		if gcsx.IsAccessDenied(err) {
+			placeholderDenied = true
+			err = nil
+			return
+		}
+
 		if err != nil {
-			err = fmt.Errorf("statObjectMayNotExist: %v", err)
+			err = fmt.Errorf("Statting placeholder: %v", err)
 			return
 		}
 
@@ -289,12 +462,21 @@ func (d *dirInode) lookUpChildDir(
 
 	// If implicit directories are enabled, find out whether the child name is
 	// implicitly defined.
-	if d.implicitDirs {
+	var prefixDenied bool
+	if d.implicitDirs && knownDir {
+		result.ImplicitDir = true
+	} else if d.implicitDirs {
 		b.Add(func(ctx context.Context) (err error) {
 			result.ImplicitDir, err = objectNamePrefixNonEmpty(
 				ctx,
 				d.bucket,
-				d.Name()+name+"/")
+				result.FullName)
+
+			if gcsx.IsAccessDenied(err) {
+				prefixDenied = true
+				err = nil
+				return
+			}
 
 			if err != nil {
 				err = fmt.Errorf("objectNamePrefixNonEmpty: %v", err)
@@ -311,6 +493,13 @@ func (d *dirInode) lookUpChildDir(
 		return
 	}
 
+	// GCS refusing to let us look within the name, when it will let us look
+	// within this directory, most likely means that it is a directory we aren't
+	// allowed to use.
+	if (placeholderDenied || prefixDenied) && !result.Exists() && !d.hideDeniedDirs {
+		result.Denied = true
+	}
+
 	return
 }
 
@@ -327,7 +516,7 @@ func (d *dirInode) lookUpConflicting(
 	// In order to a marked name to be accepted, we require the conflicting
 	// directory to exist.
 	var dirResult LookUpResult
-	dirResult, err = d.lookUpChildDir(ctx, strippedName)
+	dirResult, err = d.lookUpChildDir(ctx, strippedName, false)
 	if err != nil {
 		err = fmt.Errorf("lookUpChildDir for stripped name: %v", err)
 		return
@@ -348,6 +537,8 @@ func (d *dirInode) lookUpConflicting(
 }
 
 // List the supplied object name prefix to find out whether it is non-empty.
+// Pass on refusals directly, so that callers can recognize them with
+// gcsx.IsAccessDenied.
 func objectNamePrefixNonEmpty(
 	ctx context.Context,
 	bucket gcs.Bucket,
@@ -358,6 +549,10 @@ func objectNamePrefixNonEmpty(
 	}
 
 	listing, err := bucket.ListObjects(ctx, req)
+	if gcsx.IsAccessDenied(err) {
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("ListObjects: %v", err)
 		return
@@ -368,7 +563,7 @@ func objectNamePrefixNonEmpty(
 }
 
 // Stat the object with the given name, returning (nil, nil) if the object
-// doesn't exist rather than failing.
+// doesn't exist rather than failing. Pass on refusals directly.
 func statObjectMayNotExist(
 	ctx context.Context,
 	bucket gcs.Bucket,
@@ -386,6 +581,10 @@ func statObjectMayNotExist(
 	}
 
 	// Annotate others.
+	if gcsx.IsAccessDenied(err) {
+		return
+	}
+
 	if err != nil {
 		err = fmt.Errorf("StatObject: %v", err)
 		return
@@ -394,6 +593,51 @@ func statObjectMayNotExist(
 	return
 }
 
+// Find out whether the named folder exists. Pass on refusals directly.
+func folderExists(
+	ctx context.Context,
+	folders storage.Folders,
+	name string) (exists bool, err error) {
+	err = folders.GetFolder(ctx, name)
+
+	// Suppress "not found" errors.
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	// Annotate others.
+	if gcsx.IsAccessDenied(err) {
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("GetFolder: %v", err)
+		return
+	}
+
+	exists = true
+	return
+}
+
+// Find out whether the object with the name of the supplied child plus the
+// suffix exists, or for a directory in a bucket with a hierarchical namespace,
+// the folder.
+func (d *dirInode) childExists(
+	ctx context.Context,
+	name string,
+	suffix string) (exists bool, err error) {
+	objName := d.childObjectName(name) + suffix
+	if suffix == "/" && d.folders != nil {
+		exists, err = folderExists(ctx, d.folders, objName)
+		return
+	}
+
+	o, err := statObjectMayNotExist(ctx, d.bucket, objName)
+	exists = o != nil
+	return
+}
+
 // Fail if the name already exists. Pass on errors directly.
 func (d *dirInode) createNewObject(
 	ctx context.Context,
@@ -417,25 +661,21 @@ func (d *dirInode) createNewObject(
 	return
 }
 
-// An implementation detail fo filterMissingChildDirs.
-func filterMissingChildDirNames(
+// An implementation detail of filterChildDirs.
+func filterChildDirNames(
 	ctx context.Context,
-	bucket gcs.Bucket,
-	dirName string,
+	keep func(context.Context, string) (bool, error),
 	unfiltered <-chan string,
 	filtered chan<- string) (err error) {
 	for name := range unfiltered {
-		var o *gcs.Object
-
-		// Stat the placeholder.
-		o, err = statObjectMayNotExist(ctx, bucket, dirName+name+"/")
+		// Should we pass on this name?
+		var ok bool
+		ok, err = keep(ctx, name)
 		if err != nil {
-			err = fmt.Errorf("statObjectMayNotExist: %v", err)
 			return
 		}
 
-		// Should we pass on this name?
-		if o == nil {
+		if !ok {
 			continue
 		}
 
@@ -451,37 +691,14 @@ func filterMissingChildDirNames(
 	return
 }
 
-// Given a list of child names that appear to be directories according to
-// d.bucket.ListObjects (which always behaves as if implicit directories are
-// enabled), filter out the ones for which a placeholder object does not
-// actually exist. If implicit directories are enabled, simply return them all.
-//
-// LOCKS_REQUIRED(d)
-func (d *dirInode) filterMissingChildDirs(
+// Return those of the supplied child directory names for which keep returns
+// true, calling it for several at once.
+func (d *dirInode) filterChildDirs(
 	ctx context.Context,
-	in []string) (out []string, err error) {
-	// Do we need to do anything?
-	if d.implicitDirs {
-		out = in
-		return
-	}
-
+	in []string,
+	keep func(context.Context, string) (bool, error)) (out []string, err error) {
 	b := syncutil.NewBundle(ctx)
 
-	// First add any names that we already know are directories according to our
-	// cache, removing them from the input.
-	now := d.cacheClock.Now()
-	var tmp []string
-	for _, name := range in {
-		if d.cache.IsDir(now, name) {
-			out = append(out, name)
-		} else {
-			tmp = append(tmp, name)
-		}
-	}
-
-	in = tmp
-
 	// Feed names into a channel.
 	unfiltered := make(chan string, 100)
 	b.Add(func(ctx context.Context) (err error) {
@@ -500,22 +717,15 @@ func (d *dirInode) filterMissingChildDirs(
 		return
 	})
 
-	// Stat the placeholder object for each, filtering out placeholders that are
-	// not found. Use some parallelism.
-	const statWorkers = 32
+	// Filter the names. Use some parallelism.
+	const filterWorkers = 32
 	filtered := make(chan string, 100)
 	var wg sync.WaitGroup
-	for i := 0; i < statWorkers; i++ {
+	for i := 0; i < filterWorkers; i++ {
 		wg.Add(1)
 		b.Add(func(ctx context.Context) (err error) {
 			defer wg.Done()
-			err = filterMissingChildDirNames(
-				ctx,
-				d.bucket,
-				d.Name(),
-				unfiltered,
-				filtered)
-
+			err = filterChildDirNames(ctx, keep, unfiltered, filtered)
 			return
 		})
 	}
@@ -526,10 +736,9 @@ func (d *dirInode) filterMissingChildDirs(
 	}()
 
 	// Accumulate into a slice.
-	var filteredSlice []string
 	b.Add(func(ctx context.Context) (err error) {
 		for name := range filtered {
-			filteredSlice = append(filteredSlice, name)
+			out = append(out, name)
 		}
 
 		return
@@ -537,15 +746,108 @@ func (d *dirInode) filterMissingChildDirs(
 
 	// Wait for everything to complete.
 	err = b.Join()
+	return
+}
+
+// Given a list of child names that appear to be directories according to
+// d.bucket.ListObjects (which always behaves as if implicit directories are
+// enabled), filter out the ones for which a placeholder object does not
+// actually exist. If implicit directories are enabled, simply return them all.
+// Keep those whose placeholders GCS refuses to let us stat, as LookUpChild
+// finds them.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) filterMissingChildDirs(
+	ctx context.Context,
+	in []string) (out []string, err error) {
+	// Do we need to do anything?
+	if d.implicitDirs {
+		out = in
+		return
+	}
+
+	// First add any names that we already know are directories according to our
+	// cache, removing them from the input.
+	now := d.cacheClock.Now()
+	var tmp []string
+	for _, name := range in {
+		if d.cache.IsDir(now, name) {
+			out = append(out, name)
+		} else {
+			tmp = append(tmp, name)
+		}
+	}
+
+	in = tmp
+
+	// Stat the placeholder object for each, filtering out placeholders that are
+	// not found.
+	filtered, err := d.filterChildDirs(
+		ctx,
+		in,
+		func(ctx context.Context, name string) (ok bool, err error) {
+			o, err := statObjectMayNotExist(ctx, d.bucket, d.childObjectName(name)+"/")
+			if gcsx.IsAccessDenied(err) {
+				ok = true
+				err = nil
+				return
+			}
+
+			if err != nil {
+				err = fmt.Errorf("statObjectMayNotExist: %v", err)
+				return
+			}
+
+			ok = o != nil
+			return
+		})
 
 	// Update the cache with everything we learned.
 	now = d.cacheClock.Now()
-	for _, name := range filteredSlice {
+	for _, name := range filtered {
 		d.cache.NoteDir(now, name)
 	}
 
 	// Return everything we learned.
-	out = append(out, filteredSlice...)
+	out = append(out, filtered...)
+
+	return
+}
+
+// If hideDeniedDirs is set, filter out the supplied child directory names
+// whose prefixes GCS refuses to let us list. Otherwise return them all.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) filterDeniedChildDirs(
+	ctx context.Context,
+	in []string) (out []string, err error) {
+	if !d.hideDeniedDirs {
+		out = in
+		return
+	}
+
+	out, err = d.filterChildDirs(
+		ctx,
+		in,
+		func(ctx context.Context, name string) (ok bool, err error) {
+			_, err = objectNamePrefixNonEmpty(
+				ctx,
+				d.bucket,
+				d.childObjectName(name)+"/")
+
+			if gcsx.IsAccessDenied(err) {
+				err = nil
+				return
+			}
+
+			if err != nil {
+				err = fmt.Errorf("objectNamePrefixNonEmpty: %v", err)
+				return
+			}
+
+			ok = true
+			return
+		})
 
 	return
 }
@@ -554,46 +856,68 @@ func (d *dirInode) filterMissingChildDirs(
 // Public interface
 ////////////////////////////////////////////////////////////////////////
 
-func (d *dirInode) Lock() {
-	d.mu.Lock()
+// LOCKS_REQUIRED(d)
+func (d *dirInode) Destroy() (err error) {
+	// Nothing interesting to do.
+	return
 }
 
-func (d *dirInode) Unlock() {
-	d.mu.Unlock()
-}
+// LOCKS_REQUIRED(d)
+func (d *dirInode) Attributes(
+	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
+	now := d.cacheClock.Now()
 
-func (d *dirInode) ID() fuseops.InodeID {
-	return d.id
-}
+	// Can we use the cached attributes?
+	if cached, ok := d.attrCache.LookUp(now); ok {
+		attrs = cached
+		return
+	}
 
-func (d *dirInode) Name() string {
-	return d.name
+	attrs, err = d.computeAttributes(ctx)
+	if err != nil {
+		return
+	}
+
+	d.attrCache.Insert(now, attrs)
+	return
 }
 
 // LOCKS_REQUIRED(d)
-func (d *dirInode) IncrementLookupCount() {
-	d.lc.Inc()
+func (d *dirInode) AttributesExpiration() time.Time {
+	return d.attrCache.Expiration()
 }
 
 // LOCKS_REQUIRED(d)
-func (d *dirInode) DecrementLookupCount(n uint64) (destroy bool) {
-	destroy = d.lc.Dec(n)
-	return
+func (d *dirInode) InvalidateCaches() {
+	d.attrCache.Erase()
+	d.cache.EraseAll()
+	d.foldedNames = nil
+	d.listingCache = nil
 }
 
 // LOCKS_REQUIRED(d)
-func (d *dirInode) Destroy() (err error) {
-	// Nothing interesting to do.
-	return
+func (d *dirInode) SetCacheTTLs(attributes time.Duration, types time.Duration) {
+	d.attrCache.SetTTL(attributes)
+	d.cache.SetTTL(types)
+	d.foldedNamesTTL = types
 }
 
 // LOCKS_REQUIRED(d)
-func (d *dirInode) Attributes(
+func (d *dirInode) computeAttributes(
 	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
 	// Set up basic attributes.
 	attrs = d.attrs
 	attrs.Nlink = 1
 
+	// Counting the child directories for a traditional link count would mean
+	// listing the directory each time the kernel asks for its attributes, so
+	// we report one link, which tools like find(1) treat as unknown. Without
+	// child directories, we know the count: one for the entry in the parent
+	// and one for ".".
+	if d.flat {
+		attrs.Nlink = 2
+	}
+
 	return
 }
 
@@ -605,8 +929,218 @@ func (d *dirInode) Attributes(
 // See also the notes on DirInode.LookUpChild.
 const ConflictingFileNameSuffix = "\n"
 
+// A suffix used to tag the names of children whose object name component
+// (relative to the directory, without any trailing slash) can't be used as a
+// file system name: the empty string (as in "foo//bar"), "." and "..". These
+// appear as "\r", ".\r" and "..\r" respectively. (Unambiguous because U+000D
+// is not allowed in GCS object names.)
+const UnrepresentableNameSuffix = "\r"
+
+// Return the file system name for a child with the supplied object name
+// component.
+func componentToName(component string) string {
+	switch component {
+	case "", ".", "..":
+		return component + UnrepresentableNameSuffix
+	}
+
+	return component
+}
+
+// The inverse of componentToName.
+func nameToComponent(name string) string {
+	switch name {
+	case UnrepresentableNameSuffix,
+		"." + UnrepresentableNameSuffix,
+		".." + UnrepresentableNameSuffix:
+		return strings.TrimSuffix(name, UnrepresentableNameSuffix)
+	}
+
+	return name
+}
+
+// Return the name of the object backing the child directory with the
+// supplied file system name, minus its trailing slash.
+func (d *dirInode) childObjectName(name string) string {
+	return d.Name() + nameToComponent(name)
+}
+
+// Return the name of the object backing the child file or symlink with the
+// supplied file system name, failing for the name whose object would be the
+// directory's own placeholder.
+func (d *dirInode) childFileObjectName(name string) (objName string, err error) {
+	objName = d.childObjectName(name)
+	if objName == d.Name() {
+		err = fmt.Errorf("Illegal file name: %q", name)
+		return
+	}
+
+	return
+}
+
+// Apply d.normalizeName, if any, to the supplied child name.
+func (d *dirInode) normalizedName(name string) string {
+	if d.normalizeName == nil {
+		return name
+	}
+
+	return d.normalizeName(name)
+}
+
+// Return the name of the existing child to which a name given by the kernel
+// refers, using the same rules as LookUpChild: the normalized name if an
+// object (or folder) exists for it, or otherwise the name as given, or otherwise if
+// lookups ignore case the name of a child differing only in case. suffix is
+// appended to the object name when statting, to distinguish directories.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) resolveName(
+	ctx context.Context,
+	name string,
+	suffix string) (resolved string, err error) {
+	normalized := d.normalizedName(name)
+	if normalized == name && !d.caseInsensitive {
+		resolved = name
+		return
+	}
+
+	// Try the normalized name, then the name as given if we would otherwise go
+	// on to ignore case.
+	candidates := []string{normalized}
+	if d.caseInsensitive && normalized != name {
+		candidates = append(candidates, name)
+	}
+
+	for _, c := range candidates {
+		var exists bool
+		exists, err = d.childExists(ctx, c, suffix)
+		if err != nil {
+			err = fmt.Errorf("childExists: %v", err)
+			return
+		}
+
+		if exists {
+			resolved = c
+			return
+		}
+	}
+
+	resolved = name
+	if !d.caseInsensitive {
+		return
+	}
+
+	folded, ok, err := d.lookUpFoldedName(ctx, name)
+	if err != nil {
+		err = fmt.Errorf("lookUpFoldedName: %v", err)
+		return
+	}
+
+	if ok {
+		resolved = folded
+	}
+
+	return
+}
+
+// Return the name of the child whose name differs from the supplied one (or
+// its normalization) only in case, rebuilding the index of such names from a
+// listing of the directory if it has expired.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) lookUpFoldedName(
+	ctx context.Context,
+	name string) (folded string, ok bool, err error) {
+	now := d.cacheClock.Now()
+	if d.foldedNames == nil || !now.Before(d.foldedNamesExpiration) {
+		d.foldedNames = nil
+
+		var index map[string]string
+		index, err = d.indexFoldedNames(ctx)
+		if err != nil {
+			return
+		}
+
+		d.foldedNames = index
+		d.foldedNamesExpiration = now.Add(d.foldedNamesTTL)
+	}
+
+	folded, ok = d.foldedNames[strings.ToLower(d.normalizedName(name))]
+	return
+}
+
+// List the visible children of the directory, returning an index from their
+// lower-cased names to their names.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) indexFoldedNames(
+	ctx context.Context) (index map[string]string, err error) {
+	index = make(map[string]string)
+
+	var tok string
+	for {
+		var entries []fuseutil.Dirent
+		entries, tok, err = d.ReadEntries(ctx, tok)
+		if err != nil {
+			err = fmt.Errorf("ReadEntries: %v", err)
+			return
+		}
+
+		for _, e := range entries {
+			key := strings.ToLower(d.normalizedName(e.Name))
+			if existing, ok := index[key]; !ok || e.Name < existing {
+				index[key] = e.Name
+			}
+		}
+
+		if tok == "" {
+			return
+		}
+	}
+}
+
 // LOCKS_REQUIRED(d)
 func (d *dirInode) LookUpChild(
+	ctx context.Context,
+	name string) (result LookUpResult, err error) {
+	normalized := d.normalizedName(name)
+	result, err = d.lookUpChild(ctx, normalized)
+	if err == nil && !result.Exists() && normalized != name {
+		result, err = d.lookUpChild(ctx, name)
+	}
+
+	if err == nil && !result.Exists() && d.caseInsensitive {
+		var folded string
+		var ok bool
+		folded, ok, err = d.lookUpFoldedName(ctx, name)
+		if err != nil {
+			err = fmt.Errorf("lookUpFoldedName: %v", err)
+			return
+		}
+
+		if ok {
+			result, err = d.lookUpChild(ctx, folded)
+		}
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Hide children excluded by the filter.
+	visible := d.filter.Visible(
+		strings.TrimSuffix(name, ConflictingFileNameSuffix),
+		strings.HasSuffix(result.FullName, "/"))
+
+	if result.Exists() && !visible {
+		result = LookUpResult{}
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) lookUpChild(
 	ctx context.Context,
 	name string) (result LookUpResult, err error) {
 	// Consult the cache about the type of the child. This may save us work
@@ -615,9 +1149,13 @@ func (d *dirInode) LookUpChild(
 	cacheSaysFile := d.cache.IsFile(now, name)
 	cacheSaysDir := d.cache.IsDir(now, name)
 
-	// Is this a conflict marker name?
+	// Is this a conflict marker name? Without child directories there can be
+	// no conflicts.
 	if strings.HasSuffix(name, ConflictingFileNameSuffix) {
-		result, err = d.lookUpConflicting(ctx, name)
+		if !d.flat {
+			result, err = d.lookUpConflicting(ctx, name)
+		}
+
 		return
 	}
 
@@ -634,11 +1172,11 @@ func (d *dirInode) LookUpChild(
 	}
 
 	// Stat the child as a directory, unless the cache has told us it's a file
-	// but not a directory.
+	// but not a directory, or there are no child directories.
 	var dirResult LookUpResult
-	if !(cacheSaysFile && !cacheSaysDir) {
+	if !d.flat && !(cacheSaysFile && !cacheSaysDir) {
 		b.Add(func(ctx context.Context) (err error) {
-			dirResult, err = d.lookUpChildDir(ctx, name)
+			dirResult, err = d.lookUpChildDir(ctx, name, cacheSaysDir)
 			return
 		})
 	}
@@ -649,12 +1187,15 @@ func (d *dirInode) LookUpChild(
 		return
 	}
 
-	// Prefer directories over files.
+	// Prefer directories over files, but files over directories we were refused
+	// access to.
 	switch {
-	case dirResult.Exists():
+	case dirResult.Exists() && !dirResult.Denied:
 		result = dirResult
 	case fileResult.Exists():
 		result = fileResult
+	case dirResult.Denied:
+		result = dirResult
 	}
 
 	// Update the cache.
@@ -663,7 +1204,7 @@ func (d *dirInode) LookUpChild(
 		d.cache.NoteFile(now, name)
 	}
 
-	if dirResult.Exists() {
+	if dirResult.Exists() && !dirResult.Denied {
 		d.cache.NoteDir(now, name)
 	}
 
@@ -672,6 +1213,42 @@ func (d *dirInode) LookUpChild(
 
 // LOCKS_REQUIRED(d)
 func (d *dirInode) ReadEntries(
+	ctx context.Context,
+	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
+	// Can we use a cached page?
+	if page, ok := d.listingCache[tok]; ok {
+		if d.cacheClock.Now().Before(page.expiration) {
+			entries = append([]fuseutil.Dirent(nil), page.entries...)
+			newTok = page.newTok
+			return
+		}
+
+		delete(d.listingCache, tok)
+	}
+
+	entries, newTok, err = d.readEntries(ctx, tok)
+	if err != nil {
+		return
+	}
+
+	// Cache the page, if enabled.
+	if d.listingCacheTTL > 0 {
+		if d.listingCache == nil {
+			d.listingCache = make(map[string]listingPage)
+		}
+
+		d.listingCache[tok] = listingPage{
+			entries:    append([]fuseutil.Dirent(nil), entries...),
+			newTok:     newTok,
+			expiration: d.cacheClock.Now().Add(d.listingCacheTTL),
+		}
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) readEntries(
 	ctx context.Context,
 	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
 	// Ask the bucket to list some objects.
@@ -696,7 +1273,7 @@ func (d *dirInode) ReadEntries(
 		}
 
 		e := fuseutil.Dirent{
-			Name: path.Base(o.Name),
+			Name: componentToName(strings.TrimPrefix(o.Name, d.Name())),
 			Type: fuseutil.DT_File,
 		}
 
@@ -707,16 +1284,10 @@ func (d *dirInode) ReadEntries(
 		entries = append(entries, e)
 	}
 
-	// Extract directory names from the collapsed runs.
-	var dirNames []string
-	for _, p := range listing.CollapsedRuns {
-		dirNames = append(dirNames, path.Base(p))
-	}
-
-	// Filter the directory names according to our implicit directory settings.
-	dirNames, err = d.filterMissingChildDirs(ctx, dirNames)
+	// Find the names of child directories.
+	dirNames, err := d.readChildDirNames(ctx, tok, listing)
 	if err != nil {
-		err = fmt.Errorf("filterMissingChildDirs: %v", err)
+		err = fmt.Errorf("readChildDirNames: %v", err)
 		return
 	}
 
@@ -730,6 +1301,16 @@ func (d *dirInode) ReadEntries(
 		entries = append(entries, e)
 	}
 
+	// Hide children excluded by the filter.
+	visible := entries[:0]
+	for _, e := range entries {
+		if d.filter.Visible(e.Name, e.Type == fuseutil.DT_Directory) {
+			visible = append(visible, e)
+		}
+	}
+
+	entries = visible
+
 	// Return an appropriate continuation token, if any.
 	newTok = listing.ContinuationToken
 
@@ -748,20 +1329,176 @@ func (d *dirInode) ReadEntries(
 	return
 }
 
+// Return the names of the child directories to list along with the supplied
+// page of objects, read with the continuation token tok. Ordinarily these are
+// the collapsed runs in the page, filtered according to our implicit directory
+// settings and to whether we may list them. In a bucket with a hierarchical namespace they are the folders
+// instead, which include empty ones, and we list them all along with the
+// first page.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) readChildDirNames(
+	ctx context.Context,
+	tok string,
+	listing *gcs.Listing) (dirNames []string, err error) {
+	if d.flat {
+		return
+	}
+
+	runs := listing.CollapsedRuns
+	if d.folders != nil {
+		runs = nil
+		if tok == "" {
+			runs, err = d.folders.ListFolders(ctx, d.Name())
+			if err != nil {
+				err = fmt.Errorf("ListFolders: %v", err)
+				return
+			}
+		}
+	}
+
+	for _, p := range runs {
+		component := strings.TrimSuffix(strings.TrimPrefix(p, d.Name()), "/")
+		dirNames = append(dirNames, componentToName(component))
+	}
+
+	dirNames, err = d.filterDeniedChildDirs(ctx, dirNames)
+	if err != nil {
+		err = fmt.Errorf("filterDeniedChildDirs: %v", err)
+		return
+	}
+
+	if d.folders != nil {
+		return
+	}
+
+	dirNames, err = d.filterMissingChildDirs(ctx, dirNames)
+	if err != nil {
+		err = fmt.Errorf("filterMissingChildDirs: %v", err)
+		return
+	}
+
+	return
+}
+
+// The key by which GCS orders the supplied entry in listings: its name,
+// followed by a slash for a directory, since that is the name of its
+// placeholder object or collapsed run.
+func listingKey(e fuseutil.Dirent) string {
+	if e.Type == fuseutil.DT_Directory {
+		return e.Name + "/"
+	}
+
+	return e.Name
+}
+
+// Update the cached listing, if any, to show a child with the supplied name and
+// type, created through this inode, replacing any entry of the same kind
+// (directory or not) for the name. The entry goes in the page that GCS would
+// list it in, so that pages stay in name order. If that page isn't cached, the
+// listing is discarded instead.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) addToListingCache(name string, t fuseutil.DirentType) {
+	if d.listingCache == nil {
+		return
+	}
+
+	e := fuseutil.Dirent{
+		Name: name,
+		Type: t,
+	}
+
+	// Children hidden by the filter aren't listed.
+	if !d.filter.Visible(name, t == fuseutil.DT_Directory) {
+		return
+	}
+
+	// Follow the pages in order to the first whose greatest key isn't less than
+	// the entry's, or the last.
+	now := d.cacheClock.Now()
+	key := listingKey(e)
+	tok := ""
+	for {
+		page, ok := d.listingCache[tok]
+		if !ok || !now.Before(page.expiration) {
+			d.listingCache = nil
+			return
+		}
+
+		last := ""
+		for _, other := range page.entries {
+			if k := listingKey(other); k > last {
+				last = k
+			}
+		}
+
+		if page.newTok != "" && last < key {
+			tok = page.newTok
+			continue
+		}
+
+		// Replace or add the entry, without disturbing the slices that
+		// ReadEntries has returned.
+		entries := make([]fuseutil.Dirent, 0, len(page.entries)+1)
+		for _, other := range page.entries {
+			if listingKey(other) != key {
+				entries = append(entries, other)
+			}
+		}
+
+		page.entries = append(entries, e)
+		d.listingCache[tok] = page
+		return
+	}
+}
+
+// Update the cached listing, if any, to no longer show the child directory
+// (if isDir is set) or file or symlink (otherwise) with the supplied name.
+//
+// LOCKS_REQUIRED(d)
+func (d *dirInode) removeFromListingCache(name string, isDir bool) {
+	key := name
+	if isDir {
+		key += "/"
+	}
+
+	for tok, page := range d.listingCache {
+		entries := make([]fuseutil.Dirent, 0, len(page.entries))
+		for _, e := range page.entries {
+			if listingKey(e) != key {
+				entries = append(entries, e)
+			}
+		}
+
+		page.entries = entries
+		d.listingCache[tok] = page
+	}
+}
+
 // LOCKS_REQUIRED(d)
 func (d *dirInode) CreateChildFile(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
+	name = d.normalizedName(name)
+
 	metadata := map[string]string{
 		FileMtimeMetadataKey: d.mtimeClock.Now().UTC().Format(time.RFC3339Nano),
 	}
 
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name), metadata)
+	objName, err := d.childFileObjectName(name)
+	if err != nil {
+		return
+	}
+
+	o, err = d.createNewObject(ctx, objName, metadata)
 	if err != nil {
 		return
 	}
 
 	d.cache.NoteFile(d.cacheClock.Now(), name)
+	d.foldedNames = nil
+	d.addToListingCache(name, fuseutil.DT_File)
 
 	return
 }
@@ -771,6 +1508,13 @@ func (d *dirInode) CloneToChildFile(
 	ctx context.Context,
 	name string,
 	src *gcs.Object) (o *gcs.Object, err error) {
+	name = d.normalizedName(name)
+
+	dstName, err := d.childFileObjectName(name)
+	if err != nil {
+		return
+	}
+
 	// Erase any existing type information for this name.
 	d.cache.Erase(name)
 
@@ -781,15 +1525,22 @@ func (d *dirInode) CloneToChildFile(
 			SrcName:                       src.Name,
 			SrcGeneration:                 src.Generation,
 			SrcMetaGenerationPrecondition: &src.MetaGeneration,
-			DstName: path.Join(d.Name(), name),
+			DstName:                       dstName,
 		})
 
 	if err != nil {
 		return
 	}
 
-	// Update the type cache.
+	// Update the caches.
 	d.cache.NoteFile(d.cacheClock.Now(), name)
+	d.foldedNames = nil
+
+	if IsSymlink(o) {
+		d.addToListingCache(name, fuseutil.DT_Link)
+	} else {
+		d.addToListingCache(name, fuseutil.DT_File)
+	}
 
 	return
 }
@@ -799,16 +1550,25 @@ func (d *dirInode) CreateChildSymlink(
 	ctx context.Context,
 	name string,
 	target string) (o *gcs.Object, err error) {
+	name = d.normalizedName(name)
+
 	metadata := map[string]string{
 		SymlinkMetadataKey: target,
 	}
 
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name), metadata)
+	objName, err := d.childFileObjectName(name)
+	if err != nil {
+		return
+	}
+
+	o, err = d.createNewObject(ctx, objName, metadata)
 	if err != nil {
 		return
 	}
 
 	d.cache.NoteFile(d.cacheClock.Now(), name)
+	d.foldedNames = nil
+	d.addToListingCache(name, fuseutil.DT_Link)
 
 	return
 }
@@ -817,12 +1577,21 @@ func (d *dirInode) CreateChildSymlink(
 func (d *dirInode) CreateChildDir(
 	ctx context.Context,
 	name string) (o *gcs.Object, err error) {
-	o, err = d.createNewObject(ctx, path.Join(d.Name(), name)+"/", nil)
+	name = d.normalizedName(name)
+
+	if d.folders != nil {
+		err = d.folders.CreateFolder(ctx, d.childObjectName(name)+"/")
+	} else {
+		o, err = d.createNewObject(ctx, d.childObjectName(name)+"/", nil)
+	}
+
 	if err != nil {
 		return
 	}
 
 	d.cache.NoteDir(d.cacheClock.Now(), name)
+	d.foldedNames = nil
+	d.addToListingCache(name, fuseutil.DT_Directory)
 
 	return
 }
@@ -833,12 +1602,23 @@ func (d *dirInode) DeleteChildFile(
 	name string,
 	generation int64,
 	metaGeneration *int64) (err error) {
+	name, err = d.resolveName(ctx, name, "")
+	if err != nil {
+		err = fmt.Errorf("resolveName: %v", err)
+		return
+	}
+
+	objName, err := d.childFileObjectName(name)
+	if err != nil {
+		return
+	}
+
 	d.cache.Erase(name)
 
 	err = d.bucket.DeleteObject(
 		ctx,
 		&gcs.DeleteObjectRequest{
-			Name:                       path.Join(d.Name(), name),
+			Name:                       objName,
 			Generation:                 generation,
 			MetaGenerationPrecondition: metaGeneration,
 		})
@@ -848,21 +1628,56 @@ func (d *dirInode) DeleteChildFile(
 		return
 	}
 
+	d.removeFromListingCache(name, false)
+
 	return
 }
 
 // LOCKS_REQUIRED(d)
 func (d *dirInode) DeleteChildDir(
 	ctx context.Context,
-	name string) (err error) {
+	name string,
+	child DirInode) (err error) {
+	name, err = d.resolveName(ctx, name, "/")
+	if err != nil {
+		err = fmt.Errorf("resolveName: %v", err)
+		return
+	}
+
 	d.cache.Erase(name)
 
-	// Delete the backing object. Unfortunately we have no way to precondition
-	// this on the directory being empty.
+	// Drop the directory from the cached listing once it's gone.
+	defer func() {
+		if err == nil {
+			d.removeFromListingCache(name, true)
+		}
+	}()
+
+	// In a bucket with a hierarchical namespace, delete the folder. Unlike for a
+	// placeholder object, GCS refuses if it isn't empty.
+	if d.folders != nil {
+		err = d.folders.DeleteFolder(ctx, d.childObjectName(name)+"/")
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = nil
+		}
+
+		return
+	}
+
+	// Is there a placeholder object?
+	explicit, ok := child.(ExplicitDirInode)
+	if !ok {
+		return
+	}
+
+	// Delete the backing object, unless it has been replaced since the child
+	// inode was created. Unfortunately we have no way to precondition this on
+	// the directory being empty.
 	err = d.bucket.DeleteObject(
 		ctx,
 		&gcs.DeleteObjectRequest{
-			Name: path.Join(d.Name(), name) + "/",
+			Name:       d.childObjectName(name) + "/",
+			Generation: explicit.objectGeneration(),
 		})
 
 	if err != nil {
@@ -872,3 +1687,45 @@ func (d *dirInode) DeleteChildDir(
 
 	return
 }
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) RenameChildDir(
+	ctx context.Context,
+	name string,
+	newParent DirInode,
+	newName string) (err error) {
+	if d.folders == nil {
+		err = errors.New("Renaming directories requires folders")
+		return
+	}
+
+	name, err = d.resolveName(ctx, name, "/")
+	if err != nil {
+		err = fmt.Errorf("resolveName: %v", err)
+		return
+	}
+
+	d.cache.Erase(name)
+	d.foldedNames = nil
+
+	// The new parent is configured as we are.
+	dstName := newParent.Name() + nameToComponent(d.normalizedName(newName)) + "/"
+
+	err = d.folders.RenameFolder(ctx, d.childObjectName(name)+"/", dstName)
+	if err != nil {
+		return
+	}
+
+	d.removeFromListingCache(name, true)
+
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *dirInode) NoteRenamedChildDir(name string) {
+	name = d.normalizedName(name)
+
+	d.cache.NoteDir(d.cacheClock.Now(), name)
+	d.foldedNames = nil
+	d.addToListingCache(name, fuseutil.DT_Directory)
+}
@@ -15,15 +15,20 @@
 package inode_test
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/gcloud/gcs"
@@ -32,6 +37,8 @@ import (
 	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/googleapi"
 )
 
 func TestDir(t *testing.T) { RunTests(t) }
@@ -50,6 +57,16 @@ type DirTest struct {
 	bucket gcs.Bucket
 	clock  timeutil.SimulatedClock
 
+	// Passed to the inode by resetInode. Nil or zero by default.
+	normalizeName   func(string) string
+	caseInsensitive bool
+	filter          *inode.NameFilter
+	hideDeniedDirs  bool
+	flat            bool
+	attrCacheTTL    time.Duration
+	listingCacheTTL time.Duration
+	folders         storage.Folders
+
 	in inode.DirInode
 }
 
@@ -95,14 +112,75 @@ func (t *DirTest) resetInode(implicitDirs bool) {
 			Mode: dirMode,
 		},
 		implicitDirs,
+		t.normalizeName,
+		t.caseInsensitive,
+		t.filter,
+		t.hideDeniedDirs,
+		t.flat,
 		typeCacheTTL,
+		t.attrCacheTTL,
+		t.listingCacheTTL,
 		t.bucket,
+		t.folders,
 		&t.clock,
 		&t.clock)
 
 	t.in.Lock()
 }
 
+// Create an inode for the child directory with the given name, explicit if o
+// is non-nil and implicit otherwise. The inode is not locked.
+func (t *DirTest) newChildDir(name string, o *gcs.Object) (d inode.DirInode) {
+	attrs := fuseops.InodeAttributes{
+		Uid:   uid,
+		Gid:   gid,
+		Mode:  dirMode,
+		Mtime: t.clock.Now(),
+	}
+
+	if o != nil {
+		d = inode.NewExplicitDirInode(
+			dirInodeID+1,
+			o,
+			attrs,
+			false, // implicitDirs
+			t.normalizeName,
+			t.caseInsensitive,
+			t.filter,
+			t.hideDeniedDirs,
+			false, // flat
+			typeCacheTTL,
+			t.attrCacheTTL,
+			t.listingCacheTTL,
+			t.bucket,
+			t.folders,
+			&t.clock,
+			&t.clock)
+
+		return
+	}
+
+	d = inode.NewImplicitDirInode(
+		dirInodeID+1,
+		path.Join(dirInodeName, name)+"/",
+		attrs,
+		false, // implicitDirs
+		t.normalizeName,
+		t.caseInsensitive,
+		t.filter,
+		t.hideDeniedDirs,
+		false, // flat
+		typeCacheTTL,
+		t.attrCacheTTL,
+		t.listingCacheTTL,
+		t.bucket,
+		t.folders,
+		&t.clock,
+		&t.clock)
+
+	return
+}
+
 // Read all of the entries and sort them by name.
 func (t *DirTest) readAllEntries() (entries []fuseutil.Dirent, err error) {
 	tok := ""
@@ -123,6 +201,120 @@ func (t *DirTest) readAllEntries() (entries []fuseutil.Dirent, err error) {
 	return
 }
 
+// Folders kept in memory, which don't move the objects within them when
+// renamed.
+type fakeFolders struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func newFakeFolders(names ...string) (f *fakeFolders) {
+	f = &fakeFolders{names: make(map[string]bool)}
+	for _, n := range names {
+		f.names[n] = true
+	}
+
+	return
+}
+
+func (f *fakeFolders) GetFolder(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.names[name] {
+		return &gcs.NotFoundError{Err: errors.New(name)}
+	}
+
+	return nil
+}
+
+func (f *fakeFolders) CreateFolder(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.names[name] {
+		return &gcs.PreconditionError{Err: errors.New(name + " exists")}
+	}
+
+	f.names[name] = true
+	return nil
+}
+
+func (f *fakeFolders) DeleteFolder(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.names[name] {
+		return &gcs.NotFoundError{Err: errors.New(name)}
+	}
+
+	delete(f.names, name)
+	return nil
+}
+
+func (f *fakeFolders) RenameFolder(
+	ctx context.Context,
+	srcName string,
+	dstName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.names[srcName] {
+		return &gcs.NotFoundError{Err: errors.New(srcName)}
+	}
+
+	if f.names[dstName] {
+		return &gcs.PreconditionError{Err: errors.New(dstName + " exists")}
+	}
+
+	delete(f.names, srcName)
+	f.names[dstName] = true
+	return nil
+}
+
+func (f *fakeFolders) ListFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for n := range f.names {
+		rel := strings.TrimSuffix(strings.TrimPrefix(n, parent), "/")
+		if strings.HasPrefix(n, parent) && rel != "" && !strings.Contains(rel, "/") {
+			names = append(names, n)
+		}
+	}
+
+	return
+}
+
+// A bucket that refuses requests for objects whose names begin with prefix,
+// as GCS does for a managed folder we aren't allowed to use.
+type deniedBucket struct {
+	gcs.Bucket
+	prefix string
+}
+
+func (b *deniedBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (*gcs.Object, error) {
+	if strings.HasPrefix(req.Name, b.prefix) {
+		return nil, &googleapi.Error{Code: 403, Message: "forbidden"}
+	}
+
+	return b.Bucket.StatObject(ctx, req)
+}
+
+func (b *deniedBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (*gcs.Listing, error) {
+	if strings.HasPrefix(req.Prefix, b.prefix) {
+		return nil, &googleapi.Error{Code: 403, Message: "forbidden"}
+	}
+
+	return b.Bucket.ListObjects(ctx, req)
+}
+
 func (t *DirTest) setSymlinkTarget(
 	objName string,
 	target string) (err error) {
@@ -169,6 +361,111 @@ func (t *DirTest) Attributes() {
 	ExpectEq(dirMode|os.ModeDir, attrs.Mode)
 }
 
+func (t *DirTest) Attributes_ExplicitDirTimes() {
+	// Create a placeholder object, then let some time pass.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"qux/", nil)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(time.Hour)
+
+	// The explicit directory's times should come from the placeholder object,
+	// not the time at which the inode was created.
+	d := t.newChildDir("qux", o)
+	d.Lock()
+	defer d.Unlock()
+
+	attrs, err := d.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectThat(attrs.Atime, timeutil.TimeEq(o.Updated))
+	ExpectThat(attrs.Ctime, timeutil.TimeEq(o.Updated))
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(o.Updated))
+}
+
+func (t *DirTest) Attributes_ImplicitDirTimes() {
+	t.clock.AdvanceTime(time.Hour)
+
+	// With no object to go on, the times are those supplied when the inode was
+	// created.
+	d := t.newChildDir("qux", nil)
+	d.Lock()
+	defer d.Unlock()
+
+	attrs, err := d.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.clock.Now()))
+}
+
+func (t *DirTest) Attributes_Flat() {
+	t.flat = true
+	t.resetInode(true)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{dirInodeName + "baz/"})
+
+	AssertEq(nil, err)
+
+	// The directory is taken to have no child directories.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(2, attrs.Nlink)
+}
+
+func (t *DirTest) Attributes_Cached() {
+	const ttl = time.Minute
+	t.attrCacheTTL = ttl
+	t.resetInode(true)
+
+	_, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(
+		t.in.AttributesExpiration(),
+		timeutil.TimeEq(t.clock.Now().Add(ttl)))
+
+	// The expiration isn't extended until the cached attributes expire.
+	t.clock.AdvanceTime(ttl / 2)
+	_, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(
+		t.in.AttributesExpiration(),
+		timeutil.TimeEq(t.clock.Now().Add(ttl/2)))
+
+	t.clock.AdvanceTime(ttl)
+	_, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(
+		t.in.AttributesExpiration(),
+		timeutil.TimeEq(t.clock.Now().Add(ttl)))
+}
+
+func (t *DirTest) Attributes_LinkCount() {
+	// Create a child file and directories.
+	for _, name := range []string{"qux", "baz/", "taco/burrito"} {
+		_, err := gcsutil.CreateObject(
+			t.ctx,
+			t.bucket,
+			dirInodeName+name,
+			[]byte{})
+
+		AssertEq(nil, err)
+	}
+
+	// We don't list the directory to count its child directories, whether or
+	// not implicit directories are enabled.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, attrs.Nlink)
+
+	t.resetInode(true)
+
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, attrs.Nlink)
+}
+
 func (t *DirTest) LookUpChild_NonExistent() {
 	result, err := t.in.LookUpChild(t.ctx, "qux")
 
@@ -283,6 +580,43 @@ func (t *DirTest) LookUpChild_ImplicitDirOnly_Enabled() {
 	ExpectFalse(result.Exists())
 }
 
+func (t *DirTest) LookUpChild_Flat() {
+	var err error
+
+	t.flat = true
+	t.resetInode(true)
+
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			dirInodeName + "explicit/",
+			dirInodeName + "file",
+			dirInodeName + "file/",
+			dirInodeName + "implicit/foo",
+		})
+
+	AssertEq(nil, err)
+
+	// Only files are found.
+	result, err := t.in.LookUpChild(t.ctx, "file")
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"file", result.FullName)
+
+	result, err = t.in.LookUpChild(t.ctx, "explicit")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+
+	result, err = t.in.LookUpChild(t.ctx, "implicit")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+
+	result, err = t.in.LookUpChild(t.ctx, "file"+inode.ConflictingFileNameSuffix)
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
 func (t *DirTest) LookUpChild_FileAndDir() {
 	const name = "qux"
 	fileObjName := path.Join(dirInodeName, name)
@@ -459,6 +793,36 @@ func (t *DirTest) LookUpChild_FileAndDirAndImplicitDir_Enabled() {
 	ExpectEq(fileObj.Size, o.Size)
 }
 
+func (t *DirTest) LookUpChild_UnrepresentableNames() {
+	const suffix = inode.UnrepresentableNameSuffix
+
+	// Create objects whose components are "", "." and "..".
+	objs := []string{
+		dirInodeName + "/",
+		dirInodeName + "./",
+		dirInodeName + "..",
+	}
+
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
+	AssertEq(nil, err)
+
+	// Each should be found by its escaped name.
+	result, err := t.in.LookUpChild(t.ctx, suffix)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"/", result.Object.Name)
+
+	result, err = t.in.LookUpChild(t.ctx, "."+suffix)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"./", result.Object.Name)
+
+	result, err = t.in.LookUpChild(t.ctx, ".."+suffix)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+"..", result.Object.Name)
+}
+
 func (t *DirTest) LookUpChild_TypeCaching() {
 	const name = "qux"
 	fileObjName := path.Join(dirInodeName, name)
@@ -608,86 +972,133 @@ func (t *DirTest) ReadEntries_NonEmpty_ImplicitDirsEnabled() {
 	ExpectEq(fuseutil.DT_Link, entry.Type)
 }
 
-func (t *DirTest) ReadEntries_TypeCaching() {
-	const name = "qux"
-	fileObjName := path.Join(dirInodeName, name)
-	dirObjName := path.Join(dirInodeName, name) + "/"
-
-	var o *gcs.Object
+func (t *DirTest) ReadEntries_Filtered() {
 	var err error
 
-	// Create a backing object for a file.
-	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	t.filter, err = inode.NewNameFilter(
+		[]string{"_checkpoints/", "*.tmp"},
+		[]string{"*.csv"})
+
 	AssertEq(nil, err)
+	t.resetInode(true)
 
-	// Read the directory, priming the type cache.
-	_, err = t.readAllEntries()
+	// Set up contents.
+	objs := []string{
+		dirInodeName + "_checkpoints/blah",
+		dirInodeName + "_checkpoints",
+		dirInodeName + "data/",
+		dirInodeName + "a.csv",
+		dirInodeName + "b.csv.tmp",
+		dirInodeName + "c.json",
+	}
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
 	AssertEq(nil, err)
 
-	// Create a backing object for a directory.
-	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte("taco"))
+	// Read entries. The directory pattern doesn't hide the file with the same
+	// name, but the include pattern does.
+	entries, err := t.readAllEntries()
 	AssertEq(nil, err)
 
-	// Look up the name. Even though the directory should shadow the file,
-	// because we've cached only seeing the file that's what we should get back.
-	result, err := t.in.LookUpChild(t.ctx, name)
-	o = result.Object
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
 
-	AssertEq(nil, err)
-	AssertNe(nil, o)
+	ExpectThat(names, ElementsAre("a.csv", "data"))
+}
 
-	ExpectEq(fileObjName, o.Name)
+func (t *DirTest) LookUpChild_Filtered() {
+	var err error
 
-	// But after the TTL expires, the behavior should flip.
-	t.clock.AdvanceTime(typeCacheTTL + time.Millisecond)
+	t.filter, err = inode.NewNameFilter([]string{"_checkpoints/", "*.tmp"}, nil)
+	AssertEq(nil, err)
+	t.resetInode(true)
 
-	result, err = t.in.LookUpChild(t.ctx, name)
-	o = result.Object
+	// Set up contents.
+	objs := []string{
+		dirInodeName + "_checkpoints/blah",
+		dirInodeName + "foo.tmp",
+		dirInodeName + "foo",
+	}
 
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
 	AssertEq(nil, err)
-	AssertNe(nil, o)
 
-	ExpectEq(dirObjName, o.Name)
-}
+	// Hidden names aren't found.
+	for _, name := range []string{"_checkpoints", "foo.tmp"} {
+		result, err := t.in.LookUpChild(t.ctx, name)
+		AssertEq(nil, err)
+		ExpectFalse(result.Exists(), "name: %q", name)
+	}
 
-func (t *DirTest) CreateChildFile_DoesntExist() {
-	const name = "qux"
-	objName := path.Join(dirInodeName, name)
+	// Others are.
+	result, err := t.in.LookUpChild(t.ctx, "foo")
+	AssertEq(nil, err)
+	ExpectTrue(result.Exists())
+}
 
-	var o *gcs.Object
-	var err error
+func (t *DirTest) NewNameFilter_BadPattern() {
+	_, err := inode.NewNameFilter([]string{"["}, nil)
+	ExpectThat(err, Error(HasSubstr("syntax error")))
+}
 
-	// Call the inode.
-	o, err = t.in.CreateChildFile(t.ctx, name)
+func (t *DirTest) NameFilter_Ignoring() {
+	f, err := inode.NewNameFilter([]string{"*.tmp"}, []string{"*.csv"})
 	AssertEq(nil, err)
-	AssertNe(nil, o)
 
-	ExpectEq(objName, o.Name)
-	ExpectFalse(inode.IsSymlink(o))
+	g := f.Ignoring("._*")
+	ExpectFalse(g.Visible("a.tmp", false))
+	ExpectFalse(g.Visible("._a.csv", false))
+	ExpectFalse(g.Visible("a.json", false))
+	ExpectTrue(g.Visible("a.csv", false))
 
-	ExpectEq(1, len(o.Metadata))
-	ExpectEq(
-		t.clock.Now().UTC().Format(time.RFC3339Nano),
-		o.Metadata["gcsfuse_mtime"])
+	// The original is unchanged.
+	ExpectTrue(f.Visible("._a.csv", false))
+
+	// A nil filter can be extended too.
+	var none *inode.NameFilter
+	g = none.Ignoring("._*")
+	ExpectFalse(g.Visible("._a.csv", false))
+	ExpectTrue(g.Visible("a.json", false))
 }
 
-func (t *DirTest) CreateChildFile_Exists() {
-	const name = "qux"
-	objName := path.Join(dirInodeName, name)
+func (t *DirTest) ReadEntries_UnrepresentableNames() {
+	const suffix = inode.UnrepresentableNameSuffix
+	var entry fuseutil.Dirent
 
-	var err error
+	// Set up contents.
+	objs := []string{
+		dirInodeName + "/",
+		dirInodeName + "//foo",
+		dirInodeName + ".",
+		dirInodeName + "../",
+		dirInodeName + "../bar",
+	}
 
-	// Create an existing backing object.
-	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, objs)
 	AssertEq(nil, err)
 
-	// Call the inode.
-	_, err = t.in.CreateChildFile(t.ctx, name)
-	ExpectThat(err, Error(HasSubstr("Precondition")))
-	ExpectThat(err, Error(HasSubstr("exists")))
+	// Read entries.
+	entries, err := t.readAllEntries()
+
+	AssertEq(nil, err)
+	AssertEq(3, len(entries))
+
+	entry = entries[0]
+	ExpectEq(suffix, entry.Name)
+	ExpectEq(fuseutil.DT_Directory, entry.Type)
+
+	entry = entries[1]
+	ExpectEq("."+suffix, entry.Name)
+	ExpectEq(fuseutil.DT_File, entry.Type)
+
+	entry = entries[2]
+	ExpectEq(".."+suffix, entry.Name)
+	ExpectEq(fuseutil.DT_Directory, entry.Type)
 }
 
-func (t *DirTest) CreateChildFile_TypeCaching() {
+func (t *DirTest) ReadEntries_TypeCaching() {
 	const name = "qux"
 	fileObjName := path.Join(dirInodeName, name)
 	dirObjName := path.Join(dirInodeName, name) + "/"
@@ -695,8 +1106,12 @@ func (t *DirTest) CreateChildFile_TypeCaching() {
 	var o *gcs.Object
 	var err error
 
-	// Create the name.
-	_, err = t.in.CreateChildFile(t.ctx, name)
+	// Create a backing object for a file.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, fileObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// Read the directory, priming the type cache.
+	_, err = t.readAllEntries()
 	AssertEq(nil, err)
 
 	// Create a backing object for a directory.
@@ -725,24 +1140,578 @@ func (t *DirTest) CreateChildFile_TypeCaching() {
 	ExpectEq(dirObjName, o.Name)
 }
 
-func (t *DirTest) CloneToChildFile_SourceDoesntExist() {
-	const srcName = "blah/baz"
-	dstName := path.Join(dirInodeName, "qux")
+func (t *DirTest) ReadEntries_TypeCaching_ImplicitDir() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name, "asdf")
 
 	var err error
 
-	// Create and then delete the source.
-	src, err := gcsutil.CreateObject(t.ctx, t.bucket, srcName, []byte(""))
+	// Enable implicit dirs.
+	t.resetInode(true)
+
+	// Create an object that implicitly defines the directory.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte(""))
+	AssertEq(nil, err)
+
+	// Read the directory, priming the type cache.
+	_, err = t.readAllEntries()
 	AssertEq(nil, err)
 
+	// Delete the object.
 	err = t.bucket.DeleteObject(
 		t.ctx,
-		&gcs.DeleteObjectRequest{Name: srcName})
+		&gcs.DeleteObjectRequest{Name: objName})
 
 	AssertEq(nil, err)
 
-	// Call the inode.
-	_, err = t.in.CloneToChildFile(t.ctx, path.Base(dstName), src)
+	// Look up the name. Because the listing showed the directory, we shouldn't
+	// list its contents again to find out whether it exists.
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+
+	ExpectEq(nil, result.Object)
+	ExpectTrue(result.ImplicitDir)
+
+	// But after the TTL expires, it should disappear.
+	t.clock.AdvanceTime(typeCacheTTL + time.Millisecond)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+// Return the names of the entries in the directory.
+func (t *DirTest) readAllNames() (names []string) {
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return
+}
+
+func (t *DirTest) ReadEntries_Flat() {
+	var err error
+
+	t.flat = true
+	t.resetInode(true)
+
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			dirInodeName + "bar",
+			dirInodeName + "baz/",
+			dirInodeName + "foo",
+			dirInodeName + "qux/asdf",
+		})
+
+	AssertEq(nil, err)
+
+	// Only files are listed.
+	ExpectThat(t.readAllNames(), ElementsAre("bar", "foo"))
+}
+
+func (t *DirTest) ReadEntries_ListingCacheDisabled() {
+	var err error
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"foo", nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("foo"))
+
+	// A child created by someone else shows up right away.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"bar", nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("bar", "foo"))
+}
+
+func (t *DirTest) ReadEntries_ListingCaching() {
+	const ttl = time.Minute
+	var err error
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"foo", nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("foo"))
+
+	// A child created by someone else doesn't show up until the TTL expires.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"bar", nil)
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(ttl - time.Millisecond)
+	ExpectThat(t.readAllNames(), ElementsAre("foo"))
+
+	t.clock.AdvanceTime(2 * time.Millisecond)
+	ExpectThat(t.readAllNames(), ElementsAre("bar", "foo"))
+}
+
+func (t *DirTest) ReadEntries_ListingCaching_LocalChanges() {
+	const ttl = time.Minute
+	var err error
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"foo", nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("foo"))
+
+	// Changes made through the inode show up right away.
+	_, err = t.in.CreateChildFile(t.ctx, "bar")
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("bar", "foo"))
+
+	_, err = t.in.CreateChildDir(t.ctx, "baz")
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("bar", "baz", "foo"))
+
+	err = t.in.DeleteChildFile(t.ctx, "foo", 0, nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("bar", "baz"))
+}
+
+func (t *DirTest) ReadEntries_ListingCaching_WriteThrough() {
+	const ttl = time.Minute
+	var err error
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"foo", nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("foo"))
+
+	// Changes made by someone else don't show up...
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"remote", nil)
+	AssertEq(nil, err)
+
+	// ...even once we make our own, which update the cached listing rather
+	// than discarding it.
+	_, err = t.in.CreateChildSymlink(t.ctx, "link", "foo")
+	AssertEq(nil, err)
+
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("foo", entries[0].Name)
+	ExpectEq(fuseutil.DT_File, entries[0].Type)
+	ExpectEq("link", entries[1].Name)
+	ExpectEq(fuseutil.DT_Link, entries[1].Type)
+
+	// Replacing the symlink with a file changes its type.
+	src, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: dirInodeName + "foo"})
+
+	AssertEq(nil, err)
+
+	_, err = t.in.CloneToChildFile(t.ctx, "link", src)
+	AssertEq(nil, err)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("link", entries[1].Name)
+	ExpectEq(fuseutil.DT_File, entries[1].Type)
+
+	// Directories, and deletions.
+	_, err = t.in.CreateChildDir(t.ctx, "dir")
+	AssertEq(nil, err)
+
+	err = t.in.DeleteChildFile(t.ctx, "foo", 0, nil)
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("dir", "link"))
+
+	err = t.in.DeleteChildDir(t.ctx, "dir", t.newChildDir("dir", nil))
+	AssertEq(nil, err)
+
+	ExpectThat(t.readAllNames(), ElementsAre("link"))
+}
+
+func (t *DirTest) ReadEntries_ListingCaching_WriteThroughPages() {
+	const ttl = time.Minute
+	var err error
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	// Create enough objects to need two pages.
+	var names []string
+	for i := 0; i < 1500; i++ {
+		names = append(names, fmt.Sprintf("%sf%04d", dirInodeName, i))
+	}
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, names)
+	AssertEq(nil, err)
+
+	_, err = t.readAllEntries()
+	AssertEq(nil, err)
+
+	// New children go in the page that GCS would list them in, keeping the
+	// pages in name order.
+	_, err = t.in.CreateChildFile(t.ctx, "f0000a")
+	AssertEq(nil, err)
+
+	_, err = t.in.CreateChildFile(t.ctx, "z")
+	AssertEq(nil, err)
+
+	first, tok, err := t.in.ReadEntries(t.ctx, "")
+	AssertEq(nil, err)
+	AssertNe("", tok)
+
+	second, tok, err := t.in.ReadEntries(t.ctx, tok)
+	AssertEq(nil, err)
+	AssertEq("", tok)
+
+	ExpectEq(1502, len(first)+len(second))
+	ExpectEq("z", second[len(second)-1].Name)
+
+	var found bool
+	for _, e := range first {
+		found = found || e.Name == "f0000a"
+	}
+
+	ExpectTrue(found)
+}
+
+func (t *DirTest) ReadEntries_ListingCaching_PageNotCached() {
+	const ttl = time.Minute
+	var err error
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	var names []string
+	for i := 0; i < 1500; i++ {
+		names = append(names, fmt.Sprintf("%sf%04d", dirInodeName, i))
+	}
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, names)
+	AssertEq(nil, err)
+
+	// Read only the first page.
+	_, tok, err := t.in.ReadEntries(t.ctx, "")
+	AssertEq(nil, err)
+	AssertNe("", tok)
+
+	// A child that belongs in the second page can't be added to the cached
+	// listing, so it is discarded, and a change made by someone else shows up.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"remote", nil)
+	AssertEq(nil, err)
+
+	_, err = t.in.CreateChildFile(t.ctx, "z")
+	AssertEq(nil, err)
+
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1502, len(entries))
+	ExpectEq("remote", entries[1500].Name)
+	ExpectEq("z", entries[1501].Name)
+}
+
+func (t *DirTest) ReadEntries_ListingCaching_RenamedChildDir() {
+	const ttl = time.Minute
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	ExpectThat(t.readAllNames(), ElementsAre())
+
+	// A directory renamed into this one by another inode shows up once noted.
+	t.in.NoteRenamedChildDir("foo")
+
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[0].Type)
+}
+
+func (t *DirTest) ReadEntries_ListingCaching_Invalidated() {
+	const ttl = time.Minute
+	var err error
+
+	t.listingCacheTTL = ttl
+	t.resetInode(false)
+
+	ExpectThat(t.readAllNames(), ElementsAre())
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"foo", nil)
+	AssertEq(nil, err)
+
+	t.in.(inode.CachingInode).InvalidateCaches()
+	ExpectThat(t.readAllNames(), ElementsAre("foo"))
+}
+
+func (t *DirTest) CreateChildFile_DoesntExist() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name)
+
+	var o *gcs.Object
+	var err error
+
+	// Call the inode.
+	o, err = t.in.CreateChildFile(t.ctx, name)
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(objName, o.Name)
+	ExpectFalse(inode.IsSymlink(o))
+
+	ExpectEq(1, len(o.Metadata))
+	ExpectEq(
+		t.clock.Now().UTC().Format(time.RFC3339Nano),
+		o.Metadata["gcsfuse_mtime"])
+}
+
+func (t *DirTest) CreateChildFile_Exists() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name)
+
+	var err error
+
+	// Create an existing backing object.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// Call the inode.
+	_, err = t.in.CreateChildFile(t.ctx, name)
+	ExpectThat(err, Error(HasSubstr("Precondition")))
+	ExpectThat(err, Error(HasSubstr("exists")))
+}
+
+func (t *DirTest) CreateChildFile_UnrepresentableName() {
+	o, err := t.in.CreateChildFile(t.ctx, ".."+inode.UnrepresentableNameSuffix)
+	AssertEq(nil, err)
+	ExpectEq(dirInodeName+"..", o.Name)
+
+	// The escaped empty name would refer to the directory's placeholder.
+	_, err = t.in.CreateChildFile(t.ctx, inode.UnrepresentableNameSuffix)
+	ExpectThat(err, Error(HasSubstr("Illegal")))
+}
+
+func (t *DirTest) CreateChildFile_NormalizesName() {
+	t.normalizeName = norm.NFC.String
+	t.resetInode(false)
+
+	// "é" as 'e' followed by a combining acute accent.
+	const decomposed = "caf\u0065\u0301"
+	const composed = "caf\u00e9"
+
+	o, err := t.in.CreateChildFile(t.ctx, decomposed)
+	AssertEq(nil, err)
+	ExpectEq(path.Join(dirInodeName, composed), o.Name)
+
+	// Either form finds the object.
+	for _, name := range []string{composed, decomposed} {
+		result, err := t.in.LookUpChild(t.ctx, name)
+		AssertEq(nil, err)
+		AssertNe(nil, result.Object, "name: %q", name)
+		ExpectEq(o.Name, result.Object.Name)
+	}
+}
+
+func (t *DirTest) LookUpChild_FallsBackToUnnormalizedName() {
+	t.normalizeName = norm.NFC.String
+	t.resetInode(false)
+
+	const decomposed = "caf\u0065\u0301"
+	objName := path.Join(dirInodeName, decomposed)
+
+	// An object created by something that doesn't normalize.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, decomposed)
+	AssertEq(nil, err)
+	AssertNe(nil, result.Object)
+	ExpectEq(objName, result.Object.Name)
+
+	// Deleting it by the same name deletes that object.
+	err = t.in.DeleteChildFile(t.ctx, decomposed, 0, nil)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DirTest) LookUpChild_CaseSensitiveByDefault() {
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{path.Join(dirInodeName, "Foo.txt")})
+
+	AssertEq(nil, err)
+
+	result, err := t.in.LookUpChild(t.ctx, "foo.txt")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) LookUpChild_CaseInsensitive() {
+	t.caseInsensitive = true
+	t.resetInode(false)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			path.Join(dirInodeName, "Foo.txt"),
+			path.Join(dirInodeName, "Bar") + "/",
+			path.Join(dirInodeName, "README"),
+			path.Join(dirInodeName, "readme"),
+		})
+
+	AssertEq(nil, err)
+
+	// Names that differ in case find the children.
+	result, err := t.in.LookUpChild(t.ctx, "foo.TXT")
+	AssertEq(nil, err)
+	AssertTrue(result.Exists())
+	ExpectEq(path.Join(dirInodeName, "Foo.txt"), result.FullName)
+
+	result, err = t.in.LookUpChild(t.ctx, "bar")
+	AssertEq(nil, err)
+	AssertTrue(result.Exists())
+	ExpectEq(path.Join(dirInodeName, "Bar")+"/", result.FullName)
+
+	// Exact matches win, and otherwise the first name in order.
+	result, err = t.in.LookUpChild(t.ctx, "readme")
+	AssertEq(nil, err)
+	ExpectEq(path.Join(dirInodeName, "readme"), result.FullName)
+
+	result, err = t.in.LookUpChild(t.ctx, "ReadMe")
+	AssertEq(nil, err)
+	ExpectEq(path.Join(dirInodeName, "README"), result.FullName)
+
+	// Others still aren't found.
+	result, err = t.in.LookUpChild(t.ctx, "baz")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) LookUpChild_CaseInsensitiveIndexExpires() {
+	t.caseInsensitive = true
+	t.resetInode(false)
+
+	// Build the index with a miss.
+	result, err := t.in.LookUpChild(t.ctx, "QUX")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+
+	// Another writer creates the child. Until the index expires, only the
+	// exact name finds it.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		path.Join(dirInodeName, "qux"),
+		[]byte("taco"))
+
+	AssertEq(nil, err)
+
+	result, err = t.in.LookUpChild(t.ctx, "QUX")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+
+	t.clock.AdvanceTime(typeCacheTTL + time.Millisecond)
+
+	result, err = t.in.LookUpChild(t.ctx, "QUX")
+	AssertEq(nil, err)
+	ExpectTrue(result.Exists())
+
+	// Children we create are found right away.
+	_, err = t.in.CreateChildFile(t.ctx, "Taco")
+	AssertEq(nil, err)
+
+	result, err = t.in.LookUpChild(t.ctx, "TACO")
+	AssertEq(nil, err)
+	ExpectTrue(result.Exists())
+}
+
+func (t *DirTest) DeleteChildFile_CaseInsensitive() {
+	t.caseInsensitive = true
+	t.resetInode(false)
+
+	objName := path.Join(dirInodeName, "Foo.txt")
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.in.DeleteChildFile(t.ctx, "FOO.TXT", 0, nil)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DirTest) CreateChildFile_TypeCaching() {
+	const name = "qux"
+	fileObjName := path.Join(dirInodeName, name)
+	dirObjName := path.Join(dirInodeName, name) + "/"
+
+	var o *gcs.Object
+	var err error
+
+	// Create the name.
+	_, err = t.in.CreateChildFile(t.ctx, name)
+	AssertEq(nil, err)
+
+	// Create a backing object for a directory.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirObjName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// Look up the name. Even though the directory should shadow the file,
+	// because we've cached only seeing the file that's what we should get back.
+	result, err := t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(fileObjName, o.Name)
+
+	// But after the TTL expires, the behavior should flip.
+	t.clock.AdvanceTime(typeCacheTTL + time.Millisecond)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	o = result.Object
+
+	AssertEq(nil, err)
+	AssertNe(nil, o)
+
+	ExpectEq(dirObjName, o.Name)
+}
+
+func (t *DirTest) CloneToChildFile_SourceDoesntExist() {
+	const srcName = "blah/baz"
+	dstName := path.Join(dirInodeName, "qux")
+
+	var err error
+
+	// Create and then delete the source.
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, srcName, []byte(""))
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: srcName})
+
+	AssertEq(nil, err)
+
+	// Call the inode.
+	_, err = t.in.CloneToChildFile(t.ctx, path.Base(dstName), src)
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
 
@@ -1078,7 +2047,7 @@ func (t *DirTest) DeleteChildFile_TypeCaching() {
 func (t *DirTest) DeleteChildDir_DoesntExist() {
 	const name = "qux"
 
-	err := t.in.DeleteChildDir(t.ctx, name)
+	err := t.in.DeleteChildDir(t.ctx, name, t.newChildDir(name, nil))
 	ExpectEq(nil, err)
 }
 
@@ -1089,14 +2058,272 @@ func (t *DirTest) DeleteChildDir_Exists() {
 	var err error
 
 	// Create a backing object.
-	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
 	AssertEq(nil, err)
 
 	// Call the inode.
-	err = t.in.DeleteChildDir(t.ctx, name)
+	err = t.in.DeleteChildDir(t.ctx, name, t.newChildDir(name, o))
 	AssertEq(nil, err)
 
 	// Check the bucket.
 	_, err = gcsutil.ReadObject(t.ctx, t.bucket, objName)
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
+
+func (t *DirTest) DeleteChildDir_WrongGeneration() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name) + "/"
+
+	var err error
+
+	// Create a backing object, then replace it.
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("burrito"))
+	AssertEq(nil, err)
+
+	// Call the inode with the old generation. No error should be returned.
+	err = t.in.DeleteChildDir(t.ctx, name, t.newChildDir(name, o))
+	AssertEq(nil, err)
+
+	// The new generation should still be there.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, objName)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *DirTest) DeleteChildDir_Implicit() {
+	const name = "qux"
+	objName := path.Join(dirInodeName, name) + "/"
+
+	var err error
+
+	// Create a placeholder object that the implicit directory inode doesn't
+	// know about, as if another machine ran mkdir concurrently.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, objName, []byte("taco"))
+	AssertEq(nil, err)
+
+	// Call the inode.
+	err = t.in.DeleteChildDir(t.ctx, name, t.newChildDir(name, nil))
+	AssertEq(nil, err)
+
+	// The placeholder should be left alone.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, objName)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DirTest) Folders_LookUpChild() {
+	folders := newFakeFolders(dirInodeName + "qux/")
+	t.folders = folders
+	t.resetInode(false)
+
+	// A folder is found, though there is no placeholder object.
+	result, err := t.in.LookUpChild(t.ctx, "qux")
+	AssertEq(nil, err)
+	ExpectTrue(result.Exists())
+	ExpectTrue(result.Folder)
+	ExpectEq(nil, result.Object)
+	ExpectEq(dirInodeName+"qux/", result.FullName)
+
+	// A placeholder object without a folder isn't.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, dirInodeName+"taco/", nil)
+	AssertEq(nil, err)
+
+	result, err = t.in.LookUpChild(t.ctx, "taco")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) Folders_ReadEntries() {
+	t.folders = newFakeFolders(
+		dirInodeName+"empty/",
+		dirInodeName+"full/",
+		dirInodeName+"full/nested/",
+		"unrelated/")
+
+	t.resetInode(false)
+
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, []string{
+		dirInodeName + "file",
+		dirInodeName + "full/baz",
+	})
+
+	AssertEq(nil, err)
+
+	// Directories come from the folders, including empty ones.
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(3, len(entries))
+
+	ExpectEq("empty", entries[0].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[0].Type)
+	ExpectEq("file", entries[1].Name)
+	ExpectEq(fuseutil.DT_File, entries[1].Type)
+	ExpectEq("full", entries[2].Name)
+	ExpectEq(fuseutil.DT_Directory, entries[2].Type)
+}
+
+func (t *DirTest) Folders_CreateChildDir() {
+	folders := newFakeFolders()
+	t.folders = folders
+	t.resetInode(false)
+
+	o, err := t.in.CreateChildDir(t.ctx, "qux")
+	AssertEq(nil, err)
+	ExpectEq(nil, o)
+	ExpectTrue(folders.names[dirInodeName+"qux/"])
+
+	// No placeholder object was created.
+	_, err = t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: dirInodeName + "qux/"})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Creating it again fails.
+	_, err = t.in.CreateChildDir(t.ctx, "qux")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *DirTest) Folders_DeleteChildDir() {
+	folders := newFakeFolders(dirInodeName + "qux/")
+	t.folders = folders
+	t.resetInode(false)
+
+	err := t.in.DeleteChildDir(t.ctx, "qux", t.newChildDir("qux", nil))
+	AssertEq(nil, err)
+	ExpectFalse(folders.names[dirInodeName+"qux/"])
+
+	// Deleting a folder that is already gone succeeds.
+	err = t.in.DeleteChildDir(t.ctx, "qux", t.newChildDir("qux", nil))
+	ExpectEq(nil, err)
+}
+
+func (t *DirTest) Folders_RenameChildDir() {
+	folders := newFakeFolders(dirInodeName+"qux/", "taco/")
+	t.folders = folders
+	t.resetInode(false)
+
+	newParent := inode.NewImplicitDirInode(
+		dirInodeID+1,
+		"taco/",
+		fuseops.InodeAttributes{},
+		false, // implicitDirs
+		nil,
+		false, // caseInsensitive
+		nil,
+		false, // hideDeniedDirs
+		false, // flat
+		typeCacheTTL,
+		0, // attrCacheTTL
+		0, // listingCacheTTL
+		t.bucket,
+		t.folders,
+		&t.clock,
+		&t.clock)
+
+	err := t.in.RenameChildDir(t.ctx, "qux", newParent, "burrito")
+	AssertEq(nil, err)
+	ExpectFalse(folders.names[dirInodeName+"qux/"])
+	ExpectTrue(folders.names["taco/burrito/"])
+
+	// The old name is gone, despite the type cache having seen it.
+	result, err := t.in.LookUpChild(t.ctx, "qux")
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) RenameChildDir_NoFolders() {
+	_, err := t.in.CreateChildDir(t.ctx, "qux")
+	AssertEq(nil, err)
+
+	err = t.in.RenameChildDir(t.ctx, "qux", t.in, "burrito")
+	ExpectThat(err, Error(HasSubstr("folders")))
+}
+
+func (t *DirTest) LookUpChild_DeniedDir() {
+	const name = "qux"
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{dirInodeName + name + "/", dirInodeName + name + "/a"})
+
+	AssertEq(nil, err)
+
+	t.bucket = &deniedBucket{Bucket: t.bucket, prefix: dirInodeName + name + "/"}
+	t.resetInode(true)
+
+	// The child shows up as a directory that we were refused.
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectTrue(result.Exists())
+	ExpectTrue(result.Denied)
+	ExpectEq(nil, result.Object)
+	ExpectEq(dirInodeName+name+"/", result.FullName)
+
+	// Unless we're hiding such directories.
+	t.hideDeniedDirs = true
+	t.resetInode(true)
+
+	result, err = t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectFalse(result.Exists())
+}
+
+func (t *DirTest) LookUpChild_DeniedDirAndFile() {
+	const name = "qux"
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{dirInodeName + name, dirInodeName + name + "/a"})
+
+	AssertEq(nil, err)
+
+	t.bucket = &deniedBucket{Bucket: t.bucket, prefix: dirInodeName + name + "/"}
+	t.resetInode(true)
+
+	// The file we can see wins over the directory we can't.
+	result, err := t.in.LookUpChild(t.ctx, name)
+	AssertEq(nil, err)
+	ExpectFalse(result.Denied)
+	AssertNe(nil, result.Object)
+	ExpectEq(dirInodeName+name, result.Object.Name)
+}
+
+func (t *DirTest) ReadEntries_DeniedDirs() {
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			dirInodeName + "allowed/",
+			dirInodeName + "denied/",
+			dirInodeName + "file",
+		})
+
+	AssertEq(nil, err)
+
+	t.bucket = &deniedBucket{Bucket: t.bucket, prefix: dirInodeName + "denied/"}
+
+	// By default, both directories are listed, even without implicit
+	// directories, where the refused placeholder can't be statted.
+	t.resetInode(false)
+
+	entries, err := t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(3, len(entries))
+	ExpectEq("allowed", entries[0].Name)
+	ExpectEq("denied", entries[1].Name)
+	ExpectEq("file", entries[2].Name)
+
+	// With hideDeniedDirs, the refused one isn't.
+	t.hideDeniedDirs = true
+	t.resetInode(false)
+
+	entries, err = t.readAllEntries()
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("allowed", entries[0].Name)
+	ExpectEq("file", entries[1].Name)
+}
@@ -15,47 +15,101 @@
 package inode
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
 )
 
 // An inode representing a directory backed by an object in GCS with a specific
 // generation.
 type ExplicitDirInode interface {
 	DirInode
+
+	// Requires the inode lock.
 	SourceGeneration() Generation
+
+	// Return the custom metadata of the placeholder object as currently
+	// recorded in GCS, along with its meta-generation, which the inode adopts.
+	// Return *gcs.NotFoundError if the placeholder has been deleted or replaced
+	// by a new generation.
+	//
+	// Requires the inode lock.
+	Metadata(ctx context.Context) (
+		metadata map[string]string,
+		metaGeneration int64,
+		err error)
+
+	// Apply the updates to the custom metadata of the placeholder object, with
+	// the semantics of gcs.UpdateObjectRequest.Metadata, provided that its
+	// meta-generation is still as given. Return *gcs.PreconditionError if not,
+	// and *gcs.NotFoundError as for Metadata.
+	//
+	// Requires the inode lock.
+	UpdateMetadata(
+		ctx context.Context,
+		updates map[string]*string,
+		metaGeneration int64) (err error)
+
+	// Return the generation number of the placeholder object, which never
+	// changes.
+	//
+	// Does not require the lock to be held.
+	objectGeneration() int64
 }
 
 // Create an explicit dir inode backed by the supplied object. See notes on
-// NewDirInode for more.
+// NewDirInode for more. The times in attrs are replaced with the update time
+// of the object.
 func NewExplicitDirInode(
 	id fuseops.InodeID,
 	o *gcs.Object,
 	attrs fuseops.InodeAttributes,
 	implicitDirs bool,
+	normalizeName func(string) string,
+	caseInsensitive bool,
+	filter *NameFilter,
+	hideDeniedDirs bool,
+	flat bool,
 	typeCacheTTL time.Duration,
+	attrCacheTTL time.Duration,
+	listingCacheTTL time.Duration,
 	bucket gcs.Bucket,
+	folders storage.Folders,
 	mtimeClock timeutil.Clock,
 	cacheClock timeutil.Clock) (d ExplicitDirInode) {
+	// The placeholder object is written when the directory is created, and not
+	// touched again while the directory exists.
+	attrs.Atime = o.Updated
+	attrs.Ctime = o.Updated
+	attrs.Mtime = o.Updated
+
 	wrapped := NewDirInode(
 		id,
 		o.Name,
 		attrs,
 		implicitDirs,
+		normalizeName,
+		caseInsensitive,
+		filter,
+		hideDeniedDirs,
+		flat,
 		typeCacheTTL,
+		attrCacheTTL,
+		listingCacheTTL,
 		bucket,
+		folders,
 		mtimeClock,
 		cacheClock)
 
 	d = &explicitDirInode{
-		dirInode: wrapped.(*dirInode),
-		generation: Generation{
-			Object:   o.Generation,
-			Metadata: o.MetaGeneration,
-		},
+		dirInode:       wrapped.(*dirInode),
+		objectGen:      o.Generation,
+		metaGeneration: o.MetaGeneration,
 	}
 
 	return
@@ -63,10 +117,83 @@ func NewExplicitDirInode(
 
 type explicitDirInode struct {
 	*dirInode
-	generation Generation
+
+	// The generation of the placeholder object. Constant.
+	objectGen int64
+
+	// The meta-generation of the placeholder object, which changes when its
+	// metadata is updated.
+	//
+	// GUARDED_BY(mu)
+	metaGeneration int64
 }
 
+// LOCKS_REQUIRED(d)
 func (d *explicitDirInode) SourceGeneration() (gen Generation) {
-	gen = d.generation
+	gen = Generation{
+		Object:   d.objectGen,
+		Metadata: d.metaGeneration,
+	}
+
+	return
+}
+
+func (d *explicitDirInode) objectGeneration() int64 {
+	return d.objectGen
+}
+
+// LOCKS_REQUIRED(d)
+func (d *explicitDirInode) Metadata(ctx context.Context) (
+	metadata map[string]string,
+	metaGeneration int64,
+	err error) {
+	o, err := d.bucket.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: d.Name()})
+
+	// Leave errors unwrapped so that callers can check their types.
+	if err != nil {
+		return
+	}
+
+	if o.Generation != d.objectGen {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf(
+				"Placeholder %q replaced by generation %d",
+				d.Name(),
+				o.Generation),
+		}
+
+		return
+	}
+
+	if o.MetaGeneration > d.metaGeneration {
+		d.metaGeneration = o.MetaGeneration
+	}
+
+	metadata = o.Metadata
+	metaGeneration = o.MetaGeneration
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *explicitDirInode) UpdateMetadata(
+	ctx context.Context,
+	updates map[string]*string,
+	metaGeneration int64) (err error) {
+	o, err := d.bucket.UpdateObject(
+		ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                       d.Name(),
+			Generation:                 d.objectGen,
+			MetaGenerationPrecondition: &metaGeneration,
+			Metadata:                   updates,
+		})
+
+	if err != nil {
+		return
+	}
+
+	d.metaGeneration = o.MetaGeneration
 	return
 }
@@ -17,12 +17,14 @@ package inode
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/gcloud/gcs"
-	"github.com/jacobsa/syncutil"
 	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
 )
@@ -32,6 +34,8 @@ import (
 const FileMtimeMetadataKey = gcsx.MtimeMetadataKey
 
 type FileInode struct {
+	BaseInode
+
 	/////////////////////////
 	// Dependencies
 	/////////////////////////
@@ -39,27 +43,37 @@ type FileInode struct {
 	bucket     gcs.Bucket
 	syncer     gcsx.Syncer
 	mtimeClock timeutil.Clock
+	cacheClock timeutil.Clock
 
 	/////////////////////////
 	// Constant data
 	/////////////////////////
 
-	id      fuseops.InodeID
-	name    string
 	attrs   fuseops.InodeAttributes
 	tempDir string
 
+	// Content no larger than this is kept in memory rather than in tempDir.
+	spillThreshold int64
+
+	// If non-nil, used to encrypt temp files created in tempDir.
+	cipher *gcsx.DiskCipher
+
+	// If non-nil, temp files are created here rather than in tempDir.
+	staging *gcsx.StagingArea
+
+	// Consulted before content is staged, if non-nil.
+	space *gcsx.SpaceChecker
+
+	// If non-nil, a write lease is taken on the object before it is modified.
+	lease *LeaseConfig
+
+	// Are writes that fill an empty file from the start streamed to GCS?
+	streamWrites bool
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
-	// A mutex that must be held when calling certain methods. See documentation
-	// for each method.
-	mu syncutil.InvariantMutex
-
-	// GUARDED_BY(mu)
-	lc lookupCount
-
 	// The source object from which this inode derives.
 	//
 	// INVARIANT: src.Name == name
@@ -71,16 +85,59 @@ type FileInode struct {
 	// authoritative.
 	content gcsx.TempFile
 
+	// An upload in progress of the contents being written, if they are being
+	// streamed to GCS, and the time of the last write to it.
+	//
+	// INVARIANT: If stream != nil, content == nil
+	//
+	// GUARDED_BY(mu)
+	stream      *gcsx.StreamingUpload
+	streamMtime time.Time
+
+	// When the write lease we hold on the object expires, or the zero time if
+	// we don't hold one.
+	//
+	// GUARDED_BY(mu)
+	leaseExpiry time.Time
+
+	// The storage class to give the object when the contents are next written
+	// out, or empty to keep that of the source object.
+	//
+	// GUARDED_BY(mu)
+	storageClass string
+
+	// Set when Refresh adopts a generation with different contents, and
+	// cleared by TakeContentReplaced.
+	//
+	// GUARDED_BY(mu)
+	contentReplaced bool
+
+	// Attributes most recently returned by Attributes, erased whenever the
+	// inode changes.
+	//
+	// GUARDED_BY(mu)
+	attrCache attrCache
+
 	// Has Destroy been called?
 	//
 	// GUARDED_BY(mu)
 	destroyed bool
 }
 
-var _ Inode = &FileInode{}
+var _ RefreshableInode = &FileInode{}
+var _ CachingInode = &FileInode{}
 
 // Create a file inode for the given object in GCS. The initial lookup count is
-// zero.
+// zero. If attrCacheTTL is non-zero, attributes are cached for that long,
+// according to cacheClock, during which changes made to the object by other
+// writers aren't noticed. If space is non-nil, writes that would stage more
+// content than it allows fail with syscall.ENOSPC. Unless staging is non-nil,
+// content is kept in memory until it grows beyond spillThreshold bytes. If
+// lease is non-nil, modifications fail with syscall.EBUSY while another mount
+// holds a write lease on the object. If streamWrites is set, writes that fill
+// an empty or newly truncated file from the start are passed straight on to
+// GCS instead of being staged, and other writes to it fail with
+// syscall.ENOTSUP.
 //
 // REQUIRES: o != nil
 // REQUIRES: o.Generation > 0
@@ -94,23 +151,34 @@ func NewFileInode(
 	bucket gcs.Bucket,
 	syncer gcsx.Syncer,
 	tempDir string,
-	mtimeClock timeutil.Clock) (f *FileInode) {
+	spillThreshold int64,
+	cipher *gcsx.DiskCipher,
+	staging *gcsx.StagingArea,
+	space *gcsx.SpaceChecker,
+	lease *LeaseConfig,
+	streamWrites bool,
+	attrCacheTTL time.Duration,
+	mtimeClock timeutil.Clock,
+	cacheClock timeutil.Clock) (f *FileInode) {
 	// Set up the basic struct.
 	f = &FileInode{
-		bucket:     bucket,
-		syncer:     syncer,
-		mtimeClock: mtimeClock,
-		id:         id,
-		name:       o.Name,
-		attrs:      attrs,
-		tempDir:    tempDir,
-		src:        *o,
+		bucket:         bucket,
+		syncer:         syncer,
+		mtimeClock:     mtimeClock,
+		cacheClock:     cacheClock,
+		attrs:          attrs,
+		tempDir:        tempDir,
+		spillThreshold: spillThreshold,
+		cipher:         cipher,
+		staging:        staging,
+		space:          space,
+		lease:          lease,
+		streamWrites:   streamWrites,
+		src:            *o,
+		attrCache:      newAttrCache(attrCacheTTL),
 	}
 
-	f.lc.Init(id)
-
-	// Set up invariant checking.
-	f.mu = syncutil.NewInvariantMutex(f.checkInvariants)
+	f.Init(id, o.Name, f.checkInvariants)
 
 	return
 }
@@ -140,6 +208,11 @@ func (f *FileInode) checkInvariants() {
 	if f.content != nil {
 		f.content.CheckInvariants()
 	}
+
+	// INVARIANT: If stream != nil, content == nil
+	if f.stream != nil && f.content != nil {
+		panic("Both streaming and staging content")
+	}
 }
 
 // LOCKS_REQUIRED(f.mu)
@@ -168,32 +241,258 @@ func (f *FileInode) clobbered(ctx context.Context) (b bool, err error) {
 	return
 }
 
+// Return syscall.ENOSPC if there isn't room to stage n more bytes, along with
+// the first limit bytes of the source object if they have yet to be fetched.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) checkSpace(n int64, limit int64) (err error) {
+	if f.content == nil {
+		if limit > int64(f.src.Size) {
+			limit = int64(f.src.Size)
+		}
+
+		n += limit
+	}
+
+	err = f.space.Check(n)
+	return
+}
+
+// If write leases are enabled, make sure that we hold a lease on the object
+// that won't expire soon, taking or renewing it as necessary. Return
+// syscall.EBUSY if another mount holds one. An object that has been deleted or
+// replaced is left for Sync to treat as unlinked, as without leases.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) acquireLease(ctx context.Context) (err error) {
+	if f.lease == nil {
+		return
+	}
+
+	// Is the lease we hold good for a while yet?
+	now := f.mtimeClock.Now()
+	if now.Add(f.lease.TTL / 2).Before(f.leaseExpiry) {
+		return
+	}
+
+	// Try with the metadata we know about, and once more if it turns out to
+	// have changed.
+	for attempt := 0; ; attempt++ {
+		owner, expiry, ok := parseLease(f.src.Metadata[LeaseMetadataKey])
+		if ok && owner != f.lease.Owner && now.Before(expiry) {
+			err = syscall.EBUSY
+			return
+		}
+
+		expiry = now.Add(f.lease.TTL)
+		value := formatLease(f.lease.Owner, expiry)
+
+		req := &gcs.UpdateObjectRequest{
+			Name:                       f.src.Name,
+			Generation:                 f.src.Generation,
+			MetaGenerationPrecondition: &f.src.MetaGeneration,
+			Metadata: map[string]*string{
+				LeaseMetadataKey: &value,
+			},
+		}
+
+		var o *gcs.Object
+		o, err = f.bucket.UpdateObject(ctx, req)
+		switch err.(type) {
+		case nil:
+			f.src = *o
+			f.leaseExpiry = expiry
+			return
+
+		case *gcs.NotFoundError:
+			err = nil
+			return
+
+		case *gcs.PreconditionError:
+			// Someone else is updating the object's metadata as fast as we are.
+			if attempt > 0 {
+				err = syscall.EBUSY
+				return
+			}
+
+		default:
+			err = fmt.Errorf("UpdateObject: %v", err)
+			return
+		}
+
+		// Find out what changed.
+		o, err = f.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: f.name})
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("StatObject: %v", err)
+			return
+		}
+
+		if o.Generation != f.src.Generation {
+			return
+		}
+
+		f.src = *o
+	}
+}
+
+// Start streaming the file's new contents to GCS, replacing the source object.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) startStream(ctx context.Context) (err error) {
+	// Make sure no other mount is writing, returning EBUSY as is if one is.
+	err = f.acquireLease(ctx)
+	if err != nil {
+		return
+	}
+
+	src := f.src
+	if f.storageClass != "" {
+		src.StorageClass = f.storageClass
+	}
+
+	f.stream = gcsx.NewStreamingUpload(f.bucket, &src)
+	f.streamMtime = f.mtimeClock.Now()
+
+	return
+}
+
+// Finish the upload started by startStream, adopting the new generation. As
+// with Sync, a failed precondition is treated as the file having been
+// unlinked.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) finishStream() (err error) {
+	o, err := f.stream.Finish()
+	f.stream = nil
+
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Finish: %v", err)
+		return
+	}
+
+	f.src = *o
+	f.leaseExpiry = time.Time{}
+
+	return
+}
+
 // Ensure that f.content != nil
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) ensureContent(ctx context.Context) (err error) {
-	// Is there anything to do?
-	if f.content != nil {
+	err = f.ensureContentPrefix(ctx, int64(f.src.Size))
+	return
+}
+
+// Set f.content to a temp file that fetches the source object's contents only
+// once they are needed, for appending to.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) startAppend() (err error) {
+	// The fetch may happen during any later operation, which supplies its own
+	// context.
+	bucket := f.bucket
+	req := &gcs.ReadObjectRequest{
+		Name:       f.src.Name,
+		Generation: f.src.Generation,
+	}
+
+	fetch := func(ctx context.Context) (rc io.ReadCloser, err error) {
+		rc, err = bucket.NewReader(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("NewReader: %v", err)
+			return
+		}
+
 		return
 	}
 
-	// Open a reader for the generation we care about.
-	rc, err := f.bucket.NewReader(
-		ctx,
-		&gcs.ReadObjectRequest{
-			Name:       f.src.Name,
-			Generation: f.src.Generation,
-		})
+	f.content, err = gcsx.NewAppendingTempFile(
+		int64(f.src.Size),
+		fetch,
+		f.tempDir,
+		f.cipher,
+		f.mtimeClock)
 
 	if err != nil {
-		err = fmt.Errorf("NewReader: %v", err)
+		err = fmt.Errorf("NewAppendingTempFile: %v", err)
 		return
 	}
 
+	return
+}
+
+// Ensure that f.content != nil, filling it with no more than the first limit
+// bytes of the source object if it must be created. The caller must truncate
+// the content to limit when it is shorter than the source object, so that it
+// is marked dirty.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) ensureContentPrefix(
+	ctx context.Context,
+	limit int64) (err error) {
+	// Is there anything to do?
+	if f.content != nil {
+		return
+	}
+
+	if limit > int64(f.src.Size) {
+		limit = int64(f.src.Size)
+	}
+
+	// Open a reader for the range of the generation we care about, unless it's
+	// empty.
+	var rc io.ReadCloser = ioutil.NopCloser(strings.NewReader(""))
+	if limit > 0 {
+		rc, err = f.bucket.NewReader(
+			ctx,
+			&gcs.ReadObjectRequest{
+				Name:       f.src.Name,
+				Generation: f.src.Generation,
+				Range: &gcs.ByteRange{
+					Start: 0,
+					Limit: uint64(limit),
+				},
+			})
+
+		if err != nil {
+			err = fmt.Errorf("NewReader: %v", err)
+			return
+		}
+	}
+
 	defer rc.Close()
 
 	// Create a temporary file with its contents.
-	tf, err := gcsx.NewTempFile(rc, f.tempDir, f.mtimeClock)
+	var tf gcsx.TempFile
+	if f.staging != nil {
+		tf, err = f.staging.NewTempFile(
+			rc,
+			gcsx.StagedWrite{
+				Bucket:     f.bucket.Name(),
+				Object:     f.src.Name,
+				Generation: f.src.Generation,
+			},
+			f.mtimeClock)
+	} else {
+		tf, err = gcsx.NewSpillingTempFile(
+			rc,
+			f.tempDir,
+			f.spillThreshold,
+			f.cipher,
+			f.mtimeClock)
+	}
+
 	if err != nil {
 		err = fmt.Errorf("NewTempFile: %v", err)
 		return
@@ -209,22 +508,6 @@ func (f *FileInode) ensureContent(ctx context.Context) (err error) {
 // Public interface
 ////////////////////////////////////////////////////////////////////////
 
-func (f *FileInode) Lock() {
-	f.mu.Lock()
-}
-
-func (f *FileInode) Unlock() {
-	f.mu.Unlock()
-}
-
-func (f *FileInode) ID() fuseops.InodeID {
-	return f.id
-}
-
-func (f *FileInode) Name() string {
-	return f.name
-}
-
 // Return a record for the GCS object from which this inode is branched. The
 // record is guaranteed not to be modified, and users must not modify it.
 //
@@ -242,26 +525,200 @@ func (f *FileInode) Source() *gcs.Object {
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) SourceGenerationIsAuthoritative() bool {
-	return f.content == nil
+	return f.content == nil && f.stream == nil
 }
 
-// Equivalent to the generation returned by f.Source().
+// Does the inode have local modifications that have not yet been written out
+// to GCS?
 //
-// LOCKS_REQUIRED(f)
-func (f *FileInode) SourceGeneration() (g Generation) {
-	g.Object = f.src.Generation
-	g.Metadata = f.src.MetaGeneration
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Dirty() bool {
+	return (f.content != nil || f.stream != nil) && !f.destroyed
+}
+
+// Return the size of the contents that writing out the inode would send to
+// GCS, or zero if it isn't dirty. Contents being streamed have already been
+// sent as they were written, so don't count.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) DirtyBytes() int64 {
+	if f.content == nil || f.destroyed {
+		return 0
+	}
+
+	sr, err := f.content.Stat()
+	if err != nil {
+		return 0
+	}
+
+	return sr.Size
+}
+
+// Return the storage class that the contents have, or will be given when they
+// are next written out if SetStorageClass has been called. Empty if unknown.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) StorageClass() string {
+	if f.storageClass != "" {
+		return f.storageClass
+	}
+
+	return f.src.StorageClass
+}
+
+// Set the storage class to give the object when the contents are next written
+// out, or with the empty string go back to keeping that of the source object.
+// The object in GCS is unaffected until then.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetStorageClass(class string) {
+	f.storageClass = class
+}
+
+// Return the custom time of the source object, or the zero time if it has
+// none. New generations written out by Sync keep it.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) CustomTime() time.Time {
+	return f.src.CustomTime
+}
+
+// Set the custom time of the source object in GCS. Fail with
+// *gcs.NotFoundError or *gcs.PreconditionError if it has been deleted or
+// changed since it was read, and with syscall.ENOTSUP while streaming, since
+// the generation being streamed wouldn't get the new time.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetCustomTime(
+	ctx context.Context,
+	t time.Time) (err error) {
+	if f.stream != nil {
+		err = syscall.ENOTSUP
+		return
+	}
+
+	err = f.updateSource(ctx, &gcs.UpdateObjectRequest{CustomTime: &t})
 	return
 }
 
+// Is the source object under a temporary hold?
+//
 // LOCKS_REQUIRED(f.mu)
-func (f *FileInode) IncrementLookupCount() {
-	f.lc.Inc()
+func (f *FileInode) TemporaryHold() bool {
+	return f.src.TemporaryHold
 }
 
+// Place or release a temporary hold on the source object in GCS. Fail with
+// syscall.EBUSY if there are local modifications, which would otherwise be
+// refused by GCS once held, and otherwise as for SetCustomTime.
+//
 // LOCKS_REQUIRED(f.mu)
-func (f *FileInode) DecrementLookupCount(n uint64) (destroy bool) {
-	destroy = f.lc.Dec(n)
+func (f *FileInode) SetTemporaryHold(
+	ctx context.Context,
+	hold bool) (err error) {
+	if f.Dirty() {
+		err = syscall.EBUSY
+		return
+	}
+
+	err = f.updateSource(ctx, &gcs.UpdateObjectRequest{TemporaryHold: &hold})
+	return
+}
+
+// Replace the source object in GCS with the concatenation of the named
+// objects, which may include the source object itself, without reading any of
+// them, giving it the supplied mtime. Fail with syscall.EBUSY if there are
+// local modifications, with *gcs.NotFoundError if a source object doesn't
+// exist, and with *gcs.PreconditionError if the source object has been
+// changed since it was read.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Compose(
+	ctx context.Context,
+	srcNames []string,
+	mtime time.Time) (err error) {
+	if f.Dirty() {
+		err = syscall.EBUSY
+		return
+	}
+
+	f.attrCache.Erase()
+
+	// Pin our own generation if it's among the sources, so that it can't
+	// change between the precondition being checked and being read.
+	var sources []gcs.ComposeSource
+	for _, name := range srcNames {
+		s := gcs.ComposeSource{Name: name}
+		if name == f.src.Name {
+			s.Generation = f.src.Generation
+		}
+
+		sources = append(sources, s)
+	}
+
+	req := &gcs.ComposeObjectsRequest{
+		DstName:                       f.src.Name,
+		DstGenerationPrecondition:     &f.src.Generation,
+		DstMetaGenerationPrecondition: &f.src.MetaGeneration,
+		Sources:                       sources,
+		ContentType:                   f.src.ContentType,
+		Metadata: map[string]string{
+			FileMtimeMetadataKey: mtime.UTC().Format(time.RFC3339Nano),
+		},
+		StorageClass: f.StorageClass(),
+		CustomTime:   f.src.CustomTime,
+	}
+
+	o, err := f.bucket.ComposeObjects(ctx, req)
+	switch err.(type) {
+	case nil:
+		f.src = *o
+		f.contentReplaced = true
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+
+	default:
+		err = fmt.Errorf("ComposeObjects: %v", err)
+	}
+
+	return
+}
+
+// Apply the supplied update to the source generation, on the condition that
+// its metadata hasn't changed, and adopt the result so that the change isn't
+// mistaken for the object having been clobbered.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) updateSource(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (err error) {
+	f.attrCache.Erase()
+
+	srcGen := f.SourceGeneration()
+	req.Name = f.src.Name
+	req.Generation = srcGen.Object
+	req.MetaGenerationPrecondition = &srcGen.Metadata
+
+	o, err := f.bucket.UpdateObject(ctx, req)
+	switch err.(type) {
+	case nil:
+		f.src = *o
+
+	case *gcs.NotFoundError, *gcs.PreconditionError:
+
+	default:
+		err = fmt.Errorf("UpdateObject: %v", err)
+	}
+
+	return
+}
+
+// Equivalent to the generation returned by f.Source().
+//
+// LOCKS_REQUIRED(f)
+func (f *FileInode) SourceGeneration() (g Generation) {
+	g.Object = f.src.Generation
+	g.Metadata = f.src.MetaGeneration
 	return
 }
 
@@ -273,11 +730,51 @@ func (f *FileInode) Destroy() (err error) {
 		f.content.Destroy()
 	}
 
+	if f.stream != nil {
+		f.stream.Abort()
+		f.stream = nil
+	}
+
 	return
 }
 
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Attributes(
+	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
+	now := f.cacheClock.Now()
+
+	// Can we use the cached attributes?
+	if cached, ok := f.attrCache.LookUp(now); ok {
+		attrs = cached
+		return
+	}
+
+	attrs, err = f.computeAttributes(ctx)
+	if err != nil {
+		return
+	}
+
+	f.attrCache.Insert(now, attrs)
+	return
+}
+
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) AttributesExpiration() time.Time {
+	return f.attrCache.Expiration()
+}
+
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) InvalidateCaches() {
+	f.attrCache.Erase()
+}
+
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) SetCacheTTLs(attributes time.Duration, types time.Duration) {
+	f.attrCache.SetTTL(attributes)
+}
+
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) computeAttributes(
 	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
 	attrs = f.attrs
 
@@ -289,6 +786,12 @@ func (f *FileInode) Attributes(
 	attrs.Atime = attrs.Mtime
 	attrs.Ctime = attrs.Mtime
 
+	// A custom time set on the object, commonly the time it was last used for
+	// lifecycle rules to act on, stands in for the atime.
+	if !f.src.CustomTime.IsZero() {
+		attrs.Atime = f.src.CustomTime
+	}
+
 	// If the source object has an mtime metadata key, use that instead of its
 	// update time.
 	if formatted, ok := f.src.Metadata["gcsfuse_mtime"]; ok {
@@ -299,6 +802,12 @@ func (f *FileInode) Attributes(
 		}
 	}
 
+	// Likewise if we're streaming new content.
+	if f.stream != nil {
+		attrs.Size = uint64(f.stream.Offset())
+		attrs.Mtime = f.streamMtime
+	}
+
 	// If we've got local content, its size and (maybe) mtime take precedence.
 	if f.content != nil {
 		var sr gcsx.StatResult
@@ -339,6 +848,12 @@ func (f *FileInode) Read(
 	ctx context.Context,
 	dst []byte,
 	offset int64) (n int, err error) {
+	// What has been streamed to GCS can't be read back until it's finished.
+	if f.stream != nil {
+		err = syscall.ENOTSUP
+		return
+	}
+
 	// Make sure f.content != nil.
 	err = f.ensureContent(ctx)
 	if err != nil {
@@ -346,6 +861,13 @@ func (f *FileInode) Read(
 		return
 	}
 
+	// Fetch what we are about to read, if it hasn't been.
+	err = f.content.Fetch(ctx, offset)
+	if err != nil {
+		err = fmt.Errorf("content.Fetch: %v", err)
+		return
+	}
+
 	// Read from the local content, propagating io.EOF.
 	n, err = f.content.ReadAt(dst, offset)
 	switch {
@@ -367,10 +889,84 @@ func (f *FileInode) Write(
 	ctx context.Context,
 	data []byte,
 	offset int64) (err error) {
+	f.attrCache.Erase()
+
+	// In streaming mode, a write at the start of an empty file begins streaming
+	// to GCS, as long as nothing has been staged. Writes while streaming must
+	// continue where the last left off; anything else fails with ENOTSUP.
+	if f.stream == nil &&
+		f.streamWrites &&
+		f.content == nil &&
+		f.src.Size == 0 &&
+		offset == 0 {
+		err = f.startStream(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	if f.stream != nil {
+		if offset != f.stream.Offset() {
+			err = syscall.ENOTSUP
+			return
+		}
+
+		err = f.stream.Write(data)
+		if err != nil {
+			err = fmt.Errorf("stream.Write: %v", err)
+			return
+		}
+
+		f.streamMtime = f.mtimeClock.Now()
+		return
+	}
+
+	// Appending to an object, as a log shipper does, needn't download it: the
+	// syncer composes what was appended onto the existing object, and the
+	// existing contents are fetched only if something else turns out to need
+	// them. A staging area must be able to resume from what it holds, so it
+	// gets everything up front.
+	appending := f.content == nil &&
+		f.staging == nil &&
+		f.src.Size > 0 &&
+		offset >= int64(f.src.Size)
+
+	// Make sure there's room, returning ENOSPC as is if not.
+	limit := int64(f.src.Size)
+	if appending {
+		limit = 0
+	}
+
+	err = f.checkSpace(int64(len(data)), limit)
+	if err != nil {
+		return
+	}
+
+	// Make sure no other mount is writing, returning EBUSY as is if one is.
+	err = f.acquireLease(ctx)
+	if err != nil {
+		return
+	}
+
 	// Make sure f.content != nil.
-	err = f.ensureContent(ctx)
+	if appending {
+		err = f.startAppend()
+		if err != nil {
+			err = fmt.Errorf("startAppend: %v", err)
+			return
+		}
+	} else {
+		err = f.ensureContent(ctx)
+		if err != nil {
+			err = fmt.Errorf("ensureContent: %v", err)
+			return
+		}
+	}
+
+	// Fetch what we are about to write into, if it hasn't been.
+	err = f.content.Fetch(ctx, offset)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		err = fmt.Errorf("content.Fetch: %v", err)
 		return
 	}
 
@@ -387,6 +983,8 @@ func (f *FileInode) Write(
 func (f *FileInode) SetMtime(
 	ctx context.Context,
 	mtime time.Time) (err error) {
+	f.attrCache.Erase()
+
 	// If we have a local temp file, stat it.
 	var sr gcsx.StatResult
 	if f.content != nil {
@@ -408,6 +1006,12 @@ func (f *FileInode) SetMtime(
 		return
 	}
 
+	// Likewise if we're streaming. The mtime isn't recorded in GCS.
+	if f.stream != nil {
+		f.streamMtime = mtime
+		return
+	}
+
 	// Otherwise, update the backing object's metadata.
 	formatted := mtime.UTC().Format(time.RFC3339Nano)
 	srcGen := f.SourceGeneration()
@@ -455,13 +1059,22 @@ func (f *FileInode) SetMtime(
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Sync(ctx context.Context) (err error) {
+	// If we're streaming, finish. There's no continuing afterward.
+	if f.stream != nil {
+		f.attrCache.Erase()
+		err = f.finishStream()
+		return
+	}
+
 	// If we have not been dirtied, there is nothing to do.
 	if f.content == nil {
 		return
 	}
 
+	f.attrCache.Erase()
+
 	// Write out the contents if they are dirty.
-	newObj, err := f.syncer.SyncObject(ctx, &f.src, f.content)
+	newObj, err := f.syncer.SyncObject(ctx, &f.src, f.storageClass, f.content)
 
 	// Special case: a precondition error means we were clobbered, which we treat
 	// as being unlinked. There's no reason to return an error in that case.
@@ -469,6 +1082,26 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 		err = nil
 	}
 
+	// Special case: if GCS is unreachable, the staging area may queue the write
+	// to be made later. The content stays dirty, so that a later sync that
+	// succeeds supersedes the queued write.
+	if _, ok := err.(*gcsx.UnreachableError); ok &&
+		f.staging != nil && f.staging.QueuesOfflineWrites() {
+		err = f.staging.Queue(
+			f.content,
+			gcsx.StagedWrite{
+				Bucket:     f.bucket.Name(),
+				Object:     f.src.Name,
+				Generation: f.src.Generation,
+			})
+
+		if err != nil {
+			err = fmt.Errorf("Queue: %v", err)
+		}
+
+		return
+	}
+
 	// Propagate other errors.
 	if err != nil {
 		err = fmt.Errorf("SyncObject: %v", err)
@@ -478,22 +1111,125 @@ func (f *FileInode) Sync(ctx context.Context) (err error) {
 	// If we wrote out a new object, we need to update our state.
 	if newObj != nil {
 		f.src = *newObj
+		f.content.Destroy()
 		f.content = nil
+
+		// The new generation doesn't carry our lease.
+		f.leaseExpiry = time.Time{}
+
+		if f.staging != nil {
+			f.staging.Dequeue(f.src.Name)
+		}
 	}
 
 	return
 }
 
+// If the inode is clean and its object has since been replaced or had its
+// metadata updated by another writer, adopt the newer generation so that
+// later reads and attributes reflect it. Return true if the source generation
+// changed. An object that has been deleted is left for Attributes to report
+// as unlinked.
+//
+// The caller must make sure that no other inode is known by the newer
+// generation.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) Refresh(ctx context.Context) (refreshed bool, err error) {
+	// Local modifications take precedence; Sync will notice the clobbering.
+	if f.content != nil || f.stream != nil {
+		return
+	}
+
+	req := &gcs.StatObjectRequest{Name: f.name}
+	o, err := f.bucket.StatObject(ctx, req)
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	oGen := Generation{o.Generation, o.MetaGeneration}
+	if oGen.Compare(f.SourceGeneration()) <= 0 {
+		return
+	}
+
+	if o.Generation != f.src.Generation {
+		f.contentReplaced = true
+	}
+
+	f.src = *o
+	f.attrCache.Erase()
+	refreshed = true
+
+	return
+}
+
+// Return true if Refresh has adopted a generation with different contents
+// since the last call, in which case any contents the kernel has cached for
+// the inode are stale.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *FileInode) TakeContentReplaced() (replaced bool) {
+	replaced = f.contentReplaced
+	f.contentReplaced = false
+	return
+}
+
 // Truncate the file to the specified size.
 //
 // LOCKS_REQUIRED(f.mu)
 func (f *FileInode) Truncate(
 	ctx context.Context,
 	size int64) (err error) {
-	// Make sure f.content != nil.
-	err = f.ensureContent(ctx)
+	f.attrCache.Erase()
+
+	// While streaming, only the current size will do.
+	if f.stream != nil {
+		if size != f.stream.Offset() {
+			err = syscall.ENOTSUP
+		}
+
+		return
+	}
+
+	// In streaming mode, truncating to empty (as when opening with O_TRUNC)
+	// begins streaming the new contents.
+	if f.streamWrites && f.content == nil && size == 0 {
+		err = f.startStream(ctx)
+		return
+	}
+
+	// Make sure there's room for what we must fetch, returning ENOSPC as is if
+	// not. Growing the content makes it sparse, which takes no space.
+	err = f.checkSpace(0, size)
 	if err != nil {
-		err = fmt.Errorf("ensureContent: %v", err)
+		return
+	}
+
+	// Make sure no other mount is writing, returning EBUSY as is if one is.
+	err = f.acquireLease(ctx)
+	if err != nil {
+		return
+	}
+
+	// Make sure f.content != nil, fetching only what survives the truncation.
+	// In particular opening with O_TRUNC downloads nothing.
+	err = f.ensureContentPrefix(ctx, size)
+	if err != nil {
+		err = fmt.Errorf("ensureContentPrefix: %v", err)
+		return
+	}
+
+	// Fetch what survives the truncation, if it hasn't been.
+	err = f.content.Fetch(ctx, size)
+	if err != nil {
+		err = fmt.Errorf("content.Fetch: %v", err)
 		return
 	}
 
@@ -15,9 +15,12 @@
 package inode_test
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"syscall"
 	"testing"
 	"time"
 
@@ -29,6 +32,7 @@ import (
 	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/gcloud/gcs/gcsfake"
 	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
 	. "github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 )
@@ -54,6 +58,12 @@ type FileTest struct {
 	initialContents string
 	backingObj      *gcs.Object
 
+	// Passed to the inode by createInode. Zero by default.
+	attrCacheTTL time.Duration
+	space        *gcsx.SpaceChecker
+	lease        *inode.LeaseConfig
+	streamWrites bool
+
 	in *inode.FileInode
 }
 
@@ -87,6 +97,20 @@ func (t *FileTest) TearDown() {
 	t.in.Unlock()
 }
 
+// A bucket that records the read requests made through it.
+type readRecordingBucket struct {
+	gcs.Bucket
+	reqs []*gcs.ReadObjectRequest
+}
+
+func (b *readRecordingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.reqs = append(b.reqs, req)
+	rc, err = b.Bucket.NewReader(ctx, req)
+	return
+}
+
 func (t *FileTest) createInode() {
 	if t.in != nil {
 		t.in.Unlock()
@@ -104,8 +128,17 @@ func (t *FileTest) createInode() {
 		gcsx.NewSyncer(
 			1, // Append threshold
 			".gcsfuse_tmp/",
-			t.bucket),
+			t.bucket,
+			nil),
 		"",
+		0,
+		nil,
+		nil,
+		t.space,
+		t.lease,
+		t.streamWrites,
+		t.attrCacheTTL,
+		&t.clock,
 		&t.clock)
 
 	t.in.Lock()
@@ -161,6 +194,76 @@ func (t *FileTest) InitialAttributes_MtimeFromObjectMetadata() {
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
 }
 
+func (t *FileTest) Attributes_NotCachedByDefault() {
+	_, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectTrue(t.in.AttributesExpiration().IsZero())
+}
+
+func (t *FileTest) Attributes_Cached() {
+	const ttl = time.Minute
+	t.attrCacheTTL = ttl
+	t.createInode()
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, attrs.Nlink)
+	ExpectThat(
+		t.in.AttributesExpiration(),
+		timeutil.TimeEq(t.clock.Now().Add(ttl)))
+
+	// Delete the backing object. Until the cached attributes expire, the inode
+	// doesn't notice.
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(ttl)
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, attrs.Nlink)
+
+	// After that, it does.
+	t.clock.AdvanceTime(time.Millisecond)
+	attrs, err = t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, attrs.Nlink)
+}
+
+func (t *FileTest) Attributes_CacheErasedByWrite() {
+	t.attrCacheTTL = time.Minute
+	t.createInode()
+
+	_, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	// Extend the file. The new size should be visible right away.
+	err = t.in.Write(t.ctx, []byte("burrito"), int64(len(t.initialContents)))
+	AssertEq(nil, err)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len(t.initialContents)+len("burrito"), attrs.Size)
+}
+
+func (t *FileTest) Attributes_CacheErasedByTruncate() {
+	t.attrCacheTTL = time.Minute
+	t.createInode()
+
+	_, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+
+	err = t.in.Truncate(t.ctx, 1)
+	AssertEq(nil, err)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(1, attrs.Size)
+}
+
 func (t *FileTest) Read() {
 	AssertEq("taco", t.initialContents)
 
@@ -460,6 +563,159 @@ func (t *FileTest) TruncateUpwardThenSync() {
 	ExpectThat(attrs.Mtime, timeutil.TimeEq(truncateTime.UTC()))
 }
 
+func (t *FileTest) NoSpace() {
+	t.space = gcsx.NewSpaceChecker("", 1<<62)
+	t.createInode()
+
+	// Writing fails without fetching the contents.
+	ExpectEq(syscall.ENOSPC, t.in.Write(t.ctx, []byte("burrito"), 0))
+	ExpectEq(syscall.ENOSPC, t.in.Truncate(t.ctx, 2))
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+
+	// Truncating to zero stages nothing, so is allowed.
+	ExpectEq(nil, t.in.Truncate(t.ctx, 0))
+}
+
+func (t *FileTest) TruncateToZero_ReadsNothing() {
+	recorder := &readRecordingBucket{Bucket: t.bucket}
+	t.bucket = recorder
+	t.createInode()
+
+	// Truncating to zero, as opening with O_TRUNC does, needn't download the
+	// object.
+	err := t.in.Truncate(t.ctx, 0)
+	AssertEq(nil, err)
+	ExpectEq(0, len(recorder.reqs))
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
+}
+
+func (t *FileTest) TruncateDownward_ReadsOnlyPrefix() {
+	recorder := &readRecordingBucket{Bucket: t.bucket}
+	t.bucket = recorder
+	t.createInode()
+
+	err := t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	AssertEq(1, len(recorder.reqs))
+	ExpectThat(
+		recorder.reqs[0].Range,
+		Pointee(DeepEquals(gcs.ByteRange{Start: 0, Limit: 2})))
+
+	// Further operations use the local content.
+	var buf [1024]byte
+	n, err := t.in.Read(t.ctx, buf[:], 0)
+	if err == io.EOF {
+		err = nil
+	}
+
+	AssertEq(nil, err)
+	ExpectEq("ta", string(buf[:n]))
+	ExpectEq(1, len(recorder.reqs))
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("ta", string(contents))
+}
+
+func (t *FileTest) Append_ReadsNothing() {
+	recorder := &readRecordingBucket{Bucket: t.bucket}
+	t.bucket = recorder
+	t.createInode()
+
+	// Appending, as with O_APPEND, needn't download the object.
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), attrs.Size)
+
+	// Nor does syncing, which composes.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, len(recorder.reqs))
+
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+	ExpectEq(2, o.ComponentCount)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+}
+
+func (t *FileTest) Append_ThenReadPrefix() {
+	recorder := &readRecordingBucket{Bucket: t.bucket}
+	t.bucket = recorder
+	t.createInode()
+
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	// Reading what came before fetches it, once.
+	for i := 0; i < 2; i++ {
+		var buf [1024]byte
+		n, err := t.in.Read(t.ctx, buf[:], 0)
+		if err == io.EOF {
+			err = nil
+		}
+
+		AssertEq(nil, err)
+		ExpectEq("tacoburrito", string(buf[:n]))
+	}
+
+	ExpectEq(1, len(recorder.reqs))
+}
+
+func (t *FileTest) Append_ThenOverwritePrefix() {
+	err := t.in.Write(t.ctx, []byte("burrito"), int64(len("taco")))
+	AssertEq(nil, err)
+
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("pacoburrito", string(contents))
+}
+
+func (t *FileTest) WritePastEndThenSync() {
+	var err error
+
+	AssertEq("taco", t.initialContents)
+
+	// Write well past the end of the file, leaving a hole.
+	err = t.in.Write(t.ctx, []byte("burrito"), 8)
+	AssertEq(nil, err)
+
+	// Sync.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	// The hole should have been written out as zeros.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, t.in.Name())
+	AssertEq(nil, err)
+	ExpectEq("taco\x00\x00\x00\x00burrito", string(contents))
+}
+
 func (t *FileTest) Sync_Clobbered() {
 	var err error
 
@@ -492,6 +748,120 @@ func (t *FileTest) Sync_Clobbered() {
 	ExpectEq(newObj.Size, o.Size)
 }
 
+func (t *FileTest) Refresh_Unchanged() {
+	refreshed, err := t.in.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectFalse(refreshed)
+	ExpectFalse(t.in.TakeContentReplaced())
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *FileTest) Refresh_ObjectReplaced() {
+	// Replace the backing object.
+	newObj, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	// Refresh. The inode should adopt the new generation.
+	refreshed, err := t.in.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectTrue(refreshed)
+	ExpectEq(newObj.Generation, t.in.SourceGeneration().Object)
+	ExpectEq(newObj.MetaGeneration, t.in.SourceGeneration().Metadata)
+
+	ExpectTrue(t.in.TakeContentReplaced())
+	ExpectFalse(t.in.TakeContentReplaced())
+
+	// Attributes and reads should reflect the new contents.
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("burrito"), attrs.Size)
+	ExpectEq(1, attrs.Nlink)
+
+	buf := make([]byte, 1024)
+	n, err := t.in.Read(t.ctx, buf, 0)
+
+	// Ignore EOF.
+	if err == io.EOF {
+		err = nil
+	}
+
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(buf[:n]))
+}
+
+func (t *FileTest) Refresh_MetadataUpdated() {
+	// Update the backing object's metadata.
+	mtime := time.Date(2001, 2, 3, 4, 5, 0, 0, time.UTC)
+	formatted := mtime.Format(time.RFC3339Nano)
+
+	_, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name: t.in.Name(),
+			Metadata: map[string]*string{
+				inode.FileMtimeMetadataKey: &formatted,
+			},
+		})
+
+	AssertEq(nil, err)
+
+	// Refresh. The contents are unchanged, but the mtime should be picked up.
+	refreshed, err := t.in.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectTrue(refreshed)
+	ExpectFalse(t.in.TakeContentReplaced())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(mtime))
+}
+
+func (t *FileTest) Refresh_Dirty() {
+	// Dirty the inode.
+	err := t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+
+	// Replace the backing object. Refreshing should leave the local
+	// modifications alone.
+	_, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		t.in.Name(),
+		[]byte("burrito"))
+
+	AssertEq(nil, err)
+
+	refreshed, err := t.in.Refresh(t.ctx)
+	AssertEq(nil, err)
+
+	ExpectFalse(refreshed)
+	ExpectEq(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *FileTest) Refresh_ObjectDeleted() {
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: t.in.Name()})
+
+	AssertEq(nil, err)
+
+	refreshed, err := t.in.Refresh(t.ctx)
+	AssertEq(nil, err)
+	ExpectFalse(refreshed)
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(0, attrs.Nlink)
+}
+
 func (t *FileTest) SetMtime_ContentNotFaultedIn() {
 	var err error
 	var attrs fuseops.InodeAttributes
@@ -635,3 +1005,261 @@ func (t *FileTest) SetMtime_SourceObjectMetaGenerationChanged() {
 	ExpectEq(newObj.Generation, o.Generation)
 	ExpectEq(newObj.MetaGeneration, o.MetaGeneration)
 }
+
+func (t *FileTest) setUpLeases() {
+	t.lease = &inode.LeaseConfig{
+		Owner: "me",
+		TTL:   time.Minute,
+	}
+
+	t.createInode()
+}
+
+// Return the lease recorded on the backing object, or the empty string.
+func (t *FileTest) leaseMetadata() string {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: fileInodeName})
+
+	AssertEq(nil, err)
+	return o.Metadata[inode.LeaseMetadataKey]
+}
+
+// Record a lease on the backing object as another mount would.
+func (t *FileTest) setOtherLease(expiry time.Time) {
+	value := "someone_else " + expiry.UTC().Format(time.RFC3339Nano)
+	_, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     fileInodeName,
+			Metadata: map[string]*string{inode.LeaseMetadataKey: &value},
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *FileTest) Lease_WriteTakesLease() {
+	t.setUpLeases()
+
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+
+	expiry := t.clock.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)
+	ExpectEq("me "+expiry, t.leaseMetadata())
+
+	// The inode follows the metadata change, so still syncs.
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, fileInodeName)
+	AssertEq(nil, err)
+	ExpectEq("paco", string(contents))
+}
+
+func (t *FileTest) Lease_SyncReleasesLease() {
+	t.setUpLeases()
+
+	err := t.in.Truncate(t.ctx, 2)
+	AssertEq(nil, err)
+	AssertNe("", t.leaseMetadata())
+
+	err = t.in.Sync(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq("", t.leaseMetadata())
+
+	// Writing again takes a new lease.
+	err = t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	ExpectNe("", t.leaseMetadata())
+}
+
+func (t *FileTest) Lease_RenewedAfterHalfTTL() {
+	t.setUpLeases()
+
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	first := t.leaseMetadata()
+
+	// Not renewed early on.
+	t.clock.AdvanceTime(10 * time.Second)
+	err = t.in.Write(t.ctx, []byte("a"), 1)
+	AssertEq(nil, err)
+	ExpectEq(first, t.leaseMetadata())
+
+	// But renewed once it's half gone.
+	t.clock.AdvanceTime(25 * time.Second)
+	err = t.in.Write(t.ctx, []byte("c"), 2)
+	AssertEq(nil, err)
+
+	expiry := t.clock.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)
+	ExpectEq("me "+expiry, t.leaseMetadata())
+}
+
+func (t *FileTest) Lease_HeldElsewhere() {
+	t.setUpLeases()
+	t.setOtherLease(t.clock.Now().Add(time.Minute))
+
+	ExpectEq(syscall.EBUSY, t.in.Write(t.ctx, []byte("p"), 0))
+	ExpectEq(syscall.EBUSY, t.in.Truncate(t.ctx, 0))
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+}
+
+func (t *FileTest) Lease_ExpiredElsewhere() {
+	t.setUpLeases()
+	t.setOtherLease(t.clock.Now().Add(-time.Second))
+
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	ExpectThat(t.leaseMetadata(), HasSubstr("me "))
+}
+
+func (t *FileTest) Lease_Disabled() {
+	t.setOtherLease(t.clock.Now().Add(time.Minute))
+	t.createInode()
+
+	err := t.in.Write(t.ctx, []byte("p"), 0)
+	AssertEq(nil, err)
+	ExpectThat(t.leaseMetadata(), HasSubstr("someone_else "))
+}
+
+// A bucket that reads the contents of objects to be created before calling
+// through, so that the fake bucket's lock isn't held while a test is still
+// supplying them.
+type bufferingBucket struct {
+	gcs.Bucket
+}
+
+func (b *bufferingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		return
+	}
+
+	reqCopy := *req
+	reqCopy.Contents = bytes.NewReader(contents)
+
+	o, err = b.Bucket.CreateObject(ctx, &reqCopy)
+	return
+}
+
+// Replace the backing object with one with the given contents, and recreate
+// the inode in streaming mode.
+func (t *FileTest) setUpStreaming(contents string) {
+	var err error
+	t.bucket = &bufferingBucket{t.bucket}
+	t.backingObj, err = gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		fileInodeName,
+		[]byte(contents))
+
+	AssertEq(nil, err)
+
+	t.streamWrites = true
+	t.createInode()
+}
+
+func (t *FileTest) readBackingObject() string {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, fileInodeName)
+	AssertEq(nil, err)
+	return string(contents)
+}
+
+func (t *FileTest) Stream_WriteThenSync() {
+	t.setUpStreaming("")
+
+	AssertEq(nil, t.in.Write(t.ctx, []byte("taco"), 0))
+	AssertEq(nil, t.in.Write(t.ctx, []byte("burrito"), 4))
+
+	// Nothing is staged, and the object is unchanged until we sync.
+	ExpectFalse(t.in.SourceGenerationIsAuthoritative())
+	ExpectTrue(t.in.Dirty())
+	ExpectEq("", t.readBackingObject())
+
+	attrs, err := t.in.Attributes(t.ctx)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), attrs.Size)
+	ExpectThat(attrs.Mtime, timeutil.TimeEq(t.clock.Now()))
+
+	// Reads aren't possible in the meantime.
+	_, err = t.in.Read(t.ctx, make([]byte, 4), 0)
+	ExpectEq(syscall.ENOTSUP, err)
+
+	// Sync.
+	AssertEq(nil, t.in.Sync(t.ctx))
+
+	ExpectEq("tacoburrito", t.readBackingObject())
+	ExpectTrue(t.in.SourceGenerationIsAuthoritative())
+	ExpectFalse(t.in.Dirty())
+	ExpectLt(t.backingObj.Generation, t.in.SourceGeneration().Object)
+}
+
+func (t *FileTest) Stream_OutOfOrder() {
+	t.setUpStreaming("")
+
+	AssertEq(nil, t.in.Write(t.ctx, []byte("taco"), 0))
+
+	ExpectEq(syscall.ENOTSUP, t.in.Write(t.ctx, []byte("p"), 0))
+	ExpectEq(syscall.ENOTSUP, t.in.Write(t.ctx, []byte("p"), 5))
+	ExpectEq(syscall.ENOTSUP, t.in.Truncate(t.ctx, 2))
+	ExpectEq(nil, t.in.Truncate(t.ctx, 4))
+
+	AssertEq(nil, t.in.Sync(t.ctx))
+	ExpectEq("taco", t.readBackingObject())
+}
+
+func (t *FileTest) Stream_TruncateToEmpty() {
+	t.setUpStreaming("taco")
+
+	// As with O_TRUNC.
+	AssertEq(nil, t.in.Truncate(t.ctx, 0))
+	AssertEq(nil, t.in.Write(t.ctx, []byte("burrito"), 0))
+
+	AssertEq(nil, t.in.Sync(t.ctx))
+	ExpectEq("burrito", t.readBackingObject())
+}
+
+func (t *FileTest) Stream_ModifyingExistingContentsStages() {
+	t.setUpStreaming("taco")
+
+	AssertEq(nil, t.in.Write(t.ctx, []byte("burrito"), 4))
+
+	buf := make([]byte, 11)
+	n, err := t.in.Read(t.ctx, buf, 0)
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(buf[:n]))
+
+	AssertEq(nil, t.in.Sync(t.ctx))
+	ExpectEq("tacoburrito", t.readBackingObject())
+}
+
+func (t *FileTest) Stream_Clobbered() {
+	t.setUpStreaming("")
+
+	AssertEq(nil, t.in.Write(t.ctx, []byte("taco"), 0))
+
+	_, err := gcsutil.CreateObject(
+		t.ctx,
+		t.bucket,
+		fileInodeName,
+		[]byte("enchilada"))
+
+	AssertEq(nil, err)
+
+	// As with staged content, this is treated as an unlink.
+	AssertEq(nil, t.in.Sync(t.ctx))
+	ExpectEq("enchilada", t.readBackingObject())
+}
+
+func (t *FileTest) Stream_Destroy() {
+	t.setUpStreaming("")
+
+	AssertEq(nil, t.in.Write(t.ctx, []byte("taco"), 0))
+	AssertEq(nil, t.in.Destroy())
+
+	// Give the abandoned upload a chance to do any damage.
+	time.Sleep(10 * time.Millisecond)
+	ExpectEq("", t.readBackingObject())
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+)
+
+// An inode representing a directory with no placeholder object, which exists
+// because other objects have its name as a prefix. The root directory is also
+// of this kind.
+type ImplicitDirInode interface {
+	DirInode
+
+	// Distinguishes implicit directories from explicit ones, which are
+	// otherwise interchangeable as DirInodes.
+	implicitDir()
+}
+
+// Create an implicit dir inode for the supplied name. The times in attrs are
+// used as is, since there is no object to take them from. See notes on
+// NewDirInode for more.
+//
+// REQUIRES: IsDirName(name)
+func NewImplicitDirInode(
+	id fuseops.InodeID,
+	name string,
+	attrs fuseops.InodeAttributes,
+	implicitDirs bool,
+	normalizeName func(string) string,
+	caseInsensitive bool,
+	filter *NameFilter,
+	hideDeniedDirs bool,
+	flat bool,
+	typeCacheTTL time.Duration,
+	attrCacheTTL time.Duration,
+	listingCacheTTL time.Duration,
+	bucket gcs.Bucket,
+	folders storage.Folders,
+	mtimeClock timeutil.Clock,
+	cacheClock timeutil.Clock) (d ImplicitDirInode) {
+	wrapped := NewDirInode(
+		id,
+		name,
+		attrs,
+		implicitDirs,
+		normalizeName,
+		caseInsensitive,
+		filter,
+		hideDeniedDirs,
+		flat,
+		typeCacheTTL,
+		attrCacheTTL,
+		listingCacheTTL,
+		bucket,
+		folders,
+		mtimeClock,
+		cacheClock)
+
+	d = &implicitDirInode{
+		dirInode: wrapped.(*dirInode),
+	}
+
+	return
+}
+
+type implicitDirInode struct {
+	*dirInode
+}
+
+func (d *implicitDirInode) implicitDir() {}
@@ -16,6 +16,7 @@ package inode
 
 import (
 	"sync"
+	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"golang.org/x/net/context"
@@ -40,9 +41,16 @@ type Inode interface {
 	// the kernel expects us to remember the inode.
 	IncrementLookupCount()
 
-	// Return up to date attributes for this inode.
+	// Return attributes for this inode. These may have been cached when
+	// previously returned, if they haven't yet expired; see
+	// AttributesExpiration.
 	Attributes(ctx context.Context) (fuseops.InodeAttributes, error)
 
+	// Return the time, according to the inode's cache clock, at which the
+	// attributes cached by Attributes expire, or the zero time if none are
+	// cached.
+	AttributesExpiration() time.Time
+
 	// Decrement the lookup count for the inode by the given amount.
 	//
 	// If this method returns true, the lookup count has hit zero and the
@@ -65,6 +73,36 @@ type GenerationBackedInode interface {
 	SourceGeneration() Generation
 }
 
+// A generation-backed inode that can adopt a newer generation of its object
+// written by someone else, while keeping its ID.
+type RefreshableInode interface {
+	GenerationBackedInode
+
+	// Adopt the latest generation of the object if it's newer than the source
+	// generation and the inode can represent it, returning true if so.
+	//
+	// Requires the inode lock.
+	Refresh(ctx context.Context) (refreshed bool, err error)
+}
+
+// An inode that caches what it has learned from GCS, such as its attributes,
+// until a TTL expires.
+type CachingInode interface {
+	Inode
+
+	// Discard everything cached, so that it is fetched from GCS afresh when
+	// next needed.
+	//
+	// Requires the inode lock.
+	InvalidateCaches()
+
+	// Change how long attributes, and for directories the types of children,
+	// are cached from now on. Whatever is already cached keeps its expiration.
+	//
+	// Requires the inode lock.
+	SetCacheTTLs(attributes time.Duration, types time.Duration)
+}
+
 // A particular generation of a GCS object, consisting of both a GCS object
 // generation number and meta-generation number. Lexicographically ordered on
 // the two.
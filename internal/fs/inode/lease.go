@@ -0,0 +1,62 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// While a mount that takes write leases has local modifications to a file,
+// the file's object carries a custom metadata field with this key, naming the
+// mount and the time at which the lease expires unless renewed. Writing out
+// the modifications creates a new generation without it, releasing the lease.
+const LeaseMetadataKey = "gcsfuse_lease"
+
+// Settings for cooperative write leases, which let mounts that all use them
+// refuse with EBUSY to modify a file that another is modifying, rather than
+// one silently discarding the other's changes.
+type LeaseConfig struct {
+	// Identifies this mount in the leases it takes. Must not contain spaces.
+	Owner string
+
+	// How long a lease lasts. Leases are renewed while the file continues to be
+	// written, and expire if the mount goes away without writing out its
+	// modifications.
+	TTL time.Duration
+}
+
+func formatLease(owner string, expiry time.Time) string {
+	return fmt.Sprintf("%s %s", owner, expiry.UTC().Format(time.RFC3339Nano))
+}
+
+// Parse a value formatted by formatLease, returning ok == false if it is
+// malformed.
+func parseLease(v string) (owner string, expiry time.Time, ok bool) {
+	i := strings.LastIndex(v, " ")
+	if i < 0 {
+		return
+	}
+
+	expiry, err := time.Parse(time.RFC3339Nano, v[i+1:])
+	if err != nil {
+		return
+	}
+
+	owner = v[:i]
+	ok = true
+	return
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Decides which children of directories are visible in the file system, by
+// matching their names against globs with the syntax of path.Match. A pattern
+// ending in a slash matches only directories, with the slash removed.
+//
+// A child is hidden if it matches any ignore pattern. Otherwise if there are
+// include patterns, a file or symlink is hidden unless it matches one of them.
+// Include patterns don't apply to directories, so that the files within them
+// remain reachable.
+//
+// Safe for concurrent access.
+type NameFilter struct {
+	ignore  []string
+	include []string
+}
+
+// Create a filter with the supplied patterns, checking that they are well
+// formed.
+func NewNameFilter(ignore, include []string) (f *NameFilter, err error) {
+	for _, p := range append(append([]string{}, ignore...), include...) {
+		if _, err = path.Match(strings.TrimSuffix(p, "/"), ""); err != nil {
+			err = fmt.Errorf("Pattern %q: %v", p, err)
+			return
+		}
+	}
+
+	f = &NameFilter{
+		ignore:  ignore,
+		include: include,
+	}
+
+	return
+}
+
+// Is the child with the given name and type visible? A nil filter shows
+// everything.
+func (f *NameFilter) Visible(name string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+
+	if matchAny(f.ignore, name, isDir) {
+		return false
+	}
+
+	if len(f.include) == 0 || isDir {
+		return true
+	}
+
+	return matchAny(f.include, name, isDir)
+}
+
+// Return a filter that hides everything f does, and in addition children
+// matching the supplied ignore patterns, which must be well formed. f may be
+// nil.
+func (f *NameFilter) Ignoring(patterns ...string) *NameFilter {
+	g := &NameFilter{}
+	if f != nil {
+		*g = *f
+	}
+
+	g.ignore = append(append([]string{}, g.ignore...), patterns...)
+	return g
+}
+
+func matchAny(patterns []string, name string, isDir bool) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") {
+			if !isDir {
+				continue
+			}
+
+			p = strings.TrimSuffix(p, "/")
+		}
+
+		// Patterns are checked by NewNameFilter.
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -15,10 +15,12 @@
 package inode
 
 import (
-	"sync"
+	"fmt"
+	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
 	"golang.org/x/net/context"
 )
 
@@ -34,39 +36,57 @@ func IsSymlink(o *gcs.Object) bool {
 }
 
 type SymlinkInode struct {
+	BaseInode
+
 	/////////////////////////
-	// Constant data
+	// Dependencies
 	/////////////////////////
 
-	id               fuseops.InodeID
-	name             string
-	sourceGeneration Generation
-	attrs            fuseops.InodeAttributes
-	target           string
+	bucket     gcs.Bucket
+	cacheClock timeutil.Clock
 
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
-	mu sync.Mutex
+	// The generation of the object from which the target was taken, and the
+	// target itself. Updated by Refresh when the symlink is re-created.
+	//
+	// GUARDED_BY(mu)
+	sourceGeneration Generation
 
 	// GUARDED_BY(mu)
-	lc lookupCount
+	target string
+
+	// GUARDED_BY(mu)
+	attrs fuseops.InodeAttributes
+
+	// Lets the kernel cache the attributes for the same time as those of other
+	// inodes. Erased when Refresh picks up a new generation.
+	//
+	// GUARDED_BY(mu)
+	attrCache attrCache
 }
 
-var _ Inode = &SymlinkInode{}
+var _ RefreshableInode = &SymlinkInode{}
+var _ CachingInode = &SymlinkInode{}
 
-// Create a symlink inode for the supplied object record.
+// Create a symlink inode for the supplied object record, whose attributes are
+// cached for attrCacheTTL according to cacheClock. The bucket is used to
+// refresh the target.
 //
 // REQUIRES: IsSymlink(o)
 func NewSymlinkInode(
 	id fuseops.InodeID,
 	o *gcs.Object,
-	attrs fuseops.InodeAttributes) (s *SymlinkInode) {
+	attrs fuseops.InodeAttributes,
+	attrCacheTTL time.Duration,
+	bucket gcs.Bucket,
+	cacheClock timeutil.Clock) (s *SymlinkInode) {
 	// Create the inode.
 	s = &SymlinkInode{
-		id:   id,
-		name: o.Name,
+		bucket:     bucket,
+		cacheClock: cacheClock,
 		sourceGeneration: Generation{
 			Object:   o.Generation,
 			Metadata: o.MetaGeneration,
@@ -78,11 +98,11 @@ func NewSymlinkInode(
 			Mode:  attrs.Mode,
 			Mtime: o.Updated,
 		},
-		target: o.Metadata[SymlinkMetadataKey],
+		target:    o.Metadata[SymlinkMetadataKey],
+		attrCache: newAttrCache(attrCacheTTL),
 	}
 
-	// Set up lookup counting.
-	s.lc.Init(id)
+	s.Init(id, o.Name, nil)
 
 	return
 }
@@ -91,22 +111,6 @@ func NewSymlinkInode(
 // Public interface
 ////////////////////////////////////////////////////////////////////////
 
-func (s *SymlinkInode) Lock() {
-	s.mu.Lock()
-}
-
-func (s *SymlinkInode) Unlock() {
-	s.mu.Unlock()
-}
-
-func (s *SymlinkInode) ID() fuseops.InodeID {
-	return s.id
-}
-
-func (s *SymlinkInode) Name() string {
-	return s.name
-}
-
 // Return the object generation from which this inode was branched.
 //
 // LOCKS_REQUIRED(s)
@@ -114,31 +118,77 @@ func (s *SymlinkInode) SourceGeneration() Generation {
 	return s.sourceGeneration
 }
 
-// LOCKS_REQUIRED(s.mu)
-func (s *SymlinkInode) IncrementLookupCount() {
-	s.lc.Inc()
-}
-
-// LOCKS_REQUIRED(s.mu)
-func (s *SymlinkInode) DecrementLookupCount(n uint64) (destroy bool) {
-	destroy = s.lc.Dec(n)
-	return
-}
-
 // LOCKS_REQUIRED(s.mu)
 func (s *SymlinkInode) Destroy() (err error) {
 	// Nothing to do.
 	return
 }
 
+// LOCKS_REQUIRED(s.mu)
 func (s *SymlinkInode) Attributes(
 	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
 	attrs = s.attrs
+	s.attrCache.Insert(s.cacheClock.Now(), attrs)
 	return
 }
 
+// LOCKS_REQUIRED(s.mu)
+func (s *SymlinkInode) AttributesExpiration() time.Time {
+	return s.attrCache.Expiration()
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *SymlinkInode) InvalidateCaches() {
+	s.attrCache.Erase()
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *SymlinkInode) SetCacheTTLs(attributes time.Duration, types time.Duration) {
+	s.attrCache.SetTTL(attributes)
+}
+
 // Return the target of the symlink.
+//
+// LOCKS_REQUIRED(s.mu)
 func (s *SymlinkInode) Target() (target string) {
 	target = s.target
 	return
 }
+
+// If the symlink has since been re-created by another writer, either as a new
+// object or by updating the target in the existing object's metadata, adopt
+// the newer generation and its target. Return true if the source generation
+// changed. An object that has been deleted, or replaced by something other
+// than a symlink, is left alone; lookups will find the new object.
+//
+// The caller must make sure that no other inode is known by the newer
+// generation.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *SymlinkInode) Refresh(ctx context.Context) (refreshed bool, err error) {
+	req := &gcs.StatObjectRequest{Name: s.name}
+	o, err := s.bucket.StatObject(ctx, req)
+
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	oGen := Generation{o.Generation, o.MetaGeneration}
+	if oGen.Compare(s.sourceGeneration) <= 0 || !IsSymlink(o) {
+		return
+	}
+
+	s.sourceGeneration = oGen
+	s.target = o.Metadata[SymlinkMetadataKey]
+	s.attrs.Mtime = o.Updated
+	s.attrCache.Erase()
+	refreshed = true
+
+	return
+}
@@ -0,0 +1,376 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inode
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The name of the directory at the root of the file system within which the
+// soft-deleted objects of a bucket appear, at the paths they had when live.
+const TrashDirName = ".trash"
+
+// The names of trash inodes are those of the soft-deleted objects, or of their
+// prefixes for directories, following this.
+const trashPrefix = TrashDirName + "/"
+
+// Is the supplied name that of a trash inode?
+func IsTrashName(name string) bool {
+	return strings.HasPrefix(name, trashPrefix)
+}
+
+// Return the name of the soft-deleted object (or, for a directory, its prefix)
+// represented by the trash inode with the supplied name.
+//
+// REQUIRES: IsTrashName(name)
+func TrashObjectName(name string) string {
+	return strings.TrimPrefix(name, trashPrefix)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directories
+////////////////////////////////////////////////////////////////////////
+
+// A read-only directory whose children are the soft-deleted objects, and the
+// directories implied by their names, with a particular name prefix. It is
+// never backed by an object, so it is an implicit directory as far as the
+// file system is concerned. Attempts to modify it fail with EROFS.
+type TrashDirInode struct {
+	BaseInode
+
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	softDeleted storage.SoftDeleted
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	attrs fuseops.InodeAttributes
+}
+
+var _ ImplicitDirInode = &TrashDirInode{}
+
+// Create a trash directory inode for the supplied name, listing the
+// soft-deleted objects whose names begin with TrashObjectName(name).
+//
+// REQUIRES: IsTrashName(name)
+// REQUIRES: IsDirName(name)
+func NewTrashDirInode(
+	id fuseops.InodeID,
+	name string,
+	attrs fuseops.InodeAttributes,
+	softDeleted storage.SoftDeleted) (d *TrashDirInode) {
+	if !IsTrashName(name) || !IsDirName(name) {
+		panic(fmt.Sprintf("Unexpected name: %s", name))
+	}
+
+	d = &TrashDirInode{
+		softDeleted: softDeleted,
+		attrs:       attrs,
+	}
+
+	d.attrs.Nlink = 1
+	d.Init(id, name, nil)
+
+	return
+}
+
+func (d *TrashDirInode) implicitDir() {}
+
+// The object name prefix of the directory's children.
+func (d *TrashDirInode) prefix() string {
+	return TrashObjectName(d.Name())
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) Destroy() (err error) {
+	// Nothing to do.
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) Attributes(
+	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
+	attrs = d.attrs
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) AttributesExpiration() time.Time {
+	return time.Time{}
+}
+
+// Look up the child with the supplied name. A directory is preferred over the
+// newest soft-deleted generation of an object with the same name, and is
+// returned with ImplicitDir set.
+//
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) LookUpChild(
+	ctx context.Context,
+	name string) (result LookUpResult, err error) {
+	objName := d.prefix() + nameToComponent(name)
+	req := &gcs.ListObjectsRequest{
+		Prefix:    objName,
+		Delimiter: "/",
+	}
+
+	var newest *gcs.Object
+	for {
+		var listing *gcs.Listing
+		listing, err = d.softDeleted.ListSoftDeleted(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListSoftDeleted: %v", err)
+			return
+		}
+
+		for _, p := range listing.CollapsedRuns {
+			if p == objName+"/" {
+				result.FullName = trashPrefix + p
+				result.ImplicitDir = true
+				return
+			}
+		}
+
+		for _, o := range listing.Objects {
+			if o.Name == objName && (newest == nil || o.Generation > newest.Generation) {
+				newest = o
+			}
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	if newest != nil {
+		o := *newest
+		o.Name = trashPrefix + o.Name
+		result.FullName = o.Name
+		result.Object = &o
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) ReadEntries(
+	ctx context.Context,
+	tok string) (entries []fuseutil.Dirent, newTok string, err error) {
+	req := &gcs.ListObjectsRequest{
+		Prefix:            d.prefix(),
+		Delimiter:         "/",
+		ContinuationToken: tok,
+	}
+
+	listing, err := d.softDeleted.ListSoftDeleted(ctx, req)
+	if err != nil {
+		err = fmt.Errorf("ListSoftDeleted: %v", err)
+		return
+	}
+
+	// Several generations of an object may be soft-deleted. List each name
+	// once.
+	seen := make(map[string]bool)
+	for _, o := range listing.Objects {
+		if o.Name == d.prefix() || seen[o.Name] {
+			continue
+		}
+
+		seen[o.Name] = true
+		entries = append(entries, fuseutil.Dirent{
+			Name: componentToName(strings.TrimPrefix(o.Name, d.prefix())),
+			Type: fuseutil.DT_File,
+		})
+	}
+
+	for _, p := range listing.CollapsedRuns {
+		component := strings.TrimSuffix(strings.TrimPrefix(p, d.prefix()), "/")
+		entries = append(entries, fuseutil.Dirent{
+			Name: componentToName(component),
+			Type: fuseutil.DT_Directory,
+		})
+	}
+
+	newTok = listing.ContinuationToken
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) CreateChildFile(
+	ctx context.Context,
+	name string) (o *gcs.Object, err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) CloneToChildFile(
+	ctx context.Context,
+	name string,
+	src *gcs.Object) (o *gcs.Object, err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) CreateChildSymlink(
+	ctx context.Context,
+	name string,
+	target string) (o *gcs.Object, err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) CreateChildDir(
+	ctx context.Context,
+	name string) (o *gcs.Object, err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) DeleteChildFile(
+	ctx context.Context,
+	name string,
+	generation int64,
+	metaGeneration *int64) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) DeleteChildDir(
+	ctx context.Context,
+	name string,
+	child DirInode) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) RenameChildDir(
+	ctx context.Context,
+	name string,
+	newParent DirInode,
+	newName string) (err error) {
+	err = syscall.EROFS
+	return
+}
+
+// LOCKS_REQUIRED(d)
+func (d *TrashDirInode) NoteRenamedChildDir(name string) {
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+// A soft-deleted generation of an object. GCS doesn't serve the contents of
+// soft-deleted objects, so it can't be opened; it can only be restored.
+type TrashFileInode struct {
+	BaseInode
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	// The soft-deleted object, under the name of the inode.
+	src gcs.Object
+
+	attrs fuseops.InodeAttributes
+}
+
+var _ GenerationBackedInode = &TrashFileInode{}
+
+// Create a trash file inode for the supplied soft-deleted object, whose name
+// is that of the inode, as returned by TrashDirInode.LookUpChild.
+//
+// REQUIRES: IsTrashName(o.Name)
+func NewTrashFileInode(
+	id fuseops.InodeID,
+	o *gcs.Object,
+	attrs fuseops.InodeAttributes) (f *TrashFileInode) {
+	if !IsTrashName(o.Name) {
+		panic(fmt.Sprintf("Unexpected name: %s", o.Name))
+	}
+
+	f = &TrashFileInode{
+		src: *o,
+		attrs: fuseops.InodeAttributes{
+			Size:  o.Size,
+			Nlink: 1,
+			Mode:  attrs.Mode,
+			Atime: o.Updated,
+			Mtime: o.Updated,
+			Ctime: o.Deleted,
+			Uid:   attrs.Uid,
+			Gid:   attrs.Gid,
+		},
+	}
+
+	f.Init(id, o.Name, nil)
+	return
+}
+
+// Return the soft-deleted object, under its own name.
+//
+// Does not require the lock to be held.
+func (f *TrashFileInode) Source() (o *gcs.Object) {
+	tmp := f.src
+	tmp.Name = TrashObjectName(tmp.Name)
+	o = &tmp
+	return
+}
+
+// LOCKS_REQUIRED(f)
+func (f *TrashFileInode) SourceGeneration() Generation {
+	return Generation{
+		Object:   f.src.Generation,
+		Metadata: f.src.MetaGeneration,
+	}
+}
+
+// LOCKS_REQUIRED(f)
+func (f *TrashFileInode) Destroy() (err error) {
+	// Nothing to do.
+	return
+}
+
+// LOCKS_REQUIRED(f)
+func (f *TrashFileInode) Attributes(
+	ctx context.Context) (attrs fuseops.InodeAttributes, err error) {
+	attrs = f.attrs
+	return
+}
+
+// LOCKS_REQUIRED(f)
+func (f *TrashFileInode) AttributesExpiration() time.Time {
+	return time.Time{}
+}
@@ -35,12 +35,14 @@ type typeCache struct {
 	// Constant data
 	/////////////////////////
 
-	ttl time.Duration
+	perTypeCapacity int
 
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	ttl time.Duration
+
 	// A cache mapping file names to the time at which the entry should expire.
 	//
 	// INVARIANT: files.CheckInvariants() does not panic
@@ -61,9 +63,10 @@ func newTypeCache(
 	perTypeCapacity int,
 	ttl time.Duration) (tc typeCache) {
 	tc = typeCache{
-		ttl:   ttl,
-		files: lrucache.New(perTypeCapacity),
-		dirs:  lrucache.New(perTypeCapacity),
+		perTypeCapacity: perTypeCapacity,
+		ttl:             ttl,
+		files:           lrucache.New(perTypeCapacity),
+		dirs:            lrucache.New(perTypeCapacity),
 	}
 
 	return
@@ -109,6 +112,17 @@ func (tc *typeCache) Erase(name string) {
 	tc.dirs.Erase(name)
 }
 
+// Change the TTL given to information recorded from now on.
+func (tc *typeCache) SetTTL(ttl time.Duration) {
+	tc.ttl = ttl
+}
+
+// Erase all information about all names.
+func (tc *typeCache) EraseAll() {
+	tc.files = lrucache.New(tc.perTypeCapacity)
+	tc.dirs = lrucache.New(tc.perTypeCapacity)
+}
+
 // Do we currently think the given name is a file?
 func (tc *typeCache) IsFile(now time.Time, name string) (res bool) {
 	// Is there an entry?
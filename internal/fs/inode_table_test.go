@@ -0,0 +1,221 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestInodeTable(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for keeping and evicting inodes that the kernel has forgotten, calling
+// the file system's methods directly as the kernel would.
+type InodeTableTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&InodeTableTest{}) }
+
+func (t *InodeTableTest) SetUp(ti *TestInfo) {
+	// Make a file system with room for the root and three more inodes.
+	t.serverCfg.InodeTableSize = 4
+	t.directFsTest.SetUp(ti)
+
+	// Create some objects.
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"foo", "bar", "baz", "qux/"})
+
+	AssertEq(nil, err)
+}
+
+func (t *InodeTableTest) mount(inodeTableSize int) {
+	t.serverCfg.InodeTableSize = inodeTableSize
+	t.createFileSystem()
+}
+
+func (t *InodeTableTest) forget(id fuseops.InodeID) {
+	err := t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: id, N: 1})
+	AssertEq(nil, err)
+}
+
+// Return the inode in the table with the given ID, or nil if none.
+func (t *InodeTableTest) inode(id fuseops.InodeID) inode.Inode {
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	return t.fs.inodes[id]
+}
+
+// Return the number of inodes in the table.
+func (t *InodeTableTest) tableSize() int {
+	t.fs.mu.Lock()
+	defer t.fs.mu.Unlock()
+
+	return len(t.fs.inodes)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *InodeTableTest) ForgottenInodeDestroyedWhenSizeIsZero() {
+	t.mount(0)
+
+	id := t.lookUp("foo")
+	in := t.inode(id)
+
+	t.forget(id)
+	ExpectEq(1, t.tableSize())
+
+	// The ID is derived from the name, so a new inode gets the same one.
+	AssertEq(id, t.lookUp("foo"))
+	ExpectNe(in, t.inode(id))
+}
+
+func (t *InodeTableTest) ForgottenInodeReused() {
+	fileID := t.lookUp("foo")
+	dirID := t.lookUp("qux")
+
+	t.forget(fileID)
+	t.forget(dirID)
+	ExpectEq(3, t.tableSize())
+
+	// Looking the names up again should find the same inodes.
+	ExpectEq(fileID, t.lookUp("foo"))
+	ExpectEq(dirID, t.lookUp("qux"))
+
+	// They can be forgotten again.
+	t.forget(fileID)
+	t.forget(dirID)
+	ExpectEq(3, t.tableSize())
+}
+
+func (t *InodeTableTest) LeastRecentlyForgottenEvicted() {
+	foo := t.lookUp("foo")
+	bar := t.lookUp("bar")
+	baz := t.lookUp("baz")
+
+	fooInode := t.inode(foo)
+	barInode := t.inode(bar)
+	bazInode := t.inode(baz)
+
+	t.forget(foo)
+	t.forget(bar)
+	t.forget(baz)
+	ExpectEq(4, t.tableSize())
+
+	// Looking up a new name should make room by evicting foo, which was
+	// forgotten first.
+	t.lookUp("qux")
+	ExpectEq(4, t.tableSize())
+
+	AssertEq(baz, t.lookUp("baz"))
+	AssertEq(bar, t.lookUp("bar"))
+	AssertEq(foo, t.lookUp("foo"))
+
+	ExpectEq(bazInode, t.inode(baz))
+	ExpectEq(barInode, t.inode(bar))
+	ExpectNe(fooInode, t.inode(foo))
+}
+
+func (t *InodeTableTest) InodesInUseNeverEvicted() {
+	ids := []fuseops.InodeID{
+		t.lookUp("foo"),
+		t.lookUp("bar"),
+		t.lookUp("baz"),
+		t.lookUp("qux"),
+	}
+
+	// The table is over size, but the kernel knows about every inode in it.
+	ExpectEq(5, t.tableSize())
+
+	for _, id := range ids {
+		err := t.fs.GetInodeAttributes(
+			t.ctx,
+			&fuseops.GetInodeAttributesOp{Inode: id})
+
+		ExpectEq(nil, err)
+	}
+
+	// Once the kernel forgets one, it goes right away to bring the table back
+	// down to size.
+	t.forget(ids[0])
+	ExpectEq(4, t.tableSize())
+	ExpectEq(nil, t.inode(ids[0]))
+}
+
+func (t *InodeTableTest) SupersededInodeNotKept() {
+	id := t.lookUp("foo")
+
+	// Overwrite the object and look it up again, minting a new inode for the
+	// new generation.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	newID := t.lookUp("foo")
+	AssertNe(id, newID)
+
+	// Nobody will look the old inode up again, so there's no use keeping it.
+	ExpectEq(3, t.tableSize())
+	t.forget(id)
+	ExpectEq(2, t.tableSize())
+}
+
+func (t *InodeTableTest) IDsStableAcrossMounts() {
+	names := []string{"foo", "bar", "qux"}
+
+	var ids []fuseops.InodeID
+	for _, name := range names {
+		ids = append(ids, t.lookUp(name))
+	}
+
+	t.mount(4)
+	for i, name := range names {
+		ExpectEq(ids[i], t.lookUp(name), "name: %q", name)
+	}
+}
+
+func (t *InodeTableTest) IDsDependOnKind() {
+	// A symlink with the same name as a file gets a different ID.
+	id := t.lookUp("foo")
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				inode.SymlinkMetadataKey: "bar",
+			},
+		})
+
+	AssertEq(nil, err)
+
+	t.mount(4)
+	ExpectNe(id, t.lookUp("foo"))
+}
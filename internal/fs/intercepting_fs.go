@@ -0,0 +1,368 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/net/context"
+)
+
+// A function that is run around each file system operation. op is the
+// *fuseops.FooOp struct for the operation. The interceptor must call next
+// exactly once (unless it decides to fail the operation without running it),
+// and may modify the context it passes on.
+type opInterceptor func(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) error
+
+// Wrap the supplied file system such that each operation runs through the
+// supplied interceptors, the first of which is outermost.
+func newInterceptingFileSystem(
+	wrapped fuseutil.FileSystem,
+	interceptors []opInterceptor) fuseutil.FileSystem {
+	return &interceptingFileSystem{
+		wrapped:      wrapped,
+		interceptors: interceptors,
+	}
+}
+
+type interceptingFileSystem struct {
+	wrapped      fuseutil.FileSystem
+	interceptors []opInterceptor
+}
+
+func (fs *interceptingFileSystem) invoke(
+	ctx context.Context,
+	op interface{},
+	f func(context.Context) error) error {
+	// Build the chain from the inside out.
+	next := f
+	for i := len(fs.interceptors) - 1; i >= 0; i-- {
+		interceptor := fs.interceptors[i]
+		inner := next
+		next = func(ctx context.Context) error {
+			return interceptor(ctx, op, inner)
+		}
+	}
+
+	return next(ctx)
+}
+
+// Return a short name for the supplied op, e.g. "LookUpInode" for
+// *fuseops.LookUpInodeOp.
+func opName(op interface{}) string {
+	t := reflect.TypeOf(op)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return strings.TrimSuffix(t.Name(), "Op")
+}
+
+// Return the inode that the supplied op concerns (the parent, for ops that
+// refer to a child by name), and the child name if any.
+func opDetails(op interface{}) (inode fuseops.InodeID, name string) {
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return typed.Parent, typed.Name
+	case *fuseops.GetInodeAttributesOp:
+		return typed.Inode, ""
+	case *fuseops.SetInodeAttributesOp:
+		return typed.Inode, ""
+	case *fuseops.ForgetInodeOp:
+		return typed.Inode, ""
+	case *fuseops.MkDirOp:
+		return typed.Parent, typed.Name
+	case *fuseops.MkNodeOp:
+		return typed.Parent, typed.Name
+	case *fuseops.CreateFileOp:
+		return typed.Parent, typed.Name
+	case *fuseops.CreateSymlinkOp:
+		return typed.Parent, typed.Name
+	case *fuseops.CreateLinkOp:
+		return typed.Parent, typed.Name
+	case *fuseops.RenameOp:
+		return typed.OldParent, typed.OldName
+	case *fuseops.RmDirOp:
+		return typed.Parent, typed.Name
+	case *fuseops.UnlinkOp:
+		return typed.Parent, typed.Name
+	case *fuseops.OpenDirOp:
+		return typed.Inode, ""
+	case *fuseops.ReadDirOp:
+		return typed.Inode, ""
+	case *fuseops.OpenFileOp:
+		return typed.Inode, ""
+	case *fuseops.ReadFileOp:
+		return typed.Inode, ""
+	case *fuseops.WriteFileOp:
+		return typed.Inode, ""
+	case *fuseops.FallocateOp:
+		return typed.Inode, ""
+	case *fuseops.SyncFileOp:
+		return typed.Inode, ""
+	case *fuseops.FlushFileOp:
+		return typed.Inode, ""
+	case *fuseops.ReadSymlinkOp:
+		return typed.Inode, ""
+	case *fuseops.RemoveXattrOp:
+		return typed.Inode, typed.Name
+	case *fuseops.GetXattrOp:
+		return typed.Inode, typed.Name
+	case *fuseops.ListXattrOp:
+		return typed.Inode, ""
+	case *fuseops.SetXattrOp:
+		return typed.Inode, typed.Name
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// fuseutil.FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *interceptingFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.StatFS(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.LookUpInode(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ForgetInode(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.MkDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.MkNode(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CreateFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CreateSymlink(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CreateLink(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Rename(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.RmDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Unlink(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.OpenDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReadDir(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReleaseDirHandle(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.OpenFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReadFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.WriteFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SyncFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.FlushFile(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReleaseFileHandle(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReadSymlink(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.RemoveXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.GetXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ListXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SetXattr(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.invoke(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Fallocate(ctx, op)
+	})
+}
+
+func (fs *interceptingFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
@@ -1238,6 +1238,39 @@ func (t *DirectoryTest) Rmdir_ThenRecreateWithSameName() {
 	ExpectTrue(fi.IsDir())
 }
 
+func (t *DirectoryTest) Sync() {
+	var err error
+
+	// Create a directory and open it.
+	err = os.Mkdir(path.Join(t.mfs.Dir(), "dir"), 0700)
+	AssertEq(nil, err)
+
+	t.f1, err = os.Open(path.Join(t.mfs.Dir(), "dir"))
+	AssertEq(nil, err)
+
+	// Create one child and unlink another.
+	err = ioutil.WriteFile(path.Join(t.mfs.Dir(), "dir/foo"), []byte("taco"), 0700)
+	AssertEq(nil, err)
+
+	err = ioutil.WriteFile(path.Join(t.mfs.Dir(), "dir/bar"), []byte(""), 0700)
+	AssertEq(nil, err)
+
+	err = os.Remove(path.Join(t.mfs.Dir(), "dir/bar"))
+	AssertEq(nil, err)
+
+	// Syncing the directory should succeed.
+	err = t.f1.Sync()
+	AssertEq(nil, err)
+
+	// Both changes should be reflected in the bucket.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "dir/foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/bar"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
 func (t *DirectoryTest) CreateHardLink() {
 	var err error
 
@@ -1251,7 +1284,7 @@ func (t *DirectoryTest) CreateHardLink() {
 		path.Join(t.mfs.Dir(), "bar"))
 
 	AssertNe(nil, err)
-	ExpectThat(err, Error(HasSubstr("not implemented")))
+	ExpectThat(err, Error(HasSubstr("not supported")))
 }
 
 func (t *DirectoryTest) Chmod() {
@@ -1649,6 +1682,7 @@ func (t *FileTest) Stat() {
 	ExpectEq(1, fi.Sys().(*syscall.Stat_t).Nlink)
 	ExpectEq(currentUid(), fi.Sys().(*syscall.Stat_t).Uid)
 	ExpectEq(currentGid(), fi.Sys().(*syscall.Stat_t).Gid)
+	ExpectEq(1, fi.Sys().(*syscall.Stat_t).Blocks)
 }
 
 func (t *FileTest) StatUnopenedFile() {
@@ -2052,6 +2086,31 @@ func (t *FileTest) Sync_Clobbered() {
 	ExpectEq("foobar", string(contents))
 }
 
+func (t *FileTest) Flock() {
+	var err error
+
+	// Open the same file twice.
+	t.f1, err = os.Create(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	t.f2, err = os.Open(path.Join(t.mfs.Dir(), "foo"))
+	AssertEq(nil, err)
+
+	// The first may take an exclusive lock, at which point the second may not.
+	err = syscall.Flock(int(t.f1.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	AssertEq(nil, err)
+
+	err = syscall.Flock(int(t.f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	ExpectEq(syscall.EWOULDBLOCK, err)
+
+	// Once the first lock is released, the second may take it.
+	err = syscall.Flock(int(t.f1.Fd()), syscall.LOCK_UN)
+	AssertEq(nil, err)
+
+	err = syscall.Flock(int(t.f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	ExpectEq(nil, err)
+}
+
 func (t *FileTest) Close_Dirty() {
 	var err error
 	var n int
@@ -2307,6 +2366,65 @@ func (t *SymlinkTest) RemoveLink() {
 	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
 }
 
+func (t *SymlinkTest) RenameLink() {
+	var err error
+
+	// Create the link.
+	oldName := path.Join(t.Dir, "foo")
+	err = os.Symlink("blah", oldName)
+	AssertEq(nil, err)
+
+	// Rename it.
+	newName := path.Join(t.Dir, "bar")
+	err = os.Rename(oldName, newName)
+	AssertEq(nil, err)
+
+	// The old name should be gone.
+	_, err = os.Lstat(oldName)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	// The new name should be a link with the same target.
+	target, err := os.Readlink(newName)
+	AssertEq(nil, err)
+	ExpectEq("blah", target)
+
+	// Check the object in the bucket.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+
+	AssertEq(nil, err)
+	ExpectEq("blah", o.Metadata["gcsfuse_symlink_target"])
+}
+
+func (t *SymlinkTest) ReplaceLink() {
+	var err error
+
+	// Create a link.
+	symlinkName := path.Join(t.Dir, "foo")
+	err = os.Symlink("taco", symlinkName)
+	AssertEq(nil, err)
+
+	// Replace it the way ln -sf does: create a new link under a temporary name,
+	// then rename it over the old one.
+	tmpName := path.Join(t.Dir, "foo.tmp")
+	err = os.Symlink("burrito", tmpName)
+	AssertEq(nil, err)
+
+	err = os.Rename(tmpName, symlinkName)
+	AssertEq(nil, err)
+
+	// Read the link.
+	target, err := os.Readlink(symlinkName)
+	AssertEq(nil, err)
+	ExpectEq("burrito", target)
+
+	// Only the one link should remain.
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq("foo", entries[0].Name())
+	ExpectEq(filePerms|os.ModeSymlink, entries[0].Mode())
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Rename
 ////////////////////////////////////////////////////////////////////////
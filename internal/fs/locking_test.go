@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	. "github.com/jacobsa/ogletest"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LockingDisabledTest struct {
+	fsTest
+	f *os.File
+}
+
+func init() { RegisterTestSuite(&LockingDisabledTest{}) }
+
+func (t *LockingDisabledTest) SetUp(ti *TestInfo) {
+	t.mountCfg.DisableLocking = true
+	t.fsTest.SetUp(ti)
+
+	var err error
+	t.f, err = os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+}
+
+func (t *LockingDisabledTest) TearDown() {
+	if t.f != nil {
+		t.f.Close()
+	}
+
+	t.fsTest.TearDown()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LockingDisabledTest) Flock() {
+	err := syscall.Flock(int(t.f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	ExpectEq(syscall.ENOTSUP, err)
+}
+
+func (t *LockingDisabledTest) SetLock() {
+	lk := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: int16(os.SEEK_SET),
+	}
+
+	err := syscall.FcntlFlock(t.f.Fd(), syscall.F_SETLK, &lk)
+	ExpectEq(syscall.ENOTSUP, err)
+}
+
+func (t *LockingDisabledTest) GetLock() {
+	lk := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: int16(os.SEEK_SET),
+	}
+
+	err := syscall.FcntlFlock(t.f.Fd(), syscall.F_GETLK, &lk)
+	ExpectEq(syscall.ENOTSUP, err)
+}
+
+func (t *LockingDisabledTest) ReadAndWrite() {
+	// Refusing locks doesn't get in the way of closing the file, which releases
+	// any locks the process holds.
+	_, err := t.f.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.f.Close()
+	t.f = nil
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(4, fi.Size())
+}
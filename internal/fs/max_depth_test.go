@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMaxDepth(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for ServerConfig.MaxDepth, calling the file system's methods directly
+// as the kernel would.
+type MaxDepthTest struct {
+	directFsTest
+	counted *countingBucket
+}
+
+func init() { RegisterTestSuite(&MaxDepthTest{}) }
+
+func (t *MaxDepthTest) SetUp(ti *TestInfo) {
+	t.counted = &countingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.bucket = t.counted
+	t.serverCfg.ImplicitDirectories = true
+	t.directFsTest.SetUp(ti)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.counted,
+		[]string{
+			"dir/",
+			"dir/foo",
+			"foo",
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *MaxDepthTest) mount(maxDepth int) {
+	t.serverCfg.MaxDepth = maxDepth
+	t.createFileSystem()
+}
+
+func (t *MaxDepthTest) mkDir(parent fuseops.InodeID, name string) error {
+	return t.fs.MkDir(
+		t.ctx,
+		&fuseops.MkDirOp{
+			Parent: parent,
+			Name:   name,
+			Mode:   0755,
+		})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MaxDepthTest) Flat() {
+	var err error
+	t.mount(1)
+
+	// Looking up a name in the root stats only the object of that name,
+	// without looking for a directory.
+	_, err = t.lookUpIn(fuseops.RootInodeID, "foo")
+	AssertEq(nil, err)
+
+	// Directories aren't found.
+	_, err = t.lookUpIn(fuseops.RootInodeID, "dir")
+	ExpectEq(fuse.ENOENT, err)
+
+	ExpectEq(0, t.counted.ListCalls())
+	for _, name := range t.counted.Statted() {
+		ExpectFalse(strings.HasSuffix(name, "/"), "%s", name)
+	}
+
+	// Nor can they be created.
+	err = t.mkDir(fuseops.RootInodeID, "new")
+	ExpectEq(syscall.EPERM, err)
+}
+
+func (t *MaxDepthTest) TwoLevels() {
+	var err error
+	t.mount(2)
+
+	// Directories in the root are found and may be created.
+	dir, err := t.lookUpIn(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	err = t.mkDir(fuseops.RootInodeID, "new")
+	ExpectEq(nil, err)
+
+	// Within them there are only files.
+	_, err = t.lookUpIn(dir.Child, "foo")
+	ExpectEq(nil, err)
+
+	err = t.mkDir(dir.Child, "new")
+	ExpectEq(syscall.EPERM, err)
+}
+
+func (t *MaxDepthTest) Unlimited() {
+	var err error
+	t.mount(0)
+
+	dir, err := t.lookUpIn(fuseops.RootInodeID, "dir")
+	AssertEq(nil, err)
+
+	err = t.mkDir(dir.Child, "new")
+	ExpectEq(nil, err)
+}
@@ -0,0 +1,37 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/metrics"
+	"golang.org/x/net/context"
+)
+
+// Return an opInterceptor that records the latency of each operation in the
+// supplied histograms, labelled by op name.
+func recordOpLatency(h *metrics.LatencyHistograms) opInterceptor {
+	return func(
+		ctx context.Context,
+		op interface{},
+		next func(context.Context) error) (err error) {
+		start := time.Now()
+		err = next(ctx)
+		h.Observe(opName(op), time.Since(start))
+
+		return
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	"github.com/jacobsa/syncutil"
+)
+
+// With ServerConfig.RecursiveRmDir, rm -r of a large tree would otherwise
+// cost a lookup and an unlink through the kernel for every file, one at a
+// time. Instead the rmdir of each non-empty directory it meets deletes
+// everything beneath it straight from a listing, so the first rmdir empties
+// the tree and rm -r finds the rest already gone.
+//
+// Only what rm -r could have deleted itself is deleted: objects hidden by the
+// name filter or MaxDepth are left alone, as are those that can't be deleted
+// because of a hold or retention, and an object is deleted only if it is the
+// generation and meta-generation that was listed.
+
+// How many objects to delete at once.
+const recursiveRmDirParallelism = 64
+
+// Delete everything visible within the directory with the given name, which
+// ends in a slash, leaving its own placeholder object or folder for the caller
+// to delete. Objects are deleted while the prefix is still being listed, then
+// any folders within it deepest first. Objects that have already gone are
+// skipped.
+//
+// Fail with EPERM if any object is held or retained, and with ENOTEMPTY if any
+// was modified after it was listed, having deleted the rest.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) deleteDirContents(
+	ctx context.Context,
+	dirName string) (err error) {
+	startTime := time.Now()
+	b := syncutil.NewBundle(ctx)
+
+	// List all objects with the directory's prefix.
+	objects := make(chan *gcs.Object, 100)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(objects)
+		err = gcsutil.ListPrefix(ctx, fs.bucket, dirName, objects)
+		if err != nil {
+			err = fmt.Errorf("ListPrefix: %v", err)
+			return
+		}
+
+		return
+	})
+
+	// Delete them, other than the placeholder and those rm -r couldn't see.
+	var objectsDeleted uint64
+	var objectsRetained uint64
+	var objectsModified uint64
+	for i := 0; i < recursiveRmDirParallelism; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for o := range objects {
+				if o.Name == dirName || !fs.visibleWithin(dirName, o.Name) {
+					continue
+				}
+
+				err = fs.checkRetention(ctx, o)
+				if err == syscall.EPERM {
+					err = nil
+					atomic.AddUint64(&objectsRetained, 1)
+					continue
+				}
+
+				if err != nil {
+					return
+				}
+
+				err = fs.bucket.DeleteObject(
+					ctx,
+					&gcs.DeleteObjectRequest{
+						Name:                       o.Name,
+						Generation:                 o.Generation,
+						MetaGenerationPrecondition: &o.MetaGeneration,
+					})
+
+				// The object may have been deleted or replaced by someone else since
+				// we listed it. Either way there is nothing of ours to delete.
+				if _, ok := err.(*gcs.NotFoundError); ok {
+					err = nil
+					continue
+				}
+
+				if _, ok := err.(*gcs.PreconditionError); ok {
+					err = nil
+					atomic.AddUint64(&objectsModified, 1)
+					continue
+				}
+
+				if err != nil {
+					err = fmt.Errorf("DeleteObject(%q): %v", o.Name, err)
+					return
+				}
+
+				atomic.AddUint64(&objectsDeleted, 1)
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	if err != nil {
+		return
+	}
+
+	logger.Infof(
+		"Deleted %d objects within %q in %v.",
+		objectsDeleted,
+		dirName,
+		time.Since(startTime))
+
+	switch {
+	case objectsRetained > 0:
+		logger.Infof(
+			"Left %d held or retained objects within %q.",
+			objectsRetained,
+			dirName)
+
+		err = syscall.EPERM
+		return
+
+	case objectsModified > 0:
+		logger.Infof(
+			"Left %d objects modified since listing within %q.",
+			objectsModified,
+			dirName)
+
+		err = fuse.ENOTEMPTY
+		return
+	}
+
+	// In a bucket with a hierarchical namespace, the folders remain.
+	if fs.folders != nil {
+		err = fs.deleteChildFolders(ctx, dirName)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Is the object with the given name, within the directory with the given
+// name, visible in the file system? It isn't if it or any directory between
+// the two is hidden by the name filter of its parent or lies beyond MaxDepth.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) visibleWithin(dirName string, name string) bool {
+	parent := dirName
+	rest := strings.TrimPrefix(name, dirName)
+	for rest != "" {
+		child := rest
+		i := strings.Index(rest, "/")
+		isDir := i >= 0
+		if isDir {
+			child = rest[:i]
+		}
+
+		if isDir && fs.isFlatDir(parent) {
+			return false
+		}
+
+		fs.mu.Lock()
+		_, _, filter := fs.settingsFor(parent)
+		fs.mu.Unlock()
+
+		if !filter.Visible(child, isDir) {
+			return false
+		}
+
+		if !isDir {
+			break
+		}
+
+		parent += rest[:i+1]
+		rest = rest[i+1:]
+	}
+
+	return true
+}
+
+// Delete the folders within the named one, deepest first.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) deleteChildFolders(
+	ctx context.Context,
+	dirName string) (err error) {
+	names, err := fs.folders.ListFolders(ctx, dirName)
+	if err != nil {
+		err = fmt.Errorf("ListFolders(%q): %v", dirName, err)
+		return
+	}
+
+	for _, name := range names {
+		err = fs.deleteChildFolders(ctx, name)
+		if err != nil {
+			return
+		}
+
+		// A folder holding hidden objects isn't empty, and is left in place.
+		err = fs.folders.DeleteFolder(ctx, name)
+		switch err.(type) {
+		case *gcs.NotFoundError, *gcs.PreconditionError:
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("DeleteFolder(%q): %v", name, err)
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRecursiveRmDir(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for rmdir of non-empty directories with ServerConfig.RecursiveRmDir,
+// calling the file system's methods directly as the kernel would.
+type RecursiveRmDirTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&RecursiveRmDirTest{}) }
+
+func (t *RecursiveRmDirTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ImplicitDirectories = true
+	t.serverCfg.RecursiveRmDir = true
+	t.directFsTest.SetUp(ti)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			"dir/",
+			"dir/foo",
+			"dir/sub/",
+			"dir/sub/bar",
+			"dir/sub/deeper/baz",
+			"dirty",
+			"implicit/foo",
+			"implicit/sub/bar",
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *RecursiveRmDirTest) rmDir(name string) error {
+	return t.fs.RmDir(
+		t.ctx,
+		&fuseops.RmDirOp{
+			Parent: fuseops.RootInodeID,
+			Name:   name,
+		})
+}
+
+// Return the names of all objects in the bucket.
+func (t *RecursiveRmDirTest) objectNames() (names []string) {
+	objects, _, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RecursiveRmDirTest) Disabled() {
+	t.fs.recursiveRmDir = false
+
+	ExpectEq(fuse.ENOTEMPTY, t.rmDir("dir"))
+	ExpectThat(t.objectNames(), Contains("dir/foo"))
+}
+
+func (t *RecursiveRmDirTest) ExplicitDir() {
+	err := t.rmDir("dir")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("dirty", "implicit/foo", "implicit/sub/bar"))
+
+	// The directory is gone.
+	err = t.fs.LookUpInode(
+		t.ctx,
+		&fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "dir"})
+
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *RecursiveRmDirTest) ImplicitDir() {
+	err := t.rmDir("implicit")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"dir/",
+			"dir/foo",
+			"dir/sub/",
+			"dir/sub/bar",
+			"dir/sub/deeper/baz",
+			"dirty"))
+}
+
+func (t *RecursiveRmDirTest) ManyObjects() {
+	var names []string
+	for i := 0; i < 3*recursiveRmDirParallelism; i++ {
+		names = append(names, "dir/sub/many/"+strings.Repeat("x", i+1))
+	}
+
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, names)
+	AssertEq(nil, err)
+
+	err = t.rmDir("dir")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre("dirty", "implicit/foo", "implicit/sub/bar"))
+}
+
+func (t *RecursiveRmDirTest) NotADirectory() {
+	ExpectEq(fuse.ENOTDIR, t.rmDir("dirty"))
+	ExpectThat(t.objectNames(), Contains("dirty"))
+}
+
+func (t *RecursiveRmDirTest) HiddenObjectsKept() {
+	filter, err := inode.NewNameFilter([]string{"*.keep", "deeper/"}, nil)
+	AssertEq(nil, err)
+
+	t.serverCfg.NameFilter = filter
+	t.createFileSystem()
+
+	err = gcsutil.CreateEmptyObjects(t.ctx, t.bucket, []string{"dir/sub/x.keep"})
+	AssertEq(nil, err)
+
+	// The objects hidden from rm -r survive it, and keep the directory from
+	// being removed.
+	ExpectEq(fuse.ENOTEMPTY, t.rmDir("dir"))
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"dir/",
+			"dir/sub/deeper/baz",
+			"dir/sub/x.keep",
+			"dirty",
+			"implicit/foo",
+			"implicit/sub/bar"))
+}
+
+func (t *RecursiveRmDirTest) HiddenObjectsKeepDirWithoutRecursion() {
+	filter, err := inode.NewNameFilter([]string{"*.keep"}, nil)
+	AssertEq(nil, err)
+
+	t.serverCfg.NameFilter = filter
+	t.serverCfg.RecursiveRmDir = false
+	t.createFileSystem()
+
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"empty/", "empty/x.keep"})
+
+	AssertEq(nil, err)
+
+	// The directory appears empty, but isn't.
+	ExpectEq(fuse.ENOTEMPTY, t.rmDir("empty"))
+	ExpectThat(t.objectNames(), Contains("empty/"))
+	ExpectThat(t.objectNames(), Contains("empty/x.keep"))
+}
+
+func (t *RecursiveRmDirTest) RetainedObjectsKept() {
+	t.serverCfg.Retention = fakeRetention{
+		"dir/sub/bar": {RetainUntil: time.Now().Add(time.Hour)},
+	}
+
+	t.createFileSystem()
+
+	// The rest are deleted, but the directory stays to hold the retained object.
+	ExpectEq(syscall.EPERM, t.rmDir("dir"))
+	ExpectThat(
+		t.objectNames(),
+		ElementsAre(
+			"dir/",
+			"dir/sub/bar",
+			"dirty",
+			"implicit/foo",
+			"implicit/sub/bar"))
+}
@@ -0,0 +1,301 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRefresh(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for picking up generations of file and symlink objects written by
+// other machines, calling the file system's methods directly as the kernel
+// would, so that inodes can be reused in ways that depend on the kernel's
+// caching.
+type RefreshTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&RefreshTest{}) }
+
+func (t *RefreshTest) createWithContents(name string, contents string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+}
+
+func (t *RefreshTest) createSymlink(name string, target string) {
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     name,
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				inode.SymlinkMetadataKey: target,
+			},
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *RefreshTest) readSymlink(id fuseops.InodeID) string {
+	op := &fuseops.ReadSymlinkOp{Inode: id}
+	err := t.fs.ReadSymlink(t.ctx, op)
+	AssertEq(nil, err)
+
+	return op.Target
+}
+
+func (t *RefreshTest) getAttributes(
+	id fuseops.InodeID) (attrs fuseops.InodeAttributes) {
+	op := &fuseops.GetInodeAttributesOp{Inode: id}
+	err := t.fs.GetInodeAttributes(t.ctx, op)
+	AssertEq(nil, err)
+
+	attrs = op.Attributes
+	return
+}
+
+func (t *RefreshTest) open(id fuseops.InodeID) (op *fuseops.OpenFileOp) {
+	op = &fuseops.OpenFileOp{Inode: id}
+	err := t.fs.OpenFile(t.ctx, op)
+	AssertEq(nil, err)
+
+	return
+}
+
+func (t *RefreshTest) release(h fuseops.HandleID) {
+	err := t.fs.ReleaseFileHandle(
+		t.ctx,
+		&fuseops.ReleaseFileHandleOp{Handle: h})
+
+	AssertEq(nil, err)
+}
+
+func (t *RefreshTest) read(
+	id fuseops.InodeID,
+	h fuseops.HandleID) (contents string) {
+	op := &fuseops.ReadFileOp{
+		Inode:  id,
+		Handle: h,
+		Dst:    make([]byte, 1024),
+	}
+
+	err := t.fs.ReadFile(t.ctx, op)
+	if err == io.EOF {
+		err = nil
+	}
+
+	AssertEq(nil, err)
+
+	contents = string(op.Dst[:op.BytesRead])
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RefreshTest) StatAfterOverwrite() {
+	t.createWithContents("foo", "taco")
+	id := t.lookUp("foo")
+
+	// Overwrite the object remotely. Statting the inode should show the new
+	// generation, not an unlinked file.
+	t.createWithContents("foo", "burrito")
+
+	attrs := t.getAttributes(id)
+	ExpectEq(len("burrito"), attrs.Size)
+	ExpectEq(1, attrs.Nlink)
+}
+
+func (t *RefreshTest) OpenAfterOverwrite() {
+	t.createWithContents("foo", "taco")
+	id := t.lookUp("foo")
+
+	op := t.open(id)
+	ExpectTrue(op.KeepPageCache)
+	ExpectEq("taco", t.read(id, op.Handle))
+	t.release(op.Handle)
+
+	// Overwrite the object remotely. Reopening the inode should serve the new
+	// contents, and tell the kernel to drop what it has cached.
+	t.createWithContents("foo", "burrito")
+
+	op = t.open(id)
+	ExpectFalse(op.KeepPageCache)
+	ExpectEq("burrito", t.read(id, op.Handle))
+	t.release(op.Handle)
+
+	// The cache is valid again for the next open.
+	op = t.open(id)
+	ExpectTrue(op.KeepPageCache)
+	t.release(op.Handle)
+}
+
+func (t *RefreshTest) StatThenOpenAfterOverwrite() {
+	t.createWithContents("foo", "taco")
+	id := t.lookUp("foo")
+
+	// A stat that picks up the new generation should still cause the next open
+	// to drop the page cache.
+	t.createWithContents("foo", "burrito")
+	ExpectEq(len("burrito"), t.getAttributes(id).Size)
+
+	op := t.open(id)
+	ExpectFalse(op.KeepPageCache)
+	t.release(op.Handle)
+}
+
+func (t *RefreshTest) MetadataChangeKeepsPageCache() {
+	t.createWithContents("foo", "taco")
+	id := t.lookUp("foo")
+
+	lang := "fr"
+	_, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:            "foo",
+			ContentLanguage: &lang,
+		})
+
+	AssertEq(nil, err)
+
+	op := t.open(id)
+	ExpectTrue(op.KeepPageCache)
+	t.release(op.Handle)
+}
+
+func (t *RefreshTest) OpenInodeIsNotRefreshed() {
+	t.createWithContents("foo", "taco")
+	id := t.lookUp("foo")
+
+	op := t.open(id)
+	defer t.release(op.Handle)
+
+	// While the file is open, its readers keep a consistent view, with the file
+	// appearing to have been unlinked.
+	t.createWithContents("foo", "burrito")
+
+	attrs := t.getAttributes(id)
+	ExpectEq(len("taco"), attrs.Size)
+	ExpectEq(0, attrs.Nlink)
+}
+
+func (t *RefreshTest) SupersededInodeIsNotRefreshed() {
+	t.createWithContents("foo", "taco")
+	id := t.lookUp("foo")
+
+	// Overwrite the object and look it up again, minting a new inode for the
+	// new generation.
+	t.createWithContents("foo", "burrito")
+
+	newID := t.lookUp("foo")
+	AssertNe(id, newID)
+
+	// The old inode should continue to appear unlinked.
+	attrs := t.getAttributes(id)
+	ExpectEq(len("taco"), attrs.Size)
+	ExpectEq(0, attrs.Nlink)
+
+	attrs = t.getAttributes(newID)
+	ExpectEq(len("burrito"), attrs.Size)
+	ExpectEq(1, attrs.Nlink)
+}
+
+func (t *RefreshTest) SymlinkRecreated() {
+	t.createSymlink("foo", "taco")
+	id := t.lookUp("foo")
+	ExpectEq("taco", t.readSymlink(id))
+
+	// Re-create the symlink remotely with a new target. The kernel may continue
+	// to use the inode it knows, which should follow the change.
+	t.createSymlink("foo", "burrito")
+	ExpectEq("burrito", t.readSymlink(id))
+	ExpectEq(1, t.getAttributes(id).Nlink)
+}
+
+func (t *RefreshTest) SymlinkTargetUpdatedInPlace() {
+	t.createSymlink("foo", "taco")
+	id := t.lookUp("foo")
+
+	// Update the target in the object's metadata, with a precondition on the
+	// generation we know about.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	target := "burrito"
+	_, err = t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:                       "foo",
+			Generation:                 o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+			Metadata: map[string]*string{
+				inode.SymlinkMetadataKey: &target,
+			},
+		})
+
+	AssertEq(nil, err)
+
+	ExpectEq("burrito", t.readSymlink(id))
+}
+
+func (t *RefreshTest) SymlinkUnlinkedAndRecreated() {
+	t.createSymlink("foo", "taco")
+	id := t.lookUp("foo")
+
+	// Unlink and re-create through the file system, as ln -sf does.
+	err := t.fs.Unlink(
+		t.ctx,
+		&fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "foo"})
+
+	AssertEq(nil, err)
+
+	op := &fuseops.CreateSymlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "foo",
+		Target: "burrito",
+	}
+
+	err = t.fs.CreateSymlink(t.ctx, op)
+	AssertEq(nil, err)
+
+	ExpectNe(id, op.Entry.Child)
+	ExpectEq("burrito", t.readSymlink(op.Entry.Child))
+	ExpectEq("burrito", t.readSymlink(t.lookUp("foo")))
+}
+
+func (t *RefreshTest) SymlinkReplacedByFile() {
+	t.createSymlink("foo", "taco")
+	id := t.lookUp("foo")
+
+	// A symlink inode can't become a file. It keeps its old target, and the
+	// name leads to a new inode.
+	t.createWithContents("foo", "burrito")
+	ExpectEq("taco", t.readSymlink(id))
+	ExpectNe(id, t.lookUp("foo"))
+}
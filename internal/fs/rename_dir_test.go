@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestRenameDir(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Folders kept in memory for a bucket, which move the objects within them
+// when renamed, as GCS does.
+type bucketFolders struct {
+	bucket gcs.Bucket
+
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func (f *bucketFolders) GetFolder(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.names[name] {
+		return &gcs.NotFoundError{Err: errors.New(name)}
+	}
+
+	return nil
+}
+
+func (f *bucketFolders) CreateFolder(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.names[name] {
+		return &gcs.PreconditionError{Err: errors.New(name + " exists")}
+	}
+
+	f.names[name] = true
+	return nil
+}
+
+func (f *bucketFolders) DeleteFolder(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.names[name] {
+		return &gcs.NotFoundError{Err: errors.New(name)}
+	}
+
+	delete(f.names, name)
+	return nil
+}
+
+func (f *bucketFolders) RenameFolder(
+	ctx context.Context,
+	srcName string,
+	dstName string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.names[srcName] {
+		err = &gcs.NotFoundError{Err: errors.New(srcName)}
+		return
+	}
+
+	if f.names[dstName] {
+		err = &gcs.PreconditionError{Err: errors.New(dstName + " exists")}
+		return
+	}
+
+	// Move the objects.
+	listing, err := f.bucket.ListObjects(
+		ctx,
+		&gcs.ListObjectsRequest{Prefix: srcName})
+
+	if err != nil {
+		return
+	}
+
+	for _, o := range listing.Objects {
+		_, err = f.bucket.CopyObject(
+			ctx,
+			&gcs.CopyObjectRequest{
+				SrcName: o.Name,
+				DstName: dstName + strings.TrimPrefix(o.Name, srcName),
+			})
+
+		if err != nil {
+			return
+		}
+
+		err = f.bucket.DeleteObject(
+			ctx,
+			&gcs.DeleteObjectRequest{Name: o.Name})
+
+		if err != nil {
+			return
+		}
+	}
+
+	// Move the folders.
+	for n := range f.names {
+		if strings.HasPrefix(n, srcName) {
+			delete(f.names, n)
+			f.names[dstName+strings.TrimPrefix(n, srcName)] = true
+		}
+	}
+
+	return
+}
+
+func (f *bucketFolders) ListFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for n := range f.names {
+		rel := strings.TrimSuffix(strings.TrimPrefix(n, parent), "/")
+		if strings.HasPrefix(n, parent) && rel != "" && !strings.Contains(rel, "/") {
+			names = append(names, n)
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for renaming directories in a bucket with a hierarchical namespace,
+// calling the file system's methods directly as the kernel would.
+type RenameDirTest struct {
+	directFsTest
+	notifier recordingNotifier
+}
+
+func init() { RegisterTestSuite(&RenameDirTest{}) }
+
+func (t *RenameDirTest) SetUp(ti *TestInfo) {
+	t.directFsTest.SetUp(ti)
+
+	t.serverCfg.Folders = &bucketFolders{
+		bucket: t.bucket,
+		names:  map[string]bool{"a/": true, "a/sub/": true},
+	}
+
+	t.createFileSystem()
+
+	t.notifier.calls = make(chan string, 100)
+	t.fs.setNotifier(&t.notifier)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			"a/x",
+			"a/sub/z",
+		})
+
+	AssertEq(nil, err)
+}
+
+func (t *RenameDirTest) rename(oldName string, newName string) error {
+	return t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   oldName,
+			NewParent: fuseops.RootInodeID,
+			NewName:   newName,
+		})
+}
+
+// Wait for the given number of notifications to be sent to the kernel.
+func (t *RenameDirTest) calls(n int) (calls []string) {
+	for len(calls) < n {
+		select {
+		case c := <-t.notifier.calls:
+			calls = append(calls, c)
+
+		case <-time.After(5 * time.Second):
+			AddFailure("Timed out after %d notifications", len(calls))
+			AbortTest()
+		}
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RenameDirTest) KernelEntriesInvalidated() {
+	t.lookUp("a")
+
+	err := t.rename("a", "b")
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.calls(2),
+		ElementsAre(
+			fmt.Sprintf("entry %v a", fuseops.RootInodeID),
+			fmt.Sprintf("entry %v b", fuseops.RootInodeID)))
+}
+
+func (t *RenameDirTest) NewNameLooksUpFreshInode() {
+	a := t.lookUp("a")
+	sub := t.lookUpPath("a/sub")
+
+	err := t.rename("a", "b")
+	AssertEq(nil, err)
+
+	b := t.lookUp("b")
+	ExpectNe(a, b)
+
+	t.fs.mu.Lock()
+	ExpectEq("b/", t.fs.inodes[b].Name())
+	t.fs.mu.Unlock()
+
+	ExpectNe(sub.Child, t.lookUpPath("b/sub").Child)
+}
+
+func (t *RenameDirTest) ListAfterRename() {
+	a := t.lookUp("a")
+	AssertThat(t.readDir(a), ElementsAre("sub", "x"))
+
+	err := t.rename("a", "b")
+	AssertEq(nil, err)
+
+	b := t.lookUp("b")
+	ExpectThat(t.readDir(b), ElementsAre("sub", "x"))
+	ExpectThat(t.readDir(t.lookUpPath("b/sub").Child), ElementsAre("z"))
+}
+
+func (t *RenameDirTest) CreateFileAfterRename() {
+	t.lookUp("a")
+
+	err := t.rename("a", "b")
+	AssertEq(nil, err)
+
+	err = t.fs.CreateFile(
+		t.ctx,
+		&fuseops.CreateFileOp{
+			Parent: t.lookUp("b"),
+			Name:   "y",
+			Mode:   0644,
+		})
+
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "b/y"})
+	ExpectEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "a/y"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *RenameDirTest) OldNameReused() {
+	a := t.lookUp("a")
+	AssertThat(t.readDir(a), ElementsAre("sub", "x"))
+
+	err := t.rename("a", "b")
+	AssertEq(nil, err)
+
+	err = t.fs.MkDir(
+		t.ctx,
+		&fuseops.MkDirOp{
+			Parent: fuseops.RootInodeID,
+			Name:   "a",
+			Mode:   0755,
+		})
+
+	AssertEq(nil, err)
+
+	ExpectThat(t.readDir(t.lookUp("a")), ElementsAre())
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// GCS refuses to overwrite or delete an object under a hold or retention with
+// a 403, which for a write would come only when the file is flushed, long
+// after the write appeared to succeed, and would look like a problem with our
+// credentials. So we ask before modifying an existing object for the first
+// time and fail with EPERM, as for an immutable file.
+
+// Fail with EPERM if the supplied object, which may be nil, can't be
+// overwritten or deleted because of a hold or retention.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) checkRetention(
+	ctx context.Context,
+	o *gcs.Object) (err error) {
+	if o == nil {
+		return
+	}
+
+	// The object record knows about temporary holds, such as those placed
+	// through the temporary hold xattr, but not the rest.
+	r := storage.ObjectRetention{TemporaryHold: o.TemporaryHold}
+	if fs.retention != nil && !r.TemporaryHold {
+		r, err = fs.retention.StatRetention(ctx, o.Name, o.Generation)
+
+		// If the object has gone away, the caller will find out soon enough.
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("StatRetention: %v", err)
+			return
+		}
+	}
+
+	now := fs.mtimeClock.Now()
+	if r.Locked(now) {
+		logger.Infof(
+			"Refusing to modify or delete %q, which is %s.",
+			o.Name,
+			r.Describe(now))
+
+		err = syscall.EPERM
+		return
+	}
+
+	return
+}
+
+// Fail with EPERM if the file that is the named child of the supplied parent,
+// if any, can't be overwritten or deleted because of a hold or retention.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(parent)
+func (fs *fileSystem) checkChildRetention(
+	ctx context.Context,
+	parent inode.DirInode,
+	name string) (err error) {
+	if fs.retention == nil {
+		return
+	}
+
+	parent.Lock()
+	lr, err := parent.LookUpChild(ctx, name)
+	parent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	if lr.Object == nil || inode.IsDirName(lr.FullName) {
+		return
+	}
+
+	err = fs.checkRetention(ctx, lr.Object)
+	return
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestRetention(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A storage.Retention that reports the retention it is given for each object
+// name, and none for others.
+type fakeRetention map[string]storage.ObjectRetention
+
+func (r fakeRetention) StatRetention(
+	ctx context.Context,
+	name string,
+	generation int64) (storage.ObjectRetention, error) {
+	return r[name], nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for refusing to modify held and retained objects, calling the file
+// system's methods directly as the kernel would.
+type RetentionTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&RetentionTest{}) }
+
+func (t *RetentionTest) SetUp(ti *TestInfo) {
+	t.serverCfg.Retention = fakeRetention{
+		"held":     {TemporaryHold: true},
+		"retained": {RetainUntil: time.Now().Add(time.Hour)},
+		"expired":  {RetainUntil: time.Now().Add(-time.Hour)},
+	}
+
+	t.directFsTest.SetUp(ti)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"held", "retained", "expired", "plain"})
+
+	AssertEq(nil, err)
+}
+
+func (t *RetentionTest) write(name string) (err error) {
+	err = t.fs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{
+			Inode: t.lookUp(name),
+			Data:  []byte("taco"),
+		})
+
+	return
+}
+
+func (t *RetentionTest) truncate(name string) (err error) {
+	size := uint64(0)
+	err = t.fs.SetInodeAttributes(
+		t.ctx,
+		&fuseops.SetInodeAttributesOp{
+			Inode: t.lookUp(name),
+			Size:  &size,
+		})
+
+	return
+}
+
+func (t *RetentionTest) unlink(name string) (err error) {
+	err = t.fs.Unlink(
+		t.ctx,
+		&fuseops.UnlinkOp{
+			Parent: fuseops.RootInodeID,
+			Name:   name,
+		})
+
+	return
+}
+
+func (t *RetentionTest) rename(oldName, newName string) (err error) {
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   oldName,
+			NewParent: fuseops.RootInodeID,
+			NewName:   newName,
+		})
+
+	return
+}
+
+func (t *RetentionTest) exists(name string) bool {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: name})
+	return err == nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RetentionTest) Write() {
+	ExpectEq(syscall.EPERM, t.write("held"))
+	ExpectEq(syscall.EPERM, t.write("retained"))
+	ExpectEq(nil, t.write("expired"))
+	ExpectEq(nil, t.write("plain"))
+}
+
+func (t *RetentionTest) Truncate() {
+	ExpectEq(syscall.EPERM, t.truncate("held"))
+	ExpectEq(syscall.EPERM, t.truncate("retained"))
+	ExpectEq(nil, t.truncate("plain"))
+}
+
+func (t *RetentionTest) Unlink() {
+	ExpectEq(syscall.EPERM, t.unlink("held"))
+	ExpectEq(syscall.EPERM, t.unlink("retained"))
+	ExpectEq(nil, t.unlink("expired"))
+
+	ExpectTrue(t.exists("held"))
+	ExpectTrue(t.exists("retained"))
+	ExpectFalse(t.exists("expired"))
+}
+
+func (t *RetentionTest) Rename() {
+	// Neither the source nor a file it would replace may be held.
+	ExpectEq(syscall.EPERM, t.rename("held", "new"))
+	ExpectEq(syscall.EPERM, t.rename("plain", "retained"))
+	ExpectFalse(t.exists("new"))
+	ExpectTrue(t.exists("plain"))
+
+	ExpectEq(nil, t.rename("plain", "expired"))
+	ExpectFalse(t.exists("plain"))
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/net/context"
+)
+
+// A fuse server for the file system, as returned by NewServer.
+type Server interface {
+	fuse.Server
+
+	// Prepare for unmounting: fail any further operations that aren't part of
+	// closing files, then write out the contents of every dirty file. Return
+	// the names of the files that could not be written out before ctx was
+	// cancelled or because of an error, in sorted order. If progress is
+	// non-nil, it is told about each dirty file.
+	Shutdown(ctx context.Context, progress FlushProgress) (dirty []string)
+
+	// Undo Shutdown, serving all operations normally again, as when the file
+	// system couldn't be unmounted after all.
+	Resume()
+
+	// Write out the contents of every dirty file, as for Shutdown but without
+	// failing further operations.
+	Flush(ctx context.Context, progress FlushProgress) (dirty []string)
+
+	// Return a snapshot of the state of the file system.
+	Stats() Stats
+
+	// Return how long it has been since the file system last finished serving
+	// an operation, or zero if an operation is in progress or any file or
+	// directory is open.
+	IdleTime() time.Duration
+
+	// Change how long inodes cache their attributes, and directories the types
+	// of their children, as ServerConfig.InodeAttributeCacheTTL and
+	// DirTypeCacheTTL do at creation.
+	SetCacheTTLs(attributes time.Duration, types time.Duration)
+}
+
+// Told about each dirty file as Server.Shutdown or Flush writes it out.
+// Methods are called with the file's inode locked, so must not block on the
+// file system.
+type FlushProgress interface {
+	// Called before writing out the named file.
+	Writing(name string)
+
+	// Called with the outcome for each dirty file, including those not
+	// written out because the deadline had passed.
+	Wrote(name string, err error)
+}
+
+type shutdownServer struct {
+	fuse.Server
+	fs *fileSystem
+}
+
+func (s *shutdownServer) ServeOps(c *fuse.Connection) {
+	s.fs.setNotifier(c)
+	s.Server.ServeOps(c)
+}
+
+func (s *shutdownServer) Shutdown(
+	ctx context.Context,
+	progress FlushProgress) (dirty []string) {
+	dirty = s.fs.shutDown(ctx, progress)
+	return
+}
+
+func (s *shutdownServer) Resume() {
+	atomic.StoreInt32(&s.fs.shuttingDown, 0)
+}
+
+func (s *shutdownServer) Flush(
+	ctx context.Context,
+	progress FlushProgress) (dirty []string) {
+	dirty = s.fs.writeOutDirtyFiles(ctx, progress)
+	return
+}
+
+func (s *shutdownServer) Stats() Stats {
+	return s.fs.stats()
+}
+
+func (s *shutdownServer) IdleTime() time.Duration {
+	return s.fs.idleTime()
+}
+
+func (s *shutdownServer) SetCacheTTLs(
+	attributes time.Duration,
+	types time.Duration) {
+	s.fs.setCacheTTLs(attributes, types)
+}
+
+// An opInterceptor that fails operations with EIO once shutDown has been
+// called, except for those involved in closing files and releasing inodes,
+// which the kernel needs to be able to send while unmounting.
+func (fs *fileSystem) rejectAfterShutdown(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) error {
+	if atomic.LoadInt32(&fs.shuttingDown) != 0 {
+		switch op.(type) {
+		case *fuseops.FlushFileOp,
+			*fuseops.ReleaseFileHandleOp,
+			*fuseops.ReleaseDirHandleOp,
+			*fuseops.ForgetInodeOp:
+
+		default:
+			return syscall.EIO
+		}
+	}
+
+	return next(ctx)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) shutDown(
+	ctx context.Context,
+	progress FlushProgress) (dirty []string) {
+	atomic.StoreInt32(&fs.shuttingDown, 1)
+	dirty = fs.writeOutDirtyFiles(ctx, progress)
+	return
+}
+
+// Write out the contents of every dirty file, returning the names of those
+// that could not be written out before ctx was cancelled or because of an
+// error, in sorted order. Tell progress about each, if it's non-nil.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) writeOutDirtyFiles(
+	ctx context.Context,
+	progress FlushProgress) (dirty []string) {
+	for _, f := range fs.fileInodes() {
+		f.Lock()
+
+		if f.Dirty() {
+			err := ctx.Err()
+			if err == nil {
+				if progress != nil {
+					progress.Writing(f.Name())
+				}
+
+				err = fs.syncFile(ctx, f)
+			}
+
+			if progress != nil {
+				progress.Wrote(f.Name(), err)
+			}
+
+			if err != nil {
+				logger.Errorf("Writing out %q: %v", f.Name(), err)
+				dirty = append(dirty, f.Name())
+			}
+		}
+
+		f.Unlock()
+	}
+
+	sort.Strings(dirty)
+	return
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStatCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A bucket that counts the requests that reach it. Safe for concurrent
+// access, since lookups stat in parallel.
+type countingBucket struct {
+	gcs.Bucket
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	listCalls int
+
+	// The names statted, in order.
+	//
+	// GUARDED_BY(mu)
+	statted []string
+}
+
+func (b *countingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (*gcs.Listing, error) {
+	b.mu.Lock()
+	b.listCalls++
+	b.mu.Unlock()
+
+	return b.Bucket.ListObjects(ctx, req)
+}
+
+func (b *countingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (*gcs.Object, error) {
+	b.mu.Lock()
+	b.statted = append(b.statted, req.Name)
+	b.mu.Unlock()
+
+	return b.Bucket.StatObject(ctx, req)
+}
+
+// Return the number of ListObjects calls so far.
+func (b *countingBucket) ListCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.listCalls
+}
+
+// Return the number of StatObject calls so far.
+func (b *countingBucket) StatCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.statted)
+}
+
+// Return a copy of the names statted so far, in order.
+func (b *countingBucket) Statted() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]string(nil), b.statted...)
+}
+
+// Tests for how directory listings interact with a stat caching bucket,
+// calling the file system's methods directly as the kernel would for ls -l.
+type StatCacheTest struct {
+	directFsTest
+	clock   timeutil.SimulatedClock
+	counted *countingBucket
+}
+
+func init() { RegisterTestSuite(&StatCacheTest{}) }
+
+func (t *StatCacheTest) SetUp(ti *TestInfo) {
+	const ttl = time.Minute
+	const capacity = 100
+
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.counted = &countingBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	t.bucket = t.counted
+	t.serverCfg.CacheClock = &t.clock
+	t.serverCfg.Bucket = gcscaching.NewFastStatBucket(
+		ttl,
+		gcscaching.NewStatCache(capacity),
+		&t.clock,
+		t.counted)
+
+	t.serverCfg.DirTypeCacheTTL = ttl
+	t.serverCfg.InodeAttributeCacheTTL = ttl
+	t.directFsTest.SetUp(ti)
+
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.counted,
+		[]string{
+			"bar",
+			"baz",
+			"dir/",
+			"foo",
+		})
+
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatCacheTest) LookUpsAfterListing() {
+	t.readDir(fuseops.RootInodeID)
+	ExpectEq(1, t.counted.ListCalls())
+
+	// Looking up every entry, as ls -l does, is answered from what the listing
+	// put in the cache.
+	statCalls := t.counted.StatCalls()
+	for _, name := range []string{"bar", "baz", "dir", "foo"} {
+		t.lookUp(name)
+	}
+
+	ExpectEq(statCalls, t.counted.StatCalls())
+	ExpectEq(1, t.counted.ListCalls())
+}
+
+func (t *StatCacheTest) LookUpsAfterExpiration() {
+	t.readDir(fuseops.RootInodeID)
+	t.clock.AdvanceTime(2 * time.Minute)
+
+	statCalls := t.counted.StatCalls()
+	t.lookUp("foo")
+	ExpectLt(statCalls, t.counted.StatCalls())
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot of the state of the file system, as returned by Server.Stats.
+type Stats struct {
+	Inodes          int
+	ForgottenInodes int
+	OpenHandles     int
+
+	// The number of ops being served, and if they are being tracked, what each
+	// is and how long it has been going, oldest first.
+	OpsInFlight int64
+	Ops         []OpStats
+
+	// The number of files with contents not yet written out to GCS, and the
+	// total size of those contents. Files locked by an op, such as one writing
+	// them out, can't be checked without waiting for it, and are counted in
+	// BusyFiles instead.
+	DirtyFiles int
+	DirtyBytes int64
+	BusyFiles  int
+}
+
+type OpStats struct {
+	Desc     string
+	Duration time.Duration
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) stats() (s Stats) {
+	fs.mu.Lock()
+	s.Inodes = len(fs.inodes)
+	s.ForgottenInodes = fs.forgottenInodes.Len()
+	s.OpenHandles = len(fs.handles)
+	fs.mu.Unlock()
+
+	s.OpsInFlight = atomic.LoadInt64(&fs.opsInFlight)
+	if fs.inFlight != nil {
+		now := time.Now()
+		for _, op := range fs.inFlight.snapshot() {
+			s.Ops = append(s.Ops, OpStats{Desc: op.desc, Duration: now.Sub(op.start)})
+		}
+	}
+
+	for _, f := range fs.fileInodes() {
+		if !f.TryLock() {
+			s.BusyFiles++
+			continue
+		}
+
+		if f.Dirty() {
+			s.DirtyFiles++
+			s.DirtyBytes += f.DirtyBytes()
+		}
+
+		f.Unlock()
+	}
+
+	return
+}
@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"golang.org/x/net/context"
+)
+
+// An opInterceptor that starts a root span for each operation. GCS requests
+// made on behalf of the operation appear as its children when the bucket is
+// wrapped with gcsx.NewTracingBucket.
+func traceOp(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) (err error) {
+	ctx, span := tracing.StartSpan(
+		ctx,
+		"fuse."+opName(op),
+		tracing.SpanKindServer)
+
+	inode, name := opDetails(op)
+	span.SetAttribute("fuse.inode", int64(inode))
+	if name != "" {
+		span.SetAttribute("fuse.name", name)
+	}
+
+	err = next(ctx)
+	span.End(err)
+
+	return
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// In a bucket with a soft delete policy, the soft-deleted objects appear
+// within a read-only directory named inode.TrashDirName at the root of the
+// file system, which shadows anything in the bucket with that name. It isn't
+// listed, so that programs that walk the file system don't descend into it,
+// but can be looked up. Renaming a file out of it restores the object.
+
+// Does the named child of the parent refer to the trash directory itself?
+func (fs *fileSystem) isTrashDir(
+	parent fuseops.InodeID,
+	name string) bool {
+	return fs.softDeleted != nil &&
+		parent == fuseops.RootInodeID &&
+		name == inode.TrashDirName
+}
+
+// Is the inode with the supplied ID within the trash?
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) inTrash(id fuseops.InodeID) bool {
+	if fs.softDeleted == nil {
+		return false
+	}
+
+	fs.mu.Lock()
+	in := fs.inodes[id]
+	fs.mu.Unlock()
+
+	return in != nil && inode.IsTrashName(in.Name())
+}
+
+// An opInterceptor that fails ops that would modify the trash with EROFS, and
+// attempts to open the soft-deleted objects within it with EACCES, since GCS
+// doesn't serve their contents.
+func (fs *fileSystem) protectTrash(
+	ctx context.Context,
+	op interface{},
+	next func(context.Context) error) (err error) {
+	var modifies bool
+	switch typed := op.(type) {
+	case *fuseops.MkDirOp:
+		modifies = fs.inTrash(typed.Parent) || fs.isTrashDir(typed.Parent, typed.Name)
+
+	case *fuseops.MkNodeOp:
+		modifies = fs.inTrash(typed.Parent) || fs.isTrashDir(typed.Parent, typed.Name)
+
+	case *fuseops.CreateFileOp:
+		modifies = fs.inTrash(typed.Parent) || fs.isTrashDir(typed.Parent, typed.Name)
+
+	case *fuseops.CreateSymlinkOp:
+		modifies = fs.inTrash(typed.Parent) || fs.isTrashDir(typed.Parent, typed.Name)
+
+	case *fuseops.UnlinkOp:
+		modifies = fs.inTrash(typed.Parent) || fs.isTrashDir(typed.Parent, typed.Name)
+
+	case *fuseops.RmDirOp:
+		modifies = fs.inTrash(typed.Parent) || fs.isTrashDir(typed.Parent, typed.Name)
+
+	// Renaming out of the trash is allowed; see restoreFromTrash.
+	case *fuseops.RenameOp:
+		modifies = fs.isTrashDir(typed.OldParent, typed.OldName) ||
+			fs.inTrash(typed.NewParent) ||
+			fs.isTrashDir(typed.NewParent, typed.NewName)
+
+	case *fuseops.SetInodeAttributesOp:
+		modifies = (typed.Size != nil || typed.Mtime != nil) && fs.inTrash(typed.Inode)
+
+	case *fuseops.SetXattrOp:
+		modifies = fs.inTrash(typed.Inode)
+
+	case *fuseops.RemoveXattrOp:
+		modifies = fs.inTrash(typed.Inode)
+
+	case *fuseops.OpenFileOp:
+		if fs.inTrash(typed.Inode) {
+			err = syscall.EACCES
+			return
+		}
+	}
+
+	if modifies {
+		err = syscall.EROFS
+		return
+	}
+
+	err = next(ctx)
+	return
+}
+
+// Respond to a lookup of the trash directory.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) lookUpTrashDir(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	// The trash directory always exists, and is never backed by an object, so
+	// the lookup can't be stale.
+	fs.mu.Lock()
+	in := fs.lookUpOrCreateInodeIfNotStale(inode.TrashDirName+"/", nil)
+	defer fs.unlockAndMaybeDisposeOfInode(in, &err)
+
+	// Fill out the response.
+	e := &op.Entry
+	e.Child = in.ID()
+	e.Generation = generationNumber(in)
+	e.EntryExpiration = fs.entryExpiration()
+	e.Attributes, e.AttributesExpiration, err = fs.getAttributes(ctx, in)
+
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Restore the soft-deleted object that is the named child of oldParent, a
+// directory within the trash, and then move it to the named child of
+// newParent if that isn't where it came from. GCS restores objects under their
+// own names, refusing to replace a live object, so we fail with EEXIST if
+// there is one. Directories would have to be restored one object at a time,
+// leaving a mess if interrupted, so we fail for them with ENOSYS.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(oldParent)
+// LOCKS_EXCLUDED(newParent)
+func (fs *fileSystem) restoreFromTrash(
+	ctx context.Context,
+	oldParent inode.DirInode,
+	oldName string,
+	newParent inode.DirInode,
+	newName string) (err error) {
+	// Find the soft-deleted object.
+	oldParent.Lock()
+	lr, err := oldParent.LookUpChild(ctx, oldName)
+	oldParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	if !lr.Exists() {
+		err = fuse.ENOENT
+		return
+	}
+
+	if lr.Object == nil {
+		err = fuse.ENOSYS
+		return
+	}
+
+	// Restore it.
+	o, err := fs.softDeleted.RestoreObject(
+		ctx,
+		inode.TrashObjectName(lr.Object.Name),
+		lr.Object.Generation)
+
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		err = fuse.EEXIST
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("RestoreObject: %v", err)
+		return
+	}
+
+	// Is that where it was wanted?
+	newParent.Lock()
+	dst, err := newParent.LookUpChild(ctx, newName)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("LookUpChild: %v", err)
+		return
+	}
+
+	if dst.Object != nil && dst.Object.Name == o.Name {
+		return
+	}
+
+	// If not, move it there as Rename does, deleting exactly the generation we
+	// restored.
+	newParent.Lock()
+	_, err = newParent.CloneToChildFile(ctx, newName, o)
+	newParent.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("CloneToChildFile: %v", err)
+		return
+	}
+
+	err = fs.bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{
+			Name:                       o.Name,
+			Generation:                 o.Generation,
+			MetaGenerationPrecondition: &o.MetaGeneration,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("DeleteObject: %v", err)
+		return
+	}
+
+	return
+}
@@ -0,0 +1,315 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestTrash(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A storage.SoftDeleted that holds a fixed set of soft-deleted objects, and
+// restores them by creating them in the bucket as GCS would.
+type fakeSoftDeleted struct {
+	bucket  gcs.Bucket
+	objects []*gcs.Object
+}
+
+func (sd *fakeSoftDeleted) ListSoftDeleted(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing = &gcs.Listing{}
+	seen := make(map[string]bool)
+	for _, o := range sd.objects {
+		if !strings.HasPrefix(o.Name, req.Prefix) {
+			continue
+		}
+
+		rest := o.Name[len(req.Prefix):]
+		i := strings.Index(rest, req.Delimiter)
+		if req.Delimiter == "" || i < 0 {
+			listing.Objects = append(listing.Objects, o)
+			continue
+		}
+
+		p := req.Prefix + rest[:i+len(req.Delimiter)]
+		if !seen[p] {
+			seen[p] = true
+			listing.CollapsedRuns = append(listing.CollapsedRuns, p)
+		}
+	}
+
+	sort.Strings(listing.CollapsedRuns)
+	return
+}
+
+func (sd *fakeSoftDeleted) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64) (o *gcs.Object, err error) {
+	for i, d := range sd.objects {
+		if d.Name != name || d.Generation != generation {
+			continue
+		}
+
+		var zero int64
+		o, err = sd.bucket.CreateObject(
+			ctx,
+			&gcs.CreateObjectRequest{
+				Name:                   name,
+				Contents:               strings.NewReader(""),
+				GenerationPrecondition: &zero,
+			})
+
+		if err != nil {
+			return
+		}
+
+		sd.objects = append(sd.objects[:i], sd.objects[i+1:]...)
+		return
+	}
+
+	err = &gcs.NotFoundError{Err: errors.New("no such soft-deleted object")}
+	return
+}
+
+var errNext = errors.New("next called")
+
+// For use with protectTrash.
+func next(ctx context.Context) error {
+	return errNext
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for the trash directory, calling the file system's methods directly as
+// the kernel would.
+type TrashTest struct {
+	directFsTest
+	softDeleted fakeSoftDeleted
+	deleted     time.Time
+}
+
+func init() { RegisterTestSuite(&TrashTest{}) }
+
+func (t *TrashTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ImplicitDirectories = true
+	t.serverCfg.SoftDeleted = &t.softDeleted
+	t.directFsTest.SetUp(ti)
+
+	t.deleted = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// Live objects, including one shadowed by the trash.
+	err := gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{
+			"dir/live",
+			".trash/shadowed",
+		})
+
+	AssertEq(nil, err)
+
+	// Soft-deleted objects, two of them generations of the same name.
+	t.softDeleted = fakeSoftDeleted{
+		bucket: t.bucket,
+		objects: []*gcs.Object{
+			{Name: "baz", Generation: 1, Deleted: t.deleted},
+			{Name: "dir/foo", Generation: 1, Deleted: t.deleted},
+			{Name: "dir/foo", Generation: 2, Deleted: t.deleted.Add(time.Hour)},
+			{Name: "dir/sub/bar", Generation: 1, Deleted: t.deleted},
+		},
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TrashTest) LookUpTrash() {
+	e := t.lookUpPath(".trash")
+	ExpectTrue(e.Attributes.Mode.IsDir())
+	ExpectEq(0, e.Attributes.Mode&0222)
+}
+
+func (t *TrashTest) LookUpFile() {
+	e := t.lookUpPath(".trash/dir/foo")
+	ExpectTrue(e.Attributes.Mode.IsRegular())
+	ExpectEq(0444, e.Attributes.Mode)
+
+	// The newest generation is shown.
+	ExpectThat(e.Attributes.Ctime, timeutil.TimeEq(t.deleted.Add(time.Hour)))
+}
+
+func (t *TrashTest) LookUpMissing() {
+	trash := t.lookUpPath(".trash")
+
+	_, err := t.lookUpIn(trash.Child, "shadowed")
+	ExpectEq(fuse.ENOENT, err)
+
+	_, err = t.lookUpIn(trash.Child, "live")
+	ExpectEq(fuse.ENOENT, err)
+}
+
+func (t *TrashTest) ReadDir() {
+	ExpectThat(t.readDir(fuseops.RootInodeID), ElementsAre("dir"))
+
+	trash := t.lookUpPath(".trash")
+	ExpectThat(t.readDir(trash.Child), ElementsAre("baz", "dir"))
+
+	dir := t.lookUpPath(".trash/dir")
+	ExpectThat(t.readDir(dir.Child), ElementsAre("foo", "sub"))
+}
+
+func (t *TrashTest) ModificationsAreRefused() {
+	trash := t.lookUpPath(".trash")
+	dir := t.lookUpPath(".trash/dir")
+
+	ops := []interface{}{
+		&fuseops.CreateFileOp{Parent: dir.Child, Name: "new"},
+		&fuseops.MkDirOp{Parent: trash.Child, Name: "new"},
+		&fuseops.UnlinkOp{Parent: dir.Child, Name: "foo"},
+		&fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: ".trash"},
+		&fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   "baz",
+			NewParent: dir.Child,
+			NewName:   "baz",
+		},
+	}
+
+	for _, op := range ops {
+		err := t.fs.protectTrash(t.ctx, op, next)
+		ExpectEq(syscall.EROFS, err, "op: %T", op)
+	}
+}
+
+func (t *TrashTest) OpenIsRefused() {
+	f := t.lookUpPath(".trash/baz")
+
+	err := t.fs.protectTrash(t.ctx, &fuseops.OpenFileOp{Inode: f.Child}, next)
+	ExpectEq(syscall.EACCES, err)
+}
+
+func (t *TrashTest) OtherOpsPass() {
+	f := t.lookUpPath("dir/live")
+
+	err := t.fs.protectTrash(t.ctx, &fuseops.OpenFileOp{Inode: f.Child}, next)
+	ExpectEq(errNext, err)
+
+	err = t.fs.protectTrash(
+		t.ctx,
+		&fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "new"},
+		next)
+
+	ExpectEq(errNext, err)
+}
+
+func (t *TrashTest) RestoreInPlace() {
+	trash := t.lookUpPath(".trash")
+	dir := t.lookUpPath("dir")
+
+	err := t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: trash.Child,
+			OldName:   "baz",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "baz",
+		})
+
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "baz"})
+	ExpectEq(nil, err)
+	ExpectThat(t.readDir(trash.Child), ElementsAre("dir"))
+	ExpectThat(t.readDir(dir.Child), ElementsAre("live"))
+}
+
+func (t *TrashTest) RestoreElsewhere() {
+	dir := t.lookUpPath(".trash/dir")
+
+	err := t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: dir.Child,
+			OldName:   "foo",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "restored",
+		})
+
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "restored"})
+	ExpectEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "dir/foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// The older generation is still in the trash.
+	e := t.lookUpPath(".trash/dir/foo")
+	ExpectThat(e.Attributes.Ctime, timeutil.TimeEq(t.deleted))
+}
+
+func (t *TrashTest) RestoreOverLiveObject() {
+	err := gcsutil.CreateEmptyObjects(t.ctx, t.bucket, []string{"baz"})
+	AssertEq(nil, err)
+
+	trash := t.lookUpPath(".trash")
+	err = t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: trash.Child,
+			OldName:   "baz",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "elsewhere",
+		})
+
+	ExpectEq(fuse.EEXIST, err)
+}
+
+func (t *TrashTest) RestoreDir() {
+	trash := t.lookUpPath(".trash")
+	err := t.fs.Rename(
+		t.ctx,
+		&fuseops.RenameOp{
+			OldParent: trash.Child,
+			OldName:   "dir",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "dir2",
+		})
+
+	ExpectEq(fuse.ENOSYS, err)
+}
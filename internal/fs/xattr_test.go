@@ -0,0 +1,551 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestXattr(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for extended attributes backed by placeholder object metadata,
+// calling the file system's methods directly as the kernel would.
+type XattrTest struct {
+	directFsTest
+}
+
+func init() { RegisterTestSuite(&XattrTest{}) }
+
+func (t *XattrTest) SetUp(ti *TestInfo) {
+	t.serverCfg.ImplicitDirectories = true
+	t.serverCfg.SignURL = func(object string) (string, error) {
+		return "https://example.com/" + object + "?signed", nil
+	}
+
+	t.directFsTest.SetUp(ti)
+
+	// Create a directory with a placeholder object, one without, and a file.
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "explicit/",
+			Contents: strings.NewReader(""),
+			Metadata: map[string]string{
+				"team": "taco",
+			},
+		})
+
+	AssertEq(nil, err)
+
+	err = gcsutil.CreateEmptyObjects(
+		t.ctx,
+		t.bucket,
+		[]string{"implicit/foo", "file"})
+
+	AssertEq(nil, err)
+}
+
+func (t *XattrTest) getXattr(
+	id fuseops.InodeID,
+	name string) (value string, err error) {
+	op := &fuseops.GetXattrOp{
+		Inode: id,
+		Name:  name,
+		Dst:   make([]byte, 1024),
+	}
+
+	err = t.fs.GetXattr(t.ctx, op)
+	value = string(op.Dst[:op.BytesRead])
+	return
+}
+
+func (t *XattrTest) listXattr(id fuseops.InodeID) (names []string) {
+	op := &fuseops.ListXattrOp{
+		Inode: id,
+		Dst:   make([]byte, 1024),
+	}
+
+	err := t.fs.ListXattr(t.ctx, op)
+	AssertEq(nil, err)
+
+	for _, n := range strings.Split(string(op.Dst[:op.BytesRead]), "\x00") {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+
+	return
+}
+
+func (t *XattrTest) setXattr(
+	id fuseops.InodeID,
+	name string,
+	value string,
+	flags uint32) error {
+	return t.fs.SetXattr(
+		t.ctx,
+		&fuseops.SetXattrOp{
+			Inode: id,
+			Name:  name,
+			Value: []byte(value),
+			Flags: flags,
+		})
+}
+
+func (t *XattrTest) removeXattr(id fuseops.InodeID, name string) error {
+	return t.fs.RemoveXattr(
+		t.ctx,
+		&fuseops.RemoveXattrOp{
+			Inode: id,
+			Name:  name,
+		})
+}
+
+// Return the metadata on the placeholder object.
+func (t *XattrTest) metadata() map[string]string {
+	o, err := t.bucket.StatObject(
+		t.ctx,
+		&gcs.StatObjectRequest{Name: "explicit/"})
+
+	AssertEq(nil, err)
+	return o.Metadata
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *XattrTest) Get() {
+	id := t.lookUp("explicit")
+
+	value, err := t.getXattr(id, "user.team")
+	AssertEq(nil, err)
+	ExpectEq("taco", value)
+
+	_, err = t.getXattr(id, "user.retention")
+	ExpectEq(fuse.ENOATTR, err)
+
+	_, err = t.getXattr(id, "security.capability")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Get_SizeQuery() {
+	id := t.lookUp("explicit")
+
+	op := &fuseops.GetXattrOp{
+		Inode: id,
+		Name:  "user.team",
+	}
+
+	err := t.fs.GetXattr(t.ctx, op)
+	ExpectEq(syscall.ERANGE, err)
+	ExpectEq(len("taco"), op.BytesRead)
+}
+
+func (t *XattrTest) Get_ChangedInBucket() {
+	id := t.lookUp("explicit")
+
+	value := "burrito"
+	_, err := t.bucket.UpdateObject(
+		t.ctx,
+		&gcs.UpdateObjectRequest{
+			Name:     "explicit/",
+			Metadata: map[string]*string{"team": &value},
+		})
+
+	AssertEq(nil, err)
+
+	actual, err := t.getXattr(id, "user.team")
+	AssertEq(nil, err)
+	ExpectEq("burrito", actual)
+}
+
+func (t *XattrTest) Get_SignedURL() {
+	value, err := t.getXattr(t.lookUp("file"), "user.gcsfuse.signed_url")
+	AssertEq(nil, err)
+	ExpectEq("https://example.com/file?signed", value)
+
+	// Directories have no such attribute.
+	_, err = t.getXattr(t.lookUp("explicit"), "user.gcsfuse.signed_url")
+	ExpectEq(fuse.ENOATTR, err)
+
+	_, err = t.getXattr(t.lookUp("implicit"), "user.gcsfuse.signed_url")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Get_StorageClass() {
+	value, err := t.getXattr(t.lookUp("file"), "user.gcsfuse.storage_class")
+	AssertEq(nil, err)
+	ExpectEq("STANDARD", value)
+
+	// Directories have no such attribute.
+	_, err = t.getXattr(t.lookUp("explicit"), "user.gcsfuse.storage_class")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Get_ObjectAttributes() {
+	id := t.lookUp("file")
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "file"})
+	AssertEq(nil, err)
+
+	value, err := t.getXattr(id, "user.gcsfuse.generation")
+	AssertEq(nil, err)
+	ExpectEq(fmt.Sprint(o.Generation), value)
+
+	value, err = t.getXattr(id, "user.gcsfuse.metageneration")
+	AssertEq(nil, err)
+	ExpectEq("1", value)
+
+	value, err = t.getXattr(id, "user.gcsfuse.storage_class_updated")
+	AssertEq(nil, err)
+	ExpectEq(o.StorageClassUpdated.UTC().Format(time.RFC3339Nano), value)
+
+	// Updates made through the mount are reflected.
+	err = t.setXattr(id, "user.gcsfuse.temporary_hold", "true", 0)
+	AssertEq(nil, err)
+
+	value, err = t.getXattr(id, "user.gcsfuse.metageneration")
+	AssertEq(nil, err)
+	ExpectEq("2", value)
+
+	// The attributes are read-only, and directories don't have them.
+	ExpectEq(syscall.EPERM, t.setXattr(id, "user.gcsfuse.generation", "1", 0))
+	ExpectEq(syscall.EPERM, t.removeXattr(id, "user.gcsfuse.metageneration"))
+
+	_, err = t.getXattr(t.lookUp("explicit"), "user.gcsfuse.generation")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) List() {
+	id := t.lookUp("explicit")
+
+	ExpectThat(t.listXattr(id), ElementsAre("user.team"))
+	ExpectThat(t.listXattr(t.lookUp("implicit")), ElementsAre())
+	ExpectThat(
+		t.listXattr(t.lookUp("file")),
+		ElementsAre(
+			"user.gcsfuse.generation",
+			"user.gcsfuse.metageneration",
+			"user.gcsfuse.storage_class",
+			"user.gcsfuse.storage_class_updated"))
+}
+
+func (t *XattrTest) Set() {
+	id := t.lookUp("explicit")
+
+	err := t.setXattr(id, "user.retention", "30d", 0)
+	AssertEq(nil, err)
+
+	err = t.setXattr(id, "user.team", "burrito", 0)
+	AssertEq(nil, err)
+
+	ExpectThat(
+		t.metadata(),
+		DeepEquals(map[string]string{
+			"team":      "burrito",
+			"retention": "30d",
+		}))
+
+	ExpectThat(
+		t.listXattr(id),
+		ElementsAre("user.retention", "user.team"))
+}
+
+func (t *XattrTest) Set_Flags() {
+	id := t.lookUp("explicit")
+
+	ExpectEq(fuse.EEXIST, t.setXattr(id, "user.team", "burrito", 0x1))
+	ExpectEq(fuse.ENOATTR, t.setXattr(id, "user.owner", "burrito", 0x2))
+
+	ExpectEq(nil, t.setXattr(id, "user.owner", "burrito", 0x1))
+	ExpectEq(nil, t.setXattr(id, "user.team", "burrito", 0x2))
+
+	ExpectThat(
+		t.metadata(),
+		DeepEquals(map[string]string{
+			"team":  "burrito",
+			"owner": "burrito",
+		}))
+}
+
+func (t *XattrTest) Set_Unsupported() {
+	ExpectEq(
+		syscall.ENOTSUP,
+		t.setXattr(t.lookUp("explicit"), "trusted.team", "burrito", 0))
+
+	ExpectEq(
+		syscall.ENOTSUP,
+		t.setXattr(t.lookUp("implicit"), "user.team", "burrito", 0))
+
+	ExpectEq(
+		syscall.ENOTSUP,
+		t.setXattr(t.lookUp("file"), "user.team", "burrito", 0))
+}
+
+func (t *XattrTest) Set_StorageClass() {
+	id := t.lookUp("file")
+
+	ExpectEq(syscall.EINVAL, t.setXattr(id, "user.gcsfuse.storage_class", "frozen", 0))
+	ExpectEq(fuse.EEXIST, t.setXattr(id, "user.gcsfuse.storage_class", "COLDLINE", 0x1))
+
+	err := t.setXattr(id, "user.gcsfuse.storage_class", "coldline", 0)
+	AssertEq(nil, err)
+
+	value, err := t.getXattr(id, "user.gcsfuse.storage_class")
+	AssertEq(nil, err)
+	ExpectEq("COLDLINE", value)
+
+	// The object is unaffected until the file's contents are written out.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "file"})
+	AssertEq(nil, err)
+	ExpectEq("STANDARD", o.StorageClass)
+
+	err = t.fs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{Inode: id, Data: []byte("taco")})
+
+	AssertEq(nil, err)
+
+	err = t.fs.SyncFile(t.ctx, &fuseops.SyncFileOp{Inode: id})
+	AssertEq(nil, err)
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "file"})
+	AssertEq(nil, err)
+	ExpectEq("COLDLINE", o.StorageClass)
+}
+
+func (t *XattrTest) Remove_StorageClass() {
+	id := t.lookUp("file")
+
+	err := t.setXattr(id, "user.gcsfuse.storage_class", "ARCHIVE", 0)
+	AssertEq(nil, err)
+
+	err = t.removeXattr(id, "user.gcsfuse.storage_class")
+	AssertEq(nil, err)
+
+	// Back to that of the object.
+	value, err := t.getXattr(id, "user.gcsfuse.storage_class")
+	AssertEq(nil, err)
+	ExpectEq("STANDARD", value)
+}
+
+func (t *XattrTest) Set_CustomTime() {
+	id := t.lookUp("file")
+
+	// There's none to begin with.
+	_, err := t.getXattr(id, "user.gcsfuse.custom_time")
+	ExpectEq(fuse.ENOATTR, err)
+	ExpectEq(fuse.ENOATTR, t.removeXattr(id, "user.gcsfuse.custom_time"))
+	ExpectEq(syscall.EINVAL, t.setXattr(id, "user.gcsfuse.custom_time", "soon", 0))
+
+	err = t.setXattr(id, "user.gcsfuse.custom_time", "2016-03-01T12:00:00Z", 0)
+	AssertEq(nil, err)
+
+	value, err := t.getXattr(id, "user.gcsfuse.custom_time")
+	AssertEq(nil, err)
+	ExpectEq("2016-03-01T12:00:00Z", value)
+
+	expected := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "file"})
+	AssertEq(nil, err)
+	ExpectThat(o.CustomTime, timeutil.TimeEq(expected))
+
+	// It shows up as the atime.
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: id}
+	err = t.fs.GetInodeAttributes(t.ctx, attrsOp)
+	AssertEq(nil, err)
+	ExpectThat(attrsOp.Attributes.Atime, timeutil.TimeEq(expected))
+
+	// It may only move forward, and can't be removed.
+	ExpectEq(
+		syscall.EINVAL,
+		t.setXattr(id, "user.gcsfuse.custom_time", "2016-02-01T12:00:00Z", 0))
+
+	ExpectEq(
+		fuse.EEXIST,
+		t.setXattr(id, "user.gcsfuse.custom_time", "2016-04-01T12:00:00Z", 0x1))
+
+	ExpectEq(syscall.EPERM, t.removeXattr(id, "user.gcsfuse.custom_time"))
+
+	err = t.setXattr(id, "user.gcsfuse.custom_time", "2016-04-01T12:00:00+09:00", 0x2)
+	AssertEq(nil, err)
+
+	value, err = t.getXattr(id, "user.gcsfuse.custom_time")
+	AssertEq(nil, err)
+	ExpectEq("2016-04-01T03:00:00Z", value)
+	ExpectThat(t.listXattr(id), Contains("user.gcsfuse.custom_time"))
+}
+
+func (t *XattrTest) Set_TemporaryHold() {
+	id := t.lookUp("file")
+	write := func() error {
+		return t.fs.WriteFile(
+			t.ctx,
+			&fuseops.WriteFileOp{Inode: id, Data: []byte("taco")})
+	}
+
+	_, err := t.getXattr(id, "user.gcsfuse.temporary_hold")
+	ExpectEq(fuse.ENOATTR, err)
+	ExpectEq(syscall.EINVAL, t.setXattr(id, "user.gcsfuse.temporary_hold", "maybe", 0))
+
+	// Place a hold.
+	err = t.setXattr(id, "user.gcsfuse.temporary_hold", "", 0)
+	AssertEq(nil, err)
+
+	value, err := t.getXattr(id, "user.gcsfuse.temporary_hold")
+	AssertEq(nil, err)
+	ExpectEq("true", value)
+	ExpectThat(t.listXattr(id), Contains("user.gcsfuse.temporary_hold"))
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "file"})
+	AssertEq(nil, err)
+	ExpectTrue(o.TemporaryHold)
+
+	// The file can't be modified while held.
+	ExpectEq(syscall.EPERM, write())
+
+	// Release it.
+	err = t.removeXattr(id, "user.gcsfuse.temporary_hold")
+	AssertEq(nil, err)
+	ExpectEq(fuse.ENOATTR, t.removeXattr(id, "user.gcsfuse.temporary_hold"))
+
+	o, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "file"})
+	AssertEq(nil, err)
+	ExpectFalse(o.TemporaryHold)
+
+	// Now it can, but not be held with modifications outstanding.
+	AssertEq(nil, write())
+	ExpectEq(syscall.EBUSY, t.setXattr(id, "user.gcsfuse.temporary_hold", "true", 0))
+
+	err = t.fs.SyncFile(t.ctx, &fuseops.SyncFileOp{Inode: id})
+	AssertEq(nil, err)
+
+	err = t.setXattr(id, "user.gcsfuse.temporary_hold", "true", 0)
+	AssertEq(nil, err)
+
+	err = t.setXattr(id, "user.gcsfuse.temporary_hold", "false", 0)
+	AssertEq(nil, err)
+
+	_, err = t.getXattr(id, "user.gcsfuse.temporary_hold")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Set_Compose() {
+	id := t.lookUp("file")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "part1", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "part2", []byte("burrito"))
+	AssertEq(nil, err)
+
+	err = t.setXattr(id, "user.gcsfuse.compose", "part1\n/part2\n", 0)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "file")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+
+	attrsOp := &fuseops.GetInodeAttributesOp{Inode: id}
+	err = t.fs.GetInodeAttributes(t.ctx, attrsOp)
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), attrsOp.Attributes.Size)
+
+	// The file itself may be among the sources, and the others are untouched.
+	err = t.setXattr(id, "user.gcsfuse.compose", "file\npart1", 0)
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "file")
+	AssertEq(nil, err)
+	ExpectEq("tacoburritotaco", string(contents))
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "part2")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	// It can't be read back.
+	_, err = t.getXattr(id, "user.gcsfuse.compose")
+	ExpectEq(fuse.ENOATTR, err)
+}
+
+func (t *XattrTest) Set_Compose_Invalid() {
+	id := t.lookUp("file")
+
+	ExpectEq(syscall.EINVAL, t.setXattr(id, "user.gcsfuse.compose", "\n", 0))
+	ExpectEq(syscall.EINVAL, t.setXattr(id, "user.gcsfuse.compose", "explicit/", 0))
+	ExpectEq(
+		syscall.EINVAL,
+		t.setXattr(id, "user.gcsfuse.compose", strings.Repeat("file\n", 33), 0))
+
+	ExpectEq(fuse.ENOENT, t.setXattr(id, "user.gcsfuse.compose", "missing", 0))
+
+	// Local modifications would be lost.
+	err := t.fs.WriteFile(
+		t.ctx,
+		&fuseops.WriteFileOp{Inode: id, Data: []byte("taco")})
+
+	AssertEq(nil, err)
+	ExpectEq(syscall.EBUSY, t.setXattr(id, "user.gcsfuse.compose", "file", 0))
+}
+
+func (t *XattrTest) Set_KeepsInode() {
+	id := t.lookUp("explicit")
+
+	err := t.setXattr(id, "user.team", "burrito", 0)
+	AssertEq(nil, err)
+
+	// The placeholder's meta-generation has changed, but because we changed it
+	// the directory keeps its inode.
+	ExpectEq(id, t.lookUp("explicit"))
+}
+
+func (t *XattrTest) Set_PlaceholderDeleted() {
+	id := t.lookUp("explicit")
+
+	err := t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "explicit/"})
+
+	AssertEq(nil, err)
+
+	ExpectEq(fuse.ENOENT, t.setXattr(id, "user.team", "burrito", 0))
+}
+
+func (t *XattrTest) Remove() {
+	id := t.lookUp("explicit")
+
+	err := t.removeXattr(id, "user.team")
+	AssertEq(nil, err)
+	ExpectThat(t.metadata(), DeepEquals(map[string]string{}))
+
+	ExpectEq(fuse.ENOATTR, t.removeXattr(id, "user.team"))
+	ExpectEq(fuse.ENOATTR, t.removeXattr(t.lookUp("file"), "user.team"))
+}
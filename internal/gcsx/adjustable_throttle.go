@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/ratelimit"
+	"golang.org/x/net/context"
+)
+
+// A ratelimit.Throttle whose rate can be changed while it is in use, for
+// limits that are reloaded at run time. Like the throttles of package
+// ratelimit, it is a token bucket judged by time.Now, with a capacity chosen
+// by ratelimit.ChooseTokenBucketCapacity.
+//
+// The capacity reported by the throttle is fixed at creation, so that callers
+// may keep using it to size their requests, even though the bucket itself is
+// resized with the rate. Requests larger than the current bucket are
+// accepted, and simply leave it further in debt.
+//
+// Safe for concurrent access.
+type AdjustableThrottle struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	window    time.Duration
+	startTime time.Time
+	capacity  uint64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The rate at which the bucket fills, and the credit at which it is full.
+	//
+	// GUARDED_BY(mu)
+	rateHz    float64
+	maxCredit float64
+
+	// The credit in the bucket as of creditTime, negative while requests that
+	// have been let through are still being paid for.
+	//
+	// GUARDED_BY(mu)
+	credit     float64
+	creditTime ratelimit.MonotonicTime
+}
+
+// Create a throttle with the given initial rate in tokens per second, targeting
+// only a few percent error in each window of the given size. A rate that isn't
+// positive means no limit. The throttle starts full.
+func NewAdjustableThrottle(
+	rateHz float64,
+	window time.Duration) (t *AdjustableThrottle, err error) {
+	t = &AdjustableThrottle{
+		window:    window,
+		startTime: time.Now(),
+	}
+
+	t.rateHz, t.capacity, err = t.chooseRate(rateHz)
+	if err != nil {
+		return
+	}
+
+	t.maxCredit = float64(t.capacity)
+	t.credit = t.maxCredit
+
+	return
+}
+
+// Change the rate of the throttle, with a rate that isn't positive meaning no
+// limit. Any credit built up at the old rate is discarded, so that a lowered
+// rate takes effect immediately, but requests already paid for at the old rate
+// are not charged again.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *AdjustableThrottle) SetRate(rateHz float64) (err error) {
+	rateHz, capacity, err := t.chooseRate(rateHz)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.fill(t.now())
+	if t.credit > 0 {
+		t.credit = 0
+	}
+
+	t.rateHz = rateHz
+	t.maxCredit = float64(capacity)
+
+	return
+}
+
+// Return the current rate of the throttle in tokens per second, zero meaning
+// no limit, and how long requests arriving now would have to wait for those
+// already let through to be paid for.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *AdjustableThrottle) State() (rateHz float64, backlog time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.fill(t.now())
+	if t.rateHz < unlimitedRateHz {
+		rateHz = t.rateHz
+	}
+
+	if t.credit < 0 {
+		backlog = time.Duration(-t.credit / t.rateHz * float64(time.Second))
+	}
+
+	return
+}
+
+func (t *AdjustableThrottle) Capacity() uint64 {
+	return t.capacity
+}
+
+// LOCKS_EXCLUDED(t.mu)
+func (t *AdjustableThrottle) Wait(
+	ctx context.Context,
+	tokens uint64) (err error) {
+	now := t.now()
+
+	// Deduct the tokens, and work out when the credit will be back to zero.
+	t.mu.Lock()
+	t.fill(now)
+	t.credit -= float64(tokens)
+
+	var delay time.Duration
+	if t.credit < 0 {
+		// Don't overflow for very large requests.
+		d := -t.credit / t.rateHz * float64(time.Second)
+		delay = time.Duration(math.MaxInt64)
+		if d < float64(math.MaxInt64) {
+			delay = time.Duration(d)
+		}
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+
+	case <-time.After(delay):
+		return
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// The rate standing in for no limit at all.
+const unlimitedRateHz = 1e15
+
+func (t *AdjustableThrottle) now() ratelimit.MonotonicTime {
+	return ratelimit.MonotonicTime(time.Now().Sub(t.startTime))
+}
+
+// Credit the tokens accumulated between creditTime and now, up to the
+// bucket's capacity.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *AdjustableThrottle) fill(now ratelimit.MonotonicTime) {
+	if now <= t.creditTime {
+		return
+	}
+
+	t.credit += t.rateHz * float64(now-t.creditTime) / float64(time.Second)
+	if !(t.credit <= t.maxCredit) {
+		t.credit = t.maxCredit
+	}
+
+	t.creditTime = now
+}
+
+func (t *AdjustableThrottle) chooseRate(
+	in float64) (rateHz float64, capacity uint64, err error) {
+	// Treat a disabled limit as a very large one.
+	rateHz = in
+	if !(rateHz > 0) {
+		rateHz = unlimitedRateHz
+	}
+
+	capacity, err = ratelimit.ChooseTokenBucketCapacity(rateHz, t.window)
+	if err != nil {
+		err = fmt.Errorf("ChooseTokenBucketCapacity: %v", err)
+		return
+	}
+
+	return
+}
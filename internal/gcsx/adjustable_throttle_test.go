@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestAdjustableThrottle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const adjustableThrottleWindow = time.Hour
+
+type AdjustableThrottleTest struct {
+	ctx context.Context
+	t   *AdjustableThrottle
+}
+
+var _ SetUpInterface = &AdjustableThrottleTest{}
+
+func init() { RegisterTestSuite(&AdjustableThrottleTest{}) }
+
+func (t *AdjustableThrottleTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	// Start out unlimited.
+	t.t, err = NewAdjustableThrottle(0, adjustableThrottleWindow)
+	AssertEq(nil, err)
+}
+
+// Return how long a call to Wait for the given number of tokens takes, giving
+// up after the given timeout.
+func (t *AdjustableThrottleTest) timeWait(
+	tokens uint64,
+	timeout time.Duration) (d time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(t.ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err = t.t.Wait(ctx, tokens)
+	d = time.Since(start)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AdjustableThrottleTest) Unlimited() {
+	for i := 0; i < 10; i++ {
+		_, err := t.timeWait(1<<30, time.Second)
+		AssertEq(nil, err)
+	}
+}
+
+func (t *AdjustableThrottleTest) RateLowered() {
+	capacity := t.t.Capacity()
+
+	err := t.t.SetRate(100)
+	AssertEq(nil, err)
+
+	// The capacity shouldn't change.
+	ExpectEq(capacity, t.t.Capacity())
+
+	// Ten tokens should take around a tenth of a second, with no credit left
+	// over from the old rate.
+	d, err := t.timeWait(10, 5*time.Second)
+	AssertEq(nil, err)
+	ExpectGe(d, 50*time.Millisecond)
+}
+
+func (t *AdjustableThrottleTest) LargeRequest() {
+	err := t.t.SetRate(1)
+	AssertEq(nil, err)
+
+	// A request for the original capacity is far larger than the bucket for the
+	// new rate. It should be accepted, and then take practically forever.
+	_, err = t.timeWait(t.t.Capacity(), 50*time.Millisecond)
+	ExpectTrue(err == context.DeadlineExceeded, "err: %v", err)
+}
+
+func (t *AdjustableThrottleTest) RateRaised() {
+	err := t.t.SetRate(1)
+	AssertEq(nil, err)
+
+	err = t.t.SetRate(0)
+	AssertEq(nil, err)
+
+	d, err := t.timeWait(1000, time.Second)
+	AssertEq(nil, err)
+	ExpectLt(d, 500*time.Millisecond)
+}
+
+func (t *AdjustableThrottleTest) State() {
+	// Unlimited.
+	rate, backlog := t.t.State()
+	ExpectEq(0, rate)
+	ExpectEq(0, backlog)
+
+	// Limited, with nothing let through yet.
+	err := t.t.SetRate(1)
+	AssertEq(nil, err)
+
+	rate, backlog = t.t.State()
+	ExpectEq(1, rate)
+	ExpectEq(0, backlog)
+
+	// A request that will take a while to pay for.
+	_, err = t.timeWait(100, time.Millisecond)
+	ExpectTrue(err == context.DeadlineExceeded, "err: %v", err)
+
+	_, backlog = t.t.State()
+	ExpectGt(backlog, 90*time.Second)
+	ExpectLe(backlog, 100*time.Second)
+}
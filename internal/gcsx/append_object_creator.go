@@ -32,7 +32,7 @@ import (
 // behind, but it may fail to do so. Users should arrange for garbage collection.
 //
 // Create guarantees to return *gcs.PreconditionError when the source object
-// has been clobbered.
+// has been clobbered, and *UnreachableError when GCS couldn't be reached.
 func newAppendObjectCreator(
 	prefix string,
 	bucket gcs.Bucket) (oc objectCreator) {
@@ -97,6 +97,7 @@ func (oc *appendObjectCreator) Create(
 			Name: tmpName,
 			GenerationPrecondition: &zero,
 			Contents:               r,
+			StorageClass:           srcObject.StorageClass,
 		})
 
 	// Don't mangle precondition errors.
@@ -110,7 +111,12 @@ func (oc *appendObjectCreator) Create(
 		return
 
 	default:
+		unreachable := isUnreachable(err)
 		err = fmt.Errorf("CreateObject: %v", err)
+		if unreachable {
+			err = &UnreachableError{Err: err}
+		}
+
 		return
 	}
 
@@ -148,6 +154,8 @@ func (oc *appendObjectCreator) Create(
 			Metadata: map[string]string{
 				MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
 			},
+			StorageClass: srcObject.StorageClass,
+			CustomTime:   srcObject.CustomTime,
 		})
 
 	switch typed := err.(type) {
@@ -171,7 +179,12 @@ func (oc *appendObjectCreator) Create(
 		return
 
 	default:
+		unreachable := isUnreachable(err)
 		err = fmt.Errorf("ComposeObjects: %v", err)
+		if unreachable {
+			err = &UnreachableError{Err: err}
+		}
+
 		return
 	}
 
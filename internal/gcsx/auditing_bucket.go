@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+type auditContextKey int
+
+const auditOpKey auditContextKey = 0
+
+// The file system operation on whose behalf requests are made.
+type auditOp struct {
+	name   string
+	caller *fuse.OpCaller
+}
+
+// Return a context that records the name of the file system operation on
+// whose behalf requests are made, and the process that called it if known,
+// for inclusion in audit records.
+func NewAuditContext(
+	parent context.Context,
+	op string,
+	caller *fuse.OpCaller) context.Context {
+	return context.WithValue(parent, auditOpKey, auditOp{op, caller})
+}
+
+// A single line in the audit log.
+type AuditRecord struct {
+	Time string `json:"time"`
+
+	// The file system operation that caused the request, e.g. "Unlink", if
+	// known.
+	Op string `json:"op,omitempty"`
+
+	// The UID and PID of the process that called the operation, if known.
+	Uid *uint32 `json:"uid,omitempty"`
+	Pid *uint32 `json:"pid,omitempty"`
+
+	// The bucket method called, e.g. "DeleteObject".
+	Method string `json:"method"`
+
+	Object string `json:"object"`
+
+	// For creations, the generation created. For deletions, the generation
+	// requested, or zero for the latest.
+	Generation int64 `json:"generation"`
+
+	// The source object, for copies.
+	Source string `json:"source,omitempty"`
+
+	// "OK", or the error returned.
+	Result string `json:"result"`
+}
+
+// Create a bucket that writes a JSON AuditRecord line to w for each request
+// that modifies an object. Reads are passed through unrecorded.
+func NewAuditingBucket(
+	clock timeutil.Clock,
+	w io.Writer,
+	wrapped gcs.Bucket) gcs.Bucket {
+	return &auditingBucket{
+		Bucket: wrapped,
+		clock:  clock,
+		w:      w,
+	}
+}
+
+type auditingBucket struct {
+	gcs.Bucket
+	clock timeutil.Clock
+
+	mu sync.Mutex
+	w  io.Writer // GUARDED_BY(mu)
+}
+
+func (b *auditingBucket) record(
+	ctx context.Context,
+	r AuditRecord,
+	err error) {
+	r.Time = b.clock.Now().Format(time.RFC3339Nano)
+	op, _ := ctx.Value(auditOpKey).(auditOp)
+	r.Op = op.name
+	if op.caller != nil {
+		r.Uid = &op.caller.Uid
+		r.Pid = &op.caller.Pid
+	}
+
+	r.Result = "OK"
+	if err != nil {
+		r.Result = err.Error()
+	}
+
+	buf, jsonErr := json.Marshal(&r)
+	if jsonErr != nil {
+		panic(jsonErr)
+	}
+
+	buf = append(buf, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// There's nothing useful to be done with a write error.
+	b.w.Write(buf)
+}
+
+func (b *auditingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+
+	r := AuditRecord{Method: "CreateObject", Object: req.Name}
+	if o != nil {
+		r.Generation = o.Generation
+	}
+
+	b.record(ctx, r, err)
+	return
+}
+
+func (b *auditingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+
+	r := AuditRecord{
+		Method: "CopyObject",
+		Object: req.DstName,
+		Source: req.SrcName,
+	}
+
+	if o != nil {
+		r.Generation = o.Generation
+	}
+
+	b.record(ctx, r, err)
+	return
+}
+
+func (b *auditingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+
+	r := AuditRecord{Method: "ComposeObjects", Object: req.DstName}
+	if o != nil {
+		r.Generation = o.Generation
+	}
+
+	b.record(ctx, r, err)
+	return
+}
+
+func (b *auditingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.UpdateObject(ctx, req)
+
+	r := AuditRecord{Method: "UpdateObject", Object: req.Name}
+	if o != nil {
+		r.Generation = o.Generation
+	}
+
+	b.record(ctx, r, err)
+	return
+}
+
+func (b *auditingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.Bucket.DeleteObject(ctx, req)
+
+	r := AuditRecord{
+		Method:     "DeleteObject",
+		Object:     req.Name,
+		Generation: req.Generation,
+	}
+
+	b.record(ctx, r, err)
+	return
+}
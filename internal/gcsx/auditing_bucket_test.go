@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestAuditingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type AuditingBucketTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	buf    bytes.Buffer
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &AuditingBucketTest{}
+
+func init() { RegisterTestSuite(&AuditingBucketTest{}) }
+
+func (t *AuditingBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	t.bucket = gcsx.NewAuditingBucket(
+		&t.clock,
+		&t.buf,
+		gcsfake.NewFakeBucket(&t.clock, "some_bucket"))
+}
+
+// Parse the records written so far.
+func (t *AuditingBucketTest) records() (records []gcsx.AuditRecord) {
+	d := json.NewDecoder(&t.buf)
+	for d.More() {
+		var r gcsx.AuditRecord
+		AssertEq(nil, d.Decode(&r))
+		records = append(records, r)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AuditingBucketTest) ReadsNotRecorded() {
+	_, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	ExpectEq(0, t.buf.Len())
+}
+
+func (t *AuditingBucketTest) CreateObject() {
+	ctx := gcsx.NewAuditContext(
+		t.ctx,
+		"FlushFile",
+		&fuse.OpCaller{Uid: 1000, Gid: 1001, Pid: 17})
+
+	o, err := gcsutil.CreateObject(ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	records := t.records()
+	AssertEq(1, len(records))
+
+	r := records[0]
+	ExpectEq("2015-04-05T02:15:00Z", r.Time)
+	ExpectEq("FlushFile", r.Op)
+	AssertNe(nil, r.Uid)
+	ExpectEq(1000, *r.Uid)
+	AssertNe(nil, r.Pid)
+	ExpectEq(17, *r.Pid)
+	ExpectEq("CreateObject", r.Method)
+	ExpectEq("foo", r.Object)
+	ExpectEq(o.Generation, r.Generation)
+	ExpectEq("OK", r.Result)
+}
+
+func (t *AuditingBucketTest) CopyAndDelete() {
+	src, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	ctx := gcsx.NewAuditContext(t.ctx, "Rename", &fuse.OpCaller{})
+	dst, err := t.bucket.CopyObject(
+		ctx,
+		&gcs.CopyObjectRequest{SrcName: "foo", DstName: "bar"})
+	AssertEq(nil, err)
+
+	err = t.bucket.DeleteObject(
+		ctx,
+		&gcs.DeleteObjectRequest{Name: "foo", Generation: src.Generation})
+	AssertEq(nil, err)
+
+	records := t.records()
+	AssertEq(3, len(records))
+
+	ExpectEq("CopyObject", records[1].Method)
+	ExpectEq("Rename", records[1].Op)
+	ExpectEq("bar", records[1].Object)
+	ExpectEq("foo", records[1].Source)
+	ExpectEq(dst.Generation, records[1].Generation)
+
+	ExpectEq("DeleteObject", records[2].Method)
+	ExpectEq("Rename", records[2].Op)
+	ExpectThat(records[2].Uid, Pointee(Equals(0)))
+	ExpectEq("foo", records[2].Object)
+	ExpectEq(src.Generation, records[2].Generation)
+	ExpectEq("OK", records[2].Result)
+}
+
+func (t *AuditingBucketTest) FailureRecorded() {
+	var precond int64 = 17
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               bytes.NewReader(nil),
+			GenerationPrecondition: &precond,
+		})
+
+	AssertNe(nil, err)
+
+	records := t.records()
+	AssertEq(1, len(records))
+	ExpectEq("", records[0].Op)
+	ExpectEq(nil, records[0].Uid)
+	ExpectEq(nil, records[0].Pid)
+	ExpectEq("foo", records[0].Object)
+	ExpectEq(0, records[0].Generation)
+	ExpectEq(err.Error(), records[0].Result)
+}
@@ -0,0 +1,332 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// The minimum time between attempts to reauthenticate, so that a bucket that
+// legitimately refuses us some requests doesn't cause a storm of token
+// requests.
+const reauthInterval = time.Minute
+
+// A bucket that deals with GCS refusing our credentials part way through a
+// session, as happens when a token can't be renewed or a key is revoked.
+//
+// A request that fails with HTTP 401 or 403 is made once more after calling
+// the reauthenticate function, if any, to obtain fresh credentials, as long as
+// that wasn't done within the last minute. If GCS still refuses, Denied
+// reports true until a later request succeeds, and the first such failure is
+// logged along with what to do about it. Refusals are also recorded in the
+// context of the request, if it was derived from one returned by
+// RecordRefusals, so that a caller can tell them apart from other failures.
+//
+// Safe for concurrent access.
+type AuthBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	clock   timeutil.Clock
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	reauthenticate func() error
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The last time we called reauthenticate, or the zero time if never.
+	//
+	// GUARDED_BY(mu)
+	lastReauth time.Time
+
+	// Whether the last request to complete was refused.
+	//
+	// GUARDED_BY(mu)
+	denied bool
+}
+
+var _ gcs.Bucket = &AuthBucket{}
+
+// Create a bucket that calls reauthenticate, if non-nil, when the wrapped
+// bucket refuses our credentials.
+func NewAuthBucket(
+	reauthenticate func() error,
+	clock timeutil.Clock,
+	wrapped gcs.Bucket) (b *AuthBucket) {
+	b = &AuthBucket{
+		clock:          clock,
+		wrapped:        wrapped,
+		reauthenticate: reauthenticate,
+	}
+
+	return
+}
+
+// Return true if GCS refused the last request to complete because of our
+// credentials, even after trying to renew them.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *AuthBucket) Denied() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.denied
+}
+
+type refusalsKey struct{}
+
+// Return a context derived from parent in which AuthBucket records GCS refusing
+// a request made with it or a context derived from it, and a function that
+// reports whether it has done so.
+func RecordRefusals(
+	parent context.Context) (ctx context.Context, refused func() bool) {
+	flag := new(int32)
+	ctx = context.WithValue(parent, refusalsKey{}, flag)
+	refused = func() bool { return atomic.LoadInt32(flag) != 0 }
+	return
+}
+
+// Did GCS refuse a request because our credentials lack permission for the
+// object or prefix concerned? Unlike credentials that are refused outright,
+// this may affect only part of the bucket, as when the IAM policy of a managed
+// folder doesn't grant us access to it.
+func IsAccessDenied(err error) bool {
+	typed, ok := err.(*googleapi.Error)
+	return ok && typed.Code == http.StatusForbidden
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Did GCS refuse a request because of our credentials?
+func isAuthError(err error) bool {
+	typed, ok := err.(*googleapi.Error)
+	return ok &&
+		(typed.Code == http.StatusUnauthorized ||
+			typed.Code == http.StatusForbidden)
+}
+
+// Try to obtain fresh credentials, returning true if a request that was
+// refused is worth making again.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *AuthBucket) tryReauthenticate() (ok bool) {
+	if b.reauthenticate == nil {
+		return
+	}
+
+	b.mu.Lock()
+	now := b.clock.Now()
+	if !b.lastReauth.IsZero() && now.Sub(b.lastReauth) < reauthInterval {
+		b.mu.Unlock()
+		return
+	}
+
+	b.lastReauth = now
+	b.mu.Unlock()
+
+	logger.Infof("GCS refused our credentials. Renewing them.")
+	if err := b.reauthenticate(); err != nil {
+		logger.Errorf("Renewing credentials: %v", err)
+		return
+	}
+
+	ok = true
+	return
+}
+
+// Record the outcome of a request, logging the start of a run of refusals.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *AuthBucket) record(err error) {
+	// Responses from GCS other than refusals show that our credentials are
+	// accepted. Other errors, such as network errors, tell us nothing.
+	switch err.(type) {
+	case nil, *googleapi.Error, *gcs.NotFoundError, *gcs.PreconditionError:
+	default:
+		return
+	}
+
+	denied := isAuthError(err)
+
+	b.mu.Lock()
+	start := denied && !b.denied
+	b.denied = denied
+	b.mu.Unlock()
+
+	if start {
+		logger.Errorf(
+			"GCS refused gcsfuse's credentials for bucket %q: %v. File system "+
+				"operations will fail with EACCES until they are accepted again. "+
+				"Make sure that the service account or key file still exists and "+
+				"has access to the bucket, and that its tokens can be renewed; "+
+				"then remount if the problem persists. If only some directories "+
+				"are affected, check the IAM policies of any managed folders "+
+				"for them.",
+			b.wrapped.Name(),
+			err)
+	}
+}
+
+// Call f, reauthenticating if GCS refuses it and then calling it again if retry
+// is true, and record the outcome, including in ctx if GCS refused it.
+func (b *AuthBucket) call(
+	ctx context.Context,
+	retry bool,
+	f func() error) (err error) {
+	err = f()
+	if isAuthError(err) && b.tryReauthenticate() && retry {
+		err = f()
+	}
+
+	b.record(err)
+	if flag, ok := ctx.Value(refusalsKey{}).(*int32); ok && isAuthError(err) {
+		atomic.StoreInt32(flag, 1)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *AuthBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *AuthBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = b.call(ctx, true, func() (err error) {
+		rc, err = b.wrapped.NewReader(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	// We can only send the contents again if we can rewind them. Either way,
+	// later requests benefit from renewing the credentials.
+	seeker, canRewind := req.Contents.(io.Seeker)
+	var pos int64
+	if canRewind {
+		pos, err = seeker.Seek(0, io.SeekCurrent)
+		canRewind = err == nil
+	}
+
+	var attempts int
+	err = b.call(ctx, canRewind, func() (err error) {
+		attempts++
+		if attempts > 1 {
+			if _, err = seeker.Seek(pos, io.SeekStart); err != nil {
+				return
+			}
+		}
+
+		o, err = b.wrapped.CreateObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	err = b.call(ctx, true, func() (err error) {
+		o, err = b.wrapped.CopyObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	err = b.call(ctx, true, func() (err error) {
+		o, err = b.wrapped.ComposeObjects(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.call(ctx, true, func() (err error) {
+		o, err = b.wrapped.StatObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	err = b.call(ctx, true, func() (err error) {
+		listing, err = b.wrapped.ListObjects(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	err = b.call(ctx, true, func() (err error) {
+		o, err = b.wrapped.UpdateObject(ctx, req)
+		return
+	})
+
+	return
+}
+
+func (b *AuthBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.call(ctx, true, func() error {
+		return b.wrapped.DeleteObject(ctx, req)
+	})
+
+	return
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestAuthBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+var errUnauthorized = &googleapi.Error{Code: 401, Message: "unauthorized"}
+
+type AuthBucketTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	failing *failingBucket
+
+	// The number of times reauthenticate has been called, and the error it
+	// returns.
+	reauths   int
+	reauthErr error
+
+	bucket *gcsx.AuthBucket
+}
+
+var _ SetUpInterface = &AuthBucketTest{}
+
+func init() { RegisterTestSuite(&AuthBucketTest{}) }
+
+func (t *AuthBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.failing = &failingBucket{
+		Bucket: gcsfake.NewFakeBucket(&t.clock, "some_bucket"),
+	}
+
+	t.bucket = gcsx.NewAuthBucket(t.reauthenticate, &t.clock, t.failing)
+
+	_, err := gcsutil.CreateObject(t.ctx, t.failing.Bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+}
+
+func (t *AuthBucketTest) reauthenticate() error {
+	t.reauths++
+	return t.reauthErr
+}
+
+func (t *AuthBucketTest) stat() (err error) {
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *AuthBucketTest) Success() {
+	ExpectEq(nil, t.stat())
+	ExpectEq(0, t.reauths)
+	ExpectFalse(t.bucket.Denied())
+}
+
+func (t *AuthBucketTest) RefusedOnce() {
+	t.failing.failures = []error{errUnauthorized}
+
+	// We renew the credentials and try again, successfully.
+	ExpectEq(nil, t.stat())
+	ExpectEq(1, t.reauths)
+	ExpectEq(2, t.failing.calls)
+	ExpectFalse(t.bucket.Denied())
+}
+
+func (t *AuthBucketTest) RefusedAgain() {
+	t.failing.failures = []error{errUnauthorized, errForbidden}
+
+	ExpectEq(errForbidden, t.stat())
+	ExpectEq(1, t.reauths)
+	ExpectTrue(t.bucket.Denied())
+
+	// A later success clears the state.
+	ExpectEq(nil, t.stat())
+	ExpectFalse(t.bucket.Denied())
+}
+
+func (t *AuthBucketTest) ReauthenticateFails() {
+	t.failing.failures = []error{errUnauthorized}
+	t.reauthErr = errors.New("taco")
+
+	// There's no point trying again.
+	ExpectEq(errUnauthorized, t.stat())
+	ExpectEq(1, t.reauths)
+	ExpectEq(1, t.failing.calls)
+	ExpectTrue(t.bucket.Denied())
+}
+
+func (t *AuthBucketTest) ReauthenticatesAtMostOncePerMinute() {
+	t.failing.failures = []error{
+		errUnauthorized,
+		errUnauthorized,
+		errUnauthorized,
+		errUnauthorized,
+	}
+
+	ExpectEq(errUnauthorized, t.stat())
+	ExpectEq(1, t.reauths)
+
+	// Shortly after, we don't try again.
+	t.clock.AdvanceTime(30 * time.Second)
+	ExpectEq(errUnauthorized, t.stat())
+	ExpectEq(1, t.reauths)
+
+	// After a minute we do, and it works.
+	t.clock.AdvanceTime(30 * time.Second)
+	ExpectEq(nil, t.stat())
+	ExpectEq(2, t.reauths)
+	ExpectFalse(t.bucket.Denied())
+}
+
+func (t *AuthBucketTest) OtherErrorsDontCount() {
+	// Network errors tell us nothing about our credentials.
+	t.failing.failures = []error{errUnauthorized, errUnauthorized}
+	t.reauthErr = errors.New("taco")
+	t.stat()
+	AssertTrue(t.bucket.Denied())
+
+	t.failing.failures = []error{errors.New("connection reset")}
+	t.stat()
+	ExpectTrue(t.bucket.Denied())
+
+	// But other responses from GCS show that it accepted them.
+	t.failing.failures = []error{errUnavailable}
+	t.stat()
+	ExpectFalse(t.bucket.Denied())
+
+	// As does an object not being found.
+	t.failing.failures = []error{errUnauthorized}
+	t.clock.AdvanceTime(time.Hour)
+	t.stat()
+	AssertTrue(t.bucket.Denied())
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "bar"})
+	ExpectNe(nil, err)
+	ExpectFalse(t.bucket.Denied())
+}
+
+func (t *AuthBucketTest) CreateObject_RewindsContents() {
+	t.failing.failures = []error{errUnauthorized}
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "bar",
+			Contents: strings.NewReader("burrito"),
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(1, t.reauths)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.failing.Bucket, "bar")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *AuthBucketTest) CreateObject_CantRewind() {
+	t.failing.failures = []error{errUnauthorized}
+
+	// Contents that can't be rewound can't be sent again, but the credentials
+	// are still renewed for later requests.
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "bar",
+			Contents: struct{ io.Reader }{strings.NewReader("burrito")},
+		})
+
+	ExpectEq(errUnauthorized, err)
+	ExpectEq(1, t.reauths)
+	ExpectEq(1, t.failing.calls)
+}
+
+func (t *AuthBucketTest) RecordsRefusalsInContext() {
+	ctx, refused := gcsx.RecordRefusals(t.ctx)
+
+	// Other failures aren't recorded.
+	t.failing.failures = []error{errUnavailable}
+	_, err := t.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertNe(nil, err)
+	ExpectFalse(refused())
+
+	// Refusals are, even when made with a derived context.
+	t.failing.failures = []error{errForbidden, errForbidden}
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	_, err = t.bucket.StatObject(child, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(errForbidden, err)
+	ExpectTrue(refused())
+	ExpectTrue(gcsx.IsAccessDenied(err))
+
+	// But not in unrelated contexts.
+	_, otherRefused := gcsx.RecordRefusals(t.ctx)
+	ExpectFalse(otherRefused())
+	ExpectFalse(gcsx.IsAccessDenied(errUnauthorized))
+}
@@ -0,0 +1,502 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// A description of an object whose content is held in a ContentCache, stored
+// in a manifest beside the content.
+type CachedObject struct {
+	Bucket     string `json:"bucket"`
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+	Size       int64  `json:"size"`
+
+	// The checksum GCS reported for the generation, which the content matched
+	// when it was fetched.
+	CRC32C uint32 `json:"crc32c"`
+
+	// The modification time and metadata of the object when it was fetched.
+	Updated  time.Time         `json:"updated"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// The path to the cached content.
+	Path string `json:"-"`
+}
+
+// A directory holding copies of whole objects, each accompanied by a manifest
+// describing the generation it is a copy of, so that reads of that generation
+// can be served from local disk. The copies survive the death of the process,
+// so a later mount using the same directory starts with them. Objects are
+// added to the cache only by Insert.
+//
+// The directory must not be used by more than one process at once. Safe for
+// concurrent access.
+type ContentCache struct {
+	dir string
+
+	// If non-nil, used to encrypt cached content.
+	cipher *DiskCipher
+
+	// The total size of content beyond which Insert refuses to add more, or
+	// zero for no limit.
+	maxSize int64
+
+	mu sync.Mutex
+
+	// The cached objects, keyed by cacheKey.
+	//
+	// INVARIANT: size is the sum of the sizes of the objects
+	//
+	// GUARDED_BY(mu)
+	objects map[string]CachedObject
+	size    int64
+
+	// The number of reads served from the cache, and of those for objects it
+	// didn't have.
+	//
+	// GUARDED_BY(mu)
+	hits   uint64
+	misses uint64
+}
+
+const (
+	cachedContentPrefix = "cached_"
+	fetchingPrefix      = "fetching_"
+)
+
+// Create a cache in the supplied directory, creating it if necessary, and
+// adopt the content left there by earlier processes. Content left without a
+// manifest by a process that died while fetching it is discarded. If cipher
+// is non-nil, content is encrypted with it, and so must be the content left
+// by earlier processes.
+func NewContentCache(
+	dir string,
+	maxSize int64,
+	cipher *DiskCipher) (cc *ContentCache, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	cc = &ContentCache{
+		dir:     dir,
+		cipher:  cipher,
+		maxSize: maxSize,
+		objects: make(map[string]CachedObject),
+	}
+
+	err = cc.load()
+	if err != nil {
+		err = fmt.Errorf("load: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the directory holding the cache.
+func (cc *ContentCache) Dir() string {
+	return cc.dir
+}
+
+// Make sure the cache holds the content of the supplied generation of an
+// object in the supplied bucket, fetching it in full if not. The content is
+// checked against the size and CRC32C in the object record. Any other
+// generation of the object in the cache is replaced. Return whether anything
+// was fetched.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Insert(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	o *gcs.Object) (fetched bool, err error) {
+	key := cacheKey(bucket.Name(), o.Name)
+
+	// Is there anything to do? Reserve room for the content while we fetch it,
+	// so that concurrent inserts can't overfill the cache between them.
+	cc.mu.Lock()
+	prev, ok := cc.objects[key]
+	if ok && prev.Generation == o.Generation {
+		cc.mu.Unlock()
+		return
+	}
+
+	if cc.maxSize > 0 && cc.size+int64(o.Size) > cc.maxSize {
+		cc.mu.Unlock()
+		err = fmt.Errorf(
+			"caching %d bytes would take the cache over its limit of %d bytes",
+			o.Size,
+			cc.maxSize)
+		return
+	}
+
+	cc.size += int64(o.Size)
+	cc.mu.Unlock()
+
+	defer func() {
+		if err != nil {
+			cc.mu.Lock()
+			cc.size -= int64(o.Size)
+			cc.mu.Unlock()
+		}
+	}()
+
+	// Fetch the content.
+	c := CachedObject{
+		Bucket:     bucket.Name(),
+		Object:     o.Name,
+		Generation: o.Generation,
+		Size:       int64(o.Size),
+		CRC32C:     o.CRC32C,
+		Updated:    o.Updated,
+		Metadata:   o.Metadata,
+		Path:       filepath.Join(cc.dir, cachedContentPrefix+key),
+	}
+
+	tmp, err := cc.fetch(ctx, bucket, &c)
+	if err != nil {
+		return
+	}
+
+	// Put it in place of any previous generation, removing the old manifest
+	// first so that it never describes the new content.
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if prev, ok := cc.objects[key]; ok {
+		os.Remove(prev.Path + manifestSuffix)
+		cc.size -= prev.Size
+		delete(cc.objects, key)
+	}
+
+	err = os.Rename(tmp, c.Path)
+	if err != nil {
+		os.Remove(tmp)
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	err = writeManifest(c.Path+manifestSuffix, &c)
+	if err != nil {
+		os.Remove(c.Path)
+		err = fmt.Errorf("writeManifest: %v", err)
+		return
+	}
+
+	cc.objects[key] = c
+	fetched = true
+
+	return
+}
+
+// Open the cached content of the supplied generation of an object for reading,
+// if the cache holds it, counting a hit or miss. The content is seekable.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Open(
+	bucketName string,
+	name string,
+	generation int64) (rc io.ReadCloser, ok bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	c, found := cc.objects[cacheKey(bucketName, name)]
+	if !found || c.Generation != generation {
+		cc.misses++
+		return
+	}
+
+	f, err := os.Open(c.Path)
+	if err != nil {
+		cc.misses++
+		return
+	}
+
+	r, err := cc.cipher.newReader(f)
+	if err != nil {
+		f.Close()
+		cc.misses++
+		return
+	}
+
+	rc = struct {
+		io.ReadSeeker
+		io.Closer
+	}{r, f}
+
+	ok = true
+	cc.hits++
+
+	return
+}
+
+// Check that the cached content described by c, as returned by Objects, still
+// has the size and CRC32C recorded when it was fetched, returning an error
+// describing the problem if not.
+func (cc *ContentCache) Check(c CachedObject) (err error) {
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	r, err := cc.cipher.newReader(f)
+	if err != nil {
+		err = fmt.Errorf("newReader: %v", err)
+		return
+	}
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	n, err := io.Copy(h, r)
+	if err != nil {
+		err = fmt.Errorf("read: %v", err)
+		return
+	}
+
+	if n != c.Size || h.Sum32() != c.CRC32C {
+		err = fmt.Errorf(
+			"content has %d bytes with CRC32C %#08x, expected %d bytes with %#08x",
+			n,
+			h.Sum32(),
+			c.Size,
+			c.CRC32C)
+		return
+	}
+
+	return
+}
+
+// Discard the cached content described by c, unless it has been replaced by
+// another generation since c was returned by Objects.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Evict(c CachedObject) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := cacheKey(c.Bucket, c.Object)
+	if cur, ok := cc.objects[key]; ok && cur.Generation == c.Generation {
+		removeStaged(cur.Path)
+		cc.size -= cur.Size
+		delete(cc.objects, key)
+	}
+}
+
+// Discard any cached content of the supplied object.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Remove(bucketName string, name string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	key := cacheKey(bucketName, name)
+	if c, ok := cc.objects[key]; ok {
+		removeStaged(c.Path)
+		cc.size -= c.Size
+		delete(cc.objects, key)
+	}
+}
+
+// Return a description of the object in the cache with the supplied name, if
+// any, without counting a hit or miss.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Lookup(
+	bucketName string,
+	name string) (c CachedObject, ok bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	c, ok = cc.objects[cacheKey(bucketName, name)]
+	return
+}
+
+// Return a description of each object in the cache, in no particular order.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Objects() (objects []CachedObject) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	for _, c := range cc.objects {
+		objects = append(objects, c)
+	}
+
+	return
+}
+
+// Return the number of objects in the cache, their total size, and the
+// number of reads served from it and not.
+//
+// LOCKS_EXCLUDED(cc.mu)
+func (cc *ContentCache) Usage() (
+	objects int,
+	size int64,
+	hits uint64,
+	misses uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return len(cc.objects), cc.size, cc.hits, cc.misses
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the name by which the content of an object is known in the cache.
+// Object names may be longer than file names and contain slashes, so they are
+// hashed.
+func cacheKey(bucketName string, name string) string {
+	sum := sha256.Sum256([]byte(bucketName + "\x00" + name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Copy the content of the supplied object into a new file in the cache
+// directory, checking it against c. The caller owns the file, which lives at
+// the returned path.
+func (cc *ContentCache) fetch(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	c *CachedObject) (path string, err error) {
+	rc, err := bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:       c.Object,
+			Generation: c.Generation,
+		})
+
+	if err != nil {
+		err = fmt.Errorf("NewReader: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	osFile, err := ioutil.TempFile(cc.dir, fetchingPrefix)
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	path = osFile.Name()
+
+	// Clean up after ourselves if we fail.
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	f, err := cc.cipher.wrap(osFile)
+	if err != nil {
+		osFile.Close()
+		err = fmt.Errorf("wrap: %v", err)
+		return
+	}
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	n, err := io.Copy(f, io.TeeReader(rc, h))
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("copy: %v", err)
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	if n != c.Size || h.Sum32() != c.CRC32C {
+		err = fmt.Errorf(
+			"fetched %d bytes with CRC32C %#08x, expected %d bytes with %#08x",
+			n,
+			h.Sum32(),
+			c.Size,
+			c.CRC32C)
+		return
+	}
+
+	return
+}
+
+// Adopt the content described by the manifests in the cache directory, and
+// discard any other content. Must be called before the cache is shared.
+func (cc *ContentCache) load() (err error) {
+	entries, err := ioutil.ReadDir(cc.dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	manifests := make(map[string]bool)
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), manifestSuffix) {
+			manifests[strings.TrimSuffix(e.Name(), manifestSuffix)] = true
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(cc.dir, name)
+
+		switch {
+		case strings.HasPrefix(name, fetchingPrefix):
+			os.Remove(path)
+			continue
+
+		case !strings.HasPrefix(name, cachedContentPrefix) ||
+			strings.HasSuffix(name, manifestSuffix):
+			continue
+
+		case !manifests[name]:
+			os.Remove(path)
+			continue
+		}
+
+		var c CachedObject
+		err = readManifest(path+manifestSuffix, &c)
+		if err != nil {
+			err = fmt.Errorf("readManifest: %v", err)
+			return
+		}
+
+		c.Path = path
+		cc.objects[strings.TrimPrefix(name, cachedContentPrefix)] = c
+		cc.size += c.Size
+	}
+
+	return
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewContentCacheBucket creates a wrapper bucket that serves reads of specific
+// generations of objects from the supplied cache when it holds them, and
+// discards cached content of objects that are modified through it.
+func NewContentCacheBucket(cache *ContentCache, b gcs.Bucket) gcs.Bucket {
+	return contentCacheBucket{b, cache}
+}
+
+type contentCacheBucket struct {
+	gcs.Bucket
+	cache *ContentCache
+}
+
+func (b contentCacheBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	// Without a generation, we can't know whether the cache is up to date.
+	if req.Generation == 0 {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	cached, ok := b.cache.Open(b.Name(), req.Name, req.Generation)
+	if !ok {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	if req.Range == nil {
+		rc = cached
+		return
+	}
+
+	// Serve the requested range.
+	_, err = cached.(io.Seeker).Seek(int64(req.Range.Start), io.SeekStart)
+	if err != nil {
+		cached.Close()
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	var r io.Reader = cached
+	if req.Range.Limit > req.Range.Start {
+		r = io.LimitReader(r, int64(req.Range.Limit-req.Range.Start))
+	} else {
+		r = io.LimitReader(r, 0)
+	}
+
+	rc = struct {
+		io.Reader
+		io.Closer
+	}{r, cached}
+
+	return
+}
+
+func (b contentCacheBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CreateObject(ctx, req)
+	if err == nil {
+		b.cache.Remove(b.Name(), req.Name)
+	}
+
+	return
+}
+
+func (b contentCacheBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.CopyObject(ctx, req)
+	if err == nil {
+		b.cache.Remove(b.Name(), req.DstName)
+	}
+
+	return
+}
+
+func (b contentCacheBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	if err == nil {
+		b.cache.Remove(b.Name(), req.DstName)
+	}
+
+	return
+}
+
+func (b contentCacheBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	err = b.Bucket.DeleteObject(ctx, req)
+	if err == nil {
+		b.cache.Remove(b.Name(), req.Name)
+	}
+
+	return
+}
@@ -0,0 +1,347 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestContentCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ContentCacheTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	cipher *gcsx.DiskCipher
+	dir    string
+
+	// The bucket behind the cache, and the caching layer in front of it.
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+	cache   *gcsx.ContentCache
+}
+
+var _ SetUpInterface = &ContentCacheTest{}
+var _ TearDownInterface = &ContentCacheTest{}
+
+func init() { RegisterTestSuite(&ContentCacheTest{}) }
+
+func (t *ContentCacheTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "content_cache_test")
+	AssertEq(nil, err)
+
+	t.reopen(0)
+}
+
+func (t *ContentCacheTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// Open the cache directory afresh, as a new mount would.
+func (t *ContentCacheTest) reopen(maxSize int64) {
+	var err error
+	t.cache, err = gcsx.NewContentCache(
+		filepath.Join(t.dir, "cache"),
+		maxSize,
+		t.cipher)
+
+	AssertEq(nil, err)
+	t.bucket = gcsx.NewContentCacheBucket(t.cache, t.wrapped)
+}
+
+func (t *ContentCacheTest) create(name string, contents string) *gcs.Object {
+	o, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte(contents))
+	AssertEq(nil, err)
+
+	return o
+}
+
+// Read the supplied range of a generation of an object through the caching
+// layer.
+func (t *ContentCacheTest) read(
+	name string,
+	generation int64,
+	r *gcs.ByteRange) (s string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: generation,
+			Range:      r,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	s = string(b)
+
+	return
+}
+
+// Delete an object behind the cache's back, so that reads of it succeed only
+// if they are served from the cache.
+func (t *ContentCacheTest) deleteBehindBack(name string) {
+	err := t.wrapped.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+	AssertEq(nil, err)
+}
+
+// The same tests, for a cache whose content is encrypted.
+type EncryptedContentCacheTest struct {
+	ContentCacheTest
+}
+
+func init() { RegisterTestSuite(&EncryptedContentCacheTest{}) }
+
+func (t *EncryptedContentCacheTest) SetUp(ti *TestInfo) {
+	var err error
+	t.cipher, err = gcsx.NewDiskCipher([]byte(strings.Repeat("k", 32)))
+	AssertEq(nil, err)
+
+	t.ContentCacheTest.SetUp(ti)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ContentCacheTest) ServesCachedGeneration() {
+	o := t.create("foo", "taco burrito")
+
+	fetched, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+	ExpectTrue(fetched)
+
+	t.deleteBehindBack("foo")
+
+	s, err := t.read("foo", o.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco burrito", s)
+
+	s, err = t.read("foo", o.Generation, &gcs.ByteRange{Start: 5, Limit: 8})
+	AssertEq(nil, err)
+	ExpectEq("bur", s)
+
+	s, err = t.read("foo", o.Generation, &gcs.ByteRange{Start: 5, Limit: 100})
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+
+	objects, size, hits, misses := t.cache.Usage()
+	ExpectEq(1, objects)
+	ExpectEq(len("taco burrito"), size)
+	ExpectEq(3, hits)
+	ExpectEq(0, misses)
+}
+
+func (t *ContentCacheTest) OtherGenerationsPassedOn() {
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	o2 := t.create("foo", "burrito")
+
+	s, err := t.read("foo", o2.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+
+	// Without a generation, the cache can't know whether it's up to date.
+	s, err = t.read("foo", 0, nil)
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+
+	_, _, hits, misses := t.cache.Usage()
+	ExpectEq(0, hits)
+	ExpectEq(1, misses)
+}
+
+func (t *ContentCacheTest) InsertIsIdempotent() {
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	fetched, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+	ExpectFalse(fetched)
+}
+
+func (t *ContentCacheTest) NewGenerationReplacesOld() {
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	o2 := t.create("foo", "burrito")
+	_, err = t.cache.Insert(t.ctx, t.wrapped, o2)
+	AssertEq(nil, err)
+
+	objects, size, _, _ := t.cache.Usage()
+	ExpectEq(1, objects)
+	ExpectEq(len("burrito"), size)
+
+	cached := t.cache.Objects()
+	AssertEq(1, len(cached))
+	ExpectEq(o2.Generation, cached[0].Generation)
+}
+
+func (t *ContentCacheTest) ChecksumMismatch() {
+	o := t.create("foo", "taco")
+	o.CRC32C++
+
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	ExpectThat(err, Error(HasSubstr("CRC32C")))
+
+	objects, size, _, _ := t.cache.Usage()
+	ExpectEq(0, objects)
+	ExpectEq(0, size)
+
+	// Nothing should be left behind.
+	entries, err := ioutil.ReadDir(t.cache.Dir())
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *ContentCacheTest) MaxSize() {
+	t.reopen(6)
+
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	o = t.create("bar", "burrito")
+	_, err = t.cache.Insert(t.ctx, t.wrapped, o)
+	ExpectThat(err, Error(HasSubstr("over its limit of 6 bytes")))
+}
+
+func (t *ContentCacheTest) ModificationsDiscardContent() {
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("burrito"))
+	AssertEq(nil, err)
+
+	objects, _, _, _ := t.cache.Usage()
+	ExpectEq(0, objects)
+}
+
+func (t *ContentCacheTest) SurvivesReopening() {
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	t.deleteBehindBack("foo")
+
+	// Simulate a crash while fetching another object.
+	err = ioutil.WriteFile(
+		filepath.Join(t.cache.Dir(), "fetching_123"),
+		[]byte("bur"),
+		0600)
+
+	AssertEq(nil, err)
+
+	t.reopen(0)
+
+	s, err := t.read("foo", o.Generation, nil)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+
+	_, err = os.Stat(filepath.Join(t.cache.Dir(), "fetching_123"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *EncryptedContentCacheTest) ContentIsEncrypted() {
+	o := t.create("foo", "taco burrito enchilada")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	cached := t.cache.Objects()
+	AssertEq(1, len(cached))
+
+	b, err := ioutil.ReadFile(cached[0].Path)
+	AssertEq(nil, err)
+	ExpectFalse(strings.Contains(string(b), "burrito"))
+}
+
+func (t *ContentCacheTest) CheckDetectsCorruption() {
+	o := t.create("foo", "taco burrito enchilada")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	cached := t.cache.Objects()
+	AssertEq(1, len(cached))
+	ExpectEq(nil, t.cache.Check(cached[0]))
+
+	// Flip a byte on disk.
+	f, err := os.OpenFile(cached[0].Path, os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 7)
+	AssertEq(nil, err)
+
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, 7)
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	ExpectNe(nil, t.cache.Check(cached[0]))
+}
+
+func (t *ContentCacheTest) EvictIgnoresReplacedContent() {
+	o := t.create("foo", "taco")
+	_, err := t.cache.Insert(t.ctx, t.wrapped, o)
+	AssertEq(nil, err)
+
+	old := t.cache.Objects()[0]
+
+	o2 := t.create("foo", "burrito")
+	_, err = t.cache.Insert(t.ctx, t.wrapped, o2)
+	AssertEq(nil, err)
+
+	t.cache.Evict(old)
+	objects, _, _, _ := t.cache.Usage()
+	ExpectEq(1, objects)
+
+	t.cache.Evict(t.cache.Objects()[0])
+	objects, size, _, _ := t.cache.Usage()
+	ExpectEq(0, objects)
+	ExpectEq(0, size)
+
+	entries, err := ioutil.ReadDir(t.cache.Dir())
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
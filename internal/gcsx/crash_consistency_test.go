@@ -0,0 +1,351 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCrashConsistency(t *testing.T) { RunTests(t) }
+
+var fCrashTrials = flag.Int(
+	"crash_trials",
+	200,
+	"Number of interrupted syncs to run in CrashConsistencyTest.")
+
+var fCrashSeed = flag.Int64(
+	"crash_seed",
+	0,
+	"Seed for CrashConsistencyTest, or zero to choose one based on the time.")
+
+////////////////////////////////////////////////////////////////////////
+// crashingBucket
+////////////////////////////////////////////////////////////////////////
+
+var errCrashed = errors.New("crashed")
+
+// A bucket that lets a fixed number of mutating requests through and then
+// "crashes", as if the process died at that point. The crash happens at a
+// random moment relative to the request: before it is sent, part way through
+// uploading its contents, or after it has taken effect but before the
+// response arrives. All later requests fail.
+type crashingBucket struct {
+	gcs.Bucket
+	rand *rand.Rand
+
+	// The number of mutating requests left before the crash, or -1 once
+	// crashed.
+	remaining int
+}
+
+// Called at the start of each mutating request. If a crash is due, return
+// the moment at which it should happen relative to the request.
+func (b *crashingBucket) crashPoint() (crash bool, when int) {
+	switch {
+	case b.remaining < 0:
+		crash = true
+
+	case b.remaining == 0:
+		crash = true
+		when = 1 + b.rand.Intn(3)
+		b.remaining = -1
+
+	default:
+		b.remaining--
+	}
+
+	return
+}
+
+const (
+	crashBefore = 1
+	crashDuring = 2
+	crashAfter  = 3
+)
+
+func (b *crashingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	crash, when := b.crashPoint()
+	if !crash {
+		o, err = b.Bucket.CreateObject(ctx, req)
+		return
+	}
+
+	switch when {
+	case crashDuring:
+		// Cut the upload off after a random prefix of its contents.
+		reqCopy := *req
+		reqCopy.Contents = &failingReader{
+			r: req.Contents,
+			n: b.rand.Int63n(1 << 16),
+		}
+
+		_, err = b.Bucket.CreateObject(ctx, &reqCopy)
+		if err == nil {
+			// The contents were shorter than the cut-off point, so the request
+			// went through and only the response was lost.
+			err = errCrashed
+		}
+
+	case crashAfter:
+		b.Bucket.CreateObject(ctx, req)
+		err = errCrashed
+
+	default:
+		err = errCrashed
+	}
+
+	return
+}
+
+func (b *crashingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	crash, when := b.crashPoint()
+	if !crash {
+		o, err = b.Bucket.ComposeObjects(ctx, req)
+		return
+	}
+
+	if when == crashAfter {
+		b.Bucket.ComposeObjects(ctx, req)
+	}
+
+	err = errCrashed
+	return
+}
+
+func (b *crashingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	crash, when := b.crashPoint()
+	if !crash {
+		err = b.Bucket.DeleteObject(ctx, req)
+		return
+	}
+
+	if when == crashAfter {
+		b.Bucket.DeleteObject(ctx, req)
+	}
+
+	err = errCrashed
+	return
+}
+
+// A reader that fails once n bytes have been read from r.
+type failingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (fr *failingReader) Read(p []byte) (n int, err error) {
+	if fr.n <= 0 {
+		err = errCrashed
+		return
+	}
+
+	if int64(len(p)) > fr.n {
+		p = p[:fr.n]
+	}
+
+	n, err = fr.r.Read(p)
+	fr.n -= int64(n)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const crashTmpObjectPrefix = ".gcsfuse_tmp/"
+
+type CrashConsistencyTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	seed  int64
+	rand  *rand.Rand
+}
+
+var _ SetUpInterface = &CrashConsistencyTest{}
+
+func init() { RegisterTestSuite(&CrashConsistencyTest{}) }
+
+func (t *CrashConsistencyTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.seed = *fCrashSeed
+	if t.seed == 0 {
+		t.seed = time.Now().UnixNano()
+	}
+
+	t.rand = rand.New(rand.NewSource(t.seed))
+}
+
+// Return n bytes of random content drawn from t.rand, so that a trial can be
+// reproduced from its seed.
+func (t *CrashConsistencyTest) randBytes(n int) (b []byte) {
+	b = make([]byte, n)
+	t.rand.Read(b)
+	return
+}
+
+// Modify the temp file in a random way that dirties it, applying the same
+// change to contents. Return the new contents.
+func (t *CrashConsistencyTest) mutate(
+	tf gcsx.TempFile,
+	contents []byte) (newContents []byte, err error) {
+	newContents = append([]byte(nil), contents...)
+
+	switch t.rand.Intn(3) {
+	// Append.
+	case 0:
+		data := t.randBytes(1 + t.rand.Intn(1<<16))
+		_, err = tf.WriteAt(data, int64(len(contents)))
+		newContents = append(newContents, data...)
+
+	// Overwrite somewhere, possibly extending.
+	case 1:
+		data := t.randBytes(1 + t.rand.Intn(1<<14))
+		off := t.rand.Intn(len(contents) + 1)
+		_, err = tf.WriteAt(data, int64(off))
+
+		if end := off + len(data); end > len(newContents) {
+			newContents = append(newContents, make([]byte, end-len(newContents))...)
+		}
+
+		copy(newContents[off:], data)
+
+	// Truncate, either shrinking or growing.
+	case 2:
+		n := t.rand.Intn(2*len(contents) + 1)
+		err = tf.Truncate(int64(n))
+
+		if n <= len(newContents) {
+			newContents = newContents[:n]
+		} else {
+			newContents = append(newContents, make([]byte, n-len(newContents))...)
+		}
+	}
+
+	// Make sure the temp file counts as dirty even if the change happened to
+	// be a no-op.
+	tf.SetMtime(t.clock.Now())
+
+	return
+}
+
+// Run a single sync that crashes after a random number of requests, then
+// check the state of the bucket.
+func (t *CrashConsistencyTest) runTrial(trial int) {
+	bucket := gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	// Create the object with some random contents.
+	const name = "foo"
+	oldContents := t.randBytes(t.rand.Intn(1 << 16))
+
+	src, err := gcsutil.CreateObject(t.ctx, bucket, name, oldContents)
+	AssertEq(nil, err)
+
+	// Load it into a temp file and dirty it.
+	tf, err := gcsx.NewTempFile(bytes.NewReader(oldContents), "", &t.clock)
+	AssertEq(nil, err)
+
+	newContents, err := t.mutate(tf, oldContents)
+	AssertEq(nil, err)
+
+	// Sync through a bucket that crashes part way. Choose between the append
+	// and full paths at random.
+	var appendThreshold int64
+	if t.rand.Intn(2) == 0 {
+		appendThreshold = math.MaxInt64
+	}
+
+	cb := &crashingBucket{
+		Bucket:    bucket,
+		rand:      t.rand,
+		remaining: t.rand.Intn(4),
+	}
+
+	syncer := gcsx.NewSyncer(appendThreshold, crashTmpObjectPrefix, cb, nil)
+	o, syncErr := syncer.SyncObject(t.ctx, src, "", tf)
+	if syncErr != nil || o == nil {
+		tf.Destroy()
+	}
+
+	// The object must hold either the old or the new contents in full.
+	actual, err := gcsutil.ReadObject(t.ctx, bucket, name)
+	AssertEq(nil, err, "seed %d, trial %d", t.seed, trial)
+
+	isOld := bytes.Equal(oldContents, actual)
+	isNew := bytes.Equal(newContents, actual)
+
+	AssertTrue(
+		isOld || isNew,
+		"seed %d, trial %d: object has %d bytes; old %d, new %d",
+		t.seed,
+		trial,
+		len(actual),
+		len(oldContents),
+		len(newContents))
+
+	// If the sync claimed success, it must have written the new contents.
+	if syncErr == nil {
+		AssertTrue(isNew, "seed %d, trial %d", t.seed, trial)
+	}
+
+	// Anything left behind must be a temporary object.
+	objects, _, err := gcsutil.ListAll(t.ctx, bucket, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+
+	for _, o := range objects {
+		if o.Name != name {
+			AssertTrue(
+				strings.HasPrefix(o.Name, crashTmpObjectPrefix),
+				"seed %d, trial %d: unexpected object %q",
+				t.seed,
+				trial,
+				o.Name)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *CrashConsistencyTest) OldOrNewContents() {
+	for i := 0; i < *fCrashTrials; i++ {
+		t.runTrial(i)
+	}
+}
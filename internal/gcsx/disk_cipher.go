@@ -0,0 +1,637 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Encrypts the content of dirty files that is written to local disk, both in
+// anonymous temp files and in a staging area, with AES-256-GCM under a key
+// supplied by the user, so that object data never rests there in the clear.
+// Each file is encrypted under a key of its own, derived from the user's.
+//
+// A nil *DiskCipher leaves content unencrypted. Safe for concurrent access.
+type DiskCipher struct {
+	key []byte
+}
+
+// The number of bytes of content sealed together. Content is encrypted in
+// chunks so that it can be read and modified at random offsets, at the cost
+// of a nonce and tag per chunk.
+const cipherChunkSize = 4096
+
+// The number of bytes of random salt at the start of each file, from which
+// the file's key is derived.
+const cipherSaltSize = 32
+
+// The info with which file keys are derived, per RFC 5869.
+var fileKeyInfo = []byte("gcsfuse disk cipher file key")
+
+// Create a cipher using the supplied AES-256 key.
+func NewDiskCipher(key []byte) (dc *DiskCipher, err error) {
+	if len(key) != 32 {
+		err = fmt.Errorf("Key is %d bytes long; expected 32", len(key))
+		return
+	}
+
+	dc = &DiskCipher{key: append([]byte(nil), key...)}
+	return
+}
+
+// Create a cipher using the key in the file at the supplied path, which must
+// hold 32 bytes encoded in base64, as generated by e.g. `openssl rand -base64
+// 32`.
+func ReadDiskCipher(path string) (dc *DiskCipher, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(
+		strings.TrimSpace(string(contents)))
+
+	if err != nil {
+		err = fmt.Errorf("Decoding %q: %v", path, err)
+		return
+	}
+
+	dc, err = NewDiskCipher(key)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return storage through which the content of f, which must be empty and
+// which the storage takes ownership of, is written. If dc is nil this is f
+// itself.
+func (dc *DiskCipher) wrap(f *os.File) (s tempStorage, err error) {
+	if dc == nil {
+		s = f
+		return
+	}
+
+	s, err = newEncryptedFile(f, dc)
+	return
+}
+
+// Return an AEAD using the key for the file with the supplied salt, derived
+// from ours with HKDF-SHA256 (RFC 5869). A single block of output is all an
+// AES-256 key needs.
+func (dc *DiskCipher) fileAEAD(salt []byte) (aead cipher.AEAD, err error) {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(dc.key)
+
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(fileKeyInfo)
+	expand.Write([]byte{1})
+
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		err = fmt.Errorf("NewCipher: %v", err)
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		err = fmt.Errorf("NewGCM: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return a reader for the content of f, from the start.
+func (dc *DiskCipher) newReader(f *os.File) (r io.ReadSeeker, err error) {
+	if dc == nil {
+		r = f
+		return
+	}
+
+	ef, err := openEncryptedFile(f, dc)
+	if err != nil {
+		return
+	}
+
+	r = io.NewSectionReader(ef, 0, ef.size)
+	return
+}
+
+// A tempStorage that keeps its content encrypted in a file, in chunks of
+// cipherChunkSize bytes. The file starts with a random salt from which its key
+// is derived. Each chunk follows as its nonce and the sealed content, with the
+// chunk's index as additional data so that chunks can't be moved around the
+// file unnoticed. Every chunk but the last is full.
+//
+// Nonces count the seals made under the file's key, so that none is used
+// twice however often chunks are rewritten.
+//
+// The chunks are followed by a trailer holding the size of the content,
+// sealed in the same way, so that truncating the file is noticed rather than
+// read as shorter content. Every chunk is sealed, including those filled with
+// zeros when the content is extended, so a chunk that doesn't authenticate is
+// always an error.
+//
+// Not safe for concurrent access.
+type encryptedFile struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	f    *os.File
+	aead cipher.AEAD
+
+	// Set for a file opened by openEncryptedFile, whose count of seals we
+	// don't know.
+	readOnly bool
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// The number of seals made under the file's key, from which the nonce of
+	// the next is made.
+	sealed uint64
+
+	// The size of the content, as recorded in the trailer.
+	//
+	// INVARIANT: size >= 0
+	size int64
+
+	// The seek position, which may be beyond the end of the content.
+	//
+	// INVARIANT: pos >= 0
+	pos int64
+}
+
+var _ tempStorage = &encryptedFile{}
+
+// The additional data with which the trailer is sealed, distinct from that of
+// any chunk.
+var trailerData = []byte("size")
+
+// Wrap f, which must be empty, recording empty content under a new key.
+func newEncryptedFile(
+	f *os.File,
+	dc *DiskCipher) (ef *encryptedFile, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	if fi.Size() != 0 {
+		err = fmt.Errorf("File has size %d; expected 0", fi.Size())
+		return
+	}
+
+	salt := make([]byte, cipherSaltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		err = fmt.Errorf("Generating salt: %v", err)
+		return
+	}
+
+	aead, err := dc.fileAEAD(salt)
+	if err != nil {
+		err = fmt.Errorf("fileAEAD: %v", err)
+		return
+	}
+
+	_, err = f.WriteAt(salt, 0)
+	if err != nil {
+		err = fmt.Errorf("WriteAt: %v", err)
+		return
+	}
+
+	ef = &encryptedFile{
+		f:    f,
+		aead: aead,
+	}
+
+	err = ef.writeTrailer()
+	return
+}
+
+// Wrap f for reading, whose existing content must have been written by an
+// encryptedFile using the same cipher.
+func openEncryptedFile(
+	f *os.File,
+	dc *DiskCipher) (ef *encryptedFile, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	// Derive the file's key from its salt.
+	if fi.Size() < cipherSaltSize {
+		err = fmt.Errorf("Truncated encrypted file of size %d", fi.Size())
+		return
+	}
+
+	salt := make([]byte, cipherSaltSize)
+	_, err = f.ReadAt(salt, 0)
+	if err != nil {
+		err = fmt.Errorf("ReadAt: %v", err)
+		return
+	}
+
+	aead, err := dc.fileAEAD(salt)
+	if err != nil {
+		err = fmt.Errorf("fileAEAD: %v", err)
+		return
+	}
+
+	ef = &encryptedFile{
+		f:        f,
+		aead:     aead,
+		readOnly: true,
+	}
+
+	// Read the size of the content from the trailer, and check that the chunks
+	// before it are all there.
+	if fi.Size() < ef.storedSize(0) {
+		err = fmt.Errorf("Truncated encrypted file of size %d", fi.Size())
+		return
+	}
+
+	stored := make([]byte, ef.trailerSize())
+	_, err = f.ReadAt(stored, fi.Size()-ef.trailerSize())
+	if err != nil {
+		err = fmt.Errorf("ReadAt: %v", err)
+		return
+	}
+
+	nonceSize := aead.NonceSize()
+	size, err := aead.Open(
+		nil,
+		stored[:nonceSize],
+		stored[nonceSize:],
+		trailerData)
+
+	if err != nil {
+		err = fmt.Errorf("Decrypting trailer: %v", err)
+		return
+	}
+
+	ef.size = int64(binary.BigEndian.Uint64(size))
+	if ef.size < 0 || ef.storedSize(ef.size) != fi.Size() {
+		err = fmt.Errorf(
+			"Encrypted file of size %d can't hold %d bytes",
+			fi.Size(),
+			ef.size)
+		return
+	}
+
+	return
+}
+
+func (ef *encryptedFile) Read(p []byte) (n int, err error) {
+	n, err = ef.ReadAt(p, ef.pos)
+	ef.pos += int64(n)
+
+	// Like *os.File, don't return io.EOF along with data.
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+
+	return
+}
+
+func (ef *encryptedFile) Write(p []byte) (n int, err error) {
+	n, err = ef.WriteAt(p, ef.pos)
+	ef.pos += int64(n)
+	return
+}
+
+func (ef *encryptedFile) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case 0:
+		pos = offset
+	case 1:
+		pos = ef.pos + offset
+	case 2:
+		pos = ef.size + offset
+	default:
+		err = fmt.Errorf("Invalid whence: %d", whence)
+		return
+	}
+
+	if pos < 0 {
+		err = errors.New("Negative seek position")
+		return
+	}
+
+	ef.pos = pos
+	return
+}
+
+func (ef *encryptedFile) ReadAt(p []byte, offset int64) (n int, err error) {
+	for n < len(p) {
+		off := offset + int64(n)
+		if off >= ef.size {
+			err = io.EOF
+			return
+		}
+
+		var chunk []byte
+		chunk, err = ef.readChunk(off / cipherChunkSize)
+		if err != nil {
+			return
+		}
+
+		n += copy(p[n:], chunk[off%cipherChunkSize:])
+	}
+
+	return
+}
+
+func (ef *encryptedFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	// Fill any gap with zeros first.
+	if offset > ef.size {
+		err = ef.Truncate(offset)
+		if err != nil {
+			return
+		}
+	}
+
+	// Record any growth in the trailer once we're done.
+	oldSize := ef.size
+	defer func() {
+		if ef.size != oldSize {
+			trailerErr := ef.writeTrailer()
+			if err == nil {
+				err = trailerErr
+			}
+		}
+	}()
+
+	for n < len(p) {
+		off := offset + int64(n)
+		i := off / cipherChunkSize
+		start := i * cipherChunkSize
+
+		// Read the chunk's existing content, if any, and overlay the new.
+		var chunk []byte
+		if start < ef.size {
+			chunk, err = ef.readChunk(i)
+			if err != nil {
+				return
+			}
+		}
+
+		end := minInt64(start+cipherChunkSize, offset+int64(len(p)))
+		if int64(len(chunk)) < end-start {
+			chunk = append(chunk, make([]byte, end-start-int64(len(chunk)))...)
+		}
+
+		copied := copy(chunk[off-start:], p[n:])
+
+		err = ef.writeChunk(i, chunk)
+		if err != nil {
+			return
+		}
+
+		n += copied
+		if start+int64(len(chunk)) > ef.size {
+			ef.size = start + int64(len(chunk))
+		}
+	}
+
+	return
+}
+
+func (ef *encryptedFile) Truncate(n int64) (err error) {
+	if n == ef.size {
+		return
+	}
+
+	if n < ef.size {
+		err = ef.shrink(n)
+	} else {
+		err = ef.extend(n)
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = ef.writeTrailer()
+	if err != nil {
+		return
+	}
+
+	// Drop anything beyond the trailer.
+	err = ef.f.Truncate(ef.storedSize(ef.size))
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (ef *encryptedFile) Close() error {
+	return ef.f.Close()
+}
+
+// Shrink the content to n bytes, re-sealing the chunk that becomes the last
+// one if it is cut short. The caller must write the trailer.
+//
+// REQUIRES: n < ef.size
+func (ef *encryptedFile) shrink(n int64) (err error) {
+	i := n / cipherChunkSize
+	length := n % cipherChunkSize
+
+	if length > 0 {
+		var chunk []byte
+		chunk, err = ef.readChunk(i)
+		if err != nil {
+			return
+		}
+
+		err = ef.writeChunk(i, chunk[:length])
+		if err != nil {
+			return
+		}
+	}
+
+	ef.size = n
+	return
+}
+
+// Extend the content to n bytes of which the new ones are zeros, padding the
+// last chunk and sealing zeros for each chunk after it. The caller must write
+// the trailer.
+//
+// REQUIRES: n > ef.size
+func (ef *encryptedFile) extend(n int64) (err error) {
+	zeros := make([]byte, cipherChunkSize)
+	for ef.size < n {
+		i := ef.size / cipherChunkSize
+		start := i * cipherChunkSize
+		length := minInt64(n-start, cipherChunkSize)
+
+		// Start from the existing content of a partial last chunk.
+		var chunk []byte
+		if start < ef.size {
+			chunk, err = ef.readChunk(i)
+			if err != nil {
+				return
+			}
+		}
+
+		chunk = append(chunk, zeros[:length-int64(len(chunk))]...)
+
+		err = ef.writeChunk(i, chunk)
+		if err != nil {
+			return
+		}
+
+		ef.size = start + length
+	}
+
+	return
+}
+
+// The number of bytes each chunk occupies in the file beyond its content.
+func (ef *encryptedFile) overhead() int64 {
+	return int64(ef.aead.NonceSize() + ef.aead.Overhead())
+}
+
+// The number of bytes a full chunk occupies in the file.
+func (ef *encryptedFile) storedChunkSize() int64 {
+	return cipherChunkSize + ef.overhead()
+}
+
+// The number of bytes the trailer occupies in the file.
+func (ef *encryptedFile) trailerSize() int64 {
+	return 8 + ef.overhead()
+}
+
+// The size of the chunks holding content of the given size.
+func (ef *encryptedFile) storedChunksSize(size int64) (n int64) {
+	n = size / cipherChunkSize * ef.storedChunkSize()
+	if rest := size % cipherChunkSize; rest != 0 {
+		n += rest + ef.overhead()
+	}
+
+	return
+}
+
+// The size of the file holding content of the given size.
+func (ef *encryptedFile) storedSize(size int64) int64 {
+	return cipherSaltSize + ef.storedChunksSize(size) + ef.trailerSize()
+}
+
+// The offset in the file of the ith chunk.
+func (ef *encryptedFile) chunkOffset(i int64) int64 {
+	return cipherSaltSize + i*ef.storedChunkSize()
+}
+
+// Return the content of the ith chunk.
+//
+// REQUIRES: i*cipherChunkSize < ef.size
+func (ef *encryptedFile) readChunk(i int64) (chunk []byte, err error) {
+	length := minInt64(ef.size-i*cipherChunkSize, cipherChunkSize)
+	stored := make([]byte, length+ef.overhead())
+
+	_, err = ef.f.ReadAt(stored, ef.chunkOffset(i))
+	if err != nil {
+		err = fmt.Errorf("ReadAt: %v", err)
+		return
+	}
+
+	nonceSize := ef.aead.NonceSize()
+	chunk, err = ef.aead.Open(
+		nil,
+		stored[:nonceSize],
+		stored[nonceSize:],
+		chunkIndex(i))
+
+	if err != nil {
+		err = fmt.Errorf("Decrypting chunk %d: %v", i, err)
+		return
+	}
+
+	return
+}
+
+// Seal the supplied content as the ith chunk.
+func (ef *encryptedFile) writeChunk(i int64, chunk []byte) (err error) {
+	err = ef.seal(ef.chunkOffset(i), chunk, chunkIndex(i))
+	return
+}
+
+// Seal the size of the content as the trailer, after the last chunk.
+func (ef *encryptedFile) writeTrailer() (err error) {
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(ef.size))
+
+	err = ef.seal(
+		cipherSaltSize+ef.storedChunksSize(ef.size),
+		size,
+		trailerData)
+
+	return
+}
+
+// Seal the supplied content with the next nonce and the supplied additional
+// data, writing the result at the given offset in the file.
+func (ef *encryptedFile) seal(
+	offset int64,
+	content []byte,
+	additionalData []byte) (err error) {
+	if ef.readOnly {
+		err = errors.New("Encrypted file opened for reading only")
+		return
+	}
+
+	nonce := make([]byte, ef.aead.NonceSize(), int64(len(content))+ef.overhead())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], ef.sealed)
+	ef.sealed++
+
+	stored := ef.aead.Seal(nonce, nonce, content, additionalData)
+
+	_, err = ef.f.WriteAt(stored, offset)
+	if err != nil {
+		err = fmt.Errorf("WriteAt: %v", err)
+		return
+	}
+
+	return
+}
+
+// The additional data with which the ith chunk is sealed.
+func chunkIndex(i int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(i))
+	return buf
+}
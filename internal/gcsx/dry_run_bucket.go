@@ -0,0 +1,774 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that never sends requests that would modify objects to the
+// wrapped bucket. Instead it logs each one, with the object name and size,
+// and applies it to an in-memory overlay. Reads see the overlay in front of
+// the wrapped bucket, so that a file system using the bucket behaves as if
+// the modifications had been made while nothing in GCS changes.
+//
+// The contents of objects created through the bucket are kept in memory for
+// as long as it exists.
+func NewDryRunBucket(clock timeutil.Clock, wrapped gcs.Bucket) gcs.Bucket {
+	return &dryRunBucket{
+		wrapped: wrapped,
+		clock:   clock,
+		overlay: make(map[string]*dryRunObject),
+	}
+}
+
+// An object as seen through the overlay.
+type dryRunObject struct {
+	// The object's record, or nil if it has been deleted.
+	o *gcs.Object
+
+	// The contents of an object created through the overlay. Never modified.
+	contents []byte
+
+	// Otherwise, the name and generation of the object in the wrapped bucket
+	// that has the same contents.
+	backingName       string
+	backingGeneration int64
+}
+
+type dryRunBucket struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	wrapped gcs.Bucket
+	clock   timeutil.Clock
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// Modifications are made while holding the lock throughout, so that their
+	// preconditions hold when they are applied. That serializes them, which is
+	// of no concern for a dry run.
+	mu sync.Mutex
+
+	// The objects modified through the bucket, by name.
+	//
+	// GUARDED_BY(mu)
+	overlay map[string]*dryRunObject
+
+	// The most recent generation handed out.
+	//
+	// GUARDED_BY(mu)
+	lastGeneration int64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Log a modification that wasn't made, naming the file system operation that
+// asked for it if known.
+func (b *dryRunBucket) logf(
+	ctx context.Context,
+	format string,
+	v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if op, ok := ctx.Value(auditOpKey).(string); ok {
+		msg += fmt.Sprintf(" (%s)", op)
+	}
+
+	logger.Infof("Dry run, not sent to GCS: %s", msg)
+}
+
+// Return the current state of the named object, from the overlay if it has
+// been modified and from the wrapped bucket otherwise, or nil if it doesn't
+// exist.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *dryRunBucket) lookup(
+	ctx context.Context,
+	name string) (e *dryRunObject, err error) {
+	if e, ok := b.overlay[name]; ok {
+		if e.o == nil {
+			return nil, nil
+		}
+
+		return e, nil
+	}
+
+	o, err := b.wrapped.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if _, ok := err.(*gcs.NotFoundError); ok {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	e = &dryRunObject{
+		o:                 o,
+		backingName:       o.Name,
+		backingGeneration: o.Generation,
+	}
+
+	return
+}
+
+// Read the full contents of an object.
+func (b *dryRunBucket) readAll(
+	ctx context.Context,
+	e *dryRunObject) (contents []byte, err error) {
+	if e.backingName == "" {
+		contents = e.contents
+		return
+	}
+
+	rc, err := b.wrapped.NewReader(ctx, &gcs.ReadObjectRequest{
+		Name:       e.backingName,
+		Generation: e.backingGeneration,
+	})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+	contents, err = ioutil.ReadAll(rc)
+	return
+}
+
+// Choose a generation for a new object, later than any handed out before and,
+// since GCS uses microseconds, any that the wrapped bucket is likely to have.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *dryRunBucket) nextGeneration() int64 {
+	g := b.clock.Now().UnixNano()
+	if g <= b.lastGeneration {
+		g = b.lastGeneration + 1
+	}
+
+	b.lastGeneration = g
+	return g
+}
+
+// Return an error if an object doesn't meet preconditions on its generation
+// and meta-generation.
+func checkPreconditions(
+	name string,
+	e *dryRunObject,
+	generation *int64,
+	metaGeneration *int64) (err error) {
+	var gen, metaGen int64
+	if e != nil {
+		gen = e.o.Generation
+		metaGen = e.o.MetaGeneration
+	}
+
+	if generation != nil && *generation != gen {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf("%q has generation %d, not %d", name, gen, *generation),
+		}
+
+		return
+	}
+
+	if metaGeneration != nil && e != nil && *metaGeneration != metaGen {
+		err = &gcs.PreconditionError{
+			Err: fmt.Errorf(
+				"%q has meta-generation %d, not %d",
+				name,
+				metaGen,
+				*metaGeneration),
+		}
+
+		return
+	}
+
+	return
+}
+
+// Add a new object with the supplied contents to the overlay, filling in the
+// fields of o that follow from them.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *dryRunBucket) add(o *gcs.Object, contents []byte) *gcs.Object {
+	o.Size = uint64(len(contents))
+	o.CRC32C = crc32.Checksum(contents, crc32.MakeTable(crc32.Castagnoli))
+	o.Generation = b.nextGeneration()
+	o.MetaGeneration = 1
+	o.Updated = b.clock.Now()
+
+	b.overlay[o.Name] = &dryRunObject{o: o, contents: contents}
+
+	c := *o
+	return &c
+}
+
+// Return whether the wrapped bucket has an object under the supplied prefix
+// that hasn't been deleted through the overlay.
+func (b *dryRunBucket) anyRemaining(
+	ctx context.Context,
+	prefix string) (found bool, err error) {
+	req := &gcs.ListObjectsRequest{Prefix: prefix}
+	for {
+		var listing *gcs.Listing
+		listing, err = b.wrapped.ListObjects(ctx, req)
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		for _, o := range listing.Objects {
+			if e, ok := b.overlay[o.Name]; !ok || e.o != nil {
+				found = true
+			}
+		}
+		b.mu.Unlock()
+
+		if found || listing.ContinuationToken == "" {
+			return
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Reads
+////////////////////////////////////////////////////////////////////////
+
+func (b *dryRunBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *dryRunBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	e, ok := b.overlay[req.Name]
+	b.mu.Unlock()
+
+	if !ok {
+		rc, err = b.wrapped.NewReader(ctx, req)
+		return
+	}
+
+	if e.o == nil || (req.Generation != 0 && req.Generation != e.o.Generation) {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q not found", req.Name),
+		}
+
+		return
+	}
+
+	if e.backingName != "" {
+		rc, err = b.wrapped.NewReader(ctx, &gcs.ReadObjectRequest{
+			Name:       e.backingName,
+			Generation: e.backingGeneration,
+			Range:      req.Range,
+		})
+
+		return
+	}
+
+	contents := e.contents
+	if req.Range != nil {
+		start := req.Range.Start
+		limit := req.Range.Limit
+		if limit > uint64(len(contents)) {
+			limit = uint64(len(contents))
+		}
+
+		if start > limit {
+			start = limit
+		}
+
+		contents = contents[start:limit]
+	}
+
+	rc = ioutil.NopCloser(bytes.NewReader(contents))
+	return
+}
+
+func (b *dryRunBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	e, ok := b.overlay[req.Name]
+	b.mu.Unlock()
+
+	if !ok {
+		o, err = b.wrapped.StatObject(ctx, req)
+		return
+	}
+
+	if e.o == nil {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q not found", req.Name),
+		}
+
+		return
+	}
+
+	c := *e.o
+	o = &c
+	return
+}
+
+// Listings under a prefix with modifications are merged with the overlay in
+// full, and so aren't broken into pages. A listing continued from a page
+// returned before the first modification includes only the modifications
+// that sort after that page.
+func (b *dryRunBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	// Find the modifications under the prefix. Without any, there's nothing to
+	// merge.
+	modified := make(map[string]*dryRunObject)
+
+	b.mu.Lock()
+	for name, e := range b.overlay {
+		if strings.HasPrefix(name, req.Prefix) {
+			modified[name] = e
+		}
+	}
+	b.mu.Unlock()
+
+	if len(modified) == 0 {
+		listing, err = b.wrapped.ListObjects(ctx, req)
+		return
+	}
+
+	// List everything the wrapped bucket has.
+	objects := make(map[string]*gcs.Object)
+	runs := make(map[string]bool)
+	from := ""
+
+	wrappedReq := *req
+	wrappedReq.MaxResults = 0
+	for {
+		var l *gcs.Listing
+		l, err = b.wrapped.ListObjects(ctx, &wrappedReq)
+		if err != nil {
+			return
+		}
+
+		for _, o := range l.Objects {
+			objects[o.Name] = o
+		}
+
+		for _, r := range l.CollapsedRuns {
+			runs[r] = true
+		}
+
+		if l.ContinuationToken == "" {
+			break
+		}
+
+		wrappedReq.ContinuationToken = l.ContinuationToken
+	}
+
+	if req.ContinuationToken != "" {
+		for name := range objects {
+			if from == "" || name < from {
+				from = name
+			}
+		}
+
+		for r := range runs {
+			if from == "" || r < from {
+				from = r
+			}
+		}
+	}
+
+	// Apply the modifications. Deletions may empty a collapsed run, which can
+	// only be found out by listing it.
+	liveRuns := make(map[string]bool)
+	deletedRuns := make(map[string]bool)
+	for name, e := range modified {
+		rest := name[len(req.Prefix):]
+		if i := strings.Index(rest, req.Delimiter); req.Delimiter != "" && i >= 0 {
+			r := req.Prefix + rest[:i+len(req.Delimiter)]
+			if r < from {
+				continue
+			}
+
+			if e.o != nil {
+				liveRuns[r] = true
+			} else {
+				deletedRuns[r] = true
+			}
+
+			continue
+		}
+
+		if name < from {
+			continue
+		}
+
+		if e.o == nil {
+			delete(objects, name)
+		} else {
+			c := *e.o
+			objects[name] = &c
+		}
+	}
+
+	for r := range liveRuns {
+		runs[r] = true
+	}
+
+	for r := range deletedRuns {
+		if liveRuns[r] || !runs[r] {
+			continue
+		}
+
+		var found bool
+		found, err = b.anyRemaining(ctx, r)
+		if err != nil {
+			return
+		}
+
+		if !found {
+			delete(runs, r)
+		}
+	}
+
+	// Assemble the listing in order.
+	listing = new(gcs.Listing)
+	for _, o := range objects {
+		listing.Objects = append(listing.Objects, o)
+	}
+
+	sort.Slice(listing.Objects, func(i, j int) bool {
+		return listing.Objects[i].Name < listing.Objects[j].Name
+	})
+
+	for r := range runs {
+		listing.CollapsedRuns = append(listing.CollapsedRuns, r)
+	}
+
+	sort.Strings(listing.CollapsedRuns)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Modifications
+////////////////////////////////////////////////////////////////////////
+
+func (b *dryRunBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	contents, err := ioutil.ReadAll(req.Contents)
+	if err != nil {
+		err = fmt.Errorf("ReadAll: %v", err)
+		return
+	}
+
+	if req.CRC32C != nil &&
+		*req.CRC32C != crc32.Checksum(contents, crc32.MakeTable(crc32.Castagnoli)) {
+		err = errors.New("CRC32C mismatch")
+		return
+	}
+
+	if req.MD5 != nil && *req.MD5 != md5.Sum(contents) {
+		err = errors.New("MD5 mismatch")
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cur, err := b.lookup(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	err = checkPreconditions(
+		req.Name,
+		cur,
+		req.GenerationPrecondition,
+		req.MetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	sum := md5.Sum(contents)
+	o = b.add(&gcs.Object{
+		Name:            req.Name,
+		ContentType:     req.ContentType,
+		ContentLanguage: req.ContentLanguage,
+		ContentEncoding: req.ContentEncoding,
+		CacheControl:    req.CacheControl,
+		Metadata:        copyMetadata(req.Metadata),
+		StorageClass:    req.StorageClass,
+		CustomTime:      req.CustomTime,
+		MD5:             &sum,
+	}, contents)
+
+	b.logf(ctx, "CreateObject %q, %d bytes", req.Name, o.Size)
+	return
+}
+
+func (b *dryRunBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src, err := b.lookup(ctx, req.SrcName)
+	if err != nil {
+		return
+	}
+
+	if src == nil || (req.SrcGeneration != 0 && req.SrcGeneration != src.o.Generation) {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q not found", req.SrcName),
+		}
+
+		return
+	}
+
+	err = checkPreconditions(
+		req.SrcName,
+		src,
+		nil,
+		req.SrcMetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	dst := *src
+	record := *src.o
+	dst.o = &record
+
+	record.Name = req.DstName
+	record.Metadata = copyMetadata(src.o.Metadata)
+	record.Generation = b.nextGeneration()
+	record.MetaGeneration = 1
+	record.Updated = b.clock.Now()
+	record.TemporaryHold = false
+
+	b.overlay[req.DstName] = &dst
+
+	c := record
+	o = &c
+
+	b.logf(ctx, "CopyObject %q from %q, %d bytes", req.DstName, req.SrcName, o.Size)
+	return
+}
+
+func (b *dryRunBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var contents []byte
+	for _, s := range req.Sources {
+		var src *dryRunObject
+		src, err = b.lookup(ctx, s.Name)
+		if err != nil {
+			return
+		}
+
+		if src == nil || (s.Generation != 0 && s.Generation != src.o.Generation) {
+			err = &gcs.NotFoundError{
+				Err: fmt.Errorf("Object %q not found", s.Name),
+			}
+
+			return
+		}
+
+		var c []byte
+		c, err = b.readAll(ctx, src)
+		if err != nil {
+			err = fmt.Errorf("Reading %q: %v", s.Name, err)
+			return
+		}
+
+		contents = append(contents, c...)
+	}
+
+	cur, err := b.lookup(ctx, req.DstName)
+	if err != nil {
+		return
+	}
+
+	err = checkPreconditions(
+		req.DstName,
+		cur,
+		req.DstGenerationPrecondition,
+		req.DstMetaGenerationPrecondition)
+
+	if err != nil {
+		return
+	}
+
+	o = b.add(&gcs.Object{
+		Name:         req.DstName,
+		ContentType:  req.ContentType,
+		Metadata:     copyMetadata(req.Metadata),
+		StorageClass: req.StorageClass,
+		CustomTime:   req.CustomTime,
+	}, contents)
+
+	b.logf(
+		ctx,
+		"ComposeObjects %q from %d sources, %d bytes",
+		req.DstName,
+		len(req.Sources),
+		o.Size)
+
+	return
+}
+
+func (b *dryRunBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cur, err := b.lookup(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	if cur == nil || (req.Generation != 0 && req.Generation != cur.o.Generation) {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("Object %q not found", req.Name),
+		}
+
+		return
+	}
+
+	err = checkPreconditions(req.Name, cur, nil, req.MetaGenerationPrecondition)
+	if err != nil {
+		return
+	}
+
+	updated := *cur
+	record := *cur.o
+	updated.o = &record
+
+	if req.ContentType != nil {
+		record.ContentType = *req.ContentType
+	}
+
+	if req.ContentEncoding != nil {
+		record.ContentEncoding = *req.ContentEncoding
+	}
+
+	if req.ContentLanguage != nil {
+		record.ContentLanguage = *req.ContentLanguage
+	}
+
+	if req.CacheControl != nil {
+		record.CacheControl = *req.CacheControl
+	}
+
+	if req.CustomTime != nil {
+		record.CustomTime = *req.CustomTime
+	}
+
+	if req.TemporaryHold != nil {
+		record.TemporaryHold = *req.TemporaryHold
+	}
+
+	record.Metadata = copyMetadata(cur.o.Metadata)
+	for k, v := range req.Metadata {
+		if v == nil {
+			delete(record.Metadata, k)
+			continue
+		}
+
+		if record.Metadata == nil {
+			record.Metadata = make(map[string]string)
+		}
+
+		record.Metadata[k] = *v
+	}
+
+	record.MetaGeneration++
+	record.Updated = b.clock.Now()
+
+	b.overlay[req.Name] = &updated
+
+	c := record
+	o = &c
+
+	b.logf(ctx, "UpdateObject %q, %d bytes", req.Name, o.Size)
+	return
+}
+
+func (b *dryRunBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cur, err := b.lookup(ctx, req.Name)
+	if err != nil {
+		return
+	}
+
+	// Non-existence isn't an error.
+	if cur == nil || (req.Generation != 0 && req.Generation != cur.o.Generation) {
+		return
+	}
+
+	err = checkPreconditions(req.Name, cur, nil, req.MetaGenerationPrecondition)
+	if err != nil {
+		return
+	}
+
+	b.overlay[req.Name] = &dryRunObject{}
+
+	b.logf(ctx, "DeleteObject %q, %d bytes", req.Name, cur.o.Size)
+	return
+}
+
+func copyMetadata(m map[string]string) (c map[string]string) {
+	if m == nil {
+		return
+	}
+
+	c = make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return
+}
@@ -0,0 +1,255 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestDryRunBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DryRunBucketTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+
+	// The bucket that would be modified, and the dry run in front of it.
+	wrapped gcs.Bucket
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &DryRunBucketTest{}
+
+func init() { RegisterTestSuite(&DryRunBucketTest{}) }
+
+func (t *DryRunBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.bucket = gcsx.NewDryRunBucket(&t.clock, t.wrapped)
+
+	err := gcsutil.CreateObjects(t.ctx, t.wrapped, map[string][]byte{
+		"foo":     []byte("taco"),
+		"dir/bar": []byte("burrito"),
+		"dir/baz": []byte("enchilada"),
+	})
+
+	AssertEq(nil, err)
+}
+
+// Return the names of the objects and collapsed runs listed for the supplied
+// prefix, using "/" as the delimiter.
+func (t *DryRunBucketTest) list(prefix string) (names []string) {
+	objects, runs, err := gcsutil.ListAll(
+		t.ctx,
+		t.bucket,
+		&gcs.ListObjectsRequest{Prefix: prefix, Delimiter: "/"})
+
+	AssertEq(nil, err)
+	for _, o := range objects {
+		names = append(names, o.Name)
+	}
+
+	names = append(names, runs...)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DryRunBucketTest) Reads() {
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	ExpectThat(t.list(""), ElementsAre("foo", "dir/"))
+	ExpectThat(t.list("dir/"), ElementsAre("dir/bar", "dir/baz"))
+}
+
+func (t *DryRunBucketTest) CreateObject() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "qux", []byte("queso"))
+	AssertEq(nil, err)
+
+	// The object is visible through the dry run.
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "qux"})
+	AssertEq(nil, err)
+	ExpectEq(len("queso"), o.Size)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "qux")
+	AssertEq(nil, err)
+	ExpectEq("queso", string(contents))
+
+	rc, err := t.bucket.NewReader(t.ctx, &gcs.ReadObjectRequest{
+		Name:  "qux",
+		Range: &gcs.ByteRange{Start: 1, Limit: 3},
+	})
+
+	AssertEq(nil, err)
+	buf := make([]byte, 10)
+	n, _ := rc.Read(buf)
+	ExpectEq("ue", string(buf[:n]))
+
+	ExpectThat(t.list(""), ElementsAre("foo", "qux", "dir/"))
+
+	// But not in the wrapped bucket.
+	_, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "qux"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *DryRunBucketTest) OverwriteObject() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("nachos"))
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("nachos", string(contents))
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.wrapped, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *DryRunBucketTest) Preconditions() {
+	var zero int64
+	_, err := t.bucket.CreateObject(t.ctx, &gcs.CreateObjectRequest{
+		Name:                   "foo",
+		Contents:               strings.NewReader(""),
+		GenerationPrecondition: &zero,
+	})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	wrong := o.MetaGeneration + 1
+	_, err = t.bucket.UpdateObject(t.ctx, &gcs.UpdateObjectRequest{
+		Name:                       "foo",
+		MetaGenerationPrecondition: &wrong,
+	})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{
+		Name:                       "foo",
+		MetaGenerationPrecondition: &wrong,
+	})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *DryRunBucketTest) UpdateObject() {
+	value := "bar"
+	o, err := t.bucket.UpdateObject(t.ctx, &gcs.UpdateObjectRequest{
+		Name:     "foo",
+		Metadata: map[string]*string{"baz": &value},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq("bar", o.Metadata["baz"])
+	ExpectEq(2, o.MetaGeneration)
+
+	// The contents are still those of the object in the wrapped bucket.
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	o, err = t.wrapped.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(0, len(o.Metadata))
+}
+
+func (t *DryRunBucketTest) CopyAndCompose() {
+	_, err := t.bucket.CopyObject(t.ctx, &gcs.CopyObjectRequest{
+		SrcName: "foo",
+		DstName: "dir/qux",
+	})
+
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "dir/qux")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	o, err := t.bucket.ComposeObjects(t.ctx, &gcs.ComposeObjectsRequest{
+		DstName: "combo",
+		Sources: []gcs.ComposeSource{{Name: "dir/qux"}, {Name: "dir/bar"}},
+	})
+
+	AssertEq(nil, err)
+	ExpectEq(len("tacoburrito"), o.Size)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "combo")
+	AssertEq(nil, err)
+	ExpectEq("tacoburrito", string(contents))
+
+	ExpectThat(t.list("dir/"), ElementsAre("dir/bar", "dir/baz", "dir/qux"))
+
+	objects, _, err := gcsutil.ListAll(t.ctx, t.wrapped, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(3, len(objects))
+}
+
+func (t *DryRunBucketTest) DeleteObject() {
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	// Deleting it again is fine.
+	err = t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	ExpectEq(nil, err)
+
+	ExpectThat(t.list(""), ElementsAre("dir/"))
+
+	_, err = gcsutil.ReadObject(t.ctx, t.wrapped, "foo")
+	ExpectEq(nil, err)
+}
+
+func (t *DryRunBucketTest) DeleteWholeRun() {
+	for _, name := range []string{"dir/bar", "dir/baz"} {
+		err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: name})
+		AssertEq(nil, err)
+	}
+
+	ExpectThat(t.list(""), ElementsAre("foo"))
+	ExpectThat(t.list("dir/"), ElementsAre())
+
+	// Creating something under it brings it back.
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "dir/qux", []byte(""))
+	AssertEq(nil, err)
+
+	ExpectThat(t.list(""), ElementsAre("foo", "dir/"))
+}
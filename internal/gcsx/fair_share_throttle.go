@@ -0,0 +1,237 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+
+	"github.com/jacobsa/ratelimit"
+	"golang.org/x/net/context"
+)
+
+// A throttle that divides the bandwidth of a wrapped throttle among a dynamic
+// set of clients using weighted fair queuing. Each client is itself a
+// ratelimit.Throttle. When several clients are waiting, the request with the
+// smallest virtual finish time is granted first, so a client that has issued a
+// long run of requests cannot starve a client that issues an occasional one.
+//
+// Requests are passed on to the wrapped throttle one at a time, so the
+// aggregate rate never exceeds that of the wrapped throttle.
+//
+// Safe for concurrent access.
+type FairShareThrottle struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	wrapped ratelimit.Throttle
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The virtual finish time of the most recently completed request. Virtual
+	// time is measured in tokens per unit weight.
+	//
+	// GUARDED_BY(mu)
+	virtualTime float64
+
+	// Requests waiting for their turn, ordered by virtual finish time.
+	//
+	// GUARDED_BY(mu)
+	waiters fairShareWaiters
+
+	// Is some request currently waiting on the wrapped throttle?
+	//
+	// GUARDED_BY(mu)
+	busy bool
+}
+
+// Create a fair share throttle that hands out the capacity of the supplied
+// throttle.
+func NewFairShareThrottle(wrapped ratelimit.Throttle) (t *FairShareThrottle) {
+	t = &FairShareThrottle{
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+// Create a new client of the throttle with the given weight. A client with
+// twice the weight of another receives twice the bandwidth when both are
+// continuously backlogged.
+//
+// REQUIRES: weight > 0
+func (t *FairShareThrottle) NewClient(weight float64) ratelimit.Throttle {
+	if !(weight > 0) {
+		panic(fmt.Sprintf("Illegal weight: %v", weight))
+	}
+
+	return &fairShareClient{
+		throttle: t,
+		weight:   weight,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// If no request is in progress, grant the waiting request with the smallest
+// virtual finish time, if any.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *FairShareThrottle) dispatch() {
+	if t.busy || len(t.waiters) == 0 {
+		return
+	}
+
+	w := heap.Pop(&t.waiters).(*fairShareWaiter)
+	w.granted = true
+	t.busy = true
+	close(w.ready)
+}
+
+// LOCKS_EXCLUDED(t.mu)
+func (t *FairShareThrottle) wait(
+	ctx context.Context,
+	c *fairShareClient,
+	tokens uint64) (err error) {
+	// Enqueue a request, tagged with its virtual finish time.
+	t.mu.Lock()
+
+	start := t.virtualTime
+	if c.lastFinish > start {
+		start = c.lastFinish
+	}
+
+	w := &fairShareWaiter{
+		finish: start + float64(tokens)/c.weight,
+		ready:  make(chan struct{}),
+	}
+
+	c.lastFinish = w.finish
+	heap.Push(&t.waiters, w)
+	t.dispatch()
+
+	t.mu.Unlock()
+
+	// Wait for our turn.
+	select {
+	case <-w.ready:
+
+	case <-ctx.Done():
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		// We may have been granted concurrently with the cancellation, in which
+		// case we must hand our turn on to the next waiter.
+		if w.granted {
+			t.busy = false
+		} else {
+			heap.Remove(&t.waiters, w.index)
+		}
+
+		t.dispatch()
+
+		err = ctx.Err()
+		return
+	}
+
+	// Call through, then let the next request go.
+	err = t.wrapped.Wait(ctx, tokens)
+
+	t.mu.Lock()
+	if w.finish > t.virtualTime {
+		t.virtualTime = w.finish
+	}
+
+	t.busy = false
+	t.dispatch()
+	t.mu.Unlock()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// fairShareClient
+////////////////////////////////////////////////////////////////////////
+
+type fairShareClient struct {
+	throttle *FairShareThrottle
+	weight   float64
+
+	// The virtual finish time of this client's most recent request.
+	//
+	// GUARDED_BY(throttle.mu)
+	lastFinish float64
+}
+
+func (c *fairShareClient) Capacity() uint64 {
+	return c.throttle.wrapped.Capacity()
+}
+
+func (c *fairShareClient) Wait(
+	ctx context.Context,
+	tokens uint64) (err error) {
+	err = c.throttle.wait(ctx, c, tokens)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// fairShareWaiters
+////////////////////////////////////////////////////////////////////////
+
+type fairShareWaiter struct {
+	// The virtual time at which the request will have been served.
+	finish float64
+
+	// Closed when the request is granted.
+	ready   chan struct{}
+	granted bool
+
+	// The index of the waiter within the heap, maintained by the heap methods.
+	index int
+}
+
+// A min-heap of waiters keyed on virtual finish time, for use with package
+// container/heap.
+type fairShareWaiters []*fairShareWaiter
+
+func (ws fairShareWaiters) Len() int           { return len(ws) }
+func (ws fairShareWaiters) Less(i, j int) bool { return ws[i].finish < ws[j].finish }
+
+func (ws fairShareWaiters) Swap(i, j int) {
+	ws[i], ws[j] = ws[j], ws[i]
+	ws[i].index = i
+	ws[j].index = j
+}
+
+func (ws *fairShareWaiters) Push(x interface{}) {
+	w := x.(*fairShareWaiter)
+	w.index = len(*ws)
+	*ws = append(*ws, w)
+}
+
+func (ws *fairShareWaiters) Pop() interface{} {
+	old := *ws
+	w := old[len(old)-1]
+	*ws = old[:len(old)-1]
+	return w
+}
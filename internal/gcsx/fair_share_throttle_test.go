@@ -0,0 +1,218 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestFairShareThrottle(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Gated throttle
+////////////////////////////////////////////////////////////////////////
+
+// A throttle that records the name attached to the context of each call to
+// Wait, and then blocks until released by the test.
+type gatedThrottle struct {
+	release chan struct{}
+
+	mu    sync.Mutex
+	names []string
+}
+
+type nameKey struct{}
+
+func (t *gatedThrottle) Capacity() uint64 {
+	return 1 << 20
+}
+
+func (t *gatedThrottle) Wait(
+	ctx context.Context,
+	tokens uint64) (err error) {
+	t.mu.Lock()
+	t.names = append(t.names, ctx.Value(nameKey{}).(string))
+	t.mu.Unlock()
+
+	<-t.release
+	return
+}
+
+func (t *gatedThrottle) Names() (names []string) {
+	t.mu.Lock()
+	names = append(names, t.names...)
+	t.mu.Unlock()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FairShareThrottleTest struct {
+	ctx     context.Context
+	wrapped gatedThrottle
+	t       *FairShareThrottle
+	wg      sync.WaitGroup
+}
+
+var _ SetUpInterface = &FairShareThrottleTest{}
+
+func init() { RegisterTestSuite(&FairShareThrottleTest{}) }
+
+func (t *FairShareThrottleTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.wrapped.release = make(chan struct{})
+	t.t = NewFairShareThrottle(&t.wrapped)
+}
+
+// Start a call to Wait on the supplied client in the background, waiting
+// until the call has either reached the wrapped throttle or been queued.
+func (t *FairShareThrottleTest) startWait(
+	c interface {
+		Wait(context.Context, uint64) error
+	},
+	name string,
+	tokens uint64) {
+	t.t.mu.Lock()
+	before := len(t.t.waiters)
+	t.t.mu.Unlock()
+	calls := len(t.wrapped.Names())
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ctx := context.WithValue(t.ctx, nameKey{}, name)
+		err := c.Wait(ctx, tokens)
+		AssertEq(nil, err)
+	}()
+
+	for {
+		t.t.mu.Lock()
+		after := len(t.t.waiters)
+		t.t.mu.Unlock()
+
+		if after > before || len(t.wrapped.Names()) > calls {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FairShareThrottleTest) IllegalWeight() {
+	ExpectThat(
+		func() { t.t.NewClient(0) },
+		Panics(HasSubstr("weight")))
+}
+
+func (t *FairShareThrottleTest) CapacityComesFromWrapped() {
+	c := t.t.NewClient(1)
+	ExpectEq(1<<20, c.Capacity())
+}
+
+func (t *FairShareThrottleTest) BackloggedClientDoesntStarveOthers() {
+	a := t.t.NewClient(1)
+	b := t.t.NewClient(1)
+
+	// Client A issues a run of requests, the first of which proceeds to the
+	// wrapped throttle immediately.
+	t.startWait(a, "a0", 100)
+	t.startWait(a, "a1", 100)
+	t.startWait(a, "a2", 100)
+
+	// Client B then issues a single request.
+	t.startWait(b, "b0", 100)
+
+	// Let everything run.
+	close(t.wrapped.release)
+	t.wg.Wait()
+
+	// B should have been served ahead of A's backlog.
+	ExpectThat(t.wrapped.Names(), ElementsAre("a0", "b0", "a1", "a2"))
+}
+
+func (t *FairShareThrottleTest) WeightsAreRespected() {
+	a := t.t.NewClient(1)
+	b := t.t.NewClient(4)
+
+	// Block the throttle with an unrelated request.
+	t.startWait(t.t.NewClient(1), "x", 1)
+
+	t.startWait(a, "a0", 100)
+	t.startWait(a, "a1", 100)
+	t.startWait(b, "b0", 100)
+	t.startWait(b, "b1", 100)
+	t.startWait(b, "b2", 100)
+
+	close(t.wrapped.release)
+	t.wg.Wait()
+
+	// B's requests cost a quarter as much virtual time each, so all three fit
+	// before A's first.
+	ExpectThat(
+		t.wrapped.Names(),
+		ElementsAre("x", "b0", "b1", "b2", "a0", "a1"))
+}
+
+func (t *FairShareThrottleTest) CancelledWaiterIsRemoved() {
+	a := t.t.NewClient(1)
+	b := t.t.NewClient(1)
+
+	// Block the throttle.
+	t.startWait(a, "a0", 100)
+
+	// Queue a request from B, then cancel it.
+	ctx, cancel := context.WithCancel(context.WithValue(t.ctx, nameKey{}, "b0"))
+	errChan := make(chan error, 1)
+	go func() { errChan <- b.Wait(ctx, 100) }()
+
+	for {
+		t.t.mu.Lock()
+		n := len(t.t.waiters)
+		t.t.mu.Unlock()
+
+		if n == 1 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	ExpectEq(context.Canceled, <-errChan)
+
+	t.t.mu.Lock()
+	ExpectEq(0, len(t.t.waiters))
+	t.t.mu.Unlock()
+
+	// Later requests should still be served.
+	t.startWait(a, "a1", 100)
+	close(t.wrapped.release)
+	t.wg.Wait()
+
+	ExpectThat(t.wrapped.Names(), ElementsAre("a0", "a1"))
+}
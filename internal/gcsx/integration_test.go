@@ -90,7 +90,8 @@ func (t *IntegrationTest) SetUp(ti *TestInfo) {
 	t.syncer = gcsx.NewSyncer(
 		appendThreshold,
 		tmpObjectPrefix,
-		t.bucket)
+		t.bucket,
+		gcsx.NewUploadQueue(1))
 }
 
 func (t *IntegrationTest) TearDown() {
@@ -144,7 +145,7 @@ func (t *IntegrationTest) objectGeneration(name string) (gen int64) {
 }
 
 func (t *IntegrationTest) sync(src *gcs.Object) (o *gcs.Object, err error) {
-	o, err = t.syncer.SyncObject(t.ctx, src, t.tf)
+	o, err = t.syncer.SyncObject(t.ctx, src, "", t.tf)
 	if err == nil && o != nil {
 		t.tf = nil
 	}
@@ -268,6 +269,39 @@ func (t *IntegrationTest) AppendThenSync() {
 	ExpectEq("foo", objects[0].Name)
 }
 
+func (t *IntegrationTest) SyncKeepsCustomTime() {
+	customTime := time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+
+	// Create.
+	o, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:       "foo",
+			Contents:   bytes.NewReader([]byte("taco")),
+			CustomTime: customTime,
+		})
+
+	AssertEq(nil, err)
+
+	// Both overwriting and appending should keep the custom time.
+	t.create(o)
+	_, err = t.tf.WriteAt([]byte("p"), 0)
+	AssertEq(nil, err)
+
+	o, err = t.sync(o)
+	AssertEq(nil, err)
+	ExpectThat(o.CustomTime, timeutil.TimeEq(customTime))
+
+	t.create(o)
+	_, err = t.tf.WriteAt([]byte("burrito"), 4)
+	AssertEq(nil, err)
+
+	o, err = t.sync(o)
+	AssertEq(nil, err)
+	ExpectThat(o.CustomTime, timeutil.TimeEq(customTime))
+	ExpectEq(2, o.ComponentCount)
+}
+
 func (t *IntegrationTest) TruncateThenSync() {
 	// Create.
 	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
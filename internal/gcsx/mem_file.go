@@ -0,0 +1,163 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The subset of *os.File's methods used by tempFile.
+type tempStorage interface {
+	io.ReadWriteSeeker
+	io.ReaderAt
+	io.WriterAt
+	Truncate(n int64) error
+	Close() error
+}
+
+// An in-memory tempStorage, with the semantics of an *os.File.
+//
+// Not safe for concurrent access.
+type memFile struct {
+	buf []byte
+
+	// The seek position, which may be beyond the end of buf.
+	//
+	// INVARIANT: pos >= 0
+	pos int64
+}
+
+var _ tempStorage = &memFile{}
+
+func (mf *memFile) Read(p []byte) (n int, err error) {
+	if mf.pos >= int64(len(mf.buf)) {
+		err = io.EOF
+		return
+	}
+
+	n = copy(p, mf.buf[mf.pos:])
+	mf.pos += int64(n)
+	return
+}
+
+func (mf *memFile) Write(p []byte) (n int, err error) {
+	n, err = mf.WriteAt(p, mf.pos)
+	mf.pos += int64(n)
+	return
+}
+
+func (mf *memFile) Seek(offset int64, whence int) (pos int64, err error) {
+	switch whence {
+	case 0:
+		pos = offset
+
+	case 1:
+		pos = mf.pos + offset
+
+	case 2:
+		pos = int64(len(mf.buf)) + offset
+
+	default:
+		err = fmt.Errorf("Illegal whence: %d", whence)
+		return
+	}
+
+	if pos < 0 {
+		err = errors.New("Negative seek position")
+		return
+	}
+
+	mf.pos = pos
+	return
+}
+
+func (mf *memFile) ReadAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		err = errors.New("Negative offset")
+		return
+	}
+
+	if offset < int64(len(mf.buf)) {
+		n = copy(p, mf.buf[offset:])
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (mf *memFile) WriteAt(p []byte, offset int64) (n int, err error) {
+	if offset < 0 {
+		err = errors.New("Negative offset")
+		return
+	}
+
+	end := offset + int64(len(p))
+	if end > int64(len(mf.buf)) {
+		mf.grow(end)
+	}
+
+	n = copy(mf.buf[offset:], p)
+	return
+}
+
+func (mf *memFile) Truncate(n int64) (err error) {
+	if n < 0 {
+		err = errors.New("Negative size")
+		return
+	}
+
+	if n > int64(len(mf.buf)) {
+		mf.grow(n)
+	} else {
+		mf.buf = mf.buf[:n]
+	}
+
+	return
+}
+
+func (mf *memFile) Close() (err error) {
+	mf.buf = nil
+	return
+}
+
+// Extend the buffer with zeroes to the given size.
+//
+// REQUIRES: n >= len(mf.buf)
+func (mf *memFile) grow(n int64) {
+	if n <= int64(cap(mf.buf)) {
+		old := len(mf.buf)
+		mf.buf = mf.buf[:n]
+		for i := old; i < len(mf.buf); i++ {
+			mf.buf[i] = 0
+		}
+
+		return
+	}
+
+	// Allocate at least double, to amortize a run of small appends.
+	c := 2 * int64(cap(mf.buf))
+	if c < n {
+		c = n
+	}
+
+	buf := make([]byte, n, c)
+	copy(buf, mf.buf)
+	mf.buf = buf
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// NewOfflineBucket creates a wrapper bucket that copies each generation of an
+// object read through it into the supplied cache in the background, and
+// serves stats and listings from the cache while GCS is unreachable, so that
+// objects read earlier can still be found and read. Reads of the cached
+// generations are served by wrapped, which must be a bucket created by
+// NewContentCacheBucket with the same cache.
+//
+// While GCS is unreachable, objects not in the cache appear not to exist.
+func NewOfflineBucket(cache *ContentCache, wrapped gcs.Bucket) gcs.Bucket {
+	return &offlineBucket{
+		Bucket:   wrapped,
+		cache:    cache,
+		fetching: make(map[string]bool),
+	}
+}
+
+type offlineBucket struct {
+	gcs.Bucket
+	cache *ContentCache
+
+	mu sync.Mutex
+
+	// The names of the objects being copied into the cache.
+	//
+	// GUARDED_BY(mu)
+	fetching map[string]bool
+}
+
+func (b *offlineBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err == nil && req.Generation != 0 {
+		b.remember(req.Name, req.Generation)
+	}
+
+	return
+}
+
+func (b *offlineBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	o, err = b.Bucket.StatObject(ctx, req)
+	if !isUnreachable(err) {
+		return
+	}
+
+	c, ok := b.cache.Lookup(b.Name(), req.Name)
+	if !ok {
+		err = &gcs.NotFoundError{
+			Err: fmt.Errorf("%q isn't cached and GCS is unreachable: %v", req.Name, err),
+		}
+
+		return
+	}
+
+	o = c.object()
+	err = nil
+
+	return
+}
+
+func (b *offlineBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	listing, err = b.Bucket.ListObjects(ctx, req)
+
+	// The cache can't continue a listing that GCS began.
+	if !isUnreachable(err) || req.ContinuationToken != "" {
+		return
+	}
+
+	listing = b.cachedListing(req)
+	err = nil
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Copy the supplied generation of an object into the cache in the background,
+// unless it is already there or on its way.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *offlineBucket) remember(name string, generation int64) {
+	if c, ok := b.cache.Lookup(b.Name(), name); ok && c.Generation == generation {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fetching[name] {
+		return
+	}
+
+	b.fetching[name] = true
+	go func() {
+		err := b.fetch(context.Background(), name, generation)
+		if err != nil {
+			logger.Debugf("Not caching %q for offline use: %v", name, err)
+		}
+
+		b.mu.Lock()
+		delete(b.fetching, name)
+		b.mu.Unlock()
+	}()
+}
+
+// Copy the supplied generation of an object into the cache, if it is still
+// the latest.
+func (b *offlineBucket) fetch(
+	ctx context.Context,
+	name string,
+	generation int64) (err error) {
+	o, err := b.Bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: name})
+	if err != nil {
+		err = fmt.Errorf("StatObject: %v", err)
+		return
+	}
+
+	if o.Generation != generation {
+		return
+	}
+
+	_, err = b.cache.Insert(ctx, b.Bucket, o)
+	if err != nil {
+		err = fmt.Errorf("Insert: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return a listing of the cached objects matching the supplied request, in a
+// single page.
+func (b *offlineBucket) cachedListing(
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing) {
+	listing = &gcs.Listing{}
+	runs := make(map[string]bool)
+
+	for _, c := range b.cache.Objects() {
+		if c.Bucket != b.Name() || !strings.HasPrefix(c.Object, req.Prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(c.Object, req.Prefix)
+		if i := strings.Index(rest, req.Delimiter); req.Delimiter != "" && i >= 0 {
+			runs[req.Prefix+rest[:i+len(req.Delimiter)]] = true
+			continue
+		}
+
+		listing.Objects = append(listing.Objects, c.object())
+	}
+
+	sort.Slice(listing.Objects, func(i, j int) bool {
+		return listing.Objects[i].Name < listing.Objects[j].Name
+	})
+
+	for r := range runs {
+		listing.CollapsedRuns = append(listing.CollapsedRuns, r)
+	}
+
+	sort.Strings(listing.CollapsedRuns)
+	return
+}
+
+// Return a record for the cached generation of the object.
+func (c *CachedObject) object() *gcs.Object {
+	return &gcs.Object{
+		Name:           c.Object,
+		Size:           uint64(c.Size),
+		CRC32C:         c.CRC32C,
+		Metadata:       c.Metadata,
+		Generation:     c.Generation,
+		MetaGeneration: 1,
+		Updated:        c.Updated,
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestOfflineBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type OfflineBucketTest struct {
+	ctx   context.Context
+	clock timeutil.SimulatedClock
+	dir   string
+
+	// The bucket behind everything, a layer that can be made to act as if GCS
+	// were unreachable, and the offline layer on top.
+	wrapped gcs.Bucket
+	network *switchableBucket
+	bucket  gcs.Bucket
+	cache   *gcsx.ContentCache
+}
+
+var _ SetUpInterface = &OfflineBucketTest{}
+var _ TearDownInterface = &OfflineBucketTest{}
+
+func init() { RegisterTestSuite(&OfflineBucketTest{}) }
+
+func (t *OfflineBucketTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.wrapped = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.network = &switchableBucket{Bucket: t.wrapped}
+
+	t.dir, err = ioutil.TempDir("", "offline_bucket_test")
+	AssertEq(nil, err)
+
+	t.cache, err = gcsx.NewContentCache(filepath.Join(t.dir, "cache"), 0, nil)
+	AssertEq(nil, err)
+
+	t.bucket = gcsx.NewOfflineBucket(
+		t.cache,
+		gcsx.NewContentCacheBucket(t.cache, t.network))
+}
+
+func (t *OfflineBucketTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *OfflineBucketTest) create(name string, contents string) *gcs.Object {
+	o, err := gcsutil.CreateObject(t.ctx, t.wrapped, name, []byte(contents))
+	AssertEq(nil, err)
+
+	return o
+}
+
+// Read a generation of an object through the offline layer.
+func (t *OfflineBucketTest) read(
+	name string,
+	generation int64) (s string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       name,
+			Generation: generation,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	s = string(b)
+	return
+}
+
+// Read an object through the offline layer until its copy lands in the
+// cache. Reading again covers a copy of an earlier generation having been in
+// flight.
+func (t *OfflineBucketTest) readAndWait(o *gcs.Object) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		_, err := t.read(o.Name, o.Generation)
+		AssertEq(nil, err)
+
+		c, ok := t.cache.Lookup("some_bucket", o.Name)
+		if ok && c.Generation == o.Generation {
+			return
+		}
+
+		AssertTrue(time.Now().Before(deadline), "%q never cached", o.Name)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A bucket that fails reads as if GCS were unreachable while offline is set.
+type switchableBucket struct {
+	gcs.Bucket
+	offline bool
+}
+
+func (b *switchableBucket) err() error {
+	return &url.Error{
+		Op:  "Get",
+		URL: "https://www.googleapis.com/storage/v1/b/some_bucket/o",
+		Err: &net.OpError{Op: "dial", Err: errors.New("network is unreachable")},
+	}
+}
+
+func (b *switchableBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if b.offline {
+		err = b.err()
+		return
+	}
+
+	return b.Bucket.NewReader(ctx, req)
+}
+
+func (b *switchableBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if b.offline {
+		err = b.err()
+		return
+	}
+
+	return b.Bucket.StatObject(ctx, req)
+}
+
+func (b *switchableBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	if b.offline {
+		err = b.err()
+		return
+	}
+
+	return b.Bucket.ListObjects(ctx, req)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *OfflineBucketTest) ReadObjectServedOffline() {
+	o := t.create("foo", "taco")
+	t.readAndWait(o)
+
+	t.network.offline = true
+
+	// Stat
+	stat, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("foo", stat.Name)
+	ExpectEq(o.Generation, stat.Generation)
+	ExpectEq(len("taco"), stat.Size)
+	ExpectEq(o.CRC32C, stat.CRC32C)
+	ExpectThat(stat.Updated, timeutil.TimeEq(o.Updated))
+
+	// Read
+	s, err := t.read("foo", o.Generation)
+	AssertEq(nil, err)
+	ExpectEq("taco", s)
+}
+
+func (t *OfflineBucketTest) MetadataKeptOffline() {
+	o, err := t.wrapped.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: strings.NewReader("taco"),
+			Metadata: map[string]string{"gcsfuse_mtime": "2015-04-05T02:15:00Z"},
+		})
+
+	AssertEq(nil, err)
+	t.readAndWait(o)
+
+	t.network.offline = true
+
+	stat, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq("2015-04-05T02:15:00Z", stat.Metadata["gcsfuse_mtime"])
+}
+
+func (t *OfflineBucketTest) UnreadObjectNotFoundOffline() {
+	t.create("foo", "taco")
+	t.network.offline = true
+
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) ErrorsPassedThroughOnline() {
+	_, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+
+	_, err = t.read("foo", 17)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *OfflineBucketTest) OnlineListingFromGCS() {
+	t.create("foo", "taco")
+	t.create("bar", "burrito")
+
+	listing, err := t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(2, len(listing.Objects))
+}
+
+func (t *OfflineBucketTest) ListingServedOffline() {
+	for _, name := range []string{"dir/a", "dir/sub/b", "dir/sub/c", "other"} {
+		t.readAndWait(t.create(name, "taco"))
+	}
+
+	// Never read.
+	t.create("dir/d", "burrito")
+
+	t.network.offline = true
+
+	// With a delimiter
+	listing, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{
+			Prefix:    "dir/",
+			Delimiter: "/",
+		})
+
+	AssertEq(nil, err)
+	AssertEq(1, len(listing.Objects))
+	ExpectEq("dir/a", listing.Objects[0].Name)
+	ExpectThat(listing.CollapsedRuns, ElementsAre("dir/sub/"))
+	ExpectEq("", listing.ContinuationToken)
+
+	// Without
+	listing, err = t.bucket.ListObjects(t.ctx, &gcs.ListObjectsRequest{})
+
+	AssertEq(nil, err)
+	AssertEq(4, len(listing.Objects))
+	ExpectEq("dir/a", listing.Objects[0].Name)
+	ExpectEq("dir/sub/b", listing.Objects[1].Name)
+	ExpectEq("dir/sub/c", listing.Objects[2].Name)
+	ExpectEq("other", listing.Objects[3].Name)
+	ExpectEq(0, len(listing.CollapsedRuns))
+}
+
+func (t *OfflineBucketTest) ContinuedListingFailsOffline() {
+	t.readAndWait(t.create("foo", "taco"))
+	t.network.offline = true
+
+	_, err := t.bucket.ListObjects(
+		t.ctx,
+		&gcs.ListObjectsRequest{ContinuationToken: "foo"})
+
+	ExpectThat(err, Error(HasSubstr("unreachable")))
+}
+
+func (t *OfflineBucketTest) NewGenerationReplacesCopy() {
+	t.readAndWait(t.create("foo", "taco"))
+	o := t.create("foo", "burrito")
+	t.readAndWait(o)
+
+	t.network.offline = true
+
+	s, err := t.read("foo", o.Generation)
+	AssertEq(nil, err)
+	ExpectEq("burrito", s)
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+)
+
+// Create a view on the wrapped changes matching NewPrefixBucket: object names
+// are given without the supplied prefix, which must end in a slash, and
+// changes to objects outside of it (or to the prefix itself) are dropped.
+func NewPrefixChanges(
+	prefix string,
+	wrapped storage.Changes) (c storage.Changes) {
+	c = &prefixChanges{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type prefixChanges struct {
+	prefix  string
+	wrapped storage.Changes
+}
+
+func (pc *prefixChanges) Next(
+	ctx context.Context) (changes []storage.ObjectChange, err error) {
+	for len(changes) == 0 {
+		var all []storage.ObjectChange
+		all, err = pc.wrapped.Next(ctx)
+		if err != nil {
+			return
+		}
+
+		for _, c := range all {
+			if len(c.Name) <= len(pc.prefix) || !strings.HasPrefix(c.Name, pc.prefix) {
+				continue
+			}
+
+			c.Name = c.Name[len(pc.prefix):]
+			changes = append(changes, c)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPrefixChanges(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Returns each of a list of batches in turn.
+type cannedChanges struct {
+	batches [][]storage.ObjectChange
+}
+
+func (c *cannedChanges) Next(
+	ctx context.Context) (changes []storage.ObjectChange, err error) {
+	changes = c.batches[0]
+	c.batches = c.batches[1:]
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefixChangesTest struct {
+	ctx     context.Context
+	wrapped cannedChanges
+	c       storage.Changes
+}
+
+var _ SetUpInterface = &PrefixChangesTest{}
+
+func init() { RegisterTestSuite(&PrefixChangesTest{}) }
+
+func (t *PrefixChangesTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.c = gcsx.NewPrefixChanges("foo/", &t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefixChangesTest) NamesStripped() {
+	t.wrapped.batches = [][]storage.ObjectChange{
+		{
+			{Name: "foo/bar", Generation: 17},
+			{Name: "foo/baz/", Generation: 18, Deleted: true},
+		},
+	}
+
+	changes, err := t.c.Next(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(changes, DeepEquals([]storage.ObjectChange{
+		{Name: "bar", Generation: 17},
+		{Name: "baz/", Generation: 18, Deleted: true},
+	}))
+}
+
+func (t *PrefixChangesTest) OutsidePrefixDropped() {
+	t.wrapped.batches = [][]storage.ObjectChange{
+		{
+			{Name: "foo/", Generation: 17},
+			{Name: "foobar", Generation: 18},
+			{Name: "bar/foo/baz", Generation: 19},
+		},
+		{
+			{Name: "taco", Generation: 20},
+			{Name: "foo/qux", Generation: 21},
+		},
+	}
+
+	// Batches left empty are skipped.
+	changes, err := t.c.Next(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(changes, DeepEquals([]storage.ObjectChange{
+		{Name: "qux", Generation: 21},
+	}))
+}
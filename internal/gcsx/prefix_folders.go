@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+)
+
+// Create a view on the wrapped folders matching NewPrefixBucket: folder names
+// are given and returned without the supplied prefix, which must end in a
+// slash.
+func NewPrefixFolders(
+	prefix string,
+	wrapped storage.Folders) (f storage.Folders) {
+	f = &prefixFolders{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type prefixFolders struct {
+	prefix  string
+	wrapped storage.Folders
+}
+
+func (f *prefixFolders) GetFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.wrapped.GetFolder(ctx, f.prefix+name)
+	return
+}
+
+func (f *prefixFolders) CreateFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.wrapped.CreateFolder(ctx, f.prefix+name)
+	return
+}
+
+func (f *prefixFolders) DeleteFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.wrapped.DeleteFolder(ctx, f.prefix+name)
+	return
+}
+
+func (f *prefixFolders) RenameFolder(
+	ctx context.Context,
+	srcName string,
+	dstName string) (err error) {
+	err = f.wrapped.RenameFolder(ctx, f.prefix+srcName, f.prefix+dstName)
+	return
+}
+
+func (f *prefixFolders) ListFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	names, err = f.wrapped.ListFolders(ctx, f.prefix+parent)
+	for i, n := range names {
+		names[i] = strings.TrimPrefix(n, f.prefix)
+	}
+
+	return
+}
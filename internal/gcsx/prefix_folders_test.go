@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPrefixFolders(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Records the names it is called with, and lists the names it is given.
+type recordingFolders struct {
+	calls   []string
+	listing []string
+}
+
+func (f *recordingFolders) GetFolder(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "get "+name)
+	return nil
+}
+
+func (f *recordingFolders) CreateFolder(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "create "+name)
+	return nil
+}
+
+func (f *recordingFolders) DeleteFolder(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "delete "+name)
+	return nil
+}
+
+func (f *recordingFolders) RenameFolder(
+	ctx context.Context,
+	srcName string,
+	dstName string) error {
+	f.calls = append(f.calls, "rename "+srcName+" "+dstName)
+	return nil
+}
+
+func (f *recordingFolders) ListFolders(
+	ctx context.Context,
+	parent string) ([]string, error) {
+	f.calls = append(f.calls, "list "+parent)
+	return f.listing, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefixFoldersTest struct {
+	ctx     context.Context
+	wrapped recordingFolders
+	folders storage.Folders
+}
+
+var _ SetUpInterface = &PrefixFoldersTest{}
+
+func init() { RegisterTestSuite(&PrefixFoldersTest{}) }
+
+func (t *PrefixFoldersTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.folders = gcsx.NewPrefixFolders("foo/", &t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefixFoldersTest) AddsPrefix() {
+	AssertEq(nil, t.folders.GetFolder(t.ctx, "a/"))
+	AssertEq(nil, t.folders.CreateFolder(t.ctx, "b/"))
+	AssertEq(nil, t.folders.DeleteFolder(t.ctx, "c/"))
+	AssertEq(nil, t.folders.RenameFolder(t.ctx, "d/", "e/f/"))
+
+	ExpectThat(
+		t.wrapped.calls,
+		ElementsAre(
+			"get foo/a/",
+			"create foo/b/",
+			"delete foo/c/",
+			"rename foo/d/ foo/e/f/",
+		))
+}
+
+func (t *PrefixFoldersTest) ListFolders() {
+	t.wrapped.listing = []string{"foo/bar/", "foo/bar/baz/"}
+
+	names, err := t.folders.ListFolders(t.ctx, "bar/")
+	AssertEq(nil, err)
+	ExpectThat(t.wrapped.calls, ElementsAre("list foo/bar/"))
+	ExpectThat(names, ElementsAre("bar/", "bar/baz/"))
+}
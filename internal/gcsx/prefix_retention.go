@@ -0,0 +1,47 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+)
+
+// Create a view on the wrapped retention matching NewPrefixBucket: object
+// names are given without the supplied prefix, which must end in a slash.
+func NewPrefixRetention(
+	prefix string,
+	wrapped storage.Retention) (r storage.Retention) {
+	r = &prefixRetention{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type prefixRetention struct {
+	prefix  string
+	wrapped storage.Retention
+}
+
+func (pr *prefixRetention) StatRetention(
+	ctx context.Context,
+	name string,
+	generation int64) (r storage.ObjectRetention, err error) {
+	r, err = pr.wrapped.StatRetention(ctx, pr.prefix+name, generation)
+	return
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPrefixRetention(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Records the names it is asked about, and reports a temporary hold on each.
+type recordingRetention struct {
+	names []string
+}
+
+func (r *recordingRetention) StatRetention(
+	ctx context.Context,
+	name string,
+	generation int64) (storage.ObjectRetention, error) {
+	r.names = append(r.names, name)
+	return storage.ObjectRetention{TemporaryHold: true}, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefixRetentionTest struct {
+	ctx     context.Context
+	wrapped recordingRetention
+	r       storage.Retention
+}
+
+var _ SetUpInterface = &PrefixRetentionTest{}
+
+func init() { RegisterTestSuite(&PrefixRetentionTest{}) }
+
+func (t *PrefixRetentionTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.r = gcsx.NewPrefixRetention("foo/", &t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefixRetentionTest) StatRetention() {
+	r, err := t.r.StatRetention(t.ctx, "bar/baz", 17)
+	AssertEq(nil, err)
+	ExpectThat(t.wrapped.names, ElementsAre("foo/bar/baz"))
+	ExpectTrue(r.TemporaryHold)
+}
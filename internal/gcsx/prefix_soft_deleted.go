@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+// Create a view on the wrapped soft-deleted objects matching NewPrefixBucket:
+// object names are given and returned without the supplied prefix, which must
+// end in a slash.
+func NewPrefixSoftDeleted(
+	prefix string,
+	wrapped storage.SoftDeleted) (sd storage.SoftDeleted) {
+	sd = &prefixSoftDeleted{
+		prefix:  prefix,
+		wrapped: wrapped,
+	}
+
+	return
+}
+
+type prefixSoftDeleted struct {
+	prefix  string
+	wrapped storage.SoftDeleted
+}
+
+func (sd *prefixSoftDeleted) ListSoftDeleted(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	mReq := *req
+	mReq.Prefix = sd.prefix + req.Prefix
+
+	listing, err = sd.wrapped.ListSoftDeleted(ctx, &mReq)
+	if err != nil {
+		return
+	}
+
+	for _, o := range listing.Objects {
+		o.Name = strings.TrimPrefix(o.Name, sd.prefix)
+	}
+
+	for i, p := range listing.CollapsedRuns {
+		listing.CollapsedRuns[i] = strings.TrimPrefix(p, sd.prefix)
+	}
+
+	return
+}
+
+func (sd *prefixSoftDeleted) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64) (o *gcs.Object, err error) {
+	o, err = sd.wrapped.RestoreObject(ctx, sd.prefix+name, generation)
+	if err != nil {
+		return
+	}
+
+	o.Name = strings.TrimPrefix(o.Name, sd.prefix)
+	return
+}
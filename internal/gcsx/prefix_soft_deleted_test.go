@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestPrefixSoftDeleted(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Records the requests it receives, and returns the listing it is given.
+type recordingSoftDeleted struct {
+	prefixes []string
+	restored []string
+	listing  gcs.Listing
+}
+
+func (sd *recordingSoftDeleted) ListSoftDeleted(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (*gcs.Listing, error) {
+	sd.prefixes = append(sd.prefixes, req.Prefix)
+	listing := sd.listing
+	return &listing, nil
+}
+
+func (sd *recordingSoftDeleted) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64) (*gcs.Object, error) {
+	sd.restored = append(sd.restored, name)
+	return &gcs.Object{Name: name, Generation: generation}, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefixSoftDeletedTest struct {
+	ctx     context.Context
+	wrapped recordingSoftDeleted
+	sd      storage.SoftDeleted
+}
+
+var _ SetUpInterface = &PrefixSoftDeletedTest{}
+
+func init() { RegisterTestSuite(&PrefixSoftDeletedTest{}) }
+
+func (t *PrefixSoftDeletedTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.sd = gcsx.NewPrefixSoftDeleted("foo/", &t.wrapped)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefixSoftDeletedTest) ListSoftDeleted() {
+	t.wrapped.listing = gcs.Listing{
+		Objects:       []*gcs.Object{{Name: "foo/bar/baz"}},
+		CollapsedRuns: []string{"foo/bar/qux/"},
+	}
+
+	listing, err := t.sd.ListSoftDeleted(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "bar/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	ExpectThat(t.wrapped.prefixes, ElementsAre("foo/bar/"))
+	AssertEq(1, len(listing.Objects))
+	ExpectEq("bar/baz", listing.Objects[0].Name)
+	ExpectThat(listing.CollapsedRuns, ElementsAre("bar/qux/"))
+}
+
+func (t *PrefixSoftDeletedTest) RestoreObject() {
+	o, err := t.sd.RestoreObject(t.ctx, "bar/baz", 17)
+	AssertEq(nil, err)
+	ExpectThat(t.wrapped.restored, ElementsAre("foo/bar/baz"))
+	ExpectEq("bar/baz", o.Name)
+	ExpectEq(17, o.Generation)
+}
@@ -19,6 +19,7 @@ import (
 	"io"
 	"math"
 
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
 	"github.com/jacobsa/gcloud/gcs"
 	"golang.org/x/net/context"
 )
@@ -121,7 +122,7 @@ func (rr *randomReader) ReadAt(
 
 		// If we don't have a reader, start a read operation.
 		if rr.reader == nil {
-			err = rr.startRead(offset, int64(len(p)))
+			err = rr.startRead(ctx, offset, int64(len(p)))
 			if err != nil {
 				err = fmt.Errorf("startRead: %v", err)
 				return
@@ -234,6 +235,7 @@ func (rr *randomReader) readFull(
 // Ensure that rr.reader is set up for a range for which [start, start+size) is
 // a prefix.
 func (rr *randomReader) startRead(
+	ctx context.Context,
 	start int64,
 	size int64) (err error) {
 	// Make sure start and size are legal.
@@ -266,8 +268,10 @@ func (rr *randomReader) startRead(
 		actualSize = int64(rr.object.Size) - start
 	}
 
-	// Begin the read.
-	ctx, cancel := context.WithCancel(context.Background())
+	// Begin the read. The reader may outlive the caller's context, so don't
+	// derive from it except to continue its trace.
+	ctx, cancel := context.WithCancel(
+		tracing.NewContext(context.Background(), tracing.FromContext(ctx)))
 	rc, err := rr.bucket.NewReader(
 		ctx,
 		&gcs.ReadObjectRequest{
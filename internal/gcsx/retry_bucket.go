@@ -0,0 +1,379 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// Parameters for NewRetryBucket.
+type RetryConfig struct {
+	// The delay before the first retry is chosen uniformly at random from
+	// [0, InitialDelay). Each subsequent upper bound is Multiplier times the
+	// previous one, but never more than MaxDelay.
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+
+	// The maximum number of attempts for a single request, including the
+	// first.
+	MaxAttempts int
+
+	// The number of retries allowed across all requests, as a fraction of the
+	// number of requests made. Retries in excess of this are not made, so that
+	// a widespread outage doesn't cause a storm of retries. A small initial
+	// reserve allows isolated failures to be retried before there has been
+	// much traffic.
+	BudgetRatio float64
+}
+
+// Create a bucket that retries requests that fail with errors that are likely
+// to be transient (HTTP 429 and 5xx responses, and network errors), sleeping
+// with exponential backoff and jitter between attempts.
+//
+// Only requests that are safe to repeat are retried: reads, and modifications
+// carrying a precondition or naming a specific generation such that a
+// repeated attempt can't clobber a concurrent writer.
+func NewRetryBucket(cfg RetryConfig, wrapped gcs.Bucket) gcs.Bucket {
+	return &retryBucket{
+		wrapped: wrapped,
+		cfg:     cfg,
+		budget:  retryBudgetReserve,
+	}
+}
+
+const (
+	// The number of retries available in the budget initially.
+	retryBudgetReserve = 10
+
+	// The largest balance the budget can accumulate.
+	retryBudgetMax = 1000
+)
+
+type retryBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	wrapped gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	cfg RetryConfig
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of retries we may currently make.
+	//
+	// GUARDED_BY(mu)
+	budget float64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func sleepWithContext(ctx context.Context, d time.Duration) (err error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Is the supplied error likely to be transient?
+func isRetryable(err error) bool {
+	switch typed := err.(type) {
+	case *googleapi.Error:
+		return typed.Code == 429 || (typed.Code >= 500 && typed.Code < 600)
+
+	case *net.OpError:
+		return true
+
+	case *url.Error:
+		// The HTTP package leaks EOF errors wrapped in URL errors when the server
+		// closes the connection, and otherwise wraps the real error.
+		return typed.Err == io.EOF || isRetryable(typed.Err)
+	}
+
+	return err == io.ErrUnexpectedEOF
+}
+
+// Record that a request is being made, earning credit towards retries.
+func (b *retryBucket) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.budget = math.Min(b.budget+b.cfg.BudgetRatio, retryBudgetMax)
+}
+
+// Attempt to draw a retry from the budget.
+func (b *retryBucket) withdraw() (ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.budget < 1 {
+		return
+	}
+
+	b.budget--
+	ok = true
+	return
+}
+
+// Choose the delay before the given retry, numbered from zero.
+func (b *retryBucket) chooseDelay(retry int) time.Duration {
+	limit := float64(b.cfg.InitialDelay) * math.Pow(b.cfg.Multiplier, float64(retry))
+	limit = math.Min(limit, float64(b.cfg.MaxDelay))
+	if limit < 1 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// Call f until it succeeds, fails with an error that isn't retryable, or we
+// give up. If non-nil, reset is called before each retry.
+func (b *retryBucket) retry(
+	ctx context.Context,
+	desc string,
+	reset func() error,
+	f func() error) (err error) {
+	b.deposit()
+
+	for attempt := 0; ; attempt++ {
+		err = f()
+		if err == nil || !isRetryable(err) {
+			return
+		}
+
+		// Are we allowed another attempt?
+		if attempt+1 >= b.cfg.MaxAttempts {
+			return
+		}
+
+		if !b.withdraw() {
+			logger.Warningf("Not retrying %s: retry budget exhausted", desc)
+			return
+		}
+
+		d := b.chooseDelay(attempt)
+		logger.Infof("Retrying %s in %v after error: %v", desc, d, err)
+
+		// On cancellation, return the last error we saw.
+		if sleepWithContext(ctx, d) != nil {
+			return
+		}
+
+		if reset != nil {
+			if resetErr := reset(); resetErr != nil {
+				err = fmt.Errorf("Preparing to retry: %v", resetErr)
+				return
+			}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bucket interface
+////////////////////////////////////////////////////////////////////////
+
+func (b *retryBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *retryBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	err = b.retry(
+		ctx,
+		fmt.Sprintf("NewReader(%q)", req.Name),
+		nil,
+		func() (err error) {
+			rc, err = b.wrapped.NewReader(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	var attempts int
+	f := func() (err error) {
+		attempts++
+		o, err = b.wrapped.CreateObject(ctx, req)
+		return
+	}
+
+	// Without a precondition, a retry could clobber a concurrent writer whose
+	// generation appeared after our first attempt succeeded. And we can only
+	// resend contents that we can rewind.
+	seeker, ok := req.Contents.(io.Seeker)
+	if req.GenerationPrecondition == nil || !ok {
+		err = f()
+		return
+	}
+
+	pos, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	reset := func() (err error) {
+		_, err = seeker.Seek(pos, io.SeekStart)
+		return
+	}
+
+	err = b.retry(ctx, fmt.Sprintf("CreateObject(%q)", req.Name), reset, f)
+
+	// An attempt that failed with a transient error may nevertheless have
+	// created the object. If so a later attempt to create it exclusively fails
+	// its precondition, but that doesn't mean that someone else created it, so
+	// don't let the caller conclude that they did.
+	if _, ok := err.(*gcs.PreconditionError); ok &&
+		attempts > 1 &&
+		*req.GenerationPrecondition == 0 {
+		err = fmt.Errorf(
+			"Object exists, but may have been created by an earlier attempt: %v",
+			err)
+	}
+
+	return
+}
+
+func (b *retryBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	f := func() (err error) {
+		o, err = b.wrapped.CopyObject(ctx, req)
+		return
+	}
+
+	// Copying a specific generation again yields the same result.
+	if req.SrcGeneration == 0 {
+		err = f()
+		return
+	}
+
+	err = b.retry(ctx, fmt.Sprintf("CopyObject(%q)", req.SrcName), nil, f)
+	return
+}
+
+func (b *retryBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	f := func() (err error) {
+		o, err = b.wrapped.ComposeObjects(ctx, req)
+		return
+	}
+
+	if req.DstGenerationPrecondition == nil {
+		err = f()
+		return
+	}
+
+	err = b.retry(ctx, fmt.Sprintf("ComposeObjects(%q)", req.DstName), nil, f)
+	return
+}
+
+func (b *retryBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = b.retry(
+		ctx,
+		fmt.Sprintf("StatObject(%q)", req.Name),
+		nil,
+		func() (err error) {
+			o, err = b.wrapped.StatObject(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	err = b.retry(
+		ctx,
+		fmt.Sprintf("ListObjects(%q)", req.Prefix),
+		nil,
+		func() (err error) {
+			listing, err = b.wrapped.ListObjects(ctx, req)
+			return
+		})
+
+	return
+}
+
+func (b *retryBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	f := func() (err error) {
+		o, err = b.wrapped.UpdateObject(ctx, req)
+		return
+	}
+
+	if req.MetaGenerationPrecondition == nil {
+		err = f()
+		return
+	}
+
+	err = b.retry(ctx, fmt.Sprintf("UpdateObject(%q)", req.Name), nil, f)
+	return
+}
+
+func (b *retryBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	f := func() error {
+		return b.wrapped.DeleteObject(ctx, req)
+	}
+
+	// Deleting the latest generation again could delete a newer one.
+	if req.Generation == 0 {
+		err = f()
+		return
+	}
+
+	err = b.retry(ctx, fmt.Sprintf("DeleteObject(%q)", req.Name), nil, f)
+	return
+}
@@ -0,0 +1,309 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Failing bucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose methods return the errors in failures, one per call, before
+// delegating to the wrapped bucket.
+type failingBucket struct {
+	gcs.Bucket
+	failures []error
+	calls    int
+}
+
+func (b *failingBucket) fail() (err error) {
+	b.calls++
+	if len(b.failures) > 0 {
+		err = b.failures[0]
+		b.failures = b.failures[1:]
+	}
+
+	return
+}
+
+func (b *failingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	if err = b.fail(); err != nil {
+		return
+	}
+
+	o, err = b.Bucket.StatObject(ctx, req)
+	return
+}
+
+func (b *failingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if err = b.fail(); err != nil {
+		// Simulate the connection dropping part way through the upload.
+		ioutil.ReadAll(req.Contents)
+		return
+	}
+
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b *failingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	if err = b.fail(); err != nil {
+		return
+	}
+
+	err = b.Bucket.DeleteObject(ctx, req)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+var (
+	errUnavailable = &googleapi.Error{Code: 503, Message: "unavailable"}
+	errForbidden   = &googleapi.Error{Code: 403, Message: "forbidden"}
+)
+
+type RetryBucketTest struct {
+	ctx     context.Context
+	failing *failingBucket
+	cfg     gcsx.RetryConfig
+	bucket  gcs.Bucket
+}
+
+var _ SetUpInterface = &RetryBucketTest{}
+
+func init() { RegisterTestSuite(&RetryBucketTest{}) }
+
+func (t *RetryBucketTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.failing = &failingBucket{
+		Bucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+	}
+
+	t.cfg = gcsx.RetryConfig{
+		InitialDelay: time.Millisecond,
+		Multiplier:   2,
+		MaxDelay:     4 * time.Millisecond,
+		MaxAttempts:  4,
+		BudgetRatio:  0.1,
+	}
+
+	t.bucket = gcsx.NewRetryBucket(t.cfg, t.failing)
+}
+
+func (t *RetryBucketTest) stat() (err error) {
+	_, err = t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RetryBucketTest) TransientErrorsRetried() {
+	t.failing.failures = []error{errUnavailable, errUnavailable}
+
+	err := t.stat()
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+	ExpectEq(3, t.failing.calls)
+}
+
+func (t *RetryBucketTest) PermanentErrorsNotRetried() {
+	t.failing.failures = []error{errForbidden}
+
+	err := t.stat()
+	ExpectEq(errForbidden, err)
+	ExpectEq(1, t.failing.calls)
+}
+
+func (t *RetryBucketTest) UnknownErrorsNotRetried() {
+	t.failing.failures = []error{errors.New("taco")}
+
+	err := t.stat()
+	ExpectThat(err, Error(Equals("taco")))
+	ExpectEq(1, t.failing.calls)
+}
+
+func (t *RetryBucketTest) GivesUpAfterMaxAttempts() {
+	t.failing.failures = []error{
+		errUnavailable,
+		errUnavailable,
+		errUnavailable,
+		errUnavailable,
+		errUnavailable,
+	}
+
+	err := t.stat()
+	ExpectEq(errUnavailable, err)
+	ExpectEq(4, t.failing.calls)
+}
+
+func (t *RetryBucketTest) BudgetExhausted() {
+	// The initial reserve allows ten retries. Spend them.
+	for i := 0; i < 10; i++ {
+		t.failing.failures = []error{errUnavailable}
+		AssertThat(t.stat(), HasSameTypeAs(&gcs.NotFoundError{}))
+	}
+
+	// The eleven requests so far have earned 1.1 retries, so the next request
+	// may be retried once but not twice.
+	t.failing.calls = 0
+	t.failing.failures = []error{errUnavailable, errUnavailable}
+
+	err := t.stat()
+	ExpectEq(errUnavailable, err)
+	ExpectEq(2, t.failing.calls)
+}
+
+func (t *RetryBucketTest) CancellationStopsRetrying() {
+	t.cfg.InitialDelay = time.Hour
+	t.cfg.MaxDelay = time.Hour
+	t.bucket = gcsx.NewRetryBucket(t.cfg, t.failing)
+	t.failing.failures = []error{errUnavailable, errUnavailable}
+
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Millisecond)
+	defer cancel()
+
+	_, err := t.bucket.StatObject(ctx, &gcs.StatObjectRequest{Name: "foo"})
+	ExpectEq(errUnavailable, err)
+	ExpectEq(1, t.failing.calls)
+}
+
+func (t *RetryBucketTest) CreateWithPreconditionRewindsContents() {
+	t.failing.failures = []error{errUnavailable}
+
+	// Start part way into the contents, as the syncer does when appending.
+	contents := bytes.NewReader([]byte("burrito"))
+	_, err := contents.Seek(3, 0)
+	AssertEq(nil, err)
+
+	var precond int64
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               contents,
+			GenerationPrecondition: &precond,
+		})
+
+	AssertEq(nil, err)
+	ExpectEq(2, t.failing.calls)
+
+	actual, err := gcsutil.ReadObject(t.ctx, t.failing, "foo")
+	AssertEq(nil, err)
+	ExpectEq("rito", string(actual))
+}
+
+func (t *RetryBucketTest) ExclusiveCreateAmbiguousAfterRetry() {
+	// Simulate the first attempt creating the object but the response being
+	// lost, so that the retry finds the object already exists.
+	_, err := gcsutil.CreateObject(t.ctx, t.failing, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.failing.calls = 0
+	t.failing.failures = []error{errUnavailable}
+
+	var precond int64
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               bytes.NewReader([]byte("taco")),
+			GenerationPrecondition: &precond,
+		})
+
+	ExpectEq(2, t.failing.calls)
+	ExpectThat(err, Error(HasSubstr("earlier attempt")))
+	_, ok := err.(*gcs.PreconditionError)
+	ExpectFalse(ok)
+}
+
+func (t *RetryBucketTest) ExclusiveCreateConflictWithoutRetry() {
+	_, err := gcsutil.CreateObject(t.ctx, t.failing, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	var precond int64
+	_, err = t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   "foo",
+			Contents:               bytes.NewReader([]byte("taco")),
+			GenerationPrecondition: &precond,
+		})
+
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *RetryBucketTest) CreateWithoutPreconditionNotRetried() {
+	t.failing.failures = []error{errUnavailable}
+
+	_, err := t.bucket.CreateObject(
+		t.ctx,
+		&gcs.CreateObjectRequest{
+			Name:     "foo",
+			Contents: bytes.NewReader([]byte("taco")),
+		})
+
+	ExpectEq(errUnavailable, err)
+	ExpectEq(1, t.failing.calls)
+}
+
+func (t *RetryBucketTest) DeleteLatestGenerationNotRetried() {
+	t.failing.failures = []error{errUnavailable}
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	ExpectEq(errUnavailable, err)
+	ExpectEq(1, t.failing.calls)
+}
+
+func (t *RetryBucketTest) DeleteSpecificGenerationRetried() {
+	o, err := gcsutil.CreateObject(t.ctx, t.failing, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.failing.calls = 0
+	t.failing.failures = []error{errUnavailable}
+
+	err = t.bucket.DeleteObject(
+		t.ctx,
+		&gcs.DeleteObjectRequest{Name: "foo", Generation: o.Generation})
+
+	AssertEq(nil, err)
+	ExpectEq(2, t.failing.calls)
+}
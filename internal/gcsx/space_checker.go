@@ -0,0 +1,82 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// Checks, before content is staged in a directory, that the file system
+// holding it has room, leaving a reserve free for everything else on it. This
+// lets a write fail cleanly with ENOSPC up front, rather than part way through
+// copying an object or with an obscure error from the local file system.
+//
+// A nil *SpaceChecker allows everything. Safe for concurrent access.
+type SpaceChecker struct {
+	dir     string
+	reserve uint64
+}
+
+// Create a checker for the file system containing dir, or the system default
+// temporary location if dir is empty, that keeps reserve bytes free.
+func NewSpaceChecker(dir string, reserve uint64) (sc *SpaceChecker) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	sc = &SpaceChecker{
+		dir:     dir,
+		reserve: reserve,
+	}
+
+	return
+}
+
+// Return syscall.ENOSPC, unwrapped so that it can be passed on to the kernel,
+// if staging n more bytes would leave less than the reserve free.
+func (sc *SpaceChecker) Check(n int64) (err error) {
+	if sc == nil || n <= 0 {
+		return
+	}
+
+	var st syscall.Statfs_t
+	err = syscall.Statfs(sc.dir, &st)
+	if err != nil {
+		err = fmt.Errorf("Statfs: %v", err)
+		return
+	}
+
+	// Blocks available to unprivileged users, which we are likely to be.
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	if free >= sc.reserve && free-sc.reserve >= uint64(n) {
+		return
+	}
+
+	logger.Errorf(
+		"Refusing to stage %d bytes in %q, which has %d bytes free, of which %d "+
+			"are to be kept free. Free up space there or choose another "+
+			"directory with --temp-dir or --staging-dir.",
+		n,
+		sc.dir,
+		free,
+		sc.reserve)
+
+	err = syscall.ENOSPC
+	return
+}
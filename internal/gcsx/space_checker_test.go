@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSpaceChecker(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SpaceCheckerTest struct {
+	dir string
+}
+
+var _ SetUpInterface = &SpaceCheckerTest{}
+var _ TearDownInterface = &SpaceCheckerTest{}
+
+func init() { RegisterTestSuite(&SpaceCheckerTest{}) }
+
+func (t *SpaceCheckerTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "space_checker_test")
+	AssertEq(nil, err)
+}
+
+func (t *SpaceCheckerTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SpaceCheckerTest) NilChecker() {
+	var sc *gcsx.SpaceChecker
+	ExpectEq(nil, sc.Check(1<<62))
+}
+
+func (t *SpaceCheckerTest) RoomAvailable() {
+	sc := gcsx.NewSpaceChecker(t.dir, 0)
+	ExpectEq(nil, sc.Check(1))
+}
+
+func (t *SpaceCheckerTest) WriteTooLarge() {
+	sc := gcsx.NewSpaceChecker(t.dir, 0)
+	ExpectEq(syscall.ENOSPC, sc.Check(1<<62))
+}
+
+func (t *SpaceCheckerTest) ReserveExceedsFreeSpace() {
+	sc := gcsx.NewSpaceChecker(t.dir, 1<<62)
+	ExpectEq(syscall.ENOSPC, sc.Check(1))
+
+	// Nothing to stage is always fine.
+	ExpectEq(nil, sc.Check(0))
+}
+
+func (t *SpaceCheckerTest) MissingDirectory() {
+	sc := gcsx.NewSpaceChecker(t.dir+"/foo", 0)
+	err := sc.Check(1)
+
+	ExpectThat(err, Error(HasSubstr("Statfs")))
+}
+
+func (t *SpaceCheckerTest) DefaultDirectory() {
+	sc := gcsx.NewSpaceChecker("", 0)
+	ExpectEq(nil, sc.Check(1))
+}
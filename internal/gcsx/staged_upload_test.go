@@ -0,0 +1,434 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+func TestStagedUpload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+const testChunkSize = gcs.ResumableChunkMultiple
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A transport that plays the part of GCS for resumable uploads, holding the
+// bytes received by each session.
+type uploadTransport struct {
+	mu sync.Mutex
+
+	// The bytes received by each session, keyed by URL.
+	sessions map[string][]byte
+
+	// The Content-Range headers of the requests carrying data, in order.
+	ranges []string
+
+	// The number of requests carrying data to accept before failing the rest,
+	// as if the process died. Negative for no limit.
+	remaining int
+}
+
+func (rt *uploadTransport) RoundTrip(
+	req *http.Request) (res *http.Response, err error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	res = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+		Request:    req,
+	}
+
+	switch {
+	// Start a session.
+	case req.Method == "POST" &&
+		req.URL.Query().Get("uploadType") == "resumable":
+		u := fmt.Sprintf("https://uploads.test/session/%d", len(rt.sessions))
+		rt.sessions[u] = []byte{}
+		res.Header.Set("Location", u)
+
+	// Send to or query a session.
+	case req.Method == "PUT":
+		received, ok := rt.sessions[req.URL.String()]
+		if !ok {
+			res.StatusCode = http.StatusNotFound
+			break
+		}
+
+		// A request without a Content-Range carries all of the contents.
+		var first, last, size int64
+		cr := req.Header.Get("Content-Range")
+		if _, err := fmt.Sscanf(cr, "bytes */%d", &size); err != nil {
+			if rt.remaining == 0 {
+				return nil, &net.OpError{
+					Op:  "read",
+					Net: "tcp",
+					Err: errors.New("connection reset"),
+				}
+			}
+
+			rt.remaining--
+			if cr != "" {
+				rt.ranges = append(rt.ranges, cr)
+				fmt.Sscanf(cr, "bytes %d-%d/%d", &first, &last, &size)
+			}
+
+			if first != int64(len(received)) {
+				res.StatusCode = http.StatusBadRequest
+				break
+			}
+
+			data, _ := ioutil.ReadAll(req.Body)
+			received = append(received, data...)
+			rt.sessions[req.URL.String()] = received
+
+			if cr == "" {
+				size = int64(len(received))
+			}
+		}
+
+		if int64(len(received)) < size {
+			res.StatusCode = http.StatusPermanentRedirect
+			if len(received) > 0 {
+				res.Header.Set("Range", fmt.Sprintf("bytes=0-%d", len(received)-1))
+			}
+
+			break
+		}
+
+		crc := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc, crc32.Checksum(received, crc32cTable))
+		md5Sum := md5.Sum(received)
+
+		res.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(
+			`{"name": "foo", "generation": "17", "size": "%d", `+
+				`"crc32c": "%s", "md5Hash": "%s"}`,
+			len(received),
+			base64.StdEncoding.EncodeToString(crc),
+			base64.StdEncoding.EncodeToString(md5Sum[:]))))
+	}
+
+	return
+}
+
+func (rt *uploadTransport) CancelRequest(req *http.Request) {
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// Tests for resuming large uploads of staged content.
+type StagedUploadTest struct {
+	ctx       context.Context
+	clock     timeutil.SimulatedClock
+	transport uploadTransport
+	bucket    gcs.Bucket
+	dir       string
+	sa        *StagingArea
+	contents  []byte
+}
+
+func init() { RegisterTestSuite(&StagedUploadTest{}) }
+
+func (t *StagedUploadTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.transport.sessions = make(map[string][]byte)
+	t.transport.remaining = -1
+
+	conn, err := gcs.NewConn(&gcs.ConnConfig{
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "taco"}),
+		Transport:   &t.transport,
+	})
+
+	AssertEq(nil, err)
+
+	t.bucket, err = conn.OpenBucket(t.ctx, "some_bucket")
+	AssertEq(nil, err)
+
+	t.dir, err = ioutil.TempDir("", "staged_upload_test")
+	AssertEq(nil, err)
+
+	t.sa = t.newArea()
+
+	// Two and a half chunks.
+	t.contents = bytes.Repeat([]byte("0123456789abcdef"), 5*testChunkSize/32)
+}
+
+func (t *StagedUploadTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *StagedUploadTest) newArea() (sa *StagingArea) {
+	sa, err := NewStagingArea(filepath.Join(t.dir, "staging"), "", nil)
+	AssertEq(nil, err)
+
+	sa.chunkSize = testChunkSize
+	return
+}
+
+// Simulate the death of the process, and another taking over the area.
+func (t *StagedUploadTest) restart() {
+	t.sa.Close()
+	t.sa = t.newArea()
+}
+
+// Stage the contents for a new object, as a file inode does.
+func (t *StagedUploadTest) stage() (tf TempFile) {
+	tf, err := t.sa.NewTempFile(
+		bytes.NewReader(t.contents),
+		StagedWrite{
+			Bucket: t.bucket.Name(),
+			Object: "foo",
+		},
+		&t.clock)
+
+	AssertEq(nil, err)
+	return
+}
+
+// Upload the staged contents as the syncer does.
+func (t *StagedUploadTest) upload(tf TempFile) (err error) {
+	_, err = tf.Seek(0, 0)
+	AssertEq(nil, err)
+
+	oc := &fullObjectCreator{bucket: t.bucket}
+	_, err = oc.Create(t.ctx, &gcs.Object{Name: "foo"}, time.Now(), tf)
+	return
+}
+
+// Return the single write left in the area.
+func (t *StagedUploadTest) orphan() (w StagedWrite) {
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	w = writes[0]
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StagedUploadTest) UploadedInChunks() {
+	err := t.upload(t.stage())
+	AssertEq(nil, err)
+
+	ExpectThat(t.transport.ranges, ElementsAre(
+		fmt.Sprintf("bytes 0-%d/%d", testChunkSize-1, len(t.contents)),
+		fmt.Sprintf(
+			"bytes %d-%d/%d",
+			testChunkSize,
+			2*testChunkSize-1,
+			len(t.contents)),
+		fmt.Sprintf(
+			"bytes %d-%d/%d",
+			2*testChunkSize,
+			len(t.contents)-1,
+			len(t.contents)),
+	))
+
+	ExpectTrue(bytes.Equal(t.contents, t.transport.sessions[t.orphan().UploadURL]))
+}
+
+func (t *StagedUploadTest) SmallContentsUploadedInOneGo() {
+	t.contents = t.contents[:testChunkSize-1]
+
+	err := t.upload(t.stage())
+	AssertEq(nil, err)
+
+	ExpectThat(t.transport.ranges, ElementsAre())
+	ExpectEq("", t.orphan().UploadURL)
+}
+
+func (t *StagedUploadTest) ProgressCheckpointed() {
+	t.transport.remaining = 2
+
+	err := t.upload(t.stage())
+	ExpectThat(err, Error(HasSubstr("connection reset")))
+
+	w := t.orphan()
+	ExpectEq("https://uploads.test/session/0", w.UploadURL)
+	ExpectEq(2*testChunkSize, w.UploadOffset)
+}
+
+func (t *StagedUploadTest) ResumedByLaterProcess() {
+	t.transport.remaining = 2
+
+	err := t.upload(t.stage())
+	AssertNe(nil, err)
+
+	// A later process continues the session from where it left off.
+	t.transport.remaining = -1
+	t.transport.ranges = nil
+
+	t.restart()
+	err = t.sa.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectThat(t.transport.ranges, ElementsAre(
+		fmt.Sprintf(
+			"bytes %d-%d/%d",
+			2*testChunkSize,
+			len(t.contents)-1,
+			len(t.contents)),
+	))
+
+	ExpectEq(1, len(t.transport.sessions))
+	ExpectTrue(
+		bytes.Equal(
+			t.contents,
+			t.transport.sessions["https://uploads.test/session/0"]))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+}
+
+func (t *StagedUploadTest) RetriedInSameProcess() {
+	t.transport.remaining = 1
+
+	tf := t.stage()
+	err := t.upload(tf)
+	AssertNe(nil, err)
+
+	t.transport.remaining = -1
+	t.transport.ranges = nil
+
+	err = t.upload(tf)
+	AssertEq(nil, err)
+
+	ExpectEq(1, len(t.transport.sessions))
+	ExpectEq(2, len(t.transport.ranges))
+	ExpectTrue(
+		bytes.Equal(
+			t.contents,
+			t.transport.sessions["https://uploads.test/session/0"]))
+}
+
+func (t *StagedUploadTest) ModifyingContentsForgetsSession() {
+	t.transport.remaining = 1
+
+	tf := t.stage()
+	err := t.upload(tf)
+	AssertNe(nil, err)
+	AssertNe("", t.orphan().UploadURL)
+
+	_, err = tf.WriteAt([]byte("taco"), 0)
+	AssertEq(nil, err)
+
+	w := t.orphan()
+	ExpectEq("", w.UploadURL)
+	ExpectEq(0, w.UploadOffset)
+
+	// The next upload starts over in a new session.
+	t.transport.remaining = -1
+	t.transport.ranges = nil
+
+	err = t.upload(tf)
+	AssertEq(nil, err)
+
+	ExpectEq(2, len(t.transport.sessions))
+	ExpectEq(3, len(t.transport.ranges))
+}
+
+func (t *StagedUploadTest) ExpiredSessionReplaced() {
+	t.transport.remaining = 1
+
+	err := t.upload(t.stage())
+	AssertNe(nil, err)
+
+	delete(t.transport.sessions, t.orphan().UploadURL)
+	t.transport.remaining = -1
+	t.transport.ranges = nil
+
+	t.restart()
+	err = t.sa.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	ExpectEq(3, len(t.transport.ranges))
+	ExpectTrue(
+		bytes.Equal(
+			t.contents,
+			t.transport.sessions["https://uploads.test/session/0"]))
+}
+
+func (t *StagedUploadTest) QueuedWriteContinuesSession() {
+	tf, err := NewTempFile(bytes.NewReader(t.contents), "", &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	err = t.sa.Queue(
+		tf,
+		StagedWrite{
+			Bucket: t.bucket.Name(),
+			Object: "foo",
+		})
+
+	AssertEq(nil, err)
+
+	// The first attempt is cut short, and the write stays queued.
+	t.transport.remaining = 1
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	AssertEq(1, len(t.transport.sessions))
+	AssertEq(1, len(t.transport.ranges))
+
+	// The next picks up where it left off.
+	t.transport.remaining = -1
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	ExpectEq(1, len(t.transport.sessions))
+	ExpectEq(3, len(t.transport.ranges))
+	ExpectTrue(
+		bytes.Equal(
+			t.contents,
+			t.transport.sessions["https://uploads.test/session/0"]))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+}
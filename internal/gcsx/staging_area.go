@@ -0,0 +1,822 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// A description of content staged for an object, stored in a manifest beside
+// the content.
+type StagedWrite struct {
+	Bucket string `json:"bucket"`
+	Object string `json:"object"`
+
+	// The prefix of the bucket to which Object is relative, if the file system
+	// was limited to one with --only-dir. Filled in by the area.
+	Prefix string `json:"prefix,omitempty"`
+
+	// The generation of the object from which the content was derived.
+	Generation int64 `json:"generation"`
+
+	// The resumable upload session through which the content was last being
+	// uploaded, if any, and how many bytes of it GCS had confirmed receiving.
+	// Cleared when the content is modified.
+	UploadURL    string `json:"upload_url,omitempty"`
+	UploadOffset int64  `json:"upload_offset,omitempty"`
+
+	// The path to the staged content.
+	Path string `json:"-"`
+}
+
+// A directory in which temp files for dirty objects are kept as named files,
+// each accompanied by a manifest describing the object it belongs to. Unlike
+// anonymous temp files, these survive the death of the process, so that a
+// later process can find the writes that were never synced and resume them.
+//
+// The area may also hold writes queued because GCS was unreachable when they
+// were synced, which it retries periodically once started with
+// StartReconciling. Safe for concurrent access.
+//
+// Large content is uploaded in chunks through a resumable upload session,
+// which is checkpointed in the manifest after each chunk. A later process
+// resuming the write continues the session rather than starting over.
+//
+// Several processes may share a directory. Each holds a lock on a file of its
+// own there until it exits, and names the content it stages after that file,
+// so that the others can tell its writes from those of processes that died.
+type StagingArea struct {
+	dir string
+
+	// The prefix of the bucket to which the objects of staged writes are
+	// relative.
+	prefix string
+
+	// The ID naming our lock file and the content we stage, and the locked
+	// file itself.
+	owner string
+	lock  *os.File
+
+	// Content at least this large is uploaded resumably, in chunks of this
+	// size.
+	chunkSize int64
+
+	// If non-nil, used to encrypt staged content.
+	cipher *DiskCipher
+
+	mu sync.Mutex
+
+	// Has StartReconciling been called? If so, stops the background
+	// reconciliation it started and waits for it to finish.
+	//
+	// GUARDED_BY(mu)
+	reconciling     bool
+	stopReconciling func()
+
+	// Writes queued by Queue and not yet reconciled, keyed by object name.
+	//
+	// GUARDED_BY(mu)
+	queued map[string]StagedWrite
+}
+
+const (
+	stagedContentPrefix = "staged_"
+	manifestSuffix      = ".json"
+	lockFilePrefix      = "lock_"
+
+	// See StagingArea.chunkSize.
+	uploadChunkSize = 64 << 20
+)
+
+// Return the directory holding the staging area.
+func (sa *StagingArea) Dir() string {
+	return sa.dir
+}
+
+// Create a staging area in the supplied directory, creating it if necessary,
+// for writes to objects whose names are relative to the given prefix of the
+// bucket. If cipher is non-nil, content is encrypted with it, and so must be
+// the content left by earlier processes.
+//
+// The area must be closed when the file system is unmounted.
+func NewStagingArea(
+	dir string,
+	prefix string,
+	cipher *DiskCipher) (sa *StagingArea, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	// Lock our lock file before giving it the name under which other processes
+	// look for it, so that they never find it unlocked.
+	lock, err := ioutil.TempFile(dir, "."+lockFilePrefix)
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(lock.Name())
+			lock.Close()
+		}
+	}()
+
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		err = fmt.Errorf("Flock: %v", err)
+		return
+	}
+
+	sa = &StagingArea{
+		dir:       dir,
+		prefix:    prefix,
+		owner:     strings.TrimPrefix(filepath.Base(lock.Name()), "."+lockFilePrefix),
+		lock:      lock,
+		chunkSize: uploadChunkSize,
+		cipher:    cipher,
+		queued:    make(map[string]StagedWrite),
+	}
+
+	err = os.Rename(lock.Name(), sa.lockPath(sa.owner))
+	if err != nil {
+		sa = nil
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+// Stop any background reconciliation and release the area's lock, leaving any
+// content still staged or queued in it to be resumed by a later process. The
+// area must not be used afterward.
+func (sa *StagingArea) Close() {
+	sa.mu.Lock()
+	stop := sa.stopReconciling
+	sa.mu.Unlock()
+
+	// Reconcile takes the lock, so wait for it without holding it.
+	if stop != nil {
+		stop()
+	}
+
+	os.Remove(sa.lockPath(sa.owner))
+	sa.lock.Close()
+}
+
+// Like NewTempFile, but the file is staged in the area along with a manifest
+// holding the supplied description until it is destroyed. w.Path is ignored.
+func (sa *StagingArea) NewTempFile(
+	content io.Reader,
+	w StagedWrite,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	f, path, size, err := sa.stage(content, &w)
+	if err != nil {
+		return
+	}
+
+	w.Path = path
+	tf = &tempFile{
+		clock:          clock,
+		f:              f,
+		dirtyThreshold: size,
+		staged:         &stagedManifest{sa: sa, w: w},
+		cleanUp: func() {
+			removeStaged(path)
+		},
+	}
+
+	return
+}
+
+// Does the area queue writes made while GCS is unreachable? True once
+// StartReconciling has been called.
+func (sa *StagingArea) QueuesOfflineWrites() bool {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	return sa.reconciling
+}
+
+// Copy the supplied content into the area as a write to be retried by
+// Reconcile, replacing any write already queued for the same object.
+// w.Path is ignored.
+func (sa *StagingArea) Queue(content TempFile, w StagedWrite) (err error) {
+	sr, err := content.Stat()
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	f, path, _, err := sa.stage(io.NewSectionReader(content, 0, sr.Size), &w)
+	if err != nil {
+		return
+	}
+
+	f.Close()
+	w.Path = path
+
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	if prev, ok := sa.queued[w.Object]; ok {
+		removeStaged(prev.Path)
+	}
+
+	sa.queued[w.Object] = w
+	logger.Infof("GCS is unreachable; queued write of %q.", w.Object)
+
+	return
+}
+
+// Discard any write queued for the supplied object, because newer content has
+// been written to GCS.
+func (sa *StagingArea) Dequeue(object string) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	if w, ok := sa.queued[object]; ok {
+		removeStaged(w.Path)
+		delete(sa.queued, object)
+	}
+}
+
+// Attempt to write out each queued write on the condition that the object
+// hasn't changed since the content was staged. Writes that succeed are
+// removed from the area. Those that fail because the object was modified in
+// the meantime are reported as conflicts and left in place for the user to
+// deal with, as are those that fail for other reasons. Writes that fail
+// because GCS is still unreachable remain queued.
+//
+// LOCKS_EXCLUDED(sa.mu)
+func (sa *StagingArea) Reconcile(
+	ctx context.Context,
+	bucket gcs.Bucket) {
+	sa.mu.Lock()
+	writes := make([]StagedWrite, 0, len(sa.queued))
+	for _, w := range sa.queued {
+		writes = append(writes, w)
+	}
+	sa.mu.Unlock()
+
+	for _, w := range writes {
+		// Writes cut short by the area being closed are left for the next
+		// process.
+		resumeErr := sa.resumeWrite(ctx, bucket, w)
+		if isUnreachable(resumeErr) || ctx.Err() != nil {
+			continue
+		}
+
+		sa.mu.Lock()
+
+		// Has the write been superseded while we were working?
+		if sa.queued[w.Object] != w {
+			sa.mu.Unlock()
+			continue
+		}
+
+		delete(sa.queued, w.Object)
+		sa.mu.Unlock()
+
+		switch resumeErr.(type) {
+		case nil:
+			logger.Infof("Wrote queued write of %q.", w.Object)
+			removeStaged(w.Path)
+
+		case *gcs.PreconditionError:
+			logger.Warningf(
+				"Conflict: %q was modified in GCS while its write was queued; "+
+					"the queued content is at %s",
+				w.Object,
+				w.Path)
+
+		default:
+			logger.Warningf(
+				"Failed to write queued write of %q; its content is at %s: %v",
+				w.Object,
+				w.Path,
+				resumeErr)
+		}
+	}
+}
+
+// Start queueing writes made while GCS is unreachable, and reconciling them
+// with the supplied bucket at the given interval in the background until the
+// area is closed.
+func (sa *StagingArea) StartReconciling(
+	bucket gcs.Bucket,
+	interval time.Duration) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	if sa.reconciling {
+		panic("StartReconciling called twice")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	sa.reconciling = true
+	sa.stopReconciling = func() {
+		cancel()
+		<-done
+	}
+
+	go func() {
+		defer close(done)
+		sa.reconcilePeriodically(ctx, bucket, interval)
+	}()
+}
+
+// Call Reconcile each time the given interval passes, until the context is
+// cancelled.
+func (sa *StagingArea) reconcilePeriodically(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		sa.Reconcile(ctx, bucket)
+	}
+}
+
+// Return the writes staged by earlier processes that were never synced or
+// destroyed. Content left without a manifest by a process that died while
+// creating it is discarded. Writes of processes still using the area are left
+// alone.
+//
+// Must be called before the area is used to create temp files.
+func (sa *StagingArea) Orphans() (writes []StagedWrite, err error) {
+	writes, locks, err := sa.orphans()
+	for _, f := range locks {
+		f.Close()
+	}
+
+	return
+}
+
+// Like Orphans, but also return the locked lock files of the dead processes
+// that staged the writes, which the caller must close.
+func (sa *StagingArea) orphans() (
+	writes []StagedWrite,
+	locks []*os.File,
+	err error) {
+	entries, err := ioutil.ReadDir(sa.dir)
+	if err != nil {
+		err = fmt.Errorf("ReadDir: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			for _, f := range locks {
+				f.Close()
+			}
+
+			locks = nil
+		}
+	}()
+
+	// Find out which of the processes that staged content or left a lock file
+	// are still running, locking the lock files of the rest.
+	manifests := make(map[string]bool)
+	live := make(map[string]bool)
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, manifestSuffix) {
+			manifests[strings.TrimSuffix(name, manifestSuffix)] = true
+		}
+
+		var owner string
+		switch {
+		case strings.HasPrefix(name, lockFilePrefix):
+			owner = strings.TrimPrefix(name, lockFilePrefix)
+
+		case strings.HasPrefix(name, stagedContentPrefix):
+			owner = stagedContentOwner(name)
+
+		default:
+			continue
+		}
+
+		if _, ok := live[owner]; ok || owner == sa.owner {
+			continue
+		}
+
+		var f *os.File
+		f, live[owner], err = sa.lockOwner(owner)
+		if err != nil {
+			err = fmt.Errorf("lockOwner: %v", err)
+			return
+		}
+
+		if f != nil {
+			locks = append(locks, f)
+		}
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, stagedContentPrefix) ||
+			strings.HasSuffix(name, manifestSuffix) ||
+			live[stagedContentOwner(name)] {
+			continue
+		}
+
+		path := filepath.Join(sa.dir, name)
+		if !manifests[name] {
+			os.Remove(path)
+			continue
+		}
+
+		var w StagedWrite
+		err = readManifest(path+manifestSuffix, &w)
+		if err != nil {
+			err = fmt.Errorf("readManifest: %v", err)
+			return
+		}
+
+		w.Path = path
+		writes = append(writes, w)
+	}
+
+	return
+}
+
+// Open the content of a staged write for reading, decrypting it if the area
+// is encrypted.
+func (sa *StagingArea) Open(w StagedWrite) (rc io.ReadCloser, err error) {
+	f, err := os.Open(w.Path)
+	if err != nil {
+		return
+	}
+
+	r, err := sa.cipher.newReader(f)
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	// Keep the content seekable, so that a failed write can be retried.
+	rc = struct {
+		io.ReadSeeker
+		io.Closer
+	}{r, f}
+
+	return
+}
+
+// Attempt to write out each orphaned write belonging to the supplied bucket
+// and the area's prefix of it, on the condition that the object hasn't changed
+// since the content was staged. Writes that succeed are removed from the area;
+// the rest are logged and left in place for the user to deal with.
+func (sa *StagingArea) ResumeOrphans(
+	ctx context.Context,
+	bucket gcs.Bucket) (err error) {
+	writes, locks, err := sa.orphans()
+	if err != nil {
+		err = fmt.Errorf("orphans: %v", err)
+		return
+	}
+
+	// Hold the locks of the dead processes while we work, so that another
+	// process starting up doesn't resume the same writes. Their lock files are
+	// no longer needed once we're done.
+	defer func() {
+		for _, f := range locks {
+			os.Remove(f.Name())
+			f.Close()
+		}
+	}()
+
+	for _, w := range writes {
+		if w.Bucket != bucket.Name() || w.Prefix != sa.prefix {
+			logger.Warningf(
+				"Leaving staged write of %q in bucket %q at %s",
+				w.Prefix+w.Object,
+				w.Bucket,
+				w.Path)
+
+			continue
+		}
+
+		resumeErr := sa.resumeWrite(ctx, bucket, w)
+		if resumeErr != nil {
+			logger.Warningf(
+				"Failed to resume staged write of %q; its content is at %s: %v",
+				w.Object,
+				w.Path,
+				resumeErr)
+
+			continue
+		}
+
+		logger.Infof("Resumed staged write of %q.", w.Object)
+		removeStaged(w.Path)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Copy the supplied content into a new file in the area, followed by a
+// manifest holding the supplied description. The caller owns the file, which
+// lives at the returned path.
+func (sa *StagingArea) stage(
+	content io.Reader,
+	w *StagedWrite) (f tempStorage, path string, size int64, err error) {
+	w.Prefix = sa.prefix
+
+	osFile, err := ioutil.TempFile(sa.dir, stagedContentPrefix+sa.owner+"_")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	path = osFile.Name()
+
+	// Copy into the file. If we fail before writing the manifest, clean up
+	// after ourselves.
+	defer func() {
+		if err != nil {
+			osFile.Close()
+			os.Remove(path)
+		}
+	}()
+
+	f, err = sa.cipher.wrap(osFile)
+	if err != nil {
+		err = fmt.Errorf("wrap: %v", err)
+		return
+	}
+
+	size, err = io.Copy(f, content)
+	if err != nil {
+		err = fmt.Errorf("copy: %v", err)
+		return
+	}
+
+	// Write the manifest only once the content is complete, so that a manifest
+	// never describes a partial copy.
+	err = writeManifest(path+manifestSuffix, w)
+	if err != nil {
+		err = fmt.Errorf("writeManifest: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the path of the lock file of the process with the supplied ID.
+func (sa *StagingArea) lockPath(owner string) string {
+	return filepath.Join(sa.dir, lockFilePrefix+owner)
+}
+
+// Return the ID of the process that staged the content with the supplied file
+// name.
+func stagedContentOwner(name string) string {
+	name = strings.TrimPrefix(name, stagedContentPrefix)
+	return strings.SplitN(name, "_", 2)[0]
+}
+
+// Attempt to lock the lock file of the process with the supplied ID, returning
+// live == true if the process still holds it. Otherwise f is the locked file,
+// or nil if the process removed it when it was closed.
+func (sa *StagingArea) lockOwner(owner string) (
+	f *os.File,
+	live bool,
+	err error) {
+	f, err = os.Open(sa.lockPath(owner))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		f = nil
+
+		if err == syscall.EWOULDBLOCK {
+			live = true
+			err = nil
+			return
+		}
+
+		err = fmt.Errorf("Flock: %v", err)
+		return
+	}
+
+	return
+}
+
+// Remove staged content and its manifest, manifest first so that we never
+// leave a manifest without content.
+func removeStaged(path string) {
+	os.Remove(path + manifestSuffix)
+	os.Remove(path)
+}
+
+// Write the manifest atomically, so that a crash can't leave a partial one.
+func writeManifest(path string, v interface{}) (err error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		err = fmt.Errorf("WriteFile: %v", err)
+		return
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+func readManifest(path string, v interface{}) (err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	return
+}
+
+func (sa *StagingArea) resumeWrite(
+	ctx context.Context,
+	bucket gcs.Bucket,
+	w StagedWrite) (err error) {
+	rc, err := sa.Open(w)
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	// Pick up any upload session checkpointed in the manifest by an earlier
+	// attempt, and find the size of the content so that we can continue it.
+	err = readManifest(w.Path+manifestSuffix, &w)
+	if err != nil {
+		err = fmt.Errorf("readManifest: %v", err)
+		return
+	}
+
+	seeker := rc.(io.Seeker)
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	_, err = seeker.Seek(0, io.SeekStart)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	_, err = bucket.CreateObject(
+		ctx,
+		&gcs.CreateObjectRequest{
+			Name:                   w.Object,
+			Contents:               rc,
+			Resumable:              sa.resumableUpload(&w, size),
+			GenerationPrecondition: &w.Generation,
+		})
+
+	return
+}
+
+// Return how to upload the content of the supplied write, which has the given
+// size, through a resumable upload session checkpointed in its manifest,
+// continuing the session recorded there if any. Return nil if the content is
+// too small to bother.
+func (sa *StagingArea) resumableUpload(
+	w *StagedWrite,
+	size int64) (ru *gcs.ResumableUpload) {
+	if size < sa.chunkSize {
+		return
+	}
+
+	ru = &gcs.ResumableUpload{
+		Size:       size,
+		ChunkSize:  sa.chunkSize,
+		SessionURL: w.UploadURL,
+		Offset:     w.UploadOffset,
+		Checkpoint: func(sessionURL string, offset int64) {
+			checkpointUpload(w, sessionURL, offset)
+		},
+	}
+
+	return
+}
+
+// Record the progress of an upload in the manifest of the write. Failing to
+// do so costs only the chance to resume, so is logged rather than returned.
+func checkpointUpload(w *StagedWrite, sessionURL string, offset int64) {
+	// Don't resurrect the manifest of content that has since been removed.
+	if _, err := os.Stat(w.Path); err != nil {
+		return
+	}
+
+	w.UploadURL = sessionURL
+	w.UploadOffset = offset
+
+	err := writeManifest(w.Path+manifestSuffix, w)
+	if err != nil {
+		logger.Warningf("Checkpointing upload of %q: %v", w.Object, err)
+	}
+}
+
+// The manifest of a staged temp file, in which uploads of its content are
+// checkpointed. Not safe for concurrent access.
+type stagedManifest struct {
+	sa *StagingArea
+	w  StagedWrite
+}
+
+// Return how to upload the content, which has the given size; see
+// StagingArea.resumableUpload.
+func (m *stagedManifest) resumableUpload(size int64) *gcs.ResumableUpload {
+	return m.sa.resumableUpload(&m.w, size)
+}
+
+// Forget any upload session recorded in the manifest, because the content is
+// about to be modified and so can no longer be used to continue it.
+func (m *stagedManifest) forgetUpload() (err error) {
+	if m.w.UploadURL == "" {
+		return
+	}
+
+	w := m.w
+	w.UploadURL = ""
+	w.UploadOffset = 0
+
+	err = writeManifest(w.Path+manifestSuffix, &w)
+	if err != nil {
+		err = fmt.Errorf("writeManifest: %v", err)
+		return
+	}
+
+	m.w = w
+	return
+}
@@ -0,0 +1,659 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStagingArea(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StagingAreaTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	dir    string
+	cipher *gcsx.DiskCipher
+	sa     *gcsx.StagingArea
+}
+
+var _ SetUpInterface = &StagingAreaTest{}
+var _ TearDownInterface = &StagingAreaTest{}
+
+func init() { RegisterTestSuite(&StagingAreaTest{}) }
+
+func (t *StagingAreaTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "staging_area_test")
+	AssertEq(nil, err)
+
+	t.sa = t.newArea("")
+}
+
+func (t *StagingAreaTest) TearDown() {
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// Open the area in the test's directory as another process would, for the
+// supplied prefix of the bucket.
+func (t *StagingAreaTest) newArea(prefix string) *gcsx.StagingArea {
+	sa, err := gcsx.NewStagingArea(
+		filepath.Join(t.dir, "staging"),
+		prefix,
+		t.cipher)
+
+	AssertEq(nil, err)
+	return sa
+}
+
+// Stage modified content for the supplied object, simulating a crash before
+// it is synced by not destroying the temp file.
+func (t *StagingAreaTest) stage(o *gcs.Object, contents string) {
+	tf, err := t.sa.NewTempFile(
+		strings.NewReader(""),
+		gcsx.StagedWrite{
+			Bucket:     t.bucket.Name(),
+			Object:     o.Name,
+			Generation: o.Generation,
+		},
+		&t.clock)
+
+	AssertEq(nil, err)
+
+	_, err = tf.WriteAt([]byte(contents), 0)
+	AssertEq(nil, err)
+}
+
+// Queue a write of the supplied content for the supplied object, as a file
+// inode does when GCS is unreachable.
+func (t *StagingAreaTest) queue(o *gcs.Object, contents string) {
+	tf, err := gcsx.NewTempFile(strings.NewReader(contents), "", &t.clock)
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	err = t.sa.Queue(
+		tf,
+		gcsx.StagedWrite{
+			Bucket:     t.bucket.Name(),
+			Object:     o.Name,
+			Generation: o.Generation,
+		})
+
+	AssertEq(nil, err)
+}
+
+// The same tests, for an area whose content is encrypted.
+type EncryptedStagingAreaTest struct {
+	StagingAreaTest
+}
+
+func init() { RegisterTestSuite(&EncryptedStagingAreaTest{}) }
+
+func (t *EncryptedStagingAreaTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.dir, err = ioutil.TempDir("", "staging_area_test")
+	AssertEq(nil, err)
+
+	t.cipher = t.newCipher("k")
+	t.sa = t.newArea("")
+}
+
+// Return a cipher whose key consists of the supplied byte.
+func (t *EncryptedStagingAreaTest) newCipher(b string) *gcsx.DiskCipher {
+	dc, err := gcsx.NewDiskCipher([]byte(strings.Repeat(b, 32)))
+	AssertEq(nil, err)
+
+	return dc
+}
+
+// Return the content of a staged write.
+func (t *StagingAreaTest) readStaged(w gcsx.StagedWrite) (b []byte, err error) {
+	rc, err := t.sa.Open(w)
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+	b, err = ioutil.ReadAll(rc)
+	return
+}
+
+// A bucket whose CreateObject method fails as if the network were down.
+type unreachableBucket struct {
+	gcs.Bucket
+}
+
+func (b unreachableBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	err = &url.Error{
+		Op:  "Post",
+		URL: "https://www.googleapis.com/upload/storage/v1/b/some_bucket/o",
+		Err: &net.OpError{Op: "dial", Err: errors.New("network is unreachable")},
+	}
+
+	return
+}
+
+// An unreachable bucket that counts the writes attempted on it.
+type countingBucket struct {
+	unreachableBucket
+	attempts int32
+}
+
+func (b *countingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	atomic.AddInt32(&b.attempts, 1)
+	return b.unreachableBucket.CreateObject(ctx, req)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StagingAreaTest) EmptyArea() {
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+}
+
+func (t *StagingAreaTest) DestroyRemovesStagedFiles() {
+	tf, err := t.sa.NewTempFile(
+		strings.NewReader("taco"),
+		gcsx.StagedWrite{Bucket: "some_bucket", Object: "foo", Generation: 1},
+		&t.clock)
+
+	AssertEq(nil, err)
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+	ExpectEq("foo", writes[0].Object)
+
+	tf.Destroy()
+	t.sa.Close()
+
+	entries, err := ioutil.ReadDir(filepath.Join(t.dir, "staging"))
+	AssertEq(nil, err)
+	ExpectEq(0, len(entries))
+}
+
+func (t *StagingAreaTest) ContentWithoutManifestDiscarded() {
+	path := filepath.Join(t.dir, "staging", "staged_1234")
+	err := ioutil.WriteFile(path, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+
+	_, err = os.Stat(path)
+	ExpectTrue(os.IsNotExist(err))
+}
+
+func (t *StagingAreaTest) ResumeOrphans() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, "burrito")
+
+	err = t.sa.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+}
+
+func (t *StagingAreaTest) ObjectModifiedSinceStaging() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, "burrito")
+
+	// Clobber the object.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	// The staged write should be left alone.
+	err = t.sa.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	staged, err := t.readStaged(writes[0])
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(staged))
+}
+
+func (t *StagingAreaTest) OtherBucketLeftAlone() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, "burrito")
+
+	other := gcsfake.NewFakeBucket(&t.clock, "other_bucket")
+	err = t.sa.ResumeOrphans(t.ctx, other)
+	AssertEq(nil, err)
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectThat(writes, ElementsAre(Any()))
+}
+
+func (t *StagingAreaTest) OtherPrefixLeftAlone() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Stage a write from a mount of a prefix of the bucket, whose object name is
+	// relative to the prefix.
+	t.sa.Close()
+	t.sa = t.newArea("dir/")
+
+	t.stage(o, "burrito")
+	t.sa.Close()
+
+	// A later mount of the whole bucket should leave it alone.
+	t.sa = t.newArea("")
+
+	err = t.sa.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+	ExpectEq("dir/", writes[0].Prefix)
+	ExpectEq("foo", writes[0].Object)
+}
+
+func (t *StagingAreaTest) LiveProcessLeftAlone() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, "burrito")
+
+	// Another mount sharing the directory should leave the write alone while
+	// we're still running, along with content we're in the middle of staging.
+	path := filepath.Join(t.dir, "staging", "staged_1234")
+	err = ioutil.WriteFile(path, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	other := t.newArea("")
+	defer other.Close()
+
+	lock := filepath.Join(t.dir, "staging", "lock_1234")
+	f, err := os.Create(lock)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	AssertEq(nil, err)
+
+	err = other.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	writes, err := other.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+
+	_, err = os.Stat(path)
+	ExpectEq(nil, err)
+
+	// Once we exit, it may be resumed.
+	t.sa.Close()
+
+	err = other.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+}
+
+func (t *StagingAreaTest) ReconcileQueuedWrite() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.queue(o, "burrito")
+
+	// While GCS is unreachable, the write stays queued.
+	t.sa.Reconcile(t.ctx, unreachableBucket{t.bucket})
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	// Once it is reachable again, the write is made and removed from the area.
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(contents))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+}
+
+func (t *StagingAreaTest) CloseStopsReconciling() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.queue(o, "burrito")
+
+	b := &countingBucket{unreachableBucket: unreachableBucket{t.bucket}}
+	t.sa.StartReconciling(b, time.Millisecond)
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if atomic.LoadInt32(&b.attempts) > 0 {
+			break
+		}
+
+		AssertTrue(time.Now().Before(deadline), "never reconciled")
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once closed, the write should not be tried again.
+	t.sa.Close()
+	attempts := atomic.LoadInt32(&b.attempts)
+
+	time.Sleep(50 * time.Millisecond)
+	ExpectEq(attempts, atomic.LoadInt32(&b.attempts))
+}
+
+func (t *StagingAreaTest) ReconcileConflict() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.queue(o, "burrito")
+
+	// Clobber the object.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	// The queued write should lose, but its content should be left in place.
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	staged, err := t.readStaged(writes[0])
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(staged))
+
+	// It should not be retried.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("queso"))
+	AssertEq(nil, err)
+
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	contents, err = gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("queso", string(contents))
+}
+
+func (t *StagingAreaTest) QueueReplacesEarlierWrite() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.queue(o, "burrito")
+	t.queue(o, "enchilada")
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(contents))
+}
+
+func (t *StagingAreaTest) DequeueDiscardsWrite() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.queue(o, "burrito")
+	t.sa.Dequeue("foo")
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(0, len(writes))
+
+	t.sa.Reconcile(t.ctx, t.bucket)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *EncryptedStagingAreaTest) ContentEncryptedOnDisk() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, "burrito")
+	t.queue(o, "enchilada")
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(2, len(writes))
+
+	for _, w := range writes {
+		contents, err := ioutil.ReadFile(w.Path)
+		AssertEq(nil, err)
+		ExpectThat(string(contents), Not(HasSubstr("burrito")))
+		ExpectThat(string(contents), Not(HasSubstr("enchilada")))
+	}
+}
+
+func (t *EncryptedStagingAreaTest) ResumeWithWrongKey() {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, "burrito")
+
+	// A later process with a different key can't read the content, and leaves
+	// it in place.
+	t.sa.Close()
+	sa, err := gcsx.NewStagingArea(
+		filepath.Join(t.dir, "staging"),
+		"",
+		t.newCipher("x"))
+
+	AssertEq(nil, err)
+
+	err = sa.ResumeOrphans(t.ctx, t.bucket)
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	writes, err := sa.Orphans()
+	AssertEq(nil, err)
+	ExpectEq(1, len(writes))
+}
+
+// Stage content spanning three chunks, returning the path of the file holding
+// it.
+func (t *EncryptedStagingAreaTest) stageChunks() (path string) {
+	o, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	t.stage(o, strings.Repeat("burrito", 1500))
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	// The content must read back intact before we tamper with it.
+	contents, err := t.readStaged(writes[0])
+	AssertEq(nil, err)
+	AssertEq(strings.Repeat("burrito", 1500), string(contents))
+
+	path = writes[0].Path
+	return
+}
+
+// The file starts with a 32-byte salt. With AES-256-GCM, each sealed chunk and
+// the trailer carry a 12-byte nonce and a 16-byte tag.
+const (
+	saltSize        = 32
+	storedChunkSize = 4096 + 28
+	trailerSize     = 8 + 28
+)
+
+func (t *EncryptedStagingAreaTest) KeysAndNoncesNotReused() {
+	w := gcsx.StagedWrite{Bucket: "some_bucket", Object: "foo", Generation: 1}
+	tf, err := t.sa.NewTempFile(strings.NewReader("taco"), w, &t.clock)
+	AssertEq(nil, err)
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	path := writes[0].Path
+	before, err := ioutil.ReadFile(path)
+	AssertEq(nil, err)
+
+	// Rewriting a chunk with the same content seals it with a new nonce.
+	_, err = tf.WriteAt([]byte("taco"), 0)
+	AssertEq(nil, err)
+
+	after, err := ioutil.ReadFile(path)
+	AssertEq(nil, err)
+
+	chunk := before[saltSize : saltSize+4+28]
+	ExpectFalse(bytes.Equal(chunk[:12], after[saltSize:saltSize+12]))
+
+	// Another file holding the same content has its own key.
+	_, err = t.sa.NewTempFile(strings.NewReader("taco"), w, &t.clock)
+	AssertEq(nil, err)
+
+	writes, err = t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(2, len(writes))
+
+	other := writes[0].Path
+	if other == path {
+		other = writes[1].Path
+	}
+
+	contents, err := ioutil.ReadFile(other)
+	AssertEq(nil, err)
+	ExpectFalse(bytes.Equal(before[:saltSize], contents[:saltSize]))
+	ExpectFalse(bytes.Equal(chunk, contents[saltSize:saltSize+4+28]))
+}
+
+func (t *EncryptedStagingAreaTest) ZeroedChunkRejected() {
+	path := t.stageChunks()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	AssertEq(nil, err)
+	_, err = f.WriteAt(make([]byte, storedChunkSize), saltSize+storedChunkSize)
+	AssertEq(nil, err)
+	AssertEq(nil, f.Close())
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	_, err = t.readStaged(writes[0])
+	ExpectThat(err, Error(HasSubstr("chunk 1")))
+}
+
+func (t *EncryptedStagingAreaTest) TruncationRejected() {
+	path := t.stageChunks()
+
+	// Drop the last chunk, keeping the trailer.
+	contents, err := ioutil.ReadFile(path)
+	AssertEq(nil, err)
+
+	trailer := contents[len(contents)-trailerSize:]
+	end := saltSize + 2*storedChunkSize
+	truncated := append(contents[:end:end], trailer...)
+	err = ioutil.WriteFile(path, truncated, 0600)
+	AssertEq(nil, err)
+
+	writes, err := t.sa.Orphans()
+	AssertEq(nil, err)
+	AssertEq(1, len(writes))
+
+	_, err = t.readStaged(writes[0])
+	ExpectThat(err, Error(HasSubstr("can't hold")))
+
+	// Dropping the trailer too doesn't help.
+	err = ioutil.WriteFile(path, contents[:end], 0600)
+	AssertEq(nil, err)
+
+	_, err = t.readStaged(writes[0])
+	ExpectThat(err, Error(HasSubstr("trailer")))
+}
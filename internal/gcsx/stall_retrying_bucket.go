@@ -0,0 +1,220 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket whose readers watch for stalls: if a call to Read on the
+// underlying reader makes no progress within the given timeout, the request
+// is cancelled and the remainder of the range is requested again, up to
+// maxRetries times per reader. Other operations are passed through
+// unmodified.
+//
+// Only reads of a specific generation are retried, since otherwise the
+// reissued request could return the contents of a different generation.
+func NewStallRetryingBucket(
+	timeout time.Duration,
+	maxRetries int,
+	wrapped gcs.Bucket) gcs.Bucket {
+	return &stallRetryingBucket{
+		Bucket:     wrapped,
+		timeout:    timeout,
+		maxRetries: maxRetries,
+	}
+}
+
+type stallRetryingBucket struct {
+	gcs.Bucket
+	timeout    time.Duration
+	maxRetries int
+}
+
+func (b *stallRetryingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	if req.Generation == 0 {
+		rc, err = b.Bucket.NewReader(ctx, req)
+		return
+	}
+
+	r := &stallRetryingReader{
+		bucket: b,
+		ctx:    ctx,
+		req:    *req,
+	}
+
+	r.rangeStart = 0
+	r.rangeLimit = math.MaxUint64
+	if req.Range != nil {
+		r.rangeStart = req.Range.Start
+		r.rangeLimit = req.Range.Limit
+	}
+
+	err = r.open()
+	if err != nil {
+		return
+	}
+
+	rc = r
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Reader
+////////////////////////////////////////////////////////////////////////
+
+type stallRetryingReader struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	bucket *stallRetryingBucket
+	ctx    context.Context
+	req    gcs.ReadObjectRequest
+
+	// The range originally requested.
+	rangeStart uint64
+	rangeLimit uint64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// The number of bytes returned so far.
+	offset uint64
+
+	// The number of times we've reissued the request.
+	retries int
+
+	// The current request, or nil if it has stalled and not yet been reissued.
+	//
+	// INVARIANT: (wrapped == nil) == (cancel == nil)
+	wrapped io.ReadCloser
+	cancel  func()
+}
+
+// Issue a request for the part of the range we haven't yet returned.
+//
+// REQUIRES: r.wrapped == nil
+func (r *stallRetryingReader) open() (err error) {
+	req := r.req
+	req.Range = &gcs.ByteRange{
+		Start: r.rangeStart + r.offset,
+		Limit: r.rangeLimit,
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	rc, err := r.bucket.Bucket.NewReader(ctx, &req)
+	if err != nil {
+		cancel()
+		return
+	}
+
+	r.wrapped = rc
+	r.cancel = cancel
+
+	return
+}
+
+// Throw away the current request.
+//
+// REQUIRES: r.wrapped != nil
+func (r *stallRetryingReader) abandon() {
+	r.cancel()
+	r.wrapped.Close()
+
+	r.wrapped = nil
+	r.cancel = nil
+}
+
+func (r *stallRetryingReader) Read(p []byte) (n int, err error) {
+	for {
+		// Reissue the request if it previously stalled.
+		if r.wrapped == nil {
+			if r.retries >= r.bucket.maxRetries {
+				err = fmt.Errorf(
+					"Read stalled for %v %d times in a row",
+					r.bucket.timeout,
+					r.retries+1)
+				return
+			}
+
+			r.retries++
+			logger.Warningf(
+				"Read of %q stalled for %v; retrying at offset %d (attempt %d)",
+				r.req.Name,
+				r.bucket.timeout,
+				r.rangeStart+r.offset,
+				r.retries)
+
+			err = r.open()
+			if err != nil {
+				err = fmt.Errorf("NewReader: %v", err)
+				return
+			}
+		}
+
+		// Read, cancelling the request if it doesn't return in time.
+		var stalled int32
+		timer := time.AfterFunc(r.bucket.timeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			r.cancel()
+		})
+
+		n, err = r.wrapped.Read(p)
+		timer.Stop()
+		r.offset += uint64(n)
+
+		// If we didn't stall (or the caller has given up anyway), we're done.
+		if atomic.LoadInt32(&stalled) == 0 || r.ctx.Err() != nil {
+			if n > 0 {
+				r.retries = 0
+			}
+
+			return
+		}
+
+		// Otherwise the request is dead. Return whatever we got, and reissue it
+		// on the next call.
+		r.abandon()
+		if n > 0 {
+			r.retries = 0
+			err = nil
+			return
+		}
+	}
+}
+
+func (r *stallRetryingReader) Close() (err error) {
+	if r.wrapped != nil {
+		err = r.wrapped.Close()
+		r.cancel()
+
+		r.wrapped = nil
+		r.cancel = nil
+	}
+
+	return
+}
@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStallRetryingBucket(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Stalling bucket
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose readers return the first stallAfter bytes of each of the
+// first stallCount requests, then block until cancelled.
+type stallingBucket struct {
+	gcs.Bucket
+	stallAfter int64
+
+	mu         sync.Mutex
+	stallCount int
+	requests   []gcs.ByteRange
+}
+
+func (b *stallingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.requests = append(b.requests, *req.Range)
+
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil || b.stallCount == 0 {
+		return
+	}
+
+	b.stallCount--
+	rc = &stallingReader{
+		ReadCloser: rc,
+		ctx:        ctx,
+		remaining:  b.stallAfter,
+	}
+
+	return
+}
+
+type stallingReader struct {
+	io.ReadCloser
+	ctx       context.Context
+	remaining int64
+}
+
+func (r *stallingReader) Read(p []byte) (n int, err error) {
+	if r.remaining == 0 {
+		<-r.ctx.Done()
+		err = r.ctx.Err()
+		return
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err = r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const stallTimeout = 20 * time.Millisecond
+
+type StallRetryingBucketTest struct {
+	ctx      context.Context
+	stalling *stallingBucket
+	bucket   gcs.Bucket
+	object   *gcs.Object
+}
+
+var _ SetUpInterface = &StallRetryingBucketTest{}
+
+func init() { RegisterTestSuite(&StallRetryingBucketTest{}) }
+
+func (t *StallRetryingBucketTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.stalling = &stallingBucket{
+		Bucket:     gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		stallAfter: 4,
+	}
+
+	t.bucket = gcsx.NewStallRetryingBucket(stallTimeout, 2, t.stalling)
+
+	t.object, err = gcsutil.CreateObject(
+		t.ctx,
+		t.stalling,
+		"foo",
+		[]byte("0123456789abcdef"))
+
+	AssertEq(nil, err)
+}
+
+func (t *StallRetryingBucketTest) read(r *gcs.ByteRange) (s string, err error) {
+	rc, err := t.bucket.NewReader(
+		t.ctx,
+		&gcs.ReadObjectRequest{
+			Name:       "foo",
+			Generation: t.object.Generation,
+			Range:      r,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	s = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StallRetryingBucketTest) NoStall() {
+	s, err := t.read(nil)
+	AssertEq(nil, err)
+	ExpectEq("0123456789abcdef", s)
+	ExpectEq(1, len(t.stalling.requests))
+}
+
+func (t *StallRetryingBucketTest) StallsThenRecovers() {
+	t.stalling.stallCount = 2
+
+	s, err := t.read(&gcs.ByteRange{Start: 2, Limit: 15})
+	AssertEq(nil, err)
+	ExpectEq("23456789abcde", s)
+
+	// Each retry should pick up where the previous request stalled.
+	ExpectThat(
+		t.stalling.requests,
+		DeepEquals([]gcs.ByteRange{
+			{Start: 2, Limit: 15},
+			{Start: 6, Limit: 15},
+			{Start: 10, Limit: 15},
+		}))
+}
+
+func (t *StallRetryingBucketTest) ProgressResetsRetryCount() {
+	// Four stalls is more than the retry limit, but each request makes
+	// progress before stalling.
+	t.stalling.stallCount = 4
+
+	s, err := t.read(nil)
+	AssertEq(nil, err)
+	ExpectEq("0123456789abcdef", s)
+	ExpectEq(5, len(t.stalling.requests))
+}
+
+func (t *StallRetryingBucketTest) GivesUp() {
+	t.stalling.stallAfter = 0
+	t.stalling.stallCount = 100
+
+	_, err := t.read(nil)
+	ExpectThat(err, Error(HasSubstr("stalled")))
+	ExpectEq(3, len(t.stalling.requests))
+}
+
+func (t *StallRetryingBucketTest) LatestGenerationNotRetried() {
+	t.stalling.stallAfter = 0
+	t.stalling.stallCount = 1
+
+	// Use a context with a deadline, since the read will otherwise hang.
+	ctx, cancel := context.WithTimeout(t.ctx, 5*stallTimeout)
+	defer cancel()
+
+	rc, err := t.bucket.NewReader(
+		ctx,
+		&gcs.ReadObjectRequest{
+			Name:  "foo",
+			Range: &gcs.ByteRange{Start: 0, Limit: 16},
+		})
+
+	AssertEq(nil, err)
+	defer rc.Close()
+
+	_, err = ioutil.ReadAll(rc)
+	ExpectTrue(err == context.DeadlineExceeded)
+	ExpectEq(1, len(t.stalling.requests))
+}
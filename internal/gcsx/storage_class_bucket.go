@@ -0,0 +1,75 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The storage classes that objects may be created with (cf.
+// https://cloud.google.com/storage/docs/storage-classes), including the
+// legacy ones that GCS still accepts.
+var storageClasses = map[string]bool{
+	"STANDARD":                     true,
+	"NEARLINE":                     true,
+	"COLDLINE":                     true,
+	"ARCHIVE":                      true,
+	"MULTI_REGIONAL":               true,
+	"REGIONAL":                     true,
+	"DURABLE_REDUCED_AVAILABILITY": true,
+}
+
+// IsStorageClass reports whether s names a storage class that objects may be
+// created with. Names are upper case, as GCS reports them.
+func IsStorageClass(s string) bool {
+	return storageClasses[s]
+}
+
+// NewStorageClassBucket creates a wrapper bucket that gives newly created or
+// composed objects the supplied storage class when an explicit class is not
+// already set, rather than the bucket's default.
+func NewStorageClassBucket(class string, b gcs.Bucket) gcs.Bucket {
+	return storageClassBucket{b, class}
+}
+
+type storageClassBucket struct {
+	gcs.Bucket
+	class string
+}
+
+func (b storageClassBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	if req.StorageClass == "" {
+		req.StorageClass = b.class
+	}
+
+	// Pass on the request.
+	o, err = b.Bucket.CreateObject(ctx, req)
+	return
+}
+
+func (b storageClassBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	if req.StorageClass == "" {
+		req.StorageClass = b.class
+	}
+
+	// Pass on the request.
+	o, err = b.Bucket.ComposeObjects(ctx, req)
+	return
+}
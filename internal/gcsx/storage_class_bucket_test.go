@@ -0,0 +1,96 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStorageClassBucket_CreateObject(t *testing.T) {
+	ctx := context.Background()
+	bucket := gcsx.NewStorageClassBucket(
+		"COLDLINE",
+		gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
+
+	for _, tc := range []struct{ request, expected string }{
+		{"", "COLDLINE"},
+		{"NEARLINE", "NEARLINE"},
+	} {
+		o, err := bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+			Name:         "foo",
+			StorageClass: tc.request,
+			Contents:     strings.NewReader(""),
+		})
+
+		if err != nil {
+			t.Fatalf("CreateObject: %v", err)
+		}
+
+		if got, want := o.StorageClass, tc.expected; got != want {
+			t.Errorf("Requesting %q: o.StorageClass is %q, want %q", tc.request, got, want)
+		}
+	}
+}
+
+func TestStorageClassBucket_ComposeObjects(t *testing.T) {
+	ctx := context.Background()
+	bucket := gcsx.NewStorageClassBucket(
+		"ARCHIVE",
+		gcsfake.NewFakeBucket(timeutil.RealClock(), ""))
+
+	_, err := bucket.CreateObject(ctx, &gcs.CreateObjectRequest{
+		Name:         "some_src",
+		StorageClass: "STANDARD",
+		Contents:     strings.NewReader(""),
+	})
+
+	if err != nil {
+		t.Fatalf("CreateObject: %v", err)
+	}
+
+	o, err := bucket.ComposeObjects(ctx, &gcs.ComposeObjectsRequest{
+		DstName: "foo",
+		Sources: []gcs.ComposeSource{{Name: "some_src"}},
+	})
+
+	if err != nil {
+		t.Fatalf("ComposeObjects: %v", err)
+	}
+
+	if got, want := o.StorageClass, "ARCHIVE"; got != want {
+		t.Errorf("o.StorageClass is %q, want %q", got, want)
+	}
+}
+
+func TestIsStorageClass(t *testing.T) {
+	for s, want := range map[string]bool{
+		"STANDARD": true,
+		"COLDLINE": true,
+		"coldline": false,
+		"":         false,
+		"FROZEN":   false,
+	} {
+		if got := gcsx.IsStorageClass(s); got != want {
+			t.Errorf("IsStorageClass(%q) is %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// An upload whose contents are passed on to GCS as they are written, rather
+// than being staged locally first. The contents must be written in order, from
+// start to finish, so this suits files produced that way, such as logs and
+// archives, and lets them be written without using any local disk space.
+//
+// Not safe for concurrent access.
+type StreamingUpload struct {
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// The write end of the pipe from which the upload reads the contents.
+	w *io.PipeWriter
+
+	// The number of bytes written so far.
+	offset int64
+
+	// Closed when the upload has finished, after setting o and err.
+	done chan struct{}
+	o    *gcs.Object
+	err  error
+}
+
+// Start replacing srcObject in the bucket with contents to be supplied by
+// calls to Write, on the condition that the object hasn't changed in the
+// meantime. The upload proceeds in the background, each write waiting for its
+// data to be consumed, until Finish or Abort is called.
+func NewStreamingUpload(
+	bucket gcs.Bucket,
+	srcObject *gcs.Object) (u *StreamingUpload) {
+	pr, pw := io.Pipe()
+
+	u = &StreamingUpload{
+		w:    pw,
+		done: make(chan struct{}),
+	}
+
+	req := &gcs.CreateObjectRequest{
+		Name:                       srcObject.Name,
+		GenerationPrecondition:     &srcObject.Generation,
+		MetaGenerationPrecondition: &srcObject.MetaGeneration,
+		Contents:                   pr,
+		StorageClass:               srcObject.StorageClass,
+		CustomTime:                 srcObject.CustomTime,
+	}
+
+	// The upload outlives the operation that starts it, so isn't subject to its
+	// context.
+	go func() {
+		o, err := bucket.CreateObject(context.Background(), req)
+
+		// Make any further writes fail rather than block.
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.Close()
+		}
+
+		u.o = o
+		u.err = err
+		close(u.done)
+	}()
+
+	return
+}
+
+// Return the number of bytes written so far, which is the offset at which the
+// next write must be made.
+func (u *StreamingUpload) Offset() int64 {
+	return u.offset
+}
+
+// Append p to the contents, blocking until the upload has consumed it.
+func (u *StreamingUpload) Write(p []byte) (err error) {
+	n, err := u.w.Write(p)
+	u.offset += int64(n)
+
+	if err != nil {
+		err = fmt.Errorf("upload: %v", err)
+		return
+	}
+
+	return
+}
+
+// Mark the end of the contents and wait for the object to be created. Like
+// Syncer.SyncObject, fail with *gcs.PreconditionError if the source object has
+// changed. The upload must not be used again.
+func (u *StreamingUpload) Finish() (o *gcs.Object, err error) {
+	u.w.Close()
+	<-u.done
+
+	o = u.o
+	err = u.err
+
+	if _, ok := err.(*gcs.PreconditionError); ok {
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("CreateObject: %v", err)
+		return
+	}
+
+	return
+}
+
+// Abandon the upload without creating an object. The upload must not be used
+// again.
+func (u *StreamingUpload) Abort() {
+	u.w.CloseWithError(errors.New("upload aborted"))
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestStreamingUpload(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StreamingUploadTest struct {
+	ctx    context.Context
+	clock  timeutil.SimulatedClock
+	bucket gcs.Bucket
+	src    *gcs.Object
+}
+
+var _ SetUpInterface = &StreamingUploadTest{}
+
+func init() { RegisterTestSuite(&StreamingUploadTest{}) }
+
+func (t *StreamingUploadTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+
+	t.src, err = gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte{})
+	AssertEq(nil, err)
+}
+
+func (t *StreamingUploadTest) contents() string {
+	b, err := gcsutil.ReadObject(t.ctx, t.bucket, "foo")
+	AssertEq(nil, err)
+	return string(b)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StreamingUploadTest) WritesInOrder() {
+	u := gcsx.NewStreamingUpload(t.bucket, t.src)
+	ExpectEq(0, u.Offset())
+
+	AssertEq(nil, u.Write([]byte("taco")))
+	AssertEq(nil, u.Write([]byte("burrito")))
+	ExpectEq(len("tacoburrito"), u.Offset())
+
+	o, err := u.Finish()
+	AssertEq(nil, err)
+
+	ExpectEq("foo", o.Name)
+	ExpectEq(len("tacoburrito"), o.Size)
+	ExpectLt(t.src.Generation, o.Generation)
+	ExpectEq("tacoburrito", t.contents())
+}
+
+func (t *StreamingUploadTest) NothingWritten() {
+	u := gcsx.NewStreamingUpload(t.bucket, t.src)
+
+	o, err := u.Finish()
+	AssertEq(nil, err)
+
+	ExpectEq(0, o.Size)
+	ExpectLt(t.src.Generation, o.Generation)
+}
+
+func (t *StreamingUploadTest) SourceChanged() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	u := gcsx.NewStreamingUpload(t.bucket, t.src)
+	u.Write([]byte("taco"))
+
+	_, err = u.Finish()
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+	ExpectEq("enchilada", t.contents())
+}
+
+func (t *StreamingUploadTest) Abort() {
+	u := gcsx.NewStreamingUpload(t.bucket, t.src)
+	AssertEq(nil, u.Write([]byte("taco")))
+
+	u.Abort()
+
+	// The object should be left alone. The upload finishes in the background,
+	// so give it a chance to do any damage.
+	time.Sleep(10 * time.Millisecond)
+
+	o, err := t.bucket.StatObject(t.ctx, &gcs.StatObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+	ExpectEq(t.src.Generation, o.Generation)
+	ExpectEq("", t.contents())
+}
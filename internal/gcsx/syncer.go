@@ -17,6 +17,8 @@ package gcsx
 import (
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"time"
 
 	"github.com/jacobsa/gcloud/gcs"
@@ -35,31 +37,58 @@ type Syncer interface {
 	// *   If the temp file has not been modified, return a nil new object.
 	//
 	// *   Otherwise, write out a new generation in the bucket (failing with
-	//     *gcs.PreconditionError if the source generation is no longer current).
+	//     *gcs.PreconditionError if the source generation is no longer current,
+	//     or *UnreachableError if GCS couldn't be reached).
 	//
 	// In the second case, the TempFile is destroyed. Otherwise, including when
 	// this function fails, it is guaranteed to still be valid.
+	//
+	// The new generation has the given storage class, or if it is empty that of
+	// the source generation.
 	SyncObject(
 		ctx context.Context,
 		srcObject *gcs.Object,
+		storageClass string,
 		content TempFile) (o *gcs.Object, err error)
 }
 
+// An error returned by Syncer.SyncObject when GCS couldn't be reached at all,
+// as opposed to refusing the request, so that the write may succeed if made
+// again later.
+type UnreachableError struct {
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("GCS unreachable: %v", e.Err)
+}
+
 // Create a syncer that syncs into the supplied bucket.
 //
 // When the source object has been changed only by appending, and the source
 // object's size is at least appendThreshold, we will "append" to it by writing
 // out a temporary blob and composing it with the source object.
 //
+// This is the only partial upload we can make. The temp file's DirtyThreshold
+// says how long a prefix is unmodified, but GCS composes whole objects only,
+// so an unmodified prefix shorter than the source object can't be reused
+// server-side. If any byte of the source object has been overwritten, or it
+// has been truncated, we upload the full contents.
+//
 // Temporary blobs have names beginning with tmpObjectPrefix. We make an effort
 // to delete them, but if we are interrupted for some reason we may not be able
 // to do so. Therefore the user should arrange for garbage collection.
+//
+// Each upload waits for its turn in the supplied queue, which may be nil to
+// impose no limit. Content that hasn't been dirtied isn't uploaded, so doesn't
+// wait.
 func NewSyncer(
 	appendThreshold int64,
 	tmpObjectPrefix string,
-	bucket gcs.Bucket) (os Syncer) {
+	bucket gcs.Bucket,
+	uploads *UploadQueue) (os Syncer) {
 	// Create the object creators.
-	fullCreator := &fullObjectCreator{
+	var fullCreator objectCreator = &fullObjectCreator{
 		bucket: bucket,
 	}
 
@@ -67,6 +96,11 @@ func NewSyncer(
 		tmpObjectPrefix,
 		bucket)
 
+	if uploads != nil {
+		fullCreator = &queuedObjectCreator{uploads, fullCreator}
+		appendCreator = &queuedObjectCreator{uploads, appendCreator}
+	}
+
 	// And the syncer.
 	os = newSyncer(appendThreshold, fullCreator, appendCreator)
 
@@ -81,6 +115,12 @@ type fullObjectCreator struct {
 	bucket gcs.Bucket
 }
 
+// Implemented by temp files whose uploads can be checkpointed, so that they
+// can be continued by a later process.
+type resumableContent interface {
+	resumableUpload() (*gcs.ResumableUpload, error)
+}
+
 func (oc *fullObjectCreator) Create(
 	ctx context.Context,
 	srcObject *gcs.Object,
@@ -91,11 +131,22 @@ func (oc *fullObjectCreator) Create(
 		GenerationPrecondition:     &srcObject.Generation,
 		MetaGenerationPrecondition: &srcObject.MetaGeneration,
 		Contents:                   r,
+		StorageClass:               srcObject.StorageClass,
+		CustomTime:                 srcObject.CustomTime,
 		Metadata: map[string]string{
 			MtimeMetadataKey: mtime.Format(time.RFC3339Nano),
 		},
 	}
 
+	// Upload large staged contents resumably; see StagingArea.
+	if rc, ok := r.(resumableContent); ok {
+		req.Resumable, err = rc.resumableUpload()
+		if err != nil {
+			err = fmt.Errorf("resumableUpload: %v", err)
+			return
+		}
+	}
+
 	o, err = oc.bucket.CreateObject(ctx, req)
 	if err != nil {
 		// Don't mangle precondition errors.
@@ -103,10 +154,43 @@ func (oc *fullObjectCreator) Create(
 			return
 		}
 
+		unreachable := isUnreachable(err)
 		err = fmt.Errorf("CreateObject: %v", err)
+		if unreachable {
+			err = &UnreachableError{Err: err}
+		}
+
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// queuedObjectCreator
+////////////////////////////////////////////////////////////////////////
+
+// An object creator that waits for a slot in an upload queue before calling
+// through to a wrapped creator.
+type queuedObjectCreator struct {
+	uploads *UploadQueue
+	wrapped objectCreator
+}
+
+func (oc *queuedObjectCreator) Create(
+	ctx context.Context,
+	srcObject *gcs.Object,
+	mtime time.Time,
+	r io.Reader) (o *gcs.Object, err error) {
+	err = oc.uploads.Acquire(ctx)
+	if err != nil {
+		err = fmt.Errorf("Acquire: %v", err)
 		return
 	}
 
+	defer oc.uploads.Release()
+
+	o, err = oc.wrapped.Create(ctx, srcObject, mtime, r)
 	return
 }
 
@@ -158,6 +242,7 @@ type syncer struct {
 func (os *syncer) SyncObject(
 	ctx context.Context,
 	srcObject *gcs.Object,
+	storageClass string,
 	content TempFile) (o *gcs.Object, err error) {
 	// Stat the content.
 	sr, err := content.Stat()
@@ -195,11 +280,17 @@ func (os *syncer) SyncObject(
 	mtime := sr.Mtime.UTC()
 
 	// Otherwise, we need to create a new generation. If the source object is
-	// long enough, hasn't been dirtied, and has a low enough component count,
-	// then we can make the optimization of not rewriting its contents.
+	// long enough, hasn't been dirtied, has a low enough component count, and
+	// is to keep its storage class, then we can make the optimization of not
+	// rewriting its contents.
+	if storageClass == "" {
+		storageClass = srcObject.StorageClass
+	}
+
 	if srcSize >= os.appendThreshold &&
 		sr.DirtyThreshold == srcSize &&
-		srcObject.ComponentCount < gcs.MaxComponentCount {
+		srcObject.ComponentCount < gcs.MaxComponentCount &&
+		storageClass == srcObject.StorageClass {
 		_, err = content.Seek(srcSize, 0)
 		if err != nil {
 			err = fmt.Errorf("Seek: %v", err)
@@ -208,19 +299,28 @@ func (os *syncer) SyncObject(
 
 		o, err = os.appendCreator.Create(ctx, srcObject, mtime, content)
 	} else {
+		err = content.Fetch(ctx, 0)
+		if err != nil {
+			err = fmt.Errorf("Fetch: %v", err)
+			return
+		}
+
 		_, err = content.Seek(0, 0)
 		if err != nil {
 			err = fmt.Errorf("Seek: %v", err)
 			return
 		}
 
-		o, err = os.fullCreator.Create(ctx, srcObject, mtime, content)
+		dst := *srcObject
+		dst.StorageClass = storageClass
+		o, err = os.fullCreator.Create(ctx, &dst, mtime, content)
 	}
 
 	// Deal with errors.
 	if err != nil {
-		// Special case: don't mess with precondition errors.
-		if _, ok := err.(*gcs.PreconditionError); ok {
+		// Special case: don't mess with precondition or unreachable errors.
+		switch err.(type) {
+		case *gcs.PreconditionError, *UnreachableError:
 			return
 		}
 
@@ -233,3 +333,21 @@ func (os *syncer) SyncObject(
 
 	return
 }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Does the supplied error, as returned by a bucket, mean that the request
+// never reached GCS or its response never came back?
+func isUnreachable(err error) bool {
+	switch typed := err.(type) {
+	case *net.OpError, *net.DNSError:
+		return true
+
+	case *url.Error:
+		return isUnreachable(typed.Err)
+	}
+
+	return false
+}
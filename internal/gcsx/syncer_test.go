@@ -18,6 +18,8 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -88,8 +90,9 @@ type SyncerTest struct {
 	syncer Syncer
 	clock  timeutil.SimulatedClock
 
-	srcObject *gcs.Object
-	content   TempFile
+	srcObject    *gcs.Object
+	storageClass string
+	content      TempFile
 }
 
 var _ SetUpInterface = &SyncerTest{}
@@ -133,7 +136,7 @@ func (t *SyncerTest) SetUp(ti *TestInfo) {
 }
 
 func (t *SyncerTest) call() (o *gcs.Object, err error) {
-	o, err = t.syncer.SyncObject(t.ctx, t.srcObject, t.content)
+	o, err = t.syncer.SyncObject(t.ctx, t.srcObject, t.storageClass, t.content)
 	return
 }
 
@@ -267,11 +270,32 @@ func (t *SyncerTest) CallsFullCreator() {
 	t.call()
 
 	AssertTrue(t.fullCreator.called)
-	ExpectEq(t.srcObject, t.fullCreator.srcObject)
+	ExpectThat(t.fullCreator.srcObject, Pointee(DeepEquals(*t.srcObject)))
 	ExpectThat(t.fullCreator.mtime, timeutil.TimeEq(mtime.UTC()))
 	ExpectEq(srcObjectContents[:2], string(t.fullCreator.contents))
 }
 
+func (t *SyncerTest) ChangesStorageClass() {
+	var err error
+	t.storageClass = "COLDLINE"
+
+	// Append some data, which would otherwise be composed with the source
+	// object.
+	_, err = t.content.WriteAt([]byte("burrito"), int64(t.srcObject.Size))
+	AssertEq(nil, err)
+
+	// The full creator should be called, with the new class.
+	t.call()
+
+	ExpectFalse(t.appendCreator.called)
+	AssertTrue(t.fullCreator.called)
+	ExpectEq(t.srcObject.Name, t.fullCreator.srcObject.Name)
+	ExpectEq(t.srcObject.Generation, t.fullCreator.srcObject.Generation)
+	ExpectEq("COLDLINE", t.fullCreator.srcObject.StorageClass)
+	ExpectEq("STANDARD", t.srcObject.StorageClass)
+	ExpectEq(srcObjectContents+"burrito", string(t.fullCreator.contents))
+}
+
 func (t *SyncerTest) FullCreatorFails() {
 	var err error
 	t.fullCreator.err = errors.New("taco")
@@ -301,6 +325,33 @@ func (t *SyncerTest) FullCreatorReturnsPreconditionError() {
 	ExpectEq(t.fullCreator.err, err)
 }
 
+func (t *SyncerTest) FullCreatorReturnsUnreachableError() {
+	var err error
+	t.fullCreator.err = &UnreachableError{Err: errors.New("taco")}
+
+	// Truncate downward.
+	err = t.content.Truncate(2)
+	AssertEq(nil, err)
+
+	// Call
+	_, err = t.call()
+
+	ExpectEq(t.fullCreator.err, err)
+}
+
+func (t *SyncerTest) ClassifiesUnreachableErrors() {
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("network is unreachable")}
+
+	ExpectTrue(isUnreachable(dialErr))
+	ExpectTrue(isUnreachable(&url.Error{Op: "Post", Err: dialErr}))
+	ExpectTrue(isUnreachable(&net.DNSError{Err: "no such host"}))
+
+	ExpectFalse(isUnreachable(nil))
+	ExpectFalse(isUnreachable(errors.New("taco")))
+	ExpectFalse(isUnreachable(&gcs.PreconditionError{}))
+	ExpectFalse(isUnreachable(&url.Error{Op: "Post", Err: io.EOF}))
+}
+
 func (t *SyncerTest) FullCreatorSucceeds() {
 	var err error
 	t.fullCreator.o = &gcs.Object{}
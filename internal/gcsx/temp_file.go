@@ -17,11 +17,12 @@ package gcsx
 import (
 	"fmt"
 	"io"
-	"os"
 	"time"
 
 	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/gcloud/gcs"
 	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
 )
 
 // A temporary file that keeps track of the lowest offset at which it has been
@@ -38,6 +39,12 @@ type TempFile interface {
 	io.WriterAt
 	Truncate(n int64) (err error)
 
+	// If offset falls within initial contents that have yet to be fetched (see
+	// NewAppendingTempFile), fetch them, giving up if ctx is cancelled. The
+	// methods above fetch them as needed too, but can't be cancelled, so
+	// callers with a context should call this first.
+	Fetch(ctx context.Context, offset int64) (err error)
+
 	// Return information about the current state of the content. May invalidate
 	// the seek position.
 	Stat() (sr StatResult, err error)
@@ -76,27 +83,106 @@ func NewTempFile(
 	content io.Reader,
 	dir string,
 	clock timeutil.Clock) (tf TempFile, err error) {
-	// Create an anonymous file to wrap. When we close it, its resources will be
-	// magically cleaned up.
-	f, err := fsutil.AnonymousFile(dir)
-	if err != nil {
-		err = fmt.Errorf("AnonymousFile: %v", err)
-		return
+	tf, err = NewSpillingTempFile(content, dir, 0, nil, clock)
+	return
+}
+
+// Like NewTempFile, but the contents are kept in memory for as long as they are
+// no larger than spillThreshold bytes, moving to a file in dir only once they
+// grow beyond that. This saves creating a file at all for small contents. A
+// threshold of zero means always use a file. The file's content is encrypted
+// with cipher, if non-nil.
+func NewSpillingTempFile(
+	content io.Reader,
+	dir string,
+	spillThreshold int64,
+	cipher *DiskCipher,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	t := &tempFile{
+		clock:          clock,
+		dir:            dir,
+		spillThreshold: spillThreshold,
+		cipher:         cipher,
+	}
+
+	// Read as much as fits in memory, plus a byte to tell whether there is more.
+	var size int64
+	if spillThreshold > 0 {
+		mf := &memFile{}
+		_, err = io.Copy(mf, io.LimitReader(content, spillThreshold+1))
+		if err != nil {
+			err = fmt.Errorf("copy: %v", err)
+			return
+		}
+
+		t.f = mf
+		size = int64(len(mf.buf))
 	}
 
-	// Copy into the file.
-	size, err := io.Copy(f, content)
+	// Move to a file if that didn't fit.
+	if spillThreshold == 0 || size > spillThreshold {
+		err = t.spill()
+		if err != nil {
+			return
+		}
+
+		// Copy the rest into the file.
+		var n int64
+		n, err = io.Copy(t.f, content)
+		if err != nil {
+			err = fmt.Errorf("copy: %v", err)
+			return
+		}
+
+		size += n
+	}
+
+	t.dirtyThreshold = size
+	tf = t
+
+	return
+}
+
+// Create a temp file whose initial contents are prefixSize bytes that are
+// fetched by calling fetch only once they are first needed: when they are
+// read, written, or truncated into. Until then they take no space, so content
+// that is only appended to can be synced by composing, without ever
+// downloading what it is appended to. The file is never kept in memory, and
+// its content is encrypted with cipher, if non-nil.
+func NewAppendingTempFile(
+	prefixSize int64,
+	fetch func(ctx context.Context) (io.ReadCloser, error),
+	dir string,
+	cipher *DiskCipher,
+	clock timeutil.Clock) (tf TempFile, err error) {
+	t := &tempFile{
+		clock:          clock,
+		dir:            dir,
+		cipher:         cipher,
+		missing:        prefixSize,
+		fetch:          fetch,
+		dirtyThreshold: prefixSize,
+	}
+
+	err = t.spill()
 	if err != nil {
-		err = fmt.Errorf("copy: %v", err)
 		return
 	}
 
-	tf = &tempFile{
-		clock:          clock,
-		f:              f,
-		dirtyThreshold: size,
+	// Leave a hole for the prefix, with the seek position after it as for other
+	// temp files.
+	err = t.f.Truncate(prefixSize)
+	if err == nil {
+		_, err = t.f.Seek(prefixSize, 0)
 	}
 
+	if err != nil {
+		t.f.Close()
+		err = fmt.Errorf("Truncate: %v", err)
+		return
+	}
+
+	tf = t
 	return
 }
 
@@ -107,14 +193,29 @@ type tempFile struct {
 
 	clock timeutil.Clock
 
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	// Where to create a file if the contents outgrow memory.
+	dir string
+
+	// The size beyond which contents held in memory move to a file. Zero if
+	// they are always in a file.
+	spillThreshold int64
+
+	// If non-nil, used to encrypt the content of a file created in dir.
+	cipher *DiskCipher
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
 	destroyed bool
 
-	// A file containing our current contents.
-	f *os.File
+	// Our current contents: a *memFile while they fit within spillThreshold,
+	// and a file, possibly encrypted, after that.
+	f tempStorage
 
 	// The lowest byte index that has been modified from the initial contents.
 	//
@@ -126,6 +227,21 @@ type tempFile struct {
 	//
 	// INVARIANT: mtime == nil => Stat().DirtyThreshold == Stat().Size
 	mtime *time.Time
+
+	// If non-nil, called by Destroy after closing the file, to remove it from
+	// a staging area.
+	cleanUp func()
+
+	// If non-nil, the manifest of the staging area holding the file, in which
+	// uploads of the contents are checkpointed.
+	staged *stagedManifest
+
+	// The length of the prefix of the initial contents that has yet to be
+	// fetched by calling fetch, and reads as zeros in f until then.
+	//
+	// INVARIANT: missing <= dirtyThreshold
+	missing int64
+	fetch   func(ctx context.Context) (io.ReadCloser, error)
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -164,17 +280,39 @@ func (tf *tempFile) CheckInvariants() {
 	if tf.mtime == nil && sr.DirtyThreshold != sr.Size {
 		panic(fmt.Sprintf("Mismatch: %d vs. %d", sr.DirtyThreshold, sr.Size))
 	}
+
+	// INVARIANT: missing <= dirtyThreshold
+	if !(tf.missing <= tf.dirtyThreshold) {
+		panic(fmt.Sprintf("Mismatch: %d vs. %d", tf.missing, tf.dirtyThreshold))
+	}
 }
 
 func (tf *tempFile) Destroy() {
 	tf.destroyed = true
 
-	// Throw away the file.
-	tf.f.Close()
-	tf.f = nil
+	// Throw away the file. We may already have been destroyed.
+	if tf.f != nil {
+		tf.f.Close()
+		tf.f = nil
+	}
+
+	if tf.cleanUp != nil {
+		tf.cleanUp()
+	}
 }
 
 func (tf *tempFile) Read(p []byte) (int, error) {
+	if tf.missing > 0 {
+		pos, err := tf.f.Seek(0, 1)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := tf.Fetch(context.Background(), pos); err != nil {
+			return 0, err
+		}
+	}
+
 	return tf.f.Read(p)
 }
 
@@ -183,6 +321,10 @@ func (tf *tempFile) Seek(offset int64, whence int) (int64, error) {
 }
 
 func (tf *tempFile) ReadAt(p []byte, offset int64) (int, error) {
+	if err := tf.Fetch(context.Background(), offset); err != nil {
+		return 0, err
+	}
+
 	return tf.f.ReadAt(p, offset)
 }
 
@@ -201,6 +343,21 @@ func (tf *tempFile) Stat() (sr StatResult, err error) {
 }
 
 func (tf *tempFile) WriteAt(p []byte, offset int64) (int, error) {
+	// Move to a file if we're about to outgrow memory.
+	if err := tf.spillIfExceeds(offset + int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	// An upload of the old contents can't be continued with the new.
+	if err := tf.forgetUpload(); err != nil {
+		return 0, err
+	}
+
+	// Don't let a write into the prefix be clobbered by fetching it later.
+	if err := tf.Fetch(context.Background(), offset); err != nil {
+		return 0, err
+	}
+
 	// Update our state regarding being dirty.
 	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, offset)
 
@@ -212,6 +369,21 @@ func (tf *tempFile) WriteAt(p []byte, offset int64) (int, error) {
 }
 
 func (tf *tempFile) Truncate(n int64) error {
+	// Move to a file if we're about to outgrow memory.
+	if err := tf.spillIfExceeds(n); err != nil {
+		return err
+	}
+
+	// An upload of the old contents can't be continued with the new.
+	if err := tf.forgetUpload(); err != nil {
+		return err
+	}
+
+	// Keep what survives of the prefix.
+	if err := tf.Fetch(context.Background(), n); err != nil {
+		return err
+	}
+
 	// Update our state regarding being dirty.
 	tf.dirtyThreshold = minInt64(tf.dirtyThreshold, n)
 
@@ -226,10 +398,158 @@ func (tf *tempFile) SetMtime(mtime time.Time) {
 	tf.mtime = &mtime
 }
 
+// Return how to upload the contents through a resumable upload session
+// checkpointed in the staging area holding them, or nil if they aren't staged
+// or are too small to bother. Doesn't disturb the seek position.
+func (tf *tempFile) resumableUpload() (ru *gcs.ResumableUpload, err error) {
+	if tf.staged == nil {
+		return
+	}
+
+	pos, err := tf.f.Seek(0, 1)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	size, err := tf.f.Seek(0, 2)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	_, err = tf.f.Seek(pos, 0)
+	if err != nil {
+		err = fmt.Errorf("Seek: %v", err)
+		return
+	}
+
+	ru = tf.staged.resumableUpload(size)
+	return
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// Forget any upload session checkpointed for the contents, which are about to
+// be modified.
+func (tf *tempFile) forgetUpload() (err error) {
+	if tf.staged == nil {
+		return
+	}
+
+	err = tf.staged.forgetUpload()
+	if err != nil {
+		err = fmt.Errorf("forgetUpload: %v", err)
+		return
+	}
+
+	return
+}
+
+// If the contents are in memory and would grow beyond spillThreshold by
+// having the given size, move them to a file.
+func (tf *tempFile) spillIfExceeds(size int64) (err error) {
+	if _, ok := tf.f.(*memFile); !ok || size <= tf.spillThreshold {
+		return
+	}
+
+	err = tf.spill()
+	return
+}
+
+// Move the contents, if any, to an anonymous file in tf.dir, preserving the
+// seek position. When we close the file its resources will be magically
+// cleaned up.
+func (tf *tempFile) spill() (err error) {
+	af, err := fsutil.AnonymousFile(tf.dir)
+	if err != nil {
+		err = fmt.Errorf("AnonymousFile: %v", err)
+		return
+	}
+
+	f, err := tf.cipher.wrap(af)
+	if err != nil {
+		af.Close()
+		err = fmt.Errorf("wrap: %v", err)
+		return
+	}
+
+	if mf, ok := tf.f.(*memFile); ok {
+		_, err = f.Write(mf.buf)
+		if err == nil {
+			_, err = f.Seek(mf.pos, 0)
+		}
+
+		if err != nil {
+			f.Close()
+			err = fmt.Errorf("spill: %v", err)
+			return
+		}
+	}
+
+	tf.f = f
+	return
+}
+
+// Fetch the whole prefix if necessary, without disturbing the seek position or
+// our state regarding being dirty.
+func (tf *tempFile) Fetch(ctx context.Context, offset int64) (err error) {
+	if offset >= tf.missing {
+		return
+	}
+
+	rc, err := tf.fetch(ctx)
+	if err != nil {
+		err = fmt.Errorf("fetch: %v", err)
+		return
+	}
+
+	defer rc.Close()
+
+	n, err := copyAt(tf.f, io.LimitReader(rc, tf.missing))
+	if err != nil {
+		err = fmt.Errorf("fetch: %v", err)
+		return
+	}
+
+	if n != tf.missing {
+		err = fmt.Errorf("fetch: got %d bytes, expected %d", n, tf.missing)
+		return
+	}
+
+	tf.missing = 0
+	return
+}
+
+// Copy r to the start of w, returning the number of bytes copied.
+func copyAt(w io.WriterAt, r io.Reader) (n int64, err error) {
+	buf := make([]byte, 32*1024)
+	for {
+		var nr int
+		nr, err = r.Read(buf)
+		if nr > 0 {
+			_, werr := w.WriteAt(buf[:nr], n)
+			if werr != nil {
+				err = werr
+				return
+			}
+
+			n += int64(nr)
+		}
+
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
 func minInt64(a int64, b int64) int64 {
 	if a < b {
 		return a
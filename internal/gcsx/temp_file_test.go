@@ -15,6 +15,8 @@
 package gcsx_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -97,6 +99,12 @@ func (tf *checkingTempFile) Truncate(n int64) error {
 	return tf.wrapped.Truncate(n)
 }
 
+func (tf *checkingTempFile) Fetch(ctx context.Context, offset int64) error {
+	tf.wrapped.CheckInvariants()
+	defer tf.wrapped.CheckInvariants()
+	return tf.wrapped.Fetch(ctx, offset)
+}
+
 func (tf *checkingTempFile) SetMtime(mtime time.Time) {
 	tf.wrapped.CheckInvariants()
 	defer tf.wrapped.CheckInvariants()
@@ -143,6 +151,324 @@ func (t *TempFileTest) SetUp(ti *TestInfo) {
 	AssertEq(nil, err)
 }
 
+// The same tests, for content kept in memory throughout.
+type InMemoryTempFileTest struct {
+	TempFileTest
+}
+
+func init() { RegisterTestSuite(&InMemoryTempFileTest{}) }
+
+func (t *InMemoryTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.tf.wrapped, err = gcsx.NewSpillingTempFile(
+		strings.NewReader(initialContent),
+		"",
+		1<<30,
+		nil,
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+// The same tests, for content that starts in memory and moves to a file when
+// it grows beyond a few bytes more than the initial content.
+type SpillingTempFileTest struct {
+	TempFileTest
+}
+
+func init() { RegisterTestSuite(&SpillingTempFileTest{}) }
+
+const spillThreshold = int64(initialContentSize) + 4
+
+func (t *SpillingTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.tf.wrapped, err = gcsx.NewSpillingTempFile(
+		strings.NewReader(initialContent),
+		"",
+		spillThreshold,
+		nil,
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+func (t *SpillingTempFileTest) SpillPreservesSeekPosition() {
+	_, err := t.tf.Seek(0, 0)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(&t.tf, buf)
+	AssertEq(nil, err)
+	AssertEq(initialContent[:4], string(buf))
+
+	// Grow beyond the threshold.
+	_, err = t.tf.WriteAt([]byte("enchilada"), int64(initialContentSize))
+	AssertEq(nil, err)
+
+	// Reading continues where it left off.
+	rest, err := ioutil.ReadAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq(initialContent[4:]+"enchilada", string(rest))
+}
+
+func (t *SpillingTempFileTest) WriteUpToThreshold() {
+	// Reach the threshold exactly.
+	p := []byte("salsa")[:spillThreshold-int64(initialContentSize)]
+	_, err := t.tf.WriteAt(p, int64(initialContentSize))
+	AssertEq(nil, err)
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq(initialContent+string(p), string(actual))
+}
+
+func (t *SpillingTempFileTest) InitialContentLargerThanThreshold() {
+	contents := strings.Repeat("taco", 100)
+	tf, err := gcsx.NewSpillingTempFile(
+		strings.NewReader(contents),
+		"",
+		spillThreshold,
+		nil,
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	sr, err := tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(len(contents), sr.Size)
+	ExpectEq(len(contents), sr.DirtyThreshold)
+
+	actual, err := readAll(tf)
+	AssertEq(nil, err)
+	ExpectEq(contents, string(actual))
+}
+
+// The same tests, for initial content that is fetched only when needed.
+type AppendingTempFileTest struct {
+	TempFileTest
+
+	fetches int
+}
+
+func init() { RegisterTestSuite(&AppendingTempFileTest{}) }
+
+func (t *AppendingTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.tf.wrapped, err = gcsx.NewAppendingTempFile(
+		int64(initialContentSize),
+		t.fetch,
+		"",
+		nil,
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+func (t *AppendingTempFileTest) fetch(
+	ctx context.Context) (rc io.ReadCloser, err error) {
+	t.fetches++
+	rc = ioutil.NopCloser(strings.NewReader(initialContent))
+	return
+}
+
+func (t *AppendingTempFileTest) AppendDoesntFetch() {
+	_, err := t.tf.WriteAt([]byte("enchilada"), int64(initialContentSize))
+	AssertEq(nil, err)
+
+	sr, err := t.tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize+len("enchilada"), sr.Size)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+
+	// Reading back what was appended needn't fetch either.
+	_, err = t.tf.Seek(int64(initialContentSize), 0)
+	AssertEq(nil, err)
+
+	rest, err := ioutil.ReadAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectEq("enchilada", string(rest))
+
+	ExpectEq(0, t.fetches)
+}
+
+func (t *AppendingTempFileTest) ReadingPrefixFetchesOnce() {
+	_, err := t.tf.WriteAt([]byte("enchilada"), int64(initialContentSize))
+	AssertEq(nil, err)
+
+	for i := 0; i < 2; i++ {
+		actual, err := readAll(&t.tf)
+		AssertEq(nil, err)
+		ExpectEq(initialContent+"enchilada", string(actual))
+	}
+
+	ExpectEq(1, t.fetches)
+
+	// Fetching doesn't count as modifying.
+	sr, err := t.tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+}
+
+func (t *AppendingTempFileTest) FetchError() {
+	t.tf.wrapped, _ = gcsx.NewAppendingTempFile(
+		int64(initialContentSize),
+		func(context.Context) (io.ReadCloser, error) {
+			return nil, errors.New("taco")
+		},
+		"",
+		nil,
+		&t.clock)
+
+	var buf [4]byte
+	_, err := t.tf.ReadAt(buf[:], 0)
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	_, err = t.tf.WriteAt([]byte("enchilada"), 2)
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	// Nothing was modified.
+	sr, err := t.tf.Stat()
+	AssertEq(nil, err)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+	ExpectEq(nil, sr.Mtime)
+}
+
+func (t *AppendingTempFileTest) FetchCancelled() {
+	// A fetch that hangs until its context is cancelled.
+	t.tf.wrapped, _ = gcsx.NewAppendingTempFile(
+		int64(initialContentSize),
+		func(ctx context.Context) (io.ReadCloser, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		"",
+		nil,
+		&t.clock)
+
+	ctx, cancel := context.WithTimeout(t.ctx, 10*time.Millisecond)
+	defer cancel()
+
+	err := t.tf.Fetch(ctx, 2)
+	ExpectThat(err, Error(HasSubstr("deadline exceeded")))
+
+	// Nothing past the prefix needs fetching.
+	err = t.tf.Fetch(ctx, int64(initialContentSize))
+	ExpectEq(nil, err)
+}
+
+func (t *AppendingTempFileTest) ShortFetch() {
+	t.tf.wrapped, _ = gcsx.NewAppendingTempFile(
+		int64(initialContentSize),
+		func(context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("taco")), nil
+		},
+		"",
+		nil,
+		&t.clock)
+
+	var buf [4]byte
+	_, err := t.tf.ReadAt(buf[:], 0)
+	ExpectThat(err, Error(HasSubstr("expected 11")))
+}
+
+// The same tests, for a file whose content is encrypted.
+type EncryptedTempFileTest struct {
+	TempFileTest
+
+	cipher *gcsx.DiskCipher
+}
+
+func init() { RegisterTestSuite(&EncryptedTempFileTest{}) }
+
+func (t *EncryptedTempFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	t.cipher, err = gcsx.NewDiskCipher(bytes.Repeat([]byte("k"), 32))
+	AssertEq(nil, err)
+
+	t.tf.wrapped, err = gcsx.NewSpillingTempFile(
+		strings.NewReader(initialContent),
+		"",
+		0,
+		t.cipher,
+		&t.clock)
+
+	AssertEq(nil, err)
+}
+
+func (t *EncryptedTempFileTest) WritesAcrossChunks() {
+	// Make a series of modifications spanning many chunks, and the ends of
+	// chunks, mirroring them in memory.
+	expected := []byte(initialContent)
+	writeAt := func(p []byte, offset int) {
+		_, err := t.tf.WriteAt(p, int64(offset))
+		AssertEq(nil, err)
+
+		if len(expected) < offset+len(p) {
+			expected = append(expected, make([]byte, offset+len(p)-len(expected))...)
+		}
+
+		copy(expected[offset:], p)
+	}
+
+	truncate := func(n int) {
+		err := t.tf.Truncate(int64(n))
+		AssertEq(nil, err)
+
+		if len(expected) < n {
+			expected = append(expected, make([]byte, n-len(expected))...)
+		}
+
+		expected = expected[:n]
+	}
+
+	writeAt(bytes.Repeat([]byte("taco"), 5000), 3)
+	writeAt([]byte("burrito"), 4093)
+	writeAt([]byte("enchilada"), 50000)
+	truncate(12289)
+	writeAt([]byte("queso"), 8190)
+	truncate(30000)
+	writeAt([]byte("salsa"), 28000)
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, actual))
+}
+
+func (t *EncryptedTempFileTest) AppendingPrefixAcrossChunks() {
+	prefix := bytes.Repeat([]byte("taco"), 5000)
+	tf, err := gcsx.NewAppendingTempFile(
+		int64(len(prefix)),
+		func(context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(prefix)), nil
+		},
+		"",
+		t.cipher,
+		&t.clock)
+
+	AssertEq(nil, err)
+	defer tf.Destroy()
+
+	_, err = tf.WriteAt([]byte("burrito"), int64(len(prefix)))
+	AssertEq(nil, err)
+
+	actual, err := readAll(tf)
+	AssertEq(nil, err)
+	ExpectEq(string(prefix)+"burrito", string(actual))
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Tests
 ////////////////////////////////////////////////////////////////////////
@@ -221,6 +547,57 @@ func (t *TempFileTest) Truncate() {
 	ExpectEq(expected, string(actual))
 }
 
+func (t *TempFileTest) Truncate_Extend() {
+	const size = 1 << 20
+
+	// Call
+	err := t.tf.Truncate(size)
+	ExpectEq(nil, err)
+
+	// Check Stat. The original content is still clean.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(size, sr.Size)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+	ExpectThat(sr.Mtime, Pointee(timeutil.TimeEq(t.clock.Now())))
+
+	// Read back. The extension reads as zeros.
+	expected := make([]byte, size)
+	copy(expected, initialContent)
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, actual))
+}
+
+func (t *TempFileTest) WriteAt_PastEnd() {
+	const offset = 1 << 20
+
+	// Call
+	p := []byte("enchilada")
+	n, err := t.tf.WriteAt(p, offset)
+
+	ExpectEq(len(p), n)
+	ExpectEq(nil, err)
+
+	// Check Stat.
+	sr, err := t.tf.Stat()
+
+	AssertEq(nil, err)
+	ExpectEq(offset+len(p), sr.Size)
+	ExpectEq(initialContentSize, sr.DirtyThreshold)
+
+	// Read back. The gap reads as zeros.
+	expected := make([]byte, offset+len(p))
+	copy(expected, initialContent)
+	copy(expected[offset:], p)
+
+	actual, err := readAll(&t.tf)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(expected, actual))
+}
+
 func (t *TempFileTest) SetMtime() {
 	mtime := time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
 	AssertThat(mtime, Not(timeutil.TimeEq(t.clock.Now())))
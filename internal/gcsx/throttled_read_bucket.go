@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/ratelimit"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that limits the rate at which object contents may be read
+// through it using the supplied throttle. Other operations are passed through
+// unmodified.
+func NewThrottledReadBucket(
+	throttle ratelimit.Throttle,
+	wrapped gcs.Bucket) gcs.Bucket {
+	return throttledReadBucket{
+		Bucket:   wrapped,
+		throttle: throttle,
+	}
+}
+
+type throttledReadBucket struct {
+	gcs.Bucket
+	throttle ratelimit.Throttle
+}
+
+func (b throttledReadBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	rc, err = b.Bucket.NewReader(ctx, req)
+	if err != nil {
+		return
+	}
+
+	rc = &throttledReadCloser{
+		Reader: ratelimit.ThrottledReader(ctx, rc, b.throttle),
+		Closer: rc,
+	}
+
+	return
+}
+
+type throttledReadCloser struct {
+	io.Reader
+	io.Closer
+}
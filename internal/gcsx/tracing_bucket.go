@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"io"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// Create a bucket that records a child span for each request made within the
+// context of an existing trace (see package tracing). Requests made outside of
+// a trace are not recorded.
+func NewTracingBucket(wrapped gcs.Bucket) gcs.Bucket {
+	return &tracingBucket{
+		wrapped: wrapped,
+	}
+}
+
+type tracingBucket struct {
+	wrapped gcs.Bucket
+}
+
+func (b *tracingBucket) startSpan(
+	ctx context.Context,
+	method string,
+	name string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartChildSpan(
+		ctx,
+		"gcs."+method,
+		tracing.SpanKindClient)
+
+	span.SetAttribute("gcs.bucket", b.wrapped.Name())
+	if name != "" {
+		span.SetAttribute("gcs.object", name)
+	}
+
+	return ctx, span
+}
+
+func (b *tracingBucket) Name() string {
+	return b.wrapped.Name()
+}
+
+func (b *tracingBucket) NewReader(
+	ctx context.Context,
+	req *gcs.ReadObjectRequest) (rc io.ReadCloser, err error) {
+	ctx, span := b.startSpan(ctx, "NewReader", req.Name)
+	if req.Range != nil {
+		span.SetAttribute("gcs.range_start", int64(req.Range.Start))
+		span.SetAttribute("gcs.range_limit", int64(req.Range.Limit))
+	}
+
+	rc, err = b.wrapped.NewReader(ctx, req)
+	if err != nil {
+		span.End(err)
+		return
+	}
+
+	// The span covers the lifetime of the reader.
+	rc = &tracingReadCloser{
+		ReadCloser: rc,
+		span:       span,
+	}
+
+	return
+}
+
+func (b *tracingBucket) CreateObject(
+	ctx context.Context,
+	req *gcs.CreateObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "CreateObject", req.Name)
+	defer func() { span.End(err) }()
+
+	o, err = b.wrapped.CreateObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) CopyObject(
+	ctx context.Context,
+	req *gcs.CopyObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "CopyObject", req.DstName)
+	span.SetAttribute("gcs.src_object", req.SrcName)
+	defer func() { span.End(err) }()
+
+	o, err = b.wrapped.CopyObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) ComposeObjects(
+	ctx context.Context,
+	req *gcs.ComposeObjectsRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "ComposeObjects", req.DstName)
+	span.SetAttribute("gcs.source_count", len(req.Sources))
+	defer func() { span.End(err) }()
+
+	o, err = b.wrapped.ComposeObjects(ctx, req)
+	return
+}
+
+func (b *tracingBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "StatObject", req.Name)
+	defer func() { span.End(err) }()
+
+	o, err = b.wrapped.StatObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) ListObjects(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	ctx, span := b.startSpan(ctx, "ListObjects", "")
+	span.SetAttribute("gcs.prefix", req.Prefix)
+	defer func() { span.End(err) }()
+
+	listing, err = b.wrapped.ListObjects(ctx, req)
+	return
+}
+
+func (b *tracingBucket) UpdateObject(
+	ctx context.Context,
+	req *gcs.UpdateObjectRequest) (o *gcs.Object, err error) {
+	ctx, span := b.startSpan(ctx, "UpdateObject", req.Name)
+	defer func() { span.End(err) }()
+
+	o, err = b.wrapped.UpdateObject(ctx, req)
+	return
+}
+
+func (b *tracingBucket) DeleteObject(
+	ctx context.Context,
+	req *gcs.DeleteObjectRequest) (err error) {
+	ctx, span := b.startSpan(ctx, "DeleteObject", req.Name)
+	defer func() { span.End(err) }()
+
+	err = b.wrapped.DeleteObject(ctx, req)
+	return
+}
+
+type tracingReadCloser struct {
+	io.ReadCloser
+	span *tracing.Span
+}
+
+func (rc *tracingReadCloser) Close() (err error) {
+	err = rc.ReadCloser.Close()
+	rc.span.End(err)
+	return
+}
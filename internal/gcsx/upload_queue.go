@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Limits the number of uploads in flight at once, making the rest wait their
+// turn in the order in which they arrived. Without this, closing many files at
+// once (for example after extracting an archive) would issue a request to GCS
+// for each of them simultaneously.
+//
+// A nil *UploadQueue imposes no limit. Safe for concurrent access.
+type UploadQueue struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	limit int
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The number of uploads that have acquired a slot and not yet released it.
+	//
+	// INVARIANT: 0 <= inFlight <= limit
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+
+	// Uploads waiting for a slot, oldest first. Each element is an
+	// *uploadWaiter.
+	//
+	// INVARIANT: If waiters.Len() > 0, then inFlight == limit
+	//
+	// GUARDED_BY(mu)
+	waiters list.List
+}
+
+type uploadWaiter struct {
+	// Closed when the waiter has been handed a slot.
+	ready   chan struct{}
+	granted bool
+}
+
+// Create a queue that allows at most limit uploads in flight.
+//
+// REQUIRES: limit > 0
+func NewUploadQueue(limit int) (q *UploadQueue) {
+	if limit <= 0 {
+		panic(fmt.Sprintf("Illegal limit: %d", limit))
+	}
+
+	q = &UploadQueue{
+		limit: limit,
+	}
+
+	return
+}
+
+// Wait until an upload may begin, or the context is cancelled. If this
+// returns nil, the caller must call Release when the upload finishes.
+func (q *UploadQueue) Acquire(ctx context.Context) (err error) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+
+	// Is there a free slot?
+	if q.inFlight < q.limit {
+		q.inFlight++
+		q.mu.Unlock()
+		return
+	}
+
+	// Otherwise join the back of the queue.
+	w := &uploadWaiter{
+		ready: make(chan struct{}),
+	}
+
+	e := q.waiters.PushBack(w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return
+
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		// We may have been handed a slot concurrently with the cancellation, in
+		// which case we must pass it on.
+		if w.granted {
+			q.release()
+		} else {
+			q.waiters.Remove(e)
+		}
+
+		err = ctx.Err()
+		return
+	}
+}
+
+// Release a slot acquired with Acquire, letting the next waiting upload begin.
+func (q *UploadQueue) Release() {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.release()
+}
+
+// Hand the releasing upload's slot to the oldest waiter, if any.
+//
+// LOCKS_REQUIRED(q.mu)
+func (q *UploadQueue) release() {
+	e := q.waiters.Front()
+	if e == nil {
+		q.inFlight--
+		return
+	}
+
+	w := q.waiters.Remove(e).(*uploadWaiter)
+	w.granted = true
+	close(w.ready)
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestUploadQueue(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type UploadQueueTest struct {
+	ctx context.Context
+	q   *UploadQueue
+
+	// Receives the name of each upload started by startAcquire once it has
+	// acquired a slot.
+	acquired chan string
+}
+
+var _ SetUpInterface = &UploadQueueTest{}
+
+func init() { RegisterTestSuite(&UploadQueueTest{}) }
+
+func (t *UploadQueueTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.q = NewUploadQueue(2)
+	t.acquired = make(chan string, 10)
+}
+
+func (t *UploadQueueTest) waiters() (n int) {
+	t.q.mu.Lock()
+	n = t.q.waiters.Len()
+	t.q.mu.Unlock()
+
+	return
+}
+
+// Start a call to Acquire in the background, waiting until it has either
+// succeeded or been queued.
+func (t *UploadQueueTest) startAcquire(name string) {
+	before := t.waiters()
+	done := make(chan struct{})
+
+	go func() {
+		err := t.q.Acquire(t.ctx)
+		AssertEq(nil, err)
+
+		close(done)
+		t.acquired <- name
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if t.waiters() > before {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Return the name of the next upload to acquire a slot, or the empty string if
+// none does promptly.
+func (t *UploadQueueTest) nextAcquired() string {
+	select {
+	case name := <-t.acquired:
+		return name
+
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UploadQueueTest) IllegalLimit() {
+	ExpectThat(
+		func() { NewUploadQueue(0) },
+		Panics(HasSubstr("limit")))
+}
+
+func (t *UploadQueueTest) NilQueue() {
+	var q *UploadQueue
+	for i := 0; i < 100; i++ {
+		AssertEq(nil, q.Acquire(t.ctx))
+	}
+
+	q.Release()
+}
+
+func (t *UploadQueueTest) LimitRespected() {
+	t.startAcquire("a")
+	t.startAcquire("b")
+	t.startAcquire("c")
+
+	ExpectEq("a", t.nextAcquired())
+	ExpectEq("b", t.nextAcquired())
+	ExpectEq("", t.nextAcquired())
+	ExpectEq(1, t.waiters())
+
+	// Finishing an upload lets the waiting one begin.
+	t.q.Release()
+	ExpectEq("c", t.nextAcquired())
+	ExpectEq(0, t.waiters())
+}
+
+func (t *UploadQueueTest) FirstInFirstOut() {
+	t.startAcquire("a")
+	t.startAcquire("b")
+	AssertEq("a", t.nextAcquired())
+	AssertEq("b", t.nextAcquired())
+
+	t.startAcquire("c")
+	t.startAcquire("d")
+	t.startAcquire("e")
+
+	var order []string
+	for i := 0; i < 3; i++ {
+		t.q.Release()
+		order = append(order, t.nextAcquired())
+	}
+
+	ExpectThat(order, ElementsAre("c", "d", "e"))
+}
+
+func (t *UploadQueueTest) SlotsAreReused() {
+	for i := 0; i < 10; i++ {
+		AssertEq(nil, t.q.Acquire(t.ctx))
+		AssertEq(nil, t.q.Acquire(t.ctx))
+		t.q.Release()
+		t.q.Release()
+	}
+
+	t.q.mu.Lock()
+	ExpectEq(0, t.q.inFlight)
+	t.q.mu.Unlock()
+}
+
+func (t *UploadQueueTest) CancelledWaiterIsRemoved() {
+	t.startAcquire("a")
+	t.startAcquire("b")
+	AssertEq("a", t.nextAcquired())
+	AssertEq("b", t.nextAcquired())
+
+	// Queue an upload, then cancel it.
+	ctx, cancel := context.WithCancel(t.ctx)
+	errChan := make(chan error, 1)
+	go func() { errChan <- t.q.Acquire(ctx) }()
+
+	for t.waiters() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	ExpectEq(context.Canceled, <-errChan)
+	ExpectEq(0, t.waiters())
+
+	// Later uploads should still be served.
+	t.startAcquire("c")
+	t.q.Release()
+	ExpectEq("c", t.nextAcquired())
+}
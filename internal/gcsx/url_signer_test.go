@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestURLSigner(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const signerEmail = "reader@some-project.iam.gserviceaccount.com"
+
+type URLSignerTest struct {
+	clock  timeutil.SimulatedClock
+	key    *rsa.PrivateKey
+	signer *gcsx.URLSigner
+}
+
+var _ SetUpInterface = &URLSignerTest{}
+
+func init() { RegisterTestSuite(&URLSignerTest{}) }
+
+func (t *URLSignerTest) SetUp(ti *TestInfo) {
+	var err error
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC))
+
+	t.key, err = rsa.GenerateKey(rand.Reader, 1024)
+	AssertEq(nil, err)
+
+	t.signer, err = gcsx.NewURLSigner(t.jsonKey(), time.Hour, &t.clock)
+	AssertEq(nil, err)
+}
+
+// Return a JSON key for our service account, like those downloaded from the
+// Cloud Console.
+func (t *URLSignerTest) jsonKey() []byte {
+	pemKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(t.key),
+	})
+
+	b, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   signerEmail,
+		"private_key_id": "17",
+		"private_key":    string(pemKey),
+	})
+
+	AssertEq(nil, err)
+	return b
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *URLSignerTest) InvalidExpiry() {
+	_, err := gcsx.NewURLSigner(t.jsonKey(), 0, &t.clock)
+	ExpectThat(err, Error(HasSubstr("expiry")))
+
+	_, err = gcsx.NewURLSigner(t.jsonKey(), 8*24*time.Hour, &t.clock)
+	ExpectThat(err, Error(HasSubstr("expiry")))
+}
+
+func (t *URLSignerTest) NotAServiceAccountKey() {
+	_, err := gcsx.NewURLSigner(
+		[]byte(`{"type": "authorized_user"}`),
+		time.Hour,
+		&t.clock)
+
+	ExpectThat(err, Error(HasSubstr("service_account")))
+}
+
+func (t *URLSignerTest) Parameters() {
+	s, err := t.signer.SignedURL("some_bucket", "foo bar/baz+qux")
+	AssertEq(nil, err)
+
+	u, err := url.Parse(s)
+	AssertEq(nil, err)
+
+	ExpectEq("https", u.Scheme)
+	ExpectEq("storage.googleapis.com", u.Host)
+	ExpectEq("/some_bucket/foo%20bar/baz%2Bqux", u.EscapedPath())
+
+	q := u.Query()
+	ExpectEq("GOOG4-RSA-SHA256", q.Get("X-Goog-Algorithm"))
+	ExpectEq(
+		signerEmail+"/20150405/auto/storage/goog4_request",
+		q.Get("X-Goog-Credential"))
+
+	ExpectEq("20150405T021500Z", q.Get("X-Goog-Date"))
+	ExpectEq("3600", q.Get("X-Goog-Expires"))
+	ExpectEq("host", q.Get("X-Goog-SignedHeaders"))
+
+	// Spaces and slashes in parameters are percent-encoded.
+	ExpectThat(s, HasSubstr("reader%40some-project.iam.gserviceaccount.com%2F"))
+	ExpectFalse(strings.Contains(s, "+"))
+}
+
+func (t *URLSignerTest) Signature() {
+	s, err := t.signer.SignedURL("some_bucket", "foo")
+	AssertEq(nil, err)
+
+	// Rebuild what should have been signed, following the documented process.
+	i := strings.Index(s, "&X-Goog-Signature=")
+	AssertNe(-1, i)
+
+	query := s[strings.Index(s, "?")+1 : i]
+	request := "GET\n/some_bucket/foo\n" + query + "\n" +
+		"host:storage.googleapis.com\n\nhost\nUNSIGNED-PAYLOAD"
+
+	requestHash := sha256.Sum256([]byte(request))
+	toSign := "GOOG4-RSA-SHA256\n20150405T021500Z\n" +
+		"20150405/auto/storage/goog4_request\n" +
+		hex.EncodeToString(requestHash[:])
+
+	sig, err := hex.DecodeString(s[i+len("&X-Goog-Signature="):])
+	AssertEq(nil, err)
+
+	digest := sha256.Sum256([]byte(toSign))
+	err = rsa.VerifyPKCS1v15(&t.key.PublicKey, crypto.SHA256, digest[:], sig)
+	ExpectEq(nil, err)
+}
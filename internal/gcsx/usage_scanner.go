@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// The total size and number of the objects in a bucket, as of some time.
+type BucketUsage struct {
+	Bytes   uint64
+	Objects uint64
+}
+
+// Lists a bucket to find out how much it contains, reusing the result for a
+// while because doing so may take many requests. Safe for concurrent access.
+type UsageScanner struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	bucket gcs.Bucket
+	clock  timeutil.Clock
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	ttl time.Duration
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The result of the most recent successful scan, if any.
+	//
+	// GUARDED_BY(mu)
+	usage   BucketUsage
+	scanned bool
+
+	// The time at which the scan that produced usage started.
+	//
+	// GUARDED_BY(mu)
+	scanTime time.Time
+
+	// Is a scan started by Usage currently in progress?
+	//
+	// GUARDED_BY(mu)
+	scanning bool
+}
+
+// Create a scanner for the supplied bucket, whose results are considered
+// stale after the given TTL.
+func NewUsageScanner(
+	bucket gcs.Bucket,
+	ttl time.Duration,
+	clock timeutil.Clock) (s *UsageScanner) {
+	s = &UsageScanner{
+		bucket: bucket,
+		clock:  clock,
+		ttl:    ttl,
+	}
+
+	return
+}
+
+// Return the most recent result, if there is one. If it is missing or stale,
+// start a new scan in the background, so that a later call receives a fresher
+// result. Does not block on GCS.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *UsageScanner) Usage() (usage BucketUsage, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage, ok = s.usage, s.scanned
+
+	stale := !s.scanned || s.clock.Now().Sub(s.scanTime) >= s.ttl
+	if stale && !s.scanning {
+		s.scanning = true
+		go s.scanInBackground()
+	}
+
+	return
+}
+
+// List the entire bucket, updating the result returned by Usage.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *UsageScanner) Scan(ctx context.Context) (err error) {
+	start := s.clock.Now()
+
+	var usage BucketUsage
+	req := &gcs.ListObjectsRequest{}
+	for {
+		var listing *gcs.Listing
+		listing, err = s.bucket.ListObjects(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("ListObjects: %v", err)
+			return
+		}
+
+		for _, o := range listing.Objects {
+			usage.Bytes += o.Size
+			usage.Objects++
+		}
+
+		if listing.ContinuationToken == "" {
+			break
+		}
+
+		req.ContinuationToken = listing.ContinuationToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Don't replace a result from a scan that started later.
+	if s.scanned && s.scanTime.After(start) {
+		return
+	}
+
+	s.usage = usage
+	s.scanned = true
+	s.scanTime = start
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *UsageScanner) scanInBackground() {
+	err := s.Scan(context.Background())
+	if err != nil {
+		logger.Warningf("Scanning bucket usage: %v", err)
+	}
+
+	s.mu.Lock()
+	s.scanning = false
+	s.mu.Unlock()
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcsx_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestUsageScanner(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+const usageTTL = time.Minute
+
+type UsageScannerTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	bucket  gcs.Bucket
+	scanner *gcsx.UsageScanner
+}
+
+var _ SetUpInterface = &UsageScannerTest{}
+
+func init() { RegisterTestSuite(&UsageScannerTest{}) }
+
+func (t *UsageScannerTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.bucket = gcsfake.NewFakeBucket(&t.clock, "some_bucket")
+	t.scanner = gcsx.NewUsageScanner(t.bucket, usageTTL, &t.clock)
+}
+
+// Call Usage until it returns the expected result or we give up.
+func (t *UsageScannerTest) awaitUsage(expected gcsx.BucketUsage) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		usage, ok := t.scanner.Usage()
+		if ok && usage == expected {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			AddFailure("Timed out waiting for %v; last saw %v", expected, usage)
+			AbortTest()
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UsageScannerTest) EmptyBucket() {
+	err := t.scanner.Scan(t.ctx)
+	AssertEq(nil, err)
+
+	usage, ok := t.scanner.Usage()
+	AssertTrue(ok)
+	ExpectEq(0, usage.Bytes)
+	ExpectEq(0, usage.Objects)
+}
+
+func (t *UsageScannerTest) CountsAllObjects() {
+	err := gcsutil.CreateObjects(
+		t.ctx,
+		t.bucket,
+		map[string][]byte{
+			"foo":         []byte("taco"),
+			"bar/":        []byte(""),
+			"bar/baz":     []byte("burrito"),
+			"bar/qux/enc": []byte("enchilada"),
+		})
+
+	AssertEq(nil, err)
+
+	err = t.scanner.Scan(t.ctx)
+	AssertEq(nil, err)
+
+	usage, ok := t.scanner.Usage()
+	AssertTrue(ok)
+	ExpectEq(len("taco")+len("burrito")+len("enchilada"), usage.Bytes)
+	ExpectEq(4, usage.Objects)
+}
+
+func (t *UsageScannerTest) FirstCallStartsScan() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	// Nothing is known yet, but asking starts a scan.
+	_, ok := t.scanner.Usage()
+	ExpectFalse(ok)
+
+	t.awaitUsage(gcsx.BucketUsage{Bytes: 4, Objects: 1})
+}
+
+func (t *UsageScannerTest) StaleResultIsRefreshed() {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("taco"))
+	AssertEq(nil, err)
+
+	err = t.scanner.Scan(t.ctx)
+	AssertEq(nil, err)
+
+	// Add another object. Until the TTL expires, the old result stands.
+	_, err = gcsutil.CreateObject(t.ctx, t.bucket, "bar", []byte("burrito"))
+	AssertEq(nil, err)
+
+	t.clock.AdvanceTime(usageTTL / 2)
+	usage, ok := t.scanner.Usage()
+	AssertTrue(ok)
+	ExpectEq(1, usage.Objects)
+
+	// Afterward the old result is returned while a new scan is made.
+	t.clock.AdvanceTime(usageTTL)
+	usage, ok = t.scanner.Usage()
+	AssertTrue(ok)
+	ExpectEq(1, usage.Objects)
+
+	t.awaitUsage(gcsx.BucketUsage{Bytes: 11, Objects: 2})
+}
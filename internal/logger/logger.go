@@ -0,0 +1,241 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Process-wide logging with severities, writing either human-readable text or
+// one JSON object per line.
+//
+// By default records are written as text to stderr. Call Init to send them to
+// a file or change the format. Output from the standard log package is
+// captured too, at SeverityInfo.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Severity int
+
+const (
+	SeverityDebug Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityDebug:
+		return "DEBUG"
+	case SeverityInfo:
+		return "INFO"
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityError:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Parse the lower-case name of a severity, such as "warning".
+func ParseSeverity(s string) (sev Severity, err error) {
+	for sev = SeverityDebug; sev <= SeverityError; sev++ {
+		if s == strings.ToLower(sev.String()) {
+			return
+		}
+	}
+
+	err = fmt.Errorf("Unknown log severity: %q", s)
+	return
+}
+
+// Supported values for the format argument to Init.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	gMu sync.Mutex
+
+	// GUARDED_BY(gMu)
+	gHandler = newHandler(os.Stderr, FormatText)
+
+	// Records less severe than this are discarded.
+	//
+	// GUARDED_BY(gMu)
+	gSeverity = SeverityDebug
+
+	// The file opened by Init, if any.
+	//
+	// GUARDED_BY(gMu)
+	gFile *os.File
+)
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(&legacyWriter{severity: SeverityInfo})
+}
+
+// Configure the destination and format of log records. If path is empty,
+// records go to stderr; otherwise they are appended to the file with that
+// name, which is created if necessary. format must be FormatText or
+// FormatJSON.
+func Init(path string, format string) (err error) {
+	if format != FormatText && format != FormatJSON {
+		err = fmt.Errorf("Unknown log format: %q", format)
+		return
+	}
+
+	var w io.Writer = os.Stderr
+	var f *os.File
+	if path != "" {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			err = fmt.Errorf("OpenFile: %v", err)
+			return
+		}
+
+		w = f
+	}
+
+	gMu.Lock()
+	defer gMu.Unlock()
+
+	if gFile != nil {
+		gFile.Close()
+	}
+
+	gHandler = newHandler(w, format)
+	gFile = f
+
+	return
+}
+
+// Discard records less severe than the supplied severity from now on. By
+// default none are discarded.
+func SetSeverity(sev Severity) {
+	gMu.Lock()
+	defer gMu.Unlock()
+
+	gSeverity = sev
+}
+
+func Debugf(format string, v ...interface{}) {
+	output(SeverityDebug, fmt.Sprintf(format, v...))
+}
+
+func Infof(format string, v ...interface{}) {
+	output(SeverityInfo, fmt.Sprintf(format, v...))
+}
+
+func Warningf(format string, v ...interface{}) {
+	output(SeverityWarning, fmt.Sprintf(format, v...))
+}
+
+func Errorf(format string, v ...interface{}) {
+	output(SeverityError, fmt.Sprintf(format, v...))
+}
+
+// Return a *log.Logger whose output is written as records of the given
+// severity, for handing to code that wants a logger of that type. Each call
+// to its Print methods becomes one record, with the supplied prefix at the
+// start of the message.
+func NewLegacyLogger(sev Severity, prefix string) *log.Logger {
+	w := &legacyWriter{
+		severity: sev,
+	}
+
+	return log.New(w, prefix, 0)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func output(sev Severity, msg string) {
+	gMu.Lock()
+	defer gMu.Unlock()
+
+	if sev < gSeverity {
+		return
+	}
+
+	gHandler.output(time.Now(), sev, msg)
+}
+
+type legacyWriter struct {
+	severity Severity
+}
+
+func (w *legacyWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	output(w.severity, string(bytes.TrimSuffix(p, []byte("\n"))))
+	return
+}
+
+type handler struct {
+	w      io.Writer
+	format string
+}
+
+func newHandler(w io.Writer, format string) *handler {
+	return &handler{
+		w:      w,
+		format: format,
+	}
+}
+
+type jsonRecord struct {
+	Time     string `json:"time"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (h *handler) output(t time.Time, sev Severity, msg string) {
+	var buf bytes.Buffer
+
+	switch h.format {
+	case FormatJSON:
+		r := jsonRecord{
+			Time:     t.Format(time.RFC3339Nano),
+			Severity: sev.String(),
+			Message:  msg,
+		}
+
+		// Encode appends a newline.
+		if err := json.NewEncoder(&buf).Encode(&r); err != nil {
+			panic(fmt.Sprintf("Encode: %v", err))
+		}
+
+	default:
+		fmt.Fprintf(
+			&buf,
+			"%s %s: %s\n",
+			t.Format("2006/01/02 15:04:05.000000"),
+			sev,
+			msg)
+	}
+
+	// There's nowhere sensible to report a failure to write.
+	h.w.Write(buf.Bytes())
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestLogger(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LoggerTest struct {
+	buf bytes.Buffer
+}
+
+var _ SetUpInterface = &LoggerTest{}
+var _ TearDownInterface = &LoggerTest{}
+
+func init() { RegisterTestSuite(&LoggerTest{}) }
+
+func (t *LoggerTest) SetUp(ti *TestInfo) {
+	t.setFormat(FormatText)
+}
+
+func (t *LoggerTest) TearDown() {
+	err := Init("", FormatText)
+	AssertEq(nil, err)
+
+	SetSeverity(SeverityDebug)
+}
+
+func (t *LoggerTest) setFormat(format string) {
+	gMu.Lock()
+	gHandler = newHandler(&t.buf, format)
+	gMu.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LoggerTest) UnknownFormat() {
+	err := Init("", "xml")
+	ExpectThat(err, Error(HasSubstr("Unknown log format")))
+}
+
+func (t *LoggerTest) Text() {
+	Warningf("taco: %d", 17)
+	ExpectThat(
+		t.buf.String(),
+		MatchesRegexp(`^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} WARNING: taco: 17\n$`))
+}
+
+func (t *LoggerTest) JSON() {
+	t.setFormat(FormatJSON)
+
+	before := time.Now()
+	Errorf("burrito: %q", "enchilada")
+
+	var r jsonRecord
+	err := json.Unmarshal(t.buf.Bytes(), &r)
+	AssertEq(nil, err)
+
+	ExpectEq("ERROR", r.Severity)
+	ExpectEq(`burrito: "enchilada"`, r.Message)
+
+	recordTime, err := time.Parse(time.RFC3339Nano, r.Time)
+	AssertEq(nil, err)
+	ExpectFalse(recordTime.Before(before.Truncate(time.Second)))
+}
+
+func (t *LoggerTest) OneRecordPerLine() {
+	t.setFormat(FormatJSON)
+
+	Infof("foo\nbar")
+	Debugf("baz")
+
+	lines := bytes.Split(bytes.TrimSuffix(t.buf.Bytes(), []byte("\n")), []byte("\n"))
+	AssertEq(2, len(lines))
+
+	var r jsonRecord
+	AssertEq(nil, json.Unmarshal(lines[0], &r))
+	ExpectEq("INFO", r.Severity)
+	ExpectEq("foo\nbar", r.Message)
+
+	AssertEq(nil, json.Unmarshal(lines[1], &r))
+	ExpectEq("DEBUG", r.Severity)
+	ExpectEq("baz", r.Message)
+}
+
+func (t *LoggerTest) MinimumSeverity() {
+	SetSeverity(SeverityWarning)
+
+	Infof("taco")
+	Warningf("burrito")
+	Errorf("enchilada")
+
+	ExpectThat(t.buf.String(), Not(HasSubstr("taco")))
+	ExpectThat(t.buf.String(), HasSubstr("WARNING: burrito\n"))
+	ExpectThat(t.buf.String(), HasSubstr("ERROR: enchilada\n"))
+}
+
+func (t *LoggerTest) ParseSeverity() {
+	sev, err := ParseSeverity("warning")
+	AssertEq(nil, err)
+	ExpectEq(SeverityWarning, sev)
+
+	sev, err = ParseSeverity("debug")
+	AssertEq(nil, err)
+	ExpectEq(SeverityDebug, sev)
+
+	_, err = ParseSeverity("loud")
+	ExpectThat(err, Error(HasSubstr("Unknown log severity")))
+}
+
+func (t *LoggerTest) LegacyLogger() {
+	l := NewLegacyLogger(SeverityDebug, "fuse_debug: ")
+	l.Println("taco")
+
+	ExpectThat(t.buf.String(), HasSubstr("DEBUG: fuse_debug: taco\n"))
+}
+
+func (t *LoggerTest) StandardLogPackage() {
+	log.Printf("taco")
+	ExpectThat(t.buf.String(), HasSubstr("INFO: taco\n"))
+}
+
+func (t *LoggerTest) LogFile() {
+	dir, err := ioutil.TempDir("", "logger_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "foo.log")
+
+	// Write some existing content, which should be preserved.
+	err = ioutil.WriteFile(p, []byte("existing\n"), 0644)
+	AssertEq(nil, err)
+
+	err = Init(p, FormatText)
+	AssertEq(nil, err)
+
+	Infof("taco")
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectThat(string(contents), MatchesRegexp("^existing\n.* INFO: taco\n$"))
+}
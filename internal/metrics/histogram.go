@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Return n bucket upper bounds, starting at start and each factor times the
+// last.
+func ExponentialBuckets(start float64, factor float64, n int) (b []float64) {
+	for i := 0; i < n; i++ {
+		b = append(b, start)
+		start *= factor
+	}
+
+	return
+}
+
+// Default buckets for latencies in seconds: 100 µs up to about 100 s.
+var DefaultLatencyBuckets = ExponentialBuckets(0.0001, 2, 21)
+
+// A family of latency histograms distinguished by the value of a single
+// label, e.g. one histogram per op type. Safe for concurrent access.
+type LatencyHistograms struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	histograms map[string]*histogram
+}
+
+var _ Collector = &LatencyHistograms{}
+
+// Create a family of histograms with the given metric name and help text,
+// distinguished by the named label. buckets must be sorted; an implicit
+// +Inf bucket is added.
+func NewLatencyHistograms(
+	name string,
+	help string,
+	label string,
+	buckets []float64) (h *LatencyHistograms) {
+	h = &LatencyHistograms{
+		name:       name,
+		help:       help,
+		label:      label,
+		buckets:    buckets,
+		histograms: make(map[string]*histogram),
+	}
+
+	return
+}
+
+// Record an observation for the histogram with the given label value.
+func (h *LatencyHistograms) Observe(labelValue string, d time.Duration) {
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.histograms[labelValue]
+	if !ok {
+		hist = &histogram{
+			counts: make([]uint64, len(h.buckets)),
+		}
+
+		h.histograms[labelValue] = hist
+	}
+
+	for i, b := range h.buckets {
+		if seconds <= b {
+			hist.counts[i]++
+		}
+	}
+
+	hist.count++
+	hist.sum += seconds
+}
+
+func (h *LatencyHistograms) WriteMetrics(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	for _, v := range sortedKeys(h.histograms) {
+		hist := h.histograms[v]
+		for i, b := range h.buckets {
+			fmt.Fprintf(
+				w,
+				"%s_bucket{%s=%q,le=%q} %d\n",
+				h.name,
+				h.label,
+				v,
+				formatFloat(b),
+				hist.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, v, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", h.name, h.label, v, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, v, hist.count)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Cumulative counts for a single histogram.
+type histogram struct {
+	counts []uint64 // Observations <= the corresponding bucket bound
+	count  uint64
+	sum    float64
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]*histogram) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return
+}
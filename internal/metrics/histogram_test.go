@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/metrics"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestHistogram(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type HistogramTest struct {
+	h *metrics.LatencyHistograms
+}
+
+var _ SetUpInterface = &HistogramTest{}
+
+func init() { RegisterTestSuite(&HistogramTest{}) }
+
+func (t *HistogramTest) SetUp(ti *TestInfo) {
+	t.h = metrics.NewLatencyHistograms(
+		"some_latency_seconds",
+		"Some help.",
+		"op",
+		[]float64{0.001, 0.01, 0.1})
+}
+
+func (t *HistogramTest) write() string {
+	var buf bytes.Buffer
+	t.h.WriteMetrics(&buf)
+	return buf.String()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *HistogramTest) ExponentialBuckets() {
+	ExpectThat(
+		metrics.ExponentialBuckets(1, 10, 4),
+		ElementsAre(1, 10, 100, 1000))
+}
+
+func (t *HistogramTest) NoObservations() {
+	ExpectEq(
+		"# HELP some_latency_seconds Some help.\n"+
+			"# TYPE some_latency_seconds histogram\n",
+		t.write())
+}
+
+func (t *HistogramTest) CumulativeBuckets() {
+	t.h.Observe("Read", 500*time.Microsecond)
+	t.h.Observe("Read", 5*time.Millisecond)
+	t.h.Observe("Read", time.Second)
+	t.h.Observe("Lookup", 50*time.Millisecond)
+
+	ExpectEq(
+		"# HELP some_latency_seconds Some help.\n"+
+			"# TYPE some_latency_seconds histogram\n"+
+			`some_latency_seconds_bucket{op="Lookup",le="0.001"} 0`+"\n"+
+			`some_latency_seconds_bucket{op="Lookup",le="0.01"} 0`+"\n"+
+			`some_latency_seconds_bucket{op="Lookup",le="0.1"} 1`+"\n"+
+			`some_latency_seconds_bucket{op="Lookup",le="+Inf"} 1`+"\n"+
+			`some_latency_seconds_sum{op="Lookup"} 0.05`+"\n"+
+			`some_latency_seconds_count{op="Lookup"} 1`+"\n"+
+			`some_latency_seconds_bucket{op="Read",le="0.001"} 1`+"\n"+
+			`some_latency_seconds_bucket{op="Read",le="0.01"} 2`+"\n"+
+			`some_latency_seconds_bucket{op="Read",le="0.1"} 2`+"\n"+
+			`some_latency_seconds_bucket{op="Read",le="+Inf"} 3`+"\n"+
+			`some_latency_seconds_sum{op="Read"} 1.0055`+"\n"+
+			`some_latency_seconds_count{op="Read"} 3`+"\n",
+		t.write())
+}
+
+func (t *HistogramTest) Handler() {
+	metrics.DefaultRegistry.Register(t.h)
+	t.h.Observe("Read", time.Millisecond)
+
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+
+	ExpectThat(resp.Header.Get("Content-Type"), HasSubstr("text/plain"))
+	ExpectThat(
+		string(body),
+		HasSubstr(`some_latency_seconds_count{op="Read"} 1`))
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A minimal metrics registry whose contents can be served over HTTP in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Something that can write a set of metrics in the Prometheus text format.
+type Collector interface {
+	WriteMetrics(w io.Writer)
+}
+
+// A set of collectors, written in the order in which they were registered.
+type Registry struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	collectors []Collector
+}
+
+// The registry served by Handler.
+var DefaultRegistry = &Registry{}
+
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+func (r *Registry) WriteMetrics(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.WriteMetrics(w)
+	}
+}
+
+// Return a handler that serves the contents of DefaultRegistry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		DefaultRegistry.WriteMetrics(&buf)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Sources of the buckets on which file systems are mounted.
+//
+// The file system depends only on the gcs.Bucket interface, so any store that
+// can implement it (with generations, preconditions, and delimited listings)
+// can be mounted by supplying a Backend that opens its buckets.
+package storage
+
+import (
+	"sync"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+// A source of buckets, by name. Implementations must be safe for concurrent
+// access.
+type Backend interface {
+	// Return the bucket with the given name, failing early if it can't be
+	// accessed.
+	OpenBucket(
+		ctx context.Context,
+		name string) (b gcs.Bucket, err error)
+}
+
+// Implemented by backends whose credentials can expire or be revoked during a
+// session. Reauthenticate discards any cached credentials, so that the next
+// request obtains fresh ones.
+type Reauthenticator interface {
+	Reauthenticate() (err error)
+}
+
+// A connection to GCS is the usual backend.
+var _ Backend = gcs.Conn(nil)
+
+// Create a backend that keeps buckets in memory, creating each empty the first
+// time it is opened. Opening the same name again returns the same bucket, so
+// its contents last as long as the backend.
+func NewMemoryBackend(clock timeutil.Clock) Backend {
+	return &memoryBackend{
+		clock:   clock,
+		buckets: make(map[string]gcs.Bucket),
+	}
+}
+
+type memoryBackend struct {
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	buckets map[string]gcs.Bucket
+}
+
+// LOCKS_EXCLUDED(mb.mu)
+func (mb *memoryBackend) OpenBucket(
+	ctx context.Context,
+	name string) (b gcs.Bucket, err error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	b, ok := mb.buckets[name]
+	if !ok {
+		b = gcsfake.NewFakeBucket(mb.clock, name)
+		mb.buckets[name] = b
+	}
+
+	return
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestBackend(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MemoryBackendTest struct {
+	ctx     context.Context
+	clock   timeutil.SimulatedClock
+	backend storage.Backend
+}
+
+var _ SetUpInterface = &MemoryBackendTest{}
+
+func init() { RegisterTestSuite(&MemoryBackendTest{}) }
+
+func (t *MemoryBackendTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	t.backend = storage.NewMemoryBackend(&t.clock)
+}
+
+func (t *MemoryBackendTest) open(name string) (b gcs.Bucket) {
+	b, err := t.backend.OpenBucket(t.ctx, name)
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MemoryBackendTest) NewBucketIsEmpty() {
+	b := t.open("foo")
+	ExpectEq("foo", b.Name())
+
+	objects, runs, err := gcsutil.ListAll(t.ctx, b, &gcs.ListObjectsRequest{})
+	AssertEq(nil, err)
+	ExpectEq(0, len(objects))
+	ExpectEq(0, len(runs))
+}
+
+func (t *MemoryBackendTest) ContentsPersistAcrossOpens() {
+	_, err := gcsutil.CreateObject(t.ctx, t.open("foo"), "bar", []byte("taco"))
+	AssertEq(nil, err)
+
+	contents, err := gcsutil.ReadObject(t.ctx, t.open("foo"), "bar")
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *MemoryBackendTest) BucketsAreDistinct() {
+	_, err := gcsutil.CreateObject(t.ctx, t.open("foo"), "bar", []byte("taco"))
+	AssertEq(nil, err)
+
+	_, err = gcsutil.ReadObject(t.ctx, t.open("baz"), "bar")
+	_, ok := err.(*gcs.NotFoundError)
+	ExpectTrue(ok, "err: %v", err)
+}
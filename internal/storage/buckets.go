@@ -0,0 +1,42 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// A bucket as listed by a BucketLister.
+type BucketInfo struct {
+	Name string
+
+	// The bucket's location, e.g. "US-EAST1", and default storage class, e.g.
+	// "STANDARD".
+	Location     string
+	StorageClass string
+
+	Created time.Time
+}
+
+// Implemented by backends that can list the buckets their credentials can see.
+type BucketLister interface {
+	// Return the buckets of the given project, in order of name. GCS lists
+	// buckets one project at a time.
+	ListBuckets(
+		ctx context.Context,
+		project string) (buckets []BucketInfo, err error)
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"golang.org/x/net/context"
+)
+
+// A feed of changes made to the objects in a bucket by any writer, including
+// the file system itself. Implementations must be safe for concurrent access.
+type Changes interface {
+	// Block until there are changes to report or ctx is done, then return them.
+	// A change may be reported late, more than once, or out of order with
+	// respect to others, so it is only a hint to look at the object again.
+	Next(ctx context.Context) (changes []ObjectChange, err error)
+}
+
+// A change to an object.
+type ObjectChange struct {
+	Name string
+
+	// The generation that was created, updated, or deleted, and if known (or
+	// else zero) its metadata generation at the time.
+	Generation     int64
+	Metageneration int64
+
+	// Set if the generation was deleted without being replaced by another.
+	Deleted bool
+}
+
+// Implemented by backends that can report changes to objects. OpenChanges
+// returns the changes to objects in the named bucket delivered to the named
+// subscription, whose form depends on the backend.
+type ChangesBackend interface {
+	OpenChanges(
+		ctx context.Context,
+		bucketName string,
+		subscription string) (c Changes, err error)
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import "golang.org/x/net/context"
+
+// The folders of a bucket with a hierarchical namespace. In such a bucket,
+// directories are resources of their own rather than placeholder objects, and
+// can be renamed along with everything within them in a single atomic
+// operation. Folder names end in a slash, as for placeholder objects.
+// Implementations must be safe for concurrent access.
+type Folders interface {
+	// Return nil if the named folder exists, and *gcs.NotFoundError if not.
+	GetFolder(
+		ctx context.Context,
+		name string) (err error)
+
+	// Create the named folder, along with any missing parents, failing with
+	// *gcs.PreconditionError if it already exists.
+	CreateFolder(
+		ctx context.Context,
+		name string) (err error)
+
+	// Delete the named folder, failing with *gcs.NotFoundError if it doesn't
+	// exist and *gcs.PreconditionError if it isn't empty.
+	DeleteFolder(
+		ctx context.Context,
+		name string) (err error)
+
+	// Rename the folder, and the objects and folders within it, returning once
+	// the rename is complete. Fail with *gcs.NotFoundError if the source doesn't
+	// exist and *gcs.PreconditionError if the destination does.
+	RenameFolder(
+		ctx context.Context,
+		srcName string,
+		dstName string) (err error)
+
+	// List the names of the folders directly within the named one, which may be
+	// "" for the top of the bucket.
+	ListFolders(
+		ctx context.Context,
+		parent string) (names []string, err error)
+}
+
+// Implemented by backends whose buckets may have a hierarchical namespace.
+// OpenFolders returns the folders of the named bucket, or nil if it doesn't
+// have a hierarchical namespace.
+type FolderBackend interface {
+	OpenFolders(
+		ctx context.Context,
+		bucketName string) (f Folders, err error)
+}
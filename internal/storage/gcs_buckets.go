@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Return the buckets of the given GCS project that the credentials of the
+// supplied client, which must add them to requests, allow it to list.
+func ListGCSBuckets(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	project string) (buckets []BucketInfo, err error) {
+	buckets, err = listGCSBuckets(ctx, client, userAgent, gcsEndpoint, project)
+	return
+}
+
+func listGCSBuckets(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	endpoint string,
+	project string) (buckets []BucketInfo, err error) {
+	// No bucket name, to refer to the collection of buckets.
+	a := &jsonAPI{
+		client:    client,
+		userAgent: userAgent,
+		endpoint:  endpoint,
+	}
+
+	query := make(url.Values)
+	query.Set("project", project)
+	query.Set("fields", "items(name,location,storageClass,timeCreated),nextPageToken")
+
+	for {
+		var listing struct {
+			Items []struct {
+				Name         string    `json:"name"`
+				Location     string    `json:"location"`
+				StorageClass string    `json:"storageClass"`
+				TimeCreated  time.Time `json:"timeCreated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		err = a.call(ctx, "GET", "", query, nil, &listing)
+		if err != nil {
+			return
+		}
+
+		for _, item := range listing.Items {
+			buckets = append(buckets, BucketInfo{
+				Name:         item.Name,
+				Location:     item.Location,
+				StorageClass: item.StorageClass,
+				Created:      item.TimeCreated,
+			})
+		}
+
+		if listing.NextPageToken == "" {
+			return
+		}
+
+		query.Set("pageToken", listing.NextPageToken)
+	}
+}
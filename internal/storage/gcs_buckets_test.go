@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestGCSBuckets(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Serves the bucket collection of the project "some-project" in pages of one
+// bucket each, recording the queries made.
+type fakeBucketsServer struct {
+	buckets []string
+	queries []string
+}
+
+func (s *fakeBucketsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.queries = append(s.queries, r.URL.RawQuery)
+
+	q := r.URL.Query()
+	if r.URL.Path != "/storage/v1/b" || q.Get("project") != "some-project" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": 404, "message": "taco"}}`)
+		return
+	}
+
+	var i int
+	fmt.Sscanf(q.Get("pageToken"), "%d", &i)
+	if i >= len(s.buckets) {
+		fmt.Fprint(w, `{}`)
+		return
+	}
+
+	next := ""
+	if i+1 < len(s.buckets) {
+		next = fmt.Sprintf("%d", i+1)
+	}
+
+	fmt.Fprintf(w, `{
+		"items": [{
+			"name": %q,
+			"location": "US-EAST1",
+			"storageClass": "STANDARD",
+			"timeCreated": "2015-04-05T02:15:00Z"
+		}],
+		"nextPageToken": %q
+	}`, s.buckets[i], next)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type GCSBucketsTest struct {
+	ctx    context.Context
+	fake   fakeBucketsServer
+	server *httptest.Server
+}
+
+var _ SetUpInterface = &GCSBucketsTest{}
+var _ TearDownInterface = &GCSBucketsTest{}
+
+func init() { RegisterTestSuite(&GCSBucketsTest{}) }
+
+func (t *GCSBucketsTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(&t.fake)
+}
+
+func (t *GCSBucketsTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *GCSBucketsTest) list(project string) ([]BucketInfo, error) {
+	return listGCSBuckets(
+		t.ctx,
+		http.DefaultClient,
+		"gcsfuse_test",
+		t.server.URL,
+		project)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GCSBucketsTest) NoBuckets() {
+	buckets, err := t.list("some-project")
+	AssertEq(nil, err)
+	ExpectEq(0, len(buckets))
+}
+
+func (t *GCSBucketsTest) SeveralPages() {
+	t.fake.buckets = []string{"bar", "baz", "foo"}
+
+	buckets, err := t.list("some-project")
+	AssertEq(nil, err)
+	AssertEq(3, len(buckets))
+
+	ExpectEq("bar", buckets[0].Name)
+	ExpectEq("baz", buckets[1].Name)
+	ExpectEq("foo", buckets[2].Name)
+
+	ExpectEq("US-EAST1", buckets[0].Location)
+	ExpectEq("STANDARD", buckets[0].StorageClass)
+	ExpectTrue(
+		buckets[0].Created.Equal(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)),
+		"%v",
+		buckets[0].Created)
+
+	AssertEq(3, len(t.fake.queries))
+	ExpectThat(t.fake.queries[0], Not(HasSubstr("pageToken=")))
+	ExpectThat(t.fake.queries[2], HasSubstr("pageToken=2"))
+}
+
+func (t *GCSBucketsTest) UnknownProject() {
+	_, err := t.list("other-project")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,224 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+const pubsubEndpoint = "https://pubsub.googleapis.com"
+
+// The OAuth scope needed to pull messages from a Pub/Sub subscription.
+const PubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+var subscriptionRegexp = regexp.MustCompile(
+	`^projects/[^/]+/subscriptions/[^/]+$`)
+
+// Return the changes to objects in the named GCS bucket that the bucket's
+// Pub/Sub notifications (cf. https://cloud.google.com/storage/docs/pubsub-notifications)
+// deliver to the supplied subscription, which must be of the form
+// projects/PROJECT/subscriptions/SUBSCRIPTION. Notifications are acknowledged
+// as they are received, and those for other buckets are ignored. Requests are
+// made with the supplied client, which must add credentials with PubsubScope
+// to them.
+func NewGCSChanges(
+	client *http.Client,
+	userAgent string,
+	bucketName string,
+	subscription string) (c Changes, err error) {
+	c, err = newGCSChanges(
+		client,
+		userAgent,
+		pubsubEndpoint,
+		bucketName,
+		subscription)
+
+	return
+}
+
+func newGCSChanges(
+	client *http.Client,
+	userAgent string,
+	endpoint string,
+	bucketName string,
+	subscription string) (c Changes, err error) {
+	if !subscriptionRegexp.MatchString(subscription) {
+		err = fmt.Errorf(
+			"Invalid subscription %q; expected "+
+				"projects/PROJECT/subscriptions/SUBSCRIPTION",
+			subscription)
+		return
+	}
+
+	c = &gcsChanges{
+		jsonAPI: jsonAPI{
+			client:     client,
+			userAgent:  userAgent,
+			endpoint:   endpoint,
+			bucketName: bucketName,
+		},
+		subscription: subscription,
+	}
+
+	return
+}
+
+// Object change notifications pulled from Pub/Sub with its REST API.
+type gcsChanges struct {
+	jsonAPI
+	subscription string
+}
+
+// The most messages to ask for in one pull.
+const maxPulledMessages = 1000
+
+func (gc *gcsChanges) Next(
+	ctx context.Context) (changes []ObjectChange, err error) {
+	// Skip batches holding only notifications we don't care about.
+	for len(changes) == 0 {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		// Wait for some messages.
+		var res struct {
+			ReceivedMessages []struct {
+				AckID   string `json:"ackId"`
+				Message struct {
+					Attributes map[string]string `json:"attributes"`
+					Data       string            `json:"data"`
+				} `json:"message"`
+			} `json:"receivedMessages"`
+		}
+
+		err = gc.post(
+			ctx,
+			"pull",
+			map[string]interface{}{"maxMessages": maxPulledMessages},
+			&res)
+
+		if err != nil {
+			err = fmt.Errorf("pull: %v", err)
+			return
+		}
+
+		if len(res.ReceivedMessages) == 0 {
+			continue
+		}
+
+		var ackIDs []string
+		for _, m := range res.ReceivedMessages {
+			ackIDs = append(ackIDs, m.AckID)
+			c, ok := parseNotification(
+				gc.bucketName,
+				m.Message.Attributes,
+				m.Message.Data)
+
+			if ok {
+				changes = append(changes, c)
+			}
+		}
+
+		// Don't have them redelivered. A change that is lost in the meantime just
+		// takes longer to notice, as if there were no notifications.
+		err = gc.post(
+			ctx,
+			"acknowledge",
+			map[string]interface{}{"ackIds": ackIDs},
+			nil)
+
+		if err != nil {
+			err = fmt.Errorf("acknowledge: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Call the subscription method with the supplied name.
+func (gc *gcsChanges) post(
+	ctx context.Context,
+	method string,
+	in interface{},
+	out interface{}) (err error) {
+	u, err := url.Parse(gc.endpoint + "/v1/" + gc.subscription + ":" + method)
+	if err != nil {
+		err = fmt.Errorf("url.Parse: %v", err)
+		return
+	}
+
+	err = gc.do(ctx, "POST", u, in, out)
+	return
+}
+
+// Interpret the attributes and base64-encoded payload of a notification,
+// returning false if it isn't about an object in the named bucket.
+func parseNotification(
+	bucketName string,
+	attrs map[string]string,
+	data string) (c ObjectChange, ok bool) {
+	if attrs["bucketId"] != bucketName || attrs["objectId"] == "" {
+		return
+	}
+
+	generation, err := strconv.ParseInt(attrs["objectGeneration"], 10, 64)
+	if err != nil {
+		return
+	}
+
+	c = ObjectChange{
+		Name:       attrs["objectId"],
+		Generation: generation,
+	}
+
+	// With the JSON_API_V1 payload format, the payload is the object's
+	// metadata. Go without the metadata generation if it's missing.
+	if attrs["payloadFormat"] == "JSON_API_V1" {
+		var o struct {
+			Metageneration int64 `json:"metageneration,string"`
+		}
+
+		if b, err := base64.StdEncoding.DecodeString(data); err == nil {
+			if json.Unmarshal(b, &o) == nil {
+				c.Metageneration = o.Metageneration
+			}
+		}
+	}
+
+	// A generation that is overwritten is reported as deleted, or archived in a
+	// bucket with versioning, and the new one as finalized.
+	switch attrs["eventType"] {
+	case "OBJECT_FINALIZE", "OBJECT_METADATA_UPDATE":
+
+	case "OBJECT_DELETE", "OBJECT_ARCHIVE":
+		_, overwritten := attrs["overwrittenByGeneration"]
+		c.Deleted = !overwritten
+
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
@@ -0,0 +1,284 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestGCSChanges(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+const testSubscription = "projects/some_project/subscriptions/some_sub"
+
+// Serves pulls from the subscription above, responding to each with the next
+// of a list of JSON bodies (and with no messages once they run out), and
+// records the IDs acknowledged.
+type fakePubsubServer struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	pulls []string
+
+	// GUARDED_BY(mu)
+	acked []string
+}
+
+func (s *fakePubsubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method != "POST":
+
+	case r.URL.Path == "/v1/"+testSubscription+":pull":
+		if len(s.pulls) == 0 {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+
+		fmt.Fprint(w, s.pulls[0])
+		s.pulls = s.pulls[1:]
+		return
+
+	case r.URL.Path == "/v1/"+testSubscription+":acknowledge":
+		var req struct {
+			AckIDs []string `json:"ackIds"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			break
+		}
+
+		s.acked = append(s.acked, req.AckIDs...)
+		fmt.Fprint(w, `{}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{"error": {"code": 404, "message": "taco"}}`)
+}
+
+func (s *fakePubsubServer) Acked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.acked...)
+}
+
+// Return the JSON for a received message with the supplied attributes.
+func message(ackID string, attrs map[string]string) string {
+	return messageWithPayload(ackID, attrs, "")
+}
+
+// Return the JSON for a received message with the supplied attributes and
+// payload.
+func messageWithPayload(
+	ackID string,
+	attrs map[string]string,
+	payload string) string {
+	m := map[string]interface{}{
+		"ackId": ackID,
+		"message": map[string]interface{}{
+			"attributes": attrs,
+			"data":       base64.StdEncoding.EncodeToString([]byte(payload)),
+		},
+	}
+
+	b, err := json.Marshal(m)
+	AssertEq(nil, err)
+
+	return string(b)
+}
+
+// Return the attributes of a notification about an object in some_bucket.
+func notification(
+	eventType string,
+	name string,
+	generation string) map[string]string {
+	return map[string]string{
+		"eventType":        eventType,
+		"bucketId":         "some_bucket",
+		"objectId":         name,
+		"objectGeneration": generation,
+		"payloadFormat":    "JSON_API_V1",
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type GCSChangesTest struct {
+	ctx    context.Context
+	fake   fakePubsubServer
+	server *httptest.Server
+	c      Changes
+}
+
+var _ SetUpInterface = &GCSChangesTest{}
+var _ TearDownInterface = &GCSChangesTest{}
+
+func init() { RegisterTestSuite(&GCSChangesTest{}) }
+
+func (t *GCSChangesTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.server = httptest.NewServer(&t.fake)
+
+	var err error
+	t.c, err = newGCSChanges(
+		http.DefaultClient,
+		"gcsfuse_test",
+		t.server.URL,
+		"some_bucket",
+		testSubscription)
+
+	AssertEq(nil, err)
+}
+
+func (t *GCSChangesTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GCSChangesTest) InvalidSubscription() {
+	for _, s := range []string{"", "some_sub", "projects/p/topics/t", "projects/p/subscriptions/s/x"} {
+		_, err := newGCSChanges(
+			http.DefaultClient,
+			"gcsfuse_test",
+			t.server.URL,
+			"some_bucket",
+			s)
+
+		ExpectThat(err, Error(HasSubstr("Invalid subscription")), "s: %q", s)
+	}
+}
+
+func (t *GCSChangesTest) EventTypes() {
+	overwritten := notification("OBJECT_DELETE", "bar", "18")
+	overwritten["overwrittenByGeneration"] = "19"
+
+	t.fake.pulls = []string{fmt.Sprintf(
+		`{"receivedMessages": [%s, %s, %s, %s, %s, %s]}`,
+		message("a", notification("OBJECT_FINALIZE", "foo", "17")),
+		message("b", notification("OBJECT_METADATA_UPDATE", "foo", "17")),
+		message("c", overwritten),
+		message("d", notification("OBJECT_DELETE", "baz/", "20")),
+		message("e", notification("OBJECT_ARCHIVE", "qux", "21")),
+		message("f", notification("SOMETHING_NEW", "foo", "17")),
+	)}
+
+	changes, err := t.c.Next(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(changes, DeepEquals([]ObjectChange{
+		{Name: "foo", Generation: 17},
+		{Name: "foo", Generation: 17},
+		{Name: "bar", Generation: 18},
+		{Name: "baz/", Generation: 20, Deleted: true},
+		{Name: "qux", Generation: 21, Deleted: true},
+	}))
+
+	ExpectThat(t.fake.Acked(), ElementsAre("a", "b", "c", "d", "e", "f"))
+}
+
+func (t *GCSChangesTest) Metageneration() {
+	t.fake.pulls = []string{fmt.Sprintf(
+		`{"receivedMessages": [%s, %s, %s]}`,
+		messageWithPayload(
+			"a",
+			notification("OBJECT_METADATA_UPDATE", "foo", "17"),
+			`{"name": "foo", "generation": "17", "metageneration": "3"}`),
+		messageWithPayload(
+			"b",
+			notification("OBJECT_METADATA_UPDATE", "bar", "18"),
+			`taco`),
+		message("c", notification("OBJECT_FINALIZE", "baz", "19")),
+	)}
+
+	changes, err := t.c.Next(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(changes, DeepEquals([]ObjectChange{
+		{Name: "foo", Generation: 17, Metageneration: 3},
+		{Name: "bar", Generation: 18},
+		{Name: "baz", Generation: 19},
+	}))
+}
+
+func (t *GCSChangesTest) OtherBucketsAndMalformedMessagesSkipped() {
+	other := notification("OBJECT_FINALIZE", "foo", "17")
+	other["bucketId"] = "other_bucket"
+
+	t.fake.pulls = []string{
+		`{}`,
+		fmt.Sprintf(
+			`{"receivedMessages": [%s, %s]}`,
+			message("a", other),
+			message("b", notification("OBJECT_FINALIZE", "foo", "taco"))),
+		fmt.Sprintf(
+			`{"receivedMessages": [%s]}`,
+			message("c", notification("OBJECT_FINALIZE", "bar", "18"))),
+	}
+
+	// Next keeps pulling until it has something to report.
+	changes, err := t.c.Next(t.ctx)
+	AssertEq(nil, err)
+	ExpectThat(changes, DeepEquals([]ObjectChange{{Name: "bar", Generation: 18}}))
+	ExpectThat(t.fake.Acked(), ElementsAre("a", "b", "c"))
+}
+
+func (t *GCSChangesTest) Cancelled() {
+	// With no messages to come, Next waits until it's cancelled.
+	ctx, cancel := context.WithTimeout(t.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	// Depending on when the deadline passes, the error comes from the context
+	// or from the cancelled pull.
+	_, err := t.c.Next(ctx)
+	ExpectThat(
+		err,
+		Error(AnyOf(HasSubstr("deadline exceeded"), HasSubstr("canceled"))))
+}
+
+func (t *GCSChangesTest) PullFails() {
+	var err error
+	t.c, err = newGCSChanges(
+		http.DefaultClient,
+		"gcsfuse_test",
+		t.server.URL,
+		"some_bucket",
+		"projects/some_project/subscriptions/missing")
+
+	AssertEq(nil, err)
+
+	_, err = t.c.Next(t.ctx)
+	ExpectThat(err, Error(HasSubstr("pull")))
+}
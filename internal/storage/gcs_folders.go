@@ -0,0 +1,235 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+)
+
+// Return the folders of the named GCS bucket, or nil if it doesn't have a
+// hierarchical namespace. Requests are made with the supplied client, which
+// must add credentials to them.
+func OpenGCSFolders(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	bucketName string) (f Folders, err error) {
+	f, err = openGCSFolders(ctx, client, userAgent, gcsEndpoint, bucketName)
+	return
+}
+
+func openGCSFolders(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	endpoint string,
+	bucketName string) (f Folders, err error) {
+	typed := &gcsFolders{
+		jsonAPI: jsonAPI{
+			client:     client,
+			userAgent:  userAgent,
+			endpoint:   endpoint,
+			bucketName: bucketName,
+		},
+		pollInterval: 100 * time.Millisecond,
+	}
+
+	// Find out whether the bucket has a hierarchical namespace (cf.
+	// https://cloud.google.com/storage/docs/json_api/v1/buckets/getStorageLayout).
+	var layout struct {
+		HierarchicalNamespace struct {
+			Enabled bool `json:"enabled"`
+		} `json:"hierarchicalNamespace"`
+	}
+
+	err = typed.call(ctx, "GET", "/storageLayout", nil, nil, &layout)
+	if err != nil {
+		err = fmt.Errorf("getStorageLayout: %v", err)
+		return
+	}
+
+	if layout.HierarchicalNamespace.Enabled {
+		f = typed
+	}
+
+	return
+}
+
+// Folders in GCS, managed with the JSON API (cf.
+// https://cloud.google.com/storage/docs/json_api/v1/folders).
+type gcsFolders struct {
+	jsonAPI
+
+	// How often to check whether a rename has completed.
+	pollInterval time.Duration
+}
+
+type gcsFolder struct {
+	Name string `json:"name"`
+}
+
+// A long-running operation, as returned for a rename.
+type gcsOperation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (f *gcsFolders) GetFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.call(
+		ctx,
+		"GET",
+		"/folders/"+httputil.EncodePathSegment(name),
+		nil,
+		nil,
+		nil)
+
+	return
+}
+
+func (f *gcsFolders) CreateFolder(
+	ctx context.Context,
+	name string) (err error) {
+	query := make(url.Values)
+	query.Set("recursive", "true")
+
+	err = f.call(ctx, "POST", "/folders", query, &gcsFolder{Name: name}, nil)
+	return
+}
+
+func (f *gcsFolders) DeleteFolder(
+	ctx context.Context,
+	name string) (err error) {
+	err = f.call(
+		ctx,
+		"DELETE",
+		"/folders/"+httputil.EncodePathSegment(name),
+		nil,
+		nil,
+		nil)
+
+	return
+}
+
+func (f *gcsFolders) RenameFolder(
+	ctx context.Context,
+	srcName string,
+	dstName string) (err error) {
+	// Start the rename.
+	var op gcsOperation
+	err = f.call(
+		ctx,
+		"POST",
+		fmt.Sprintf(
+			"/folders/%s/renameTo/folders/%s",
+			httputil.EncodePathSegment(srcName),
+			httputil.EncodePathSegment(dstName)),
+		nil,
+		nil,
+		&op)
+
+	if err != nil {
+		return
+	}
+
+	// Wait for it to complete. The operation's name ends in its ID.
+	for !op.Done {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+
+		case <-time.After(f.pollInterval):
+		}
+
+		err = f.call(
+			ctx,
+			"GET",
+			"/operations/"+httputil.EncodePathSegment(path.Base(op.Name)),
+			nil,
+			nil,
+			&op)
+
+		if err != nil {
+			err = fmt.Errorf("Polling %s: %v", op.Name, err)
+			return
+		}
+	}
+
+	// Translate failures, whose codes are those of google.rpc.Code.
+	if op.Error != nil {
+		err = fmt.Errorf("%s (code %d)", op.Error.Message, op.Error.Code)
+
+		switch op.Error.Code {
+		case 5: // NOT_FOUND
+			err = &gcs.NotFoundError{Err: err}
+
+		case 6, 9: // ALREADY_EXISTS, FAILED_PRECONDITION
+			err = &gcs.PreconditionError{Err: err}
+		}
+
+		return
+	}
+
+	return
+}
+
+func (f *gcsFolders) ListFolders(
+	ctx context.Context,
+	parent string) (names []string, err error) {
+	query := make(url.Values)
+	query.Set("prefix", parent)
+	query.Set("delimiter", "/")
+
+	for {
+		var listing struct {
+			Items         []gcsFolder `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+
+		err = f.call(ctx, "GET", "/folders", query, nil, &listing)
+		if err != nil {
+			return
+		}
+
+		// Keep only direct children.
+		for _, folder := range listing.Items {
+			rel := strings.TrimSuffix(strings.TrimPrefix(folder.Name, parent), "/")
+			if folder.Name != parent && !strings.Contains(rel, "/") {
+				names = append(names, folder.Name)
+			}
+		}
+
+		if listing.NextPageToken == "" {
+			return
+		}
+
+		query.Set("pageToken", listing.NextPageToken)
+	}
+}
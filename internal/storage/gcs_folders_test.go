@@ -0,0 +1,277 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestGCSFolders(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Serves enough of the JSON API for the bucket "some_bucket" to exercise
+// gcsFolders.
+type fakeFolderServer struct {
+	hns bool
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	folders map[string]bool
+
+	// The number of polls each operation takes to complete, and the operation
+	// to report when it does.
+	//
+	// GUARDED_BY(mu)
+	pending map[string]int
+	results map[string]gcsOperation
+}
+
+func (s *fakeFolderServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	const prefix = "/storage/v1/b/some_bucket"
+	p := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	fail := func(code int) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error": {"code": %d, "message": "taco"}}`, code)
+	}
+
+	switch {
+	case r.Method == "GET" && p == "/storageLayout":
+		fmt.Fprintf(w, `{"hierarchicalNamespace": {"enabled": %v}}`, s.hns)
+
+	case r.Method == "GET" && strings.HasPrefix(p, "/folders/"):
+		if !s.folders[r.URL.Path[len(prefix+"/folders/"):]] {
+			fail(http.StatusNotFound)
+			return
+		}
+
+		reply(gcsFolder{})
+
+	case r.Method == "POST" && p == "/folders":
+		var f gcsFolder
+		json.NewDecoder(r.Body).Decode(&f)
+		if s.folders[f.Name] || r.URL.Query().Get("recursive") != "true" {
+			fail(http.StatusConflict)
+			return
+		}
+
+		s.folders[f.Name] = true
+		reply(f)
+
+	case r.Method == "DELETE" && strings.HasPrefix(p, "/folders/"):
+		name := r.URL.Path[len(prefix+"/folders/"):]
+		if !s.folders[name] {
+			fail(http.StatusNotFound)
+			return
+		}
+
+		delete(s.folders, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && strings.Contains(p, "/renameTo/folders/"):
+		names := strings.SplitN(
+			r.URL.Path[len(prefix+"/folders/"):],
+			"/renameTo/folders/",
+			2)
+
+		op := gcsOperation{Name: "projects/_/buckets/some_bucket/operations/17"}
+		result := op
+		result.Done = true
+		if s.folders[names[1]] {
+			result.Error = &struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}{6, "exists"}
+		} else {
+			delete(s.folders, names[0])
+			s.folders[names[1]] = true
+		}
+
+		s.pending[op.Name] = 2
+		s.results[op.Name] = result
+		reply(op)
+
+	case r.Method == "GET" && p == "/operations/17":
+		name := "projects/_/buckets/some_bucket/operations/17"
+		s.pending[name]--
+		if s.pending[name] > 0 {
+			reply(gcsOperation{Name: name})
+			return
+		}
+
+		reply(s.results[name])
+
+	case r.Method == "GET" && p == "/folders":
+		// Return one folder per page, including those nested deeper.
+		var names []string
+		for n := range s.folders {
+			if strings.HasPrefix(n, r.URL.Query().Get("prefix")) {
+				names = append(names, n)
+			}
+		}
+
+		sort.Strings(names)
+
+		i := 0
+		if tok := r.URL.Query().Get("pageToken"); tok != "" {
+			fmt.Sscan(tok, &i)
+		}
+
+		var listing struct {
+			Items         []gcsFolder `json:"items"`
+			NextPageToken string      `json:"nextPageToken,omitempty"`
+		}
+
+		if i < len(names) {
+			listing.Items = []gcsFolder{{Name: names[i]}}
+			listing.NextPageToken = fmt.Sprint(i + 1)
+		}
+
+		reply(listing)
+
+	default:
+		fail(http.StatusBadRequest)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type GCSFoldersTest struct {
+	ctx     context.Context
+	fake    fakeFolderServer
+	server  *httptest.Server
+	folders Folders
+}
+
+var _ SetUpInterface = &GCSFoldersTest{}
+var _ TearDownInterface = &GCSFoldersTest{}
+
+func init() { RegisterTestSuite(&GCSFoldersTest{}) }
+
+func (t *GCSFoldersTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.fake.hns = true
+	t.fake.folders = map[string]bool{"foo/": true}
+	t.fake.pending = make(map[string]int)
+	t.fake.results = make(map[string]gcsOperation)
+	t.server = httptest.NewServer(&t.fake)
+
+	t.folders = t.open()
+	AssertNe(nil, t.folders)
+	t.folders.(*gcsFolders).pollInterval = 0
+}
+
+func (t *GCSFoldersTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *GCSFoldersTest) open() (f Folders) {
+	f, err := openGCSFolders(
+		t.ctx,
+		http.DefaultClient,
+		"gcsfuse_test",
+		t.server.URL,
+		"some_bucket")
+
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GCSFoldersTest) NoHierarchicalNamespace() {
+	t.fake.hns = false
+	ExpectEq(nil, t.open())
+}
+
+func (t *GCSFoldersTest) GetFolder() {
+	ExpectEq(nil, t.folders.GetFolder(t.ctx, "foo/"))
+
+	err := t.folders.GetFolder(t.ctx, "bar/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *GCSFoldersTest) CreateFolder() {
+	err := t.folders.CreateFolder(t.ctx, "foo/bar/")
+	AssertEq(nil, err)
+	ExpectTrue(t.fake.folders["foo/bar/"])
+
+	err = t.folders.CreateFolder(t.ctx, "foo/bar/")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *GCSFoldersTest) DeleteFolder() {
+	err := t.folders.DeleteFolder(t.ctx, "foo/")
+	AssertEq(nil, err)
+	ExpectFalse(t.fake.folders["foo/"])
+
+	err = t.folders.DeleteFolder(t.ctx, "foo/")
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
+
+func (t *GCSFoldersTest) RenameFolder() {
+	err := t.folders.RenameFolder(t.ctx, "foo/", "bar/baz/")
+	AssertEq(nil, err)
+	ExpectFalse(t.fake.folders["foo/"])
+	ExpectTrue(t.fake.folders["bar/baz/"])
+
+	// The operation was polled until done.
+	ExpectEq(0, t.fake.pending["projects/_/buckets/some_bucket/operations/17"])
+}
+
+func (t *GCSFoldersTest) RenameFolder_DestinationExists() {
+	t.fake.folders["bar/"] = true
+
+	err := t.folders.RenameFolder(t.ctx, "foo/", "bar/")
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+	ExpectThat(err, Error(HasSubstr("exists")))
+}
+
+func (t *GCSFoldersTest) ListFolders() {
+	t.fake.folders["foo/bar/"] = true
+	t.fake.folders["foo/bar/baz/"] = true
+	t.fake.folders["foo/qux/"] = true
+
+	names, err := t.folders.ListFolders(t.ctx, "foo/")
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("foo/bar/", "foo/qux/"))
+
+	names, err = t.folders.ListFolders(t.ctx, "")
+	AssertEq(nil, err)
+	ExpectThat(names, ElementsAre("foo/"))
+}
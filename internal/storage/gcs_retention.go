@@ -0,0 +1,108 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+)
+
+// Return the retention of objects in the named GCS bucket. Requests are made
+// with the supplied client, which must add credentials to them.
+func NewGCSRetention(
+	client *http.Client,
+	userAgent string,
+	bucketName string) (r Retention) {
+	r = newGCSRetention(client, userAgent, gcsEndpoint, bucketName)
+	return
+}
+
+func newGCSRetention(
+	client *http.Client,
+	userAgent string,
+	endpoint string,
+	bucketName string) (r Retention) {
+	r = &gcsRetention{
+		jsonAPI: jsonAPI{
+			client:     client,
+			userAgent:  userAgent,
+			endpoint:   endpoint,
+			bucketName: bucketName,
+		},
+	}
+
+	return
+}
+
+// Object holds and retention in GCS, read from the object resource's fields
+// with the JSON API.
+type gcsRetention struct {
+	jsonAPI
+}
+
+func (gr *gcsRetention) StatRetention(
+	ctx context.Context,
+	name string,
+	generation int64) (r ObjectRetention, err error) {
+	query := make(url.Values)
+	query.Set(
+		"fields",
+		"temporaryHold,eventBasedHold,retentionExpirationTime,retention")
+
+	if generation != 0 {
+		query.Set("generation", strconv.FormatInt(generation, 10))
+	}
+
+	// The bucket's retention policy sets retentionExpirationTime, and object
+	// retention sets retention.retainUntilTime. Either mode of the latter
+	// prevents deletion until the time passes.
+	var res struct {
+		TemporaryHold           bool      `json:"temporaryHold"`
+		EventBasedHold          bool      `json:"eventBasedHold"`
+		RetentionExpirationTime time.Time `json:"retentionExpirationTime"`
+		Retention               struct {
+			RetainUntilTime time.Time `json:"retainUntilTime"`
+		} `json:"retention"`
+	}
+
+	err = gr.call(
+		ctx,
+		"GET",
+		"/o/"+httputil.EncodePathSegment(name),
+		query,
+		nil,
+		&res)
+
+	if err != nil {
+		return
+	}
+
+	r = ObjectRetention{
+		TemporaryHold:  res.TemporaryHold,
+		EventBasedHold: res.EventBasedHold,
+		RetainUntil:    res.RetentionExpirationTime,
+	}
+
+	if res.Retention.RetainUntilTime.After(r.RetainUntil) {
+		r.RetainUntil = res.Retention.RetainUntilTime
+	}
+
+	return
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestGCSRetention(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Serves object resources for the bucket "some_bucket" from a map of object
+// names to JSON bodies, recording the query of the last request.
+type fakeRetentionServer struct {
+	objects   map[string]string
+	lastQuery string
+}
+
+func (s *fakeRetentionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lastQuery = r.URL.RawQuery
+
+	name := strings.TrimPrefix(r.URL.Path, "/storage/v1/b/some_bucket/o/")
+	body, ok := s.objects[name]
+	if r.Method != "GET" || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"code": 404, "message": "taco"}}`)
+		return
+	}
+
+	fmt.Fprint(w, body)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type GCSRetentionTest struct {
+	ctx    context.Context
+	fake   fakeRetentionServer
+	server *httptest.Server
+	r      Retention
+}
+
+var _ SetUpInterface = &GCSRetentionTest{}
+var _ TearDownInterface = &GCSRetentionTest{}
+
+func init() { RegisterTestSuite(&GCSRetentionTest{}) }
+
+func (t *GCSRetentionTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.fake.objects = map[string]string{
+		"plain": `{}`,
+		"held":  `{"temporaryHold": true, "eventBasedHold": true}`,
+		"retained": `{
+			"retentionExpirationTime": "2015-04-05T02:15:00Z",
+			"retention": {"mode": "Unlocked", "retainUntilTime": "2016-04-05T02:15:00Z"}
+		}`,
+	}
+
+	t.server = httptest.NewServer(&t.fake)
+	t.r = newGCSRetention(
+		http.DefaultClient,
+		"gcsfuse_test",
+		t.server.URL,
+		"some_bucket")
+}
+
+func (t *GCSRetentionTest) TearDown() {
+	t.server.Close()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GCSRetentionTest) NotLocked() {
+	r, err := t.r.StatRetention(t.ctx, "plain", 0)
+	AssertEq(nil, err)
+	ExpectFalse(r.Locked(time.Now()))
+	ExpectThat(t.fake.lastQuery, Not(HasSubstr("generation=")))
+}
+
+func (t *GCSRetentionTest) Holds() {
+	r, err := t.r.StatRetention(t.ctx, "held", 17)
+	AssertEq(nil, err)
+	ExpectThat(t.fake.lastQuery, HasSubstr("generation=17"))
+	ExpectTrue(r.TemporaryHold)
+	ExpectTrue(r.EventBasedHold)
+	ExpectTrue(r.Locked(time.Now()))
+	ExpectEq(
+		"under a temporary hold and under an event-based hold",
+		r.Describe(time.Now()))
+}
+
+func (t *GCSRetentionTest) RetainUntil() {
+	r, err := t.r.StatRetention(t.ctx, "retained", 0)
+	AssertEq(nil, err)
+
+	// The later of the two times applies.
+	until := time.Date(2016, 4, 5, 2, 15, 0, 0, time.UTC)
+	ExpectTrue(r.RetainUntil.Equal(until), "%v", r.RetainUntil)
+	ExpectTrue(r.Locked(until.Add(-time.Second)))
+	ExpectFalse(r.Locked(until))
+	ExpectEq(
+		"retained until 2016-04-05T02:15:00Z",
+		r.Describe(until.Add(-time.Second)))
+}
+
+func (t *GCSRetentionTest) NotFound() {
+	_, err := t.r.StatRetention(t.ctx, "missing", 0)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+)
+
+// Return the soft-deleted objects of the named GCS bucket, or nil if it
+// doesn't have a soft delete policy. Requests are made with the supplied
+// client, which must add credentials to them.
+func OpenGCSSoftDeleted(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	bucketName string) (sd SoftDeleted, err error) {
+	sd, err = openGCSSoftDeleted(ctx, client, userAgent, gcsEndpoint, bucketName)
+	return
+}
+
+func openGCSSoftDeleted(
+	ctx context.Context,
+	client *http.Client,
+	userAgent string,
+	endpoint string,
+	bucketName string) (sd SoftDeleted, err error) {
+	typed := &gcsSoftDeleted{
+		jsonAPI: jsonAPI{
+			client:     client,
+			userAgent:  userAgent,
+			endpoint:   endpoint,
+			bucketName: bucketName,
+		},
+	}
+
+	// Find out whether the bucket keeps soft-deleted objects (cf.
+	// https://cloud.google.com/storage/docs/soft-delete). A retention duration
+	// of zero disables soft delete.
+	var bucket struct {
+		SoftDeletePolicy struct {
+			RetentionDurationSeconds int64 `json:"retentionDurationSeconds,string"`
+		} `json:"softDeletePolicy"`
+	}
+
+	query := make(url.Values)
+	query.Set("fields", "softDeletePolicy")
+
+	err = typed.call(ctx, "GET", "", query, nil, &bucket)
+	if err != nil {
+		err = fmt.Errorf("Getting soft delete policy: %v", err)
+		return
+	}
+
+	if bucket.SoftDeletePolicy.RetentionDurationSeconds > 0 {
+		sd = typed
+	}
+
+	return
+}
+
+// Soft-deleted objects in GCS, listed and restored with the JSON API (cf.
+// https://cloud.google.com/storage/docs/json_api/v1/objects/restore).
+type gcsSoftDeleted struct {
+	jsonAPI
+}
+
+// An object resource, with the fields we use.
+type gcsObject struct {
+	Name           string            `json:"name"`
+	ContentType    string            `json:"contentType"`
+	Size           uint64            `json:"size,string"`
+	Generation     int64             `json:"generation,string"`
+	MetaGeneration int64             `json:"metageneration,string"`
+	Updated        time.Time         `json:"updated"`
+	SoftDeleteTime time.Time         `json:"softDeleteTime"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+func (o *gcsObject) toObject() *gcs.Object {
+	return &gcs.Object{
+		Name:           o.Name,
+		ContentType:    o.ContentType,
+		Size:           o.Size,
+		Generation:     o.Generation,
+		MetaGeneration: o.MetaGeneration,
+		Updated:        o.Updated,
+		Deleted:        o.SoftDeleteTime,
+		Metadata:       o.Metadata,
+	}
+}
+
+func (sd *gcsSoftDeleted) ListSoftDeleted(
+	ctx context.Context,
+	req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error) {
+	query := make(url.Values)
+	query.Set("softDeleted", "true")
+	query.Set("prefix", req.Prefix)
+	if req.Delimiter != "" {
+		query.Set("delimiter", req.Delimiter)
+	}
+
+	if req.ContinuationToken != "" {
+		query.Set("pageToken", req.ContinuationToken)
+	}
+
+	if req.MaxResults != 0 {
+		query.Set("maxResults", strconv.Itoa(req.MaxResults))
+	}
+
+	var res struct {
+		Items         []gcsObject `json:"items"`
+		Prefixes      []string    `json:"prefixes"`
+		NextPageToken string      `json:"nextPageToken"`
+	}
+
+	err = sd.call(ctx, "GET", "/o", query, nil, &res)
+	if err != nil {
+		return
+	}
+
+	listing = &gcs.Listing{
+		CollapsedRuns:     res.Prefixes,
+		ContinuationToken: res.NextPageToken,
+	}
+
+	for i := range res.Items {
+		listing.Objects = append(listing.Objects, res.Items[i].toObject())
+	}
+
+	return
+}
+
+func (sd *gcsSoftDeleted) RestoreObject(
+	ctx context.Context,
+	name string,
+	generation int64) (o *gcs.Object, err error) {
+	// Don't replace a live object.
+	query := make(url.Values)
+	query.Set("generation", strconv.FormatInt(generation, 10))
+	query.Set("ifGenerationMatch", "0")
+
+	var res gcsObject
+	err = sd.call(
+		ctx,
+		"POST",
+		"/o/"+httputil.EncodePathSegment(name)+"/restore",
+		query,
+		nil,
+		&res)
+
+	if err != nil {
+		return
+	}
+
+	o = res.toObject()
+	return
+}
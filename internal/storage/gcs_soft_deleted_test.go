@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestGCSSoftDeleted(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Serves enough of the JSON API for the bucket "some_bucket" to exercise
+// gcsSoftDeleted.
+type fakeSoftDeleteServer struct {
+	retention string
+
+	mu sync.Mutex
+
+	// Soft-deleted generations, in listing order, and the names of live objects.
+	//
+	// GUARDED_BY(mu)
+	deleted []gcsObject
+	live    map[string]bool
+
+	// The query of the last listing.
+	//
+	// GUARDED_BY(mu)
+	lastQuery string
+}
+
+func (s *fakeSoftDeleteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	const prefix = "/storage/v1/b/some_bucket"
+	p := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	reply := func(v interface{}) { json.NewEncoder(w).Encode(v) }
+	fail := func(code int) {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error": {"code": %d, "message": "taco"}}`, code)
+	}
+
+	switch {
+	case r.Method == "GET" && p == "":
+		fmt.Fprintf(
+			w,
+			`{"softDeletePolicy": {"retentionDurationSeconds": "%s"}}`,
+			s.retention)
+
+	case r.Method == "GET" && p == "/o":
+		s.lastQuery = r.URL.RawQuery
+		if r.URL.Query().Get("softDeleted") != "true" {
+			fail(http.StatusBadRequest)
+			return
+		}
+
+		var listing struct {
+			Items []gcsObject `json:"items"`
+		}
+
+		for _, o := range s.deleted {
+			if strings.HasPrefix(o.Name, r.URL.Query().Get("prefix")) {
+				listing.Items = append(listing.Items, o)
+			}
+		}
+
+		reply(listing)
+
+	case r.Method == "POST" && strings.HasSuffix(p, "/restore"):
+		name := strings.TrimSuffix(r.URL.Path[len(prefix+"/o/"):], "/restore")
+		gen := r.URL.Query().Get("generation")
+		if s.live[name] && r.URL.Query().Get("ifGenerationMatch") == "0" {
+			fail(http.StatusPreconditionFailed)
+			return
+		}
+
+		for _, o := range s.deleted {
+			if o.Name == name && fmt.Sprint(o.Generation) == gen {
+				s.live[name] = true
+				o.SoftDeleteTime = time.Time{}
+				reply(o)
+				return
+			}
+		}
+
+		fail(http.StatusNotFound)
+
+	default:
+		fail(http.StatusBadRequest)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type GCSSoftDeletedTest struct {
+	ctx    context.Context
+	fake   fakeSoftDeleteServer
+	server *httptest.Server
+	sd     SoftDeleted
+}
+
+var _ SetUpInterface = &GCSSoftDeletedTest{}
+var _ TearDownInterface = &GCSSoftDeletedTest{}
+
+func init() { RegisterTestSuite(&GCSSoftDeletedTest{}) }
+
+func (t *GCSSoftDeletedTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	t.fake.retention = "604800"
+	t.fake.live = make(map[string]bool)
+	t.fake.deleted = []gcsObject{
+		{
+			Name:           "foo/bar",
+			Size:           17,
+			Generation:     1234,
+			MetaGeneration: 1,
+			SoftDeleteTime: time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC),
+		},
+	}
+
+	t.server = httptest.NewServer(&t.fake)
+
+	t.sd = t.open()
+	AssertNe(nil, t.sd)
+}
+
+func (t *GCSSoftDeletedTest) TearDown() {
+	t.server.Close()
+}
+
+func (t *GCSSoftDeletedTest) open() (sd SoftDeleted) {
+	sd, err := openGCSSoftDeleted(
+		t.ctx,
+		http.DefaultClient,
+		"gcsfuse_test",
+		t.server.URL,
+		"some_bucket")
+
+	AssertEq(nil, err)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *GCSSoftDeletedTest) NoSoftDeletePolicy() {
+	t.fake.retention = "0"
+	ExpectEq(nil, t.open())
+}
+
+func (t *GCSSoftDeletedTest) ListSoftDeleted() {
+	listing, err := t.sd.ListSoftDeleted(
+		t.ctx,
+		&gcs.ListObjectsRequest{Prefix: "foo/", Delimiter: "/"})
+
+	AssertEq(nil, err)
+	ExpectThat(t.fake.lastQuery, HasSubstr("delimiter=%2F"))
+	AssertEq(1, len(listing.Objects))
+
+	o := listing.Objects[0]
+	ExpectEq("foo/bar", o.Name)
+	ExpectEq(17, o.Size)
+	ExpectEq(1234, o.Generation)
+	ExpectEq(1, o.MetaGeneration)
+	ExpectTrue(
+		o.Deleted.Equal(time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)),
+		"%v",
+		o.Deleted)
+}
+
+func (t *GCSSoftDeletedTest) RestoreObject() {
+	o, err := t.sd.RestoreObject(t.ctx, "foo/bar", 1234)
+	AssertEq(nil, err)
+	ExpectEq("foo/bar", o.Name)
+	ExpectEq(1234, o.Generation)
+	ExpectTrue(t.fake.live["foo/bar"])
+
+	// A live object isn't replaced.
+	_, err = t.sd.RestoreObject(t.ctx, "foo/bar", 1234)
+	ExpectThat(err, HasSameTypeAs(&gcs.PreconditionError{}))
+}
+
+func (t *GCSSoftDeletedTest) RestoreObject_NotFound() {
+	_, err := t.sd.RestoreObject(t.ctx, "foo/bar", 17)
+	ExpectThat(err, HasSameTypeAs(&gcs.NotFoundError{}))
+}
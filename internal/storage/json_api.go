@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// Makes requests to the GCS JSON API concerning a particular bucket, or
+// buckets in general if bucketName is empty, for the features that gcs.Conn
+// doesn't cover.
+type jsonAPI struct {
+	client     *http.Client
+	userAgent  string
+	endpoint   string
+	bucketName string
+}
+
+// Make a request to the supplied path within the bucket's URL, sending in (if
+// non-nil) as the JSON body and decoding the JSON response into out (if
+// non-nil). Translate errors for missing and conflicting resources into
+// *gcs.NotFoundError and *gcs.PreconditionError.
+func (a *jsonAPI) call(
+	ctx context.Context,
+	method string,
+	p string,
+	query url.Values,
+	in interface{},
+	out interface{}) (err error) {
+	resource := a.endpoint + "/storage/v1/b"
+	if a.bucketName != "" {
+		resource += "/" + httputil.EncodePathSegment(a.bucketName)
+	}
+
+	u, err := url.Parse(resource + p)
+
+	if err != nil {
+		err = fmt.Errorf("url.Parse: %v", err)
+		return
+	}
+
+	u.RawQuery = query.Encode()
+	err = a.do(ctx, method, u, in, out)
+	return
+}
+
+// Like call, but make the request to the supplied URL, which needn't belong
+// to GCS.
+func (a *jsonAPI) do(
+	ctx context.Context,
+	method string,
+	u *url.URL,
+	in interface{},
+	out interface{}) (err error) {
+	var body io.ReadCloser
+	var bodyLength int64
+	if in != nil {
+		var buf []byte
+		buf, err = json.Marshal(in)
+		if err != nil {
+			err = fmt.Errorf("json.Marshal: %v", err)
+			return
+		}
+
+		body = ioutil.NopCloser(bytes.NewReader(buf))
+		bodyLength = int64(len(buf))
+	}
+
+	req, err := httputil.NewRequest(ctx, method, u, body, bodyLength, a.userAgent)
+	if err != nil {
+		err = fmt.Errorf("httputil.NewRequest: %v", err)
+		return
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer googleapi.CloseBody(res)
+
+	if err = googleapi.CheckResponse(res); err != nil {
+		if typed, ok := err.(*googleapi.Error); ok {
+			switch typed.Code {
+			case http.StatusNotFound:
+				err = &gcs.NotFoundError{Err: typed}
+
+			case http.StatusConflict, http.StatusPreconditionFailed:
+				err = &gcs.PreconditionError{Err: typed}
+			}
+		}
+
+		return
+	}
+
+	if out != nil {
+		err = json.NewDecoder(res.Body).Decode(out)
+		if err != nil {
+			err = fmt.Errorf("Decoding response: %v", err)
+			return
+		}
+	}
+
+	return
+}
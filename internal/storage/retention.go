@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Reports the holds and retention that stop objects in a bucket from being
+// overwritten or deleted, which gcs.Object doesn't include. Implementations
+// must be safe for concurrent access.
+type Retention interface {
+	// Return the holds and retention of the given generation of the named
+	// object, or of the live generation if generation is zero. Fail with
+	// *gcs.NotFoundError if there is no such object.
+	StatRetention(
+		ctx context.Context,
+		name string,
+		generation int64) (r ObjectRetention, err error)
+}
+
+// The holds and retention of an object (cf.
+// https://cloud.google.com/storage/docs/object-holds and
+// https://cloud.google.com/storage/docs/object-lock).
+type ObjectRetention struct {
+	TemporaryHold  bool
+	EventBasedHold bool
+
+	// The time until which the object must be retained, either by the bucket's
+	// retention policy or its own retention configuration, or the zero time if
+	// neither applies.
+	RetainUntil time.Time
+}
+
+// Is the object protected from being overwritten or deleted at the given time?
+func (r *ObjectRetention) Locked(now time.Time) bool {
+	return r.TemporaryHold || r.EventBasedHold || now.Before(r.RetainUntil)
+}
+
+// Describe what protects the object at the given time, for use in log
+// messages, e.g. "under a temporary hold".
+func (r *ObjectRetention) Describe(now time.Time) string {
+	var reasons []string
+	if r.TemporaryHold {
+		reasons = append(reasons, "under a temporary hold")
+	}
+
+	if r.EventBasedHold {
+		reasons = append(reasons, "under an event-based hold")
+	}
+
+	if now.Before(r.RetainUntil) {
+		reasons = append(
+			reasons,
+			fmt.Sprintf("retained until %s", r.RetainUntil.Format(time.RFC3339)))
+	}
+
+	return strings.Join(reasons, " and ")
+}
+
+// Implemented by backends whose objects may be held or retained.
+// OpenRetention returns the retention of objects in the named bucket.
+type RetentionBackend interface {
+	OpenRetention(
+		ctx context.Context,
+		bucketName string) (r Retention, err error)
+}
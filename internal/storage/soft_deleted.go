@@ -0,0 +1,51 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The soft-deleted objects of a bucket with a soft delete policy, which GCS
+// keeps for the policy's retention duration after they are deleted or
+// replaced, and from which they can be restored. Several generations of an
+// object may be soft-deleted at once. Implementations must be safe for
+// concurrent access.
+type SoftDeleted interface {
+	// List soft-deleted objects as gcs.Bucket.ListObjects lists live ones. The
+	// Deleted field of each object is the time at which it was soft-deleted.
+	ListSoftDeleted(
+		ctx context.Context,
+		req *gcs.ListObjectsRequest) (listing *gcs.Listing, err error)
+
+	// Restore the given generation of the named soft-deleted object, making it
+	// live again under its own name. Fail with *gcs.NotFoundError if there is no
+	// such soft-deleted generation, and *gcs.PreconditionError if there is
+	// already a live object with the name.
+	RestoreObject(
+		ctx context.Context,
+		name string,
+		generation int64) (o *gcs.Object, err error)
+}
+
+// Implemented by backends whose buckets may have a soft delete policy.
+// OpenSoftDeleted returns the soft-deleted objects of the named bucket, or nil
+// if it doesn't have a soft delete policy.
+type SoftDeleteBackend interface {
+	OpenSoftDeleted(
+		ctx context.Context,
+		bucketName string) (sd SoftDeleted, err error)
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// An exporter that sends spans in batches to an OpenTelemetry collector,
+// using the OTLP/HTTP protocol with JSON encoding. Spans that arrive while the
+// buffer is full are dropped rather than blocking the caller.
+type OTLPExporter struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	client *http.Client
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	endpoint    string
+	serviceName string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	spans chan *Span
+
+	// Closed by Shutdown; closed by the export loop once it has drained spans.
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var _ Exporter = &OTLPExporter{}
+
+const (
+	otlpBufferSize    = 4096
+	otlpMaxBatchSize  = 512
+	otlpFlushInterval = 5 * time.Second
+)
+
+// Create an exporter that posts to the supplied URL, e.g.
+// "http://localhost:4318/v1/traces". Spans are tagged with the given service
+// name. The caller must arrange for Shutdown to be called.
+func NewOTLPExporter(
+	endpoint string,
+	serviceName string) (e *OTLPExporter) {
+	e = &OTLPExporter{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		spans:       make(chan *Span, otlpBufferSize),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	go e.exportLoop()
+	return
+}
+
+func (e *OTLPExporter) ExportSpan(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+// Flush any buffered spans and stop exporting. Spans exported after this
+// method is called are discarded.
+func (e *OTLPExporter) Shutdown() {
+	close(e.stop)
+	<-e.stopped
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (e *OTLPExporter) exportLoop() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		err := e.post(batch)
+		if err != nil {
+			logger.Warningf("Error exporting %d spans: %v", len(batch), err)
+		}
+
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= otlpMaxBatchSize {
+				flush()
+			}
+
+		case <-ticker.C:
+			flush()
+
+		case <-e.stop:
+			// Drain whatever is already buffered.
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+
+			flush()
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) post(spans []*Span) (err error) {
+	body, err := json.Marshal(e.makeRequest(spans))
+	if err != nil {
+		err = fmt.Errorf("json.Marshal: %v", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		err = fmt.Errorf("Post: %v", err)
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("Unexpected HTTP status: %s", resp.Status)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// OTLP JSON encoding
+////////////////////////////////////////////////////////////////////////
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+func makeOTLPValue(v interface{}) (ov otlpValue) {
+	switch typed := v.(type) {
+	case int64:
+		s := strconv.FormatInt(typed, 10)
+		ov.IntValue = &s
+
+	case bool:
+		ov.BoolValue = &typed
+
+	default:
+		s := fmt.Sprint(v)
+		ov.StringValue = &s
+	}
+
+	return
+}
+
+func (e *OTLPExporter) makeRequest(spans []*Span) (req otlpRequest) {
+	var ss otlpScopeSpans
+	ss.Scope.Name = "gcsfuse"
+
+	var zeroParent [8]byte
+	for _, s := range spans {
+		os := otlpSpan{
+			TraceID:           hex.EncodeToString(s.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.SpanID[:]),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+
+		if s.ParentID != zeroParent {
+			os.ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+
+		for _, a := range s.Attributes() {
+			os.Attributes = append(
+				os.Attributes,
+				otlpKeyValue{Key: a.Key, Value: makeOTLPValue(a.Value)})
+		}
+
+		if s.Err != nil {
+			os.Status = otlpStatus{
+				Code:    otlpStatusError,
+				Message: s.Err.Error(),
+			}
+		}
+
+		ss.Spans = append(ss.Spans, os)
+	}
+
+	rs := otlpResourceSpans{
+		Resource: otlpResource{
+			Attributes: []otlpKeyValue{
+				{Key: "service.name", Value: makeOTLPValue(e.serviceName)},
+			},
+		},
+		ScopeSpans: []otlpScopeSpans{ss},
+	}
+
+	req.ResourceSpans = []otlpResourceSpans{rs}
+	return
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Lightweight distributed tracing, following the OpenTelemetry data model.
+//
+// Spans are carried in contexts. Nothing is recorded unless an exporter has
+// been installed with SetExporter, in which case StartSpan creates a root span
+// if the context doesn't already carry one, or a child span otherwise.
+package tracing
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The kind of a span, with values matching the OpenTelemetry SpanKind enum.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// A destination for finished spans.
+type Exporter interface {
+	// Export a span that has finished. Must not block for long.
+	ExportSpan(s *Span)
+}
+
+var (
+	gExporterMu sync.RWMutex
+	gExporter   Exporter
+)
+
+// Set the exporter to which finished spans are sent, or nil to disable
+// tracing.
+func SetExporter(e Exporter) {
+	gExporterMu.Lock()
+	gExporter = e
+	gExporterMu.Unlock()
+}
+
+// Is an exporter installed?
+func Enabled() bool {
+	return exporter() != nil
+}
+
+func exporter() (e Exporter) {
+	gExporterMu.RLock()
+	e = gExporter
+	gExporterMu.RUnlock()
+
+	return
+}
+
+// A single timed operation within a trace. A nil *Span is valid and ignores
+// all method calls, so that callers need not check whether tracing is
+// enabled.
+type Span struct {
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	exporter Exporter
+
+	TraceID   [16]byte
+	SpanID    [8]byte
+	ParentID  [8]byte // Zero for root spans
+	Name      string
+	Kind      SpanKind
+	StartTime time.Time
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	attributes []Attribute
+
+	// Set by End.
+	//
+	// GUARDED_BY(mu)
+	ended   bool
+	EndTime time.Time
+	Err     error
+}
+
+// A key/value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{} // string, int64, or bool
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// Return the span carried by the context, or nil if none.
+func FromContext(ctx context.Context) (s *Span) {
+	s, _ = ctx.Value(spanKey).(*Span)
+	return
+}
+
+// Return a context derived from parent that carries the supplied span. This
+// can be used to continue a trace in a context that is not derived from the
+// one in which the span was started.
+func NewContext(parent context.Context, s *Span) context.Context {
+	if s == nil {
+		return parent
+	}
+
+	return context.WithValue(parent, spanKey, s)
+}
+
+// Start a span with the given name, as a child of the span in the supplied
+// context if any. The returned context carries the new span. The caller must
+// arrange for End to be called.
+//
+// If tracing is disabled, return the context unmodified and a nil span.
+func StartSpan(
+	parent context.Context,
+	name string,
+	kind SpanKind) (ctx context.Context, s *Span) {
+	ctx = parent
+
+	e := exporter()
+	if e == nil {
+		return
+	}
+
+	s = &Span{
+		exporter:  e,
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+	}
+
+	if p := FromContext(parent); p != nil {
+		s.TraceID = p.TraceID
+		s.ParentID = p.SpanID
+	} else {
+		randomBytes(s.TraceID[:])
+	}
+
+	randomBytes(s.SpanID[:])
+
+	ctx = NewContext(parent, s)
+	return
+}
+
+// Start a span only if the context already carries one, i.e. only ever as a
+// child. This is appropriate for operations that are interesting only in the
+// context of some larger operation.
+func StartChildSpan(
+	parent context.Context,
+	name string,
+	kind SpanKind) (ctx context.Context, s *Span) {
+	if FromContext(parent) == nil {
+		ctx = parent
+		return
+	}
+
+	ctx, s = StartSpan(parent, name, kind)
+	return
+}
+
+// Attach an attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	switch value.(type) {
+	case string, int64, bool:
+	case int:
+		value = int64(value.(int))
+	default:
+		value = fmt.Sprint(value)
+	}
+
+	s.mu.Lock()
+	s.attributes = append(s.attributes, Attribute{key, value})
+	s.mu.Unlock()
+}
+
+// Return a copy of the attributes attached to the span so far.
+func (s *Span) Attributes() (attrs []Attribute) {
+	s.mu.Lock()
+	attrs = append(attrs, s.attributes...)
+	s.mu.Unlock()
+
+	return
+}
+
+// Finish the span, recording the supplied error (which may be nil) as its
+// outcome, and hand it to the exporter. Calls after the first are ignored.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.EndTime = time.Now()
+	s.Err = err
+	s.mu.Unlock()
+
+	s.exporter.ExportSpan(s)
+}
+
+func randomBytes(b []byte) {
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(fmt.Sprintf("rand.Read: %v", err))
+	}
+}
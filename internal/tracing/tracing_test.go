@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestTracing(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Recording exporter
+////////////////////////////////////////////////////////////////////////
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *recordingExporter) ExportSpan(s *Span) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	e.mu.Unlock()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type TracingTest struct {
+	ctx      context.Context
+	exporter recordingExporter
+}
+
+var _ SetUpInterface = &TracingTest{}
+var _ TearDownInterface = &TracingTest{}
+
+func init() { RegisterTestSuite(&TracingTest{}) }
+
+func (t *TracingTest) SetUp(ti *TestInfo) {
+	t.ctx = ti.Ctx
+	SetExporter(&t.exporter)
+}
+
+func (t *TracingTest) TearDown() {
+	SetExporter(nil)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *TracingTest) Disabled() {
+	SetExporter(nil)
+	ExpectFalse(Enabled())
+
+	ctx, span := StartSpan(t.ctx, "foo", SpanKindServer)
+	ExpectTrue(ctx == t.ctx)
+	ExpectEq(nil, span)
+
+	// Methods on a nil span should be harmless.
+	span.SetAttribute("taco", "burrito")
+	span.End(nil)
+}
+
+func (t *TracingTest) ParentAndChild() {
+	ctx, parent := StartSpan(t.ctx, "parent", SpanKindServer)
+	AssertNe(nil, parent)
+	ExpectEq(parent, FromContext(ctx))
+
+	_, child := StartSpan(ctx, "child", SpanKindClient)
+	AssertNe(nil, child)
+
+	ExpectEq(parent.TraceID, child.TraceID)
+	ExpectEq(parent.SpanID, child.ParentID)
+	ExpectNe(parent.SpanID, child.SpanID)
+	ExpectEq([8]byte{}, parent.ParentID)
+
+	child.End(nil)
+	parent.End(errors.New("taco"))
+
+	AssertEq(2, len(t.exporter.spans))
+	ExpectEq("child", t.exporter.spans[0].Name)
+	ExpectEq("parent", t.exporter.spans[1].Name)
+	ExpectThat(parent.Err, Error(Equals("taco")))
+}
+
+func (t *TracingTest) ChildSpanRequiresParent() {
+	_, span := StartChildSpan(t.ctx, "orphan", SpanKindClient)
+	ExpectEq(nil, span)
+
+	ctx, parent := StartSpan(t.ctx, "parent", SpanKindServer)
+	_, span = StartChildSpan(ctx, "child", SpanKindClient)
+	AssertNe(nil, span)
+	ExpectEq(parent.SpanID, span.ParentID)
+}
+
+func (t *TracingTest) EndIsIdempotent() {
+	_, span := StartSpan(t.ctx, "foo", SpanKindServer)
+	span.End(nil)
+	span.End(errors.New("taco"))
+
+	ExpectEq(1, len(t.exporter.spans))
+	ExpectEq(nil, span.Err)
+}
+
+func (t *TracingTest) AttributeTypes() {
+	_, span := StartSpan(t.ctx, "foo", SpanKindServer)
+	span.SetAttribute("s", "taco")
+	span.SetAttribute("i", 17)
+	span.SetAttribute("b", true)
+	span.SetAttribute("u", uint32(19))
+
+	attrs := span.Attributes()
+	AssertEq(4, len(attrs))
+	ExpectEq("taco", attrs[0].Value)
+	ExpectEq(int64(17), attrs[1].Value)
+	ExpectEq(true, attrs[2].Value)
+	ExpectEq("19", attrs[3].Value)
+}
+
+func (t *TracingTest) OTLPExport() {
+	// Set up a server that records requests.
+	var mu sync.Mutex
+	var requests []map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			err := json.NewDecoder(r.Body).Decode(&body)
+			AssertEq(nil, err)
+
+			mu.Lock()
+			requests = append(requests, body)
+			mu.Unlock()
+		}))
+
+	defer server.Close()
+
+	// Export a span with an error, then shut down to flush.
+	e := NewOTLPExporter(server.URL, "some_service")
+	SetExporter(e)
+
+	_, span := StartSpan(t.ctx, "foo", SpanKindServer)
+	span.SetAttribute("fuse.inode", 17)
+	span.End(errors.New("taco"))
+
+	e.Shutdown()
+
+	// Check the request.
+	AssertEq(1, len(requests))
+
+	encoded, err := json.Marshal(requests[0])
+	AssertEq(nil, err)
+
+	ExpectThat(string(encoded), HasSubstr(`"stringValue":"some_service"`))
+	ExpectThat(string(encoded), HasSubstr(`"name":"foo"`))
+	ExpectThat(string(encoded), HasSubstr(`"intValue":"17"`))
+	ExpectThat(string(encoded), HasSubstr(`"message":"taco"`))
+	ExpectThat(string(encoded), HasSubstr(`"kind":2`))
+}
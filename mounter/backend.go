@@ -0,0 +1,402 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/httputil"
+	"github.com/jacobsa/timeutil"
+)
+
+// Create token source from the JSON file at the supplide path.
+func newTokenSourceFromPath(
+	path string,
+	scopes []string) (ts oauth2.TokenSource, err error) {
+	// Read the file.
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile(%q): %v", path, err)
+		return
+	}
+
+	// Create a config struct based on its contents.
+	jwtConfig, err := google.JWTConfigFromJSON(contents, scopes...)
+	if err != nil {
+		err = fmt.Errorf("JWTConfigFromJSON: %v", err)
+		return
+	}
+
+	// Create the token source.
+	ts = jwtConfig.TokenSource(context.Background())
+
+	return
+}
+
+// Create a token source that fetches tokens for the default service account
+// from the metadata server, as on GCE or in a GKE pod using Workload Identity.
+// The tokens are cached and replaced with fresh ones as they expire.
+func newMetadataTokenSource(
+	scopes []string) (ts oauth2.TokenSource, err error) {
+	// Tokens from the metadata server carry the scopes of the instance, which we
+	// can't widen. Refuse to go on if they won't do.
+	have, scopesErr := metadata.Scopes("")
+	if scopesErr != nil {
+		logger.Infof(
+			"Couldn't find the scopes of metadata server tokens: %v",
+			scopesErr)
+	} else {
+		for _, scope := range scopes {
+			if !scopesSatisfy(have, scope) {
+				err = fmt.Errorf(
+					"The metadata server's tokens have scopes %q, but this mount "+
+						"needs %q or broader. Give the instance or node pool that "+
+						"scope, or use --key-file",
+					have,
+					scope)
+				return
+			}
+		}
+	}
+
+	ts = google.ComputeTokenSource("")
+	return
+}
+
+// Choose where to get credentials from: the key file if one is given, then
+// the file named by the application default credentials environment variable,
+// then the metadata server if there is one, then the rest of the application
+// default credentials (such as those of the gcloud tool).
+func newTokenSource(
+	keyFile string,
+	scopes []string) (ts oauth2.TokenSource, err error) {
+	switch {
+	case keyFile != "":
+		ts, err = newTokenSourceFromPath(keyFile, scopes)
+		if err != nil {
+			err = fmt.Errorf("newTokenSourceFromPath: %v", err)
+			return
+		}
+
+	case os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" && metadata.OnGCE():
+		logger.Infof("Using credentials from the metadata server.")
+		ts, err = newMetadataTokenSource(scopes)
+		if err != nil {
+			err = fmt.Errorf("newMetadataTokenSource: %v", err)
+			return
+		}
+
+	default:
+		ts, err = google.DefaultTokenSource(context.Background(), scopes...)
+		if err != nil {
+			err = fmt.Errorf("DefaultTokenSource: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// A token source that can be replaced with a newly created one, discarding any
+// token that the old one cached. Safe for concurrent access.
+type renewableTokenSource struct {
+	create func() (oauth2.TokenSource, error)
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	ts oauth2.TokenSource
+}
+
+func newRenewableTokenSource(
+	create func() (oauth2.TokenSource, error)) (
+	r *renewableTokenSource, err error) {
+	r = &renewableTokenSource{create: create}
+	r.ts, err = create()
+	return
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *renewableTokenSource) Token() (*oauth2.Token, error) {
+	r.mu.Lock()
+	ts := r.ts
+	r.mu.Unlock()
+
+	return ts.Token()
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *renewableTokenSource) Renew() (err error) {
+	ts, err := r.create()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.ts = ts
+	r.mu.Unlock()
+
+	return
+}
+
+// A connection to GCS that can obtain fresh credentials when GCS refuses the
+// ones it has, and open the folders of buckets with a hierarchical namespace.
+type gcsBackend struct {
+	gcs.Conn
+	tokens *renewableTokenSource
+
+	// Makes authenticated requests for the folders, soft delete and retention
+	// APIs, which gcs.Conn doesn't cover.
+	client    *http.Client
+	userAgent string
+}
+
+var _ storage.Reauthenticator = &gcsBackend{}
+var _ storage.FolderBackend = &gcsBackend{}
+var _ storage.SoftDeleteBackend = &gcsBackend{}
+var _ storage.RetentionBackend = &gcsBackend{}
+var _ storage.BucketLister = &gcsBackend{}
+
+func (b *gcsBackend) Reauthenticate() (err error) {
+	err = b.tokens.Renew()
+	return
+}
+
+func (b *gcsBackend) OpenFolders(
+	ctx context.Context,
+	bucketName string) (f storage.Folders, err error) {
+	f, err = storage.OpenGCSFolders(ctx, b.client, b.userAgent, bucketName)
+	return
+}
+
+func (b *gcsBackend) OpenSoftDeleted(
+	ctx context.Context,
+	bucketName string) (sd storage.SoftDeleted, err error) {
+	sd, err = storage.OpenGCSSoftDeleted(ctx, b.client, b.userAgent, bucketName)
+	return
+}
+
+func (b *gcsBackend) OpenRetention(
+	ctx context.Context,
+	bucketName string) (r storage.Retention, err error) {
+	r = storage.NewGCSRetention(b.client, b.userAgent, bucketName)
+	return
+}
+
+func (b *gcsBackend) OpenChanges(
+	ctx context.Context,
+	bucketName string,
+	subscription string) (c storage.Changes, err error) {
+	c, err = storage.NewGCSChanges(b.client, b.userAgent, bucketName, subscription)
+	return
+}
+
+func (b *gcsBackend) ListBuckets(
+	ctx context.Context,
+	project string) (buckets []storage.BucketInfo, err error) {
+	buckets, err = storage.ListGCSBuckets(ctx, b.client, b.userAgent, project)
+	return
+}
+
+// Trust the CA certificates in the PEM file at the given path, as well as the
+// system's, for TLS connections made with the default HTTP transport. That
+// covers both requests to GCS and those that fetch tokens, which the oauth2
+// package makes with the default client. The default transport also takes
+// proxies from HTTPS_PROXY and NO_PROXY.
+func trustCACerts(path string) (err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("ReadFile(%q): %v", path, err)
+		return
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		err = fmt.Errorf("SystemCertPool: %v", err)
+		return
+	}
+
+	if !pool.AppendCertsFromPEM(contents) {
+		err = fmt.Errorf("No PEM certificates found in %q", path)
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+
+	transport.TLSClientConfig.RootCAs = pool
+	return
+}
+
+// Log the proxy, if any, that requests to GCS will go through, to help with
+// debugging connection problems.
+func logProxy() {
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/", nil)
+	if err != nil {
+		return
+	}
+
+	proxy, err := http.ProxyFromEnvironment(req)
+	switch {
+	case err != nil:
+		logger.Errorf("Invalid proxy configuration: %v", err)
+
+	case proxy != nil:
+		logger.Infof("Connecting to GCS through proxy %s.", proxy.Redacted())
+	}
+}
+
+func getConn(flags *flagStorage) (b storage.Backend, err error) {
+	// Set up TLS and proxies.
+	if flags.CACert != "" {
+		err = trustCACerts(flags.CACert)
+		if err != nil {
+			err = fmt.Errorf("trustCACerts: %v", err)
+			return
+		}
+	}
+
+	logProxy()
+
+	// Create the oauth2 token source.
+	scopes := chooseScopes(flags)
+
+	tokenSrc, err := newRenewableTokenSource(
+		func() (oauth2.TokenSource, error) {
+			return newTokenSource(flags.KeyFile, scopes)
+		})
+
+	if err != nil {
+		err = fmt.Errorf("newTokenSource: %v", err)
+		return
+	}
+
+	// Create the connection.
+	const userAgent = "gcsfuse/0.0"
+	cfg := &gcs.ConnConfig{
+		TokenSource: tokenSrc,
+		UserAgent:   userAgent,
+	}
+
+	// Add any custom headers to each request.
+	if len(flags.RequestHeaders) > 0 {
+		var header http.Header
+		header, err = parseRequestHeaders(flags.RequestHeaders)
+		if err != nil {
+			err = fmt.Errorf("parseRequestHeaders: %v", err)
+			return
+		}
+
+		cfg.Transport = &headerTransport{
+			header:  header,
+			wrapped: http.DefaultTransport.(httputil.CancellableRoundTripper),
+		}
+	}
+
+	if flags.DebugHTTP {
+		cfg.HTTPDebugLogger = logger.NewLegacyLogger(logger.SeverityDebug, "http: ")
+	}
+
+	if flags.DebugGCS {
+		cfg.GCSDebugLogger = logger.NewLegacyLogger(logger.SeverityDebug, "gcs: ")
+	}
+
+	conn, err := gcs.NewConn(cfg)
+	if err != nil {
+		return
+	}
+
+	// Make requests outside of the connection in the same way.
+	var transport http.RoundTripper
+	if cfg.Transport != nil {
+		transport = cfg.Transport
+	}
+
+	b = &gcsBackend{
+		Conn:   conn,
+		tokens: tokenSrc,
+		client: &http.Client{
+			Transport: &oauth2.Transport{
+				Source: tokenSrc,
+				Base:   transport,
+			},
+		},
+		userAgent: userAgent,
+	}
+
+	return
+}
+
+// Return the backend requested by the supplied flags.
+func chooseBackend(
+	flags *flagStorage,
+	mountStatus *log.Logger) (b storage.Backend, err error) {
+	switch flags.Backend {
+	case "gcs":
+		mountStatus.Println("Opening GCS connection...")
+
+		b, err = getConn(flags)
+		if err != nil {
+			err = fmt.Errorf("getConn: %v", err)
+			return
+		}
+
+	case "memory":
+		b = storage.NewMemoryBackend(timeutil.RealClock())
+
+	default:
+		err = fmt.Errorf("Unknown backend: %q", flags.Backend)
+		return
+	}
+
+	return
+}
+
+// Return the backend from which to open the named bucket, or nil if it is the
+// fake bucket, which doesn't need one.
+func chooseBackendForBucket(
+	bucketName string,
+	flags *flagStorage,
+	mountStatus *log.Logger) (b storage.Backend, err error) {
+	if bucketName == canned.FakeBucketName {
+		return
+	}
+
+	b, err = chooseBackend(flags, mountStatus)
+	if err != nil {
+		err = fmt.Errorf("chooseBackend: %v", err)
+		return
+	}
+
+	return
+}
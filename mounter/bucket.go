@@ -0,0 +1,462 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/canned"
+	"github.com/googlecloudplatform/gcsfuse/internal/clock"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+	"github.com/jacobsa/ratelimit"
+	"github.com/jacobsa/timeutil"
+)
+
+func setUpRateLimiting(
+	in gcs.Bucket,
+	opRateLimitHz float64,
+	egressBandwidthLimit float64) (out gcs.Bucket, err error) {
+	// If no rate limiting has been requested, just return the bucket.
+	if !(opRateLimitHz > 0 || egressBandwidthLimit > 0) {
+		out = in
+		return
+	}
+
+	// Treat a disabled limit as a very large one.
+	if !(opRateLimitHz > 0) {
+		opRateLimitHz = 1e15
+	}
+
+	if !(egressBandwidthLimit > 0) {
+		egressBandwidthLimit = 1e15
+	}
+
+	// Choose token bucket capacities, targeting only a few percent error in each
+	// window of the given size.
+	const window = 8 * time.Hour
+
+	opCapacity, err := ratelimit.ChooseTokenBucketCapacity(
+		opRateLimitHz,
+		window)
+
+	if err != nil {
+		err = fmt.Errorf("Choosing operation token bucket capacity: %v", err)
+		return
+	}
+
+	egressCapacity, err := ratelimit.ChooseTokenBucketCapacity(
+		egressBandwidthLimit,
+		window)
+
+	if err != nil {
+		err = fmt.Errorf("Choosing egress bandwidth token bucket capacity: %v", err)
+		return
+	}
+
+	// Create the throttles.
+	opThrottle := ratelimit.NewThrottle(opRateLimitHz, opCapacity)
+	egressThrottle := ratelimit.NewThrottle(egressBandwidthLimit, egressCapacity)
+
+	// And the bucket.
+	out = ratelimit.NewThrottledBucket(
+		opThrottle,
+		egressThrottle,
+		in)
+
+	return
+}
+
+// Like setUpRateLimiting, but always limit both operations and egress
+// bandwidth, with throttles whose rates can be changed later through the
+// supplied tunables. A limit that isn't positive is treated as a very large
+// one.
+func setUpAdjustableRateLimiting(
+	in gcs.Bucket,
+	flags *flagStorage,
+	t *tunables) (out gcs.Bucket, err error) {
+	const window = 8 * time.Hour
+
+	t.opThrottle, err = gcsx.NewAdjustableThrottle(flags.OpRateLimitHz, window)
+	if err != nil {
+		err = fmt.Errorf("Creating operation throttle: %v", err)
+		return
+	}
+
+	t.egressThrottle, err = gcsx.NewAdjustableThrottle(
+		flags.EgressBandwidthLimitBytesPerSecond,
+		window)
+
+	if err != nil {
+		err = fmt.Errorf("Creating egress bandwidth throttle: %v", err)
+		return
+	}
+
+	out = ratelimit.NewThrottledBucket(t.opThrottle, t.egressThrottle, in)
+	return
+}
+
+// Set up a throttle that divides the egress bandwidth limit among file
+// handles, if requested. Return nil if not. If tunables are supplied, the
+// throttle is set up even without a limit, so that one can be applied later.
+func setUpFairShareThrottle(
+	flags *flagStorage,
+	tunables *tunables) (t *gcsx.FairShareThrottle, err error) {
+	if !flags.EgressBandwidthFairShare {
+		return
+	}
+
+	// Choose a token bucket capacity in the same manner as setUpRateLimiting.
+	const window = 8 * time.Hour
+
+	if tunables != nil {
+		tunables.fairShareThrottle, err = gcsx.NewAdjustableThrottle(
+			flags.EgressBandwidthLimitBytesPerSecond,
+			window)
+
+		if err != nil {
+			err = fmt.Errorf("Creating fair share throttle: %v", err)
+			return
+		}
+
+		t = gcsx.NewFairShareThrottle(tunables.fairShareThrottle)
+		return
+	}
+
+	if !(flags.EgressBandwidthLimitBytesPerSecond > 0) {
+		return
+	}
+
+	capacity, err := ratelimit.ChooseTokenBucketCapacity(
+		flags.EgressBandwidthLimitBytesPerSecond,
+		window)
+
+	if err != nil {
+		err = fmt.Errorf("Choosing fair share token bucket capacity: %v", err)
+		return
+	}
+
+	t = gcsx.NewFairShareThrottle(
+		ratelimit.NewThrottle(flags.EgressBandwidthLimitBytesPerSecond, capacity))
+
+	return
+}
+
+// Return the folders of the named bucket if it has a hierarchical namespace,
+// limited to --only-dir as the bucket is, or nil if it doesn't. Failing to find
+// out is only worth a warning, since the bucket is usable without them.
+func setUpFolders(
+	ctx context.Context,
+	flags *flagStorage,
+	backend storage.Backend,
+	name string) (f storage.Folders) {
+	// Folders are modified directly rather than through the bucket, so a dry
+	// run does without them.
+	fb, ok := backend.(storage.FolderBackend)
+	if !ok || name == canned.FakeBucketName || flags.DryRun {
+		return
+	}
+
+	f, err := fb.OpenFolders(ctx, name)
+	if err != nil {
+		logger.Errorf("Couldn't find out whether %s has folders: %v", name, err)
+		return
+	}
+
+	if f == nil {
+		return
+	}
+
+	logger.Infof("Bucket %s has a hierarchical namespace; using its folders.", name)
+
+	if flags.OnlyDir != "" {
+		f = gcsx.NewPrefixFolders(path.Clean(flags.OnlyDir)+"/", f)
+	}
+
+	return
+}
+
+// Return the soft-deleted objects of the named bucket if it has a soft delete
+// policy, limited to --only-dir as the bucket is, or nil if it doesn't. As for
+// folders, failing to find out is only worth a warning.
+func setUpSoftDeleted(
+	ctx context.Context,
+	flags *flagStorage,
+	backend storage.Backend,
+	name string) (sd storage.SoftDeleted) {
+	// Nor can objects be restored in a dry run.
+	sb, ok := backend.(storage.SoftDeleteBackend)
+	if !ok || name == canned.FakeBucketName || flags.DryRun {
+		return
+	}
+
+	sd, err := sb.OpenSoftDeleted(ctx, name)
+	if err != nil {
+		logger.Errorf("Couldn't find out whether %s has a soft delete policy: %v", name, err)
+		return
+	}
+
+	if sd == nil {
+		return
+	}
+
+	logger.Infof("Bucket %s has a soft delete policy; showing deleted objects in .trash.", name)
+
+	if flags.OnlyDir != "" {
+		sd = gcsx.NewPrefixSoftDeleted(path.Clean(flags.OnlyDir)+"/", sd)
+	}
+
+	return
+}
+
+// Return the retention of objects in the named bucket, limited to --only-dir
+// as the bucket is, or nil if the backend can't report it. Failing to set it
+// up is only worth a warning, since GCS refuses to modify retained objects
+// regardless.
+func setUpRetention(
+	ctx context.Context,
+	flags *flagStorage,
+	backend storage.Backend,
+	name string) (r storage.Retention) {
+	rb, ok := backend.(storage.RetentionBackend)
+	if !ok || name == canned.FakeBucketName {
+		return
+	}
+
+	r, err := rb.OpenRetention(ctx, name)
+	if err != nil {
+		logger.Errorf("Couldn't set up retention checks for %s: %v", name, err)
+		return
+	}
+
+	if r != nil && flags.OnlyDir != "" {
+		r = gcsx.NewPrefixRetention(path.Clean(flags.OnlyDir)+"/", r)
+	}
+
+	return
+}
+
+// Return the changes to objects in the named bucket delivered to
+// --notification-subscription, limited to --only-dir as the bucket is, or nil
+// if the flag isn't given. Unlike the above this was asked for explicitly, so
+// failing to set it up is an error.
+func setUpChanges(
+	ctx context.Context,
+	flags *flagStorage,
+	backend storage.Backend,
+	name string) (c storage.Changes, err error) {
+	if flags.NotificationSubscription == "" {
+		return
+	}
+
+	cb, ok := backend.(storage.ChangesBackend)
+	if !ok || name == canned.FakeBucketName {
+		err = fmt.Errorf("%s doesn't support --notification-subscription", name)
+		return
+	}
+
+	c, err = cb.OpenChanges(ctx, name, flags.NotificationSubscription)
+	if err != nil {
+		err = fmt.Errorf("OpenChanges: %v", err)
+		return
+	}
+
+	if flags.OnlyDir != "" {
+		c = gcsx.NewPrefixChanges(path.Clean(flags.OnlyDir)+"/", c)
+	}
+
+	return
+}
+
+// Configure a bucket based on the supplied flags. Also return the layer that
+// watches for GCS refusing our credentials. If cache is non-nil, reads of the
+// objects it holds are served from it. If tunables are supplied, the
+// layers whose settings can be reloaded from a config file are recorded
+// there, and set up even if disabled for now.
+//
+// Special case: if the bucket name is canned.FakeBucketName, set up a fake
+// bucket as described in that package.
+func setUpBucket(
+	ctx context.Context,
+	flags *flagStorage,
+	backend storage.Backend,
+	name string,
+	cache *gcsx.ContentCache,
+	t *tunables) (b gcs.Bucket, auth *gcsx.AuthBucket, err error) {
+	// Set up the appropriate backing bucket.
+	if name == canned.FakeBucketName {
+		b = canned.MakeFakeBucket(ctx)
+	} else {
+		b, err = backend.OpenBucket(ctx, name)
+		if err != nil {
+			err = fmt.Errorf("OpenBucket: %v", err)
+			return
+		}
+	}
+
+	// Record GCS requests in traces, if tracing is enabled.
+	if tracing.Enabled() {
+		b = gcsx.NewTracingBucket(b)
+	}
+
+	// Renew credentials that GCS refuses, if the backend can.
+	var reauthenticate func() error
+	if r, ok := backend.(storage.Reauthenticator); ok {
+		reauthenticate = r.Reauthenticate
+	}
+
+	auth = gcsx.NewAuthBucket(reauthenticate, timeutil.RealClock(), b)
+	b = auth
+
+	// Retry requests that fail with transient errors, unless disabled.
+	if flags.MaxRetrySleep > 0 {
+		cfg := gcsx.RetryConfig{
+			InitialDelay: 100 * time.Millisecond,
+			Multiplier:   flags.RetryMultiplier,
+			MaxDelay:     flags.MaxRetrySleep,
+			MaxAttempts:  10,
+			BudgetRatio:  flags.RetryBudget,
+		}
+
+		b = gcsx.NewRetryBucket(cfg, b)
+	}
+
+	// Keep modifications to ourselves, if requested. Nothing below here reaches
+	// GCS, so there's nothing for an audit log to record.
+	if flags.DryRun {
+		logger.Infof("Dry run: objects in %s won't be modified.", name)
+		b = gcsx.NewDryRunBucket(timeutil.RealClock(), b)
+	}
+
+	// Record modifications, if requested.
+	if flags.AuditLog != "" {
+		var f *os.File
+		f, err = os.OpenFile(
+			flags.AuditLog,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+			0600)
+
+		if err != nil {
+			err = fmt.Errorf("Opening audit log: %v", err)
+			return
+		}
+
+		b = gcsx.NewAuditingBucket(timeutil.RealClock(), f, b)
+	}
+
+	// Retry reads that stall, if requested.
+	if flags.ReadStallTimeout > 0 {
+		const maxRetries = 3
+		b = gcsx.NewStallRetryingBucket(flags.ReadStallTimeout, maxRetries, b)
+	}
+
+	// Give new objects the requested storage class, if any.
+	if flags.StorageClass != "" {
+		class := strings.ToUpper(flags.StorageClass)
+		if !gcsx.IsStorageClass(class) {
+			err = fmt.Errorf("Unknown --storage-class: %q", flags.StorageClass)
+			return
+		}
+
+		b = gcsx.NewStorageClassBucket(class, b)
+	}
+
+	// Serve reads from prefetched copies, if any. This sees whole object names,
+	// so that copies may be shared by mounts of different parts of the bucket.
+	if cache != nil {
+		if t != nil {
+			t.contentCache = cache
+			t.prefetchBucket = b
+			if flags.OnlyDir != "" {
+				t.prefetchPrefix = path.Clean(flags.OnlyDir) + "/"
+			}
+		}
+
+		b = gcsx.NewContentCacheBucket(cache, b)
+
+		// Keep copies of the objects read, to be found while GCS is unreachable.
+		if flags.OfflineRetryInterval > 0 {
+			b = gcsx.NewOfflineBucket(cache, b)
+		}
+	}
+
+	// Limit to a requested prefix of the bucket, if any.
+	if flags.OnlyDir != "" {
+		b, err = gcsx.NewPrefixBucket(path.Clean(flags.OnlyDir)+"/", b)
+		if err != nil {
+			err = fmt.Errorf("NewPrefixBucket: %v", err)
+			return
+		}
+	}
+
+	// Enable rate limiting, if requested.
+	if t != nil {
+		b, err = setUpAdjustableRateLimiting(b, flags, t)
+		if err != nil {
+			err = fmt.Errorf("setUpAdjustableRateLimiting: %v", err)
+			return
+		}
+	} else {
+		b, err = setUpRateLimiting(
+			b,
+			flags.OpRateLimitHz,
+			flags.EgressBandwidthLimitBytesPerSecond)
+
+		if err != nil {
+			err = fmt.Errorf("setUpRateLimiting: %v", err)
+			return
+		}
+	}
+
+	// Enable cached StatObject results, if appropriate.
+	if flags.StatCacheTTL != 0 || t != nil {
+		if flags.StatCacheCapacity <= 0 {
+			err = fmt.Errorf("--stat-cache-capacity must be positive")
+			return
+		}
+
+		b = gcscaching.NewFastStatBucket(
+			flags.StatCacheTTL,
+			gcscaching.NewStatCache(flags.StatCacheCapacity),
+			clock.NewMonotonicClock(),
+			b)
+
+		if t != nil {
+			t.statCache = b.(gcscaching.TTLSetter)
+			t.statCacheHits = b.(gcscaching.HitCounter)
+		}
+	}
+
+	// Check whether this bucket works, giving the user a warning early if there
+	// is some problem.
+	{
+		_, err := b.ListObjects(ctx, &gcs.ListObjectsRequest{MaxResults: 1})
+		if err != nil {
+			fmt.Fprintln(os.Stdout, "WARNING, bucket doesn't appear to work: ", err)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,447 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/metrics"
+	"github.com/googlecloudplatform/gcsfuse/internal/tracing"
+	"github.com/jacobsa/daemonize"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"github.com/kardianos/osext"
+)
+
+// Serve the supplied handler on the given port on localhost, describing it
+// in log messages with the given name. Return an error only if listening
+// fails.
+func startLocalHTTPServer(
+	desc string,
+	port int,
+	handler http.Handler) (err error) {
+	addr := fmt.Sprintf("localhost:%d", port)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	logger.Infof("Serving %s on %s", desc, l.Addr())
+
+	go func() {
+		err := http.Serve(l, handler)
+		logger.Errorf("%s server: %v", desc, err)
+	}()
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// main logic
+////////////////////////////////////////////////////////////////////////
+
+// Mount the file system according to arguments in the supplied context. The
+// flags named in pinned were given on the command line, and so aren't changed
+// by reloading the config file.
+func mountWithArgs(
+	bucketName string,
+	mountPoint string,
+	flags *flagStorage,
+	pinned map[string]bool,
+	mountStatus *log.Logger) (
+	mfs *fuse.MountedFileSystem,
+	control *controlListener,
+	err error) {
+	// Enable invariant checking if requested.
+	if flags.DebugInvariants {
+		syncutil.EnableInvariantChecking()
+	}
+
+	// Choose the backend from which to open the bucket.
+	backend, err := chooseBackendForBucket(bucketName, flags, mountStatus)
+	if err != nil {
+		err = fmt.Errorf("chooseBackendForBucket: %v", err)
+		return
+	}
+
+	// Serve health checks, if requested.
+	if flags.HealthPort >= 0 {
+		var bucket gcs.Bucket
+		bucket, err = openHealthCheckBucket(
+			context.Background(),
+			backend,
+			bucketName)
+
+		if err != nil {
+			err = fmt.Errorf("openHealthCheckBucket: %v", err)
+			return
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", newHealthHandler(mountPoint, bucket, healthCheckTimeout))
+
+		err = startLocalHTTPServer("health checks", flags.HealthPort, mux)
+		if err != nil {
+			err = fmt.Errorf("startLocalHTTPServer: %v", err)
+			return
+		}
+	}
+
+	// Record op latencies if metrics are being served.
+	var opLatencies *metrics.LatencyHistograms
+	if flags.MetricsPort >= 0 {
+		opLatencies = newOpLatencies()
+		metrics.DefaultRegistry.Register(opLatencies)
+	}
+
+	// Dump in-flight ops and open handles on SIGUSR1. (main additionally
+	// writes a CPU profile.)
+	dumpStateSignals := make(chan os.Signal, 1)
+	signal.Notify(dumpStateSignals, syscall.SIGUSR1)
+
+	// Reload the config file, if any, on SIGHUP.
+	var reloader *configReloader
+	if flags.ConfigFile != "" {
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+		reloader = &configReloader{signals: reloadSignals, pinned: pinned}
+	}
+
+	// Mount the file system, keeping track of what the config file may adjust
+	// and what `gcsfuse stats` reports on.
+	t := new(tunables)
+	mfs, server, err := mountWithBackend(
+		context.Background(),
+		bucketName,
+		mountPoint,
+		flags,
+		backend,
+		mountStatus,
+		opLatencies,
+		dumpStateSignals,
+		t,
+		reloader)
+
+	if err != nil {
+		err = fmt.Errorf("mountWithBackend: %v", err)
+		return
+	}
+
+	// Let the user unmount with Ctrl-C (SIGINT), or the system with SIGTERM.
+	registerShutdownHandler(mfs.Dir(), server, flags.ShutdownTimeout)
+
+	// Answer `gcsfuse stats`, and let `gcsfuse unmount` ask us to unmount
+	// safely, unless another process mounted the file system and so must
+	// unmount it.
+	if !fuse.IsMountedFD(mfs.Dir()) {
+		control, err = listenForControl(mfs.Dir(), t, flags.ShutdownTimeout)
+		if err != nil {
+			logger.Errorf(
+				"gcsfuse stats and unmount won't work: listenForControl: %v",
+				err)
+			err = nil
+		}
+	}
+
+	if flags.UnmountAfterIdle > 0 {
+		go unmountWhenIdle(
+			mfs.Dir(),
+			server,
+			flags.UnmountAfterIdle,
+			flags.ShutdownTimeout,
+			nil)
+	}
+
+	return
+}
+
+// Make the paths given on the command line for flags in pathFlags absolute,
+// returning flags that give the daemon the same paths.
+func absolutizePathFlags(c *cli.Context) (args []string, err error) {
+	var names []string
+	for name := range pathFlags {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := c.String(name)
+		if !c.IsSet(name) || p == "" || filepath.IsAbs(p) {
+			continue
+		}
+
+		p, err = filepath.Abs(p)
+		if err != nil {
+			err = fmt.Errorf("canonicalizing --%s: %v", name, err)
+			return
+		}
+
+		err = c.Set(name, p)
+		if err != nil {
+			err = fmt.Errorf("--%s: %v", name, err)
+			return
+		}
+
+		args = append(args, fmt.Sprintf("--%s=%s", name, p))
+	}
+
+	return
+}
+
+func runCLIApp(c *cli.Context, osArgs []string) (err error) {
+	// Fill in flags not given on the command line from the config file, if any.
+	pinned := commandLineFlags(c)
+	pathArgs, err := absolutizePathFlags(c)
+	if err != nil {
+		return
+	}
+
+	err = applyConfigFile(c)
+	if err != nil {
+		err = fmt.Errorf("Reading --config-file: %v", err)
+		return
+	}
+
+	flags := populateFlags(c)
+
+	// Extract arguments.
+	if len(c.Args()) != 2 {
+		err = fmt.Errorf(
+			"%s takes exactly two arguments. Run `%s --help` for more info.",
+			path.Base(osArgs[0]),
+			path.Base(osArgs[0]))
+
+		return
+	}
+
+	bucketName := c.Args()[0]
+	mountPoint := c.Args()[1]
+
+	// Canonicalize the mount point, making it absolute. This is important when
+	// daemonizing below, since the daemon will change its working directory
+	// before running this code again.
+	mountPoint, err = filepath.Abs(mountPoint)
+	if err != nil {
+		err = fmt.Errorf("canonicalizing mount point: %v", err)
+		return
+	}
+
+	fmt.Fprintf(os.Stdout, "Using mount point: %s\n", mountPoint)
+
+	// The daemon doesn't inherit our file descriptors, so can't serve one that
+	// was passed to us.
+	if fuse.IsMountedFD(mountPoint) && !flags.Foreground {
+		err = fmt.Errorf("Mounting from %s requires --foreground", mountPoint)
+		return
+	}
+
+	// If we haven't been asked to run in foreground mode, we should run a daemon
+	// with the foreground flag set and wait for it to mount.
+	if !flags.Foreground {
+		// Find the executable.
+		var path string
+		path, err = osext.Executable()
+		if err != nil {
+			err = fmt.Errorf("osext.Executable: %v", err)
+			return
+		}
+
+		// Set up arguments. Be sure to use foreground mode, and to send along the
+		// absolute paths, which override those given, and the
+		// potentially-modified mount point.
+		flagArgs := osArgs[1 : len(osArgs)-2]
+		posArgs := []string{bucketName, mountPoint}
+		if n := len(flagArgs); n > 0 && flagArgs[n-1] == "--" {
+			flagArgs = flagArgs[:n-1]
+			posArgs = append([]string{"--"}, posArgs...)
+		}
+
+		args := append([]string{"--foreground"}, flagArgs...)
+		args = append(args, pathArgs...)
+		args = append(args, posArgs...)
+
+		// Pass along PATH so that the daemon can find fusermount on Linux.
+		env := []string{
+			fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
+		}
+
+		// Pass along GOOGLE_APPLICATION_CREDENTIALS, since we document in
+		// mounting.md that it can be used for specifying a key file.
+		if p, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
+			env = append(env, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", p))
+		}
+
+		// Run.
+		err = daemonize.Run(path, args, env, os.Stdout)
+		if err != nil {
+			err = fmt.Errorf("daemonize.Run: %v", err)
+			return
+		}
+
+		return
+	}
+
+	// Set up logging for the daemon.
+	err = logger.Init(flags.LogFile, flags.LogFormat)
+	if err != nil {
+		err = fmt.Errorf("logger.Init: %v", err)
+		return
+	}
+
+	severity, err := logger.ParseSeverity(flags.LogSeverity)
+	if err != nil {
+		err = fmt.Errorf("--log-severity: %v", err)
+		return
+	}
+
+	logger.SetSeverity(severity)
+
+	// Serve profiles, if requested. Package net/http/pprof registers its
+	// handlers with http.DefaultServeMux.
+	if flags.PprofPort >= 0 {
+		err = startLocalHTTPServer("pprof", flags.PprofPort, http.DefaultServeMux)
+		if err != nil {
+			err = fmt.Errorf("startLocalHTTPServer: %v", err)
+			return
+		}
+	}
+
+	// Serve metrics, if requested.
+	if flags.MetricsPort >= 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+
+		err = startLocalHTTPServer("metrics", flags.MetricsPort, mux)
+		if err != nil {
+			err = fmt.Errorf("startLocalHTTPServer: %v", err)
+			return
+		}
+	}
+
+	// Export traces, if requested. This must happen before mounting, since
+	// the bucket and file system check whether tracing is enabled.
+	if flags.OTLPEndpoint != "" {
+		exporter := tracing.NewOTLPExporter(flags.OTLPEndpoint, "gcsfuse")
+		tracing.SetExporter(exporter)
+		defer exporter.Shutdown()
+	}
+
+	// Mount, writing information about our progress to the writer that package
+	// daemonize gives us and telling it about the outcome.
+	var mfs *fuse.MountedFileSystem
+	var control *controlListener
+	{
+		mountStatus := log.New(daemonize.StatusWriter, "", 0)
+		mfs, control, err = mountWithArgs(
+			bucketName,
+			mountPoint,
+			flags,
+			pinned,
+			mountStatus)
+
+		if err == nil {
+			mountStatus.Println("File system has been successfully mounted.")
+			daemonize.SignalOutcome(nil)
+		} else {
+			err = fmt.Errorf("mountWithArgs: %v", err)
+			daemonize.SignalOutcome(err)
+			return
+		}
+	}
+
+	// Tell systemd that we're ready, if it's listening, and keep its watchdog
+	// happy for as long as the file system responds.
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Errorf("sdNotify: %v", err)
+	}
+
+	if interval, err := watchdogInterval(); err != nil {
+		logger.Errorf("watchdogInterval: %v", err)
+	} else if interval > 0 {
+		go pingWatchdog(mfs.Dir(), interval, nil)
+	}
+
+	// Wait for the file system to be unmounted, then for any unmount request
+	// to be told so.
+	err = mfs.Join(context.Background())
+	if control != nil {
+		control.Close()
+	}
+
+	if err != nil {
+		err = fmt.Errorf("MountedFileSystem.Join: %v", err)
+		return
+	}
+
+	return
+}
+
+// Run gcsfuse with the supplied command line, whose first element is the
+// program name, as the gcsfuse binary does. Unless --foreground is given,
+// this runs the current executable again in the background to serve the file
+// system, so it is of use only to gcsfuse itself; other programs should use
+// Mount.
+func RunCLI(args []string, version string) (err error) {
+	// Set up the app.
+	app := newApp(version)
+
+	var appErr error
+	app.Action = func(c *cli.Context) {
+		appErr = runCLIApp(c, args)
+	}
+
+	app.Commands = []cli.Command{
+		newListBucketsCommand(func(c *cli.Context) {
+			appErr = runListBuckets(c)
+		}),
+		newUnmountCommand(func(c *cli.Context) {
+			appErr = runUnmount(c)
+		}),
+		newStatsCommand(func(c *cli.Context) {
+			appErr = runStats(c)
+		}),
+		newPrefetchCommand(func(c *cli.Context) {
+			appErr = runPrefetch(c)
+		}),
+		newVerifyCacheCommand(func(c *cli.Context) {
+			appErr = runVerifyCache(c)
+		}),
+	}
+
+	// Run it.
+	err = app.Run(args)
+	if err != nil {
+		return
+	}
+
+	err = appErr
+	return
+}
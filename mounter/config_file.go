@@ -0,0 +1,536 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcscaching"
+)
+
+// A setting in a config file: the name of a flag, and the values to give it.
+// Flags that may be repeated may have several values.
+type configSetting struct {
+	Name   string
+	Values []string
+}
+
+// The flags that may be changed while mounted, by reloading the config file.
+var reloadableFlags = map[string]bool{
+	"log-severity":        true,
+	"stat-cache-ttl":      true,
+	"type-cache-ttl":      true,
+	"limit-ops-per-sec":   true,
+	"limit-bytes-per-sec": true,
+}
+
+// The flags naming files or directories. Relative paths for them are resolved
+// against the directory containing the config file when they appear in it, and
+// made absolute by runCLIApp when given on the command line, since the daemon
+// runs in the root directory.
+var pathFlags = map[string]bool{
+	"audit-log":           true,
+	"ca-cert":             true,
+	"cache-dir":           true,
+	"config-file":         true,
+	"encryption-key-file": true,
+	"key-file":            true,
+	"log-file":            true,
+	"staging-dir":         true,
+	"temp-dir":            true,
+}
+
+// Read the config file at the supplied path. It is either a JSON object or a
+// YAML mapping from flag names to values, which may be lists for flags that
+// may be repeated. Flags that make no sense in a config file, and names that
+// aren't flags, are rejected.
+func readConfigFile(path string) (settings []configSetting, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(string(contents)), "{") {
+		settings, err = parseJSONConfig(contents)
+	} else {
+		settings, err = parseYAMLConfig(contents)
+	}
+
+	if err != nil {
+		return
+	}
+
+	names := flagNames()
+	for _, s := range settings {
+		switch {
+		case s.Name == "config-file" || s.Name == "help" || s.Name == "version":
+			err = fmt.Errorf("%q can't be set in a config file", s.Name)
+			return
+
+		case names[s.Name] == nil:
+			err = fmt.Errorf("Unknown flag: %q", s.Name)
+			return
+		}
+	}
+
+	return
+}
+
+// Set the flags in the supplied context from the config file named by
+// --config-file, if any, except for those given on the command line, which
+// take precedence.
+func applyConfigFile(c *cli.Context) (err error) {
+	path := c.String("config-file")
+	if path == "" {
+		return
+	}
+
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return
+	}
+
+	names := flagNames()
+	pinned := commandLineFlags(c)
+	for _, s := range settings {
+		if pinned[s.Name] {
+			continue
+		}
+
+		// Set every name of the flag, since the others aren't kept in sync.
+		for _, name := range names[s.Name] {
+			for _, v := range s.Values {
+				if pathFlags[s.Name] && v != "" && !filepath.IsAbs(v) {
+					v = filepath.Join(filepath.Dir(path), v)
+				}
+
+				err = c.Set(name, v)
+				if err != nil {
+					err = fmt.Errorf("%s: %v", s.Name, err)
+					return
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// Return the names of the flags given on the command line, including the
+// other names of those that have several.
+func commandLineFlags(c *cli.Context) (pinned map[string]bool) {
+	pinned = make(map[string]bool)
+	for name, aliases := range flagNames() {
+		if c.IsSet(name) {
+			for _, a := range aliases {
+				pinned[a] = true
+			}
+		}
+	}
+
+	return
+}
+
+// Return a map from each name of each flag gcsfuse accepts to all of the
+// names of that flag.
+func flagNames() (names map[string][]string) {
+	names = make(map[string][]string)
+	for _, f := range newApp("").Flags {
+		var aliases []string
+		for _, name := range strings.Split(f.GetName(), ",") {
+			aliases = append(aliases, strings.TrimSpace(name))
+		}
+
+		for _, name := range aliases {
+			names[name] = aliases
+		}
+	}
+
+	return
+}
+
+// Parse a config file holding a JSON object, whose values are strings,
+// numbers, booleans, or arrays of them.
+func parseJSONConfig(contents []byte) (settings []configSetting, err error) {
+	var doc map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(contents))
+	d.UseNumber()
+
+	err = d.Decode(&doc)
+	if err != nil {
+		err = fmt.Errorf("Decoding JSON: %v", err)
+		return
+	}
+
+	var names []string
+	for name := range doc {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := configSetting{Name: name}
+
+		values, isList := doc[name].([]interface{})
+		if !isList {
+			values = []interface{}{doc[name]}
+		}
+
+		for _, v := range values {
+			switch v.(type) {
+			case string, json.Number, bool:
+				s.Values = append(s.Values, fmt.Sprint(v))
+
+			default:
+				err = fmt.Errorf("%s: unsupported value: %v", name, v)
+				return
+			}
+		}
+
+		settings = append(settings, s)
+	}
+
+	return
+}
+
+// Parse a config file holding a YAML mapping. Only the subset of YAML needed
+// for flags is supported: "name: value" lines with plain or quoted scalars,
+// lists either as "[a, b]" or as indented "- item" lines following "name:",
+// and comments.
+func parseYAMLConfig(contents []byte) (settings []configSetting, err error) {
+	seen := make(map[string]bool)
+
+	// The setting to which "- item" lines belong, if any.
+	var list *configSetting
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		raw := stripYAMLComment(scanner.Text())
+		line := strings.TrimSpace(raw)
+
+		switch {
+		case line == "" || line == "---" || line == "...":
+			continue
+
+		// An item of a block list.
+		case line == "-" || strings.HasPrefix(line, "- "):
+			if list == nil || raw[0] != ' ' {
+				err = fmt.Errorf("Line %d: unexpected list item", n)
+				return
+			}
+
+			var v string
+			v, err = parseYAMLScalar(strings.TrimSpace(line[1:]))
+			if err != nil {
+				err = fmt.Errorf("Line %d: %v", n, err)
+				return
+			}
+
+			list.Values = append(list.Values, v)
+			continue
+		}
+
+		// Otherwise this must be a top-level "name: value" line.
+		i := strings.Index(line, ":")
+		if i <= 0 || raw[0] == ' ' || raw[0] == '\t' {
+			err = fmt.Errorf("Line %d: expected \"name: value\", got %q", n, line)
+			return
+		}
+
+		s := configSetting{Name: strings.TrimSpace(line[:i])}
+		value := strings.TrimSpace(line[i+1:])
+
+		if seen[s.Name] {
+			err = fmt.Errorf("Line %d: %q appears twice", n, s.Name)
+			return
+		}
+
+		seen[s.Name] = true
+
+		switch {
+		case value == "":
+			// Perhaps a block list follows.
+
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				err = fmt.Errorf("Line %d: unterminated list", n)
+				return
+			}
+
+			inner := strings.TrimSpace(value[1 : len(value)-1])
+			if inner != "" {
+				for _, item := range strings.Split(inner, ",") {
+					var v string
+					v, err = parseYAMLScalar(strings.TrimSpace(item))
+					if err != nil {
+						err = fmt.Errorf("Line %d: %v", n, err)
+						return
+					}
+
+					s.Values = append(s.Values, v)
+				}
+			}
+
+		default:
+			var v string
+			v, err = parseYAMLScalar(value)
+			if err != nil {
+				err = fmt.Errorf("Line %d: %v", n, err)
+				return
+			}
+
+			s.Values = []string{v}
+		}
+
+		settings = append(settings, s)
+
+		list = nil
+		if value == "" {
+			list = &settings[len(settings)-1]
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
+
+// Remove a trailing comment from a line of YAML, being careful not to break
+// up quoted strings.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+
+		case r == '"' || r == '\'':
+			quote = r
+
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// Parse a plain, single-quoted or double-quoted YAML scalar.
+func parseYAMLScalar(s string) (v string, err error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		v, err = strconv.Unquote(s)
+		if err != nil {
+			err = fmt.Errorf("Bad quoted string %s: %v", s, err)
+		}
+
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			err = fmt.Errorf("Bad quoted string %s", s)
+			return
+		}
+
+		v = strings.Replace(s[1:len(s)-1], "''", "'", -1)
+
+	case strings.HasPrefix(s, "{") || strings.HasPrefix(s, "&") ||
+		strings.HasPrefix(s, "*") || strings.HasPrefix(s, "|") ||
+		strings.HasPrefix(s, ">"):
+		err = fmt.Errorf("Unsupported value: %s", s)
+
+	default:
+		v = s
+	}
+
+	return
+}
+
+// Set the named flag, which must be one that may be changed while mounted.
+func setReloadableFlag(
+	flags *flagStorage,
+	name string,
+	value string) (err error) {
+	switch name {
+	case "log-severity":
+		_, err = logger.ParseSeverity(value)
+		flags.LogSeverity = value
+
+	case "stat-cache-ttl":
+		flags.StatCacheTTL, err = time.ParseDuration(value)
+
+	case "type-cache-ttl":
+		flags.TypeCacheTTL, err = time.ParseDuration(value)
+
+	case "limit-ops-per-sec":
+		flags.OpRateLimitHz, err = strconv.ParseFloat(value, 64)
+
+	case "limit-bytes-per-sec":
+		flags.EgressBandwidthLimitBytesPerSecond, err =
+			strconv.ParseFloat(value, 64)
+
+	default:
+		err = fmt.Errorf("%q can't be changed without remounting", name)
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("%s: %v", name, err)
+		return
+	}
+
+	return
+}
+
+// The parts of a mounted file system that apply the flags a config file may
+// change, and that `gcsfuse stats` and `gcsfuse prefetch` use. Fields are nil
+// where the corresponding feature is disabled.
+type tunables struct {
+	server         fs.Server
+	statCache      gcscaching.TTLSetter
+	statCacheHits  gcscaching.HitCounter
+	opThrottle     *gcsx.AdjustableThrottle
+	egressThrottle *gcsx.AdjustableThrottle
+
+	// The throttle shared between file handles with
+	// --limit-bytes-per-sec-fair-share.
+	fairShareThrottle *gcsx.AdjustableThrottle
+
+	// The cache of prefetched objects, the bucket beneath it from which they
+	// are fetched, and the prefix that turns paths within the file system into
+	// the names of objects in that bucket.
+	contentCache   *gcsx.ContentCache
+	prefetchBucket gcs.Bucket
+	prefetchPrefix string
+}
+
+// Apply the reloadable flags to the mounted file system.
+func (t *tunables) apply(flags *flagStorage) (err error) {
+	sev, err := logger.ParseSeverity(flags.LogSeverity)
+	if err != nil {
+		err = fmt.Errorf("ParseSeverity: %v", err)
+		return
+	}
+
+	logger.SetSeverity(sev)
+
+	if t.server != nil {
+		t.server.SetCacheTTLs(flags.StatCacheTTL, flags.TypeCacheTTL)
+	}
+
+	if t.statCache != nil {
+		t.statCache.SetTTL(flags.StatCacheTTL)
+	}
+
+	rates := []struct {
+		throttle *gcsx.AdjustableThrottle
+		rateHz   float64
+	}{
+		{t.opThrottle, flags.OpRateLimitHz},
+		{t.egressThrottle, flags.EgressBandwidthLimitBytesPerSecond},
+		{t.fairShareThrottle, flags.EgressBandwidthLimitBytesPerSecond},
+	}
+
+	for _, r := range rates {
+		if r.throttle == nil {
+			continue
+		}
+
+		err = r.throttle.SetRate(r.rateHz)
+		if err != nil {
+			err = fmt.Errorf("SetRate: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Reloads the config file each time a signal is received, applying the
+// settings that may be changed while mounted.
+type configReloader struct {
+	signals <-chan os.Signal
+
+	// The names of the flags given on the command line, which take precedence
+	// over the config file.
+	pinned map[string]bool
+}
+
+// Reload the config file named by the supplied flags on each signal,
+// applying it on top of them. Settings that can't be changed while mounted
+// are ignored, as are settings no longer in the file, which keep their
+// values. A file that can't be read is logged, leaving the previous settings
+// in place.
+func (r *configReloader) run(flags flagStorage, t *tunables) {
+	for sig := range r.signals {
+		err := r.reload(&flags)
+		if err != nil {
+			logger.Errorf("Not reloading %s on %v: %v", flags.ConfigFile, sig, err)
+			continue
+		}
+
+		err = t.apply(&flags)
+		if err != nil {
+			logger.Errorf("Reloading %s on %v: %v", flags.ConfigFile, sig, err)
+			continue
+		}
+
+		logger.Infof("Reloaded %s on %v.", flags.ConfigFile, sig)
+	}
+}
+
+// Read the config file into the reloadable flags, leaving them unmodified if
+// that fails.
+func (r *configReloader) reload(flags *flagStorage) (err error) {
+	settings, err := readConfigFile(flags.ConfigFile)
+	if err != nil {
+		return
+	}
+
+	updated := *flags
+	for _, s := range settings {
+		if !reloadableFlags[s.Name] || r.pinned[s.Name] {
+			continue
+		}
+
+		if len(s.Values) != 1 {
+			err = fmt.Errorf("%s: expected a single value", s.Name)
+			return
+		}
+
+		err = setReloadableFlag(&updated, s.Name, s.Values[0])
+		if err != nil {
+			return
+		}
+	}
+
+	*flags = updated
+	return
+}
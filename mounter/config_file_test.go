@@ -0,0 +1,317 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestConfigFile(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ConfigFileTest struct {
+	dir  string
+	path string
+}
+
+var _ SetUpInterface = &ConfigFileTest{}
+var _ TearDownInterface = &ConfigFileTest{}
+
+func init() { RegisterTestSuite(&ConfigFileTest{}) }
+
+func (t *ConfigFileTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "config_file_test")
+	AssertEq(nil, err)
+
+	t.path = path.Join(t.dir, "config")
+}
+
+func (t *ConfigFileTest) TearDown() {
+	logger.SetSeverity(logger.SeverityDebug)
+
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+func (t *ConfigFileTest) write(contents string) {
+	err := ioutil.WriteFile(t.path, []byte(contents), 0600)
+	AssertEq(nil, err)
+}
+
+// Parse the supplied arguments as gcsfuse does, with the config file.
+func (t *ConfigFileTest) parse(
+	args ...string) (flags *flagStorage, pinned map[string]bool, err error) {
+	app := newApp("")
+	app.Action = func(c *cli.Context) {
+		pinned = commandLineFlags(c)
+		err = applyConfigFile(c)
+		flags = populateFlags(c)
+	}
+
+	fullArgs := append([]string{"some_app", "--config-file", t.path}, args...)
+	runErr := app.Run(fullArgs)
+	AssertEq(nil, runErr)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ConfigFileTest) RelativePaths() {
+	t.write(`---
+staging-dir: staging
+log-file: /var/log/gcsfuse.log
+cache-dir: ../cache
+`)
+
+	f, _, err := t.parse()
+	AssertEq(nil, err)
+
+	ExpectEq(path.Join(t.dir, "staging"), f.StagingDir)
+	ExpectEq("/var/log/gcsfuse.log", f.LogFile)
+	ExpectEq(path.Join(path.Dir(t.dir), "cache"), f.CacheDir)
+}
+
+func (t *ConfigFileTest) RelativePathsOnCommandLine() {
+	wd, err := os.Getwd()
+	AssertEq(nil, err)
+
+	var f *flagStorage
+	var args []string
+	app := newApp("")
+	app.Action = func(c *cli.Context) {
+		args, err = absolutizePathFlags(c)
+		f = populateFlags(c)
+	}
+
+	runErr := app.Run([]string{
+		"some_app",
+		"--config-file", "gcsfuse.yaml",
+		"--staging-dir", "staging",
+		"--log-file", "/var/log/gcsfuse.log",
+	})
+
+	AssertEq(nil, runErr)
+	AssertEq(nil, err)
+
+	ExpectEq(path.Join(wd, "gcsfuse.yaml"), f.ConfigFile)
+	ExpectEq(path.Join(wd, "staging"), f.StagingDir)
+	ExpectEq("/var/log/gcsfuse.log", f.LogFile)
+
+	ExpectThat(
+		args,
+		ElementsAre(
+			"--config-file="+path.Join(wd, "gcsfuse.yaml"),
+			"--staging-dir="+path.Join(wd, "staging")))
+}
+
+func (t *ConfigFileTest) MissingFile() {
+	_, err := readConfigFile(t.path)
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *ConfigFileTest) YAML() {
+	t.write(`---
+# Quiet down, and cache for longer.
+log-severity: warning   # not "info"
+stat-cache-ttl: 5m
+implicit-dirs: true
+only-dir: "some/dir # not a comment"
+key-file: '/etc/it''s.json'
+dir-mode: 700
+
+o: [allow_other, ro]
+ignore-pattern:
+  - "*.tmp"
+  - .DS_Store
+`)
+
+	f, _, err := t.parse()
+	AssertEq(nil, err)
+
+	ExpectEq("warning", f.LogSeverity)
+	ExpectEq(5*time.Minute, f.StatCacheTTL)
+	ExpectTrue(f.ImplicitDirs)
+	ExpectEq("some/dir # not a comment", f.OnlyDir)
+	ExpectEq("/etc/it's.json", f.KeyFile)
+	ExpectEq(os.FileMode(0700), f.DirMode)
+	ExpectThat(f.IgnorePatterns, ElementsAre("*.tmp", ".DS_Store"))
+
+	_, ok := f.MountOptions["allow_other"]
+	ExpectTrue(ok)
+	_, ok = f.MountOptions["ro"]
+	ExpectTrue(ok)
+
+	// Flags not in the file keep their defaults.
+	ExpectEq(time.Minute, f.TypeCacheTTL)
+	ExpectEq("text", f.LogFormat)
+}
+
+func (t *ConfigFileTest) JSON() {
+	t.write(`{
+  "limit-ops-per-sec": 100,
+  "limit-bytes-per-sec": 1e6,
+  "implicit-dirs": true,
+  "debug-fuse": true,
+  "type-cache-ttl": "10s",
+  "include-pattern": ["*.csv", "*.json"]
+}`)
+
+	f, _, err := t.parse()
+	AssertEq(nil, err)
+
+	ExpectEq(100, f.OpRateLimitHz)
+	ExpectEq(1e6, f.EgressBandwidthLimitBytesPerSecond)
+	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.DebugFuse)
+	ExpectEq(10*time.Second, f.TypeCacheTTL)
+	ExpectThat(f.IncludePatterns, ElementsAre("*.csv", "*.json"))
+}
+
+func (t *ConfigFileTest) CommandLineTakesPrecedence() {
+	t.write(`
+stat-cache-ttl: 5m
+type-cache-ttl: 5m
+debug-fuse: false
+ignore-pattern: [a, b]
+`)
+
+	f, pinned, err := t.parse(
+		"--stat-cache-ttl=1s",
+		"--debug_fuse",
+		"--ignore-pattern=c")
+
+	AssertEq(nil, err)
+
+	ExpectEq(time.Second, f.StatCacheTTL)
+	ExpectEq(5*time.Minute, f.TypeCacheTTL)
+	ExpectTrue(f.DebugFuse)
+	ExpectThat(f.IgnorePatterns, ElementsAre("c"))
+
+	ExpectTrue(pinned["stat-cache-ttl"])
+	ExpectTrue(pinned["debug_fuse"])
+	ExpectTrue(pinned["debug-fuse"])
+	ExpectFalse(pinned["type-cache-ttl"])
+}
+
+func (t *ConfigFileTest) BadFiles() {
+	testCases := []struct {
+		contents string
+		errSub   string
+	}{
+		{"stat-cache-ttl: 5m\nlog-severity\n", "Line 2"},
+		{"  stat-cache-ttl: 5m\n", "Line 1"},
+		{"- foo\n", "unexpected list item"},
+		{"o: [ro\n", "unterminated"},
+		{"only-dir: 'foo\n", "quoted"},
+		{"only-dir: {a: b}\n", "Unsupported"},
+		{"only-dir: a\nonly-dir: b\n", "twice"},
+		{"taco: true\n", "Unknown flag"},
+		{"config-file: /etc/other\n", "can't be set"},
+		{"{\"only-dir\": {\"a\": 1}}", "unsupported value"},
+		{"{\"only-dir\": ", "JSON"},
+	}
+
+	for _, tc := range testCases {
+		t.write(tc.contents)
+
+		_, err := readConfigFile(t.path)
+		ExpectThat(err, Error(HasSubstr(tc.errSub)), "contents: %q", tc.contents)
+	}
+}
+
+func (t *ConfigFileTest) BadValue() {
+	t.write("stat-cache-ttl: 5\n")
+
+	_, _, err := t.parse()
+	ExpectThat(err, Error(HasSubstr("stat-cache-ttl")))
+}
+
+func (t *ConfigFileTest) Reload() {
+	t.write("stat-cache-ttl: 5m\ntype-cache-ttl: 5m\n")
+	f, pinned, err := t.parse("--type-cache-ttl=1s")
+	AssertEq(nil, err)
+
+	// Change the file. Only reloadable flags not given on the command line
+	// should be changed, and flags no longer named should be kept.
+	t.write(`
+log-severity: error
+type-cache-ttl: 1h
+limit-ops-per-sec: 7
+implicit-dirs: true
+`)
+
+	r := &configReloader{pinned: pinned}
+	err = r.reload(f)
+	AssertEq(nil, err)
+
+	ExpectEq("error", f.LogSeverity)
+	ExpectEq(5*time.Minute, f.StatCacheTTL)
+	ExpectEq(time.Second, f.TypeCacheTTL)
+	ExpectEq(7, f.OpRateLimitHz)
+	ExpectFalse(f.ImplicitDirs)
+}
+
+func (t *ConfigFileTest) ReloadFailure() {
+	t.write("stat-cache-ttl: 5m\n")
+	f, pinned, err := t.parse()
+	AssertEq(nil, err)
+
+	t.write("log-severity: error\nstat-cache-ttl: soon\n")
+
+	r := &configReloader{pinned: pinned}
+	err = r.reload(f)
+	ExpectThat(err, Error(HasSubstr("stat-cache-ttl")))
+
+	// Nothing should have been applied.
+	ExpectEq("debug", f.LogSeverity)
+	ExpectEq(5*time.Minute, f.StatCacheTTL)
+}
+
+func (t *ConfigFileTest) ApplyRates() {
+	var err error
+	tun := &tunables{}
+
+	tun.opThrottle, err = gcsx.NewAdjustableThrottle(0, time.Hour)
+	AssertEq(nil, err)
+
+	flags := parseArgs([]string{"--limit-ops-per-sec=10"})
+	err = tun.apply(flags)
+	AssertEq(nil, err)
+
+	// With its credit discarded, an op should now take around a tenth of a
+	// second.
+	start := time.Now()
+	err = tun.opThrottle.Wait(context.Background(), 1)
+	AssertEq(nil, err)
+	ExpectGe(time.Since(start), 50*time.Millisecond)
+}
@@ -0,0 +1,271 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// The process serving a mount point listens on a Unix socket whose path is
+// derived from the mount point, so that commands like `gcsfuse unmount` and
+// `gcsfuse stats` can talk to it. Each connection carries a single JSON
+// controlRequest, answered in the manner of the op it names.
+
+type controlRequest struct {
+	// "unmount", "stats", "prefetch" or "verify-cache".
+	Op string `json:"op"`
+
+	// For "unmount", how long to spend writing out dirty files and waiting for
+	// the file system to stop being busy. Zero means the mount's
+	// --shutdown-timeout.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// For "prefetch", the paths of the files to fetch, relative to the mount
+	// point.
+	Paths []string `json:"paths,omitempty"`
+
+	// For "verify-cache", whether to leave content that fails verification in
+	// the cache, only reporting it.
+	ReportOnly bool `json:"report_only,omitempty"`
+
+	// For "prefetch" and "verify-cache", how many objects to work on at once.
+	Parallelism int `json:"parallelism,omitempty"`
+}
+
+// Return the path of the control socket for the process serving the supplied
+// absolute mount point. It lives in a directory belonging to the current user,
+// so only they can use it. The directory is fixed rather than chosen by
+// $TMPDIR, since the daemon doesn't inherit the environment.
+func controlSocketPath(mountPoint string) string {
+	sum := sha256.Sum256([]byte(mountPoint))
+	return path.Join(
+		"/tmp",
+		fmt.Sprintf("gcsfuse-%d", os.Getuid()),
+		hex.EncodeToString(sum[:8])+".sock")
+}
+
+// Connect to the process serving the supplied absolute mount point and send
+// it the supplied request, returning the connection on which it will reply.
+func dialControl(
+	mountPoint string,
+	req *controlRequest) (conn net.Conn, err error) {
+	conn, err = net.Dial("unix", controlSocketPath(mountPoint))
+	if err != nil {
+		err = fmt.Errorf(
+			"Couldn't reach a gcsfuse process serving %s as this user: %v",
+			mountPoint,
+			err)
+		return
+	}
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		conn.Close()
+		err = fmt.Errorf("Sending request: %v", err)
+		return
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Daemon
+////////////////////////////////////////////////////////////////////////
+
+type controlListener struct {
+	mountPoint     string
+	t              *tunables
+	defaultTimeout time.Duration
+	l              net.Listener
+
+	// Held while serving an unmount request, so that they are served one at a
+	// time.
+	unmountMu sync.Mutex
+
+	// Requests in progress, waited for by Close.
+	wg sync.WaitGroup
+}
+
+// Listen for requests for the supplied mount point, whose file system and the
+// layers beneath it are recorded in t, serving them until Close is called.
+func listenForControl(
+	mountPoint string,
+	t *tunables,
+	defaultTimeout time.Duration) (cl *controlListener, err error) {
+	p := controlSocketPath(mountPoint)
+
+	dir := path.Dir(p)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	// Make sure nobody else made the directory first, and so could answer
+	// requests in our place.
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		err = fmt.Errorf("Lstat: %v", err)
+		return
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.IsDir() || !ok || int(st.Uid) != os.Getuid() || fi.Mode().Perm() != 0700 {
+		err = fmt.Errorf("%s isn't a directory accessible only by us", dir)
+		return
+	}
+
+	// Any socket already there was left by a process that didn't exit cleanly.
+	os.Remove(p)
+
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	cl = &controlListener{
+		mountPoint:     mountPoint,
+		t:              t,
+		defaultTimeout: defaultTimeout,
+		l:              l,
+	}
+
+	go cl.serve()
+	return
+}
+
+// Stop listening, and wait for any request in progress to be answered.
+func (cl *controlListener) Close() {
+	cl.l.Close()
+	cl.wg.Wait()
+}
+
+func (cl *controlListener) serve() {
+	for {
+		conn, err := cl.l.Accept()
+		if err != nil {
+			return
+		}
+
+		cl.wg.Add(1)
+		go func() {
+			defer cl.wg.Done()
+			defer conn.Close()
+			cl.handle(conn)
+		}()
+	}
+}
+
+func (cl *controlListener) handle(conn net.Conn) {
+	var req controlRequest
+	err := json.NewDecoder(conn).Decode(&req)
+	if err != nil {
+		logger.Errorf("Reading control request: %v", err)
+		return
+	}
+
+	switch req.Op {
+	case "unmount":
+		cl.handleUnmount(conn, &req)
+
+	case "stats":
+		cl.handleStats(conn)
+
+	case "prefetch":
+		cl.handlePrefetch(conn, &req)
+
+	case "verify-cache":
+		cl.handleVerifyCache(conn, &req)
+
+	default:
+		logger.Errorf("Unknown control request: %q", req.Op)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Sends events to a requester from concurrent workers, cancelling the work if
+// the requester goes away.
+type eventReporter struct {
+	cancel func()
+
+	mu  sync.Mutex
+	enc *json.Encoder // GUARDED_BY(mu)
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *eventReporter) send(e interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.enc.Encode(e)
+	if err != nil {
+		r.cancel()
+	}
+}
+
+// Call f with each integer in [0, n), up to parallelism calls at a time,
+// giving up early if the context is cancelled.
+func runParallel(
+	ctx context.Context,
+	parallelism int,
+	n int,
+	f func(ctx context.Context, i int)) (err error) {
+	b := syncutil.NewBundle(ctx)
+
+	indices := make(chan int)
+	b.Add(func(ctx context.Context) (err error) {
+		defer close(indices)
+		for i := 0; i < n; i++ {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			}
+		}
+
+		return
+	})
+
+	for i := 0; i < parallelism; i++ {
+		b.Add(func(ctx context.Context) (err error) {
+			for i := range indices {
+				f(ctx, i)
+			}
+
+			return
+		})
+	}
+
+	err = b.Join()
+	return
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+)
+
+// Parse the values of --dir-override, each a directory followed by
+// space-separated "name=value" settings, such as
+//
+//	static/ stat-cache-ttl=1h type-cache-ttl=1h read-only=true
+//
+// The settings are stat-cache-ttl, type-cache-ttl, read-only, and
+// ignore-pattern and include-pattern, which may be repeated and replace the
+// patterns given by the flags of the same names.
+func parseDirOverrides(specs []string) (overrides []fs.DirOverride, err error) {
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) < 2 {
+			err = fmt.Errorf("Expected a directory and settings, got %q", spec)
+			return
+		}
+
+		o := fs.DirOverride{
+			Prefix: strings.Trim(fields[0], "/") + "/",
+		}
+
+		if o.Prefix == "/" {
+			err = fmt.Errorf("Use the flags themselves to configure the root: %q", spec)
+			return
+		}
+
+		if seen[o.Prefix] {
+			err = fmt.Errorf("Directory %q is overridden twice", o.Prefix)
+			return
+		}
+
+		seen[o.Prefix] = true
+
+		var ignore, include []string
+		for _, setting := range fields[1:] {
+			i := strings.Index(setting, "=")
+			if i <= 0 {
+				err = fmt.Errorf("Expected \"name=value\", got %q in %q", setting, spec)
+				return
+			}
+
+			name := setting[:i]
+			value := setting[i+1:]
+
+			switch name {
+			case "stat-cache-ttl":
+				o.InodeAttributeCacheTTL = new(time.Duration)
+				*o.InodeAttributeCacheTTL, err = time.ParseDuration(value)
+
+			case "type-cache-ttl":
+				o.DirTypeCacheTTL = new(time.Duration)
+				*o.DirTypeCacheTTL, err = time.ParseDuration(value)
+
+			case "read-only":
+				o.ReadOnly, err = strconv.ParseBool(value)
+
+			case "ignore-pattern":
+				ignore = append(ignore, value)
+
+			case "include-pattern":
+				include = append(include, value)
+
+			default:
+				err = fmt.Errorf("Unknown setting %q in %q", name, spec)
+				return
+			}
+
+			if err != nil {
+				err = fmt.Errorf("%s in %q: %v", name, spec, err)
+				return
+			}
+		}
+
+		if len(ignore) > 0 || len(include) > 0 {
+			o.NameFilter, err = inode.NewNameFilter(ignore, include)
+			if err != nil {
+				err = fmt.Errorf("NewNameFilter: %v", err)
+				return
+			}
+		}
+
+		overrides = append(overrides, o)
+	}
+
+	return
+}
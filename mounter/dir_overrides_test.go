@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDirOverrides(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DirOverridesTest struct {
+}
+
+func init() { RegisterTestSuite(&DirOverridesTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DirOverridesTest) None() {
+	overrides, err := parseDirOverrides(nil)
+	AssertEq(nil, err)
+	ExpectEq(0, len(overrides))
+}
+
+func (t *DirOverridesTest) Parse() {
+	overrides, err := parseDirOverrides([]string{
+		"static stat-cache-ttl=1h type-cache-ttl=30m read-only=true",
+		"/incoming/deep/  stat-cache-ttl=0 ignore-pattern=*.part " +
+			"ignore-pattern=*.tmp",
+	})
+
+	AssertEq(nil, err)
+	AssertEq(2, len(overrides))
+
+	o := overrides[0]
+	ExpectEq("static/", o.Prefix)
+	AssertNe(nil, o.InodeAttributeCacheTTL)
+	ExpectEq(time.Hour, *o.InodeAttributeCacheTTL)
+	AssertNe(nil, o.DirTypeCacheTTL)
+	ExpectEq(30*time.Minute, *o.DirTypeCacheTTL)
+	ExpectTrue(o.ReadOnly)
+	ExpectEq(nil, o.NameFilter)
+
+	o = overrides[1]
+	ExpectEq("incoming/deep/", o.Prefix)
+	AssertNe(nil, o.InodeAttributeCacheTTL)
+	ExpectEq(0, *o.InodeAttributeCacheTTL)
+	ExpectEq(nil, o.DirTypeCacheTTL)
+	ExpectFalse(o.ReadOnly)
+	AssertNe(nil, o.NameFilter)
+	ExpectFalse(o.NameFilter.Visible("foo.part", false))
+	ExpectFalse(o.NameFilter.Visible("foo.tmp", false))
+	ExpectTrue(o.NameFilter.Visible("foo", false))
+}
+
+func (t *DirOverridesTest) Errors() {
+	testCases := []struct {
+		spec   string
+		errSub string
+	}{
+		{"static/", "Expected a directory and settings"},
+		{"/ read-only=true", "root"},
+		{"static/ read-only", "name=value"},
+		{"static/ read-only=maybe", "read-only"},
+		{"static/ stat-cache-ttl=5", "stat-cache-ttl"},
+		{"static/ taco=1", "Unknown setting"},
+		{"static/ ignore-pattern=[", "NewNameFilter"},
+	}
+
+	for _, tc := range testCases {
+		_, err := parseDirOverrides([]string{tc.spec})
+		ExpectThat(err, Error(HasSubstr(tc.errSub)), "spec: %q", tc.spec)
+	}
+
+	_, err := parseDirOverrides([]string{
+		"static/ read-only=true",
+		"/static read-only=false",
+	})
+
+	ExpectThat(err, Error(HasSubstr("twice")))
+}
@@ -0,0 +1,924 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	mountpkg "github.com/googlecloudplatform/gcsfuse/internal/mount"
+)
+
+// Set up custom help text for gcsfuse; in particular the usage section.
+func init() {
+	cli.AppHelpTemplate = `NAME:
+   {{.Name}} - {{.Usage}}
+
+USAGE:
+   {{.Name}} {{if .Flags}}[global options]{{end}} bucket mountpoint
+   {{.Name}} {{if .Flags}}[global options]{{end}} ls-buckets [--project id]
+   {{.Name}} unmount [--timeout duration] mountpoint
+   {{.Name}} stats mountpoint
+   {{.Name}} prefetch [--parallelism n] mountpoint manifest
+   {{.Name}} verify-cache [--report-only] [--parallelism n] mountpoint
+   {{if .Version}}
+VERSION:
+   {{.Version}}
+   {{end}}{{if len .Authors}}
+AUTHOR(S):
+   {{range .Authors}}{{ . }}{{end}}
+   {{end}}{{if .Flags}}
+GLOBAL OPTIONS:
+   {{range .Flags}}{{.}}
+   {{end}}{{end}}{{if .Copyright }}
+COPYRIGHT:
+   {{.Copyright}}
+   {{end}}
+`
+}
+
+func newApp(version string) (app *cli.App) {
+	dirModeValue := new(OctalInt)
+	*dirModeValue = 0755
+
+	fileModeValue := new(OctalInt)
+	*fileModeValue = 0644
+
+	app = &cli.App{
+		Name:    "gcsfuse",
+		Version: version,
+		Usage:   "Mount a GCS bucket locally",
+		Writer:  os.Stderr,
+		Flags: []cli.Flag{
+
+			cli.BoolFlag{
+				Name:  "foreground",
+				Usage: "Stay in the foreground after mounting.",
+			},
+
+			cli.StringFlag{
+				Name:  "config-file",
+				Value: "",
+				Usage: "Path to a YAML or JSON file mapping flag names to values, " +
+					"for flags not given on the command line. The file is read " +
+					"again on SIGHUP, applying --log-severity, --stat-cache-ttl, " +
+					"--type-cache-ttl, --limit-ops-per-sec and " +
+					"--limit-bytes-per-sec without remounting. (default: none)",
+			},
+
+			/////////////////////////
+			// File system
+			/////////////////////////
+
+			cli.StringSliceFlag{
+				Name:  "o",
+				Usage: "Additional system-specific mount options. Be careful!",
+			},
+
+			cli.GenericFlag{
+				Name:  "dir-mode",
+				Value: dirModeValue,
+				Usage: "Permissions bits for directories, in octal.",
+			},
+
+			cli.GenericFlag{
+				Name:  "file-mode",
+				Value: fileModeValue,
+				Usage: "Permission bits for files, in octal.",
+			},
+
+			cli.IntFlag{
+				Name:  "uid",
+				Value: -1,
+				Usage: "UID owner of all inodes.",
+			},
+
+			cli.IntFlag{
+				Name:  "gid",
+				Value: -1,
+				Usage: "GID owner of all inodes.",
+			},
+
+			cli.GenericFlag{
+				Name:  "access-uids",
+				Value: new(UidList),
+				Usage: "Comma-separated UIDs of the only local users allowed to use " +
+					"the mount. Everyone else, including root, gets EACCES whatever " +
+					"the permission bits. Useful with -o allow_other. (default: no " +
+					"restriction)",
+			},
+
+			cli.BoolFlag{
+				Name: "implicit-dirs",
+				Usage: "Implicitly define directories based on content. See " +
+					"docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "only-dir",
+				Usage: "Mount only the given directory, relative to the bucket root.",
+			},
+
+			cli.StringFlag{
+				Name:  "normalize-names",
+				Value: "",
+				Usage: "Unicode normalization form (nfc or nfd) to apply to file " +
+					"names on lookup and creation, so that names written by macOS " +
+					"and Linux clients refer to the same objects. See " +
+					"docs/semantics.md (default: none)",
+			},
+
+			cli.BoolFlag{
+				Name: "case-insensitive",
+				Usage: "Let a name that matches no file or directory refer to " +
+					"one whose name differs only in case, e.g. for sharing the " +
+					"mount with Samba. See docs/semantics.md",
+			},
+
+			cli.StringFlag{
+				Name:  "dir-order",
+				Value: "name",
+				Usage: "Order of directory listings: name, or dirs-first to list " +
+					"directories before files and symlinks, each ordered by name.",
+			},
+
+			cli.StringSliceFlag{
+				Name: "ignore-pattern",
+				Usage: "Hide files and directories whose names match this glob, " +
+					"or directories only if it ends in a slash. May be repeated. " +
+					"See docs/semantics.md",
+			},
+
+			cli.StringSliceFlag{
+				Name: "include-pattern",
+				Usage: "Hide files and symlinks whose names match none of the " +
+					"globs given with this flag. May be repeated.",
+			},
+
+			cli.StringSliceFlag{
+				Name: "dir-override",
+				Usage: "Settings for a directory and its contents, in place of " +
+					"the flags, e.g. \"static/ stat-cache-ttl=1h " +
+					"read-only=true\". May be repeated. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "hide-denied-dirs",
+				Usage: "Hide directories that GCS refuses to let us list, e.g. " +
+					"because of managed folder IAM policies, rather than " +
+					"failing to read them with EACCES. See docs/semantics.md",
+			},
+
+			cli.IntFlag{
+				Name:  "max-depth",
+				Value: 0,
+				Usage: "Assume that no object is nested more than this many " +
+					"levels below the mount's root, e.g. 1 for a bucket with " +
+					"only top-level objects, and don't look for directories " +
+					"any deeper. See docs/semantics.md (default: 0, unlimited)",
+			},
+
+			cli.BoolFlag{
+				Name: "recursive-rmdir",
+				Usage: "Make rmdir of a non-empty directory delete everything " +
+					"within it, many objects at a time, so that rm -r needn't " +
+					"visit each file. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "control-dir",
+				Usage: "Add a directory named .gcsfuse at the root of the mount, " +
+					"holding files through which to inspect the mount and " +
+					"discard its caches. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "nfs-export",
+				Usage: "Allow the mount to be re-exported over NFS by the kernel's " +
+					"NFS server. See docs/mounting.md",
+			},
+
+			cli.BoolFlag{
+				Name: "disable-locking",
+				Usage: "Fail flock and fcntl lock requests with ENOTSUP, rather " +
+					"than granting locks that exclude only processes on this " +
+					"machine. See docs/semantics.md",
+			},
+
+			cli.BoolFlag{
+				Name: "disable-apple-noise",
+				Usage: "Hide and refuse to create the ._* and .DS_Store files " +
+					"left by the macOS Finder, and discard its com.apple.* " +
+					"extended attributes. See docs/semantics.md",
+			},
+
+			/////////////////////////
+			// GCS
+			/////////////////////////
+
+			cli.StringFlag{
+				Name:  "backend",
+				Value: "gcs",
+				Usage: "Where buckets are stored: gcs, or memory for an empty bucket " +
+					"that is discarded when unmounted, for testing.",
+			},
+
+			cli.StringFlag{
+				Name:  "key-file",
+				Value: "",
+				Usage: "Path to JSON key file for use with GCS. " +
+					"(default: none, Google application default credentials used)",
+			},
+
+			cli.StringFlag{
+				Name:  "ca-cert",
+				Value: "",
+				Usage: "Path to a PEM file of CA certificates to trust, in addition " +
+					"to the system's, when connecting to GCS, such as that of a " +
+					"TLS-intercepting proxy. Proxies are taken from HTTPS_PROXY and " +
+					"NO_PROXY. (default: none)",
+			},
+
+			cli.StringSliceFlag{
+				Name: "request-header",
+				Usage: "A header, as \"Name: value\", to send with every request " +
+					"to GCS, such as \"X-Goog-Request-Reason: team-foo\" to " +
+					"attribute the mount's access in audit logs. May be repeated.",
+			},
+
+			cli.DurationFlag{
+				Name:  "signed-url-expiry",
+				Value: 0,
+				Usage: "If non-zero, give files a user.gcsfuse.signed_url extended " +
+					"attribute holding a V4 signed URL for their object that " +
+					"expires after this long, at most 168h. Requires --key-file. " +
+					"(default: 0, no such attribute)",
+			},
+
+			cli.StringFlag{
+				Name: "storage-class",
+				Usage: "The storage class, such as NEARLINE or COLDLINE, to give " +
+					"new objects. Existing objects keep theirs when rewritten. A " +
+					"file's user.gcsfuse.storage_class extended attribute may be " +
+					"set to choose another. (default: the bucket's default class)",
+			},
+
+			cli.StringFlag{
+				Name: "notification-subscription",
+				Usage: "A Pub/Sub subscription, as projects/PROJECT/subscriptions/" +
+					"NAME, receiving the bucket's object change notifications. " +
+					"Changes made by others are then seen at once rather than " +
+					"when caches expire. Messages are acknowledged as they are " +
+					"received, so each mount needs its own subscription. See " +
+					"docs/semantics.md (default: none)",
+			},
+
+			cli.Float64Flag{
+				Name:  "limit-bytes-per-sec",
+				Value: -1,
+				Usage: "Bandwidth limit for reading data, measured over a 30-second " +
+					"window. (use -1 for no limit)",
+			},
+
+			cli.BoolFlag{
+				Name: "limit-bytes-per-sec-fair-share",
+				Usage: "Divide the bandwidth allowed by --limit-bytes-per-sec fairly " +
+					"among open file handles, so that one large read can't starve " +
+					"others.",
+			},
+
+			cli.DurationFlag{
+				Name:  "read-stall-timeout",
+				Value: 0,
+				Usage: "If a read from GCS makes no progress for this long, abort it " +
+					"and request the rest of the range again. (default: 0, wait " +
+					"indefinitely)",
+			},
+
+			cli.DurationFlag{
+				Name:  "max-retry-sleep",
+				Value: 30 * time.Second,
+				Usage: "The maximum time to sleep between attempts when retrying a " +
+					"GCS request that failed with a transient error. (use 0 to " +
+					"disable retries)",
+			},
+
+			cli.Float64Flag{
+				Name:  "retry-multiplier",
+				Value: 2,
+				Usage: "The factor by which the sleep between retries grows with " +
+					"each attempt.",
+			},
+
+			cli.Float64Flag{
+				Name:  "retry-budget",
+				Value: 0.1,
+				Usage: "The number of retries allowed, as a fraction of the number " +
+					"of GCS requests made, so that an outage doesn't cause a storm " +
+					"of retries.",
+			},
+
+			cli.Float64Flag{
+				Name:  "limit-ops-per-sec",
+				Value: 5.0,
+				Usage: "Operations per second limit, measured over a 30-second window " +
+					"(use -1 for no limit)",
+			},
+
+			/////////////////////////
+			// Tuning
+			/////////////////////////
+
+			cli.DurationFlag{
+				Name:  "stat-cache-ttl",
+				Value: time.Minute,
+				Usage: "How long to cache StatObject results and inode attributes.",
+			},
+
+			cli.IntFlag{
+				Name:  "stat-cache-capacity",
+				Value: 4096,
+				Usage: "How many StatObject results to cache. Directory listings " +
+					"fill the cache with the objects they return, so listing a " +
+					"directory and then statting every entry only avoids " +
+					"further requests to GCS if this exceeds the number of " +
+					"entries.",
+			},
+
+			cli.DurationFlag{
+				Name:  "type-cache-ttl",
+				Value: time.Minute,
+				Usage: "How long to cache name -> file/dir mappings in directory " +
+					"inodes.",
+			},
+
+			cli.DurationFlag{
+				Name:  "listing-cache-ttl",
+				Value: 0,
+				Usage: "How long to cache directory listings, so that listing a " +
+					"directory again doesn't ask GCS. Children created or " +
+					"deleted by other clients may go unnoticed in listings for " +
+					"this long. (default: 0, don't cache)",
+			},
+
+			cli.DurationFlag{
+				Name:  "kernel-entry-cache-ttl",
+				Value: 0,
+				Usage: "How long the kernel may cache name lookups without " +
+					"asking gcsfuse. Objects created or deleted by other clients " +
+					"may go unnoticed for this long. (default: 0, don't cache)",
+			},
+
+			cli.DurationFlag{
+				Name:  "kernel-attr-cache-ttl",
+				Value: 0,
+				Usage: "How long the kernel may cache inode attributes without " +
+					"asking gcsfuse. (default: until gcsfuse's own cached " +
+					"attributes expire, per --stat-cache-ttl)",
+			},
+
+			cli.IntFlag{
+				Name:  "inode-table-size",
+				Value: 0,
+				Usage: "Keep inodes the kernel has forgotten for reuse while there " +
+					"are no more than this many in total, destroying the least " +
+					"recently forgotten beyond that. (default: 0, destroy them right " +
+					"away)",
+			},
+
+			cli.StringFlag{
+				Name:  "temp-dir",
+				Value: "",
+				Usage: "Path to temporary directory for local GCS object " +
+					"copies. (default: system default, likely /tmp)",
+			},
+
+			cli.IntFlag{
+				Name:  "spill-threshold-kb",
+				Value: 64,
+				Usage: "Keep the contents of modified files in memory until they " +
+					"grow beyond this many KiB, and only then move them to " +
+					"--temp-dir. 0 means always use --temp-dir. Ignored with " +
+					"--staging-dir.",
+			},
+
+			cli.IntFlag{
+				Name:  "temp-dir-min-free-mb",
+				Value: 0,
+				Usage: "Fail writes to modified files with ENOSPC if they would leave " +
+					"less than this many MiB free on the file system holding " +
+					"--staging-dir, or --temp-dir if none. Writes that don't fit at " +
+					"all fail the same way regardless.",
+			},
+
+			cli.StringFlag{
+				Name:  "staging-dir",
+				Value: "",
+				Usage: "Directory in which to keep the contents of modified files " +
+					"until they are written to GCS, so that writes interrupted by a " +
+					"crash are resumed by the next mount. (default: none, use " +
+					"anonymous files in --temp-dir)",
+			},
+
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "",
+				Usage: "Directory in which to keep copies of objects fetched by " +
+					"the prefetch command, across mounts, serving reads of those " +
+					"generations from there. (default: none)",
+			},
+
+			cli.IntFlag{
+				Name:  "cache-max-size-mb",
+				Value: 0,
+				Usage: "Refuse to prefetch objects into --cache-dir beyond this many " +
+					"MiB in total. 0 means no limit.",
+			},
+
+			cli.StringFlag{
+				Name:  "encryption-key-file",
+				Value: "",
+				Usage: "Path to a file holding a base64-encoded 32-byte key with " +
+					"which to encrypt, using AES-256-GCM, the contents of modified " +
+					"files kept in --temp-dir or --staging-dir, and objects kept in " +
+					"--cache-dir. (default: none, store them unencrypted)",
+			},
+
+			cli.DurationFlag{
+				Name:  "offline-retry-interval",
+				Value: 0,
+				Usage: "If non-zero, when a modified file can't be written because GCS " +
+					"is unreachable, queue the write in --staging-dir and retry it at " +
+					"this interval, reporting a conflict if the object has changed " +
+					"in the meantime. With --cache-dir, also keep copies of the " +
+					"objects read, and serve them while GCS is unreachable. " +
+					"(default: return an error)",
+			},
+
+			cli.IntFlag{
+				Name:  "max-concurrent-uploads",
+				Value: 16,
+				Usage: "The maximum number of modified files to write to GCS at " +
+					"once. Further flushes and syncs wait their turn in the order " +
+					"they arrive. 0 means no limit.",
+			},
+
+			cli.BoolFlag{
+				Name: "streaming-writes",
+				Usage: "Pass writes that fill a new or truncated file from the " +
+					"start straight on to GCS, without staging them in " +
+					"--temp-dir. Such files can't be read, or written out of " +
+					"order, until closed.",
+			},
+
+			cli.DurationFlag{
+				Name:  "flush-interval",
+				Value: 0,
+				Usage: "If non-zero, write the contents of modified files to GCS " +
+					"at this interval while they are open, as well as when they " +
+					"are synced or closed. (default: 0, only when synced or closed)",
+			},
+
+			cli.DurationFlag{
+				Name:  "write-lease-ttl",
+				Value: 0,
+				Usage: "If non-zero, take a lease of this duration, renewed while " +
+					"writing, in an object's metadata before modifying its file, " +
+					"and fail with EBUSY to modify a file another mount has leased. " +
+					"Only effective if all writing mounts use it. (default: 0, " +
+					"no leases)",
+			},
+
+			cli.DurationFlag{
+				Name:  "metadata-op-timeout",
+				Value: 0,
+				Usage: "Fail file system operations other than reads, writes, " +
+					"flushes and syncs with ETIMEDOUT if they take longer than this. " +
+					"(default: 0, no timeout)",
+			},
+
+			cli.DurationFlag{
+				Name:  "data-op-timeout",
+				Value: 0,
+				Usage: "Fail reads, writes, flushes and syncs with ETIMEDOUT if they " +
+					"take longer than this. (default: 0, no timeout)",
+			},
+
+			cli.DurationFlag{
+				Name:  "shutdown-timeout",
+				Value: 30 * time.Second,
+				Usage: "On SIGINT or SIGTERM, how long to spend writing out dirty " +
+					"files and waiting for open files to be closed before reporting " +
+					"the files not written out and unmounting regardless.",
+			},
+
+			cli.DurationFlag{
+				Name:  "unmount-after-idle",
+				Value: 0,
+				Usage: "Write out dirty files and unmount once no file system " +
+					"operation has been served and no file has been open for this " +
+					"long, as for mounts made on demand by an automounter. " +
+					"(default: never)",
+			},
+
+			cli.IntFlag{
+				Name:  "statfs-capacity-gb",
+				Value: 0,
+				Usage: "Capacity in GiB to report for the file system to statfs(2) " +
+					"and tools like df. (default: 0, a very large capacity)",
+			},
+
+			cli.DurationFlag{
+				Name:  "statfs-usage-ttl",
+				Value: 0,
+				Usage: "If non-zero, list the bucket to report the space and inodes " +
+					"it uses to statfs(2), repeating the listing when the result is " +
+					"older than this. (default: 0, report nothing as used)",
+			},
+
+			/////////////////////////
+			// Logging
+			/////////////////////////
+
+			cli.StringFlag{
+				Name:  "log-file",
+				Value: "",
+				Usage: "Path to a file to which log records are appended. " +
+					"(default: stderr)",
+			},
+
+			cli.StringFlag{
+				Name:  "log-format",
+				Value: "text",
+				Usage: "Format for log records: text or json.",
+			},
+
+			cli.StringFlag{
+				Name:  "log-severity",
+				Value: "debug",
+				Usage: "Discard log records less severe than this: debug, info, " +
+					"warning or error.",
+			},
+
+			cli.StringFlag{
+				Name:  "audit-log",
+				Value: "",
+				Usage: "Path to a file to which a JSON record is appended " +
+					"for each object created, modified, or deleted through the " +
+					"mount, naming the UID and PID of the process responsible. " +
+					"(default: none)",
+			},
+
+			cli.BoolFlag{
+				Name: "dry-run",
+				Usage: "Don't modify anything in GCS. Operations that modify files " +
+					"succeed as usual, and the file system shows their effects until " +
+					"unmounted, but each object that would be created, modified, or " +
+					"deleted is logged instead.",
+			},
+
+			/////////////////////////
+			// Debugging
+			/////////////////////////
+
+			cli.BoolFlag{
+				Name: "debug_fuse, debug-fuse",
+				Usage: "Enable fuse-related debugging output, including a summary of " +
+					"each file system op with its latency and errno.",
+			},
+
+			cli.BoolFlag{
+				Name:  "debug_gcs, debug-gcs",
+				Usage: "Print GCS request and timing information.",
+			},
+
+			cli.BoolFlag{
+				Name:  "debug_http",
+				Usage: "Dump HTTP requests and responses to/from GCS.",
+			},
+
+			cli.BoolFlag{
+				Name:  "debug_invariants",
+				Usage: "Panic when internal invariants are violated.",
+			},
+
+			cli.IntFlag{
+				Name:  "pprof-port",
+				Value: -1,
+				Usage: "Serve net/http/pprof profiles on this port on localhost. " +
+					"(default: disabled)",
+			},
+
+			cli.IntFlag{
+				Name:  "metrics-port",
+				Value: -1,
+				Usage: "Serve metrics such as op latency histograms on this port on " +
+					"localhost, at /metrics in Prometheus text format. " +
+					"(default: disabled)",
+			},
+
+			cli.IntFlag{
+				Name:  "health-port",
+				Value: -1,
+				Usage: "Serve a health check on this port on localhost, at /healthz, " +
+					"which fails if the file system or the bucket is unreachable. " +
+					"Suitable for a liveness probe. (default: disabled)",
+			},
+
+			cli.StringFlag{
+				Name:  "otlp-traces-endpoint",
+				Value: "",
+				Usage: "URL of an OpenTelemetry collector to which traces of fuse " +
+					"operations and the GCS requests they cause are sent, using " +
+					"OTLP/HTTP with JSON encoding. " +
+					"(e.g. http://localhost:4318/v1/traces; default: no tracing)",
+			},
+		},
+	}
+
+	return
+}
+
+type flagStorage struct {
+	Foreground bool
+	ConfigFile string
+
+	// File system
+	MountOptions      map[string]string
+	DirMode           os.FileMode
+	FileMode          os.FileMode
+	Uid               int64
+	Gid               int64
+	AccessUids        []uint32
+	ImplicitDirs      bool
+	OnlyDir           string
+	NormalizeNames    string
+	CaseInsensitive   bool
+	DirOrder          string
+	IgnorePatterns    []string
+	IncludePatterns   []string
+	DirOverrides      []string
+	HideDeniedDirs    bool
+	MaxDepth          int
+	RecursiveRmDir    bool
+	ControlDir        bool
+	DisableAppleNoise bool
+	NFSExport         bool
+	DisableLocking    bool
+
+	// GCS
+	Backend                            string
+	KeyFile                            string
+	CACert                             string
+	RequestHeaders                     []string
+	SignedURLExpiry                    time.Duration
+	StorageClass                       string
+	NotificationSubscription           string
+	EgressBandwidthLimitBytesPerSecond float64
+	EgressBandwidthFairShare           bool
+	OpRateLimitHz                      float64
+	ReadStallTimeout                   time.Duration
+	MaxRetrySleep                      time.Duration
+	RetryMultiplier                    float64
+	RetryBudget                        float64
+
+	// Tuning
+	StatCacheTTL         time.Duration
+	StatCacheCapacity    int
+	TypeCacheTTL         time.Duration
+	ListingCacheTTL      time.Duration
+	KernelEntryCacheTTL  time.Duration
+	KernelAttrCacheTTL   time.Duration
+	InodeTableSize       int
+	TempDir              string
+	SpillThresholdKB     int
+	TempDirMinFreeMB     int
+	StagingDir           string
+	CacheDir             string
+	CacheMaxSizeMB       int
+	EncryptionKeyFile    string
+	OfflineRetryInterval time.Duration
+	MaxConcurrentUploads int
+	WriteLeaseTTL        time.Duration
+	StreamingWrites      bool
+	FlushInterval        time.Duration
+	MetadataOpTimeout    time.Duration
+	DataOpTimeout        time.Duration
+	ShutdownTimeout      time.Duration
+	UnmountAfterIdle     time.Duration
+	StatFSCapacityGB     int
+	StatFSUsageTTL       time.Duration
+
+	// Logging
+	LogFile     string
+	LogFormat   string
+	LogSeverity string
+	AuditLog    string
+	DryRun      bool
+
+	// Debugging
+	DebugFuse       bool
+	DebugGCS        bool
+	DebugHTTP       bool
+	DebugInvariants bool
+	PprofPort       int
+	MetricsPort     int
+	HealthPort      int
+	OTLPEndpoint    string
+}
+
+// Add the flags accepted by run to the supplied flag set, returning the
+// variables into which the flags will parse.
+func populateFlags(c *cli.Context) (flags *flagStorage) {
+	flags = &flagStorage{
+		Foreground: c.Bool("foreground"),
+		ConfigFile: c.String("config-file"),
+
+		// File system
+		MountOptions:      make(map[string]string),
+		DirMode:           os.FileMode(*c.Generic("dir-mode").(*OctalInt)),
+		FileMode:          os.FileMode(*c.Generic("file-mode").(*OctalInt)),
+		Uid:               int64(c.Int("uid")),
+		Gid:               int64(c.Int("gid")),
+		AccessUids:        []uint32(*c.Generic("access-uids").(*UidList)),
+		ImplicitDirs:      c.Bool("implicit-dirs"),
+		OnlyDir:           c.String("only-dir"),
+		NormalizeNames:    c.String("normalize-names"),
+		CaseInsensitive:   c.Bool("case-insensitive"),
+		DirOrder:          c.String("dir-order"),
+		IgnorePatterns:    c.StringSlice("ignore-pattern"),
+		IncludePatterns:   c.StringSlice("include-pattern"),
+		DirOverrides:      c.StringSlice("dir-override"),
+		HideDeniedDirs:    c.Bool("hide-denied-dirs"),
+		MaxDepth:          c.Int("max-depth"),
+		RecursiveRmDir:    c.Bool("recursive-rmdir"),
+		ControlDir:        c.Bool("control-dir"),
+		DisableAppleNoise: c.Bool("disable-apple-noise"),
+		NFSExport:         c.Bool("nfs-export"),
+		DisableLocking:    c.Bool("disable-locking"),
+
+		// GCS,
+		Backend:                            c.String("backend"),
+		KeyFile:                            c.String("key-file"),
+		CACert:                             c.String("ca-cert"),
+		RequestHeaders:                     c.StringSlice("request-header"),
+		SignedURLExpiry:                    c.Duration("signed-url-expiry"),
+		StorageClass:                       c.String("storage-class"),
+		NotificationSubscription:           c.String("notification-subscription"),
+		EgressBandwidthLimitBytesPerSecond: c.Float64("limit-bytes-per-sec"),
+		EgressBandwidthFairShare:           c.Bool("limit-bytes-per-sec-fair-share"),
+		OpRateLimitHz:                      c.Float64("limit-ops-per-sec"),
+		ReadStallTimeout:                   c.Duration("read-stall-timeout"),
+		MaxRetrySleep:                      c.Duration("max-retry-sleep"),
+		RetryMultiplier:                    c.Float64("retry-multiplier"),
+		RetryBudget:                        c.Float64("retry-budget"),
+
+		// Tuning,
+		StatCacheTTL:         c.Duration("stat-cache-ttl"),
+		StatCacheCapacity:    c.Int("stat-cache-capacity"),
+		TypeCacheTTL:         c.Duration("type-cache-ttl"),
+		ListingCacheTTL:      c.Duration("listing-cache-ttl"),
+		KernelEntryCacheTTL:  c.Duration("kernel-entry-cache-ttl"),
+		KernelAttrCacheTTL:   c.Duration("kernel-attr-cache-ttl"),
+		InodeTableSize:       c.Int("inode-table-size"),
+		TempDir:              c.String("temp-dir"),
+		SpillThresholdKB:     c.Int("spill-threshold-kb"),
+		TempDirMinFreeMB:     c.Int("temp-dir-min-free-mb"),
+		StagingDir:           c.String("staging-dir"),
+		CacheDir:             c.String("cache-dir"),
+		CacheMaxSizeMB:       c.Int("cache-max-size-mb"),
+		EncryptionKeyFile:    c.String("encryption-key-file"),
+		OfflineRetryInterval: c.Duration("offline-retry-interval"),
+		MaxConcurrentUploads: c.Int("max-concurrent-uploads"),
+		WriteLeaseTTL:        c.Duration("write-lease-ttl"),
+		StreamingWrites:      c.Bool("streaming-writes"),
+		FlushInterval:        c.Duration("flush-interval"),
+		MetadataOpTimeout:    c.Duration("metadata-op-timeout"),
+		DataOpTimeout:        c.Duration("data-op-timeout"),
+		ShutdownTimeout:      c.Duration("shutdown-timeout"),
+		UnmountAfterIdle:     c.Duration("unmount-after-idle"),
+		StatFSCapacityGB:     c.Int("statfs-capacity-gb"),
+		StatFSUsageTTL:       c.Duration("statfs-usage-ttl"),
+
+		// Logging
+		LogFile:     c.String("log-file"),
+		LogFormat:   c.String("log-format"),
+		LogSeverity: c.String("log-severity"),
+		AuditLog:    c.String("audit-log"),
+		DryRun:      c.Bool("dry-run"),
+
+		// Debugging,
+		DebugFuse:       c.Bool("debug_fuse"),
+		DebugGCS:        c.Bool("debug_gcs"),
+		DebugHTTP:       c.Bool("debug_http"),
+		DebugInvariants: c.Bool("debug_invariants"),
+		PprofPort:       c.Int("pprof-port"),
+		MetricsPort:     c.Int("metrics-port"),
+		HealthPort:      c.Int("health-port"),
+		OTLPEndpoint:    c.String("otlp-traces-endpoint"),
+	}
+
+	// Handle the repeated "-o" flag.
+	for _, o := range c.StringSlice("o") {
+		mountpkg.ParseOptions(flags.MountOptions, o)
+	}
+
+	return
+}
+
+// Describe the supplied flags, one "Field: value" line each in the order in
+// which flagStorage declares them, for the config file in the control
+// directory. Only the names of request headers are shown, since their values
+// may be credentials.
+func describeFlags(flags *flagStorage) string {
+	var buf bytes.Buffer
+	v := reflect.ValueOf(*flags)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i).Interface()
+
+		if name == "RequestHeaders" {
+			var names []string
+			for _, h := range flags.RequestHeaders {
+				names = append(names, strings.TrimSpace(strings.SplitN(h, ":", 2)[0]))
+			}
+
+			value = names
+		}
+
+		fmt.Fprintf(&buf, "%s: %v\n", name, value)
+	}
+
+	return buf.String()
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain an int flag
+// that is parsed in octal.
+type OctalInt int
+
+var _ cli.Generic = (*OctalInt)(nil)
+
+func (oi *OctalInt) Set(value string) (err error) {
+	tmp, err := strconv.ParseInt(value, 8, 32)
+	if err != nil {
+		err = fmt.Errorf("Parsing as octal: %v", err)
+		return
+	}
+
+	*oi = OctalInt(tmp)
+	return
+}
+
+func (oi OctalInt) String() string {
+	return fmt.Sprintf("%o", oi)
+}
+
+// A cli.Generic that can be used with cli.GenericFlag to obtain a
+// comma-separated list of UIDs.
+type UidList []uint32
+
+var _ cli.Generic = (*UidList)(nil)
+
+func (ul *UidList) Set(value string) (err error) {
+	var uids UidList
+	for _, s := range strings.Split(value, ",") {
+		var uid uint64
+		uid, err = strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			err = fmt.Errorf("Parsing UID %q: %v", s, err)
+			return
+		}
+
+		uids = append(uids, uint32(uid))
+	}
+
+	*ul = uids
+	return
+}
+
+func (ul UidList) String() string {
+	var s []string
+	for _, uid := range ul {
+		s = append(s, strconv.FormatUint(uint64(uid), 10))
+	}
+
+	return strings.Join(s, ",")
+}
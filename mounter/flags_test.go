@@ -0,0 +1,435 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestFlags(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type FlagsTest struct {
+}
+
+func init() { RegisterTestSuite(&FlagsTest{}) }
+
+func parseArgs(args []string) (flags *flagStorage) {
+	// Create a CLI app, and abuse it to snoop on the flags.
+	app := newApp("")
+	app.Action = func(appCtx *cli.Context) {
+		flags = populateFlags(appCtx)
+	}
+
+	// Simulate argv.
+	fullArgs := append([]string{"some_app"}, args...)
+
+	err := app.Run(fullArgs)
+	AssertEq(nil, err)
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *FlagsTest) Defaults() {
+	f := parseArgs([]string{})
+	ExpectEq("", f.ConfigFile)
+
+	// File system
+	ExpectNe(nil, f.MountOptions)
+	ExpectEq(0, len(f.MountOptions), "Options: %v", f.MountOptions)
+
+	ExpectEq(os.FileMode(0755), f.DirMode)
+	ExpectEq(os.FileMode(0644), f.FileMode)
+	ExpectEq(-1, f.Uid)
+	ExpectEq(-1, f.Gid)
+	ExpectEq(0, len(f.AccessUids))
+	ExpectFalse(f.ImplicitDirs)
+	ExpectEq("", f.NormalizeNames)
+	ExpectEq("name", f.DirOrder)
+	ExpectEq(0, len(f.IgnorePatterns))
+	ExpectEq(0, len(f.IncludePatterns))
+	ExpectEq(0, len(f.DirOverrides))
+	ExpectFalse(f.DisableAppleNoise)
+	ExpectFalse(f.NFSExport)
+	ExpectFalse(f.DisableLocking)
+	ExpectFalse(f.CaseInsensitive)
+	ExpectFalse(f.HideDeniedDirs)
+	ExpectEq(0, f.MaxDepth)
+	ExpectFalse(f.RecursiveRmDir)
+	ExpectFalse(f.ControlDir)
+
+	// GCS
+	ExpectEq("gcs", f.Backend)
+	ExpectEq("", f.KeyFile)
+	ExpectEq("", f.CACert)
+	ExpectEq(0, f.SignedURLExpiry)
+	ExpectEq("", f.StorageClass)
+	ExpectEq("", f.NotificationSubscription)
+	ExpectEq(-1, f.EgressBandwidthLimitBytesPerSecond)
+	ExpectFalse(f.EgressBandwidthFairShare)
+	ExpectFalse(f.StreamingWrites)
+	ExpectEq(5, f.OpRateLimitHz)
+	ExpectEq(0, f.ReadStallTimeout)
+	ExpectEq(30*time.Second, f.MaxRetrySleep)
+	ExpectEq(2, f.RetryMultiplier)
+	ExpectEq(0.1, f.RetryBudget)
+
+	// Tuning
+	ExpectEq(time.Minute, f.StatCacheTTL)
+	ExpectEq(4096, f.StatCacheCapacity)
+	ExpectEq(time.Minute, f.TypeCacheTTL)
+	ExpectEq(0, f.ListingCacheTTL)
+	ExpectEq(0, f.KernelEntryCacheTTL)
+	ExpectEq(0, f.KernelAttrCacheTTL)
+	ExpectEq(0, f.InodeTableSize)
+	ExpectEq(64, f.SpillThresholdKB)
+	ExpectEq(0, f.TempDirMinFreeMB)
+	ExpectEq(16, f.MaxConcurrentUploads)
+	ExpectEq(0, f.WriteLeaseTTL)
+	ExpectFalse(f.StreamingWrites)
+	ExpectEq(0, f.FlushInterval)
+	ExpectEq("", f.TempDir)
+	ExpectEq("", f.StagingDir)
+	ExpectEq("", f.CacheDir)
+	ExpectEq(0, f.CacheMaxSizeMB)
+	ExpectEq("", f.EncryptionKeyFile)
+	ExpectEq(0, f.OfflineRetryInterval)
+	ExpectEq(0, f.MetadataOpTimeout)
+	ExpectEq(0, f.DataOpTimeout)
+	ExpectEq(30*time.Second, f.ShutdownTimeout)
+	ExpectEq(0, f.UnmountAfterIdle)
+	ExpectEq(0, f.StatFSCapacityGB)
+	ExpectEq(0, f.StatFSUsageTTL)
+
+	// Logging
+	ExpectEq("", f.LogFile)
+	ExpectEq("text", f.LogFormat)
+	ExpectEq("debug", f.LogSeverity)
+	ExpectEq("", f.AuditLog)
+	ExpectFalse(f.DryRun)
+
+	// Debugging
+	ExpectFalse(f.DebugFuse)
+	ExpectFalse(f.DebugGCS)
+	ExpectFalse(f.DebugHTTP)
+	ExpectFalse(f.DebugInvariants)
+	ExpectEq(-1, f.PprofPort)
+	ExpectEq(-1, f.MetricsPort)
+	ExpectEq(-1, f.HealthPort)
+	ExpectEq("", f.OTLPEndpoint)
+}
+
+func (t *FlagsTest) Bools() {
+	names := []string{
+		"implicit-dirs",
+		"disable-apple-noise",
+		"nfs-export",
+		"disable-locking",
+		"case-insensitive",
+		"hide-denied-dirs",
+		"recursive-rmdir",
+		"control-dir",
+		"limit-bytes-per-sec-fair-share",
+		"streaming-writes",
+		"dry-run",
+		"debug_fuse",
+		"debug_gcs",
+		"debug_http",
+		"debug_invariants",
+	}
+
+	var args []string
+	var f *flagStorage
+
+	// --foo form
+	args = nil
+	for _, n := range names {
+		args = append(args, fmt.Sprintf("-%s", n))
+	}
+
+	f = parseArgs(args)
+	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.DisableAppleNoise)
+	ExpectTrue(f.NFSExport)
+	ExpectTrue(f.DisableLocking)
+	ExpectTrue(f.CaseInsensitive)
+	ExpectTrue(f.HideDeniedDirs)
+	ExpectTrue(f.RecursiveRmDir)
+	ExpectTrue(f.ControlDir)
+	ExpectTrue(f.EgressBandwidthFairShare)
+	ExpectTrue(f.StreamingWrites)
+	ExpectTrue(f.DryRun)
+	ExpectTrue(f.DebugFuse)
+	ExpectTrue(f.DebugGCS)
+	ExpectTrue(f.DebugHTTP)
+	ExpectTrue(f.DebugInvariants)
+
+	// --foo=false form
+	args = nil
+	for _, n := range names {
+		args = append(args, fmt.Sprintf("-%s=false", n))
+	}
+
+	f = parseArgs(args)
+	ExpectFalse(f.ImplicitDirs)
+	ExpectFalse(f.DisableAppleNoise)
+	ExpectFalse(f.NFSExport)
+	ExpectFalse(f.DisableLocking)
+	ExpectFalse(f.CaseInsensitive)
+	ExpectFalse(f.HideDeniedDirs)
+	ExpectFalse(f.RecursiveRmDir)
+	ExpectFalse(f.ControlDir)
+	ExpectFalse(f.EgressBandwidthFairShare)
+	ExpectFalse(f.StreamingWrites)
+	ExpectFalse(f.DryRun)
+	ExpectFalse(f.DebugFuse)
+	ExpectFalse(f.DebugGCS)
+	ExpectFalse(f.DebugHTTP)
+	ExpectFalse(f.DebugInvariants)
+
+	// --foo=true form
+	args = nil
+	for _, n := range names {
+		args = append(args, fmt.Sprintf("-%s=true", n))
+	}
+
+	f = parseArgs(args)
+	ExpectTrue(f.ImplicitDirs)
+	ExpectTrue(f.DisableAppleNoise)
+	ExpectTrue(f.NFSExport)
+	ExpectTrue(f.DisableLocking)
+	ExpectTrue(f.CaseInsensitive)
+	ExpectTrue(f.HideDeniedDirs)
+	ExpectTrue(f.RecursiveRmDir)
+	ExpectTrue(f.ControlDir)
+	ExpectTrue(f.EgressBandwidthFairShare)
+	ExpectTrue(f.StreamingWrites)
+	ExpectTrue(f.DryRun)
+	ExpectTrue(f.DebugFuse)
+	ExpectTrue(f.DebugGCS)
+	ExpectTrue(f.DebugHTTP)
+	ExpectTrue(f.DebugInvariants)
+}
+
+func (t *FlagsTest) HyphenatedDebugFlags() {
+	f := parseArgs([]string{"--debug-fuse", "--debug-gcs"})
+	ExpectTrue(f.DebugFuse)
+	ExpectTrue(f.DebugGCS)
+	ExpectFalse(f.DebugHTTP)
+}
+
+func (t *FlagsTest) DecimalNumbers() {
+	args := []string{
+		"--uid=17",
+		"--gid=19",
+		"--limit-bytes-per-sec=123.4",
+		"--limit-ops-per-sec=56.78",
+		"--pprof-port=6060",
+		"--metrics-port=9100",
+		"--health-port=8081",
+		"--retry-multiplier=1.5",
+		"--retry-budget=0.25",
+		"--statfs-capacity-gb=1024",
+		"--inode-table-size=100000",
+		"--spill-threshold-kb=256",
+		"--temp-dir-min-free-mb=512",
+		"--max-concurrent-uploads=4",
+		"--cache-max-size-mb=2048",
+		"--stat-cache-capacity=65536",
+		"--max-depth=2",
+	}
+
+	f := parseArgs(args)
+	ExpectEq(17, f.Uid)
+	ExpectEq(19, f.Gid)
+	ExpectEq(123.4, f.EgressBandwidthLimitBytesPerSecond)
+	ExpectEq(56.78, f.OpRateLimitHz)
+	ExpectEq(6060, f.PprofPort)
+	ExpectEq(9100, f.MetricsPort)
+	ExpectEq(8081, f.HealthPort)
+	ExpectEq(1.5, f.RetryMultiplier)
+	ExpectEq(0.25, f.RetryBudget)
+	ExpectEq(1024, f.StatFSCapacityGB)
+	ExpectEq(100000, f.InodeTableSize)
+	ExpectEq(256, f.SpillThresholdKB)
+	ExpectEq(512, f.TempDirMinFreeMB)
+	ExpectEq(4, f.MaxConcurrentUploads)
+	ExpectEq(2048, f.CacheMaxSizeMB)
+	ExpectEq(65536, f.StatCacheCapacity)
+	ExpectEq(2, f.MaxDepth)
+}
+
+func (t *FlagsTest) OctalNumbers() {
+	args := []string{
+		"--dir-mode=711",
+		"--file-mode", "611",
+	}
+
+	f := parseArgs(args)
+	ExpectEq(os.FileMode(0711), f.DirMode)
+	ExpectEq(os.FileMode(0611), f.FileMode)
+}
+
+func (t *FlagsTest) Strings() {
+	args := []string{
+		"--backend", "memory",
+		"--key-file", "-asdf",
+		"--ca-cert=/etc/ssl/proxy.pem",
+		"--temp-dir=foobar",
+		"--staging-dir=/var/lib/gcsfuse",
+		"--cache-dir=/var/cache/gcsfuse",
+		"--encryption-key-file=/etc/gcsfuse/key",
+		"--only-dir=baz",
+		"--normalize-names=nfc",
+		"--dir-order=dirs-first",
+		"--otlp-traces-endpoint=http://localhost:4318/v1/traces",
+		"--log-file=/var/log/gcsfuse.log",
+		"--log-format=json",
+		"--log-severity=warning",
+		"--config-file=/etc/gcsfuse.conf",
+		"--audit-log=/var/log/gcsfuse_audit.log",
+		"--storage-class=NEARLINE",
+		"--notification-subscription=projects/p/subscriptions/s",
+	}
+
+	f := parseArgs(args)
+	ExpectEq("memory", f.Backend)
+	ExpectEq("-asdf", f.KeyFile)
+	ExpectEq("/etc/ssl/proxy.pem", f.CACert)
+	ExpectEq("foobar", f.TempDir)
+	ExpectEq("/var/lib/gcsfuse", f.StagingDir)
+	ExpectEq("/var/cache/gcsfuse", f.CacheDir)
+	ExpectEq("/etc/gcsfuse/key", f.EncryptionKeyFile)
+	ExpectEq("baz", f.OnlyDir)
+	ExpectEq("nfc", f.NormalizeNames)
+	ExpectEq("dirs-first", f.DirOrder)
+	ExpectEq("http://localhost:4318/v1/traces", f.OTLPEndpoint)
+	ExpectEq("/var/log/gcsfuse.log", f.LogFile)
+	ExpectEq("json", f.LogFormat)
+	ExpectEq("warning", f.LogSeverity)
+	ExpectEq("/etc/gcsfuse.conf", f.ConfigFile)
+	ExpectEq("/var/log/gcsfuse_audit.log", f.AuditLog)
+	ExpectEq("NEARLINE", f.StorageClass)
+	ExpectEq("projects/p/subscriptions/s", f.NotificationSubscription)
+}
+
+func (t *FlagsTest) Durations() {
+	args := []string{
+		"--stat-cache-ttl", "1m17s",
+		"--type-cache-ttl", "19ns",
+		"--listing-cache-ttl", "3s",
+		"--kernel-entry-cache-ttl", "5s",
+		"--kernel-attr-cache-ttl", "7s",
+		"--read-stall-timeout", "30s",
+		"--max-retry-sleep", "1m",
+		"--metadata-op-timeout", "10s",
+		"--data-op-timeout", "5m",
+		"--shutdown-timeout", "2m",
+		"--unmount-after-idle", "10m",
+		"--statfs-usage-ttl", "1h",
+		"--offline-retry-interval", "45s",
+		"--write-lease-ttl", "3m",
+		"--flush-interval", "30s",
+		"--signed-url-expiry", "24h",
+	}
+
+	f := parseArgs(args)
+	ExpectEq(77*time.Second, f.StatCacheTTL)
+	ExpectEq(19*time.Nanosecond, f.TypeCacheTTL)
+	ExpectEq(3*time.Second, f.ListingCacheTTL)
+	ExpectEq(5*time.Second, f.KernelEntryCacheTTL)
+	ExpectEq(7*time.Second, f.KernelAttrCacheTTL)
+	ExpectEq(30*time.Second, f.ReadStallTimeout)
+	ExpectEq(time.Minute, f.MaxRetrySleep)
+	ExpectEq(10*time.Second, f.MetadataOpTimeout)
+	ExpectEq(5*time.Minute, f.DataOpTimeout)
+	ExpectEq(2*time.Minute, f.ShutdownTimeout)
+	ExpectEq(10*time.Minute, f.UnmountAfterIdle)
+	ExpectEq(time.Hour, f.StatFSUsageTTL)
+	ExpectEq(45*time.Second, f.OfflineRetryInterval)
+	ExpectEq(3*time.Minute, f.WriteLeaseTTL)
+	ExpectEq(30*time.Second, f.FlushInterval)
+	ExpectEq(24*time.Hour, f.SignedURLExpiry)
+}
+
+func (t *FlagsTest) Slices() {
+	args := []string{
+		"--ignore-pattern", "_checkpoints/",
+		"--ignore-pattern=*.tmp",
+		"--include-pattern", "*.csv",
+		"--dir-override", "static/ read-only=true",
+		"--request-header", "X-Goog-Request-Reason: team-foo",
+		"--access-uids", "1000, 1001,0",
+	}
+
+	f := parseArgs(args)
+	ExpectThat(f.IgnorePatterns, ElementsAre("_checkpoints/", "*.tmp"))
+	ExpectThat(f.IncludePatterns, ElementsAre("*.csv"))
+	ExpectThat(f.DirOverrides, ElementsAre("static/ read-only=true"))
+	ExpectThat(f.RequestHeaders, ElementsAre("X-Goog-Request-Reason: team-foo"))
+	ExpectThat(f.AccessUids, ElementsAre(1000, 1001, 0))
+}
+
+func (t *FlagsTest) Maps() {
+	args := []string{
+		"-o", "rw,nodev",
+		"-o", "user=jacobsa,noauto",
+	}
+
+	f := parseArgs(args)
+
+	var keys sort.StringSlice
+	for k := range f.MountOptions {
+		keys = append(keys, k)
+	}
+
+	sort.Sort(keys)
+	AssertThat(keys, ElementsAre("noauto", "nodev", "rw", "user"))
+
+	ExpectEq("", f.MountOptions["noauto"])
+	ExpectEq("", f.MountOptions["nodev"])
+	ExpectEq("", f.MountOptions["rw"])
+	ExpectEq("jacobsa", f.MountOptions["user"])
+}
+
+func (t *FlagsTest) Description() {
+	args := []string{
+		"--implicit-dirs",
+		"--stat-cache-ttl", "77s",
+		"--request-header", "Authorization: Bearer secret",
+	}
+
+	desc := describeFlags(parseArgs(args))
+	ExpectThat(desc, HasSubstr("ImplicitDirs: true\n"))
+	ExpectThat(desc, HasSubstr("StatCacheTTL: 1m17s\n"))
+	ExpectThat(desc, HasSubstr("RequestHeaders: [Authorization]\n"))
+	ExpectFalse(strings.Contains(desc, "secret"), "%s", desc)
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// The name of an object that is stat'ed to check that the bucket is
+// reachable. It needn't exist.
+const healthCheckObjectName = ".gcsfuse_health_check"
+
+// How long a health check may take before it fails.
+const healthCheckTimeout = 10 * time.Second
+
+// Stats the mount point for health checks. Replaced by tests.
+var statMountPoint = os.Stat
+
+// A stat of a mount point for health checks, whose result is ready once done
+// is closed.
+type mountPointStat struct {
+	done chan struct{}
+	err  error
+}
+
+// The stats of each mount point still in flight. A wedged file system may
+// cause a stat to hang indefinitely, so checks made meanwhile wait for the
+// same one rather than each leaving another goroutine stuck behind it.
+var mountPointStats = struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inFlight map[string]*mountPointStat
+}{inFlight: make(map[string]*mountPointStat)}
+
+// Return a handler that responds with 200 OK if the file system mounted at
+// the supplied path is serving and a trivial request to the bucket succeeds,
+// and 503 Service Unavailable otherwise. bucket may be nil, in which case only
+// the file system is checked. Each check gives up after the given timeout.
+func newHealthHandler(
+	mountPoint string,
+	bucket gcs.Bucket,
+	timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err := checkHealth(ctx, mountPoint, bucket)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%v\n", err)
+			return
+		}
+
+		io.WriteString(w, "OK\n")
+	})
+}
+
+// Check that the file system mounted at the supplied path is serving and, if
+// bucket is non-nil, that a trivial request to the bucket succeeds. If the
+// context has no deadline, healthCheckTimeout applies.
+func checkHealth(
+	ctx context.Context,
+	mountPoint string,
+	bucket gcs.Bucket) (err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+	}
+
+	// Stat the mount point, which requires the fuse connection to be serving.
+	err = statMountPointOnce(ctx, mountPoint)
+	if err != nil {
+		err = fmt.Errorf("Stat: %v", err)
+		return
+	}
+
+	// Make a cheap request to the bucket. Not finding the object is fine.
+	if bucket != nil {
+		_, err = bucket.StatObject(
+			ctx,
+			&gcs.StatObjectRequest{Name: healthCheckObjectName})
+
+		if _, ok := err.(*gcs.NotFoundError); ok {
+			err = nil
+		}
+
+		if err != nil {
+			err = fmt.Errorf("StatObject: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Stat the mount point in the background, waiting until the context is
+// cancelled for the result. If a stat begun by an earlier check is still in
+// flight, wait for that one instead of starting another.
+func statMountPointOnce(
+	ctx context.Context,
+	mountPoint string) (err error) {
+	mountPointStats.mu.Lock()
+	s := mountPointStats.inFlight[mountPoint]
+	if s == nil {
+		s = &mountPointStat{done: make(chan struct{})}
+		mountPointStats.inFlight[mountPoint] = s
+
+		go func() {
+			_, s.err = statMountPoint(mountPoint)
+
+			mountPointStats.mu.Lock()
+			delete(mountPointStats.inFlight, mountPoint)
+			mountPointStats.mu.Unlock()
+
+			close(s.done)
+		}()
+	}
+	mountPointStats.mu.Unlock()
+
+	select {
+	case <-s.done:
+		err = s.err
+
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+// Open the bucket to use for health checks directly on the backend, so that
+// checks aren't affected by rate limiting or caching. Return nil if there is
+// no backend, as for the fake bucket.
+func openHealthCheckBucket(
+	ctx context.Context,
+	backend storage.Backend,
+	bucketName string) (bucket gcs.Bucket, err error) {
+	if backend == nil {
+		return
+	}
+
+	bucket, err = backend.OpenBucket(ctx, bucketName)
+	if err != nil {
+		err = fmt.Errorf("OpenBucket: %v", err)
+		return
+	}
+
+	return
+}
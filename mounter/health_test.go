@@ -0,0 +1,158 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestHealth(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bucket whose StatObject method always fails.
+type brokenBucket struct {
+	gcs.Bucket
+}
+
+func (b *brokenBucket) StatObject(
+	ctx context.Context,
+	req *gcs.StatObjectRequest) (o *gcs.Object, err error) {
+	err = errors.New("taco")
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type HealthTest struct {
+	dir    string
+	bucket gcs.Bucket
+}
+
+var _ SetUpInterface = &HealthTest{}
+var _ TearDownInterface = &HealthTest{}
+
+func init() { RegisterTestSuite(&HealthTest{}) }
+
+func (t *HealthTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "health_test")
+	AssertEq(nil, err)
+
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+}
+
+func (t *HealthTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+// Make a request to the handler, returning the status code and body.
+func (t *HealthTest) check(
+	mountPoint string,
+	bucket gcs.Bucket) (code int, body string) {
+	server := httptest.NewServer(newHealthHandler(mountPoint, bucket, time.Second))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	AssertEq(nil, err)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	AssertEq(nil, err)
+
+	code = resp.StatusCode
+	body = string(b)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *HealthTest) Healthy() {
+	code, body := t.check(t.dir, t.bucket)
+	ExpectEq(http.StatusOK, code)
+	ExpectEq("OK\n", body)
+}
+
+func (t *HealthTest) NoBucket() {
+	code, _ := t.check(t.dir, nil)
+	ExpectEq(http.StatusOK, code)
+}
+
+func (t *HealthTest) MountPointMissing() {
+	code, body := t.check(path.Join(t.dir, "foo"), t.bucket)
+	ExpectEq(http.StatusServiceUnavailable, code)
+	ExpectThat(body, HasSubstr("Stat"))
+	ExpectThat(body, HasSubstr("no such file"))
+}
+
+func (t *HealthTest) HungStatNotRepeated() {
+	var stats int32
+	release := make(chan struct{})
+
+	statMountPoint = func(name string) (os.FileInfo, error) {
+		atomic.AddInt32(&stats, 1)
+		<-release
+		return os.Stat(name)
+	}
+
+	defer func() { statMountPoint = os.Stat }()
+
+	// While the first stat hangs, each check times out without starting
+	// another.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		err := checkHealth(ctx, t.dir, nil)
+		cancel()
+
+		ExpectThat(err, Error(HasSubstr("deadline exceeded")))
+	}
+
+	ExpectEq(1, atomic.LoadInt32(&stats))
+
+	// Once it returns, checks succeed again.
+	close(release)
+
+	err := checkHealth(context.Background(), t.dir, nil)
+	ExpectEq(nil, err)
+}
+
+func (t *HealthTest) BucketBroken() {
+	code, body := t.check(t.dir, &brokenBucket{t.bucket})
+	ExpectEq(http.StatusServiceUnavailable, code)
+	ExpectThat(body, HasSubstr("StatObject"))
+	ExpectThat(body, HasSubstr("taco"))
+}
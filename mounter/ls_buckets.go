@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+// Return the ls-buckets command, which calls action when run.
+func newListBucketsCommand(action func(c *cli.Context)) cli.Command {
+	return cli.Command{
+		Name: "ls-buckets",
+		Usage: "List the buckets that the credentials chosen by the global " +
+			"options can see, one per line with its location, default storage " +
+			"class and creation time.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name: "project",
+				Usage: "The ID of the project whose buckets to list. (default: " +
+					"$GOOGLE_CLOUD_PROJECT, or the project of the credentials)",
+			},
+		},
+		Action: action,
+	}
+}
+
+func runListBuckets(c *cli.Context) (err error) {
+	if len(c.Args()) != 0 {
+		err = fmt.Errorf("ls-buckets takes no arguments, but got %q", c.Args())
+		return
+	}
+
+	// The global options choose the credentials.
+	err = applyConfigFile(c.Parent())
+	if err != nil {
+		err = fmt.Errorf("Reading --config-file: %v", err)
+		return
+	}
+
+	flags := populateFlags(c.Parent())
+
+	err = listBuckets(context.Background(), flags, c.String("project"), os.Stdout)
+	return
+}
+
+// Write the buckets of the project, or the default project if empty, to w.
+func listBuckets(
+	ctx context.Context,
+	flags *flagStorage,
+	project string,
+	w io.Writer) (err error) {
+	backend, err := chooseBackend(flags, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		err = fmt.Errorf("chooseBackend: %v", err)
+		return
+	}
+
+	lister, ok := backend.(storage.BucketLister)
+	if !ok {
+		err = fmt.Errorf("The %s backend can't list buckets", flags.Backend)
+		return
+	}
+
+	if project == "" {
+		project, err = defaultProject(ctx, flags.KeyFile)
+		if err != nil {
+			return
+		}
+	}
+
+	buckets, err := lister.ListBuckets(ctx, project)
+	if err != nil {
+		err = fmt.Errorf("ListBuckets: %v", err)
+		return
+	}
+
+	err = writeBuckets(w, buckets)
+	return
+}
+
+// Write one line for each bucket, with columns aligned. The name comes first,
+// for the convenience of scripts.
+func writeBuckets(w io.Writer, buckets []storage.BucketInfo) (err error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, b := range buckets {
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%s\n",
+			b.Name,
+			b.Location,
+			b.StorageClass,
+			b.Created.Format(time.RFC3339))
+	}
+
+	err = tw.Flush()
+	return
+}
+
+// Choose the project whose buckets to list when none is given: the one named
+// by $GOOGLE_CLOUD_PROJECT, or else that of the key file if there is one, or
+// else that of the application default credentials, which on GCE is the
+// instance's own.
+func defaultProject(
+	ctx context.Context,
+	keyFile string) (project string, err error) {
+	if project = os.Getenv("GOOGLE_CLOUD_PROJECT"); project != "" {
+		return
+	}
+
+	if keyFile != "" {
+		var contents []byte
+		contents, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			err = fmt.Errorf("ReadFile(%q): %v", keyFile, err)
+			return
+		}
+
+		var key struct {
+			ProjectID string `json:"project_id"`
+		}
+
+		err = json.Unmarshal(contents, &key)
+		if err != nil {
+			err = fmt.Errorf("Parsing %q: %v", keyFile, err)
+			return
+		}
+
+		project = key.ProjectID
+	} else {
+		var creds *google.DefaultCredentials
+		creds, err = google.FindDefaultCredentials(ctx)
+		if err != nil {
+			err = fmt.Errorf("FindDefaultCredentials: %v", err)
+			return
+		}
+
+		project = creds.ProjectID
+	}
+
+	if project == "" {
+		err = fmt.Errorf("Can't tell which project to list buckets in; use --project")
+		return
+	}
+
+	return
+}
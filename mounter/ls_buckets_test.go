@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestListBuckets(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ListBucketsTest struct {
+	ctx context.Context
+	dir string
+
+	oldProject string
+}
+
+var _ SetUpInterface = &ListBucketsTest{}
+var _ TearDownInterface = &ListBucketsTest{}
+
+func init() { RegisterTestSuite(&ListBucketsTest{}) }
+
+func (t *ListBucketsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "ls_buckets_test")
+	AssertEq(nil, err)
+
+	t.oldProject = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	os.Unsetenv("GOOGLE_CLOUD_PROJECT")
+}
+
+func (t *ListBucketsTest) TearDown() {
+	os.Setenv("GOOGLE_CLOUD_PROJECT", t.oldProject)
+
+	err := os.RemoveAll(t.dir)
+	AssertEq(nil, err)
+}
+
+// Write a key file with the supplied contents, returning its path.
+func (t *ListBucketsTest) writeKeyFile(contents string) string {
+	p := path.Join(t.dir, "key.json")
+	err := ioutil.WriteFile(p, []byte(contents), 0600)
+	AssertEq(nil, err)
+
+	return p
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ListBucketsTest) UnsupportedBackend() {
+	flags := parseArgs([]string{"--backend", "memory"})
+
+	var buf bytes.Buffer
+	err := listBuckets(t.ctx, flags, "some-project", &buf)
+	ExpectThat(err, Error(HasSubstr("can't list buckets")))
+}
+
+func (t *ListBucketsTest) ProjectFromEnvironment() {
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "some-project")
+	keyFile := t.writeKeyFile(`{"project_id": "other-project"}`)
+
+	project, err := defaultProject(t.ctx, keyFile)
+	AssertEq(nil, err)
+	ExpectEq("some-project", project)
+}
+
+func (t *ListBucketsTest) ProjectFromKeyFile() {
+	keyFile := t.writeKeyFile(`{"type": "service_account", "project_id": "some-project"}`)
+
+	project, err := defaultProject(t.ctx, keyFile)
+	AssertEq(nil, err)
+	ExpectEq("some-project", project)
+}
+
+func (t *ListBucketsTest) KeyFileWithoutProject() {
+	keyFile := t.writeKeyFile(`{"type": "authorized_user"}`)
+
+	_, err := defaultProject(t.ctx, keyFile)
+	ExpectThat(err, Error(HasSubstr("--project")))
+}
+
+func (t *ListBucketsTest) Output() {
+	created := time.Date(2015, 4, 5, 2, 15, 0, 0, time.UTC)
+	buckets := []storage.BucketInfo{
+		{Name: "foo", Location: "US", StorageClass: "STANDARD", Created: created},
+		{Name: "some-bucket", Location: "EUROPE-WEST1", StorageClass: "NEARLINE", Created: created},
+	}
+
+	var buf bytes.Buffer
+	AssertEq(nil, writeBuckets(&buf, buckets))
+
+	ExpectEq(
+		"foo          US            STANDARD  2015-04-05T02:15:00Z\n"+
+			"some-bucket  EUROPE-WEST1  NEARLINE  2015-04-05T02:15:00Z\n",
+		buf.String())
+}
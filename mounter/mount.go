@@ -0,0 +1,445 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"golang.org/x/net/context"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/clock"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs/inode"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/googlecloudplatform/gcsfuse/internal/metrics"
+	"github.com/googlecloudplatform/gcsfuse/internal/perms"
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fsutil"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Return the function to apply to file names for the given value of
+// --normalize-names, or nil for none.
+func chooseNameNormalization(form string) (f func(string) string, err error) {
+	switch form {
+	case "":
+	case "nfc":
+		f = norm.NFC.String
+	case "nfd":
+		f = norm.NFD.String
+	default:
+		err = fmt.Errorf("Unknown normalization form: %q", form)
+	}
+
+	return
+}
+
+// Return a function that signs URLs for objects in the bucket with the
+// service account key in --key-file, given the object names seen by the file
+// system, or nil if --signed-url-expiry isn't set.
+func setUpURLSigning(
+	flags *flagStorage,
+	bucketName string) (sign func(string) (string, error), err error) {
+	if flags.SignedURLExpiry == 0 {
+		return
+	}
+
+	if flags.KeyFile == "" {
+		err = fmt.Errorf("--signed-url-expiry requires --key-file")
+		return
+	}
+
+	jsonKey, err := ioutil.ReadFile(flags.KeyFile)
+	if err != nil {
+		err = fmt.Errorf("ReadFile(%q): %v", flags.KeyFile, err)
+		return
+	}
+
+	signer, err := gcsx.NewURLSigner(
+		jsonKey,
+		flags.SignedURLExpiry,
+		timeutil.RealClock())
+
+	if err != nil {
+		err = fmt.Errorf("NewURLSigner: %v", err)
+		return
+	}
+
+	// The file system sees names within --only-dir.
+	var prefix string
+	if flags.OnlyDir != "" {
+		prefix = path.Clean(flags.OnlyDir) + "/"
+	}
+
+	sign = func(name string) (string, error) {
+		return signer.SignedURL(bucketName, prefix+name)
+	}
+
+	return
+}
+
+// Mount the file system based on the supplied arguments, returning a
+// fuse.MountedFileSystem that can be joined to wait for unmounting, and the
+// server behind it, which can be shut down before unmounting.
+//
+// If opLatencies is non-nil, the latency of each op is recorded there. If
+// dumpStateSignals is non-nil, the file system logs its state each time a
+// signal is received on it. If t is non-nil, the parts of the file system that
+// can be adjusted or observed while mounted are recorded there, and set up even
+// if disabled for now; if reloader is also non-nil, it is run to apply the
+// config file named by --config-file to them whenever it is reloaded.
+func mountWithBackend(
+	ctx context.Context,
+	bucketName string,
+	mountPoint string,
+	flags *flagStorage,
+	backend storage.Backend,
+	status *log.Logger,
+	opLatencies *metrics.LatencyHistograms,
+	dumpStateSignals <-chan os.Signal,
+	t *tunables,
+	reloader *configReloader) (
+	mfs *fuse.MountedFileSystem,
+	server fs.Server,
+	err error) {
+	// Sanity check: make sure the temporary directory exists and is writable
+	// currently. This gives a better user experience than harder to debug EIO
+	// errors when reading files in the future.
+	if flags.TempDir != "" {
+		var f *os.File
+		f, err = fsutil.AnonymousFile(flags.TempDir)
+		f.Close()
+
+		if err != nil {
+			err = fmt.Errorf(
+				"Error writing to temporary directory (%q); are you sure it exists "+
+					"with the correct permissions?",
+				err.Error())
+			return
+		}
+	}
+
+	// Find the current process's UID and GID. If it was invoked as root and the
+	// user hasn't explicitly overridden --uid, everything is going to be owned
+	// by root. This is probably not what the user wants, so print a warning.
+	uid, gid, err := perms.MyUserAndGroup()
+	if err != nil {
+		err = fmt.Errorf("MyUserAndGroup: %v", err)
+		return
+	}
+
+	if uid == 0 && flags.Uid < 0 {
+		fmt.Fprintln(os.Stdout, `
+WARNING: gcsfuse invoked as root. This will cause all files to be owned by
+root. If this is not what you intended, invoke gcsfuse as the user that will
+be interacting with the file system.
+`)
+	}
+
+	// Choose UID and GID.
+	if flags.Uid >= 0 {
+		uid = uint32(flags.Uid)
+	}
+
+	if flags.Gid >= 0 {
+		gid = uint32(flags.Gid)
+	}
+
+	// Encrypt the contents of dirty files and cached
+	// objects on local disk, if requested.
+	var diskCipher *gcsx.DiskCipher
+	if flags.EncryptionKeyFile != "" {
+		diskCipher, err = gcsx.ReadDiskCipher(flags.EncryptionKeyFile)
+		if err != nil {
+			err = fmt.Errorf("ReadDiskCipher: %v", err)
+			return
+		}
+	}
+
+	// Keep copies of prefetched objects, if requested.
+	var contentCache *gcsx.ContentCache
+	if flags.CacheDir != "" {
+		// The copies would outlive the mount, and be served to later ones.
+		if flags.DryRun {
+			err = fmt.Errorf("--cache-dir can't be used with --dry-run")
+			return
+		}
+
+		contentCache, err = gcsx.NewContentCache(
+			flags.CacheDir,
+			int64(flags.CacheMaxSizeMB)<<20,
+			diskCipher)
+
+		if err != nil {
+			err = fmt.Errorf("NewContentCache: %v", err)
+			return
+		}
+	}
+
+	// Set up the bucket.
+	status.Println("Opening bucket...")
+
+	bucket, auth, err := setUpBucket(
+		ctx,
+		flags,
+		backend,
+		bucketName,
+		contentCache,
+		t)
+
+	if err != nil {
+		err = fmt.Errorf("setUpBucket: %v", err)
+		return
+	}
+
+	// Use folders for directories in a bucket with a hierarchical namespace.
+	folders := setUpFolders(ctx, flags, backend, bucketName)
+
+	// Show soft-deleted objects in a bucket with a soft delete policy.
+	softDeleted := setUpSoftDeleted(ctx, flags, backend, bucketName)
+
+	// Refuse up front to modify objects under holds or retention.
+	retention := setUpRetention(ctx, flags, backend, bucketName)
+
+	// Hear about changes made by others, if asked to.
+	changes, err := setUpChanges(ctx, flags, backend, bucketName)
+	if err != nil {
+		err = fmt.Errorf("setUpChanges: %v", err)
+		return
+	}
+
+	// Set up per-handle bandwidth sharing, if requested.
+	handleReadThrottle, err := setUpFairShareThrottle(flags, t)
+	if err != nil {
+		err = fmt.Errorf("setUpFairShareThrottle: %v", err)
+		return
+	}
+
+	// Sign URLs for files, if requested.
+	signURL, err := setUpURLSigning(flags, bucketName)
+	if err != nil {
+		err = fmt.Errorf("setUpURLSigning: %v", err)
+		return
+	}
+
+	// Stage dirty files persistently if requested, first resuming any writes
+	// that an earlier process didn't finish.
+	var stagingArea *gcsx.StagingArea
+	if flags.StagingDir != "" {
+		if isReadOnly(flags) {
+			err = fmt.Errorf("--staging-dir can't be used with a read-only mount")
+			return
+		}
+
+		// Resuming staged writes would make them.
+		if flags.DryRun {
+			err = fmt.Errorf("--staging-dir can't be used with --dry-run")
+			return
+		}
+
+		// Staged writes record the --only-dir prefix, so that a later mount of a
+		// different one leaves them alone.
+		var prefix string
+		if flags.OnlyDir != "" {
+			prefix = path.Clean(flags.OnlyDir) + "/"
+		}
+
+		stagingArea, err = gcsx.NewStagingArea(
+			flags.StagingDir,
+			prefix,
+			diskCipher)
+
+		if err != nil {
+			err = fmt.Errorf("NewStagingArea: %v", err)
+			return
+		}
+
+		status.Println("Resuming staged writes...")
+		err = stagingArea.ResumeOrphans(ctx, bucket)
+		if err != nil {
+			err = fmt.Errorf("ResumeOrphans: %v", err)
+			return
+		}
+	}
+
+	// Queue writes made while GCS is unreachable, if requested.
+	if flags.OfflineRetryInterval > 0 {
+		if stagingArea == nil {
+			err = fmt.Errorf("--offline-retry-interval requires --staging-dir")
+			return
+		}
+
+		stagingArea.StartReconciling(bucket, flags.OfflineRetryInterval)
+	}
+
+	// Choose a normalization for file names, if requested.
+	normalizeNames, err := chooseNameNormalization(flags.NormalizeNames)
+	if err != nil {
+		err = fmt.Errorf("chooseNameNormalization: %v", err)
+		return
+	}
+
+	// Report the bucket's usage to statfs(2) if requested.
+	var usageScanner *gcsx.UsageScanner
+	if flags.StatFSUsageTTL > 0 {
+		usageScanner = gcsx.NewUsageScanner(
+			bucket,
+			flags.StatFSUsageTTL,
+			clock.NewMonotonicClock())
+	}
+
+	// Choose the order of directory listings.
+	var dirsFirst bool
+	switch flags.DirOrder {
+	case "name":
+	case "dirs-first":
+		dirsFirst = true
+	default:
+		err = fmt.Errorf("Unknown directory order: %q", flags.DirOrder)
+		return
+	}
+
+	// Set up filtering of names, if requested.
+	var nameFilter *inode.NameFilter
+	if len(flags.IgnorePatterns) > 0 || len(flags.IncludePatterns) > 0 {
+		nameFilter, err = inode.NewNameFilter(
+			flags.IgnorePatterns,
+			flags.IncludePatterns)
+
+		if err != nil {
+			err = fmt.Errorf("NewNameFilter: %v", err)
+			return
+		}
+	}
+
+	// Set up settings for particular directories, if requested.
+	dirOverrides, err := parseDirOverrides(flags.DirOverrides)
+	if err != nil {
+		err = fmt.Errorf("parseDirOverrides: %v", err)
+		return
+	}
+
+	// Create a file system server.
+	serverCfg := &fs.ServerConfig{
+		CacheClock:             clock.NewMonotonicClock(),
+		Bucket:                 bucket,
+		Folders:                folders,
+		SoftDeleted:            softDeleted,
+		Retention:              retention,
+		Changes:                changes,
+		AccessDenied:           auth.Denied,
+		AccessUids:             flags.AccessUids,
+		SignURL:                signURL,
+		ReadOnly:               isReadOnly(flags),
+		TempDir:                flags.TempDir,
+		SpillThreshold:         int64(flags.SpillThresholdKB) << 10,
+		StagingArea:            stagingArea,
+		DiskCipher:             diskCipher,
+		TempDirMinFree:         uint64(flags.TempDirMinFreeMB) << 20,
+		MaxConcurrentUploads:   flags.MaxConcurrentUploads,
+		WriteLeaseTTL:          flags.WriteLeaseTTL,
+		StreamingWrites:        flags.StreamingWrites,
+		FlushInterval:          flags.FlushInterval,
+		ImplicitDirectories:    flags.ImplicitDirs,
+		NormalizeNames:         normalizeNames,
+		CaseInsensitive:        flags.CaseInsensitive,
+		DirsFirst:              dirsFirst,
+		NameFilter:             nameFilter,
+		DirOverrides:           dirOverrides,
+		HideDeniedDirs:         flags.HideDeniedDirs,
+		MaxDepth:               flags.MaxDepth,
+		RecursiveRmDir:         flags.RecursiveRmDir,
+		ControlDir:             flags.ControlDir,
+		ControlConfig:          describeFlags(flags),
+		DisableAppleNoise:      flags.DisableAppleNoise,
+		InodeAttributeCacheTTL: flags.StatCacheTTL,
+		DirTypeCacheTTL:        flags.TypeCacheTTL,
+		DirListingCacheTTL:     flags.ListingCacheTTL,
+		KernelEntryCacheTTL:    flags.KernelEntryCacheTTL,
+		KernelAttrCacheTTL:     flags.KernelAttrCacheTTL,
+		InodeTableSize:         flags.InodeTableSize,
+		NFSExport:              flags.NFSExport,
+		Uid:                    uid,
+		Gid:                    gid,
+		FilePerms:              os.FileMode(flags.FileMode),
+		DirPerms:               os.FileMode(flags.DirMode),
+		Capacity:               uint64(flags.StatFSCapacityGB) << 30,
+		UsageScanner:           usageScanner,
+
+		AppendThreshold: 1 << 21, // 2 MiB, a total guess.
+		TmpObjectPrefix: ".gcsfuse_tmp/",
+
+		HandleReadThrottle: handleReadThrottle,
+		DebugOps:           flags.DebugFuse,
+		OpLatencies:        opLatencies,
+		AuditOps:           flags.AuditLog != "" || flags.DryRun,
+		DumpStateSignals:   dumpStateSignals,
+		MetadataOpTimeout:  flags.MetadataOpTimeout,
+		DataOpTimeout:      flags.DataOpTimeout,
+	}
+
+	server, err = fs.NewServer(serverCfg)
+	if err != nil {
+		err = fmt.Errorf("fs.NewServer: %v", err)
+		return
+	}
+
+	if t != nil {
+		t.server = server
+		if reloader != nil {
+			go reloader.run(*flags, t)
+		}
+	}
+
+	// Mount the file system.
+	status.Println("Mounting file system...")
+
+	mountCfg := &fuse.MountConfig{
+		FSName:              bucket.Name(),
+		VolumeName:          bucket.Name(),
+		Options:             flags.MountOptions,
+		EnableExportSupport: flags.NFSExport,
+		DisableLocking:      flags.DisableLocking,
+		ErrorLogger:         logger.NewLegacyLogger(logger.SeverityError, "fuse: "),
+	}
+
+	if flags.DebugFuse {
+		mountCfg.DebugLogger = logger.NewLegacyLogger(logger.SeverityDebug, "fuse_debug: ")
+	}
+
+	mfs, err = fuse.Mount(mountPoint, server, mountCfg)
+	if err != nil {
+		err = fmt.Errorf("Mount: %v", err)
+		return
+	}
+
+	return
+}
+
+// Create histograms for the latency of file system ops.
+func newOpLatencies() *metrics.LatencyHistograms {
+	return metrics.NewLatencyHistograms(
+		"gcsfuse_fs_op_latency_seconds",
+		"Latency of file system operations.",
+		"op",
+		metrics.DefaultLatencyBuckets)
+}
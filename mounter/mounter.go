@@ -0,0 +1,366 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mounter mounts GCS buckets with gcsfuse.
+//
+// Programs such as a Kubernetes CSI driver can use Mount to serve a bucket
+// from within their own process and follow the mount through its lifecycle,
+// rather than running the gcsfuse binary and scraping its output. RunCLI
+// implements the gcsfuse command itself.
+package mounter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/metrics"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/syncutil"
+	"golang.org/x/net/context"
+)
+
+// Functions called as a mount moves through its lifecycle. Any may be nil.
+// They are called on background goroutines, except for Ready, and should
+// return promptly.
+type Hooks struct {
+	// Called once the file system is mounted and serving, just before Mount
+	// returns.
+	Ready func(mountPoint string)
+
+	// Called with the outcome of the first background health check, and then
+	// each time the file system goes from healthy to unhealthy or back. A nil
+	// error means healthy. See Config.HealthCheckInterval.
+	HealthChanged func(mountPoint string, err error)
+
+	// Called once the file system has been unmounted, whether by Unmount or
+	// otherwise, with the error that serving it ended with, if any.
+	Unmounted func(mountPoint string, err error)
+}
+
+// Configuration for Mount.
+type Config struct {
+	// Flags as they would be given to gcsfuse on the command line, such as
+	// "--implicit-dirs" or "--key-file=/path/to/key.json". Flags that affect
+	// the whole gcsfuse process rather than a mount, such as --foreground,
+	// --log-file and those serving HTTP endpoints, are rejected; use the
+	// methods of MountedBucket for health checks and metrics instead.
+	Args []string
+
+	// Where to write progress messages while mounting. May be nil.
+	Status io.Writer
+
+	// How often to check the mount's health in the background, reporting
+	// changes to Hooks.HealthChanged. Zero disables background checks, though
+	// MountedBucket.CheckHealth may still be called.
+	HealthCheckInterval time.Duration
+
+	Hooks Hooks
+}
+
+// A bucket mounted by Mount. Safe for concurrent access.
+type MountedBucket struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	mfs    *fuse.MountedFileSystem
+	server fs.Server
+
+	// The bucket to check in health checks, or nil for none.
+	healthBucket gcs.Bucket
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	mountPoint      string
+	shutdownTimeout time.Duration
+	hooks           Hooks
+
+	// The latencies of the file system's ops.
+	opLatencies *metrics.LatencyHistograms
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	// Closed once the file system has been unmounted and Hooks.Unmounted has
+	// returned. joinErr is set before then.
+	joined  chan struct{}
+	joinErr error
+}
+
+// Mount the named bucket on the supplied mount point, configured as by the
+// flags in cfg.Args, returning once the file system is ready to serve. The
+// context is used only while mounting.
+//
+// Unlike the gcsfuse command, Mount doesn't install signal handlers; the
+// caller is responsible for unmounting.
+func Mount(
+	ctx context.Context,
+	bucketName string,
+	mountPoint string,
+	cfg *Config) (mb *MountedBucket, err error) {
+	flags, err := parseMountArgs(cfg.Args)
+	if err != nil {
+		err = fmt.Errorf("parseMountArgs: %v", err)
+		return
+	}
+
+	statusWriter := cfg.Status
+	if statusWriter == nil {
+		statusWriter = ioutil.Discard
+	}
+
+	status := log.New(statusWriter, "", 0)
+
+	// Enable invariant checking if requested.
+	if flags.DebugInvariants {
+		syncutil.EnableInvariantChecking()
+	}
+
+	// Choose the backend from which to open the bucket.
+	backend, err := chooseBackendForBucket(bucketName, flags, status)
+	if err != nil {
+		err = fmt.Errorf("chooseBackendForBucket: %v", err)
+		return
+	}
+
+	healthBucket, err := openHealthCheckBucket(ctx, backend, bucketName)
+	if err != nil {
+		err = fmt.Errorf("openHealthCheckBucket: %v", err)
+		return
+	}
+
+	// Mount, recording latencies for this mount alone.
+	opLatencies := newOpLatencies()
+	mfs, server, err := mountWithBackend(
+		ctx,
+		bucketName,
+		mountPoint,
+		flags,
+		backend,
+		status,
+		opLatencies,
+		nil,
+		nil,
+		nil)
+
+	if err != nil {
+		err = fmt.Errorf("mountWithBackend: %v", err)
+		return
+	}
+
+	mb = &MountedBucket{
+		mfs:             mfs,
+		server:          server,
+		healthBucket:    healthBucket,
+		mountPoint:      mfs.Dir(),
+		shutdownTimeout: flags.ShutdownTimeout,
+		hooks:           cfg.Hooks,
+		opLatencies:     opLatencies,
+		joined:          make(chan struct{}),
+	}
+
+	go mb.waitForUnmount()
+
+	if cfg.HealthCheckInterval > 0 {
+		go mb.checkHealthPeriodically(cfg.HealthCheckInterval)
+	}
+
+	if flags.UnmountAfterIdle > 0 {
+		go unmountWhenIdle(
+			mb.mountPoint,
+			server,
+			flags.UnmountAfterIdle,
+			flags.ShutdownTimeout,
+			mb.joined)
+	}
+
+	if mb.hooks.Ready != nil {
+		mb.hooks.Ready(mb.mountPoint)
+	}
+
+	return
+}
+
+// Parse the flags given to Mount, rejecting those that make sense only for
+// the gcsfuse command.
+func parseMountArgs(args []string) (flags *flagStorage, err error) {
+	app := newApp("")
+	app.Writer = ioutil.Discard
+
+	var positional []string
+	app.Action = func(c *cli.Context) {
+		flags = populateFlags(c)
+		positional = c.Args()
+	}
+
+	err = app.Run(append([]string{"gcsfuse"}, args...))
+	if err != nil {
+		return
+	}
+
+	// The action isn't run for --help and --version.
+	if flags == nil {
+		err = fmt.Errorf("Unsupported flags: %q", args)
+		return
+	}
+
+	if len(positional) != 0 {
+		err = fmt.Errorf("Unexpected arguments: %q", positional)
+		return
+	}
+
+	switch {
+	case flags.Foreground:
+		err = errors.New("--foreground is not supported")
+
+	case flags.ConfigFile != "":
+		err = errors.New("--config-file is not supported")
+
+	case flags.LogFile != "":
+		err = errors.New("--log-file is not supported")
+
+	case flags.LogSeverity != "debug":
+		err = errors.New("--log-severity is not supported")
+
+	case flags.PprofPort >= 0:
+		err = errors.New("--pprof-port is not supported")
+
+	case flags.MetricsPort >= 0:
+		err = errors.New("--metrics-port is not supported; use WriteMetrics")
+
+	case flags.HealthPort >= 0:
+		err = errors.New("--health-port is not supported; use CheckHealth")
+
+	case flags.OTLPEndpoint != "":
+		err = errors.New("--otlp-traces-endpoint is not supported")
+	}
+
+	return
+}
+
+// Return the directory on which the bucket is mounted.
+func (mb *MountedBucket) Dir() string {
+	return mb.mountPoint
+}
+
+// Check that the file system is serving and the bucket is reachable, as for
+// gcsfuse's --health-port. Return nil if so.
+func (mb *MountedBucket) CheckHealth(ctx context.Context) (err error) {
+	err = checkHealth(ctx, mb.mountPoint, mb.healthBucket)
+	return
+}
+
+// Write this mount's metrics, such as its op latency histograms, in the
+// Prometheus text format served by gcsfuse's --metrics-port.
+func (mb *MountedBucket) WriteMetrics(w io.Writer) {
+	mb.opLatencies.WriteMetrics(w)
+}
+
+// Shut down and unmount the file system as gcsfuse does on SIGTERM: stop
+// serving new ops, write out dirty files, and unmount, doing so lazily if
+// that doesn't succeed in time. If the context has no deadline, the mount's
+// --shutdown-timeout applies.
+//
+// Return once the file system has been unmounted and Hooks.Unmounted has been
+// called. A file system mounted from a file descriptor is only shut down; the
+// process that mounted it must unmount it.
+func (mb *MountedBucket) Unmount(ctx context.Context) (err error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, mb.shutdownTimeout)
+		defer cancel()
+	}
+
+	err = shutDownAndUnmount(ctx, mb.mountPoint, mb.server)
+	if err != nil {
+		err = fmt.Errorf("shutDownAndUnmount: %v", err)
+		return
+	}
+
+	if fuse.IsMountedFD(mb.mountPoint) {
+		return
+	}
+
+	// A lazy unmount may leave the connection open for a while, so don't wait
+	// past the deadline.
+	select {
+	case <-mb.joined:
+	case <-ctx.Done():
+	}
+
+	return
+}
+
+// Block until the file system has been unmounted, returning the error that
+// serving it ended with, if any, or until the context is cancelled.
+func (mb *MountedBucket) Join(ctx context.Context) (err error) {
+	select {
+	case <-mb.joined:
+		err = mb.joinErr
+
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	return
+}
+
+func (mb *MountedBucket) waitForUnmount() {
+	mb.joinErr = mb.mfs.Join(context.Background())
+	if mb.hooks.Unmounted != nil {
+		mb.hooks.Unmounted(mb.mountPoint, mb.joinErr)
+	}
+
+	close(mb.joined)
+}
+
+func (mb *MountedBucket) checkHealthPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var reported bool
+	var last error
+	for {
+		select {
+		case <-mb.joined:
+			return
+
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		err := mb.CheckHealth(ctx)
+		cancel()
+
+		if reported && (err == nil) == (last == nil) {
+			continue
+		}
+
+		reported = true
+		last = err
+		if mb.hooks.HealthChanged != nil {
+			mb.hooks.HealthChanged(mb.mountPoint, err)
+		}
+	}
+}
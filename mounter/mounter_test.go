@@ -0,0 +1,147 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestMounter(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type MounterTest struct {
+}
+
+func init() { RegisterTestSuite(&MounterTest{}) }
+
+// Return a MountedBucket whose mount point is a plain directory, which is
+// enough for health checks, along with a channel receiving each change in
+// health that it reports.
+func newFakeMountedBucket(dir string) (
+	mb *MountedBucket,
+	healthChanges chan error) {
+	healthChanges = make(chan error, 10)
+	mb = &MountedBucket{
+		healthBucket: gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket"),
+		mountPoint:   dir,
+		hooks: Hooks{
+			HealthChanged: func(mountPoint string, err error) {
+				healthChanges <- err
+			},
+		},
+		opLatencies: newOpLatencies(),
+		joined:      make(chan struct{}),
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *MounterTest) ParseMountArgs() {
+	flags, err := parseMountArgs([]string{
+		"--implicit-dirs",
+		"--dir-mode=700",
+		"--stat-cache-ttl", "1m",
+	})
+
+	AssertEq(nil, err)
+	ExpectTrue(flags.ImplicitDirs)
+	ExpectEq(0700, flags.DirMode)
+	ExpectEq(time.Minute, flags.StatCacheTTL)
+}
+
+func (t *MounterTest) ParseMountArgs_Defaults() {
+	flags, err := parseMountArgs(nil)
+
+	AssertEq(nil, err)
+	ExpectEq(parseArgs(nil).DirMode, flags.DirMode)
+	ExpectEq(-1, flags.MetricsPort)
+}
+
+func (t *MounterTest) ParseMountArgs_Positional() {
+	_, err := parseMountArgs([]string{"--implicit-dirs", "some_bucket"})
+	ExpectThat(err, Error(HasSubstr("some_bucket")))
+}
+
+func (t *MounterTest) ParseMountArgs_UnknownFlag() {
+	_, err := parseMountArgs([]string{"--taco"})
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *MounterTest) ParseMountArgs_ProcessWideFlags() {
+	for _, arg := range []string{
+		"--help",
+		"--foreground",
+		"--config-file=/tmp/config",
+		"--log-file=/tmp/log",
+		"--log-severity=info",
+		"--pprof-port=8080",
+		"--metrics-port=8080",
+		"--health-port=8080",
+		"--otlp-traces-endpoint=localhost:4318",
+	} {
+		_, err := parseMountArgs([]string{arg})
+		ExpectNe(nil, err, "arg: %q", arg)
+	}
+}
+
+func (t *MounterTest) WriteMetrics() {
+	mb, _ := newFakeMountedBucket("")
+	mb.opLatencies.Observe("LookUpInode", time.Millisecond)
+
+	var buf bytes.Buffer
+	mb.WriteMetrics(&buf)
+	ExpectThat(buf.String(), HasSubstr(`op="LookUpInode"`))
+}
+
+func (t *MounterTest) HealthChanges() {
+	dir, err := ioutil.TempDir("", "mounter_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	mb, healthChanges := newFakeMountedBucket(dir)
+	go mb.checkHealthPeriodically(time.Millisecond)
+	defer close(mb.joined)
+
+	// The first check is reported.
+	ExpectEq(nil, <-healthChanges)
+
+	// Later ones are reported only when health changes.
+	time.Sleep(20 * time.Millisecond)
+	AssertEq(0, len(healthChanges))
+
+	err = os.Remove(dir)
+	AssertEq(nil, err)
+	ExpectThat(<-healthChanges, Error(HasSubstr("Stat")))
+
+	err = os.Mkdir(dir, 0700)
+	AssertEq(nil, err)
+	ExpectEq(nil, <-healthChanges)
+}
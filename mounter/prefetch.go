@@ -0,0 +1,297 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// `gcsfuse prefetch` sends a controlRequest with Op "prefetch" to the process
+// serving a mount point, asking it to copy the listed files into its
+// --cache-dir. The reply is a stream of JSON prefetchEvents, one for each
+// file, ending with one whose Event is "done" or "error".
+
+type prefetchEvent struct {
+	// "fetched", "cached" (already) or "failed" for the file named by File,
+	// and "done" or "error" for the outcome.
+	Event string `json:"event"`
+	File  string `json:"file,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// The number of files fetched at once if the request doesn't say.
+const defaultPrefetchParallelism = 8
+
+////////////////////////////////////////////////////////////////////////
+// Daemon
+////////////////////////////////////////////////////////////////////////
+
+func (cl *controlListener) handlePrefetch(
+	conn net.Conn,
+	req *controlRequest) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &eventReporter{cancel: cancel, enc: json.NewEncoder(conn)}
+
+	if cl.t.contentCache == nil {
+		r.send(prefetchEvent{
+			Event: "error",
+			Error: "The file system was mounted without --cache-dir",
+		})
+
+		return
+	}
+
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultPrefetchParallelism
+	}
+
+	logger.Infof(
+		"Prefetching %d files, %d at a time...",
+		len(req.Paths),
+		parallelism)
+
+	err := runParallel(
+		ctx,
+		parallelism,
+		len(req.Paths),
+		func(ctx context.Context, i int) {
+			r.send(cl.prefetch(ctx, req.Paths[i]))
+		})
+
+	if err != nil {
+		logger.Infof("Prefetch abandoned: %v", err)
+		return
+	}
+
+	logger.Infof("Prefetched %d files.", len(req.Paths))
+	r.send(prefetchEvent{Event: "done"})
+}
+
+// Copy the latest generation of the file at the supplied path, relative to
+// the mount point, into the content cache.
+func (cl *controlListener) prefetch(
+	ctx context.Context,
+	p string) (e prefetchEvent) {
+	e.File = p
+	name := cl.t.prefetchPrefix + strings.TrimPrefix(path.Clean("/"+p), "/")
+
+	o, err := cl.t.prefetchBucket.StatObject(
+		ctx,
+		&gcs.StatObjectRequest{Name: name})
+
+	if err != nil {
+		e.Event = "failed"
+		e.Error = fmt.Sprintf("StatObject: %v", err)
+		return
+	}
+
+	fetched, err := cl.t.contentCache.Insert(ctx, cl.t.prefetchBucket, o)
+	if err != nil {
+		e.Event = "failed"
+		e.Error = err.Error()
+		return
+	}
+
+	e.Event = "cached"
+	if fetched {
+		e.Event = "fetched"
+	}
+
+	e.Size = int64(o.Size)
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Command
+////////////////////////////////////////////////////////////////////////
+
+// Return the prefetch command, which calls action when run.
+func newPrefetchCommand(action func(c *cli.Context)) cli.Command {
+	return cli.Command{
+		Name: "prefetch",
+		Usage: "Have the gcsfuse process serving the mount point copy the files " +
+			"listed in the manifest, one path per line, into its --cache-dir, " +
+			"so that reading them later doesn't wait for GCS. A manifest of - " +
+			"means standard input.",
+		ArgsUsage: "mountpoint manifest",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "parallelism",
+				Value: defaultPrefetchParallelism,
+				Usage: "How many files to fetch at once.",
+			},
+		},
+		Action: action,
+	}
+}
+
+func runPrefetch(c *cli.Context) (err error) {
+	if len(c.Args()) != 2 {
+		err = fmt.Errorf(
+			"prefetch takes exactly two arguments, the mount point and the " +
+				"manifest")
+		return
+	}
+
+	mountPoint, err := filepath.Abs(c.Args()[0])
+	if err != nil {
+		err = fmt.Errorf("canonicalizing mount point: %v", err)
+		return
+	}
+
+	// Read the manifest.
+	var manifest io.Reader = os.Stdin
+	if name := c.Args()[1]; name != "-" {
+		var f *os.File
+		f, err = os.Open(name)
+		if err != nil {
+			return
+		}
+
+		defer f.Close()
+		manifest = f
+	}
+
+	paths, err := readPrefetchManifest(mountPoint, manifest)
+	if err != nil {
+		err = fmt.Errorf("Reading manifest: %v", err)
+		return
+	}
+
+	err = requestPrefetch(mountPoint, paths, c.Int("parallelism"), os.Stdout)
+	return
+}
+
+// Read a manifest listing one path per line, ignoring blank lines and those
+// starting with '#', and return the paths relative to the supplied absolute
+// mount point. Paths in the manifest are absolute, in which case they must
+// be within the mount point, or relative to it.
+func readPrefetchManifest(
+	mountPoint string,
+	r io.Reader) (paths []string, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		p := strings.TrimSpace(s.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		if filepath.IsAbs(p) {
+			rel, relErr := filepath.Rel(mountPoint, p)
+			if relErr != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				err = fmt.Errorf("%s isn't within %s", p, mountPoint)
+				return
+			}
+
+			p = rel
+		}
+
+		paths = append(paths, filepath.ToSlash(filepath.Clean(p)))
+	}
+
+	err = s.Err()
+	return
+}
+
+// Ask the process serving the supplied absolute mount point to copy the
+// files at the supplied paths into its cache, writing its progress to w.
+func requestPrefetch(
+	mountPoint string,
+	paths []string,
+	parallelism int,
+	w io.Writer) (err error) {
+	conn, err := dialControl(
+		mountPoint,
+		&controlRequest{
+			Op:          "prefetch",
+			Paths:       paths,
+			Parallelism: parallelism,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	var fetched, cached, failed int
+	var fetchedBytes int64
+
+	d := json.NewDecoder(conn)
+	for {
+		var e prefetchEvent
+		err = d.Decode(&e)
+		if err == io.EOF {
+			err = fmt.Errorf("gcsfuse exited before prefetching finished")
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Reading reply: %v", err)
+			return
+		}
+
+		switch e.Event {
+		case "fetched":
+			fetched++
+			fetchedBytes += e.Size
+			fmt.Fprintf(w, "Fetched %s (%s).\n", e.File, formatBytes(e.Size))
+
+		case "cached":
+			cached++
+			fmt.Fprintf(w, "Already cached: %s.\n", e.File)
+
+		case "failed":
+			failed++
+			fmt.Fprintf(w, "Failed to fetch %s: %s\n", e.File, e.Error)
+
+		case "done":
+			fmt.Fprintf(
+				w,
+				"Fetched %d files (%s), %d already cached, %d failed.\n",
+				fetched,
+				formatBytes(fetchedBytes),
+				cached,
+				failed)
+
+			if failed != 0 {
+				err = fmt.Errorf("%d files could not be prefetched", failed)
+			}
+
+			return
+
+		case "error":
+			err = fmt.Errorf("%s", e.Error)
+			return
+		}
+	}
+}
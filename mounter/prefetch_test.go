@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestPrefetch(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type PrefetchTest struct {
+	ctx      context.Context
+	dir      string
+	bucket   gcs.Bucket
+	t        tunables
+	listener *controlListener
+}
+
+var _ SetUpInterface = &PrefetchTest{}
+var _ TearDownInterface = &PrefetchTest{}
+
+func init() { RegisterTestSuite(&PrefetchTest{}) }
+
+func (t *PrefetchTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "prefetch_test")
+	AssertEq(nil, err)
+
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.t.prefetchBucket = t.bucket
+	t.t.contentCache, err = gcsx.NewContentCache(
+		filepath.Join(t.dir, "cache"),
+		0,
+		nil)
+
+	AssertEq(nil, err)
+
+	t.listener, err = listenForControl(t.dir, &t.t, time.Millisecond)
+	AssertEq(nil, err)
+}
+
+func (t *PrefetchTest) TearDown() {
+	t.listener.Close()
+	os.RemoveAll(t.dir)
+}
+
+func (t *PrefetchTest) create(name string, contents string) {
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, name, []byte(contents))
+	AssertEq(nil, err)
+}
+
+func (t *PrefetchTest) request(paths ...string) (out string, err error) {
+	var buf bytes.Buffer
+	err = requestPrefetch(t.dir, paths, 2, &buf)
+	out = buf.String()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *PrefetchTest) NoCacheDir() {
+	t.t.contentCache = nil
+
+	_, err := t.request("foo")
+	ExpectThat(err, Error(HasSubstr("without --cache-dir")))
+}
+
+func (t *PrefetchTest) FetchesFiles() {
+	t.create("foo", "taco")
+	t.create("dir/bar", "burrito")
+
+	out, err := t.request("foo", "dir/bar", "missing")
+	ExpectThat(err, Error(HasSubstr("1 files could not be prefetched")))
+
+	ExpectThat(out, HasSubstr("Fetched foo (4 bytes).\n"))
+	ExpectThat(out, HasSubstr("Fetched dir/bar (7 bytes).\n"))
+	ExpectThat(out, HasSubstr("Failed to fetch missing: "))
+	ExpectTrue(
+		strings.HasSuffix(
+			out,
+			"Fetched 2 files (11 bytes), 0 already cached, 1 failed.\n"),
+		"out: %q",
+		out)
+
+	objects, size, _, _ := t.t.contentCache.Usage()
+	ExpectEq(2, objects)
+	ExpectEq(11, size)
+}
+
+func (t *PrefetchTest) AlreadyCached() {
+	t.create("foo", "taco")
+
+	_, err := t.request("foo")
+	AssertEq(nil, err)
+
+	out, err := t.request("foo")
+	AssertEq(nil, err)
+	ExpectEq(
+		"Already cached: foo.\n"+
+			"Fetched 0 files (0 bytes), 1 already cached, 0 failed.\n",
+		out)
+}
+
+func (t *PrefetchTest) OnlyDir() {
+	t.t.prefetchPrefix = "baz/"
+	t.create("baz/foo", "taco")
+
+	_, err := t.request("foo")
+	AssertEq(nil, err)
+
+	cached := t.t.contentCache.Objects()
+	AssertEq(1, len(cached))
+	ExpectEq("baz/foo", cached[0].Object)
+}
+
+func (t *PrefetchTest) Manifest() {
+	manifest := strings.Join(
+		[]string{
+			"# Training data",
+			"foo",
+			"",
+			"  dir/./bar  ",
+			t.dir + "/baz",
+		},
+		"\n")
+
+	paths, err := readPrefetchManifest(t.dir, strings.NewReader(manifest))
+	AssertEq(nil, err)
+	ExpectThat(paths, ElementsAre("foo", "dir/bar", "baz"))
+
+	_, err = readPrefetchManifest(t.dir, strings.NewReader("/etc/passwd\n"))
+	ExpectThat(err, Error(HasSubstr("isn't within")))
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jacobsa/gcloud/httputil"
+)
+
+// Parse the values of --request-header, each of the form "Name: value", into
+// headers to add to every request to GCS.
+func parseRequestHeaders(specs []string) (h http.Header, err error) {
+	h = make(http.Header)
+	for _, spec := range specs {
+		i := strings.Index(spec, ":")
+		if i <= 0 {
+			err = fmt.Errorf("Expected \"Name: value\", got %q", spec)
+			return
+		}
+
+		name := http.CanonicalHeaderKey(strings.TrimSpace(spec[:i]))
+		value := strings.TrimSpace(spec[i+1:])
+
+		// Don't let these interfere with the requests themselves.
+		switch name {
+		case "Authorization", "Host", "Content-Length", "Content-Type", "Range":
+			err = fmt.Errorf("Header %q can't be set with --request-header", name)
+			return
+		}
+
+		h.Add(name, value)
+	}
+
+	return
+}
+
+// A transport that adds fixed headers to each request before passing it on,
+// such as X-Goog-Request-Reason, which GCS records in its audit logs.
+type headerTransport struct {
+	header  http.Header
+	wrapped httputil.CancellableRoundTripper
+}
+
+var _ httputil.CancellableRoundTripper = &headerTransport{}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Leave the caller's request alone, as the RoundTripper contract requires.
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+
+	return t.wrapped.RoundTrip(req)
+}
+
+// Requests are cancelled through their contexts, which are shared with the
+// clones we pass on, so there is nothing to map here.
+func (t *headerTransport) CancelRequest(req *http.Request) {
+	t.wrapped.CancelRequest(req)
+}
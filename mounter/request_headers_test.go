@@ -0,0 +1,97 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestRequestHeaders(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+// A transport that records the request most recently passed to it.
+type recordingTransport struct {
+	sent *http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	rt.sent = req
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func (rt *recordingTransport) CancelRequest(req *http.Request) {
+}
+
+type RequestHeadersTest struct {
+}
+
+func init() { RegisterTestSuite(&RequestHeadersTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *RequestHeadersTest) Parse() {
+	h, err := parseRequestHeaders([]string{
+		"x-goog-request-reason: team-foo",
+		"X-Mount-Name:data ",
+		"X-Mount-Name: more",
+	})
+
+	AssertEq(nil, err)
+	ExpectThat(h["X-Goog-Request-Reason"], ElementsAre("team-foo"))
+	ExpectThat(h["X-Mount-Name"], ElementsAre("data", "more"))
+}
+
+func (t *RequestHeadersTest) ParseErrors() {
+	_, err := parseRequestHeaders([]string{"X-Goog-Request-Reason"})
+	ExpectThat(err, Error(HasSubstr("Name: value")))
+
+	_, err = parseRequestHeaders([]string{": team-foo"})
+	ExpectThat(err, Error(HasSubstr("Name: value")))
+
+	_, err = parseRequestHeaders([]string{"authorization: Bearer taco"})
+	ExpectThat(err, Error(HasSubstr("Authorization")))
+}
+
+func (t *RequestHeadersTest) HeadersAdded() {
+	wrapped := &recordingTransport{}
+	transport := &headerTransport{
+		header:  http.Header{"X-Goog-Request-Reason": {"team-foo"}},
+		wrapped: wrapped,
+	}
+
+	req, err := http.NewRequest("GET", "https://www.googleapis.com/", nil)
+	AssertEq(nil, err)
+	req.Header.Set("User-Agent", "gcsfuse/0.0")
+
+	_, err = transport.RoundTrip(req)
+	AssertEq(nil, err)
+
+	AssertNe(nil, wrapped.sent)
+	ExpectEq("team-foo", wrapped.sent.Header.Get("X-Goog-Request-Reason"))
+	ExpectEq("gcsfuse/0.0", wrapped.sent.Header.Get("User-Agent"))
+
+	// The original request is untouched.
+	ExpectEq("", req.Header.Get("X-Goog-Request-Reason"))
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+)
+
+const (
+	cloudPlatformScope         = "https://www.googleapis.com/auth/cloud-platform"
+	cloudPlatformReadOnlyScope = "https://www.googleapis.com/auth/cloud-platform.read-only"
+)
+
+// For each scope that we request, the scopes that grant at least as much.
+var sufficientScopes = map[string][]string{
+	gcs.Scope_ReadOnly: []string{
+		gcs.Scope_ReadOnly,
+		gcs.Scope_ReadWrite,
+		gcs.Scope_FullControl,
+		cloudPlatformReadOnlyScope,
+		cloudPlatformScope,
+	},
+
+	gcs.Scope_ReadWrite: []string{
+		gcs.Scope_ReadWrite,
+		gcs.Scope_FullControl,
+		cloudPlatformScope,
+	},
+
+	storage.PubsubScope: []string{
+		storage.PubsubScope,
+		cloudPlatformScope,
+	},
+}
+
+// Is the mount described by the supplied flags read-only?
+func isReadOnly(flags *flagStorage) bool {
+	_, ok := flags.MountOptions["ro"]
+	return ok
+}
+
+// Choose the narrowest OAuth scope that allows everything a mount with the
+// supplied flags might do: read-only access for a read-only mount, and
+// read-write access otherwise. Neither allows changing access controls, which
+// gcsfuse never does.
+func chooseScope(flags *flagStorage) string {
+	if isReadOnly(flags) {
+		return gcs.Scope_ReadOnly
+	}
+
+	return gcs.Scope_ReadWrite
+}
+
+// Choose the OAuth scopes for a mount with the supplied flags: the one
+// chooseScope picks for GCS, along with one for pulling notifications from
+// --notification-subscription if it's given.
+func chooseScopes(flags *flagStorage) (scopes []string) {
+	scopes = []string{chooseScope(flags)}
+	if flags.NotificationSubscription != "" {
+		scopes = append(scopes, storage.PubsubScope)
+	}
+
+	return
+}
+
+// Return true if a token with the scopes in have may do everything that one
+// with the scope want may.
+func scopesSatisfy(have []string, want string) bool {
+	for _, s := range have {
+		for _, sufficient := range sufficientScopes[want] {
+			if s == sufficient {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"testing"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/storage"
+	"github.com/jacobsa/gcloud/gcs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestScopes(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ScopesTest struct {
+}
+
+func init() { RegisterTestSuite(&ScopesTest{}) }
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ScopesTest) ChooseScope() {
+	ExpectEq(gcs.Scope_ReadWrite, chooseScope(parseArgs([]string{})))
+	ExpectEq(gcs.Scope_ReadWrite, chooseScope(parseArgs([]string{"-o", "rw"})))
+	ExpectEq(gcs.Scope_ReadOnly, chooseScope(parseArgs([]string{"-o", "ro"})))
+}
+
+func (t *ScopesTest) ChooseScopes() {
+	ExpectThat(
+		chooseScopes(parseArgs([]string{"-o", "ro"})),
+		ElementsAre(gcs.Scope_ReadOnly))
+
+	ExpectThat(
+		chooseScopes(parseArgs([]string{
+			"--notification-subscription=projects/p/subscriptions/s",
+		})),
+		ElementsAre(gcs.Scope_ReadWrite, storage.PubsubScope))
+}
+
+func (t *ScopesTest) ReadOnly() {
+	const want = gcs.Scope_ReadOnly
+	const bigQuery = "https://www.googleapis.com/auth/bigquery"
+
+	ExpectTrue(scopesSatisfy([]string{gcs.Scope_ReadOnly}, want))
+	ExpectTrue(scopesSatisfy([]string{gcs.Scope_FullControl}, want))
+	ExpectTrue(scopesSatisfy([]string{cloudPlatformReadOnlyScope}, want))
+	ExpectTrue(scopesSatisfy([]string{bigQuery, gcs.Scope_ReadWrite}, want))
+	ExpectFalse(scopesSatisfy([]string{bigQuery}, want))
+	ExpectFalse(scopesSatisfy(nil, want))
+}
+
+func (t *ScopesTest) ReadWrite() {
+	const want = gcs.Scope_ReadWrite
+
+	ExpectTrue(scopesSatisfy([]string{gcs.Scope_ReadWrite}, want))
+	ExpectTrue(scopesSatisfy([]string{gcs.Scope_FullControl}, want))
+	ExpectTrue(scopesSatisfy([]string{cloudPlatformScope}, want))
+	ExpectFalse(scopesSatisfy([]string{gcs.Scope_ReadOnly}, want))
+	ExpectFalse(scopesSatisfy([]string{cloudPlatformReadOnlyScope}, want))
+}
+
+func (t *ScopesTest) Pubsub() {
+	const want = storage.PubsubScope
+
+	ExpectTrue(scopesSatisfy([]string{storage.PubsubScope}, want))
+	ExpectTrue(scopesSatisfy([]string{cloudPlatformScope}, want))
+	ExpectFalse(scopesSatisfy([]string{gcs.Scope_FullControl}, want))
+	ExpectFalse(scopesSatisfy([]string{cloudPlatformReadOnlyScope}, want))
+}
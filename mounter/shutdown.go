@@ -0,0 +1,187 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse"
+	"golang.org/x/net/context"
+)
+
+// Shut down gracefully on SIGINT or SIGTERM, as for shutDownAndUnmount.
+func registerShutdownHandler(
+	mountPoint string,
+	server fs.Server,
+	timeout time.Duration) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signalChan
+		logger.Infof("Received %v, shutting down...", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err := shutDownAndUnmount(ctx, mountPoint, server)
+		if err != nil {
+			logger.Errorf("Failed to unmount in response to %v: %v", sig, err)
+			return
+		}
+
+		// We keep serving a file system mounted by another process until we
+		// exit, which leaves it to that process to unmount.
+		if fuse.IsMountedFD(mountPoint) {
+			logger.Infof("Exiting in response to %v.", sig)
+			os.Exit(0)
+		}
+
+		logger.Infof("Unmounted in response to %v.", sig)
+	}()
+}
+
+// Stop serving new ops, write out dirty files, then unmount. If that takes
+// until the context is cancelled, report the files that weren't written out
+// and unmount lazily, detaching the file system even if it is busy. If even
+// that fails, serve the file system normally again rather than leave it
+// failing every op. A file system that another process mounted and passed to
+// us as a file descriptor is left for that process to unmount.
+func shutDownAndUnmount(
+	ctx context.Context,
+	mountPoint string,
+	server fs.Server) (err error) {
+	dirty := server.Shutdown(ctx, nil)
+	if len(dirty) != 0 {
+		logger.Errorf(
+			"%d files could not be written out and their changes will be "+
+				"lost: %q",
+			len(dirty),
+			dirty)
+	}
+
+	if fuse.IsMountedFD(mountPoint) {
+		return
+	}
+
+	// Unmounting fails while files are open, so keep trying until the
+	// deadline.
+	for {
+		err = fuse.Unmount(mountPoint)
+		if err == nil {
+			return
+		}
+
+		if ctx.Err() != nil {
+			logger.Errorf("Failed to unmount: %v", err)
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	err = forceUnmount(mountPoint)
+	if err != nil {
+		err = fmt.Errorf("forceUnmount: %v", err)
+		logger.Errorf("Failed to unmount lazily, serving again: %v", err)
+		server.Resume()
+		return
+	}
+
+	logger.Infof("Lazily unmounted %s.", mountPoint)
+	return
+}
+
+// Detach the file system at the supplied mount point even if it is busy.
+func forceUnmount(mountPoint string) (err error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "linux" {
+		cmd = exec.Command("fusermount", "-u", "-z", mountPoint)
+	} else {
+		cmd = exec.Command("umount", "-f", mountPoint)
+	}
+
+	if output, runErr := cmd.CombinedOutput(); runErr != nil {
+		err = fmt.Errorf("%v: %s", runErr, output)
+		return
+	}
+
+	return
+}
+
+// Unmount the file system once it has served no ops for the given duration
+// and has no open files, first writing out dirty files within the supplied
+// timeout, so that mounts made on demand by an automounter go away when no
+// longer used. Return once unmounted or when done is closed.
+func unmountWhenIdle(
+	mountPoint string,
+	server fs.Server,
+	idle time.Duration,
+	timeout time.Duration,
+	done <-chan struct{}) {
+	ticker := time.NewTicker(idle / 10)
+	defer ticker.Stop()
+
+	var nextAttempt time.Time
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+		}
+
+		if server.IdleTime() < idle || time.Now().Before(nextAttempt) {
+			continue
+		}
+
+		// If this attempt fails, don't try again until another idle period has
+		// passed.
+		nextAttempt = time.Now().Add(idle)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		dirty := server.Flush(ctx, nil)
+		cancel()
+
+		if len(dirty) != 0 {
+			logger.Errorf(
+				"Not unmounting while %d files can't be written out.",
+				len(dirty))
+			continue
+		}
+
+		// This fails if the file system is busy in a way that doesn't involve
+		// ops or open files, such as being some process's working directory.
+		err := fuse.Unmount(mountPoint)
+		if err != nil {
+			logger.Infof("Failed to unmount idle file system: %v", err)
+			continue
+		}
+
+		logger.Infof("Unmounted after being idle for %v.", idle)
+		return
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestShutdown(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A server reporting a fixed idle time and counting flushes.
+type idleServer struct {
+	fs.Server
+	idle    int64
+	flushes int64
+}
+
+func (s *idleServer) IdleTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.idle))
+}
+
+func (s *idleServer) Flush(
+	ctx context.Context,
+	progress fs.FlushProgress) (dirty []string) {
+	atomic.AddInt64(&s.flushes, 1)
+	return
+}
+
+// A server recording whether it is shut down.
+type resumingServer struct {
+	fs.Server
+	shutDown bool
+}
+
+func (s *resumingServer) Shutdown(
+	ctx context.Context,
+	progress fs.FlushProgress) (dirty []string) {
+	s.shutDown = true
+	return
+}
+
+func (s *resumingServer) Resume() {
+	s.shutDown = false
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type ShutdownTest struct {
+	// A directory that isn't a mount point, so unmounting it fails.
+	dir string
+}
+
+var _ SetUpInterface = &ShutdownTest{}
+var _ TearDownInterface = &ShutdownTest{}
+
+func init() { RegisterTestSuite(&ShutdownTest{}) }
+
+func (t *ShutdownTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "shutdown_test")
+	AssertEq(nil, err)
+}
+
+func (t *ShutdownTest) TearDown() {
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *ShutdownTest) ShutDownAndUnmount_FailureResumesServing() {
+	server := &resumingServer{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Neither unmounting nor lazily unmounting a directory that isn't a mount
+	// point succeeds.
+	err := shutDownAndUnmount(ctx, t.dir, server)
+	ExpectNe(nil, err)
+	ExpectFalse(server.shutDown)
+}
+
+func (t *ShutdownTest) UnmountWhenIdle_NotIdle() {
+	server := &idleServer{idle: int64(time.Millisecond)}
+
+	done := make(chan struct{})
+	go unmountWhenIdle(t.dir, server, 10*time.Millisecond, time.Second, done)
+
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+
+	ExpectEq(0, atomic.LoadInt64(&server.flushes))
+}
+
+func (t *ShutdownTest) UnmountWhenIdle_FailureBacksOff() {
+	server := &idleServer{idle: int64(time.Hour)}
+
+	done := make(chan struct{})
+	go unmountWhenIdle(t.dir, server, 200*time.Millisecond, time.Second, done)
+
+	// The first attempt, after a tenth of the idle time, flushes and then fails
+	// to unmount. The next waits for another idle period.
+	time.Sleep(100 * time.Millisecond)
+	ExpectEq(1, atomic.LoadInt64(&server.flushes))
+
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+
+	ExpectEq(2, atomic.LoadInt64(&server.flushes))
+}
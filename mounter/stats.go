@@ -0,0 +1,269 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+)
+
+// `gcsfuse stats` sends a controlRequest with Op "stats" to the process
+// serving a mount point, which replies with a single JSON statsReply.
+
+type statsReply struct {
+	FS fs.Stats `json:"fs"`
+
+	// Whether StatObject results are cached, and how many lookups the cache
+	// has answered and not.
+	StatCache       bool   `json:"stat_cache"`
+	StatCacheHits   uint64 `json:"stat_cache_hits"`
+	StatCacheMisses uint64 `json:"stat_cache_misses"`
+
+	// Whether there is a --cache-dir, what it holds, and how many reads it has
+	// served and not.
+	ContentCache        bool   `json:"content_cache"`
+	ContentCacheObjects int    `json:"content_cache_objects"`
+	ContentCacheBytes   int64  `json:"content_cache_bytes"`
+	ContentCacheHits    uint64 `json:"content_cache_hits"`
+	ContentCacheMisses  uint64 `json:"content_cache_misses"`
+
+	Throttles []throttleStats `json:"throttles"`
+}
+
+type throttleStats struct {
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+
+	// The rate in units per second, zero meaning no limit, and how long new
+	// requests must wait for those already let through to be paid for.
+	RateHz  float64       `json:"rate_hz"`
+	Backlog time.Duration `json:"backlog"`
+}
+
+////////////////////////////////////////////////////////////////////////
+// Daemon
+////////////////////////////////////////////////////////////////////////
+
+// Gather statistics from the file system and the layers beneath it.
+func collectStats(t *tunables) (r statsReply) {
+	r.FS = t.server.Stats()
+
+	if t.statCacheHits != nil {
+		r.StatCache = true
+		r.StatCacheHits, r.StatCacheMisses = t.statCacheHits.Hits()
+	}
+
+	if t.contentCache != nil {
+		r.ContentCache = true
+		r.ContentCacheObjects,
+			r.ContentCacheBytes,
+			r.ContentCacheHits,
+			r.ContentCacheMisses = t.contentCache.Usage()
+	}
+
+	throttles := []struct {
+		name     string
+		unit     string
+		throttle *gcsx.AdjustableThrottle
+	}{
+		{"operations", "ops", t.opThrottle},
+		{"egress", "bytes", t.egressThrottle},
+		{"egress per handle", "bytes", t.fairShareThrottle},
+	}
+
+	for _, th := range throttles {
+		if th.throttle == nil {
+			continue
+		}
+
+		s := throttleStats{Name: th.name, Unit: th.unit}
+		s.RateHz, s.Backlog = th.throttle.State()
+		r.Throttles = append(r.Throttles, s)
+	}
+
+	return
+}
+
+func (cl *controlListener) handleStats(conn net.Conn) {
+	r := collectStats(cl.t)
+	err := json.NewEncoder(conn).Encode(&r)
+	if err != nil {
+		logger.Errorf("Replying to stats request: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Command
+////////////////////////////////////////////////////////////////////////
+
+// Return the stats command, which calls action when run.
+func newStatsCommand(action func(c *cli.Context)) cli.Command {
+	return cli.Command{
+		Name: "stats",
+		Usage: "Print counters from the gcsfuse process serving the mount " +
+			"point: cache hit rates, dirty bytes, in-flight ops, and the state " +
+			"of rate limits.",
+		ArgsUsage: "mountpoint",
+		Action:    action,
+	}
+}
+
+func runStats(c *cli.Context) (err error) {
+	if len(c.Args()) != 1 {
+		err = fmt.Errorf("stats takes exactly one argument, the mount point")
+		return
+	}
+
+	mountPoint, err := filepath.Abs(c.Args()[0])
+	if err != nil {
+		err = fmt.Errorf("canonicalizing mount point: %v", err)
+		return
+	}
+
+	err = requestStats(mountPoint, os.Stdout)
+	return
+}
+
+// Ask the process serving the supplied absolute mount point for its
+// statistics, writing them to w.
+func requestStats(mountPoint string, w io.Writer) (err error) {
+	conn, err := dialControl(mountPoint, &controlRequest{Op: "stats"})
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	var r statsReply
+	err = json.NewDecoder(conn).Decode(&r)
+	if err == io.EOF {
+		err = fmt.Errorf("gcsfuse serving %s didn't answer", mountPoint)
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Reading reply: %v", err)
+		return
+	}
+
+	err = writeStats(w, &r)
+	return
+}
+
+func writeStats(w io.Writer, r *statsReply) (err error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Inodes:\t%d (%d forgotten)\n", r.FS.Inodes, r.FS.ForgottenInodes)
+	fmt.Fprintf(tw, "Open handles:\t%d\n", r.FS.OpenHandles)
+	fmt.Fprintf(
+		tw,
+		"Dirty files:\t%d (%s)\n",
+		r.FS.DirtyFiles,
+		formatBytes(r.FS.DirtyBytes))
+
+	if r.FS.BusyFiles != 0 {
+		fmt.Fprintf(tw, "Busy files:\t%d (not checked for dirtiness)\n", r.FS.BusyFiles)
+	}
+
+	if r.StatCache {
+		fmt.Fprintf(
+			tw,
+			"Stat cache:\t%s\n",
+			formatHitRate(r.StatCacheHits, r.StatCacheMisses))
+	} else {
+		fmt.Fprintf(tw, "Stat cache:\tdisabled\n")
+	}
+
+	if r.ContentCache {
+		fmt.Fprintf(
+			tw,
+			"Content cache:\t%d objects (%s), %s\n",
+			r.ContentCacheObjects,
+			formatBytes(r.ContentCacheBytes),
+			formatHitRate(r.ContentCacheHits, r.ContentCacheMisses))
+	}
+
+	for _, th := range r.Throttles {
+		fmt.Fprintf(tw, "Throttle (%s):\t%s\n", th.Name, formatThrottle(&th))
+	}
+
+	fmt.Fprintf(tw, "Ops in flight:\t%d\n", r.FS.OpsInFlight)
+
+	err = tw.Flush()
+	if err != nil {
+		return
+	}
+
+	// The op descriptions are too long to line up with the above.
+	for _, op := range r.FS.Ops {
+		fmt.Fprintf(w, "  %s for %v\n", op.Desc, op.Duration)
+	}
+
+	return
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatHitRate(hits, misses uint64) string {
+	total := hits + misses
+	if total == 0 {
+		return "no lookups"
+	}
+
+	return fmt.Sprintf(
+		"%.1f%% hit rate (%d hits, %d misses)",
+		100*float64(hits)/float64(total),
+		hits,
+		misses)
+}
+
+func formatThrottle(th *throttleStats) string {
+	if th.RateHz == 0 {
+		return "unlimited"
+	}
+
+	s := fmt.Sprintf("%.0f %s/s", th.RateHz, th.Unit)
+	if th.Backlog > 0 {
+		s += fmt.Sprintf(", %v backlog", th.Backlog)
+	} else {
+		s += ", no backlog"
+	}
+
+	return s
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestStats(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A server reporting fixed statistics.
+type statsServer struct {
+	fs.Server
+	stats fs.Stats
+}
+
+func (s *statsServer) Stats() fs.Stats {
+	return s.stats
+}
+
+// A stat cache reporting fixed counts.
+type hitCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *hitCounter) Hits() (hits uint64, misses uint64) {
+	return c.hits, c.misses
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type StatsTest struct {
+	dir      string
+	server   statsServer
+	t        tunables
+	listener *controlListener
+}
+
+var _ SetUpInterface = &StatsTest{}
+var _ TearDownInterface = &StatsTest{}
+
+func init() { RegisterTestSuite(&StatsTest{}) }
+
+func (t *StatsTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "stats_test")
+	AssertEq(nil, err)
+
+	t.t.server = &t.server
+	t.listener, err = listenForControl(t.dir, &t.t, time.Millisecond)
+	AssertEq(nil, err)
+}
+
+func (t *StatsTest) TearDown() {
+	t.listener.Close()
+	os.RemoveAll(t.dir)
+}
+
+func (t *StatsTest) request() (out string, err error) {
+	var buf bytes.Buffer
+	err = requestStats(t.dir, &buf)
+	out = buf.String()
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *StatsTest) NoProcess() {
+	var buf bytes.Buffer
+	err := requestStats(t.dir+"/foo", &buf)
+	ExpectThat(err, Error(HasSubstr("Couldn't reach")))
+}
+
+func (t *StatsTest) FileSystem() {
+	t.server.stats = fs.Stats{
+		Inodes:          17,
+		ForgottenInodes: 3,
+		OpenHandles:     2,
+		OpsInFlight:     1,
+		Ops: []fs.OpStats{
+			{Desc: "ReadFile (inode 5)", Duration: 2 * time.Second},
+		},
+		DirtyFiles: 1,
+		DirtyBytes: 3 << 20,
+		BusyFiles:  1,
+	}
+
+	out, err := t.request()
+	AssertEq(nil, err)
+
+	ExpectThat(out, HasSubstr("Inodes:         17 (3 forgotten)\n"))
+	ExpectThat(out, HasSubstr("Open handles:   2\n"))
+	ExpectThat(out, HasSubstr("Dirty files:    1 (3.0 MiB)\n"))
+	ExpectThat(out, HasSubstr("Busy files:     1 (not checked for dirtiness)\n"))
+	ExpectThat(out, HasSubstr("Ops in flight:  1\n"))
+	ExpectThat(out, HasSubstr("  ReadFile (inode 5) for 2s\n"))
+	ExpectThat(out, HasSubstr("Stat cache:     disabled\n"))
+}
+
+func (t *StatsTest) StatCache() {
+	t.t.statCacheHits = &hitCounter{hits: 3, misses: 1}
+
+	out, err := t.request()
+	AssertEq(nil, err)
+	ExpectThat(out, HasSubstr("75.0% hit rate (3 hits, 1 misses)\n"))
+}
+
+func (t *StatsTest) ContentCache() {
+	dir, err := ioutil.TempDir("", "stats_test")
+	AssertEq(nil, err)
+	defer os.RemoveAll(dir)
+
+	t.t.contentCache, err = gcsx.NewContentCache(dir, 0, nil)
+	AssertEq(nil, err)
+
+	out, err := t.request()
+	AssertEq(nil, err)
+	ExpectThat(out, HasSubstr("Content cache:  0 objects (0 bytes), no lookups\n"))
+}
+
+func (t *StatsTest) Throttles() {
+	var err error
+	t.t.opThrottle, err = gcsx.NewAdjustableThrottle(0, time.Hour)
+	AssertEq(nil, err)
+
+	t.t.egressThrottle, err = gcsx.NewAdjustableThrottle(1024, time.Hour)
+	AssertEq(nil, err)
+
+	out, err := t.request()
+	AssertEq(nil, err)
+	ExpectThat(out, HasSubstr("Throttle (operations):  unlimited\n"))
+	ExpectThat(out, HasSubstr("Throttle (egress):      1024 bytes/s, no backlog\n"))
+}
+
+func (t *StatsTest) FormatBytes() {
+	ExpectEq("0 bytes", formatBytes(0))
+	ExpectEq("1023 bytes", formatBytes(1023))
+	ExpectEq("1.0 KiB", formatBytes(1024))
+	ExpectEq("1.5 GiB", formatBytes(3<<29))
+}
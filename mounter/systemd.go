@@ -0,0 +1,126 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"golang.org/x/net/context"
+)
+
+// Support for systemd's service notification protocol (cf. sd_notify(3)), so
+// that a unit with Type=notify knows when the file system has been mounted,
+// and one with WatchdogSec= restarts gcsfuse if the file system stops
+// responding.
+
+// Send a state such as "READY=1" to the socket named by $NOTIFY_SOCKET. Do
+// nothing if it isn't set, i.e. if systemd isn't listening.
+func sdNotify(state string) (err error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return
+	}
+
+	// A leading '@' denotes a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix(
+		"unixgram",
+		nil,
+		&net.UnixAddr{Name: name, Net: "unixgram"})
+
+	if err != nil {
+		err = fmt.Errorf("DialUnix: %v", err)
+		return
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		err = fmt.Errorf("Write: %v", err)
+		return
+	}
+
+	return
+}
+
+// Return the interval within which systemd expects a watchdog ping from this
+// process, or zero if it doesn't expect any.
+func watchdogInterval() (d time.Duration, err error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return
+	}
+
+	// The watchdog may be meant for another process, such as one that ran us.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" {
+		if pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+	}
+
+	n, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil {
+		err = fmt.Errorf("Invalid WATCHDOG_USEC: %q", usec)
+		return
+	}
+
+	d = time.Duration(n) * time.Microsecond
+	return
+}
+
+// Ping systemd's watchdog at half the supplied interval, each time first
+// checking that the file system at the mount point responds. When it
+// doesn't, skip the ping, so that systemd restarts us if it stays wedged for
+// the whole interval. Return when done is closed.
+func pingWatchdog(
+	mountPoint string,
+	interval time.Duration,
+	done <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+		}
+
+		// Don't check the bucket: an outage of GCS isn't fixed by restarting.
+		ctx, cancel := context.WithTimeout(context.Background(), interval/2)
+		err := checkHealth(ctx, mountPoint, nil)
+		cancel()
+
+		if err != nil {
+			logger.Errorf("Skipping watchdog ping: %v", err)
+			continue
+		}
+
+		err = sdNotify("WATCHDOG=1")
+		if err != nil {
+			logger.Errorf("sdNotify: %v", err)
+		}
+	}
+}
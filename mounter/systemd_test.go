@@ -0,0 +1,162 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestSystemd(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type SystemdTest struct {
+	dir string
+
+	// A socket standing in for systemd's, named by $NOTIFY_SOCKET.
+	socket *net.UnixConn
+}
+
+var _ SetUpInterface = &SystemdTest{}
+var _ TearDownInterface = &SystemdTest{}
+
+func init() { RegisterTestSuite(&SystemdTest{}) }
+
+func (t *SystemdTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.dir, err = ioutil.TempDir("", "systemd_test")
+	AssertEq(nil, err)
+
+	name := path.Join(t.dir, "notify")
+	t.socket, err = net.ListenUnixgram(
+		"unixgram",
+		&net.UnixAddr{Name: name, Net: "unixgram"})
+
+	AssertEq(nil, err)
+	os.Setenv("NOTIFY_SOCKET", name)
+}
+
+func (t *SystemdTest) TearDown() {
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	t.socket.Close()
+	os.RemoveAll(t.dir)
+}
+
+// Return the next message sent to the socket, or "" if there is none soon.
+func (t *SystemdTest) receive(timeout time.Duration) string {
+	t.socket.SetReadDeadline(time.Now().Add(timeout))
+
+	buf := make([]byte, 1024)
+	n, err := t.socket.Read(buf)
+	if err != nil {
+		return ""
+	}
+
+	return string(buf[:n])
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *SystemdTest) Notify() {
+	err := sdNotify("READY=1")
+	AssertEq(nil, err)
+	ExpectEq("READY=1", t.receive(time.Second))
+}
+
+func (t *SystemdTest) Notify_NoSocket() {
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	err := sdNotify("READY=1")
+	ExpectEq(nil, err)
+}
+
+func (t *SystemdTest) Notify_SocketMissing() {
+	os.Setenv("NOTIFY_SOCKET", path.Join(t.dir, "missing"))
+
+	err := sdNotify("READY=1")
+	ExpectThat(err, Error(HasSubstr("DialUnix")))
+}
+
+func (t *SystemdTest) WatchdogInterval() {
+	var d time.Duration
+	var err error
+
+	// Unset
+	d, err = watchdogInterval()
+	AssertEq(nil, err)
+	ExpectEq(0, d)
+
+	// Set for this process
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	d, err = watchdogInterval()
+	AssertEq(nil, err)
+	ExpectEq(30*time.Second, d)
+
+	// Set for another process
+	os.Setenv("WATCHDOG_PID", "1")
+
+	d, err = watchdogInterval()
+	AssertEq(nil, err)
+	ExpectEq(0, d)
+
+	// Malformed
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "taco")
+
+	_, err = watchdogInterval()
+	ExpectThat(err, Error(HasSubstr("taco")))
+}
+
+func (t *SystemdTest) PingWatchdog() {
+	mountPoint := path.Join(t.dir, "mount_point")
+	err := os.Mkdir(mountPoint, 0700)
+	AssertEq(nil, err)
+
+	done := make(chan struct{})
+	defer close(done)
+	go pingWatchdog(mountPoint, 20*time.Millisecond, done)
+
+	// Pings are sent while the mount point responds.
+	ExpectEq("WATCHDOG=1", t.receive(time.Second))
+	ExpectEq("WATCHDOG=1", t.receive(time.Second))
+
+	// They stop when it doesn't.
+	err = os.Remove(mountPoint)
+	AssertEq(nil, err)
+
+	for t.receive(50*time.Millisecond) != "" {
+	}
+
+	ExpectEq("", t.receive(100*time.Millisecond))
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/fuse"
+	"golang.org/x/net/context"
+)
+
+// `gcsfuse unmount` sends a controlRequest with Op "unmount" to the process
+// serving a mount point, asking it to write out its dirty files and unmount.
+// The reply is a stream of JSON unmountEvents ending with one whose Event is
+// "unmounted" or "error".
+
+type unmountEvent struct {
+	// "writing" and "wrote" for progress with the file named by File, and
+	// "unmounted" or "error" for the outcome.
+	Event string `json:"event"`
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////
+// Daemon
+////////////////////////////////////////////////////////////////////////
+
+// Reports progress to the requester, ignoring failures to do so. A requester
+// that goes away doesn't stop the unmount.
+type unmountReporter struct {
+	enc *json.Encoder
+}
+
+func (r *unmountReporter) send(e unmountEvent) {
+	r.enc.Encode(&e)
+}
+
+func (r *unmountReporter) Writing(name string) {
+	r.send(unmountEvent{Event: "writing", File: name})
+}
+
+func (r *unmountReporter) Wrote(name string, err error) {
+	e := unmountEvent{Event: "wrote", File: name}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	r.send(e)
+}
+
+func (cl *controlListener) handleUnmount(
+	conn net.Conn,
+	req *controlRequest) {
+	cl.unmountMu.Lock()
+	defer cl.unmountMu.Unlock()
+
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = cl.defaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logger.Infof("Received an unmount request; writing out dirty files...")
+	r := &unmountReporter{enc: json.NewEncoder(conn)}
+
+	err := safeUnmount(ctx, cl.mountPoint, cl.t.server, r)
+	if err != nil {
+		logger.Errorf("Not unmounting: %v", err)
+		r.send(unmountEvent{Event: "error", Error: err.Error()})
+		return
+	}
+
+	logger.Infof("Unmounted on request.")
+	r.send(unmountEvent{Event: "unmounted"})
+}
+
+// Write out dirty files, then unmount once the file system isn't busy. Unlike
+// shutDownAndUnmount, give up if either doesn't happen before the context is
+// cancelled, leaving the file system mounted and serving as before so that
+// nothing is lost.
+func safeUnmount(
+	ctx context.Context,
+	mountPoint string,
+	server fs.Server,
+	progress fs.FlushProgress) (err error) {
+	dirty := server.Flush(ctx, progress)
+	if len(dirty) != 0 {
+		err = fmt.Errorf(
+			"%d files could not be written out, so the file system is still "+
+				"mounted: %q",
+			len(dirty),
+			dirty)
+		return
+	}
+
+	for {
+		err = fuse.Unmount(mountPoint)
+		if err == nil {
+			return
+		}
+
+		if ctx.Err() != nil {
+			err = fmt.Errorf("The file system is still mounted: %v", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Command
+////////////////////////////////////////////////////////////////////////
+
+// Return the unmount command, which calls action when run.
+func newUnmountCommand(action func(c *cli.Context)) cli.Command {
+	return cli.Command{
+		Name: "unmount",
+		Usage: "Have the gcsfuse process serving the mount point write out " +
+			"dirty files, then unmount it, reporting progress. If that can't be " +
+			"done in time, the file system is left mounted.",
+		ArgsUsage: "mountpoint",
+		Flags: []cli.Flag{
+			cli.DurationFlag{
+				Name: "timeout",
+				Usage: "How long to wait for dirty files to be written out and " +
+					"the file system to stop being busy. (default: the mount's " +
+					"--shutdown-timeout)",
+			},
+		},
+		Action: action,
+	}
+}
+
+func runUnmount(c *cli.Context) (err error) {
+	if len(c.Args()) != 1 {
+		err = fmt.Errorf("unmount takes exactly one argument, the mount point")
+		return
+	}
+
+	mountPoint, err := filepath.Abs(c.Args()[0])
+	if err != nil {
+		err = fmt.Errorf("canonicalizing mount point: %v", err)
+		return
+	}
+
+	err = requestUnmount(mountPoint, c.Duration("timeout"), os.Stdout)
+	return
+}
+
+// Ask the process serving the supplied absolute mount point to unmount it,
+// writing its progress to w.
+func requestUnmount(
+	mountPoint string,
+	timeout time.Duration,
+	w io.Writer) (err error) {
+	conn, err := dialControl(
+		mountPoint,
+		&controlRequest{Op: "unmount", Timeout: timeout})
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	d := json.NewDecoder(conn)
+	for {
+		var e unmountEvent
+		err = d.Decode(&e)
+		if err == io.EOF {
+			err = fmt.Errorf("gcsfuse exited before unmounting %s", mountPoint)
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Reading reply: %v", err)
+			return
+		}
+
+		switch e.Event {
+		case "writing":
+			fmt.Fprintf(w, "Writing out %s...\n", e.File)
+
+		case "wrote":
+			if e.Error != "" {
+				fmt.Fprintf(w, "Failed to write out %s: %s\n", e.File, e.Error)
+			} else {
+				fmt.Fprintf(w, "Wrote out %s.\n", e.File)
+			}
+
+		case "unmounted":
+			fmt.Fprintf(w, "Unmounted %s.\n", mountPoint)
+			return
+
+		case "error":
+			err = fmt.Errorf("%s", e.Error)
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/fs"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/net/context"
+)
+
+func TestUnmount(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A server whose flushes report writing out a fixed set of files, failing
+// for some of them.
+type flushingServer struct {
+	fs.Server
+	files  []string
+	failed map[string]bool
+}
+
+func (s *flushingServer) Flush(
+	ctx context.Context,
+	progress fs.FlushProgress) (dirty []string) {
+	for _, name := range s.files {
+		progress.Writing(name)
+
+		var err error
+		if s.failed[name] {
+			err = errors.New("taco")
+			dirty = append(dirty, name)
+		}
+
+		progress.Wrote(name, err)
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type UnmountTest struct {
+	// A directory that isn't a mount point, so unmounting it fails.
+	dir string
+
+	server   flushingServer
+	listener *controlListener
+}
+
+var _ SetUpInterface = &UnmountTest{}
+var _ TearDownInterface = &UnmountTest{}
+
+func init() { RegisterTestSuite(&UnmountTest{}) }
+
+func (t *UnmountTest) SetUp(ti *TestInfo) {
+	var err error
+	t.dir, err = ioutil.TempDir("", "unmount_test")
+	AssertEq(nil, err)
+
+	t.listener, err = listenForControl(
+		t.dir,
+		&tunables{server: &t.server},
+		time.Millisecond)
+
+	AssertEq(nil, err)
+}
+
+func (t *UnmountTest) TearDown() {
+	t.listener.Close()
+	os.RemoveAll(t.dir)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *UnmountTest) NoProcess() {
+	var buf bytes.Buffer
+	err := requestUnmount(t.dir+"/foo", 0, &buf)
+	ExpectThat(err, Error(HasSubstr("Couldn't reach")))
+}
+
+func (t *UnmountTest) DirtyFilesRemain() {
+	t.server.files = []string{"foo", "bar"}
+	t.server.failed = map[string]bool{"bar": true}
+
+	var buf bytes.Buffer
+	err := requestUnmount(t.dir, 0, &buf)
+	ExpectThat(err, Error(HasSubstr("1 files could not be written out")))
+	ExpectThat(err, Error(HasSubstr("still mounted")))
+
+	ExpectEq(
+		"Writing out foo...\n"+
+			"Wrote out foo.\n"+
+			"Writing out bar...\n"+
+			"Failed to write out bar: taco\n",
+		buf.String())
+}
+
+func (t *UnmountTest) UnmountFails() {
+	t.server.files = []string{"foo"}
+
+	var buf bytes.Buffer
+	err := requestUnmount(t.dir, 100*time.Millisecond, &buf)
+	ExpectThat(err, Error(HasSubstr("still mounted")))
+	ExpectEq("Writing out foo...\nWrote out foo.\n", buf.String())
+}
+
+func (t *UnmountTest) Closed() {
+	t.listener.Close()
+
+	var buf bytes.Buffer
+	err := requestUnmount(t.dir, 0, &buf)
+	ExpectThat(err, Error(HasSubstr("Couldn't reach")))
+}
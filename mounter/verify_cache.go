@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/codegangsta/cli"
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/googlecloudplatform/gcsfuse/internal/logger"
+	"github.com/jacobsa/gcloud/gcs"
+	"golang.org/x/net/context"
+)
+
+// `gcsfuse verify-cache` sends a controlRequest with Op "verify-cache" to the
+// process serving a mount point, asking it to check each object in its
+// --cache-dir against its manifest and against GCS. The reply is a stream of
+// JSON verifyEvents, one for each object, ending with one whose Event is
+// "done" or "error".
+
+type verifyEvent struct {
+	// For the object named by Object: "ok"; "mismatch", with Evicted set if
+	// its content was discarded; "unchecked" if it couldn't be compared with
+	// GCS; or "skipped" if it belongs to another bucket. Then "done" or
+	// "error" for the outcome.
+	Event   string `json:"event"`
+	Object  string `json:"object,omitempty"`
+	Evicted bool   `json:"evicted,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////
+// Daemon
+////////////////////////////////////////////////////////////////////////
+
+func (cl *controlListener) handleVerifyCache(
+	conn net.Conn,
+	req *controlRequest) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &eventReporter{cancel: cancel, enc: json.NewEncoder(conn)}
+
+	if cl.t.contentCache == nil {
+		r.send(verifyEvent{
+			Event: "error",
+			Error: "The file system was mounted without --cache-dir",
+		})
+
+		return
+	}
+
+	parallelism := req.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultPrefetchParallelism
+	}
+
+	objects := cl.t.contentCache.Objects()
+	sort.Sort(cachedObjectsByName(objects))
+
+	logger.Infof("Verifying %d cached objects...", len(objects))
+
+	err := runParallel(
+		ctx,
+		parallelism,
+		len(objects),
+		func(ctx context.Context, i int) {
+			e := cl.verify(ctx, objects[i], req.ReportOnly)
+			if e.Event == "mismatch" {
+				logger.Warningf("Cached %q: %s", e.Object, e.Error)
+			}
+
+			r.send(e)
+		})
+
+	if err != nil {
+		logger.Infof("Cache verification abandoned: %v", err)
+		return
+	}
+
+	logger.Infof("Verified %d cached objects.", len(objects))
+	r.send(verifyEvent{Event: "done"})
+}
+
+// Check the supplied cached content against its manifest and against the
+// latest generation of the object in GCS, evicting it if either doesn't
+// match, unless told only to report.
+func (cl *controlListener) verify(
+	ctx context.Context,
+	c gcsx.CachedObject,
+	reportOnly bool) (e verifyEvent) {
+	e.Object = c.Object
+
+	// We can ask GCS only about our own bucket.
+	if c.Bucket != cl.t.prefetchBucket.Name() {
+		e.Event = "skipped"
+		return
+	}
+
+	problem := cl.t.contentCache.Check(c)
+	if problem == nil {
+		o, err := cl.t.prefetchBucket.StatObject(
+			ctx,
+			&gcs.StatObjectRequest{Name: c.Object})
+
+		_, notFound := err.(*gcs.NotFoundError)
+		switch {
+		case notFound:
+			problem = fmt.Errorf("deleted from GCS")
+
+		case err != nil:
+			e.Event = "unchecked"
+			e.Error = fmt.Sprintf("StatObject: %v", err)
+			return
+
+		case o.Generation != c.Generation:
+			problem = fmt.Errorf(
+				"replaced in GCS by generation %d, cached %d",
+				o.Generation,
+				c.Generation)
+
+		case o.CRC32C != c.CRC32C:
+			problem = fmt.Errorf(
+				"GCS reports CRC32C %#08x, cached %#08x",
+				o.CRC32C,
+				c.CRC32C)
+		}
+	}
+
+	if problem == nil {
+		e.Event = "ok"
+		return
+	}
+
+	e.Event = "mismatch"
+	e.Error = problem.Error()
+	if !reportOnly {
+		cl.t.contentCache.Evict(c)
+		e.Evicted = true
+	}
+
+	return
+}
+
+type cachedObjectsByName []gcsx.CachedObject
+
+func (s cachedObjectsByName) Len() int           { return len(s) }
+func (s cachedObjectsByName) Less(i, j int) bool { return s[i].Object < s[j].Object }
+func (s cachedObjectsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+////////////////////////////////////////////////////////////////////////
+// Command
+////////////////////////////////////////////////////////////////////////
+
+// Return the verify-cache command, which calls action when run.
+func newVerifyCacheCommand(action func(c *cli.Context)) cli.Command {
+	return cli.Command{
+		Name: "verify-cache",
+		Usage: "Have the gcsfuse process serving the mount point check each " +
+			"object in its --cache-dir against the checksum recorded when it " +
+			"was fetched and against the latest generation in GCS, evicting " +
+			"those that don't match.",
+		ArgsUsage: "mountpoint",
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name: "report-only",
+				Usage: "Report objects that don't match without evicting them, " +
+					"and fail if there are any.",
+			},
+
+			cli.IntFlag{
+				Name:  "parallelism",
+				Value: defaultPrefetchParallelism,
+				Usage: "How many objects to check at once.",
+			},
+		},
+		Action: action,
+	}
+}
+
+func runVerifyCache(c *cli.Context) (err error) {
+	if len(c.Args()) != 1 {
+		err = fmt.Errorf("verify-cache takes exactly one argument, the mount point")
+		return
+	}
+
+	mountPoint, err := filepath.Abs(c.Args()[0])
+	if err != nil {
+		err = fmt.Errorf("canonicalizing mount point: %v", err)
+		return
+	}
+
+	err = requestVerifyCache(
+		mountPoint,
+		c.Bool("report-only"),
+		c.Int("parallelism"),
+		os.Stdout)
+
+	return
+}
+
+// Ask the process serving the supplied absolute mount point to verify its
+// cache, writing the problems found to w.
+func requestVerifyCache(
+	mountPoint string,
+	reportOnly bool,
+	parallelism int,
+	w io.Writer) (err error) {
+	conn, err := dialControl(
+		mountPoint,
+		&controlRequest{
+			Op:          "verify-cache",
+			ReportOnly:  reportOnly,
+			Parallelism: parallelism,
+		})
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	var ok, mismatched, unchecked, skipped int
+
+	d := json.NewDecoder(conn)
+	for {
+		var e verifyEvent
+		err = d.Decode(&e)
+		if err == io.EOF {
+			err = fmt.Errorf("gcsfuse exited before verification finished")
+			return
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Reading reply: %v", err)
+			return
+		}
+
+		switch e.Event {
+		case "ok":
+			ok++
+
+		case "skipped":
+			skipped++
+
+		case "mismatch":
+			mismatched++
+			if e.Evicted {
+				fmt.Fprintf(w, "Evicted %s: %s\n", e.Object, e.Error)
+			} else {
+				fmt.Fprintf(w, "Mismatch in %s: %s\n", e.Object, e.Error)
+			}
+
+		case "unchecked":
+			unchecked++
+			fmt.Fprintf(w, "Couldn't check %s: %s\n", e.Object, e.Error)
+
+		case "done":
+			verb := "evicted"
+			if reportOnly {
+				verb = "mismatched"
+			}
+
+			fmt.Fprintf(
+				w,
+				"Checked %d objects: %d ok, %d %s, %d couldn't be checked, "+
+					"%d skipped as belonging to other buckets.\n",
+				ok+mismatched+unchecked,
+				ok,
+				mismatched,
+				verb,
+				unchecked,
+				skipped)
+
+			switch {
+			case unchecked != 0:
+				err = fmt.Errorf("%d objects couldn't be checked", unchecked)
+
+			case reportOnly && mismatched != 0:
+				err = fmt.Errorf("%d objects don't match", mismatched)
+			}
+
+			return
+
+		case "error":
+			err = fmt.Errorf("%s", e.Error)
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/gcsfuse/internal/gcsx"
+	"github.com/jacobsa/gcloud/gcs"
+	"github.com/jacobsa/gcloud/gcs/gcsfake"
+	"github.com/jacobsa/gcloud/gcs/gcsutil"
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+	"github.com/jacobsa/timeutil"
+	"golang.org/x/net/context"
+)
+
+func TestVerifyCache(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type VerifyCacheTest struct {
+	ctx      context.Context
+	dir      string
+	bucket   gcs.Bucket
+	t        tunables
+	listener *controlListener
+}
+
+var _ SetUpInterface = &VerifyCacheTest{}
+var _ TearDownInterface = &VerifyCacheTest{}
+
+func init() { RegisterTestSuite(&VerifyCacheTest{}) }
+
+func (t *VerifyCacheTest) SetUp(ti *TestInfo) {
+	var err error
+	t.ctx = ti.Ctx
+
+	t.dir, err = ioutil.TempDir("", "verify_cache_test")
+	AssertEq(nil, err)
+
+	t.bucket = gcsfake.NewFakeBucket(timeutil.RealClock(), "some_bucket")
+	t.t.prefetchBucket = t.bucket
+	t.t.contentCache, err = gcsx.NewContentCache(
+		filepath.Join(t.dir, "cache"),
+		0,
+		nil)
+
+	AssertEq(nil, err)
+
+	t.listener, err = listenForControl(t.dir, &t.t, time.Millisecond)
+	AssertEq(nil, err)
+}
+
+func (t *VerifyCacheTest) TearDown() {
+	t.listener.Close()
+	os.RemoveAll(t.dir)
+}
+
+// Create an object in the supplied bucket and cache it.
+func (t *VerifyCacheTest) cache(
+	bucket gcs.Bucket,
+	name string,
+	contents string) {
+	o, err := gcsutil.CreateObject(t.ctx, bucket, name, []byte(contents))
+	AssertEq(nil, err)
+
+	_, err = t.t.contentCache.Insert(t.ctx, bucket, o)
+	AssertEq(nil, err)
+}
+
+func (t *VerifyCacheTest) request(reportOnly bool) (out string, err error) {
+	var buf bytes.Buffer
+	err = requestVerifyCache(t.dir, reportOnly, 2, &buf)
+	out = buf.String()
+	return
+}
+
+func (t *VerifyCacheTest) cachedObjects() int {
+	objects, _, _, _ := t.t.contentCache.Usage()
+	return objects
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *VerifyCacheTest) NoCacheDir() {
+	t.t.contentCache = nil
+
+	_, err := t.request(false)
+	ExpectThat(err, Error(HasSubstr("without --cache-dir")))
+}
+
+func (t *VerifyCacheTest) AllOK() {
+	t.cache(t.bucket, "foo", "taco")
+	t.cache(t.bucket, "bar", "burrito")
+
+	out, err := t.request(false)
+	AssertEq(nil, err)
+	ExpectEq(
+		"Checked 2 objects: 2 ok, 0 evicted, 0 couldn't be checked, "+
+			"0 skipped as belonging to other buckets.\n",
+		out)
+
+	ExpectEq(2, t.cachedObjects())
+}
+
+func (t *VerifyCacheTest) ReplacedInGCS() {
+	t.cache(t.bucket, "foo", "taco")
+	t.cache(t.bucket, "bar", "burrito")
+
+	_, err := gcsutil.CreateObject(t.ctx, t.bucket, "foo", []byte("enchilada"))
+	AssertEq(nil, err)
+
+	out, err := t.request(false)
+	AssertEq(nil, err)
+	ExpectThat(out, HasSubstr("Evicted foo: replaced in GCS by generation"))
+	ExpectThat(out, HasSubstr("1 ok, 1 evicted"))
+
+	ExpectEq(1, t.cachedObjects())
+}
+
+func (t *VerifyCacheTest) DeletedFromGCS_ReportOnly() {
+	t.cache(t.bucket, "foo", "taco")
+
+	err := t.bucket.DeleteObject(t.ctx, &gcs.DeleteObjectRequest{Name: "foo"})
+	AssertEq(nil, err)
+
+	out, err := t.request(true)
+	ExpectThat(err, Error(HasSubstr("1 objects don't match")))
+	ExpectThat(out, HasSubstr("Mismatch in foo: deleted from GCS\n"))
+	ExpectThat(out, HasSubstr("0 ok, 1 mismatched"))
+
+	ExpectEq(1, t.cachedObjects())
+}
+
+func (t *VerifyCacheTest) CorruptContent() {
+	t.cache(t.bucket, "foo", "taco")
+
+	cached := t.t.contentCache.Objects()
+	AssertEq(1, len(cached))
+
+	err := ioutil.WriteFile(cached[0].Path, []byte("tacp"), 0600)
+	AssertEq(nil, err)
+
+	out, err := t.request(false)
+	AssertEq(nil, err)
+	ExpectThat(out, HasSubstr("Evicted foo: content has 4 bytes with CRC32C"))
+
+	ExpectEq(0, t.cachedObjects())
+}
+
+func (t *VerifyCacheTest) OtherBucket() {
+	other := gcsfake.NewFakeBucket(timeutil.RealClock(), "other_bucket")
+	t.cache(other, "foo", "taco")
+
+	out, err := t.request(false)
+	AssertEq(nil, err)
+	ExpectThat(out, HasSubstr("0 ok, 0 evicted, 0 couldn't be checked, 1 skipped"))
+
+	ExpectEq(1, t.cachedObjects())
+}
@@ -25,6 +25,7 @@
 // For Linux, writes the following to dst_dir:
 //
 //     bin/gcsfuse
+//     bin/docker_volume_gcsfuse
 //     sbin/mount.fuse.gcsfuse
 //     sbin/mount.gcsfuse
 //
@@ -104,10 +105,12 @@ func buildBinaries(
 	}
 
 	// Build the binaries.
-	binaries := []struct {
+	type binary struct {
 		goTarget   string
 		outputPath string
-	}{
+	}
+
+	binaries := []binary{
 		{
 			"github.com/googlecloudplatform/gcsfuse",
 			"bin/gcsfuse",
@@ -118,6 +121,14 @@ func buildBinaries(
 		},
 	}
 
+	// Docker volume plugins are supported only on Linux.
+	if osys == "linux" {
+		binaries = append(binaries, binary{
+			"github.com/googlecloudplatform/gcsfuse/tools/docker_volume_gcsfuse",
+			"bin/docker_volume_gcsfuse",
+		})
+	}
+
 	for _, bin := range binaries {
 		log.Printf("Building %s to %s", bin.goTarget, bin.outputPath)
 
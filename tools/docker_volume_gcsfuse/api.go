@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// The HTTP side of Docker's volume plugin protocol. Each endpoint takes a
+// JSON request by POST and returns a JSON response, with failures reported in
+// its Err field.
+//
+// Cf. https://docs.docker.com/engine/extend/plugins_volume/
+
+const pluginContentType = "application/vnd.docker.plugins.v1.2+json"
+
+type volumeRequest struct {
+	Name string
+	Opts map[string]string
+	ID   string
+}
+
+type volumeInfo struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type volumeResponse struct {
+	Mountpoint   string        `json:",omitempty"`
+	Volume       *volumeInfo   `json:",omitempty"`
+	Volumes      []volumeInfo  `json:",omitempty"`
+	Capabilities *capabilities `json:",omitempty"`
+	Err          string
+}
+
+type capabilities struct {
+	Scope string
+}
+
+// Return a handler serving the plugin protocol for the driver.
+func newHandler(d *driver) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, map[string][]string{"Implements": {"VolumeDriver"}})
+	})
+
+	handle := func(
+		endpoint string,
+		f func(req *volumeRequest, resp *volumeResponse) error) {
+		mux.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
+			var req volumeRequest
+			var resp volumeResponse
+
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err == nil {
+				err = f(&req, &resp)
+			}
+
+			if err != nil {
+				log.Printf("%s %q: %v", endpoint, req.Name, err)
+				resp = volumeResponse{Err: err.Error()}
+			}
+
+			writeResponse(w, &resp)
+		})
+	}
+
+	handle("/VolumeDriver.Create", func(req *volumeRequest, resp *volumeResponse) error {
+		return d.create(req.Name, req.Opts)
+	})
+
+	handle("/VolumeDriver.Remove", func(req *volumeRequest, resp *volumeResponse) error {
+		return d.remove(req.Name)
+	})
+
+	handle("/VolumeDriver.Mount", func(req *volumeRequest, resp *volumeResponse) (err error) {
+		resp.Mountpoint, err = d.mountVolume(req.Name, req.ID)
+		return
+	})
+
+	handle("/VolumeDriver.Unmount", func(req *volumeRequest, resp *volumeResponse) error {
+		return d.unmountVolume(req.Name, req.ID)
+	})
+
+	handle("/VolumeDriver.Path", func(req *volumeRequest, resp *volumeResponse) (err error) {
+		resp.Mountpoint, err = d.path(req.Name)
+		return
+	})
+
+	handle("/VolumeDriver.Get", func(req *volumeRequest, resp *volumeResponse) (err error) {
+		dir, err := d.path(req.Name)
+		if err != nil {
+			return
+		}
+
+		resp.Volume = &volumeInfo{Name: req.Name, Mountpoint: dir}
+		return
+	})
+
+	handle("/VolumeDriver.List", func(req *volumeRequest, resp *volumeResponse) error {
+		names, dirs := d.list()
+		resp.Volumes = []volumeInfo{}
+		for i := range names {
+			resp.Volumes = append(resp.Volumes, volumeInfo{names[i], dirs[i]})
+		}
+
+		return nil
+	})
+
+	// Each volume is a mount on this host only.
+	handle("/VolumeDriver.Capabilities", func(req *volumeRequest, resp *volumeResponse) error {
+		resp.Capabilities = &capabilities{Scope: "local"}
+		return nil
+	})
+
+	return mux
+}
+
+func writeResponse(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", pluginContentType)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Printf("Encode: %v", err)
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Options to `docker volume create` that the driver handles itself rather
+// than passing on to gcsfuse as flags.
+const bucketOpt = "bucket"
+
+// Flags that volumes may not set, because the driver relies on gcsfuse
+// daemonizing once the mount is ready.
+var forbiddenOpts = map[string]bool{
+	"foreground": true,
+	"help":       true,
+	"version":    true,
+}
+
+// A volume created with `docker volume create`.
+type volume struct {
+	// The options supplied at creation.
+	Opts map[string]string
+
+	// The mount point of each container using the volume, keyed by the ID
+	// Docker gives to each Mount request. Not persisted.
+	mounts map[string]string
+}
+
+// Implements the operations of Docker's volume plugin API, giving each
+// container that uses a volume its own gcsfuse mount of the volume's bucket.
+//
+// Safe for concurrent access.
+type driver struct {
+	/////////////////////////
+	// Dependencies
+	/////////////////////////
+
+	// Mount the bucket on the directory by running gcsfuse with the supplied
+	// flags, returning once the file system is ready.
+	mount func(bucket string, dir string, flags []string) error
+
+	// Unmount the file system mounted on the directory.
+	unmount func(dir string) error
+
+	/////////////////////////
+	// Constant data
+	/////////////////////////
+
+	// The directory holding mount points and the volume list.
+	root string
+
+	// Flags given to gcsfuse for every volume, before those of the volume.
+	defaultFlags []string
+
+	/////////////////////////
+	// Mutable state
+	/////////////////////////
+
+	mu sync.Mutex
+
+	// The volumes that exist, by name. Mirrored in volumesFile.
+	//
+	// GUARDED_BY(mu)
+	volumes map[string]*volume
+}
+
+// The name of the file within the root directory recording the volumes that
+// exist, so that they survive restarts of the driver.
+const volumesFile = "volumes.json"
+
+// Create a driver keeping its state in the supplied directory, loading any
+// volumes recorded there by an earlier run.
+func newDriver(
+	root string,
+	defaultFlags []string,
+	mount func(bucket string, dir string, flags []string) error,
+	unmount func(dir string) error) (d *driver, err error) {
+	d = &driver{
+		mount:        mount,
+		unmount:      unmount,
+		root:         root,
+		defaultFlags: defaultFlags,
+		volumes:      make(map[string]*volume),
+	}
+
+	err = os.MkdirAll(root, 0700)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(root, volumesFile))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("ReadFile: %v", err)
+		return
+	}
+
+	err = json.Unmarshal(contents, &d.volumes)
+	if err != nil {
+		err = fmt.Errorf("Unmarshal: %v", err)
+		return
+	}
+
+	for _, v := range d.volumes {
+		v.mounts = make(map[string]string)
+	}
+
+	return
+}
+
+// Record the volumes that exist.
+//
+// LOCKS_REQUIRED(d.mu)
+func (d *driver) save() (err error) {
+	contents, err := json.Marshal(d.volumes)
+	if err != nil {
+		err = fmt.Errorf("Marshal: %v", err)
+		return
+	}
+
+	// Write atomically, so that a crash leaves the old list or the new.
+	p := path.Join(d.root, volumesFile)
+	err = ioutil.WriteFile(p+".tmp", contents, 0600)
+	if err != nil {
+		err = fmt.Errorf("WriteFile: %v", err)
+		return
+	}
+
+	err = os.Rename(p+".tmp", p)
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	return
+}
+
+// Turn the options of a volume into the bucket to mount and the gcsfuse
+// flags to mount it with. An option with an empty value becomes a bool flag.
+func volumeFlags(
+	name string,
+	opts map[string]string) (bucket string, flags []string, err error) {
+	bucket = name
+	var names []string
+	for k := range opts {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	for _, k := range names {
+		v := opts[k]
+		k = strings.Replace(strings.TrimLeft(k, "-"), "_", "-", -1)
+
+		switch {
+		case k == bucketOpt:
+			bucket = v
+
+		case k == "" || forbiddenOpts[k]:
+			err = fmt.Errorf("Option %q is not allowed", k)
+			return
+
+		case v == "":
+			flags = append(flags, "--"+k)
+
+		default:
+			flags = append(flags, fmt.Sprintf("--%s=%s", k, v))
+		}
+	}
+
+	if bucket == "" {
+		err = errors.New("The bucket option must not be empty")
+		return
+	}
+
+	return
+}
+
+// Can the volume name or mount ID be used as a directory name within the
+// root without escaping it or clashing with volumesFile?
+func legalName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/\x00") && s[0] != '.' &&
+		s != volumesFile
+}
+
+// Create a volume, checking its options.
+func (d *driver) create(name string, opts map[string]string) (err error) {
+	if !legalName(name) {
+		err = fmt.Errorf("Illegal volume name: %q", name)
+		return
+	}
+
+	_, _, err = volumeFlags(name, opts)
+	if err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.volumes[name]; ok {
+		err = fmt.Errorf("Volume %q already exists", name)
+		return
+	}
+
+	if opts == nil {
+		opts = make(map[string]string)
+	}
+
+	d.volumes[name] = &volume{
+		Opts:   opts,
+		mounts: make(map[string]string),
+	}
+
+	err = d.save()
+	return
+}
+
+// Remove a volume that no container is using.
+func (d *driver) remove(name string) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, ok := d.volumes[name]
+	if !ok {
+		err = fmt.Errorf("No such volume: %q", name)
+		return
+	}
+
+	if len(v.mounts) > 0 {
+		err = fmt.Errorf("Volume %q is in use", name)
+		return
+	}
+
+	delete(d.volumes, name)
+	os.Remove(path.Join(d.root, name))
+
+	err = d.save()
+	return
+}
+
+// Mount the volume for the container whose mount request has the given ID,
+// returning the mount point. Mounting again for the same ID returns the
+// existing mount point.
+func (d *driver) mountVolume(name string, id string) (dir string, err error) {
+	if !legalName(id) {
+		err = fmt.Errorf("Illegal mount ID: %q", id)
+		return
+	}
+
+	// Hold the lock throughout, so that concurrent requests for the same ID
+	// don't both run gcsfuse.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, ok := d.volumes[name]
+	if !ok {
+		err = fmt.Errorf("No such volume: %q", name)
+		return
+	}
+
+	if dir, ok = v.mounts[id]; ok {
+		return
+	}
+
+	bucket, flags, err := volumeFlags(name, v.Opts)
+	if err != nil {
+		return
+	}
+
+	dir = path.Join(d.root, name, id)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		err = fmt.Errorf("MkdirAll: %v", err)
+		return
+	}
+
+	err = d.mount(bucket, dir, append(append([]string{}, d.defaultFlags...), flags...))
+	if err != nil {
+		os.Remove(dir)
+		err = fmt.Errorf("mount: %v", err)
+		return
+	}
+
+	v.mounts[id] = dir
+	return
+}
+
+// Unmount the volume for the container whose mount request had the given ID.
+func (d *driver) unmountVolume(name string, id string) (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, ok := d.volumes[name]
+	if !ok {
+		err = fmt.Errorf("No such volume: %q", name)
+		return
+	}
+
+	dir, ok := v.mounts[id]
+	if !ok {
+		err = fmt.Errorf("Volume %q is not mounted for %q", name, id)
+		return
+	}
+
+	err = d.unmount(dir)
+	if err != nil {
+		err = fmt.Errorf("unmount: %v", err)
+		return
+	}
+
+	delete(v.mounts, id)
+	os.Remove(dir)
+
+	return
+}
+
+// Return a mount point of the volume, or the empty string if no container is
+// using it. When several are, the one for the least ID is returned.
+func (d *driver) path(name string) (dir string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v, ok := d.volumes[name]
+	if !ok {
+		err = fmt.Errorf("No such volume: %q", name)
+		return
+	}
+
+	dir = v.mountPoint()
+	return
+}
+
+// Return the names of the volumes with their mount points, as for path,
+// ordered by name.
+func (d *driver) list() (names []string, dirs []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for name := range d.volumes {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		dirs = append(dirs, d.volumes[name].mountPoint())
+	}
+
+	return
+}
+
+// Unmount everything, for use when shutting down. Errors are returned only
+// for the first failure.
+func (d *driver) unmountAll() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, v := range d.volumes {
+		for id, dir := range v.mounts {
+			unmountErr := d.unmount(dir)
+			if unmountErr != nil {
+				if err == nil {
+					err = fmt.Errorf("unmount %q: %v", dir, unmountErr)
+				}
+
+				continue
+			}
+
+			delete(v.mounts, id)
+			os.Remove(dir)
+		}
+	}
+
+	return
+}
+
+func (v *volume) mountPoint() string {
+	var ids []string
+	for id := range v.mounts {
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return ""
+	}
+
+	sort.Strings(ids)
+	return v.mounts[ids[0]]
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/jacobsa/oglematchers"
+	. "github.com/jacobsa/ogletest"
+)
+
+func TestDriver(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+type mountCall struct {
+	bucket string
+	dir    string
+	flags  []string
+}
+
+// Records calls to mount and unmount, failing them on request.
+type fakeMounter struct {
+	mounts   []mountCall
+	unmounts []string
+	err      error
+}
+
+func (m *fakeMounter) mount(bucket string, dir string, flags []string) error {
+	m.mounts = append(m.mounts, mountCall{bucket, dir, flags})
+	return m.err
+}
+
+func (m *fakeMounter) unmount(dir string) error {
+	m.unmounts = append(m.unmounts, dir)
+	return m.err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type DriverTest struct {
+	root    string
+	mounter fakeMounter
+	d       *driver
+}
+
+var _ SetUpInterface = &DriverTest{}
+var _ TearDownInterface = &DriverTest{}
+
+func init() { RegisterTestSuite(&DriverTest{}) }
+
+func (t *DriverTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.root, err = ioutil.TempDir("", "docker_volume_gcsfuse_test")
+	AssertEq(nil, err)
+
+	t.d = t.newDriver()
+}
+
+func (t *DriverTest) TearDown() {
+	err := os.RemoveAll(t.root)
+	AssertEq(nil, err)
+}
+
+func (t *DriverTest) newDriver() *driver {
+	d, err := newDriver(
+		t.root,
+		[]string{"--uid=1000"},
+		t.mounter.mount,
+		t.mounter.unmount)
+
+	AssertEq(nil, err)
+	return d
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *DriverTest) VolumeFlags() {
+	bucket, flags, err := volumeFlags(
+		"vol",
+		map[string]string{
+			"bucket":         "some-bucket",
+			"implicit_dirs":  "",
+			"--dir-mode":     "755",
+			"stat-cache-ttl": "1m",
+		})
+
+	AssertEq(nil, err)
+	ExpectEq("some-bucket", bucket)
+	ExpectThat(
+		flags,
+		ElementsAre(
+			"--dir-mode=755",
+			"--implicit-dirs",
+			"--stat-cache-ttl=1m",
+		))
+}
+
+func (t *DriverTest) VolumeFlags_BucketDefaultsToName() {
+	bucket, flags, err := volumeFlags("vol", nil)
+
+	AssertEq(nil, err)
+	ExpectEq("vol", bucket)
+	ExpectThat(flags, ElementsAre())
+}
+
+func (t *DriverTest) VolumeFlags_Forbidden() {
+	var err error
+
+	_, _, err = volumeFlags("vol", map[string]string{"foreground": ""})
+	ExpectThat(err, Error(HasSubstr("foreground")))
+
+	_, _, err = volumeFlags("vol", map[string]string{"--": ""})
+	ExpectThat(err, Error(HasSubstr("not allowed")))
+
+	_, _, err = volumeFlags("vol", map[string]string{"bucket": ""})
+	ExpectThat(err, Error(HasSubstr("bucket")))
+}
+
+func (t *DriverTest) Create_IllegalName() {
+	for _, name := range []string{"", ".", "..", "a/b", volumesFile} {
+		err := t.d.create(name, nil)
+		ExpectThat(err, Error(HasSubstr("Illegal")), "name: %q", name)
+	}
+}
+
+func (t *DriverTest) Create_AlreadyExists() {
+	AssertEq(nil, t.d.create("vol", nil))
+
+	err := t.d.create("vol", nil)
+	ExpectThat(err, Error(HasSubstr("already exists")))
+}
+
+func (t *DriverTest) MountAndUnmount() {
+	AssertEq(nil, t.d.create("vol", map[string]string{
+		"bucket":        "some-bucket",
+		"implicit_dirs": "",
+	}))
+
+	// Mount.
+	dir, err := t.d.mountVolume("vol", "taco")
+	AssertEq(nil, err)
+	ExpectEq(path.Join(t.root, "vol", "taco"), dir)
+
+	AssertEq(1, len(t.mounter.mounts))
+	ExpectEq("some-bucket", t.mounter.mounts[0].bucket)
+	ExpectEq(dir, t.mounter.mounts[0].dir)
+	ExpectThat(
+		t.mounter.mounts[0].flags,
+		ElementsAre("--uid=1000", "--implicit-dirs"))
+
+	fi, err := os.Stat(dir)
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+
+	p, err := t.d.path("vol")
+	AssertEq(nil, err)
+	ExpectEq(dir, p)
+
+	// The volume can't be removed while in use.
+	err = t.d.remove("vol")
+	ExpectThat(err, Error(HasSubstr("in use")))
+
+	// Unmount.
+	err = t.d.unmountVolume("vol", "taco")
+	AssertEq(nil, err)
+	ExpectThat(t.mounter.unmounts, ElementsAre(dir))
+
+	_, err = os.Stat(dir)
+	ExpectTrue(os.IsNotExist(err))
+
+	p, err = t.d.path("vol")
+	AssertEq(nil, err)
+	ExpectEq("", p)
+
+	err = t.d.remove("vol")
+	ExpectEq(nil, err)
+}
+
+func (t *DriverTest) Mount_PerContainer() {
+	AssertEq(nil, t.d.create("vol", nil))
+
+	dir0, err := t.d.mountVolume("vol", "burrito")
+	AssertEq(nil, err)
+
+	dir1, err := t.d.mountVolume("vol", "enchilada")
+	AssertEq(nil, err)
+
+	ExpectNe(dir0, dir1)
+	ExpectEq(2, len(t.mounter.mounts))
+
+	// Mounting again for the same ID doesn't run gcsfuse again.
+	dir, err := t.d.mountVolume("vol", "burrito")
+	AssertEq(nil, err)
+	ExpectEq(dir0, dir)
+	ExpectEq(2, len(t.mounter.mounts))
+
+	// Unmounting one leaves the other.
+	AssertEq(nil, t.d.unmountVolume("vol", "burrito"))
+
+	p, err := t.d.path("vol")
+	AssertEq(nil, err)
+	ExpectEq(dir1, p)
+}
+
+func (t *DriverTest) Mount_Fails() {
+	AssertEq(nil, t.d.create("vol", nil))
+	t.mounter.err = errors.New("taco")
+
+	_, err := t.d.mountVolume("vol", "burrito")
+	ExpectThat(err, Error(HasSubstr("taco")))
+
+	_, err = os.Stat(path.Join(t.root, "vol", "burrito"))
+	ExpectTrue(os.IsNotExist(err))
+
+	p, err := t.d.path("vol")
+	AssertEq(nil, err)
+	ExpectEq("", p)
+}
+
+func (t *DriverTest) Mount_IllegalID() {
+	AssertEq(nil, t.d.create("vol", nil))
+
+	_, err := t.d.mountVolume("vol", "../../etc")
+	ExpectThat(err, Error(HasSubstr("Illegal")))
+	ExpectEq(0, len(t.mounter.mounts))
+}
+
+func (t *DriverTest) Mount_NoSuchVolume() {
+	_, err := t.d.mountVolume("vol", "burrito")
+	ExpectThat(err, Error(HasSubstr("No such volume")))
+}
+
+func (t *DriverTest) VolumesSurviveRestart() {
+	AssertEq(nil, t.d.create("foo", map[string]string{"bucket": "some-bucket"}))
+	AssertEq(nil, t.d.create("bar", nil))
+	AssertEq(nil, t.d.remove("bar"))
+
+	d := t.newDriver()
+	names, _ := d.list()
+	ExpectThat(names, ElementsAre("foo"))
+
+	_, err := d.mountVolume("foo", "burrito")
+	AssertEq(nil, err)
+	ExpectEq("some-bucket", t.mounter.mounts[0].bucket)
+}
+
+func (t *DriverTest) List() {
+	AssertEq(nil, t.d.create("foo", nil))
+	AssertEq(nil, t.d.create("bar", nil))
+
+	dir, err := t.d.mountVolume("foo", "burrito")
+	AssertEq(nil, err)
+
+	names, dirs := t.d.list()
+	ExpectThat(names, ElementsAre("bar", "foo"))
+	ExpectThat(dirs, ElementsAre("", dir))
+}
+
+func (t *DriverTest) UnmountAll() {
+	AssertEq(nil, t.d.create("foo", nil))
+	AssertEq(nil, t.d.create("bar", nil))
+
+	_, err := t.d.mountVolume("foo", "burrito")
+	AssertEq(nil, err)
+
+	_, err = t.d.mountVolume("bar", "enchilada")
+	AssertEq(nil, err)
+
+	err = t.d.unmountAll()
+	AssertEq(nil, err)
+	ExpectEq(2, len(t.mounter.unmounts))
+
+	_, dirs := t.d.list()
+	ExpectThat(dirs, ElementsAre("", ""))
+}
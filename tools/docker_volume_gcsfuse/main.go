@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A daemon implementing Docker's volume plugin API, so that buckets can be
+// used as Docker volumes:
+//
+//     docker volume create -d gcsfuse -o bucket=my-bucket -o implicit_dirs vol
+//     docker run -v vol:/data ...
+//
+// Usage:
+//
+//     docker_volume_gcsfuse [--socket path] [--root dir] [-- gcsfuse flags...]
+//
+// Each container using a volume gets its own gcsfuse mount of the volume's
+// bucket, made when the container starts and unmounted when it stops. The
+// options given to `docker volume create` other than "bucket" become gcsfuse
+// flags for the volume, appended to those on this program's command line.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+)
+
+var fSocket = flag.String(
+	"socket",
+	"/run/docker/plugins/gcsfuse.sock",
+	"Unix socket on which to serve the plugin API. Its base name, less the "+
+		"extension, is the driver name given to docker.")
+
+var fRoot = flag.String(
+	"root",
+	"/var/lib/docker-gcsfuse",
+	"Directory holding mount points and the list of volumes.")
+
+var fGcsfuse = flag.String(
+	"gcsfuse",
+	"",
+	"Path to the gcsfuse binary. Found in the usual locations by default.")
+
+// Find the path to the gcsfuse program.
+func findGcsfuse() (p string, err error) {
+	// Docker runs plugins with a minimal environment, so as for mount_gcsfuse
+	// search a hard-coded list of candidates as well as $PATH.
+	candidates := []string{
+		"gcsfuse",
+		"/usr/bin/gcsfuse",
+		"/usr/local/bin/gcsfuse",
+	}
+
+	for _, c := range candidates {
+		_, err = exec.LookPath(c)
+		if err == nil {
+			p = c
+			return
+		}
+	}
+
+	err = errors.New("Can't find a usable executable.")
+	return
+}
+
+// Return a function that mounts buckets by running gcsfuse, which returns
+// only once the file system is ready or mounting has failed.
+func gcsfuseMounter(
+	gcsfusePath string) func(bucket string, dir string, flags []string) error {
+	return func(bucket string, dir string, flags []string) (err error) {
+		args := append(append([]string{}, flags...), bucket, dir)
+		cmd := exec.Command(gcsfusePath, args...)
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%v\nOutput:\n%s", err, output)
+			return
+		}
+
+		return
+	}
+}
+
+func run() (err error) {
+	flag.Parse()
+
+	// Find gcsfuse.
+	gcsfusePath := *fGcsfuse
+	if gcsfusePath == "" {
+		gcsfusePath, err = findGcsfuse()
+		if err != nil {
+			err = fmt.Errorf("findGcsfuse: %v", err)
+			return
+		}
+	}
+
+	// Set up the driver.
+	d, err := newDriver(
+		*fRoot,
+		flag.Args(),
+		gcsfuseMounter(gcsfusePath),
+		fuse.Unmount)
+
+	if err != nil {
+		err = fmt.Errorf("newDriver: %v", err)
+		return
+	}
+
+	// Listen, replacing any socket left behind by an earlier run.
+	err = os.Remove(*fSocket)
+	if err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("Remove: %v", err)
+		return
+	}
+
+	l, err := net.Listen("unix", *fSocket)
+	if err != nil {
+		err = fmt.Errorf("Listen: %v", err)
+		return
+	}
+
+	// Unmount everything when asked to stop, so that no gcsfuse processes are
+	// left serving mount points that docker has forgotten about.
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signalChan
+		log.Println("Received signal; unmounting volumes.")
+
+		if err := d.unmountAll(); err != nil {
+			log.Fatalf("unmountAll: %v", err)
+		}
+
+		os.Exit(0)
+	}()
+
+	log.Printf("Serving on %s", *fSocket)
+	err = http.Serve(l, newHandler(d))
+	if err != nil {
+		err = fmt.Errorf("Serve: %v", err)
+		return
+	}
+
+	return
+}
+
+func main() {
+	err := run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
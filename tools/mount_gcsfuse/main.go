@@ -80,14 +80,19 @@ func makeGcsfuseArgs(
 		case "user", "nouser", "auto", "noauto", "_netdev", "no_netdev":
 
 		// Special case: support mount-like formatting for gcsfuse bool flags.
-		case "implicit_dirs":
+		case "implicit_dirs",
+			"disable_apple_noise",
+			"nfs_export",
+			"disable_locking",
+			"case_insensitive",
+			"hide_denied_dirs":
 			args = append(
 				args,
 				"--"+strings.Replace(name, "_", "-", -1),
 			)
 
 			// Special case: support mount-like formatting for gcsfuse string flags.
-		case "dir_mode", "file_mode", "key_file", "temp_dir", "gid", "uid", "only_dir", "limit_ops_per_sec", "limit_bytes_per_sec", "stat_cache_ttl", "type_cache_ttl":
+		case "dir_mode", "file_mode", "key_file", "ca_cert", "encryption_key_file", "temp_dir", "gid", "uid", "only_dir", "limit_ops_per_sec", "limit_bytes_per_sec", "stat_cache_ttl", "type_cache_ttl", "unmount_after_idle", "notification_subscription":
 			args = append(
 				args,
 				"--"+strings.Replace(name, "_", "-", -1),